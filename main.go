@@ -23,7 +23,6 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
-	"runtime"
 	"syscall"
 
 	"github.com/mitchellh/go-homedir"
@@ -45,9 +44,31 @@ func expandPath(p string) string {
 	return p
 }
 
+// printPreflightError prints each problem on its own line
+func printPreflightError(err error) {
+	pfe, ok := err.(*core.PreflightError)
+	if !ok {
+		log.Printf("error checking configuration, %s", err.Error())
+		return
+	}
+	log.Printf("configuration has %d problem(s)", len(pfe.Problems))
+	for _, problem := range pfe.Problems {
+		log.Printf("  %s", problem)
+	}
+}
+
 func main() {
 	var server *core.AccountServer
 	var err error
+	var reEncrypt bool
+	var migrateShards bool
+	var checkConfig bool
+	var skipPreflight bool
+
+	// the store commands work on the store directly and exit, without starting the server
+	if len(os.Args) > 1 && os.Args[1] == "store" {
+		os.Exit(core.RunStoreCommand(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+	}
 
 	flags := core.Flags{}
 	flag.StringVar(&flags.ConfigFile, "c", "", "configuration filepath, other flags take precedent over the config file")
@@ -55,12 +76,16 @@ func main() {
 	flag.StringVar(&flags.Directory, "dir", "", "the directory to store/host accounts with, mututally exclusive from nsc")
 	flag.StringVar(&flags.NATSURL, "nats", "", "the NATS server to use for notifications, the default is no notifications")
 	flag.StringVar(&flags.Creds, "creds", "", "the creds file for connecting to NATS")
-	flag.StringVar(&flags.Primary, "primary", "", "the URL for the primary server, in the form http(s)://host:port/")
+	flag.StringVar(&flags.Primary, "primary", "", "the URL for the primary server, in the form http(s)://host:port/, or a comma separated list tried in order")
 	flag.BoolVar(&flags.Debug, "D", false, "turn on debug logging")
 	flag.BoolVar(&flags.Verbose, "V", false, "turn on verbose logging")
 	flag.BoolVar(&flags.DebugAndVerbose, "DV", false, "turn on debug and verbose logging")
 	flag.StringVar(&flags.HostPort, "hp", "", "http hostport, defaults to localhost:9090")
 	flag.BoolVar(&flags.ReadOnly, "ro", false, "exclusive to -dir flag, makes the server run in read-only mode, file changes will trigger nats updates (if configured)")
+	flag.BoolVar(&reEncrypt, "reencrypt", false, "encrypt the JWTs in the store directory with the configured key and exit, the server should not be running")
+	flag.BoolVar(&migrateShards, "migrateshards", false, "move the JWTs in the store directory to match the configured shard settings and exit, the server should not be running")
+	flag.BoolVar(&checkConfig, "check-config", false, "check the NATS, TLS, store and primary settings and exit, problems are printed and the exit code is 1")
+	flag.BoolVar(&skipPreflight, "skip-preflight", false, "start without checking the NATS, TLS, store and primary settings first")
 	flag.Parse()
 
 	// resolve paths with dots/tildes
@@ -71,7 +96,7 @@ func main() {
 
 	go func() {
 		sigChan := make(chan os.Signal, 1)
-		signal.Notify(sigChan, os.Interrupt, syscall.SIGHUP)
+		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 
 		for {
 			signal := <-sigChan
@@ -85,34 +110,18 @@ func main() {
 				os.Exit(0)
 			}
 
-			if signal == syscall.SIGHUP {
+			if signal == syscall.SIGTERM {
 				if server.Logger() != nil {
-					server.Logger().Errorf("received sig-hup, restarting")
+					server.Logger().Noticef("received sig-term, shutting down")
 				}
 				server.Stop()
-				server := core.NewAccountServer()
-				err = server.InitializeFromFlags(flags)
-
-				if err != nil {
-					if server.Logger() != nil {
-						server.Logger().Errorf("error starting server, %s", err.Error())
-					} else {
-						log.Printf("error starting server, %s", err.Error())
-					}
-					server.Stop()
-					os.Exit(0)
-				}
-
-				err = server.Start()
+				os.Exit(0)
+			}
 
-				if err != nil {
-					if server.Logger() != nil {
-						server.Logger().Errorf("error starting server, %s", err.Error())
-					} else {
-						log.Printf("error starting server, %s", err.Error())
-					}
-					server.Stop()
-					os.Exit(0)
+			if signal == syscall.SIGHUP {
+				server.Logger().Noticef("received sig-hup, reloading configuration")
+				if err := server.Reload(); err != nil {
+					server.Logger().Errorf("error reloading configuration, keeping the current settings, %s", err.Error())
 				}
 			}
 		}
@@ -131,6 +140,43 @@ func main() {
 		os.Exit(0)
 	}
 
+	if reEncrypt {
+		count, err := server.ReEncryptStore()
+		if err != nil {
+			log.Printf("error re-encrypting store, %s", err.Error())
+			os.Exit(1)
+		}
+		log.Printf("re-encrypted %d JWTs", count)
+		os.Exit(0)
+	}
+
+	if migrateShards {
+		count, err := server.MigrateStoreShards()
+		if err != nil {
+			log.Printf("error migrating store shards, %s", err.Error())
+			os.Exit(1)
+		}
+		log.Printf("moved %d JWTs", count)
+		os.Exit(0)
+	}
+
+	if checkConfig {
+		if err := server.Preflight(); err != nil {
+			printPreflightError(err)
+			os.Exit(1)
+		}
+		log.Printf("configuration is valid")
+		os.Exit(0)
+	}
+
+	if !skipPreflight {
+		if err := server.Preflight(); err != nil {
+			printPreflightError(err)
+			server.Stop()
+			os.Exit(1)
+		}
+	}
+
 	err = server.Start()
 
 	if err != nil {
@@ -143,6 +189,10 @@ func main() {
 		os.Exit(0)
 	}
 
-	// exit main but keep running goroutines
-	runtime.Goexit()
+	// the signal handler exits on its own, this only returns if the server stopped itself
+	<-server.Done()
+	if err := server.Err(); err != nil {
+		server.Logger().Errorf("account server stopped, %s", err.Error())
+		os.Exit(-1)
+	}
 }
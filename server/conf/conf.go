@@ -29,9 +29,179 @@ type AccountServerConfig struct {
 
 	OperatorJWTPath      string
 	SystemAccountJWTPath string
+	TrustedOperatorKeys  []string         // trusted along with the keys in the operator JWT
+	Operators            []OperatorConfig // more operators hosted by the server, each in its own namespace
 
-	Primary            string
-	ReplicationTimeout int //milliseconds
+	Primary            []string // primary URLs for a replica, tried in order
+	ReplicationTimeout int      //milliseconds, the deadline for each request to a primary, including reading the body
+	ReplicationMaxIdle int      // idle connections kept open to each primary
+	ReplicaCacheTTL    int      //seconds, 0 means replicated JWTs never go stale
+	ReplicaServeStale  bool     // serve stale JWTs, and refresh them in the background, when the primary is down
+	ReplicaMaxStale    int      //seconds a JWT can be past its stale time and still be served, 0 means no limit
+	ReplicaAuth        ReplicaAuthConfig
+	ReplicaRefresh     ReplicaRefreshConfig
+	Gossip             GossipConfig
+	LookupCounts       LookupCountsConfig
+	NegativeCache      NegativeCacheConfig
+	Relay              RelayConfig
+	Mirror             MirrorConfig
+
+	AccountCacheTTL    int //seconds clients can cache account JWTs, 0 sends no-cache
+	ActivationCacheTTL int //seconds clients can cache activation JWTs, 0 sends no-cache
+	OperatorCacheTTL   int //seconds clients can cache the operator JWT, 0 sends no-cache
+
+	ClockSkew    int  //seconds allowed either way when checking expiration and not before
+	AllowExpired bool // accept expired and not yet valid JWTs, for test environments
+
+	StrictActivations    bool // activations must be signed by their issuer account, or one of its signing keys
+	AcceptUnknownIssuers bool // with StrictActivations, activations from accounts that aren't stored are logged and saved
+
+	AuditLogPath string // account JWT changes are appended to this file, empty turns auditing off
+
+	EnableUserJWTs bool // store and serve user JWTs at /jwt/v1/users, they are never sent over NATS
+
+	MaxJWTSize int // bytes, larger uploads are rejected and larger notifications dropped, 0 means no limit
+
+	Policies PolicyConfig
+
+	LegacyJWTs LegacyJWTsConfig
+
+	GC GCConfig
+
+	ExpiryWarnings ExpiryWarningsConfig
+
+	Bootstrap BootstrapConfig
+
+	Webhooks WebhooksConfig
+
+	Debug DebugConfig
+}
+
+// PolicyConfig turns on the built-in organization policies account JWTs are checked against,
+// uploads that fail are rejected
+type PolicyConfig struct {
+	RequireMaxConnections bool     // accounts must set limits.conn
+	ForbiddenExports      []string // accounts can't export these subjects, or subjects that overlap them
+	MaxSigningKeys        int      // 0 means no limit
+	Strict                bool     // drop notified JWTs that fail, instead of saving them and flagging them in the status
+}
+
+// OperatorConfig is an operator whose accounts the server hosts along with those of the main
+// operator. Account JWTs it signs are saved in its namespace, a subdirectory of a directory store.
+type OperatorConfig struct {
+	Name        string   // the namespace, letters, digits, '-' and '_', at least 3 long
+	JWTPath     string   // the operator JWT, its identity and signing keys are trusted
+	TrustedKeys []string // more keys that sign accounts for this operator
+}
+
+// LegacyJWTsConfig finds stored JWTs that newer nats-servers reject, those signed with the
+// deprecated ed25519 algorithm or in the v1 claim format. They are served unless Strict is set.
+type LegacyJWTsConfig struct {
+	ScanOnStart bool // check every JWT in the store at startup, logging the legacy ones
+	Strict      bool // lookups for a legacy JWT get a 404, as if it wasn't stored
+}
+
+// DebugConfig serves pprof and the cache details on their own listener, which should only be
+// reachable from the machine the server runs on
+type DebugConfig struct {
+	Host string // defaults to localhost
+	Port int    // 0 turns the debug endpoints off
+}
+
+// WebhooksConfig posts account JWT changes to HTTP endpoints, each endpoint has its own queue so
+// a slow one doesn't hold up the others
+type WebhooksConfig struct {
+	Endpoints []WebhookConfig
+	QueueSize int //changes waiting for each endpoint, new ones are dropped when it is full
+	Attempts  int //tries for each change before it is dropped
+	Timeout   int //milliseconds for each try
+}
+
+// WebhookConfig is an endpoint that is sent account JWT changes
+type WebhookConfig struct {
+	URL        string
+	Accounts   []string // account public keys sent to this endpoint, empty sends every account
+	Secret     string   // bodies are signed with an HMAC-SHA256 using this secret
+	SecretFile string   // file holding the secret, mutually exclusive with Secret
+}
+
+// RelayConfig runs the server without a store of its own, lookups are requested over NATS from
+// an upstream account server, for clusters that are only reachable through leaf nodes
+type RelayConfig struct {
+	UpstreamSubjectPrefix string // the upstream's NATS.RelaySubjectPrefix, empty turns relay mode off
+	Timeout               int    //milliseconds to wait for the upstream to answer a lookup
+}
+
+// MirrorConfig follows another account server's notifications over a second NATS connection,
+// the JWTs are saved and sent again on the server's own NATS connection. Only the servers,
+// credentials, TLS, connect and reconnect settings, name and subject prefix of NATS are used.
+type MirrorConfig struct {
+	NATS NATSConfig // the other server's NATS, and its SubjectPrefix, no Servers turns mirroring off
+}
+
+// LookupCountsConfig controls the lookup counts kept for each account
+type LookupCountsConfig struct {
+	MaxAccounts     int //accounts counted between resets, others are ignored once it is full
+	Reset           int //seconds between resets of the counts, 0 never resets
+	Top             int //accounts listed on the status endpoint, 0 leaves them out
+	MetricThreshold int //lookups an account needs for its own metric label, 0 turns the labels off
+}
+
+// NegativeCacheConfig controls how long an account that wasn't found is remembered, lookups
+// for it in that time don't go to the store or the primary. Saving the account forgets it.
+type NegativeCacheConfig struct {
+	TTL        int //seconds, 0 turns the cache off
+	MaxEntries int //missing accounts remembered, the oldest are dropped first
+}
+
+// GCConfig controls the removal of expired JWTs from the store, account JWTs are only
+// removed if Accounts is set
+type GCConfig struct {
+	Interval        int  //seconds between collections, 0 turns collection off
+	ActivationGrace int  //seconds an activation is kept after it expires
+	Accounts        bool // also remove expired account JWTs
+	AccountGrace    int  //seconds an account JWT is kept after it expires
+	TombstoneGrace  int  //seconds the tombstone of a deleted account is kept
+}
+
+// BootstrapConfig controls the nats-server resolver configuration served at /jwt/v1/bootstrap
+type BootstrapConfig struct {
+	ResolverURL string // the URL nats-servers reach this server at, defaults to the HTTP listener
+	Path        string // the configuration is also written to this file, and rewritten when the operator JWT changes
+}
+
+// ExpiryWarningsConfig logs a warning for each account JWT that has expired, or will within
+// the window, every Interval
+type ExpiryWarningsConfig struct {
+	Interval int //seconds between checks, 0 turns the warnings off
+	Within   int //seconds, accounts expiring this far ahead are logged
+}
+
+// ReplicaAuthConfig has replicas sign their requests to the primary with an nkey, so the primary
+// can limit the account listing and packs to known replicas
+type ReplicaAuthConfig struct {
+	SeedFile    string   // replicas sign requests with the user nkey seed in this file
+	AllowedKeys []string // primaries only list accounts and serve packs to requests signed by one of these keys
+}
+
+// ReplicaRefreshConfig has a replica fetch the JWTs it serves most often from the primary before
+// they go stale, so lookups don't wait on the primary
+type ReplicaRefreshConfig struct {
+	Hottest     int //JWTs refreshed each pass, the most requested first, 0 turns the refresher off
+	Interval    int //seconds between passes
+	Window      int //percent of the cache TTL before a JWT goes stale that it can be refreshed
+	Concurrency int //fetches from the primary at once
+	Rate        int //fetches a second, 0 means no limit
+	HitsReset   int //seconds between resets of the request counts
+}
+
+// GossipConfig has replicas publish the accounts they saved recently, so replicas that missed
+// a notification fetch the new JWT before it goes stale
+type GossipConfig struct {
+	Subject    string // digests are published here, empty turns gossip off
+	Interval   int    //seconds between digests
+	Window     int    //seconds, accounts saved longer ago are left out
+	MaxEntries int    //accounts in each digest, the most recently saved first
 }
 
 // TLSConf holds the configuration for a TLS connection/server
@@ -41,13 +211,58 @@ type TLSConf struct {
 	Root string
 }
 
+// ClientCertConfig holds the settings for TLS client certificates on the HTTP server
+type ClientCertConfig struct {
+	CA               string   // bundle used to verify client certificates
+	RequireForWrites bool     // POST and DELETE requests need a verified client certificate
+	Allowed          []string // patterns for the certificate subject, common name or SANs, any match is enough
+}
+
+// RateLimitConfig is a token bucket for each client IP, a zero rate turns the limit off
+type RateLimitConfig struct {
+	Rate  float64 // requests per second
+	Burst int     // requests that can be made at once, defaults to the rate
+}
+
+// RateLimitsConfig limits the requests from each client IP, reads and writes use separate buckets
+type RateLimitsConfig struct {
+	Reads      RateLimitConfig
+	Writes     RateLimitConfig
+	MaxClients int      // client IPs tracked, the least recently seen are forgotten
+	Exempt     []string // IPs and CIDR blocks that are never limited
+}
+
 // HTTPConfig is used to specify the host/port/tls for an HTTP server
 type HTTPConfig struct {
-	Host         string
-	Port         int
-	TLS          TLSConf
-	ReadTimeout  int //milliseconds
-	WriteTimeout int //milliseconds
+	Host            string
+	Port            int
+	TLS             TLSConf
+	ClientCerts     ClientCertConfig
+	WriteTokens     []string // bearer tokens accepted for POST and DELETE requests
+	WriteTokenFile  string   // file with more tokens, one per line
+	WriteAllowList  []string // IPs and CIDR blocks POST and DELETE requests are allowed from, empty allows all
+	WriteDenyList   []string // IPs and CIDR blocks POST and DELETE requests are refused from
+	TrustedProxies  []string // IPs and CIDR blocks of proxies whose X-Forwarded-For header is used
+	ReadTimeout     int      //milliseconds
+	WriteTimeout    int      //milliseconds, applied to each write for streamed packs
+	IdleTimeout     int      //milliseconds a keep-alive connection waits for the next request
+	ShutdownTimeout int      //milliseconds requests in flight are given to finish when the server stops
+	RateLimits      RateLimitsConfig
+
+	AccessLog            bool // log every request with its status, size and latency
+	SlowRequestThreshold int  //milliseconds, slower requests are logged as warnings, 0 turns it off
+
+	Access    string           // "full", the default, or "read" to leave out the POST, DELETE and admin endpoints
+	Listeners []ListenerConfig // more addresses serving the same handlers and store
+}
+
+// ListenerConfig is another address for the HTTP server, with its own TLS and access. TLS listeners
+// use the client certificate settings from the HTTP configuration.
+type ListenerConfig struct {
+	Host   string
+	Port   int
+	TLS    TLSConf
+	Access string // "full", the default, or "read"
 }
 
 // NATSConfig configuration for a NATS connection
@@ -55,23 +270,160 @@ type NATSConfig struct {
 	Servers []string
 
 	ConnectTimeout int //milliseconds
-	ReconnectWait  int //milliseconds
+	ReconnectWait  int //milliseconds, the first wait between attempts to connect
 	MaxReconnects  int
+	ExitOnClose    bool // stop the server when the connection closes, instead of trying to connect again
+	DrainTimeout   int  //milliseconds, how long Stop waits for subscriptions to drain
+
+	MaxReconnectWait int //milliseconds, the wait between attempts to connect doubles up to this
+
+	NotificationQueueSize int // account notifications kept while NATS is unavailable, 0 disables the queue
+	NotifyRate            int // notifications a second sent by POST /jwt/v1/notify, 0 sends them as fast as possible
 
 	TLS             TLSConf
 	UserCredentials string
+	NKeySeedFile    string // path to a user nkey seed, mutually exclusive with UserCredentials
+
+	Username string
+	Password string
+	Token    string // mutually exclusive with Username/Password
+
+	LookupSubject string // subject for claims lookup requests, the * is replaced with the account public key
+	PackSubject   string // subject for full resolver pack requests, empty disables them
+	PackRate      int    // pack messages a second sent for each pack request, 0 sends them as fast as possible
+	SubjectPrefix string // prefix for notification subjects, defaults to $SYS.ACCOUNT
+	QueueGroup    string // queue group for request subjects, defaults to one named for the primary
+
+	RelaySubjectPrefix string // lookups from relays are answered under this prefix, empty doesn't answer them
+
+	Name        string // connection name shown by the nats-server, defaults to nats-account-server <version> <host>
+	InboxPrefix string // prefix for reply inboxes, defaults to _INBOX
+
+	JetStream JetStreamConfig
+}
+
+// JetStreamConfig keeps notifications in a JetStream stream, so servers that were offline
+// when they were sent can replay them
+type JetStreamConfig struct {
+	Stream    string // stream for notifications, created if it is missing, empty publishes with core NATS only
+	Retention string // limits or interest, defaults to limits
+	Storage   string // file or memory, defaults to file
+	Replicas  int
+
+	MaxAge            int // seconds, 0 keeps notifications until another limit is reached
+	MaxMsgs           int // 0 for no limit
+	MaxBytes          int // 0 for no limit
+	MaxMsgsPerSubject int // notifications kept for each subject, 0 for no limit, needs nats-server 2.3
+
+	Consumer string // durable consumer replicas read notifications from instead of subscribing, one for each replica
+}
+
+const redacted = "[REDACTED]"
+
+// Redacted returns a copy of the NATS configuration with secrets removed, safe
+// to print or log
+func (config NATSConfig) Redacted() NATSConfig {
+	if config.Password != "" {
+		config.Password = redacted
+	}
+	if config.Token != "" {
+		config.Token = redacted
+	}
+	return config
 }
 
 // StoreConfig is a catch-all for the store options, the store created
 // depends on the contents of the config:
 // if NSC is set the read-only NSC store is used
 // if Dir is set a folder store is used, mutability is based on ReadOnly
+// if S3.Bucket is set an S3 bucket is used, mutability is based on ReadOnly
+// if Postgres.DSN is set a Postgres table is used, mutability is based on ReadOnly
+// if Redis.Address is set a Redis server is used, mutability is based on ReadOnly
 // otherwise a memory store is used, mutability is based on ReadOnly (which means the r/o store will be stuck empty)
 type StoreConfig struct {
-	NSC      string // an nsc operator folder
-	Dir      string // the path to a folder for mutable storage
-	Shard    bool   // optional setting to shard the directory store, avoiding too many files in one folder
-	ReadOnly bool   // flag to indicate read-only status
+	NSC        string // an nsc operator folder
+	Dir        string // the path to a folder for mutable storage
+	Shard      bool   // optional setting to shard the directory store, avoiding too many files in one folder
+	ShardDepth int    // levels of single character directories for the directory store, instead of Shard
+	ReadOnly   bool   // flag to indicate read-only status
+
+	SkipNotifications bool // changes found by watching a read-only directory, or NSC, store aren't sent to NATS
+
+	VerifyOnStart bool // decode every JWT in the store at startup and report the corrupt ones
+	Repair        bool // with VerifyOnStart, move corrupt JWTs aside, only directory stores support it
+	MaxCorrupt    int  // with VerifyOnStart, the server won't start with more corrupt JWTs than this, 0 means no limit
+
+	History int // the number of replaced account JWTs kept by directory and memory stores, 0 keeps none
+
+	// saves that would take the store over a limit are rejected, 0 means no limit
+	MaxEntries int   // the number of JWTs, including tombstones
+	MaxBytes   int64 // the total size of the JWTs and their keys
+
+	S3       S3Config
+	Postgres PostgresConfig
+	Redis    RedisConfig
+	Etcd     EtcdConfig
+	Memory   MemoryConfig
+
+	Encryption EncryptionConfig // encrypts the JWTs in a directory store
+}
+
+// EncryptionConfig holds a 32 byte key, hex or base64 encoded, in a file or an environment variable
+type EncryptionConfig struct {
+	KeyFile string
+	KeyEnv  string // the name of the environment variable
+}
+
+// S3Config selects a bucket in S3, or an S3 compatible service, for storage.
+// Credentials and region fall back to the standard AWS environment variables.
+type S3Config struct {
+	Bucket       string
+	Prefix       string // prepended to every object key
+	Region       string
+	Endpoint     string // defaults to AWS, set for S3 compatible services, e.g. http://localhost:9000
+	PathStyle    bool   // put the bucket in the path instead of the host name
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+}
+
+// PostgresConfig selects a Postgres database for storage, the table is created at startup
+// if it doesn't exist
+type PostgresConfig struct {
+	DSN             string // a lib/pq connection string or URL
+	Table           string // defaults to jwts
+	MaxOpenConns    int    // 0 means unlimited
+	MaxIdleConns    int    // 0 uses the database/sql default
+	ConnMaxLifetime int    //seconds, 0 means connections are reused forever
+}
+
+// MemoryConfig limits the size of a mutable memory store, 0 means no limit
+type MemoryConfig struct {
+	MaxEntries int   // the number of JWTs kept
+	MaxBytes   int64 // the total size of the JWTs and their keys
+	MinAge     int   //seconds, JWTs saved more recently than this aren't evicted
+}
+
+// RedisConfig selects a Redis server for storage, each JWT is a string key under the prefix
+type RedisConfig struct {
+	Address  string // host:port
+	Password string
+	DB       int
+	Prefix   string // prepended to every key, defaults to jwt:
+	TTL      int    //seconds, 0 means keys don't expire
+	Channel  string // saves and deletes are published here, and read by other servers, when set
+	UseTLS   bool   // connect with TLS, implied by TLS.Root or TLS.Cert
+	TLS      TLSConf
+}
+
+// EtcdConfig selects an etcd cluster for storage, through its v3 JSON gateway. Servers sharing
+// the cluster watch the prefix, so a JWT saved by one is picked up by the others.
+type EtcdConfig struct {
+	Endpoints []string // http or https URLs for the cluster members, tried in order
+	Prefix    string   // prepended to every key, defaults to /nats-account-server/jwt/
+	Username  string
+	Password  string
+	TLS       TLSConf
 }
 
 // DefaultServerConfig generates a default configuration with
@@ -85,17 +437,93 @@ func DefaultServerConfig() *AccountServerConfig {
 			Trace:  false,
 		},
 		HTTP: HTTPConfig{
-			ReadTimeout:  5000,
-			WriteTimeout: 5000,
-			Host:         "localhost",
-			Port:         9090,
+			ReadTimeout:     5000,
+			WriteTimeout:    10000,
+			IdleTimeout:     60000,
+			ShutdownTimeout: 10000,
+			Host:            "localhost",
+			Port:            9090,
+			RateLimits: RateLimitsConfig{
+				MaxClients: 10000,
+				Exempt:     []string{"127.0.0.0/8", "::1"},
+			},
 		},
 		NATS: NATSConfig{
 			ConnectTimeout: 5000,
 			ReconnectWait:  1000,
 			MaxReconnects:  -1,
+			DrainTimeout:   5000,
+			LookupSubject:  "$SYS.REQ.ACCOUNT.*.CLAIMS.LOOKUP",
+
+			MaxReconnectWait: 30000,
+
+			NotificationQueueSize: 1000,
+			NotifyRate:            200,
+			PackRate:              1000,
+
+			JetStream: JetStreamConfig{
+				Retention: "limits",
+				Storage:   "file",
+				MaxAge:    7 * 24 * 60 * 60,
+			},
 		},
 		Store:              StoreConfig{}, // in memory store
-		ReplicationTimeout: 5000,
+		ReplicationTimeout: 3000,
+		ReplicationMaxIdle: 2,
+		ReplicaCacheTTL:    60 * 60,
+		AccountCacheTTL:    60 * 60,
+		ActivationCacheTTL: 60 * 60,
+		ReplicaRefresh: ReplicaRefreshConfig{
+			Interval:    10,
+			Window:      10,
+			Concurrency: 4,
+			Rate:        50,
+			HitsReset:   5 * 60,
+		},
+		Gossip: GossipConfig{
+			Interval:   30,
+			Window:     60 * 60,
+			MaxEntries: 1000,
+		},
+		LookupCounts: LookupCountsConfig{
+			MaxAccounts: 10000,
+			Reset:       60 * 60,
+			Top:         10,
+		},
+		NegativeCache: NegativeCacheConfig{
+			TTL:        10,
+			MaxEntries: 10000,
+		},
+		Relay: RelayConfig{
+			Timeout: 2000,
+		},
+		Mirror: MirrorConfig{
+			NATS: NATSConfig{
+				ConnectTimeout:   5000,
+				ReconnectWait:    1000,
+				MaxReconnects:    -1,
+				MaxReconnectWait: 30000,
+			},
+		},
+		ClockSkew:  30,
+		MaxJWTSize: 256 * 1024,
+		GC: GCConfig{
+			Interval:        24 * 60 * 60,
+			ActivationGrace: 24 * 60 * 60,
+			AccountGrace:    30 * 24 * 60 * 60,
+			TombstoneGrace:  30 * 24 * 60 * 60,
+		},
+		ExpiryWarnings: ExpiryWarningsConfig{
+			Interval: 24 * 60 * 60,
+			Within:   30 * 24 * 60 * 60,
+		},
+		Webhooks: WebhooksConfig{
+			QueueSize: 1000,
+			Attempts:  3,
+			Timeout:   5000,
+		},
+		Debug: DebugConfig{
+			Host: "localhost",
+		},
 	}
 }
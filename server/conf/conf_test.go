@@ -17,6 +17,7 @@
 package conf
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -27,5 +28,27 @@ func TestDefaultConfig(t *testing.T) {
 	require.Equal(t, false, config.Logging.Trace)
 	require.Equal(t, 5000, config.HTTP.ReadTimeout)
 	require.Equal(t, 5000, config.NATS.ConnectTimeout)
-	require.Equal(t, 5000, config.ReplicationTimeout)
+	require.Equal(t, 10000, config.HTTP.WriteTimeout)
+	require.Equal(t, 60000, config.HTTP.IdleTimeout)
+	require.Equal(t, 3000, config.ReplicationTimeout)
+	require.Equal(t, 2, config.ReplicationMaxIdle)
+	require.Equal(t, 2000, config.Relay.Timeout)
+	require.Empty(t, config.Relay.UpstreamSubjectPrefix)
+}
+
+func TestRedactedNATSConfig(t *testing.T) {
+	config := NATSConfig{
+		Username: "derek",
+		Password: "s3cr3t",
+		Token:    "t0k3n",
+	}
+
+	redactedConfig := config.Redacted()
+	require.Equal(t, "derek", redactedConfig.Username)
+	require.NotContains(t, fmt.Sprintf("%v", redactedConfig), "s3cr3t")
+	require.NotContains(t, fmt.Sprintf("%v", redactedConfig), "t0k3n")
+
+	// the original is untouched
+	require.Equal(t, "s3cr3t", config.Password)
+	require.Equal(t, "", NATSConfig{}.Redacted().Password)
 }
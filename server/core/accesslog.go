@@ -0,0 +1,143 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/logging"
+	"github.com/nats-io/nkeys"
+)
+
+// accessLogWriter counts the status and size of a response as it is written, nothing is
+// buffered so streamed responses go out as they always have
+type accessLogWriter struct {
+	http.ResponseWriter
+	status   int
+	size     int64
+	hijacked bool
+}
+
+func (w *accessLogWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(data)
+	w.size += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the connection
+func (w *accessLogWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Flush passes flushes through for handlers that stream their response
+func (w *accessLogWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack hands over the connection, the status and size are unknown after that
+func (w *accessLogWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the response writer can't be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+	return conn, rw, err
+}
+
+// accountForPath returns the account public key in a /jwt/v1/accounts/ path, if there is one
+func accountForPath(path string) string {
+	const prefix = "/jwt/v1/accounts/"
+	if !strings.HasPrefix(path, prefix) {
+		return ""
+	}
+	pubKey := strings.SplitN(strings.TrimPrefix(path, prefix), "/", 2)[0]
+	if !nkeys.IsValidPublicAccountKey(pubKey) {
+		return ""
+	}
+	return pubKey
+}
+
+// accessLogged logs each request with HTTP.AccessLog set, requests slower than
+// HTTP.SlowRequestThreshold are logged as warnings even when the access log is off
+func (server *AccountServer) accessLogged(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := server.currentConfig().HTTP
+		slow := time.Duration(config.SlowRequestThreshold) * time.Millisecond
+		if !config.AccessLog && slow <= 0 {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		lw := &accessLogWriter{ResponseWriter: w}
+		handler.ServeHTTP(lw, r)
+		latency := time.Since(start)
+
+		isSlow := slow > 0 && latency >= slow
+		if !config.AccessLog && !isSlow {
+			return
+		}
+
+		status := lw.status
+		if status == 0 && !lw.hijacked {
+			// the handler returned without writing anything
+			status = http.StatusOK
+		}
+
+		fields := logging.Fields{
+			"method":     r.Method,
+			"path":       r.URL.Path,
+			"remote":     r.RemoteAddr,
+			"status":     status,
+			"bytes":      lw.size,
+			"latency_ms": float64(latency) / float64(time.Millisecond),
+		}
+		if pubKey := accountForPath(r.URL.Path); pubKey != "" {
+			fields["account"] = pubKey
+		}
+		if lw.hijacked {
+			fields["hijacked"] = true
+		}
+
+		logger := server.logger.WithContext(r.Context()).WithFields(fields)
+		if isSlow {
+			logger.Warnf("slow request %s %s %d %d bytes in %s", r.Method, r.URL.Path, status, lw.size, latency)
+			return
+		}
+		logger.Noticef("%s %s %d %d bytes in %s", r.Method, r.URL.Path, status, lw.size, latency)
+	})
+}
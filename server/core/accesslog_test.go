@@ -0,0 +1,171 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/logging"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+type loggedEntry struct {
+	level  string
+	msg    string
+	fields logging.Fields
+}
+
+// recordingLogger keeps the entries logged through it, loggers with fields share the entries and the lock
+type recordingLogger struct {
+	*sync.Mutex
+	fields  logging.Fields
+	entries *[]loggedEntry
+}
+
+func newRecordingLogger() *recordingLogger {
+	return &recordingLogger{Mutex: &sync.Mutex{}, entries: &[]loggedEntry{}}
+}
+
+func (l *recordingLogger) add(level string, format string, v ...interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	*l.entries = append(*l.entries, loggedEntry{level: level, msg: fmt.Sprintf(format, v...), fields: l.fields})
+}
+
+// find returns the entries whose message contains text
+func (l *recordingLogger) find(text string) []loggedEntry {
+	l.Lock()
+	defer l.Unlock()
+	found := []loggedEntry{}
+	for _, entry := range *l.entries {
+		if strings.Contains(entry.msg, text) {
+			found = append(found, entry)
+		}
+	}
+	return found
+}
+
+func (l *recordingLogger) Debugf(format string, v ...interface{})  { l.add("debug", format, v...) }
+func (l *recordingLogger) Errorf(format string, v ...interface{})  { l.add("error", format, v...) }
+func (l *recordingLogger) Fatalf(format string, v ...interface{})  { l.add("fatal", format, v...) }
+func (l *recordingLogger) Noticef(format string, v ...interface{}) { l.add("info", format, v...) }
+func (l *recordingLogger) Tracef(format string, v ...interface{})  { l.add("trace", format, v...) }
+func (l *recordingLogger) Warnf(format string, v ...interface{})   { l.add("warn", format, v...) }
+func (l *recordingLogger) Close() error                            { return nil }
+
+func (l *recordingLogger) WithFields(fields logging.Fields) logging.Logger {
+	merged := logging.Fields{}
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &recordingLogger{Mutex: l.Mutex, fields: merged, entries: l.entries}
+}
+
+func (l *recordingLogger) WithContext(ctx context.Context) logging.Logger {
+	if traceID := logging.TraceIDFromContext(ctx); traceID != "" {
+		return l.WithFields(logging.Fields{logging.TraceIDField: traceID})
+	}
+	return l
+}
+
+func TestAccountForPath(t *testing.T) {
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+
+	require.Equal(t, pubKey, accountForPath("/jwt/v1/accounts/"+pubKey))
+	require.Equal(t, "", accountForPath("/jwt/v1/accounts/"))
+	require.Equal(t, "", accountForPath("/jwt/v1/accounts/notakey"))
+	require.Equal(t, "", accountForPath("/jwt/v1/activations/"+pubKey))
+}
+
+func TestAccessLog(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.HTTP.AccessLog = true
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	logger := newRecordingLogger()
+	testEnv.Server.Lock()
+	testEnv.Server.logger = logger
+	testEnv.Server.Unlock()
+
+	pubKey := saveTestAccount(t, testEnv, time.Now().Add(time.Hour))
+
+	path := "/jwt/v1/accounts/" + pubKey
+	resp, err := testEnv.HTTP.Get(testEnv.URLForPath(path))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	entries := logger.find("GET " + path)
+	require.Len(t, entries, 1)
+	require.Equal(t, "info", entries[0].level)
+	require.Equal(t, http.StatusOK, entries[0].fields["status"])
+	require.Equal(t, pubKey, entries[0].fields["account"])
+	require.Equal(t, "GET", entries[0].fields["method"])
+	require.True(t, entries[0].fields["bytes"].(int64) > 0)
+	_, ok := entries[0].fields["latency_ms"].(float64)
+	require.True(t, ok)
+}
+
+func TestSlowRequestLog(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.HTTP.SlowRequestThreshold = 50
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	logger := newRecordingLogger()
+	server := testEnv.Server
+	server.Lock()
+	server.logger = logger
+	server.Unlock()
+
+	handler := server.accessLogged(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		w.Write([]byte("ok"))
+		w.(http.Flusher).Flush()
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/fast", nil))
+	require.Empty(t, logger.find("/fast"))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/slow", nil))
+	require.True(t, recorder.Flushed)
+
+	entries := logger.find("slow request GET /slow 200 2 bytes")
+	require.Len(t, entries, 1)
+	require.Equal(t, "warn", entries[0].level)
+}
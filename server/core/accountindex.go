@@ -0,0 +1,225 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/nats-io/jwt"
+)
+
+// accountSummary is what the account listing returns for each account
+type accountSummary struct {
+	PubKey   string `json:"pubkey"`
+	Name     string `json:"name,omitempty"`
+	Issuer   string `json:"iss"`
+	IssuedAt int64  `json:"iat"`
+	Expires  int64  `json:"exp,omitempty"`
+
+	jti string // tells a changed JWT from one saved again
+}
+
+func summaryForAccount(claim *jwt.AccountClaims) accountSummary {
+	return accountSummary{
+		PubKey:   claim.Subject,
+		Name:     claim.Name,
+		Issuer:   claim.Issuer,
+		IssuedAt: claim.IssuedAt,
+		Expires:  claim.Expires,
+		jti:      claim.ID,
+	}
+}
+
+// accountFilter limits the accounts returned by list, the zero value matches every account
+type accountFilter struct {
+	expired  *bool  // if set, only accounts that are, or aren't, expired
+	signedBy string // if set, only accounts issued by this key
+}
+
+func (filter accountFilter) matches(summary accountSummary, now int64) bool {
+	if filter.expired != nil && (summary.Expires > 0 && summary.Expires <= now) != *filter.expired {
+		return false
+	}
+	return filter.signedBy == "" || summary.Issuer == filter.signedBy
+}
+
+// accountIndex keeps a summary of every account in the store, so listing accounts doesn't
+// read and decode every JWT. The sorted keys are rebuilt on the first list after a change.
+type accountIndex struct {
+	sync.RWMutex
+	accounts map[string]accountSummary
+	issuers  map[string]int // the number of accounts signed by each key
+	sorted   []string
+}
+
+func newAccountIndex() *accountIndex {
+	return &accountIndex{
+		accounts: map[string]accountSummary{},
+		issuers:  map[string]int{},
+	}
+}
+
+// set records the summary for an account, replacing the old one
+func (idx *accountIndex) set(summary accountSummary) {
+	idx.Lock()
+	defer idx.Unlock()
+
+	if old, ok := idx.accounts[summary.PubKey]; ok {
+		idx.uncount(old.Issuer)
+	} else {
+		idx.sorted = nil
+	}
+	idx.accounts[summary.PubKey] = summary
+	idx.issuers[summary.Issuer]++
+}
+
+// changed is true if the account isn't indexed yet, or is indexed with another JWT
+func (idx *accountIndex) changed(claim *jwt.AccountClaims) bool {
+	idx.RLock()
+	defer idx.RUnlock()
+
+	old, ok := idx.accounts[claim.Subject]
+	return !ok || old.jti != claim.ID
+}
+
+// has is true if the account is indexed
+func (idx *accountIndex) has(pubKey string) bool {
+	idx.RLock()
+	defer idx.RUnlock()
+
+	_, ok := idx.accounts[pubKey]
+	return ok
+}
+
+// issuer returns the key that signed the account's JWT, false if the account isn't indexed
+func (idx *accountIndex) issuer(pubKey string) (string, bool) {
+	idx.RLock()
+	defer idx.RUnlock()
+
+	summary, ok := idx.accounts[pubKey]
+	return summary.Issuer, ok
+}
+
+// remove drops an account from the index
+func (idx *accountIndex) remove(pubKey string) {
+	idx.Lock()
+	defer idx.Unlock()
+
+	if old, ok := idx.accounts[pubKey]; ok {
+		delete(idx.accounts, pubKey)
+		idx.uncount(old.Issuer)
+		idx.sorted = nil
+	}
+}
+
+// uncount drops an account from the issuer counts, lock should be held
+func (idx *accountIndex) uncount(issuer string) {
+	if idx.issuers[issuer]--; idx.issuers[issuer] <= 0 {
+		delete(idx.issuers, issuer)
+	}
+}
+
+// issuerCounts returns the number of accounts signed by each key
+func (idx *accountIndex) issuerCounts() map[string]int {
+	idx.RLock()
+	defer idx.RUnlock()
+
+	counts := make(map[string]int, len(idx.issuers))
+	for issuer, count := range idx.issuers {
+		counts[issuer] = count
+	}
+	return counts
+}
+
+// list returns up to limit summaries that match the filter, in public key order, for keys
+// after the one provided. Expiration is checked against now.
+func (idx *accountIndex) list(after string, limit int, filter accountFilter, now int64) []accountSummary {
+	idx.Lock()
+	if idx.sorted == nil {
+		idx.sorted = make([]string, 0, len(idx.accounts))
+		for pubKey := range idx.accounts {
+			idx.sorted = append(idx.sorted, pubKey)
+		}
+		sort.Strings(idx.sorted)
+	}
+	sorted := idx.sorted
+	idx.Unlock()
+
+	idx.RLock()
+	defer idx.RUnlock()
+
+	found := []accountSummary{}
+	start := sort.SearchStrings(sorted, after)
+	for _, pubKey := range sorted[start:] {
+		if len(found) >= limit {
+			break
+		}
+		if pubKey <= after {
+			continue
+		}
+
+		summary, ok := idx.accounts[pubKey]
+		if !ok {
+			continue
+		}
+
+		if !filter.matches(summary, now) {
+			continue
+		}
+		found = append(found, summary)
+	}
+	return found
+}
+
+// expiring returns the summaries of accounts that expire before the cutoff, soonest first
+func (idx *accountIndex) expiring(cutoff int64) []accountSummary {
+	idx.RLock()
+	found := []accountSummary{}
+	for _, summary := range idx.accounts {
+		if summary.Expires > 0 && summary.Expires < cutoff {
+			found = append(found, summary)
+		}
+	}
+	idx.RUnlock()
+
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].Expires != found[j].Expires {
+			return found[i].Expires < found[j].Expires
+		}
+		return found[i].PubKey < found[j].PubKey
+	})
+	return found
+}
+
+// size returns the number of indexed accounts
+func (idx *accountIndex) size() int {
+	idx.RLock()
+	defer idx.RUnlock()
+	return len(idx.accounts)
+}
+
+// replace swaps in the contents of another index
+func (idx *accountIndex) replace(other *accountIndex) {
+	other.RLock()
+	accounts, issuers := other.accounts, other.issuers
+	other.RUnlock()
+
+	idx.Lock()
+	idx.accounts, idx.issuers, idx.sorted = accounts, issuers, nil
+	idx.Unlock()
+}
@@ -0,0 +1,192 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccountIndex(t *testing.T) {
+	idx := newAccountIndex()
+
+	idx.set(accountSummary{PubKey: "C", Name: "three", Expires: 50})
+	idx.set(accountSummary{PubKey: "A", Name: "one"})
+	idx.set(accountSummary{PubKey: "B", Name: "two", Expires: 200})
+
+	keys := func(summaries []accountSummary) []string {
+		found := []string{}
+		for _, s := range summaries {
+			found = append(found, s.PubKey)
+		}
+		return found
+	}
+
+	require.Equal(t, []string{"A", "B", "C"}, keys(idx.list("", 10, accountFilter{}, 100)))
+	require.Equal(t, []string{"A", "B"}, keys(idx.list("", 2, accountFilter{}, 100)))
+	require.Equal(t, []string{"C"}, keys(idx.list("B", 2, accountFilter{}, 100)))
+	require.Equal(t, []string{"B", "C"}, keys(idx.list("AA", 2, accountFilter{}, 100)))
+	require.Empty(t, idx.list("C", 2, accountFilter{}, 100))
+
+	expired, unexpired := true, false
+	require.Equal(t, []string{"C"}, keys(idx.list("", 10, accountFilter{expired: &expired}, 100)))
+	require.Equal(t, []string{"A", "B"}, keys(idx.list("", 10, accountFilter{expired: &unexpired}, 100)))
+
+	idx.set(accountSummary{PubKey: "D", Issuer: "OLD"})
+	idx.set(accountSummary{PubKey: "E", Issuer: "NEW"})
+	require.Equal(t, []string{"D"}, keys(idx.list("", 10, accountFilter{signedBy: "OLD"}, 100)))
+	require.Equal(t, map[string]int{"": 3, "OLD": 1, "NEW": 1}, idx.issuerCounts())
+
+	// re-signing moves the account to the new key
+	idx.set(accountSummary{PubKey: "D", Issuer: "NEW"})
+	idx.remove("E")
+	require.Empty(t, idx.list("", 10, accountFilter{signedBy: "OLD"}, 100))
+	require.Equal(t, map[string]int{"": 3, "NEW": 1}, idx.issuerCounts())
+	idx.remove("D")
+
+	// updates replace the summary, removes drop it
+	idx.set(accountSummary{PubKey: "A", Name: "uno"})
+	idx.remove("B")
+	idx.remove("missing")
+	require.Equal(t, []accountSummary{
+		{PubKey: "A", Name: "uno"},
+		{PubKey: "C", Name: "three", Expires: 50},
+	}, idx.list("", 10, accountFilter{}, 100))
+	require.Equal(t, 2, idx.size())
+}
+
+func listAccounts(t *testing.T, testEnv *TestSetup, query string) (int, []accountSummary) {
+	resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/accounts" + query))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	summaries := []accountSummary{}
+	if resp.StatusCode == http.StatusOK {
+		require.Equal(t, ApplicationJSON, resp.Header.Get(ContentType))
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&summaries))
+	}
+	return resp.StatusCode, summaries
+}
+
+func TestAccountIndexChanged(t *testing.T) {
+	operator, err := nkeys.CreateOperator()
+	require.NoError(t, err)
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+
+	account := jwt.NewAccountClaims(pubKey)
+	acctJWT, err := account.Encode(operator)
+	require.NoError(t, err)
+	claim, err := jwt.DecodeAccountClaims(acctJWT)
+	require.NoError(t, err)
+
+	idx := newAccountIndex()
+	require.True(t, idx.changed(claim))
+	idx.set(summaryForAccount(claim))
+	require.False(t, idx.changed(claim))
+
+	account.Name = "renamed"
+	acctJWT, err = account.Encode(operator)
+	require.NoError(t, err)
+	renamed, err := jwt.DecodeAccountClaims(acctJWT)
+	require.NoError(t, err)
+	require.True(t, idx.changed(renamed))
+}
+
+func TestListAccounts(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	// indexed at startup
+	jwts := saveTestAccounts(t, testEnv, 3)
+	testEnv.Server.buildIndexes(testEnv.Server.jwtStore)
+
+	status, summaries := listAccounts(t, testEnv, "")
+	require.Equal(t, http.StatusOK, status)
+	require.Len(t, summaries, 3)
+	for i, summary := range summaries {
+		require.Contains(t, jwts, summary.PubKey)
+		require.NotZero(t, summary.IssuedAt)
+		if i > 0 {
+			require.True(t, summaries[i-1].PubKey < summary.PubKey)
+		}
+	}
+
+	// pages
+	_, page := listAccounts(t, testEnv, "?limit=2")
+	require.Equal(t, summaries[:2], page)
+	_, page = listAccounts(t, testEnv, "?limit=2&after="+page[1].PubKey)
+	require.Equal(t, summaries[2:], page)
+
+	// saved with a POST
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+	account := jwt.NewAccountClaims(pubKey)
+	account.Name = "expiring"
+	account.Expires = time.Now().Add(time.Hour).Unix()
+	postNamedAccount(t, testEnv, accountKey, "named")
+
+	_, summaries = listAccounts(t, testEnv, "")
+	require.Len(t, summaries, 4)
+
+	// the expired filter, an account that has expired is put in the store directly
+	account.Expires = time.Now().Add(-time.Hour).Unix()
+	expiredJWT, err := account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	require.NoError(t, testEnv.Server.jwtStore.Save(pubKey, expiredJWT))
+	testEnv.Server.indexJWT(pubKey, expiredJWT)
+
+	_, summaries = listAccounts(t, testEnv, "?expired=true")
+	require.Equal(t, []accountSummary{{PubKey: pubKey, Name: "expiring", Issuer: account.Issuer, IssuedAt: summaries[0].IssuedAt, Expires: account.Expires}}, summaries)
+	_, summaries = listAccounts(t, testEnv, "?expired=false")
+	require.Len(t, summaries, 3)
+
+	// deleted
+	url := testEnv.URLForPath("/jwt/v1/accounts/" + pubKey)
+	resp, err := testEnv.HTTP.Do(deleteRequest(t, url, deleteAuthorization(t, testEnv.OperatorKey, pubKey)))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	_, summaries = listAccounts(t, testEnv, "")
+	require.Len(t, summaries, 3)
+
+	for _, query := range []string{"?limit=0", "?limit=x", "?expired=maybe"} {
+		status, _ = listAccounts(t, testEnv, query)
+		require.Equal(t, http.StatusBadRequest, status, query)
+	}
+
+	// the resolver test point is unchanged
+	resp, err = testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/accounts/"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Empty(t, resp.Header.Get(ContentType))
+	require.Equal(t, int64(0), resp.ContentLength)
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/nats-io/jwt"
+)
+
+// activationKey is what consumers know about an activation, the importing account and
+// the subject it imports
+type activationKey struct {
+	account string
+	subject string
+}
+
+// activationIndex maps an importing account and subject to the hashes activations are
+// stored under, there is more than one if several accounts export the subject to it
+type activationIndex struct {
+	sync.RWMutex
+	hashes map[activationKey]map[string]string // hash to exporting account
+}
+
+func newActivationIndex() *activationIndex {
+	return &activationIndex{
+		hashes: map[activationKey]map[string]string{},
+	}
+}
+
+// exporterForActivation is the account that issued the activation, the issuer
+// or the account it signs for
+func exporterForActivation(claim *jwt.ActivationClaims) string {
+	if claim.IssuerAccount != "" {
+		return claim.IssuerAccount
+	}
+	return claim.Issuer
+}
+
+// set records the hash for an activation
+func (idx *activationIndex) set(hash string, claim *jwt.ActivationClaims) {
+	key := activationKey{account: claim.Subject, subject: string(claim.ImportSubject)}
+
+	idx.Lock()
+	defer idx.Unlock()
+
+	if idx.hashes[key] == nil {
+		idx.hashes[key] = map[string]string{}
+	}
+	idx.hashes[key][hash] = exporterForActivation(claim)
+}
+
+// remove drops an activation from the index
+func (idx *activationIndex) remove(hash string) {
+	idx.Lock()
+	defer idx.Unlock()
+
+	for key, hashes := range idx.hashes {
+		if _, ok := hashes[hash]; ok {
+			delete(hashes, hash)
+			if len(hashes) == 0 {
+				delete(idx.hashes, key)
+			}
+			return
+		}
+	}
+}
+
+// lookup returns the sorted hashes for activations into account for subject, if exporter
+// isn't empty only activations from it are returned
+func (idx *activationIndex) lookup(account string, subject string, exporter string) []string {
+	idx.RLock()
+	defer idx.RUnlock()
+
+	found := []string{}
+	for hash, from := range idx.hashes[activationKey{account: account, subject: subject}] {
+		if exporter == "" || exporter == from {
+			found = append(found, hash)
+		}
+	}
+	sort.Strings(found)
+	return found
+}
+
+// involving returns the sorted hashes for activations issued by, or to, account
+func (idx *activationIndex) involving(account string) []string {
+	idx.RLock()
+	defer idx.RUnlock()
+
+	found := []string{}
+	for key, hashes := range idx.hashes {
+		for hash, from := range hashes {
+			if key.account == account || from == account {
+				found = append(found, hash)
+			}
+		}
+	}
+	sort.Strings(found)
+	return found
+}
+
+// size returns the number of indexed activations
+func (idx *activationIndex) size() int {
+	idx.RLock()
+	defer idx.RUnlock()
+
+	count := 0
+	for _, hashes := range idx.hashes {
+		count += len(hashes)
+	}
+	return count
+}
+
+// replace swaps in the contents of another index
+func (idx *activationIndex) replace(other *activationIndex) {
+	other.RLock()
+	hashes := other.hashes
+	other.RUnlock()
+
+	idx.Lock()
+	idx.hashes = hashes
+	idx.Unlock()
+}
@@ -0,0 +1,201 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func testActivation(t *testing.T, exporter nkeys.KeyPair, importer string, subject string) (*jwt.ActivationClaims, string) {
+	act := jwt.NewActivationClaims(importer)
+	act.ImportType = jwt.Stream
+	act.ImportSubject = jwt.Subject(subject)
+	actJWT, err := act.Encode(exporter)
+	require.NoError(t, err)
+	act, err = jwt.DecodeActivationClaims(actJWT)
+	require.NoError(t, err)
+	return act, actJWT
+}
+
+func TestActivationIndex(t *testing.T) {
+	exporter, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	exporterPubKey, err := exporter.PublicKey()
+	require.NoError(t, err)
+	other, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	otherPubKey, err := other.PublicKey()
+	require.NoError(t, err)
+	importerKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	importer, err := importerKey.PublicKey()
+	require.NoError(t, err)
+
+	idx := newActivationIndex()
+	first, _ := testActivation(t, exporter, importer, "times.*")
+	second, _ := testActivation(t, other, importer, "times.*")
+	idx.set("one", first)
+	idx.set("two", second)
+
+	require.Equal(t, []string{"one", "two"}, idx.lookup(importer, "times.*", ""))
+	require.Equal(t, []string{"one"}, idx.lookup(importer, "times.*", exporterPubKey))
+	require.Equal(t, []string{"two"}, idx.lookup(importer, "times.*", otherPubKey))
+	require.Empty(t, idx.lookup(importer, "dates.*", ""))
+	require.Empty(t, idx.lookup("someone", "times.*", ""))
+
+	// saving again doesn't add a duplicate
+	idx.set("one", first)
+	require.Equal(t, 2, idx.size())
+
+	require.Equal(t, []string{"one"}, idx.involving(exporterPubKey))
+	require.Equal(t, []string{"one", "two"}, idx.involving(importer))
+	require.Empty(t, idx.involving("someone"))
+
+	idx.remove("one")
+	idx.remove("missing")
+	require.Equal(t, []string{"two"}, idx.lookup(importer, "times.*", ""))
+	idx.remove("two")
+	require.Equal(t, 0, idx.size())
+}
+
+func getActivationForImport(t *testing.T, testEnv *TestSetup, query url.Values) (int, string) {
+	resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/activations?" + query.Encode()))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(body)
+}
+
+func TestGetActivationByImport(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	exporter, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	exporterPubKey, err := exporter.PublicKey()
+	require.NoError(t, err)
+	other, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	importer, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	importerPubKey, err := importer.PublicKey()
+	require.NoError(t, err)
+
+	_, actJWT := testActivation(t, exporter, importerPubKey, "times.*")
+	resp, err := testEnv.HTTP.Post(testEnv.URLForPath("/jwt/v1/activations"), "application/json", bytes.NewBuffer([]byte(actJWT)))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	status, body := getActivationForImport(t, testEnv, url.Values{"account": {importerPubKey}, "subject": {"times.*"}})
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, actJWT, body)
+
+	status, _ = getActivationForImport(t, testEnv, url.Values{"account": {importerPubKey}, "subject": {"dates.*"}})
+	require.Equal(t, http.StatusNotFound, status)
+
+	status, _ = getActivationForImport(t, testEnv, url.Values{"account": {importerPubKey}})
+	require.Equal(t, http.StatusBadRequest, status)
+
+	// a second export of the same subject comes in as a notification
+	otherAct, otherJWT := testActivation(t, other, importerPubKey, "times.*")
+	testEnv.Server.handleActivationNotification(&nats.Msg{Data: []byte(otherJWT)})
+	hash, err := otherAct.HashID()
+	require.NoError(t, err)
+	require.Equal(t, []string{hash}, testEnv.Server.activations.lookup(importerPubKey, "times.*", otherAct.Issuer))
+
+	status, _ = getActivationForImport(t, testEnv, url.Values{"account": {importerPubKey}, "subject": {"times.*"}})
+	require.Equal(t, http.StatusConflict, status)
+
+	status, body = getActivationForImport(t, testEnv, url.Values{"account": {importerPubKey}, "subject": {"times.*"}, "issuer": {exporterPubKey}})
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, actJWT, body)
+
+	// lookups by hash still work
+	resp, err = testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/activations/" + hash))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestActivationsReplayedForNewAccount(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	server := testEnv.Server
+
+	exporter, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	exporterPubKey, err := exporter.PublicKey()
+	require.NoError(t, err)
+
+	// the activation arrives before the account that issued it
+	act, actJWT := testActivation(t, exporter, server.systemAccountClaims.Subject, "times.*")
+	hash, err := act.HashID()
+	require.NoError(t, err)
+	require.NoError(t, server.saveJWT(hash, actJWT))
+	server.indexJWT(hash, actJWT)
+
+	received := make(chan *nats.Msg, 10)
+	_, err = testEnv.NC.ChanSubscribe(server.activationNotificationSubject("*", "*"), received)
+	require.NoError(t, err)
+	require.NoError(t, testEnv.NC.Flush())
+
+	account := jwt.NewAccountClaims(exporterPubKey)
+	acctJWT, err := account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	post := func() {
+		resp, err := testEnv.HTTP.Post(testEnv.URLForPath("/jwt/v1/accounts/"+exporterPubKey), "application/json", bytes.NewBufferString(acctJWT))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	post()
+	select {
+	case msg := <-received:
+		require.Equal(t, server.activationNotificationSubject(exporterPubKey, hash), msg.Subject)
+		require.Equal(t, actJWT, string(msg.Data))
+	case <-time.After(5 * time.Second):
+		t.Fatal("activation wasn't replayed")
+	}
+
+	// the same JWT again doesn't replay
+	post()
+	select {
+	case msg := <-received:
+		t.Fatalf("unexpected replay on %s", msg.Subject)
+	case <-time.After(200 * time.Millisecond):
+	}
+	require.Equal(t, uint64(1), atomic.LoadUint64(&server.metrics.activationsReplayed))
+}
@@ -0,0 +1,266 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/logging"
+)
+
+// auditQueueSize is the number of account updates waiting to be diffed before new ones are dropped
+const auditQueueSize = 1024
+
+// auditIgnored are claim fields that change with every JWT, they aren't part of the diff
+var auditIgnored = map[string]bool{"iat": true, "jti": true}
+
+// claimChange is one field that differs between two versions of an account JWT, fields are
+// dotted paths into the claim JSON, like nats.limits.conn
+type claimChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old,omitempty"`
+	New   interface{} `json:"new,omitempty"`
+}
+
+// auditRecord is a line in the audit log
+type auditRecord struct {
+	Time        string        `json:"time"`
+	Source      string        `json:"source"`
+	Account     string        `json:"account"`
+	Issuer      string        `json:"issuer"`
+	JTI         string        `json:"jti"`
+	PreviousJTI string        `json:"previous_jti,omitempty"`
+	Changes     []claimChange `json:"changes"`
+}
+
+type pendingAudit struct {
+	at       time.Time
+	source   string
+	previous string
+	next     string
+}
+
+// auditLog diffs account JWT updates on a worker goroutine and appends them to a file as JSON lines
+type auditLog struct {
+	sync.Mutex
+	closed bool
+	queue  chan pendingAudit
+	done   chan struct{}
+	file   *os.File
+	logger logging.Logger
+}
+
+func newAuditLog(path string, logger logging.Logger) (*auditLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open audit log, %s", err.Error())
+	}
+
+	audit := &auditLog{
+		queue:  make(chan pendingAudit, auditQueueSize),
+		done:   make(chan struct{}),
+		file:   file,
+		logger: logger,
+	}
+	go audit.run()
+	return audit, nil
+}
+
+// add queues an update without blocking, previous is empty for a new account
+func (audit *auditLog) add(source string, previous string, next string) {
+	if audit == nil {
+		return
+	}
+
+	audit.Lock()
+	defer audit.Unlock()
+
+	if audit.closed {
+		return
+	}
+
+	select {
+	case audit.queue <- pendingAudit{at: time.Now().UTC(), source: source, previous: previous, next: next}:
+	default:
+		audit.logger.Warnf("audit queue is full, dropping an account update")
+	}
+}
+
+func (audit *auditLog) run() {
+	defer close(audit.done)
+
+	for pending := range audit.queue {
+		record, err := newAuditRecord(pending)
+		if err != nil {
+			audit.logger.WithFields(logging.Fields{"error": err}).Errorf("unable to audit account update, %s", err.Error())
+			continue
+		}
+
+		data, err := json.Marshal(record)
+		if err != nil {
+			audit.logger.WithFields(logging.Fields{"account": record.Account, "error": err}).Errorf("unable to encode audit record, %s", err.Error())
+			continue
+		}
+
+		if _, err := audit.file.Write(append(data, '\n')); err != nil {
+			audit.logger.WithFields(logging.Fields{"account": record.Account, "error": err}).Errorf("unable to write audit record, %s", err.Error())
+		}
+	}
+}
+
+// previousJWT loads the JWT an update is about to replace, it is only needed when auditing
+func (server *AccountServer) previousJWT(pubKey string) string {
+	if server.audit == nil {
+		return ""
+	}
+
+	theJWT, err := server.loadStored(pubKey)
+	if err != nil {
+		return ""
+	}
+	return theJWT
+}
+
+// close writes the queued updates and closes the file
+func (audit *auditLog) close() {
+	if audit == nil {
+		return
+	}
+
+	audit.Lock()
+	if audit.closed {
+		audit.Unlock()
+		return
+	}
+	audit.closed = true
+	close(audit.queue)
+	audit.Unlock()
+
+	<-audit.done
+	audit.file.Close()
+}
+
+func newAuditRecord(pending pendingAudit) (*auditRecord, error) {
+	next, err := jwt.DecodeAccountClaims(pending.next)
+	if err != nil {
+		return nil, err
+	}
+
+	record := &auditRecord{
+		Time:    pending.at.Format(time.RFC3339Nano),
+		Source:  pending.source,
+		Account: next.Subject,
+		Issuer:  next.Issuer,
+		JTI:     next.ID,
+	}
+
+	var previous *jwt.AccountClaims
+	if pending.previous != "" {
+		// a previous JWT that doesn't decode is diffed as if the account was new
+		if previous, err = jwt.DecodeAccountClaims(pending.previous); err == nil {
+			record.PreviousJTI = previous.ID
+		}
+	}
+
+	record.Changes, err = diffClaims(previous, next)
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// diffClaims compares the JSON for two claims field by field, previous can be nil
+func diffClaims(previous *jwt.AccountClaims, next *jwt.AccountClaims) ([]claimChange, error) {
+	old, err := claimFields(previous)
+	if err != nil {
+		return nil, err
+	}
+
+	updated, err := claimFields(next)
+	if err != nil {
+		return nil, err
+	}
+
+	for k := range auditIgnored {
+		delete(old, k)
+		delete(updated, k)
+	}
+
+	changes := []claimChange{}
+	diffFields("", old, updated, &changes)
+	return changes, nil
+}
+
+func claimFields(claims *jwt.AccountClaims) (map[string]interface{}, error) {
+	fields := map[string]interface{}{}
+	if claims == nil {
+		return fields, nil
+	}
+
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// diffFields walks nested objects, anything else, including lists like exports, is compared whole
+func diffFields(prefix string, old map[string]interface{}, updated map[string]interface{}, changes *[]claimChange) {
+	keys := []string{}
+	for k := range old {
+		keys = append(keys, k)
+	}
+	for k := range updated {
+		if _, ok := old[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		field := k
+		if prefix != "" {
+			field = prefix + "." + k
+		}
+
+		o, n := old[k], updated[k]
+		oldMap, oldIsMap := o.(map[string]interface{})
+		newMap, newIsMap := n.(map[string]interface{})
+
+		switch {
+		case oldIsMap && newIsMap:
+			diffFields(field, oldMap, newMap, changes)
+		case oldIsMap && n == nil:
+			diffFields(field, oldMap, map[string]interface{}{}, changes)
+		case newIsMap && o == nil:
+			diffFields(field, map[string]interface{}{}, newMap, changes)
+		case !reflect.DeepEqual(o, n):
+			*changes = append(*changes, claimChange{Field: field, Old: o, New: n})
+		}
+	}
+}
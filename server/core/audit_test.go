@@ -0,0 +1,144 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func changesByField(changes []claimChange) map[string]claimChange {
+	byField := map[string]claimChange{}
+	for _, c := range changes {
+		byField[c.Field] = c
+	}
+	return byField
+}
+
+func TestDiffClaims(t *testing.T) {
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+
+	previous := jwt.NewAccountClaims(pubKey)
+	previous.ID = "one"
+	previous.IssuedAt = 1
+	previous.Name = "same"
+	previous.Limits.Conn = 10
+
+	next := jwt.NewAccountClaims(pubKey)
+	next.ID = "two"
+	next.IssuedAt = 2
+	next.Name = "same"
+	next.Limits.Conn = 20
+	next.Exports.Add(&jwt.Export{Subject: "foo", Type: jwt.Stream})
+
+	changes, err := diffClaims(previous, next)
+	require.NoError(t, err)
+
+	byField := changesByField(changes)
+	require.Len(t, byField, 2)
+	require.Equal(t, float64(10), byField["nats.limits.conn"].Old)
+	require.Equal(t, float64(20), byField["nats.limits.conn"].New)
+	require.Nil(t, byField["nats.exports"].Old)
+	require.NotNil(t, byField["nats.exports"].New)
+
+	// no previous JWT, everything is new
+	changes, err = diffClaims(nil, next)
+	require.NoError(t, err)
+	byField = changesByField(changes)
+	require.Equal(t, pubKey, byField["sub"].New)
+	require.Equal(t, "same", byField["name"].New)
+	require.NotContains(t, byField, "jti")
+	require.NotContains(t, byField, "iat")
+
+	changes, err = diffClaims(next, next)
+	require.NoError(t, err)
+	require.Empty(t, changes)
+}
+
+func readAuditLog(t *testing.T, path string) []auditRecord {
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	records := []auditRecord{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record auditRecord
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	require.NoError(t, scanner.Err())
+	return records
+}
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "audit_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := conf.DefaultServerConfig()
+	config.AuditLogPath = filepath.Join(dir, "audit.log")
+
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+
+	first := postNamedAccount(t, testEnv, accountKey, "before")
+	second := postNamedAccount(t, testEnv, accountKey, "after")
+
+	// stopping writes everything that is queued
+	testEnv.Server.Stop()
+
+	records := readAuditLog(t, config.AuditLogPath)
+	require.Len(t, records, 2)
+
+	firstClaims, err := jwt.DecodeAccountClaims(first)
+	require.NoError(t, err)
+	secondClaims, err := jwt.DecodeAccountClaims(second)
+	require.NoError(t, err)
+
+	require.Equal(t, "http", records[0].Source)
+	require.Equal(t, pubKey, records[0].Account)
+	require.Equal(t, testEnv.OperatorPubKey, records[0].Issuer)
+	require.Equal(t, firstClaims.ID, records[0].JTI)
+	require.Empty(t, records[0].PreviousJTI)
+	require.NotEmpty(t, records[0].Time)
+
+	require.Equal(t, secondClaims.ID, records[1].JTI)
+	require.Equal(t, firstClaims.ID, records[1].PreviousJTI)
+	require.Equal(t, []claimChange{{Field: "name", Old: "before", New: "after"}}, records[1].Changes)
+
+	// updates after the log is closed are ignored
+	testEnv.Server.audit.add("http", first, second)
+}
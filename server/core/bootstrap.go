@@ -0,0 +1,188 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/logging"
+)
+
+// bootstrapCheckInterval is how often the operator JWT is checked for the bootstrap file
+var bootstrapCheckInterval = 10 * time.Second
+
+// resolverURL is the URL nats-servers use to look up accounts on this server
+func (server *AccountServer) resolverURL() string {
+	config := server.currentConfig()
+	base := config.Bootstrap.ResolverURL
+	if base == "" {
+		server.Lock()
+		base = fmt.Sprintf("%s://%s", server.protocol, server.hostPort)
+		server.Unlock()
+	}
+	return strings.TrimSuffix(base, "/") + "/jwt/v1/accounts/"
+}
+
+// bootstrapConfig returns a nats-server configuration snippet with the operator JWT, the
+// system account, preloaded, and a resolver pointing at this server. The operator JWT ID is
+// returned so writers can tell when it changes.
+func (server *AccountServer) bootstrapConfig() (string, string, error) {
+	operatorJWT, id := server.currentOperatorJWT()
+	if operatorJWT == "" {
+		return "", "", fmt.Errorf("no operator JWT is configured")
+	}
+
+	operator, err := jwt.DecodeOperatorClaims(operatorJWT)
+	if err != nil {
+		return "", "", err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# nats-server resolver configuration from the nats-account-server\n")
+	fmt.Fprintf(&buf, "# operator %q, %s\n\n", operator.Name, operator.Subject)
+	fmt.Fprintf(&buf, "operator: %s\n\n", strings.TrimSpace(operatorJWT))
+
+	if sysKey, sysJWT := server.bootstrapSystemAccount(); sysKey != "" {
+		fmt.Fprintf(&buf, "system_account: %s\n\n", sysKey)
+		fmt.Fprintf(&buf, "resolver: URL(%s)\n\n", server.resolverURL())
+		fmt.Fprintf(&buf, "resolver_preload: {\n    %s: %s\n}\n", sysKey, strings.TrimSpace(sysJWT))
+	} else {
+		fmt.Fprintf(&buf, "resolver: URL(%s)\n", server.resolverURL())
+	}
+
+	return buf.String(), id, nil
+}
+
+// bootstrapSystemAccount returns the system account's key and JWT, the stored copy is
+// preferred over the one in the configuration
+func (server *AccountServer) bootstrapSystemAccount() (string, string) {
+	server.Lock()
+	claims, configured := server.systemAccountClaims, server.systemAccountJWT
+	server.Unlock()
+
+	if claims == nil {
+		return "", ""
+	}
+
+	if stored, err := server.loadStored(claims.Subject); err == nil {
+		return claims.Subject, stored
+	}
+	return claims.Subject, configured
+}
+
+// GetBootstrap returns the nats-server resolver configuration for this server as text, a
+// 404 is returned if there is no operator JWT
+func (server *AccountServer) GetBootstrap(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logger := server.logger.WithContext(r.Context())
+	logger.Tracef("%s: %s", r.RemoteAddr, r.URL.String())
+
+	snippet, _, err := server.bootstrapConfig()
+	if err != nil {
+		server.sendErrorResponse(http.StatusNotFound, "unable to generate the bootstrap configuration", "", err, w)
+		return
+	}
+
+	w.Header().Set(ContentType, TextPlain)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(snippet))
+}
+
+// writeBootstrap writes the bootstrap configuration to the path, through a temporary file
+// so nats-servers never include a partial one
+func writeBootstrap(path string, snippet string) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(snippet), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// startBootstrap writes the bootstrap file, if Bootstrap.Path is set, and rewrites it whenever
+// the operator JWT changes until the server stops. The server lock is held.
+func (server *AccountServer) startBootstrap() {
+	path := server.config.Bootstrap.Path
+	if path == "" {
+		return
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	server.bootstrapStop = stop
+	server.bootstrapDone = done
+
+	go func() {
+		defer close(done)
+
+		written := server.updateBootstrap(path, "")
+
+		ticker := time.NewTicker(bootstrapCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				written = server.updateBootstrap(path, written)
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopBootstrap waits for the bootstrap writer to exit
+func (server *AccountServer) stopBootstrap(stop chan struct{}, done chan struct{}) {
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
+
+// updateBootstrap writes the bootstrap file if the operator JWT isn't the one last written,
+// and returns the ID of the one in the file
+func (server *AccountServer) updateBootstrap(path string, written string) string {
+	snippet, id, err := server.bootstrapConfig()
+	if err != nil {
+		server.logger.WithFields(logging.Fields{"error": err}).Warnf("unable to generate the bootstrap configuration, %s", err.Error())
+		return written
+	}
+
+	if written != "" && id == written {
+		return written
+	}
+
+	if err := writeBootstrap(path, snippet); err != nil {
+		server.logger.WithFields(logging.Fields{"error": err}).Errorf("unable to write the bootstrap configuration to %s, %s", path, err.Error())
+		return written
+	}
+
+	server.logger.Noticef("wrote the nats-server bootstrap configuration to %s", path)
+	return id
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetBootstrap(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Bootstrap.ResolverURL = "https://accounts.example.com/"
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/bootstrap"))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, TextPlain, resp.Header.Get(ContentType))
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	snippet := string(body)
+
+	operatorJWT, _ := testEnv.Server.currentOperatorJWT()
+	require.Contains(t, snippet, "operator: "+strings.TrimSpace(operatorJWT)+"\n")
+	require.Contains(t, snippet, "system_account: "+testEnv.SystemAccountPubKey+"\n")
+	require.Contains(t, snippet, "resolver: URL(https://accounts.example.com/jwt/v1/accounts/)\n")
+	require.Contains(t, snippet, testEnv.SystemAccountPubKey+": "+strings.TrimSpace(testEnv.Server.systemAccountJWT))
+}
+
+func TestBootstrapFile(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "bootstrap_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	interval := bootstrapCheckInterval
+	bootstrapCheckInterval = 50 * time.Millisecond
+	defer func() { bootstrapCheckInterval = interval }()
+
+	path := filepath.Join(dir, "resolver.conf")
+	config := conf.DefaultServerConfig()
+	config.Bootstrap.Path = path
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	readBootstrap := func(contains string) string {
+		for i := 0; i < 50; i++ {
+			data, err := ioutil.ReadFile(path)
+			if err == nil && strings.Contains(string(data), contains) {
+				return string(data)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatalf("bootstrap file doesn't contain %q", contains)
+		return ""
+	}
+
+	operatorJWT, _ := testEnv.Server.currentOperatorJWT()
+	readBootstrap(strings.TrimSpace(operatorJWT))
+	readBootstrap("resolver: URL(http://" + testEnv.Server.hostPort + "/jwt/v1/accounts/)")
+
+	// a new operator JWT is written without a request
+	claims := jwt.NewOperatorClaims(testEnv.OperatorPubKey)
+	claims.Name = "renamed"
+	updated, err := claims.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(testEnv.OperatorJWTFile, []byte(updated), 0644))
+	touch(t, testEnv.OperatorJWTFile, time.Second)
+
+	snippet := readBootstrap(updated)
+	require.Contains(t, snippet, `operator "renamed"`)
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+}
@@ -0,0 +1,217 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/logging"
+	nats "github.com/nats-io/nats.go"
+)
+
+// certCheckInterval is how often certificate files are checked for changes
+var certCheckInterval = 10 * time.Second
+
+// certificateLoader holds a key pair and loads it again when the certificate or key file
+// changes, so rotated certificates are used without a restart
+type certificateLoader struct {
+	certFile string
+	keyFile  string
+	logger   logging.Logger
+
+	lock    sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+	checked time.Time
+}
+
+// newCertificateLoader loads the key pair, the first load has to succeed
+func newCertificateLoader(certFile string, keyFile string, logger logging.Logger) (*certificateLoader, error) {
+	loader := &certificateLoader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		logger:   logger,
+		certMod:  modTime(certFile),
+		keyMod:   modTime(keyFile),
+		checked:  time.Now(),
+	}
+
+	cert, err := loadKeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	loader.cert = cert
+	return loader, nil
+}
+
+// modTime returns the modification time of the file, symlinks are followed so a swapped
+// link counts as a change, a missing file returns the zero time
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+func loadKeyPair(certFile string, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading X509 certificate/key pair: %v", err)
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("error parsing certificate: %v", err)
+	}
+	return &cert, nil
+}
+
+// check loads the key pair again if either file changed since the last check, and returns true
+// if a new certificate was loaded. A pair that doesn't load is logged and the current certificate
+// is kept, it is tried again when one of the files changes.
+func (loader *certificateLoader) check() bool {
+	loader.lock.Lock()
+	defer loader.lock.Unlock()
+
+	loader.checked = time.Now()
+	certMod, keyMod := modTime(loader.certFile), modTime(loader.keyFile)
+	if certMod.Equal(loader.certMod) && keyMod.Equal(loader.keyMod) {
+		return false
+	}
+	loader.certMod, loader.keyMod = certMod, keyMod
+
+	cert, err := loadKeyPair(loader.certFile, loader.keyFile)
+	if err != nil {
+		loader.logger.WithFields(logging.Fields{"cert": loader.certFile, "error": err}).Errorf("unable to reload the certificate in %s, still using the current one, %s", loader.certFile, err.Error())
+		return false
+	}
+
+	loader.cert = cert
+	loader.logger.Noticef("reloaded the certificate in %s, it expires %s", loader.certFile, cert.Leaf.NotAfter.Format(time.RFC3339))
+	return true
+}
+
+// current returns the certificate, checking the files first if they haven't been checked for certCheckInterval
+func (loader *certificateLoader) current() *tls.Certificate {
+	loader.lock.Lock()
+	due := time.Since(loader.checked) >= certCheckInterval
+	loader.lock.Unlock()
+
+	if due {
+		loader.check()
+	}
+
+	loader.lock.Lock()
+	defer loader.lock.Unlock()
+	return loader.cert
+}
+
+// getCertificate is the tls.Config callback for servers, each handshake gets the current certificate
+func (loader *certificateLoader) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return loader.current(), nil
+}
+
+// getClientCertificate is the tls.Config callback for clients
+func (loader *certificateLoader) getClientCertificate(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return loader.current(), nil
+}
+
+// natsClientCert replaces nats.ClientCert, the certificate comes from the loader for each connection
+func natsClientCert(loader *certificateLoader) nats.Option {
+	return func(o *nats.Options) error {
+		if o.TLSConfig == nil {
+			o.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		o.TLSConfig.GetClientCertificate = loader.getClientCertificate
+		o.Secure = true
+		return nil
+	}
+}
+
+// startNATSCertWatcher checks the NATS client certificate every certCheckInterval, when it changes
+// the server connects again so the new certificate is presented. The server lock is held.
+func (server *AccountServer) startNATSCertWatcher() {
+	if server.config.NATS.TLS.Cert == "" || len(server.config.NATS.Servers) == 0 {
+		return
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	server.natsCertStop = stop
+	server.natsCertDone = done
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(certCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				// the loader is made by the first connect that gets that far
+				server.Lock()
+				loader := server.natsCert
+				server.Unlock()
+
+				if loader != nil && loader.check() {
+					server.reconnectNATS("the NATS client certificate changed")
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopNATSCertWatcher waits for the certificate watcher to exit
+func (server *AccountServer) stopNATSCertWatcher(stop chan struct{}, done chan struct{}) {
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
+
+// reconnectNATS replaces the NATS connection with a new one, the old one is drained once the new one
+// is up and kept if no server takes the new one. A server that isn't connected uses the new
+// settings the next time it tries.
+func (server *AccountServer) reconnectNATS(reason string) {
+	server.Lock()
+
+	nc := server.nats
+	if !server.running || nc == nil {
+		server.Unlock()
+		return
+	}
+
+	server.logger.Noticef("%s, connecting to NATS again", reason)
+	if !server.replaceNATS(nc) {
+		server.Unlock()
+		server.logger.Warnf("unable to connect to NATS again, staying on the current connection")
+		return
+	}
+	server.Unlock()
+
+	go server.drainNATS(nc)
+}
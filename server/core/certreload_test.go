@@ -0,0 +1,196 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/logging"
+	"github.com/stretchr/testify/require"
+)
+
+// rotateCert writes a new certificate over the files, moving their times forward so the change is seen
+func rotateCert(t *testing.T, dir string, cert tls.Certificate, rotations int) (string, string) {
+	certFile, keyFile := writeCertPEM(t, dir, cert)
+	later := time.Now().Add(time.Duration(rotations) * time.Minute)
+	require.NoError(t, os.Chtimes(certFile, later, later))
+	require.NoError(t, os.Chtimes(keyFile, later, later))
+	return certFile, keyFile
+}
+
+func TestCertificateLoader(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "certreload_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+	certFile, keyFile := writeCertPEM(t, dir, ca.issue(t, "first"))
+
+	_, err = newCertificateLoader(certFile, dir+"/missing.pem", logging.NewNATSLogger(logging.Config{}))
+	require.Error(t, err)
+
+	loader, err := newCertificateLoader(certFile, keyFile, logging.NewNATSLogger(logging.Config{}))
+	require.NoError(t, err)
+	require.Equal(t, "first", loader.current().Leaf.Subject.CommonName)
+
+	// nothing changed
+	require.False(t, loader.check())
+
+	// a bad certificate keeps the current one
+	require.NoError(t, ioutil.WriteFile(certFile, []byte("not a certificate"), 0644))
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, later, later))
+	require.False(t, loader.check())
+	require.Equal(t, "first", loader.current().Leaf.Subject.CommonName)
+
+	rotateCert(t, dir, ca.issue(t, "second"), 2)
+	require.True(t, loader.check())
+	require.Equal(t, "second", loader.current().Leaf.Subject.CommonName)
+
+	// the files are checked again during a handshake once the interval has passed
+	interval := certCheckInterval
+	certCheckInterval = 0
+	defer func() { certCheckInterval = interval }()
+
+	rotateCert(t, dir, ca.issue(t, "third"), 3)
+	cert, err := loader.getCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	require.Equal(t, "third", cert.Leaf.Subject.CommonName)
+}
+
+func TestHTTPCertificateReload(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "certreload_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	interval := certCheckInterval
+	certCheckInterval = 0
+	defer func() { certCheckInterval = interval }()
+
+	ca := newTestCA(t)
+	certFile, keyFile := writeCertPEM(t, dir, ca.issue(t, "first", "localhost"))
+
+	config := conf.DefaultServerConfig()
+	config.HTTP.Port = 0
+	config.HTTP.TLS = conf.TLSConf{Cert: certFile, Key: keyFile}
+	server := NewAccountServer()
+	server.InitializeFromConfig(config)
+	require.NoError(t, server.Start())
+	defer server.Stop()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	newClient := func() *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	}
+	url := fmt.Sprintf("https://localhost:%d/jwt/v1/help", server.Port())
+
+	peerName := func(client *http.Client) string {
+		resp, err := client.Get(url)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		ioutil.ReadAll(resp.Body)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		return resp.TLS.PeerCertificates[0].Subject.CommonName
+	}
+
+	open := newClient()
+	require.Equal(t, "first", peerName(open))
+
+	rotateCert(t, dir, ca.issue(t, "second", "localhost"), 1)
+
+	// new connections get the new certificate, the open one isn't dropped
+	require.Equal(t, "second", peerName(newClient()))
+	require.Equal(t, "first", peerName(open))
+
+	// a broken rotation keeps serving the last good certificate
+	require.NoError(t, ioutil.WriteFile(keyFile, []byte("not a key"), 0600))
+	later := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(keyFile, later, later))
+	require.Equal(t, "second", peerName(newClient()))
+}
+
+func TestNATSClientCertificateReload(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "certreload_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	interval := certCheckInterval
+	certCheckInterval = 50 * time.Millisecond
+	defer func() { certCheckInterval = interval }()
+
+	ca := newTestCA(t)
+	caFile := ca.writePEM(t, dir)
+	serverCert := ca.issue(t, "localhost", "localhost")
+	certFile, keyFile := writeCertPEM(t, dir, ca.issue(t, "first"))
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	var seenLock sync.Mutex
+	seen := []string{}
+	natsServer, url := runWebsocketNATS(t, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+		VerifyPeerCertificate: func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+			seenLock.Lock()
+			seen = append(seen, chains[0][0].Subject.CommonName)
+			seenLock.Unlock()
+			return nil
+		},
+	})
+	defer natsServer.Shutdown()
+
+	config := conf.DefaultServerConfig()
+	config.HTTP.Port = 0
+	config.NATS.Servers = []string{url}
+	config.NATS.TLS = conf.TLSConf{Root: caFile, Cert: certFile, Key: keyFile}
+
+	server := NewAccountServer()
+	server.InitializeFromConfig(config)
+	require.NoError(t, server.Start())
+	defer server.Stop()
+
+	first := server.getNatsConnection()
+	require.NotNil(t, first)
+	require.True(t, first.IsConnected())
+
+	rotateCert(t, dir, ca.issue(t, "second"), 1)
+
+	var replaced bool
+	for i := 0; i < 100 && !replaced; i++ {
+		time.Sleep(50 * time.Millisecond)
+		nc := server.getNatsConnection()
+		replaced = nc != nil && nc != first && nc.IsConnected()
+	}
+	require.True(t, replaced)
+
+	seenLock.Lock()
+	defer seenLock.Unlock()
+	require.Equal(t, []string{"first", "second"}, seen)
+}
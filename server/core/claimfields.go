@@ -0,0 +1,133 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/nats-io/jwt"
+)
+
+// natsClaimsField holds the nats specific part of a claim, its fields are selected like the standard ones
+const natsClaimsField = "nats"
+
+// headerField and hashIDField are added to decoded activations, they aren't claims so they can't be selected
+const (
+	headerField = "header"
+	hashIDField = "hash_id"
+)
+
+var accountClaimFields = selectableClaimFields(reflect.TypeOf(jwt.AccountClaims{}))
+
+var activationClaimFields = selectableClaimFields(reflect.TypeOf(jwt.ActivationClaims{}))
+
+// selectableClaimFields lists the JSON names that can be selected from a claim type, the standard claims
+// and the fields in its nats section, sorted
+func selectableClaimFields(t reflect.Type) []string {
+	fields := []string{}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+
+		if (field.Anonymous && name == "") || (name == natsClaimsField && field.Type.Kind() == reflect.Struct) {
+			fields = append(fields, selectableClaimFields(field.Type)...)
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+		fields = append(fields, name)
+	}
+
+	sort.Strings(fields)
+	return fields
+}
+
+// parseClaimFields splits a comma separated list of fields, checking each one is valid
+func parseClaimFields(list string, valid []string) ([]string, error) {
+	if list == "" {
+		return nil, nil
+	}
+
+	fields := []string{}
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		i := sort.SearchStrings(valid, field)
+		if i == len(valid) || valid[i] != field {
+			return nil, fmt.Errorf("unknown field %q, valid fields are %s", field, strings.Join(valid, ", "))
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// projectClaims converts a claim to a map with only the selected fields, fields from the nats
+// section are moved up next to the standard claims. Fields that aren't set in the claim are left
+// out. Without any fields the whole claim is returned as it appears in the JWT.
+func projectClaims(claims interface{}, fields []string) (map[string]interface{}, error) {
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	all := map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber() // keeps large limits and times exact
+	if err := decoder.Decode(&all); err != nil {
+		return nil, err
+	}
+
+	if len(fields) == 0 {
+		return all, nil
+	}
+
+	flat := map[string]interface{}{}
+	for name, value := range all {
+		if section, ok := value.(map[string]interface{}); ok && name == natsClaimsField {
+			for subName, subValue := range section {
+				flat[subName] = subValue
+			}
+			continue
+		}
+		flat[name] = value
+	}
+
+	selected := map[string]interface{}{}
+	for _, field := range fields {
+		if value, ok := flat[field]; ok {
+			selected[field] = value
+		}
+	}
+	return selected, nil
+}
@@ -0,0 +1,219 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectableClaimFields(t *testing.T) {
+	require.Equal(t, []string{
+		"aud", "exp", "exports", "iat", "identity", "imports", "iss", "jti",
+		"limits", "name", "nbf", "revocations", "signing_keys", "sub", "tags", "type",
+	}, accountClaimFields)
+
+	require.Equal(t, accountClaimFields, selectableClaimFields(reflect.TypeOf(&jwt.AccountClaims{})))
+}
+
+func TestParseClaimFields(t *testing.T) {
+	fields, err := parseClaimFields("", accountClaimFields)
+	require.NoError(t, err)
+	require.Empty(t, fields)
+
+	fields, err = parseClaimFields("exports, limits,,signing_keys", accountClaimFields)
+	require.NoError(t, err)
+	require.Equal(t, []string{"exports", "limits", "signing_keys"}, fields)
+
+	_, err = parseClaimFields("exports,nats", accountClaimFields)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `"nats"`)
+	require.Contains(t, err.Error(), "signing_keys")
+}
+
+func TestProjectClaims(t *testing.T) {
+	account := jwt.NewAccountClaims("ADECCNBUEBWZ727OMBFSN7OMK2FPYRM52TJS25TFQWYS76NPOJBN3KU4")
+	account.Name = "projected"
+	account.Expires = 1 << 50
+	account.Exports = append(account.Exports,
+		&jwt.Export{Name: "times", Subject: "times.*", Type: jwt.Stream},
+		&jwt.Export{Name: "clock", Subject: "clock", Type: jwt.Service, TokenReq: true},
+	)
+
+	all, err := projectClaims(account, nil)
+	require.NoError(t, err)
+	require.Equal(t, "projected", all["name"])
+	require.Contains(t, all, "nats")
+	require.NotContains(t, all, "exports")
+
+	selected, err := projectClaims(account, []string{"exports", "limits", "exp", "signing_keys"})
+	require.NoError(t, err)
+	require.Len(t, selected, 3) // no signing keys are set
+
+	exports := selected["exports"].([]interface{})
+	require.Len(t, exports, 2)
+	require.Equal(t, map[string]interface{}{"name": "clock", "subject": "clock", "type": "service", "token_req": true}, exports[1])
+
+	require.Equal(t, json.Number(fmt.Sprint(int64(1<<50))), selected["exp"])
+	require.Equal(t, json.Number("-1"), selected["limits"].(map[string]interface{})["subs"])
+}
+
+func TestDecodedAccountFields(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+	signingKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	signingPubKey, err := signingKey.PublicKey()
+	require.NoError(t, err)
+
+	account := jwt.NewAccountClaims(pubKey)
+	account.SigningKeys.Add(signingPubKey)
+	account.Exports = append(account.Exports, &jwt.Export{Subject: "times.*", Type: jwt.Stream})
+	acctJWT, err := account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	resp, err := testEnv.HTTP.Post(testEnv.URLForPath("/jwt/v1/accounts/"+pubKey), "application/json", bytes.NewBuffer([]byte(acctJWT)))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	get := func(query string) (*http.Response, string) {
+		resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/accounts/" + pubKey + query))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+
+	resp, body := get("?decode=true&fields=exports,signing_keys")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, ApplicationJSON, resp.Header.Get(ContentType))
+	require.False(t, strings.Contains(strings.TrimSpace(body), "\n"))
+
+	selected := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal([]byte(body), &selected))
+	require.Len(t, selected, 2)
+	require.Equal(t, []interface{}{signingPubKey}, selected["signing_keys"])
+	require.Equal(t, "times.*", selected["exports"].([]interface{})[0].(map[string]interface{})["subject"])
+
+	resp, body = get("?decode=true&pretty=true")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.True(t, strings.Contains(body, "\n    \"nats\": {"))
+
+	all := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal([]byte(body), &all))
+	require.Equal(t, pubKey, all["sub"])
+
+	resp, body = get("?decode=true&fields=exports,bogus")
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	var apiErr errorResponse
+	require.NoError(t, json.Unmarshal([]byte(body), &apiErr))
+	require.Equal(t, CodeBadRequest, apiErr.Code)
+	require.True(t, strings.Contains(apiErr.Message, `unknown field "bogus"`))
+	require.True(t, strings.Contains(apiErr.Message, "signing_keys"))
+
+	// without fields or pretty the decoded view is unchanged
+	resp, body = get("?decode=true")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.True(t, strings.Contains(body, `"alg": "ed25519"`))
+}
+
+func TestDecodedActivationFields(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	exporterKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	exporter, err := exporterKey.PublicKey()
+	require.NoError(t, err)
+	importerKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	importer, err := importerKey.PublicKey()
+	require.NoError(t, err)
+
+	act := jwt.NewActivationClaims(importer)
+	act.ImportType = jwt.Stream
+	act.ImportSubject = "times.*"
+	act.Expires = time.Now().Add(time.Hour).Unix()
+	actJWT, err := act.Encode(exporterKey)
+	require.NoError(t, err)
+	hash, err := act.HashID()
+	require.NoError(t, err)
+	require.NoError(t, testEnv.Server.saveJWT(hash, actJWT))
+
+	get := func(query string) (*http.Response, string) {
+		resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/activations/" + hash + query))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+
+	resp, body := get("?decode=true&pretty=true")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, ApplicationJSON, resp.Header.Get(ContentType))
+
+	all := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal([]byte(body), &all))
+	require.Equal(t, importer, all["sub"])
+	require.Equal(t, exporter, all["iss"])
+	require.Equal(t, hash, all["hash_id"])
+	require.Equal(t, map[string]interface{}{"typ": "jwt", "alg": "ed25519"}, all["header"])
+	require.Equal(t, "times.*", all["nats"].(map[string]interface{})["subject"])
+
+	// the header and hash are added to the selected fields
+	resp, body = get("?decode=true&fields=exp,subject")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.False(t, strings.Contains(strings.TrimSpace(body), "\n"))
+
+	selected := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal([]byte(body), &selected))
+	require.Len(t, selected, 4)
+	require.Equal(t, "times.*", selected["subject"])
+	require.Equal(t, float64(act.Expires), selected["exp"])
+	require.Equal(t, hash, selected["hash_id"])
+
+	resp, body = get("?decode=true&fields=limits")
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.True(t, strings.Contains(body, `unknown field \"limits\"`))
+
+	// text still returns the raw JWT
+	resp, body = get("?text=true&pretty=true")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, actJWT, body)
+}
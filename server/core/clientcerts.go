@@ -0,0 +1,134 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/logging"
+)
+
+// checkClientCertConfig returns an error if the client certificate settings can't be used
+func checkClientCertConfig(config conf.HTTPConfig) error {
+	certs := config.ClientCerts
+
+	if certs.RequireForWrites && (config.TLS.Cert == "" || certs.CA == "") {
+		return fmt.Errorf("client certificates for writes need TLS and a client CA")
+	}
+
+	if len(certs.Allowed) > 0 && !certs.RequireForWrites {
+		return fmt.Errorf("allowed client certificates are only checked when they are required for writes")
+	}
+
+	for _, pattern := range certs.Allowed {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("bad client certificate pattern %q, %s", pattern, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// addClientCA asks clients for a certificate and verifies the ones they send, clients
+// without one can still connect so read only requests keep working
+func addClientCA(tlsConfig *tls.Config, caFile string) error {
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return fmt.Errorf("unable to read client CA, %s", err.Error())
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("no certificates found in client CA %s", caFile)
+	}
+
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	return nil
+}
+
+// clientCertNames returns the names a client certificate can be matched by
+func clientCertNames(cert *x509.Certificate) []string {
+	names := []string{cert.Subject.String()}
+
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+
+	return names
+}
+
+// clientCertAllowed checks the certificate against the patterns, no patterns allows any
+// verified certificate
+func clientCertAllowed(cert *x509.Certificate, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	for _, name := range clientCertNames(cert) {
+		for _, pattern := range allowed {
+			if matched, _ := path.Match(pattern, name); matched {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// requireClientCert wraps a handler that changes the store, if the config requires it
+// requests without an allowed, verified, client certificate get a 403
+func (server *AccountServer) requireClientCert(handle httprouter.Handle) httprouter.Handle {
+	certs := server.config.HTTP.ClientCerts
+	if !certs.RequireForWrites {
+		return handle
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+			server.sendErrorResponse(http.StatusForbidden, "a verified client certificate is required", "", nil, w)
+			return
+		}
+
+		cert := r.TLS.VerifiedChains[0][0]
+		if !clientCertAllowed(cert, certs.Allowed) {
+			server.logger.WithFields(logging.Fields{"subject": cert.Subject.String()}).Tracef("client certificate for %s is not allowed", cert.Subject.String())
+			server.sendErrorResponse(http.StatusForbidden, "client certificate is not allowed", "", nil, w)
+			return
+		}
+
+		handle(w, r, params)
+	}
+}
@@ -0,0 +1,210 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+// testCA signs client certificates for tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test client ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) writePEM(t *testing.T, dir string) string {
+	path := filepath.Join(dir, "client-ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+	require.NoError(t, ioutil.WriteFile(path, data, 0644))
+	return path
+}
+
+func (ca *testCA) issue(t *testing.T, commonName string, dnsNames ...string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"nats"}},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func clientWithCert(cert *tls.Certificate) *http.Client {
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	if cert != nil {
+		tlsConfig.Certificates = []tls.Certificate{*cert}
+	}
+	return &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		Timeout:   5 * time.Second,
+	}
+}
+
+func TestCheckClientCertConfig(t *testing.T) {
+	config := conf.HTTPConfig{}
+	require.NoError(t, checkClientCertConfig(config))
+
+	config.ClientCerts.RequireForWrites = true
+	require.Error(t, checkClientCertConfig(config))
+
+	config.TLS.Cert = certFile
+	require.Error(t, checkClientCertConfig(config))
+
+	config.ClientCerts.CA = "ca.pem"
+	require.NoError(t, checkClientCertConfig(config))
+
+	config.ClientCerts.Allowed = []string{"[bad"}
+	require.Error(t, checkClientCertConfig(config))
+
+	config.ClientCerts.Allowed = []string{"*.example.com"}
+	require.NoError(t, checkClientCertConfig(config))
+
+	config.ClientCerts.RequireForWrites = false
+	require.Error(t, checkClientCertConfig(config))
+}
+
+func TestClientCertAllowed(t *testing.T) {
+	ca := newTestCA(t)
+	tlsCert := ca.issue(t, "writer", "nsc.writers.example.com")
+	cert, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	require.NoError(t, err)
+
+	require.True(t, clientCertAllowed(cert, nil))
+	require.True(t, clientCertAllowed(cert, []string{"writer"}))
+	require.True(t, clientCertAllowed(cert, []string{"other", "*.writers.example.com"}))
+	require.True(t, clientCertAllowed(cert, []string{"CN=writer,O=nats"}))
+	require.False(t, clientCertAllowed(cert, []string{"reader", "*.readers.example.com"}))
+}
+
+func TestClientCertsForWrites(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "clientcerts_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+
+	config := conf.DefaultServerConfig()
+	config.HTTP.ClientCerts = conf.ClientCertConfig{
+		CA:               ca.writePEM(t, dir),
+		RequireForWrites: true,
+		Allowed:          []string{"*.writers.example.com"},
+	}
+
+	testEnv, err := SetupTestServer(config, true, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+	acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	url := testEnv.URLForPath("/jwt/v1/accounts/" + pubKey)
+	post := func(client *http.Client) int {
+		resp, err := client.Post(url, "application/json", bytes.NewBuffer([]byte(acctJWT)))
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// no certificate
+	noCert := clientWithCert(nil)
+	require.Equal(t, http.StatusForbidden, post(noCert))
+
+	// a verified certificate that doesn't match
+	reader := ca.issue(t, "reader", "nsc.readers.example.com")
+	require.Equal(t, http.StatusForbidden, post(clientWithCert(&reader)))
+
+	writer := ca.issue(t, "writer", "nsc.writers.example.com")
+	require.Equal(t, http.StatusOK, post(clientWithCert(&writer)))
+
+	// reads don't need a certificate
+	resp, err := noCert.Get(url)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// certificates from another CA fail the handshake
+	other := newTestCA(t).issue(t, "writer", "nsc.writers.example.com")
+	_, err = clientWithCert(&other).Post(url, "application/json", bytes.NewBuffer([]byte(acctJWT)))
+	require.Error(t, err)
+}
+
+func TestClientCertsNeedTLS(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.HTTP.ClientCerts = conf.ClientCertConfig{
+		CA:               caFile,
+		RequireForWrites: true,
+	}
+
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.Error(t, err)
+}
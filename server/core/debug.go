@@ -0,0 +1,178 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+)
+
+// the number of stored JWTs listed by /debug/cache
+const (
+	defaultDebugLargest = 10
+	maxDebugLargest     = 1000
+)
+
+// debugJWT is a stored JWT and its size
+type debugJWT struct {
+	Key  string `json:"key"`
+	Size int    `json:"size"`
+}
+
+// debugCache is the body for /debug/cache
+type debugCache struct {
+	Entries     int        `json:"entries"`
+	Stale       int        `json:"stale"`
+	NeverStale  int        `json:"never_stale"`
+	Refreshing  int        `json:"refreshing"`
+	Hot         int        `json:"hot"`
+	SeenJTIs    int        `json:"seen_jtis"`
+	Dirty       int        `json:"dirty"`
+	Stored      int        `json:"stored"`
+	StoredBytes int64      `json:"stored_bytes"`
+	Largest     []debugJWT `json:"largest"`
+}
+
+// startDebug serves pprof and /debug/cache on their own listener if Debug.Port is set, the
+// server lock is held
+func (server *AccountServer) startDebug(config conf.DebugConfig) error {
+	if config.Port == 0 {
+		return nil
+	}
+
+	hp := net.JoinHostPort(config.Host, strconv.Itoa(config.Port))
+	listener, err := net.Listen("tcp", hp)
+	if err != nil {
+		return fmt.Errorf("unable to listen for debug requests, %s", err.Error())
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/cache", server.GetDebugCache)
+
+	debugServer := &http.Server{Handler: mux}
+	go debugServer.Serve(listener)
+	server.debugServer = debugServer
+
+	if ip := net.ParseIP(config.Host); config.Host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		server.logger.Warnf("debug endpoints on %s can be reached from other machines", listener.Addr())
+	}
+	server.logger.Noticef("debug endpoints listening on %s", listener.Addr())
+	return nil
+}
+
+// stopDebug closes the debug listener, profiles in progress are cut off
+func (server *AccountServer) stopDebug() {
+	if server.debugServer == nil {
+		return
+	}
+	server.debugServer.Close()
+	server.debugServer = nil
+}
+
+// GetDebugCache returns the sizes of the replica cache and the other in memory state, with the
+// largest JWTs in the store, the limit query parameter sets how many are listed
+func (server *AccountServer) GetDebugCache(w http.ResponseWriter, r *http.Request) {
+	limit := defaultDebugLargest
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			server.sendErrorResponse(http.StatusBadRequest, fmt.Sprintf("bad limit %q", value), "", err, w)
+			return
+		}
+		limit = parsed
+	}
+	if limit > maxDebugLargest {
+		limit = maxDebugLargest
+	}
+
+	now := time.Now()
+	resp := debugCache{Largest: []debugJWT{}}
+
+	server.cacheLock.Lock()
+	resp.Entries = len(server.validUntil)
+	for _, staleAt := range server.validUntil {
+		if staleAt.IsZero() {
+			resp.NeverStale++
+		} else if staleAt.Before(now) {
+			resp.Stale++
+		}
+	}
+	resp.Refreshing = len(server.refreshing)
+	server.cacheLock.Unlock()
+
+	server.hits.Lock()
+	resp.Hot = len(server.hits.jwts)
+	server.hits.Unlock()
+
+	server.seenNotifications.Lock()
+	resp.SeenJTIs = len(server.seenNotifications.jtis)
+	server.seenNotifications.Unlock()
+
+	resp.Dirty = server.dirty.size()
+
+	server.Lock()
+	jwtStore := server.jwtStore
+	server.Unlock()
+
+	if jwtStore != nil {
+		sizes := []debugJWT{}
+		err := jwtStore.Iterate(func(key string, theJWT string) error {
+			resp.Stored++
+			resp.StoredBytes += int64(len(theJWT))
+			sizes = append(sizes, debugJWT{Key: key, Size: len(theJWT)})
+			return nil
+		})
+		if err != nil {
+			server.sendError(http.StatusInternalServerError, CodeStoreError, "unable to read the store", "", err, w)
+			return
+		}
+
+		sort.Slice(sizes, func(i, j int) bool {
+			if sizes[i].Size != sizes[j].Size {
+				return sizes[i].Size > sizes[j].Size
+			}
+			return sizes[i].Key < sizes[j].Key
+		})
+		if len(sizes) > limit {
+			sizes = sizes[:limit]
+		}
+		resp.Largest = sizes
+	}
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		server.sendErrorResponse(http.StatusInternalServerError, "unable to encode the cache details", "", err, w)
+		return
+	}
+
+	w.Header().Set(ContentType, ApplicationJSON)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(data)
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDebugOffByDefault(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+	require.Nil(t, testEnv.Server.debugServer)
+
+	resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/debug/pprof/"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestDebugEndpoints(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Debug.Port = int(atomic.AddUint64(&port, 1))
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	jwts := saveTestAccounts(t, testEnv, 3)
+	big := strings.Repeat("x", 5000)
+	require.NoError(t, testEnv.Server.jwtStore.Save("big", big))
+
+	testEnv.Server.cacheLock.Lock()
+	testEnv.Server.validUntil["a"] = time.Now().Add(-time.Minute)
+	testEnv.Server.validUntil["b"] = time.Time{}
+	testEnv.Server.validUntil["c"] = time.Now().Add(time.Minute)
+	testEnv.Server.cacheLock.Unlock()
+
+	debugURL := fmt.Sprintf("http://localhost:%d", config.Debug.Port)
+
+	resp, err := testEnv.HTTP.Get(debugURL + "/debug/pprof/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = testEnv.HTTP.Get(debugURL + "/debug/cache?limit=2")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, ApplicationJSON, resp.Header.Get(ContentType))
+
+	var cache debugCache
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&cache))
+	require.Equal(t, 3, cache.Entries)
+	require.Equal(t, 1, cache.Stale)
+	require.Equal(t, 1, cache.NeverStale)
+	require.Equal(t, len(jwts)+1, cache.Stored)
+	require.Len(t, cache.Largest, 2)
+	require.Equal(t, debugJWT{Key: "big", Size: len(big)}, cache.Largest[0])
+
+	resp, err = testEnv.HTTP.Get(debugURL + "/debug/cache?limit=abc")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// stopping closes the debug listener
+	testEnv.Server.Stop()
+	_, err = testEnv.HTTP.Get(debugURL + "/debug/cache")
+	require.Error(t, err)
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nats-io/jwt"
+	nats "github.com/nats-io/nats.go"
+)
+
+// seenJTIsSize is the number of notification JTIs remembered, the oldest are forgotten first
+const seenJTIsSize = 1024
+
+// InstanceHeader carries the random id of the server that published a notification, so a server
+// subscribed to its own notification subjects can drop them
+const InstanceHeader = "Nats-Account-Server-Instance"
+
+// instanceReplyPrefix marks notifications on connections without headers, the reply subject is
+// the prefix and the instance id, nothing answers on it
+const instanceReplyPrefix = "_NAS_INSTANCE."
+
+// seenJTIs remembers the JTIs of recent notifications, so one that arrives again, from a loop
+// through leafnodes or our own publish, can be dropped even if the store has moved on
+type seenJTIs struct {
+	sync.Mutex
+	max  int
+	jtis map[string]*list.Element
+	lru  *list.List
+}
+
+func newSeenJTIs(max int) *seenJTIs {
+	return &seenJTIs{
+		max:  max,
+		jtis: map[string]*list.Element{},
+		lru:  list.New(),
+	}
+}
+
+// seen is true if the JTI was added recently
+func (seen *seenJTIs) seen(jti string) bool {
+	seen.Lock()
+	defer seen.Unlock()
+
+	element, ok := seen.jtis[jti]
+	if ok {
+		seen.lru.MoveToFront(element)
+	}
+	return ok
+}
+
+func (seen *seenJTIs) add(jti string) {
+	if jti == "" {
+		return
+	}
+
+	seen.Lock()
+	defer seen.Unlock()
+
+	if element, ok := seen.jtis[jti]; ok {
+		seen.lru.MoveToFront(element)
+		return
+	}
+
+	seen.jtis[jti] = seen.lru.PushFront(jti)
+	for seen.lru.Len() > seen.max {
+		oldest := seen.lru.Back()
+		seen.lru.Remove(oldest)
+		delete(seen.jtis, oldest.Value.(string))
+	}
+}
+
+// duplicateNotification is true, and counts the notification, if its JTI was seen recently or
+// stored reports that the store already has it
+func (server *AccountServer) duplicateNotification(jti string, stored func() bool) bool {
+	if !server.seenNotifications.seen(jti) && !stored() {
+		return false
+	}
+
+	server.seenNotifications.add(jti)
+	atomic.AddUint64(&server.metrics.notificationsDuplicate, 1)
+	return true
+}
+
+// confirmReplicated resets the stale time for a key on a replica, a copy of the stored JWT in a
+// notification shows it is still current
+func (server *AccountServer) confirmReplicated(key string, cacheTTL int) {
+	if primaries, _ := server.currentPrimaries(); primaries != nil {
+		server.markValid(key, cacheTTL)
+	}
+}
+
+// storedJTI is true if the JWT stored under key has the JTI
+func (server *AccountServer) storedJTI(key string, jti string) bool {
+	stored, err := server.jwtStore.Load(key)
+	if err != nil {
+		return false
+	}
+
+	claims, err := jwt.DecodeGeneric(stored)
+	return err == nil && claims.ID == jti
+}
+
+// fromSelf is true for a notification this server published
+func (server *AccountServer) fromSelf(msg *nats.Msg) bool {
+	if server.instanceID == "" {
+		return false
+	}
+	if msg.Header != nil && msg.Header.Get(InstanceHeader) == server.instanceID {
+		return true
+	}
+	return msg.Reply == instanceReplyPrefix+server.instanceID
+}
+
+// publishMarked publishes a notification, for servers without headers, with the instance id in
+// the reply subject
+func (server *AccountServer) publishMarked(nc *nats.Conn, subject string, data []byte) error {
+	if server.instanceID == "" {
+		return server.publish(nc, subject, data)
+	}
+
+	err := nc.PublishRequest(subject, instanceReplyPrefix+server.instanceID, data)
+	server.natsState.published(err)
+	return err
+}
+
+// publishJWT publishes a notification with the JWT's JTI in the Nats-Msg-Id header, so
+// receivers, and JetStream, can drop copies, along with the instance id and the trace headers
+// of the request that sent it. Servers without headers get the JWT alone, with the instance id
+// in the reply subject.
+func (server *AccountServer) publishJWT(nc *nats.Conn, subject string, theJWT []byte, trace nats.Header) error {
+	if !nc.HeadersSupported() {
+		return server.publishMarked(nc, subject, theJWT)
+	}
+
+	msg := nats.NewMsg(subject)
+	msg.Data = theJWT
+	for key, values := range trace {
+		msg.Header[key] = values
+	}
+	if claims, err := jwt.DecodeGeneric(string(theJWT)); err == nil && claims.ID != "" {
+		msg.Header.Set(nats.MsgIdHdr, claims.ID)
+	}
+	if server.instanceID != "" {
+		msg.Header.Set(InstanceHeader, server.instanceID)
+	}
+
+	return server.publishMsg(nc, msg)
+}
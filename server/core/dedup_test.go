@@ -0,0 +1,230 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"bytes"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/store"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+// countingStore counts the saves that reach the store
+type countingStore struct {
+	store.JWTStore
+	saves int32
+}
+
+func (s *countingStore) Save(publicKey string, theJWT string) error {
+	atomic.AddInt32(&s.saves, 1)
+	return s.JWTStore.Save(publicKey, theJWT)
+}
+
+func TestSeenJTIs(t *testing.T) {
+	seen := newSeenJTIs(2)
+	seen.add("a")
+	seen.add("b")
+	seen.add("")
+	require.True(t, seen.seen("a"))
+
+	// b is the oldest now that a was seen
+	seen.add("c")
+	require.True(t, seen.seen("a"))
+	require.False(t, seen.seen("b"))
+	require.True(t, seen.seen("c"))
+	require.False(t, seen.seen(""))
+}
+
+func TestDuplicateAccountNotifications(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	server := testEnv.Server
+	counting := &countingStore{JWTStore: server.jwtStore}
+	server.Lock()
+	server.jwtStore = counting
+	server.Unlock()
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+
+	account := jwt.NewAccountClaims(pubKey)
+	first, err := account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	account.Name = "changed"
+	second, err := account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	server.handleAccountNotification(&nats.Msg{Data: []byte(first)})
+	require.Equal(t, int32(1), atomic.LoadInt32(&counting.saves))
+
+	// the stored JWT again
+	server.handleAccountNotification(&nats.Msg{Data: []byte(first)})
+	require.Equal(t, int32(1), atomic.LoadInt32(&counting.saves))
+
+	server.handleAccountNotification(&nats.Msg{Data: []byte(second)})
+	require.Equal(t, int32(2), atomic.LoadInt32(&counting.saves))
+
+	// an older JWT looping back is dropped because its JTI was seen
+	server.handleAccountNotification(&nats.Msg{Data: []byte(first)})
+	require.Equal(t, int32(2), atomic.LoadInt32(&counting.saves))
+	require.Equal(t, uint64(2), atomic.LoadUint64(&server.metrics.notificationsDuplicate))
+
+	stored, err := server.jwtStore.Load(pubKey)
+	require.NoError(t, err)
+	require.Equal(t, second, stored)
+}
+
+func TestDuplicateActivationNotifications(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	server := testEnv.Server
+	counting := &countingStore{JWTStore: server.jwtStore}
+	server.Lock()
+	server.jwtStore = counting
+	server.Unlock()
+
+	exporter, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	_, importer, _ := CreateAccountKey(t)
+
+	act := jwt.NewActivationClaims(importer)
+	act.ImportType = jwt.Stream
+	act.ImportSubject = "times.*"
+	actJWT, err := act.Encode(exporter)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		server.handleActivationNotification(&nats.Msg{Data: []byte(actJWT), Subject: "test"})
+	}
+	require.Equal(t, int32(1), atomic.LoadInt32(&counting.saves))
+	require.Equal(t, uint64(2), atomic.LoadUint64(&server.metrics.notificationsDuplicate))
+}
+
+func TestNotificationsHaveMsgID(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+	acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	claim, err := jwt.DecodeAccountClaims(acctJWT)
+	require.NoError(t, err)
+
+	notifications, err := testEnv.NC.SubscribeSync(testEnv.Server.accountNotificationSubject(pubKey))
+	require.NoError(t, err)
+	require.NoError(t, testEnv.NC.Flush())
+
+	resp, err := testEnv.HTTP.Post(testEnv.URLForPath("/jwt/v1/accounts/"+pubKey), "application/json", bytes.NewBuffer([]byte(acctJWT)))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	msg, err := notifications.NextMsg(5 * time.Second)
+	require.NoError(t, err)
+	require.Equal(t, acctJWT, string(msg.Data))
+	require.Equal(t, claim.ID, msg.Header.Get(nats.MsgIdHdr))
+}
+
+func TestSelfPublishedNotifications(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	server := testEnv.Server
+	require.NotEmpty(t, server.instanceID)
+	require.NotEqual(t, server.instanceID, NewAccountServer().instanceID)
+
+	counting := &countingStore{JWTStore: server.jwtStore}
+	server.Lock()
+	server.jwtStore = counting
+	server.Unlock()
+
+	newAccount := func() (string, string) {
+		_, pubKey, _ := CreateAccountKey(t)
+		acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+		require.NoError(t, err)
+		return pubKey, acctJWT
+	}
+
+	// our own notifications are dropped, with headers or the reply marker
+	_, acctJWT := newAccount()
+	mine := nats.NewMsg("test")
+	mine.Data = []byte(acctJWT)
+	mine.Header.Set(InstanceHeader, server.instanceID)
+	server.handleAccountNotification(mine)
+	server.handleAccountNotification(&nats.Msg{Data: []byte(acctJWT), Reply: instanceReplyPrefix + server.instanceID})
+	require.Equal(t, int32(0), atomic.LoadInt32(&counting.saves))
+
+	// other instances are processed as before
+	theirs := nats.NewMsg("test")
+	theirs.Data = []byte(acctJWT)
+	theirs.Header.Set(InstanceHeader, "other")
+	server.handleAccountNotification(theirs)
+	require.Equal(t, int32(1), atomic.LoadInt32(&counting.saves))
+
+	_, acctJWT = newAccount()
+	server.handleAccountNotification(&nats.Msg{Data: []byte(acctJWT), Reply: instanceReplyPrefix + "other"})
+	require.Equal(t, int32(2), atomic.LoadInt32(&counting.saves))
+
+	pubKey, _ := newAccount()
+	server.handleAccountDeleteNotification(&nats.Msg{Subject: server.deleteNotificationSubject(pubKey), Data: []byte(pubKey), Reply: instanceReplyPrefix + server.instanceID})
+	require.Equal(t, int32(2), atomic.LoadInt32(&counting.saves))
+
+	// the published notifications carry the id
+	received := make(chan *nats.Msg, 2)
+	_, err = testEnv.NC.Subscribe("self.>", func(m *nats.Msg) {
+		received <- m
+	})
+	require.NoError(t, err)
+	require.NoError(t, testEnv.NC.Flush())
+
+	nc := server.getNatsConnection()
+	require.NoError(t, server.publishJWT(nc, "self.headers", []byte(acctJWT), nil))
+	require.NoError(t, server.publishMarked(nc, "self.noheaders", []byte(acctJWT)))
+
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-received:
+			require.True(t, server.fromSelf(msg), msg.Subject)
+			if msg.Subject == "self.headers" {
+				require.Equal(t, server.instanceID, msg.Header.Get(InstanceHeader))
+			} else {
+				require.Equal(t, instanceReplyPrefix+server.instanceID, msg.Reply)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("notification not received")
+		}
+	}
+}
@@ -0,0 +1,239 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/logging"
+)
+
+const (
+	dirtyAccount    = "account"
+	dirtyActivation = "activation"
+
+	// saves from notifications are tried this many times before the JWT is marked dirty
+	notificationSaveAttempts = 3
+
+	// maxDirtyJWTs bounds the failed saves kept for the status and retries, the oldest go first
+	maxDirtyJWTs = 100
+)
+
+// notificationSaveBackoff is the wait before the second save attempt, it doubles after that
+var notificationSaveBackoff = 100 * time.Millisecond
+
+// dirtyJWT is a JWT from a notification that couldn't be saved, the store has an older
+// version, or none, until it is saved
+type dirtyJWT struct {
+	Key      string    `json:"key"`
+	Kind     string    `json:"kind"`
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failed_at"`
+	jwt      string
+}
+
+// dirtyList holds the latest failed save for each key, in the order the keys first failed
+type dirtyList struct {
+	sync.Mutex
+	entries map[string]dirtyJWT
+	order   []string
+}
+
+func newDirtyList() *dirtyList {
+	return &dirtyList{
+		entries: map[string]dirtyJWT{},
+	}
+}
+
+// add records a failed save, replacing an older one for the key. If the list is full the
+// oldest keys are dropped and returned.
+func (d *dirtyList) add(entry dirtyJWT, max int) (dropped []string) {
+	d.Lock()
+	defer d.Unlock()
+
+	if _, ok := d.entries[entry.Key]; ok {
+		d.entries[entry.Key] = entry
+		return nil
+	}
+
+	for len(d.order) >= max {
+		dropped = append(dropped, d.order[0])
+		delete(d.entries, d.order[0])
+		d.order = d.order[1:]
+	}
+
+	d.entries[entry.Key] = entry
+	d.order = append(d.order, entry.Key)
+	return dropped
+}
+
+// remove forgets the key, called whenever a JWT for it is saved
+func (d *dirtyList) remove(key string) {
+	d.Lock()
+	defer d.Unlock()
+
+	if _, ok := d.entries[key]; !ok {
+		return
+	}
+
+	delete(d.entries, key)
+	for i, k := range d.order {
+		if k == key {
+			d.order = append(d.order[:i], d.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// list returns the failed saves in order
+func (d *dirtyList) list() []dirtyJWT {
+	d.Lock()
+	defer d.Unlock()
+
+	entries := make([]dirtyJWT, 0, len(d.order))
+	for _, key := range d.order {
+		entries = append(entries, d.entries[key])
+	}
+	return entries
+}
+
+func (d *dirtyList) size() int {
+	d.Lock()
+	defer d.Unlock()
+	return len(d.order)
+}
+
+// saveNotifiedJWT saves a JWT from a NATS notification, retrying with backoff so a short store
+// outage doesn't lose the update. If every attempt fails the JWT is logged, counted and kept in
+// the dirty list, so operators can see which keys are stale and retry them.
+func (server *AccountServer) saveNotifiedJWT(kind string, key string, theJWT string) error {
+	wait := notificationSaveBackoff
+	var err error
+
+	for attempt := 1; attempt <= notificationSaveAttempts; attempt++ {
+		if err = server.saveJWT(key, theJWT); err == nil {
+			return nil
+		}
+		// retrying won't make room in a full store
+		if _, full := err.(storeFullError); full {
+			break
+		}
+		atomic.AddUint64(&server.metrics.storeErrors, 1)
+
+		if attempt < notificationSaveAttempts {
+			time.Sleep(wait)
+			wait *= 2
+		}
+	}
+
+	atomic.AddUint64(&server.metrics.notificationSaveFailures, 1)
+	server.logger.WithFields(logging.Fields{kind: key, "error": err}).Errorf("unable to save %s %s from notification after %d attempts, %s", kind, ShortKey(key), notificationSaveAttempts, err.Error())
+
+	dropped := server.dirty.add(dirtyJWT{
+		Key:      key,
+		Kind:     kind,
+		Error:    err.Error(),
+		FailedAt: time.Now().UTC(),
+		jwt:      theJWT,
+	}, maxDirtyJWTs)
+	for _, k := range dropped {
+		server.logger.WithFields(logging.Fields{"key": k}).Warnf("dirty list is full, no longer tracking %s", ShortKey(k))
+	}
+	return err
+}
+
+// retryDirty saves each JWT in the dirty list once, those that fail stay in the list
+func (server *AccountServer) retryDirty() (saved int, failed int) {
+	for _, entry := range server.dirty.list() {
+		var err error
+		switch entry.Kind {
+		case dirtyAccount:
+			err = server.retryDirtyAccount(entry)
+		case dirtyActivation:
+			err = server.retryDirtyActivation(entry)
+		default:
+			err = fmt.Errorf("unknown kind %s", entry.Kind)
+		}
+
+		if err != nil {
+			atomic.AddUint64(&server.metrics.storeErrors, 1)
+			server.logger.WithFields(logging.Fields{entry.Kind: entry.Key, "error": err}).Errorf("retry of %s %s failed, %s", entry.Kind, ShortKey(entry.Key), err.Error())
+			failed++
+			continue
+		}
+		saved++
+	}
+	return saved, failed
+}
+
+func (server *AccountServer) retryDirtyAccount(entry dirtyJWT) error {
+	claim, err := jwt.DecodeAccountClaims(entry.jwt)
+	if err != nil {
+		return err
+	}
+
+	previous := server.previousJWT(entry.Key)
+	changed := server.accounts.changed(claim)
+
+	if err := server.saveJWT(entry.Key, entry.jwt); err != nil {
+		return err
+	}
+	server.accountNotificationSaved(claim, previous, entry.jwt, changed)
+	return nil
+}
+
+func (server *AccountServer) retryDirtyActivation(entry dirtyJWT) error {
+	claim, err := jwt.DecodeActivationClaims(entry.jwt)
+	if err != nil {
+		return err
+	}
+
+	if err := server.saveJWT(entry.Key, entry.jwt); err != nil {
+		return err
+	}
+	server.activationNotificationSaved(entry.Key, claim)
+	return nil
+}
+
+// RetryDirtyHandler saves the JWTs from notifications that couldn't be saved, it is the target
+// of POST /admin/retry-dirty
+func (server *AccountServer) RetryDirtyHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	server.logger.Tracef("%s: %s", r.RemoteAddr, r.URL.String())
+
+	saved, failed := server.retryDirty()
+	data, err := json.Marshal(map[string]interface{}{
+		"saved":  saved,
+		"failed": failed,
+		"dirty":  server.dirty.list(),
+	})
+	if err != nil {
+		server.sendErrorResponse(http.StatusInternalServerError, "unable to encode retry result", "", err, w)
+		return
+	}
+
+	w.Header().Set(ContentType, ApplicationJSON)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/store"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyStore fails the next failures saves
+type flakyStore struct {
+	store.JWTStore
+	failures int32
+}
+
+func (s *flakyStore) Save(publicKey string, theJWT string) error {
+	if atomic.AddInt32(&s.failures, -1) >= 0 {
+		return fmt.Errorf("disk full")
+	}
+	return s.JWTStore.Save(publicKey, theJWT)
+}
+
+func TestDirtyList(t *testing.T) {
+	d := newDirtyList()
+
+	require.Empty(t, d.add(dirtyJWT{Key: "a", Error: "1"}, 2))
+	require.Empty(t, d.add(dirtyJWT{Key: "b"}, 2))
+	require.Empty(t, d.add(dirtyJWT{Key: "a", Error: "2"}, 2))
+	require.Equal(t, 2, d.size())
+
+	require.Equal(t, []string{"a"}, d.add(dirtyJWT{Key: "c"}, 2))
+	d.remove("b")
+	d.remove("notdirty")
+	require.Equal(t, []dirtyJWT{{Key: "c"}}, d.list())
+}
+
+func TestNotificationSaveRetried(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	backoff := notificationSaveBackoff
+	notificationSaveBackoff = time.Millisecond
+	defer func() { notificationSaveBackoff = backoff }()
+
+	server := testEnv.Server
+	flaky := &flakyStore{JWTStore: server.jwtStore}
+	server.Lock()
+	server.jwtStore = flaky
+	server.Unlock()
+
+	accountJWT := func() (string, string) {
+		accountKey, err := nkeys.CreateAccount()
+		require.NoError(t, err)
+		pubKey, err := accountKey.PublicKey()
+		require.NoError(t, err)
+		acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+		require.NoError(t, err)
+		return pubKey, acctJWT
+	}
+
+	// a short outage is retried
+	pubKey, acctJWT := accountJWT()
+	atomic.StoreInt32(&flaky.failures, notificationSaveAttempts-1)
+	server.handleAccountNotification(&nats.Msg{Data: []byte(acctJWT)})
+	saved, err := flaky.Load(pubKey)
+	require.NoError(t, err)
+	require.Equal(t, acctJWT, saved)
+	require.Equal(t, 0, server.dirty.size())
+
+	// a longer one leaves the account dirty
+	pubKey, acctJWT = accountJWT()
+	atomic.StoreInt32(&flaky.failures, notificationSaveAttempts)
+	server.handleAccountNotification(&nats.Msg{Data: []byte(acctJWT)})
+	_, err = flaky.Load(pubKey)
+	require.Error(t, err)
+	require.Equal(t, uint64(1), atomic.LoadUint64(&server.metrics.notificationSaveFailures))
+
+	resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/status"))
+	require.NoError(t, err)
+	var status serverStatus
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	resp.Body.Close()
+	require.Len(t, status.Dirty, 1)
+	require.Equal(t, pubKey, status.Dirty[0].Key)
+	require.Equal(t, dirtyAccount, status.Dirty[0].Kind)
+	require.Equal(t, "disk full", status.Dirty[0].Error)
+
+	resp, err = testEnv.HTTP.Post(testEnv.URLForPath("/admin/retry-dirty"), "", nil)
+	require.NoError(t, err)
+	var result struct {
+		Saved  int        `json:"saved"`
+		Failed int        `json:"failed"`
+		Dirty  []dirtyJWT `json:"dirty"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, 1, result.Saved)
+	require.Equal(t, 0, result.Failed)
+	require.Empty(t, result.Dirty)
+
+	saved, err = flaky.Load(pubKey)
+	require.NoError(t, err)
+	require.Equal(t, acctJWT, saved)
+	require.Equal(t, 2, server.accounts.size())
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/core"
+	gnatsserver "github.com/nats-io/nats-server/v2/server"
+	gnatsd "github.com/nats-io/nats-server/v2/test"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+// Runs the account server and a nats-server in one process, the nats-server resolves the
+// account from the account server when a user connects.
+func ExampleNewAccountServerFromConfig() {
+	operatorKey, _ := nkeys.CreateOperator()
+	operatorPubKey, _ := operatorKey.PublicKey()
+	operatorJWT, _ := jwt.NewOperatorClaims(operatorPubKey).Encode(operatorKey)
+
+	operatorFile, err := ioutil.TempFile(os.TempDir(), "operator")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer os.Remove(operatorFile.Name())
+	operatorFile.WriteString(operatorJWT)
+	operatorFile.Close()
+
+	config := conf.DefaultServerConfig()
+	config.HTTP.Host = "127.0.0.1"
+	config.HTTP.Port = 0 // any free port
+	config.OperatorJWTPath = operatorFile.Name()
+
+	accountServer, err := core.NewAccountServerFromConfig(config)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := accountServer.Start(); err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer accountServer.Stop()
+
+	accountKey, _ := nkeys.CreateAccount()
+	accountPubKey, _ := accountKey.PublicKey()
+	accountJWT, _ := jwt.NewAccountClaims(accountPubKey).Encode(operatorKey)
+	if err := accountServer.Store().Save(accountPubKey, accountJWT); err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	resolver, err := gnatsserver.NewURLAccResolver(fmt.Sprintf("http://127.0.0.1:%d/jwt/v1/accounts/", accountServer.Port()))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	opts := gnatsd.DefaultTestOptions
+	opts.Port = -1
+	opts.TrustedKeys = []string{operatorPubKey}
+	opts.AccountResolver = resolver
+	natsServer := gnatsd.RunServer(&opts)
+	defer natsServer.Shutdown()
+
+	userKey, _ := nkeys.CreateUser()
+	userPubKey, _ := userKey.PublicKey()
+	userJWT, _ := jwt.NewUserClaims(userPubKey).Encode(accountKey)
+
+	nc, err := nats.Connect(fmt.Sprintf("nats://%s", natsServer.Addr()), nats.UserJWT(
+		func() (string, error) { return userJWT, nil },
+		func(nonce []byte) ([]byte, error) { return userKey.Sign(nonce) },
+	))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer nc.Close()
+
+	fmt.Println("connected as a user of the account")
+	// Output: connected as a user of the account
+}
+
+// An embedder whose Start fails doesn't have to call Stop, nothing started before the failure is left running
+func TestStartFailureLeavesNothingRunning(t *testing.T) {
+	opts := gnatsd.DefaultTestOptions
+	opts.Port = -1
+	natsServer := gnatsd.RunServer(&opts)
+	defer natsServer.Shutdown()
+
+	dir, err := ioutil.TempDir(os.TempDir(), "embed_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	config := conf.DefaultServerConfig()
+	config.HTTP.Host = "127.0.0.1"
+	config.HTTP.Port = taken.Addr().(*net.TCPAddr).Port
+	config.NATS.Servers = []string{fmt.Sprintf("nats://%s", natsServer.Addr())}
+	config.Store.Dir = dir
+
+	goroutines := runtime.NumGoroutine()
+
+	accountServer, err := core.NewAccountServerFromConfig(config)
+	require.NoError(t, err)
+	err = accountServer.Start()
+	require.Error(t, err)
+
+	select {
+	case <-accountServer.Done():
+	default:
+		t.Fatal("the server is still running")
+	}
+	require.Equal(t, err, accountServer.Err())
+	require.Nil(t, accountServer.Store())
+
+	// the NATS connection is closed, and the store, GC and other goroutines are stopped
+	for i := 0; i < 50 && (natsServer.NumClients() != 0 || runtime.NumGoroutine() > goroutines); i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	require.Equal(t, 0, natsServer.NumClients())
+	require.True(t, runtime.NumGoroutine() <= goroutines, "%d goroutines were left running", runtime.NumGoroutine()-goroutines)
+
+	// once the port is free the same config starts
+	taken.Close()
+	require.NoError(t, accountServer.Start())
+	accountServer.Stop()
+}
@@ -0,0 +1,220 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/nats-io/nats-account-server/server/store"
+	"github.com/nats-io/nkeys"
+)
+
+// Error codes sent in the code field of error responses, so clients can decide what to do
+// without parsing the message
+const (
+	CodeBadRequest          = "bad_request"
+	CodeInvalidJWT          = "invalid_jwt"
+	CodeUntrustedIssuer     = "untrusted_issuer"
+	CodeUnauthorized        = "unauthorized"
+	CodeForbidden           = "forbidden"
+	CodeNotFound            = "not_found"
+	CodeMethodNotAllowed    = "method_not_allowed"
+	CodeConflict            = "conflict"
+	CodeTooLarge            = "too_large"
+	CodeRateLimited         = "rate_limited"
+	CodeStoreError          = "store_error"
+	CodeStoreFull           = "store_full"
+	CodeNotificationError   = "notification_error"
+	CodePrimaryUnreachable  = "primary_unreachable"
+	CodeBadPrimaryJWT       = "bad_primary_jwt"
+	CodeUpstreamTimeout     = "upstream_timeout"
+	CodeInternal            = "internal_error"
+	CodePolicyViolation     = "policy_violation"
+	CodeLegacyJWT           = "legacy_jwt"
+	CodeActivationCollision = "activation_collision"
+)
+
+// errorCodes describes each code, the list is sent by GET /jwt/v1/status
+var errorCodes = map[string]string{
+	CodeBadRequest:          "the request is malformed, sending it again won't help",
+	CodeInvalidJWT:          "the JWT can't be decoded or failed validation",
+	CodeUntrustedIssuer:     "the JWT isn't signed by a trusted operator key",
+	CodeUnauthorized:        "the request needs a write token or an operator signed JWT",
+	CodeForbidden:           "the request isn't allowed",
+	CodeNotFound:            "the JWT, or the path, doesn't exist",
+	CodeMethodNotAllowed:    "the server doesn't take writes, it is read-only, a replica or a relay",
+	CodeConflict:            "the request conflicts with a stored JWT",
+	CodeTooLarge:            "the body is over the server's limit",
+	CodeRateLimited:         "too many requests, retry after the Retry-After header",
+	CodeStoreError:          "the store failed, retrying may work",
+	CodeStoreFull:           "the store is at its entry or byte limit, nothing more can be saved",
+	CodeNotificationError:   "the JWT was saved, but the NATS notification wasn't sent",
+	CodePrimaryUnreachable:  "a replica couldn't reach its primary and has no copy to serve, retrying may work",
+	CodeBadPrimaryJWT:       "a replica's primary sent a JWT that failed verification",
+	CodeUpstreamTimeout:     "a relay's upstream didn't answer in time, retrying may work",
+	CodeInternal:            "an unexpected server error",
+	CodePolicyViolation:     "the account JWT failed the server's policies, failures lists them",
+	CodeLegacyJWT:           "the JWT is in a legacy format newer nats-servers reject, and the server is set to refuse them",
+	CodeActivationCollision: "an activation for another issuer or subject is stored under the same hash",
+}
+
+// errorResponse is the JSON body of every error response, account is set for errors about one account
+type errorResponse struct {
+	Code     string   `json:"code"`
+	Message  string   `json:"message"`
+	Account  string   `json:"account,omitempty"`
+	Failures []string `json:"failures,omitempty"` // the failed policies, for policy_violation
+}
+
+// statusErrorCode is the code for an error that doesn't have a more specific one
+func statusErrorCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return CodeBadRequest
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusMethodNotAllowed:
+		return CodeMethodNotAllowed
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusRequestEntityTooLarge:
+		return CodeTooLarge
+	case http.StatusTooManyRequests:
+		return CodeRateLimited
+	default:
+		return CodeInternal
+	}
+}
+
+// lookupErrorCode is the code for an error loading a JWT, it goes with lookupErrorStatus
+func lookupErrorCode(err error) string {
+	switch {
+	case err == store.ErrNotFound:
+		return CodeNotFound
+	case errors.Is(err, errPrimaryUnreachable), errors.Is(err, errPrimaryServerError):
+		return CodePrimaryUnreachable
+	case err == errUpstreamTimeout:
+		return CodeUpstreamTimeout
+	}
+	if _, ok := err.(badPrimaryJWTError); ok {
+		return CodeBadPrimaryJWT
+	}
+	return CodeStoreError
+}
+
+// errorCode picks the code for sendErrorResponse, from the error if it is one with a code
+func errorCode(status int, err error) string {
+	if errors.Is(err, errPrimaryUnreachable) || errors.Is(err, errPrimaryServerError) || err == errUpstreamTimeout {
+		return lookupErrorCode(err)
+	}
+	switch err.(type) {
+	case badPrimaryJWTError:
+		return CodeBadPrimaryJWT
+	case jwtTooLargeError:
+		return CodeTooLarge
+	}
+	return statusErrorCode(status)
+}
+
+// plainErrorWriter marks a response for a client that asked for text/plain, its errors
+// are sent as the message alone, as they were before the JSON body
+type plainErrorWriter struct {
+	http.ResponseWriter
+}
+
+// Unwrap lets http.ResponseController reach the connection
+func (w *plainErrorWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Flush passes flushes through for handlers that stream their response
+func (w *plainErrorWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack hands over the connection
+func (w *plainErrorWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the response writer can't be hijacked")
+	}
+	return hijacker.Hijack()
+}
+
+// acceptsPlainErrors is true if the Accept header asks for text/plain and not JSON
+func acceptsPlainErrors(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, TextPlain) && !strings.Contains(accept, ApplicationJSON)
+}
+
+// plainErrors marks the responses to requests that accept text/plain, see writeError
+func plainErrors(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if acceptsPlainErrors(r) {
+			w = &plainErrorWriter{ResponseWriter: w}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// wantsPlainErrors looks through the writers wrapping w for a plainErrorWriter
+func wantsPlainErrors(w http.ResponseWriter) bool {
+	for w != nil {
+		if _, ok := w.(*plainErrorWriter); ok {
+			return true
+		}
+		unwrapper, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return false
+		}
+		w = unwrapper.Unwrap()
+	}
+	return false
+}
+
+// writeError writes an error response without logging it, as JSON unless the client asked for text/plain.
+// The account is only included if it is an account public key.
+func writeError(w http.ResponseWriter, status int, code string, msg string, account string) {
+	if wantsPlainErrors(w) {
+		w.Header().Set(ContentType, TextPlain)
+		w.WriteHeader(status)
+		fmt.Fprintln(w, msg)
+		return
+	}
+
+	resp := errorResponse{Code: code, Message: msg}
+	if nkeys.IsValidPublicAccountKey(account) {
+		resp.Account = account
+	}
+	data, _ := json.Marshal(resp)
+
+	w.Header().Set(ContentType, ApplicationJSON)
+	w.WriteHeader(status)
+	w.Write(data)
+}
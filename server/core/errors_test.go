@@ -0,0 +1,112 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func decodeError(t *testing.T, resp *http.Response) errorResponse {
+	defer resp.Body.Close()
+	require.Equal(t, ApplicationJSON, resp.Header.Get(ContentType))
+	var apiErr errorResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&apiErr))
+	return apiErr
+}
+
+func TestErrorResponses(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	_, pubKey, _ := CreateAccountKey(t)
+	url := testEnv.URLForPath("/jwt/v1/accounts/" + pubKey)
+
+	resp, err := testEnv.HTTP.Get(url)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	require.Equal(t, errorResponse{Code: CodeNotFound, Message: "error loading JWT", Account: pubKey}, decodeError(t, resp))
+
+	// clients asking for text get the message alone
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", TextPlain)
+	resp, err = testEnv.HTTP.Do(req)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	require.Equal(t, TextPlain, resp.Header.Get(ContentType))
+	require.Equal(t, "error loading JWT\n", string(body))
+
+	resp, err = testEnv.HTTP.Post(url, "application/json", bytes.NewBufferString("notajwt"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.Equal(t, CodeInvalidJWT, decodeError(t, resp).Code)
+
+	untrusted, err := nkeys.CreateOperator()
+	require.NoError(t, err)
+	acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(untrusted)
+	require.NoError(t, err)
+	resp, err = testEnv.HTTP.Post(url, "application/json", bytes.NewBufferString(acctJWT))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	apiErr := decodeError(t, resp)
+	require.Equal(t, CodeUntrustedIssuer, apiErr.Code)
+	require.Equal(t, pubKey, apiErr.Account)
+
+	resp, err = testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/nothing"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	require.Equal(t, CodeNotFound, decodeError(t, resp).Code)
+
+	// the codes are listed in the status
+	resp, err = testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/status"))
+	require.NoError(t, err)
+	var status serverStatus
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	resp.Body.Close()
+	require.Equal(t, errorCodes, status.ErrorCodes)
+}
+
+func TestReplicaErrorResponses(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	replica, err := testEnv.CreateReplica("")
+	require.NoError(t, err)
+	defer replica.Stop()
+
+	_, pubKey, _ := CreateAccountKey(t)
+	testEnv.Server.Stop()
+
+	resp, err := testEnv.HTTP.Get("http://" + replica.hostPort + "/jwt/v1/accounts/" + pubKey)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.Equal(t, CodePrimaryUnreachable, decodeError(t, resp).Code)
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// defaultExpiringWithin is the window used by the expiring report without a within parameter
+const defaultExpiringWithin = 30 * 24 * time.Hour
+
+// expiringAccount is the report entry for an account that has expired or expires soon
+type expiringAccount struct {
+	accountSummary
+	Expired bool `json:"expired"`
+}
+
+// expiringAccounts returns the indexed accounts that expire within the window of now, soonest
+// first, including those that have already expired
+func (server *AccountServer) expiringAccounts(now time.Time, within time.Duration) []expiringAccount {
+	summaries := server.accounts.expiring(now.Add(within).Unix())
+
+	report := make([]expiringAccount, 0, len(summaries))
+	for _, summary := range summaries {
+		report = append(report, expiringAccount{
+			accountSummary: summary,
+			Expired:        summary.Expires <= now.Unix(),
+		})
+	}
+	return report
+}
+
+// ListExpiringAccounts returns a JSON array of the accounts that expire within the duration
+// in the within query parameter, 720h unless one is given, sorted by expiry. Accounts that have
+// already expired are included with expired set. The report is read from the account index.
+func (server *AccountServer) ListExpiringAccounts(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	within := defaultExpiringWithin
+	if value := r.URL.Query().Get("within"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			server.sendErrorResponse(http.StatusBadRequest, fmt.Sprintf("bad within duration %q", value), "", err, w)
+			return
+		}
+		within = parsed
+	}
+
+	data, err := json.Marshal(server.expiringAccounts(time.Now(), within))
+	if err != nil {
+		server.sendErrorResponse(http.StatusInternalServerError, "unable to encode accounts", "", err, w)
+		return
+	}
+
+	w.Header().Set(ContentType, ApplicationJSON)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// startExpiryWarnings logs the accounts that have expired, or will within ExpiryWarnings.Within,
+// every ExpiryWarnings.Interval until the server stops. The server lock is held.
+func (server *AccountServer) startExpiryWarnings() {
+	interval := time.Duration(server.config.ExpiryWarnings.Interval) * time.Second
+	if interval <= 0 {
+		return
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	server.expiryStop = stop
+	server.expiryDone = done
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				within := time.Duration(server.currentConfig().ExpiryWarnings.Within) * time.Second
+				server.warnExpiringAccounts(time.Now(), within)
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopExpiryWarnings waits for the warning loop to exit
+func (server *AccountServer) stopExpiryWarnings(stop chan struct{}, done chan struct{}) {
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
+
+// warnExpiringAccounts logs a warning for each account in the expiring report, and returns
+// the number logged
+func (server *AccountServer) warnExpiringAccounts(now time.Time, within time.Duration) int {
+	report := server.expiringAccounts(now, within)
+
+	for _, account := range report {
+		expires := time.Unix(account.Expires, 0)
+		if account.Expired {
+			server.logger.Warnf("account %s %q expired %s ago, at %s", ShortKey(account.PubKey), account.Name,
+				now.Sub(expires).Round(time.Second), expires.UTC().Format(time.RFC3339))
+		} else {
+			server.logger.Warnf("account %s %q expires in %s, at %s", ShortKey(account.PubKey), account.Name,
+				expires.Sub(now).Round(time.Second), expires.UTC().Format(time.RFC3339))
+		}
+	}
+	return len(report)
+}
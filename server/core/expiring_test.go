@@ -0,0 +1,89 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListExpiringAccounts(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	now := time.Now()
+	index := func(name string, expires time.Time) string {
+		_, pubKey, _ := CreateAccountKey(t)
+		claim := jwt.NewAccountClaims(pubKey)
+		claim.Name = name
+		if !expires.IsZero() {
+			claim.Expires = expires.Unix()
+		}
+		testEnv.Server.indexAccount(claim)
+		return pubKey
+	}
+
+	tomorrow := index("tomorrow", now.Add(24*time.Hour))
+	expired := index("expired", now.Add(-time.Hour))
+	index("later", now.Add(90*24*time.Hour))
+	index("never", time.Time{})
+	soon := index("soon", now.Add(time.Hour))
+
+	get := func(query string) (int, []expiringAccount) {
+		resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/accounts/expiring" + query))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		var report []expiringAccount
+		if resp.StatusCode == http.StatusOK {
+			require.Equal(t, ApplicationJSON, resp.Header.Get(ContentType))
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+		}
+		return resp.StatusCode, report
+	}
+
+	status, report := get("?within=48h")
+	require.Equal(t, http.StatusOK, status)
+	require.Len(t, report, 3)
+	require.Equal(t, expired, report[0].PubKey)
+	require.True(t, report[0].Expired)
+	require.Equal(t, soon, report[1].PubKey)
+	require.False(t, report[1].Expired)
+	require.Equal(t, tomorrow, report[2].PubKey)
+	require.Equal(t, "tomorrow", report[2].Name)
+
+	// the default window is 30 days
+	status, report = get("")
+	require.Equal(t, http.StatusOK, status)
+	require.Len(t, report, 3)
+
+	status, report = get("?within=0s")
+	require.Equal(t, http.StatusOK, status)
+	require.Len(t, report, 1)
+
+	status, _ = get("?within=soon")
+	require.Equal(t, http.StatusBadRequest, status)
+
+	require.Equal(t, 2, testEnv.Server.warnExpiringAccounts(now, 2*time.Hour))
+}
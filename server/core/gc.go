@@ -0,0 +1,217 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/logging"
+	"github.com/nats-io/nats-account-server/server/store"
+	"github.com/nats-io/nkeys"
+)
+
+// errGCStopped ends a collection when the server stops
+var errGCStopped = errors.New("garbage collection stopped")
+
+// gcCandidate is an expired JWT, or old tombstone, found while iterating the store
+type gcCandidate struct {
+	key       string
+	jwt       string
+	account   bool
+	tombstone bool
+}
+
+// startGC removes expired JWTs from the store every GC.Interval until the server stops, the
+// server lock is held. Replicas and read-only stores aren't collected.
+func (server *AccountServer) startGC() {
+	interval := time.Duration(server.config.GC.Interval) * time.Second
+	if interval <= 0 || server.primary != "" || server.jwtStore.IsReadOnly() {
+		return
+	}
+
+	jwtStore := server.jwtStore
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	server.gcStop = stop
+	server.gcDone = done
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				server.collectGarbage(jwtStore, server.currentConfig().GC, stop)
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopGC waits for a collection in progress to notice the server is stopping
+func (server *AccountServer) stopGC(stop chan struct{}, done chan struct{}) {
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
+
+// collectGarbage deletes activations, and with GC.Accounts account JWTs, that expired more
+// than their grace period ago, and the tombstones of accounts deleted more than
+// GC.TombstoneGrace ago. Entries that don't decode are left alone.
+func (server *AccountServer) collectGarbage(jwtStore store.JWTStore, config conf.GCConfig, stop chan struct{}) (int, int) {
+	start := time.Now()
+	now := start.Unix()
+	activationCutoff := now - int64(config.ActivationGrace)
+	accountCutoff := now - int64(config.AccountGrace)
+	tombstoneCutoff := now - int64(config.TombstoneGrace)
+
+	// stores can't be changed while they are iterated, so expired entries are deleted after
+	candidates := []gcCandidate{}
+	err := jwtStore.Iterate(func(key string, theJWT string) error {
+		select {
+		case <-stop:
+			return errGCStopped
+		default:
+		}
+
+		if tombstone, ok := store.DecodeTombstone(theJWT); ok {
+			if tombstone.DeletedAt < tombstoneCutoff {
+				candidates = append(candidates, gcCandidate{key: key, jwt: theJWT, tombstone: true})
+			}
+			return nil
+		}
+
+		// user JWTs, with enableuserjwts, aren't collected
+		if nkeys.IsValidPublicUserKey(key) {
+			return nil
+		}
+
+		if nkeys.IsValidPublicAccountKey(key) {
+			if !config.Accounts {
+				return nil
+			}
+			claim, err := jwt.DecodeAccountClaims(theJWT)
+			if err == nil && claim.Subject == key && claim.Expires != 0 && claim.Expires < accountCutoff {
+				candidates = append(candidates, gcCandidate{key: key, jwt: theJWT, account: true})
+			}
+			return nil
+		}
+
+		claim, err := jwt.DecodeActivationClaims(theJWT)
+		if err == nil && claim.Expires != 0 && claim.Expires < activationCutoff {
+			candidates = append(candidates, gcCandidate{key: key, jwt: theJWT})
+		}
+		return nil
+	})
+
+	if err == errGCStopped {
+		return 0, 0
+	}
+	if err != nil {
+		atomic.AddUint64(&server.metrics.storeErrors, 1)
+		server.logger.WithFields(logging.Fields{"error": err}).Warnf("unable to iterate the store for garbage collection, %s", err.Error())
+		return 0, 0
+	}
+
+	accounts, activations, tombstones := 0, 0, 0
+	for _, candidate := range candidates {
+		removed, err := server.deleteIfUnchanged(jwtStore, candidate)
+		if err != nil {
+			atomic.AddUint64(&server.metrics.storeErrors, 1)
+			server.logger.WithFields(logging.Fields{"error": err}).Warnf("unable to remove expired JWT %s, %s", ShortKey(candidate.key), err.Error())
+			continue
+		}
+		if !removed {
+			continue
+		}
+
+		if candidate.tombstone {
+			tombstones++
+			atomic.AddUint64(&server.metrics.gcTombstones, 1)
+			server.logger.WithFields(logging.Fields{"account": candidate.key}).Debugf("removed tombstone for deleted account - %s", ShortKey(candidate.key))
+		} else if candidate.account {
+			accounts++
+			atomic.AddUint64(&server.metrics.gcAccounts, 1)
+			server.unindexAccount(candidate.key)
+			server.logger.WithFields(logging.Fields{"account": candidate.key}).Noticef("removed expired JWT for account - %s", ShortKey(candidate.key))
+		} else {
+			activations++
+			atomic.AddUint64(&server.metrics.gcActivations, 1)
+			server.activations.remove(candidate.key)
+			server.logger.WithFields(logging.Fields{"activation": candidate.key}).Debugf("removed expired activation - %s", ShortKey(candidate.key))
+		}
+	}
+
+	server.logger.Noticef("garbage collection removed %d expired activations, %d expired accounts and %d tombstones in %s", activations, accounts, tombstones, time.Since(start).Round(time.Millisecond))
+	return accounts, activations
+}
+
+// deleteIfUnchanged deletes the candidate unless it was replaced after the store was iterated,
+// saves wait for the delete so a new JWT can't be removed in its place
+func (server *AccountServer) deleteIfUnchanged(jwtStore store.JWTStore, candidate gcCandidate) (bool, error) {
+	server.saveLock.Lock()
+	defer server.saveLock.Unlock()
+
+	current, err := jwtStore.Load(candidate.key)
+	if err == store.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if current != candidate.jwt {
+		return false, nil
+	}
+
+	if err := jwtStore.Delete(candidate.key); err != nil {
+		return false, err
+	}
+	server.storeDeleted(candidate.key)
+	server.legacy.forget(candidate.key)
+	return true, nil
+}
+
+// saveJWT saves a JWT in the store, it can't run while garbage collection is deleting.
+// A saved key is no longer dirty, whatever saved it.
+func (server *AccountServer) saveJWT(key string, theJWT string) error {
+	server.saveLock.RLock()
+	defer server.saveLock.RUnlock()
+	undo, err := server.reserveStoreSpace(key, theJWT)
+	if err != nil {
+		return err
+	}
+	server.saveVersion(key, theJWT)
+	if err := server.jwtStore.Save(key, theJWT); err != nil {
+		undo()
+		return err
+	}
+	server.misses.forget(key)
+	server.legacy.forget(key)
+	server.dirty.remove(key)
+	server.gossip.saved(key, theJWT)
+	return nil
+}
@@ -0,0 +1,176 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/store"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+// saveTestActivation stores an activation that expires at expires, returning its hash
+func saveTestActivation(t *testing.T, testEnv *TestSetup, expires time.Time) string {
+	issuer, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	importer, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	importerPubKey, err := importer.PublicKey()
+	require.NoError(t, err)
+
+	act := jwt.NewActivationClaims(importerPubKey)
+	act.ImportType = jwt.Stream
+	act.ImportSubject = "gc.test"
+	act.Expires = expires.Unix()
+	actJWT, err := act.Encode(issuer)
+	require.NoError(t, err)
+
+	hash, err := act.HashID()
+	require.NoError(t, err)
+	require.NoError(t, testEnv.Server.saveJWT(hash, actJWT))
+	return hash
+}
+
+// saveTestAccount stores an account JWT that expires at expires, returning its public key
+func saveTestAccount(t *testing.T, testEnv *TestSetup, expires time.Time) string {
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+
+	account := jwt.NewAccountClaims(pubKey)
+	account.Expires = expires.Unix()
+	acctJWT, err := account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	require.NoError(t, testEnv.Server.saveJWT(pubKey, acctJWT))
+	testEnv.Server.indexJWT(pubKey, acctJWT)
+	return pubKey
+}
+
+func TestCollectGarbage(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	server := testEnv.Server
+	now := time.Now()
+
+	expired := saveTestActivation(t, testEnv, now.Add(-48*time.Hour))
+	inGrace := saveTestActivation(t, testEnv, now.Add(-time.Hour))
+	current := saveTestActivation(t, testEnv, now.Add(time.Hour))
+	oldAccount := saveTestAccount(t, testEnv, now.Add(-48*time.Hour))
+	require.NoError(t, server.saveJWT("garbage", "not a JWT"))
+
+	config := conf.GCConfig{ActivationGrace: 24 * 60 * 60, AccountGrace: 24 * 60 * 60}
+	jwtStore := server.jwtStore
+
+	accounts, activations := server.collectGarbage(jwtStore, config, make(chan struct{}))
+	require.Equal(t, 0, accounts)
+	require.Equal(t, 1, activations)
+	require.Equal(t, uint64(1), atomic.LoadUint64(&server.metrics.gcActivations))
+
+	_, err = jwtStore.Load(expired)
+	require.Equal(t, store.ErrNotFound, err)
+	require.Equal(t, 1, server.accounts.size())
+	for _, key := range []string{inGrace, current, oldAccount, "garbage"} {
+		_, err = jwtStore.Load(key)
+		require.NoError(t, err)
+	}
+
+	// accounts are only removed when turned on
+	config.Accounts = true
+	accounts, activations = server.collectGarbage(jwtStore, config, make(chan struct{}))
+	require.Equal(t, 1, accounts)
+	require.Equal(t, 0, activations)
+	_, err = jwtStore.Load(oldAccount)
+	require.Equal(t, store.ErrNotFound, err)
+	require.Equal(t, 0, server.accounts.size())
+}
+
+func TestCollectGarbageTombstones(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	server := testEnv.Server
+	now := time.Now()
+
+	_, oldKey, _ := CreateAccountKey(t)
+	require.NoError(t, server.saveTombstone(store.Tombstone{PubKey: oldKey, DeletedAt: now.Add(-48 * time.Hour).Unix()}))
+	_, recentKey, _ := CreateAccountKey(t)
+	require.NoError(t, server.saveTombstone(store.Tombstone{PubKey: recentKey, DeletedAt: now.Add(-time.Hour).Unix()}))
+
+	// tombstones are removed whether or not accounts are
+	config := conf.GCConfig{TombstoneGrace: 24 * 60 * 60}
+	accounts, activations := server.collectGarbage(server.jwtStore, config, make(chan struct{}))
+	require.Equal(t, 0, accounts)
+	require.Equal(t, 0, activations)
+	require.Equal(t, uint64(1), atomic.LoadUint64(&server.metrics.gcTombstones))
+
+	_, err = server.jwtStore.Load(oldKey)
+	require.Equal(t, store.ErrNotFound, err)
+	_, err = server.loadStored(recentKey)
+	require.Equal(t, store.ErrDeleted, err)
+}
+
+func TestCollectGarbageKeepsReplacedJWT(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	server := testEnv.Server
+	pubKey := saveTestAccount(t, testEnv, time.Now().Add(-48*time.Hour))
+	oldJWT, err := server.jwtStore.Load(pubKey)
+	require.NoError(t, err)
+
+	// saved again after the store was iterated
+	require.NoError(t, server.saveJWT(pubKey, "replaced"))
+
+	removed, err := server.deleteIfUnchanged(server.jwtStore, gcCandidate{key: pubKey, jwt: oldJWT, account: true})
+	require.NoError(t, err)
+	require.False(t, removed)
+
+	theJWT, err := server.jwtStore.Load(pubKey)
+	require.NoError(t, err)
+	require.Equal(t, "replaced", theJWT)
+}
+
+func TestGCStopsWithServer(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.GC.Interval = 1
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	server := testEnv.Server
+	server.Lock()
+	done := server.gcDone
+	server.Unlock()
+	require.NotNil(t, done)
+
+	server.Stop()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("garbage collection didn't stop with the server")
+	}
+}
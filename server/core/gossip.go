@@ -0,0 +1,384 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/logging"
+	"github.com/nats-io/nats-account-server/server/store"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+const (
+	// replicas answer fetches from other replicas on <subject>.FETCH.<replica id>
+	gossipFetchToken = "FETCH"
+
+	// maxGossipEntries bounds the accounts in a digest, so it fits in a NATS message
+	maxGossipEntries = 10000
+
+	// maxGossipKeys bounds the saves a replica remembers, new ones are ignored once it is full
+	maxGossipKeys = 100000
+)
+
+// gossipDigest is published by each replica, the accounts it saved recently and a hash of their JTIs
+type gossipDigest struct {
+	Replica  string            `json:"replica"`
+	Accounts map[string]string `json:"accounts"`
+}
+
+// gossipSave is an account JWT a replica saved and when
+type gossipSave struct {
+	jtiHash string
+	savedAt time.Time
+}
+
+// gossip tracks the accounts a replica saved recently, for the digests it publishes
+type gossip struct {
+	sync.Mutex
+	id      string
+	subject string
+	saves   map[string]gossipSave
+}
+
+// jtiHash shortens a JTI for digests, a collision only means a difference is missed until the JWT goes stale
+func jtiHash(jti string) string {
+	sum := sha256.Sum256([]byte(jti))
+	return hex.EncodeToString(sum[:8])
+}
+
+func validateGossip(config *conf.AccountServerConfig) error {
+	g := config.Gossip
+	if g.Subject == "" {
+		return nil
+	}
+
+	if !validRelayPrefix(g.Subject) {
+		return fmt.Errorf("gossip subject %q is not a valid subject", g.Subject)
+	}
+
+	if len(config.Primary) == 0 {
+		return fmt.Errorf("only replicas gossip, gossip needs a primary")
+	}
+
+	if len(config.NATS.Servers) == 0 {
+		return fmt.Errorf("gossip requires NATS servers")
+	}
+
+	if g.Interval <= 0 || g.Window <= 0 {
+		return fmt.Errorf("gossip interval and window must be positive")
+	}
+
+	if g.MaxEntries <= 0 || g.MaxEntries > maxGossipEntries {
+		return fmt.Errorf("gossip max entries must be between 1 and %d", maxGossipEntries)
+	}
+	return nil
+}
+
+// newGossip returns nil unless gossip is configured, each replica gets a random id for its fetch subject
+func newGossip(config conf.GossipConfig) (*gossip, error) {
+	if config.Subject == "" {
+		return nil, nil
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	return &gossip{
+		id:      hex.EncodeToString(id),
+		subject: config.Subject,
+		saves:   map[string]gossipSave{},
+	}, nil
+}
+
+// fetchSubject is the subject the replica with id answers fetches on
+func (g *gossip) fetchSubject(id string) string {
+	return fmt.Sprintf("%s.%s.%s", g.subject, gossipFetchToken, id)
+}
+
+// saved records an account JWT the replica saved, nil means gossip is off
+func (g *gossip) saved(key string, theJWT string) {
+	if g == nil || !nkeys.IsValidPublicAccountKey(key) || store.IsTombstone(theJWT) {
+		return
+	}
+
+	claim, err := jwt.DecodeGeneric(theJWT)
+	if err != nil {
+		return
+	}
+
+	g.Lock()
+	defer g.Unlock()
+	if _, ok := g.saves[key]; !ok && len(g.saves) >= maxGossipKeys {
+		return
+	}
+	g.saves[key] = gossipSave{jtiHash: jtiHash(claim.ID), savedAt: time.Now()}
+}
+
+// digest returns up to max of the accounts saved within window, the most recent first, older
+// saves are forgotten
+func (g *gossip) digest(window time.Duration, max int, now time.Time) gossipDigest {
+	g.Lock()
+	type entry struct {
+		key string
+		gossipSave
+	}
+	entries := []entry{}
+	for key, save := range g.saves {
+		if now.Sub(save.savedAt) > window {
+			delete(g.saves, key)
+			continue
+		}
+		entries = append(entries, entry{key, save})
+	}
+	g.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].savedAt.Equal(entries[j].savedAt) {
+			return entries[i].savedAt.After(entries[j].savedAt)
+		}
+		return entries[i].key < entries[j].key
+	})
+	if len(entries) > max {
+		entries = entries[:max]
+	}
+
+	digest := gossipDigest{Replica: g.id, Accounts: map[string]string{}}
+	for _, e := range entries {
+		digest.Accounts[e.key] = e.jtiHash
+	}
+	return digest
+}
+
+// subscribeToGossip adds the digest and fetch subscriptions to the notification subscriptions.
+// Lock should be held.
+func (server *AccountServer) subscribeToGossip(nc *nats.Conn) error {
+	if server.gossip == nil {
+		return nil
+	}
+
+	handlers := map[string]nats.MsgHandler{
+		server.gossip.subject:                        server.handleGossipDigest,
+		server.gossip.fetchSubject(server.gossip.id): server.handleGossipFetch,
+	}
+
+	for subject, handler := range handlers {
+		sub, err := nc.Subscribe(subject, server.natsState.counted(subject, handler))
+		if err != nil {
+			return err
+		}
+		server.notificationSubs = append(server.notificationSubs, sub)
+	}
+
+	server.logger.Noticef("gossiping recently saved accounts on %s as replica %s", server.gossip.subject, server.gossip.id)
+	return nil
+}
+
+// startGossip publishes a digest every interval until the server stops. Lock should be held.
+func (server *AccountServer) startGossip() {
+	if server.gossip == nil {
+		return
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	server.gossipStop = stop
+	server.gossipDone = done
+	config := server.config.Gossip
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(time.Duration(config.Interval) * time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				server.publishDigest(config)
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopGossip waits for the publisher to notice the server is stopping
+func (server *AccountServer) stopGossip(stop chan struct{}, done chan struct{}) {
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
+
+// publishDigest sends the accounts saved within the window, nothing is sent if there are none
+func (server *AccountServer) publishDigest(config conf.GossipConfig) {
+	digest := server.gossip.digest(time.Duration(config.Window)*time.Second, config.MaxEntries, time.Now())
+	if len(digest.Accounts) == 0 {
+		return
+	}
+
+	nc := server.getNatsConnection()
+	if nc == nil || !nc.IsConnected() {
+		return
+	}
+
+	data, err := json.Marshal(digest)
+	if err != nil {
+		return
+	}
+
+	if err := nc.Publish(config.Subject, data); err != nil {
+		server.logger.WithFields(logging.Fields{"error": err}).Warnf("unable to publish gossip digest, %s", err.Error())
+		return
+	}
+	atomic.AddUint64(&server.metrics.gossipDigestsSent, 1)
+}
+
+// handleGossipDigest compares another replica's digest with the store, accounts whose stored JTI
+// differs are fetched in the background. Accounts the replica doesn't have are left alone, they
+// are fetched when they are looked up.
+func (server *AccountServer) handleGossipDigest(msg *nats.Msg) {
+	digest := gossipDigest{}
+	if err := json.Unmarshal(msg.Data, &digest); err != nil || digest.Replica == "" || digest.Replica == server.gossip.id {
+		return
+	}
+	atomic.AddUint64(&server.metrics.gossipDigestsReceived, 1)
+
+	if len(digest.Accounts) > maxGossipEntries || !validRelayPrefix(digest.Replica) {
+		return
+	}
+
+	differ := []string{}
+	for key, hash := range digest.Accounts {
+		if !nkeys.IsValidPublicAccountKey(key) {
+			continue
+		}
+		theJWT, err := server.jwtStore.Load(key)
+		if err != nil || store.IsTombstone(theJWT) {
+			continue
+		}
+		claim, err := jwt.DecodeGeneric(theJWT)
+		if err != nil || jtiHash(claim.ID) == hash {
+			continue
+		}
+		differ = append(differ, key)
+	}
+
+	if len(differ) == 0 {
+		return
+	}
+	sort.Strings(differ)
+
+	go func() {
+		for _, key := range differ {
+			if !server.checkRunning() {
+				return
+			}
+			server.gossipFetch(key, digest.Replica)
+		}
+	}()
+}
+
+// gossipFetch gets an account from the primary, or from the replica that advertised it if the
+// primary is down. A JWT from a replica is only saved if it was issued after the stored one.
+func (server *AccountServer) gossipFetch(key string, replica string) {
+	if !server.startRefresh(key) {
+		return
+	}
+	defer server.endRefresh(key)
+
+	logger := server.logger.WithFields(logging.Fields{"account": key, "replica": replica})
+	cached, _ := server.jwtStore.Load(key)
+
+	_, err := server.fetchFromPrimary(key, accountsPath, cached)
+	if err == nil {
+		atomic.AddUint64(&server.metrics.gossipPrimaryFetches, 1)
+		return
+	}
+	if err != errPrimaryUnreachable && err != errPrimaryServerError {
+		logger.WithFields(logging.Fields{"error": err}).Debugf("unable to fetch account %s after gossip, %s", ShortKey(key), err.Error())
+		return
+	}
+
+	nc := server.getNatsConnection()
+	if nc == nil {
+		return
+	}
+
+	timeout := time.Duration(server.currentConfig().ReplicationTimeout) * time.Millisecond
+	reply, err := nc.Request(server.gossip.fetchSubject(replica), []byte(key), timeout)
+	if err != nil || len(reply.Data) == 0 {
+		return
+	}
+	theJWT := string(reply.Data)
+
+	if err := server.verifyFetchedJWT(key, theJWT); err != nil {
+		logger.WithFields(logging.Fields{"error": err}).Warnf("rejected the JWT for %s from replica %s, %s", ShortKey(key), replica, err.Error())
+		return
+	}
+
+	claim, err := jwt.DecodeAccountClaims(theJWT)
+	if err != nil || server.checkClaimTimes(claim.Expires, claim.NotBefore) != nil {
+		return
+	}
+	if stored, err := jwt.DecodeAccountClaims(cached); err == nil && stored.IssuedAt >= claim.IssuedAt {
+		return
+	}
+
+	if err := server.saveJWT(key, theJWT); err != nil {
+		atomic.AddUint64(&server.metrics.storeErrors, 1)
+		return
+	}
+	server.indexJWT(key, theJWT)
+	atomic.AddUint64(&server.metrics.gossipReplicaFetches, 1)
+	logger.Debugf("saved account %s from replica %s, the primary is down", ShortKey(key), replica)
+}
+
+// handleGossipFetch answers another replica with the stored JWT for an account, an empty reply
+// means it isn't stored
+func (server *AccountServer) handleGossipFetch(msg *nats.Msg) {
+	if msg.Reply == "" {
+		return
+	}
+
+	var theJWT string
+	key := string(msg.Data)
+	if nkeys.IsValidPublicAccountKey(key) {
+		if stored, err := server.jwtStore.Load(key); err == nil && !store.IsTombstone(stored) {
+			theJWT = stored
+		}
+	}
+
+	if err := msg.Respond([]byte(theJWT)); err != nil {
+		server.logger.WithFields(logging.Fields{"account": key, "error": err}).Debugf("unable to answer gossip fetch for %s, %s", ShortKey(key), err.Error())
+	}
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGossipDigest(t *testing.T) {
+	g, err := newGossip(conf.GossipConfig{Subject: "gossip"})
+	require.NoError(t, err)
+	require.NotEmpty(t, g.id)
+
+	_, _, operatorKP := CreateOperatorKey(t)
+	keys := []string{}
+	for i := 0; i < 5; i++ {
+		_, pubKey, _ := CreateAccountKey(t)
+		acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(operatorKP)
+		require.NoError(t, err)
+		g.saved(pubKey, acctJWT)
+		keys = append(keys, pubKey)
+		time.Sleep(time.Millisecond)
+	}
+
+	// tombstones and activations aren't gossiped
+	g.saved(keys[0], "not a jwt")
+	require.Len(t, g.digest(time.Hour, 100, time.Now()).Accounts, 5)
+
+	digest := g.digest(time.Hour, 2, time.Now())
+	require.Equal(t, g.id, digest.Replica)
+	require.Len(t, digest.Accounts, 2)
+	require.Contains(t, digest.Accounts, keys[4])
+	require.Contains(t, digest.Accounts, keys[3])
+
+	require.Empty(t, g.digest(time.Hour, 100, time.Now().Add(2*time.Hour)).Accounts)
+	require.Empty(t, g.saves)
+
+	var off *gossip
+	off.saved(keys[0], "")
+}
+
+func TestGossipConfig(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	require.NoError(t, validateGossip(config))
+
+	config.Gossip.Subject = "gossip.>"
+	require.Error(t, validateGossip(config))
+
+	config.Gossip.Subject = "gossip"
+	require.Error(t, validateGossip(config), "only replicas gossip")
+
+	config.Primary = []string{"http://localhost:9090"}
+	require.Error(t, validateGossip(config), "gossip needs NATS")
+
+	config.NATS.Servers = []string{"nats://localhost:4222"}
+	require.NoError(t, validateGossip(config))
+
+	config.Gossip.MaxEntries = maxGossipEntries + 1
+	require.Error(t, validateGossip(config))
+}
+
+func TestGossipFetchesMissedUpdates(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	replicas := []*AccountServer{}
+	for i := 0; i < 2; i++ {
+		config := testEnv.CreateReplicaConfig("")
+		config.Gossip.Subject = "test.gossip"
+		config.Gossip.Interval = 1
+		replica := NewAccountServer()
+		replica.InitializeFromConfig(config)
+		require.NoError(t, replica.Start())
+		defer replica.Stop()
+		replicas = append(replicas, replica)
+	}
+
+	_, pubKey, _ := CreateAccountKey(t)
+	account := jwt.NewAccountClaims(pubKey)
+	account.Name = "v1"
+	v1, err := account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	resp, err := testEnv.HTTP.Post(testEnv.URLForPath("/jwt/v1/accounts/"+pubKey), "application/jwt", bytes.NewBuffer([]byte(v1)))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	for _, replica := range replicas {
+		theJWT, err := replica.fetchFromPrimary(pubKey, accountsPath, "")
+		require.NoError(t, err)
+		require.Equal(t, v1, theJWT)
+	}
+
+	// the second version only reaches the first replica, as if the notification was missed
+	account.Name = "v2"
+	v2, err := account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	require.NoError(t, testEnv.Server.jwtStore.Save(pubKey, v2))
+	theJWT, err := replicas[0].fetchFromPrimary(pubKey, accountsPath, v1)
+	require.NoError(t, err)
+	require.Equal(t, v2, theJWT)
+
+	stored := ""
+	for i := 0; i < 50 && stored != v2; i++ {
+		time.Sleep(100 * time.Millisecond)
+		stored, _ = replicas[1].jwtStore.Load(pubKey)
+	}
+	require.Equal(t, v2, stored)
+
+	// replicas answer fetches from each other
+	msg, err := testEnv.NC.Request(replicas[0].gossip.fetchSubject(replicas[0].gossip.id), []byte(pubKey), 2*time.Second)
+	require.NoError(t, err)
+	require.Equal(t, v2, string(msg.Data))
+
+	_, unknown, _ := CreateAccountKey(t)
+	msg, err = testEnv.NC.Request(replicas[0].gossip.fetchSubject(replicas[0].gossip.id), []byte(unknown), 2*time.Second)
+	require.NoError(t, err)
+	require.Empty(t, msg.Data)
+
+	metrics := fmt.Sprintf("%s://%s/metrics", replicas[1].protocol, replicas[1].hostPort)
+	resp, err = testEnv.HTTP.Get(metrics)
+	require.NoError(t, err)
+	buf := new(bytes.Buffer)
+	_, err = buf.ReadFrom(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Contains(t, buf.String(), `nats_account_server_gossip_fetches_total{source="primary"} 1`)
+}
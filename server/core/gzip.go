@@ -0,0 +1,180 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// gzipMinSize is the smallest body compressed, smaller ones aren't worth the gzip header
+const gzipMinSize = 1024
+
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(ioutil.Discard)
+	},
+}
+
+// acceptsGzip checks the Accept-Encoding header for gzip, or *, without a zero q value
+func acceptsGzip(r *http.Request) bool {
+	for _, header := range r.Header["Accept-Encoding"] {
+		for _, part := range strings.Split(header, ",") {
+			fields := strings.Split(part, ";")
+			coding := strings.ToLower(strings.TrimSpace(fields[0]))
+			if coding != "gzip" && coding != "*" {
+				continue
+			}
+
+			accepted := true
+			for _, param := range fields[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					q, err := strconv.ParseFloat(param[2:], 64)
+					accepted = err == nil && q > 0
+				}
+			}
+			return accepted
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter holds the body until it is big enough to compress, or the handler
+// flushes, then switches to gzip. Bodies that stay small are sent as is.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	buf     []byte
+	gz      *gzip.Writer
+	decided bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *gzipResponseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	if w.gz != nil {
+		return w.gz.Write(data)
+	}
+
+	if w.decided {
+		return w.ResponseWriter.Write(data)
+	}
+
+	w.buf = append(w.buf, data...)
+	if len(w.buf) >= gzipMinSize {
+		if err := w.startGzip(); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+// startGzip sends the headers for a compressed body and the buffered data.
+// Content-Length is dropped, the compressed body is chunked.
+func (w *gzipResponseWriter) startGzip() error {
+	w.decided = true
+
+	if w.Header().Get("Content-Encoding") != "" || w.status == http.StatusNoContent || w.status == http.StatusNotModified {
+		w.ResponseWriter.WriteHeader(w.status)
+		_, err := w.ResponseWriter.Write(w.buf)
+		w.buf = nil
+		return err
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(w.status)
+
+	w.gz = gzipWriters.Get().(*gzip.Writer)
+	w.gz.Reset(w.ResponseWriter)
+	_, err := w.gz.Write(w.buf)
+	w.buf = nil
+	return err
+}
+
+// Unwrap lets http.ResponseController reach the connection
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Flush sends what has been written so far, compressed if there is any
+func (w *gzipResponseWriter) Flush() {
+	if !w.decided && len(w.buf) > 0 {
+		w.startGzip()
+	}
+
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// close finishes the response once the handler returns
+func (w *gzipResponseWriter) close() {
+	if w.gz != nil {
+		w.gz.Close()
+		w.gz.Reset(ioutil.Discard)
+		gzipWriters.Put(w.gz)
+		w.gz = nil
+		return
+	}
+
+	if !w.decided {
+		w.decided = true
+		if w.status != 0 {
+			w.ResponseWriter.WriteHeader(w.status)
+		}
+		if len(w.buf) > 0 {
+			w.ResponseWriter.Write(w.buf)
+		}
+	}
+}
+
+// gzipResponses compresses responses for clients that accept gzip, other clients get the
+// same response as before
+func (server *AccountServer) gzipResponses(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if !acceptsGzip(r) {
+			handle(w, r, params)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		handle(gw, r, params)
+		gw.close()
+	}
+}
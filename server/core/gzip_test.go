@@ -0,0 +1,176 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	cases := map[string]bool{
+		"":                  false,
+		"gzip":              true,
+		"deflate, gzip":     true,
+		"GZIP;q=0.5":        true,
+		"gzip;q=0":          false,
+		"*":                 true,
+		"br, deflate":       false,
+		"gzip;q=bad, *;q=1": false,
+	}
+
+	for header, expected := range cases {
+		r, err := http.NewRequest(http.MethodGet, "/", nil)
+		require.NoError(t, err)
+		if header != "" {
+			r.Header.Set("Accept-Encoding", header)
+		}
+		require.Equal(t, expected, acceptsGzip(r), header)
+	}
+}
+
+func getWithEncoding(t *testing.T, testEnv *TestSetup, path string, encoding string) (*http.Response, []byte) {
+	request, err := http.NewRequest(http.MethodGet, testEnv.URLForPath(path), nil)
+	require.NoError(t, err)
+	if encoding != "" {
+		request.Header.Set("Accept-Encoding", encoding)
+	}
+
+	// without a transport that decompresses, so the test sees what was sent
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	resp, err := client.Do(request)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, body
+}
+
+func gunzip(t *testing.T, data []byte) []byte {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	plain, err := ioutil.ReadAll(gz)
+	require.NoError(t, err)
+	return plain
+}
+
+func TestGzipPack(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	saveTestAccounts(t, testEnv, 20)
+
+	resp, plain := getWithEncoding(t, testEnv, "/jwt/v1/pack", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Empty(t, resp.Header.Get("Content-Encoding"))
+	require.Contains(t, resp.Header["Vary"], "Accept-Encoding")
+	require.Equal(t, "20", resp.Trailer.Get(packCountTrailer))
+
+	resp, compressed := getWithEncoding(t, testEnv, "/jwt/v1/pack", "gzip")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	require.Equal(t, int64(-1), resp.ContentLength)
+	require.True(t, len(compressed) < len(plain))
+	require.Equal(t, plain, gunzip(t, compressed))
+	require.Equal(t, "20", resp.Trailer.Get(packCountTrailer))
+	require.NotEmpty(t, resp.Trailer.Get(packChecksumTrailer))
+}
+
+func TestGzipSkipsSmallBodies(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	jwts := saveTestAccounts(t, testEnv, 1)
+
+	for pubKey, theJWT := range jwts {
+		resp, body := getWithEncoding(t, testEnv, "/jwt/v1/accounts/"+pubKey, "gzip")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Empty(t, resp.Header.Get("Content-Encoding"))
+		require.Equal(t, int64(len(theJWT)), resp.ContentLength)
+		require.Equal(t, theJWT, string(body))
+
+		// a 304 isn't changed either
+		request, err := http.NewRequest(http.MethodGet, testEnv.URLForPath("/jwt/v1/accounts/"+pubKey), nil)
+		require.NoError(t, err)
+		request.Header.Set("Accept-Encoding", "gzip")
+		request.Header.Set("If-None-Match", resp.Header.Get("Etag"))
+		resp, err = testEnv.HTTP.Do(request)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusNotModified, resp.StatusCode)
+		require.Empty(t, resp.Header.Get("Content-Encoding"))
+	}
+}
+
+func TestGzipPostPack(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	jwts := saveTestAccounts(t, testEnv, 3)
+	lines := []string{}
+	for pubKey, theJWT := range jwts {
+		require.NoError(t, testEnv.Server.jwtStore.Delete(pubKey))
+		lines = append(lines, pubKey+packSeparator+theJWT)
+	}
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, err = gz.Write([]byte(strings.Join(lines, "\n")))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	request, err := http.NewRequest(http.MethodPost, testEnv.URLForPath("/jwt/v1/pack"), &compressed)
+	require.NoError(t, err)
+	request.Header.Set("Content-Encoding", "gzip")
+	resp, err := testEnv.HTTP.Do(request)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var summary packImportSummary
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&summary))
+	require.Equal(t, 3, summary.Saved)
+
+	// a body that isn't gzip, and encodings that aren't supported, are rejected
+	request, err = http.NewRequest(http.MethodPost, testEnv.URLForPath("/jwt/v1/pack"), strings.NewReader(lines[0]))
+	require.NoError(t, err)
+	request.Header.Set("Content-Encoding", "gzip")
+	resp, err = testEnv.HTTP.Do(request)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	request, err = http.NewRequest(http.MethodPost, testEnv.URLForPath("/jwt/v1/pack"), strings.NewReader(lines[0]))
+	require.NoError(t, err)
+	request.Header.Set("Content-Encoding", "br")
+	resp, err = testEnv.HTTP.Do(request)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+}
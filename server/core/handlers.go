@@ -20,16 +20,23 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/logging"
+	"github.com/nats-io/nats-account-server/server/store"
+	"github.com/nats-io/nkeys"
 )
 
 // http headers
@@ -41,20 +48,40 @@ const (
 	ApplicationJWT  = "application/jwt"
 )
 
+// primary paths replicas fetch JWTs from
+const (
+	accountsPath    = "jwt/v1/accounts"
+	activationsPath = "jwt/v1/activations"
+	usersPath       = "jwt/v1/users" // with EnableUserJWTs, users are never sent over NATS
+)
+
+// staleWarning is sent with a JWT a replica served stale because the primary was down
+const staleWarning = `110 - "Response is Stale"`
+
+// expiredWarning is sent with a JWT whose claim has expired
+const expiredWarning = `299 - "Claim is Expired"`
+
+// ClaimExpiresHeader carries a JWT's expiration, in RFC3339, for JWTs that expire
+const ClaimExpiresHeader = "X-Claim-Expires"
+
 // JWTHelp handles get requests for JWT help
 func (server *AccountServer) JWTHelp(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	server.logger.Tracef("%s: %s", r.RemoteAddr, r.URL.String())
+	logger := server.logger.WithContext(r.Context())
+	logger.Tracef("%s: %s", r.RemoteAddr, r.URL.String())
 	w.Header().Add(ContentType, TextPlain)
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(jwtAPIHelp))
 }
 
-// GetOperatorJWT returns the known operator JWT
+// GetOperatorJWT returns the known operator JWT, re-reading it if the file changed
 func (server *AccountServer) GetOperatorJWT(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	server.logger.Tracef("%s: %s", r.RemoteAddr, r.URL.String())
+	logger := server.logger.WithContext(r.Context())
+	logger.Tracef("%s: %s", r.RemoteAddr, r.URL.String())
 
-	if server.operatorJWT == "" {
-		w.WriteHeader(http.StatusBadRequest)
+	operatorJWT, id := server.currentOperatorJWT()
+
+	if operatorJWT == "" {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "no operator JWT is configured", "")
 		return
 	}
 
@@ -62,51 +89,119 @@ func (server *AccountServer) GetOperatorJWT(w http.ResponseWriter, r *http.Reque
 	text := strings.ToLower(r.URL.Query().Get("text")) == "true"
 
 	if text {
-		server.writeJWTAsText(w, "", server.operatorJWT)
+		server.writeJWTAsText(w, "", operatorJWT)
 		return
 	}
 
 	if decode {
-		server.writeDecodedJWT(w, "", server.operatorJWT)
+		server.writeDecodedJWT(w, "", operatorJWT, nil)
+		return
+	}
+
+	// the file can change at any time, by default caches have to check the ETag before reusing a copy
+	e := jwtETag(id)
+	w.Header().Set("Etag", e)
+	server.setCacheHeaders(w, "", 0, server.currentConfig().OperatorCacheTTL)
+
+	if etagMatches(r.Header.Get("If-None-Match"), e) {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
 	w.Header().Add(ContentType, ApplicationJWT)
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(server.operatorJWT))
+	w.Write([]byte(operatorJWT))
+}
+
+// jwtTooLargeError is returned for JWTs over the configured size limit
+type jwtTooLargeError struct {
+	limit int
+}
+
+func (e jwtTooLargeError) Error() string {
+	return fmt.Sprintf("JWT is larger than the %d byte limit set by maxjwtsize", e.limit)
 }
 
+// readJWTBody reads an uploaded JWT, the body is cut off at the size limit so a huge upload
+// isn't read into memory
+func (server *AccountServer) readJWTBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	limit := server.currentConfig().MaxJWTSize
+	if limit <= 0 {
+		return ioutil.ReadAll(r.Body)
+	}
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, int64(limit)))
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return nil, jwtTooLargeError{limit: limit}
+	}
+	return data, err
+}
+
+// sendBodyError responds to a body readJWTBody couldn't read, 413 if it was too large
+func (server *AccountServer) sendBodyError(msg string, err error, w http.ResponseWriter) {
+	if tooLarge, ok := err.(jwtTooLargeError); ok {
+		server.sendErrorResponse(http.StatusRequestEntityTooLarge, tooLarge.Error(), "", nil, w)
+		return
+	}
+	server.sendErrorResponse(http.StatusBadRequest, msg, "", err, w)
+}
+
+// sendErrorResponse logs and writes an error, the code comes from err or the status
 func (server *AccountServer) sendErrorResponse(httpStatus int, msg string, account string, err error, w http.ResponseWriter) error {
-	account = ShortKey(account)
+	return server.sendError(httpStatus, errorCode(httpStatus, err), msg, account, err, w)
+}
+
+// sendError logs and writes an error with the code, see writeError
+func (server *AccountServer) sendError(httpStatus int, code string, msg string, account string, err error, w http.ResponseWriter) error {
+	fields := logging.Fields{"status": httpStatus}
+	if account != "" {
+		fields["account"] = account
+	}
 	if err != nil {
-		if account != "" {
-			server.logger.Errorf("%s - %s - %s", account, msg, err.Error())
+		fields["error"] = err
+	}
+	logger := server.logger.WithContext(requestContext(w)).WithFields(fields)
+
+	shortCode := ShortKey(account)
+	if err != nil {
+		if shortCode != "" {
+			logger.Errorf("%s - %s - %s", shortCode, msg, err.Error())
 		} else {
-			server.logger.Errorf("%s - %s", msg, err.Error())
+			logger.Errorf("%s - %s", msg, err.Error())
 		}
 	} else {
-		if account != "" {
-			server.logger.Errorf("%s - %s", account, msg)
+		if shortCode != "" {
+			logger.Errorf("%s - %s", shortCode, msg)
 		} else {
-			server.logger.Errorf("%s", msg)
+			logger.Errorf("%s", msg)
 		}
 	}
 
-	w.Header().Set(ContentType, TextPlain)
-	w.WriteHeader(httpStatus)
-	fmt.Fprintln(w, msg)
+	writeError(w, httpStatus, code, msg, account)
 	return err
 }
 
+// sendSaveError responds to a failed save, 507 if the store is full, otherwise a 500 counted as a store error
+func (server *AccountServer) sendSaveError(msg string, account string, err error, w http.ResponseWriter) {
+	if _, ok := err.(storeFullError); ok {
+		server.sendError(http.StatusInsufficientStorage, CodeStoreFull, msg, account, err, w)
+		return
+	}
+	atomic.AddUint64(&server.metrics.storeErrors, 1)
+	server.sendError(http.StatusInternalServerError, CodeStoreError, msg, account, err, w)
+}
+
 func (server *AccountServer) writeJWTAsText(w http.ResponseWriter, pubKey string, theJWT string) {
 	w.Header().Add(ContentType, TextPlain)
 	w.WriteHeader(http.StatusOK)
 	_, err := w.Write([]byte(theJWT))
 
+	logger := server.logger.WithContext(requestContext(w)).WithFields(logging.Fields{"account": pubKey})
 	if err != nil {
-		server.logger.Errorf("error writing JWT as text for %s - %s", ShortKey(pubKey), err.Error())
+		logger.WithFields(logging.Fields{"error": err}).Errorf("error writing JWT as text for %s - %s", ShortKey(pubKey), err.Error())
 	} else {
-		server.logger.Tracef("returning JWT as text for - %s", ShortKey(pubKey))
+		logger.Tracef("returning JWT as text for - %s", ShortKey(pubKey))
 	}
 }
 
@@ -124,7 +219,28 @@ func UnescapedIndentedMarshal(v interface{}, prefix, indent string) ([]byte, err
 	return buf.Bytes(), nil
 }
 
-func (server *AccountServer) writeDecodedJWT(w http.ResponseWriter, pubKey string, theJWT string) {
+// decodeJWTHeader decodes the header of a JWT, without checking the claims or the signature
+func decodeJWTHeader(theJWT string) (*jwt.Header, error) {
+	parts := strings.Split(theJWT, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("expected 3 JWT segments, found %d", len(parts))
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+
+	header := &jwt.Header{}
+	if err := json.Unmarshal(data, header); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// writeDecodedJWT writes the JWT header and claims as JSON, followed by the signature. If
+// identity isn't nil it is written as JSON before the header.
+func (server *AccountServer) writeDecodedJWT(w http.ResponseWriter, pubKey string, theJWT string, identity interface{}) {
 
 	claim, err := jwt.DecodeGeneric(theJWT)
 	if err != nil {
@@ -132,19 +248,12 @@ func (server *AccountServer) writeDecodedJWT(w http.ResponseWriter, pubKey strin
 		return
 	}
 
-	parts := strings.Split(theJWT, ".")
-	head := parts[0]
-	sig := parts[2]
-	headerString, err := base64.RawURLEncoding.DecodeString(head)
+	sig := strings.Split(theJWT, ".")[2]
+	header, err := decodeJWTHeader(theJWT)
 	if err != nil {
 		server.sendErrorResponse(http.StatusInternalServerError, "error decoding claim header", pubKey, err, w)
 		return
 	}
-	header := jwt.Header{}
-	if err := json.Unmarshal(headerString, &header); err != nil {
-		server.sendErrorResponse(http.StatusInternalServerError, "error unmarshaling claim header", pubKey, err, w)
-		return
-	}
 
 	headerJSON, err := UnescapedIndentedMarshal(header, "", "    ")
 	if err != nil {
@@ -247,6 +356,15 @@ func (server *AccountServer) writeDecodedJWT(w http.ResponseWriter, pubKey strin
 
 	newLineBytes := []byte("\r\n")
 	jsonBuff := []byte{}
+	if identity != nil {
+		identityJSON, err := UnescapedIndentedMarshal(identity, "", "    ")
+		if err != nil {
+			server.sendErrorResponse(http.StatusInternalServerError, "error marshaling claim identity", pubKey, err, w)
+			return
+		}
+		jsonBuff = append(jsonBuff, identityJSON...)
+		jsonBuff = append(jsonBuff, newLineBytes...)
+	}
 	jsonBuff = append(jsonBuff, headerJSON...)
 	jsonBuff = append(jsonBuff, newLineBytes...)
 	jsonBuff = append(jsonBuff, claimJSON...)
@@ -259,64 +377,415 @@ func (server *AccountServer) writeDecodedJWT(w http.ResponseWriter, pubKey strin
 	w.WriteHeader(http.StatusOK)
 	_, err = w.Write(jsonBuff)
 
+	logger := server.logger.WithContext(requestContext(w)).WithFields(logging.Fields{"account": pubKey})
 	if err != nil {
-		server.logger.Errorf("error writing decoded JWT as text for %s - %s", ShortKey(pubKey), err.Error())
+		logger.WithFields(logging.Fields{"error": err}).Errorf("error writing decoded JWT as text for %s - %s", ShortKey(pubKey), err.Error())
 	} else {
-		server.logger.Tracef("returning decoded JWT as text for - %s", ShortKey(pubKey))
+		logger.Tracef("returning decoded JWT as text for - %s", ShortKey(pubKey))
+	}
+}
+
+// writeDecodedAccountClaims writes the account claims as JSON, with only the selected fields if there are any
+func (server *AccountServer) writeDecodedAccountClaims(w http.ResponseWriter, pubKey string, theJWT string, fields []string, pretty bool) {
+	claims, err := jwt.DecodeAccountClaims(theJWT)
+	if err != nil {
+		server.sendErrorResponse(http.StatusInternalServerError, "error decoding claim", pubKey, err, w)
+		return
+	}
+
+	projected, err := projectClaims(claims, fields)
+	if err != nil {
+		server.sendErrorResponse(http.StatusInternalServerError, "error converting claim", pubKey, err, w)
+		return
+	}
+
+	indent := ""
+	if pretty {
+		indent = "    "
+	}
+
+	data, err := UnescapedIndentedMarshal(projected, "", indent)
+	if err != nil {
+		server.sendErrorResponse(http.StatusInternalServerError, "error marshaling claim", pubKey, err, w)
+		return
+	}
+
+	w.Header().Set(ContentType, ApplicationJSON)
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(data); err != nil {
+		server.logger.WithContext(requestContext(w)).WithFields(logging.Fields{"account": pubKey, "error": err}).Errorf("error writing decoded claims for %s - %s", ShortKey(pubKey), err.Error())
+	}
+}
+
+// writeDecodedActivationClaims writes the activation claims as JSON, with only the selected fields if there
+// are any. The JWT header and the hash calculated from the claims are always included, as header and
+// hash_id, so the hash can be compared to the one that was requested.
+func (server *AccountServer) writeDecodedActivationClaims(w http.ResponseWriter, hash string, theJWT string, fields []string, pretty bool) {
+	claims, err := jwt.DecodeActivationClaims(theJWT)
+	if err != nil {
+		server.sendErrorResponse(http.StatusInternalServerError, "error decoding claim", hash, err, w)
+		return
+	}
+
+	header, err := decodeJWTHeader(theJWT)
+	if err != nil {
+		server.sendErrorResponse(http.StatusInternalServerError, "error decoding claim header", hash, err, w)
+		return
+	}
+
+	hashID, err := claims.HashID()
+	if err != nil {
+		server.sendErrorResponse(http.StatusInternalServerError, "error calculating activation hash", hash, err, w)
+		return
+	}
+
+	projected, err := projectClaims(claims, fields)
+	if err != nil {
+		server.sendErrorResponse(http.StatusInternalServerError, "error converting claim", hash, err, w)
+		return
+	}
+	projected[headerField] = header
+	projected[hashIDField] = hashID
+
+	indent := ""
+	if pretty {
+		indent = "    "
+	}
+
+	data, err := UnescapedIndentedMarshal(projected, "", indent)
+	if err != nil {
+		server.sendErrorResponse(http.StatusInternalServerError, "error marshaling claim", hash, err, w)
+		return
+	}
+
+	w.Header().Set(ContentType, ApplicationJSON)
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(data); err != nil {
+		server.logger.WithContext(requestContext(w)).WithFields(logging.Fields{"activation": hash, "error": err}).Errorf("error writing decoded claims for %s - %s", ShortKey(hash), err.Error())
 	}
 }
 
-func (server *AccountServer) cacheControlForExpiration(pubKey string, expires int64) string {
+// setCacheHeaders sets Cache-Control and Expires for a JWT, clients can cache it for ttl seconds,
+// or until it expires if that is sooner. A ttl of 0 tells clients not to reuse it without
+// checking the ETag. Replicas don't let clients keep a replicated JWT past its stale time.
+// A JWT that expires gets X-Claim-Expires, one that has expired is sent with no-cache and a warning.
+func (server *AccountServer) setCacheHeaders(w http.ResponseWriter, pubKey string, expires int64, ttl int) {
 	now := time.Now().UTC()
-	maxAge := int64(time.Unix(expires, 0).Sub(now).Seconds())
-	stale := int64(60 * 60) // One hour
 
-	if server.primary != "" && maxAge > 0 {
+	if expires > 0 {
+		w.Header().Set(ClaimExpiresHeader, time.Unix(expires, 0).UTC().Format(time.RFC3339))
+		if expires <= now.Unix() {
+			w.Header().Add("Warning", expiredWarning)
+			w.Header().Set("Cache-Control", "no-cache")
+			return
+		}
+	}
+
+	if ttl <= 0 {
+		w.Header().Set("Cache-Control", "no-cache")
+		return
+	}
+
+	maxAge := int64(ttl)
+	stale := int64(ttl)
+
+	if untilExpired := expires - now.Unix(); expires > 0 && untilExpired < maxAge {
+		maxAge = untilExpired
+	}
+
+	if primaries, _ := server.currentPrimaries(); primaries != nil && pubKey != "" && maxAge > 0 {
+		server.cacheLock.Lock()
 		staleAt, ok := server.validUntil[pubKey]
+		server.cacheLock.Unlock()
 
-		if ok {
+		if !ok {
+			return
+		}
+
+		if !staleAt.IsZero() {
 			stale = int64(staleAt.Sub(now).Seconds())
-		} else {
-			return ""
 		}
 	}
-	return fmt.Sprintf("max-age=%d, stale-while-revalidate=%d, stale-if-error=%d", maxAge, stale, stale)
+
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d, stale-while-revalidate=%d, stale-if-error=%d", maxAge, stale, stale))
+	w.Header().Set("Expires", now.Add(time.Duration(maxAge)*time.Second).Format(http.TimeFormat))
 }
 
-func (server *AccountServer) loadReplicatedJWT(pubKey string, path string) (string, error) {
+// errors from fetchFromPrimary when the primary can't answer
+var (
+	errPrimaryUnreachable = errors.New("primary is unreachable")
+	errPrimaryServerError = errors.New("primary returned a server error")
+)
+
+// badPrimaryJWTError is returned by fetchFromPrimary when the primary answers with a JWT that
+// fails verification, lookups return a 502 for it
+type badPrimaryJWTError struct {
+	err error
+}
+
+func (e badPrimaryJWTError) Error() string {
+	return fmt.Sprintf("primary returned a bad JWT, %s", e.err.Error())
+}
+
+// lookupErrorStatus is the status for an error loading a JWT, fallback if the store failed
+func lookupErrorStatus(err error, fallback int) int {
+	if _, ok := err.(badPrimaryJWTError); ok {
+		return http.StatusBadGateway
+	}
+	switch {
+	case err == store.ErrNotFound:
+		return http.StatusNotFound
+	case errors.Is(err, errPrimaryUnreachable), errors.Is(err, errPrimaryServerError):
+		return http.StatusServiceUnavailable
+	case err == errUpstreamTimeout:
+		return http.StatusGatewayTimeout
+	}
+	return fallback
+}
+
+// verifyFetchedJWT checks a JWT from the primary before it is saved: it has to decode, which
+// checks the signature, be for the key that was asked for and, for accounts, be signed by a
+// trusted key if any are configured
+func (server *AccountServer) verifyFetchedJWT(key string, theJWT string) error {
+	if nkeys.IsValidPublicUserKey(key) {
+		_, err := decodeStoredUser(key, theJWT)
+		return err
+	}
+
+	if nkeys.IsValidPublicAccountKey(key) {
+		claim, err := jwt.DecodeAccountClaims(theJWT)
+		if err != nil {
+			return err
+		}
+		if claim.Subject != key {
+			return fmt.Errorf("JWT is for account %s", ShortKey(claim.Subject))
+		}
+		if len(server.currentTrustedKeys()) > 0 {
+			return server.checkTrustedIssuer(claim.Issuer)
+		}
+		return nil
+	}
+
+	claim, err := jwt.DecodeActivationClaims(theJWT)
+	if err != nil {
+		return err
+	}
+	hash, err := claim.HashID()
+	if err != nil {
+		return err
+	}
+	if hash != key {
+		return fmt.Errorf("activation hash is %s", ShortKey(hash))
+	}
+	return nil
+}
+
+// rejectPrimaryJWT logs and counts a JWT from the primary that failed verification
+func (server *AccountServer) rejectPrimaryJWT(primary string, key string, err error) error {
+	atomic.AddUint64(&server.metrics.primaryJWTsRejected, 1)
+	server.logger.WithFields(logging.Fields{"primary": primary, "key": key, "error": err}).Errorf("rejected the JWT for %s from primary %s, %s", ShortKey(key), primary, err.Error())
+	return badPrimaryJWTError{err: err}
+}
+
+// loadReplicatedJWT returns the replica's copy of a JWT if it isn't stale, and fetches it from
+// the primary if it is. The bool is true if a stale copy was returned because the primary was down.
+func (server *AccountServer) loadReplicatedJWT(pubKey string, path string) (string, bool, error) {
 	now := time.Now().UTC()
+	server.hits.hit(pubKey, path)
 	server.cacheLock.Lock()
 	staleAt, ok := server.validUntil[pubKey]
 	server.cacheLock.Unlock()
 	stale := true // no valid until -> stale
 
 	if ok {
-		stale = int64(staleAt.Sub(now).Seconds()) < 0
+		stale = !staleAt.IsZero() && int64(staleAt.Sub(now).Seconds()) < 0
+	}
+
+	cached, err := server.loadStored(pubKey)
+	deleted := err == store.ErrDeleted
+	if err != nil {
+		cached = ""
+	}
+
+	// if we aren't stale and we have the jwt, or a tombstone, return it
+	if !stale && cached != "" {
+		return cached, false, nil
+	}
+	if !stale && deleted {
+		return "", false, store.ErrDeleted
+	}
+
+	theJWT, err := server.fetchFromPrimary(pubKey, path, cached)
+	if err == nil {
+		return theJWT, false, nil
+	}
+
+	config := server.currentConfig()
+
+	if deleted && (err == errPrimaryUnreachable || err == errPrimaryServerError) {
+		return "", false, store.ErrDeleted
+	}
+
+	if !config.ReplicaServeStale {
+		if err != errPrimaryUnreachable {
+			return "", false, err
+		}
+
+		// if we can't contact the primary, fallback to what we have on disk, without
+		// a copy the account may still exist, so it isn't reported as not found
+		theJWT, err := server.loadStored(pubKey)
+		if err == store.ErrNotFound {
+			err = errPrimaryUnreachable
+		}
+		return theJWT, err == nil, err
+	}
+
+	if cached == "" || (err != errPrimaryUnreachable && err != errPrimaryServerError) {
+		return "", false, err
+	}
+
+	// entries without a stale time, like ones from before a restart, can't be too stale
+	if max := config.ReplicaMaxStale; max > 0 && ok && !staleAt.IsZero() && now.Sub(staleAt) > time.Duration(max)*time.Second {
+		return "", false, fmt.Errorf("%w and the JWT is more than %ds past stale", errPrimaryUnreachable, max)
 	}
 
-	// if we aren't stale and we have the jwt, return it
-	if !stale {
-		theJWT, err := server.jwtStore.Load(pubKey)
+	atomic.AddUint64(&server.metrics.staleServed, 1)
+	server.refreshInBackground(pubKey, path)
+	return cached, true, nil
+}
+
+// fetchFromPrimary gets a JWT from the first primary that answers and saves it, cached is sent
+// as the ETag and returned on a 304. Primaries that can't be reached, or return a server error,
+// are counted as failures and the next one is tried.
+func (server *AccountServer) fetchFromPrimary(pubKey string, path string, cached string) (string, error) {
+	primaries, httpClient := server.currentPrimaries()
+	if primaries == nil {
+		return "", errPrimaryUnreachable
+	}
+
+	err := errPrimaryUnreachable
+	for _, primary := range primaries.candidates(time.Now()) {
+		var theJWT string
+		theJWT, err = server.fetchFrom(primary, httpClient, pubKey, path, cached)
 
-		if err == nil && theJWT != "" {
-			return theJWT, nil
+		if err == errPrimaryUnreachable || err == errPrimaryServerError {
+			server.primaryFailed(primaries, primary)
+			continue
 		}
+
+		server.primaryAnswered(primaries, primary)
+		if err == nil {
+			primaries.served(primary)
+		}
+		return theJWT, err
+	}
+	return "", err
+}
+
+// primaryConnTrace counts whether a request to a primary got a pooled connection or a new one
+func (server *AccountServer) primaryConnTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddUint64(&server.metrics.primaryConnsReused, 1)
+			} else {
+				atomic.AddUint64(&server.metrics.primaryConnsNew, 1)
+			}
+		},
 	}
+}
 
-	primary := server.primary
+// fetchOutcome classifies a request to a primary for the fetch latency histogram
+func fetchOutcome(status int, err error) string {
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return fetchTimeout
+		}
+		return fetchConnError
+	}
 
+	switch {
+	case status >= http.StatusInternalServerError:
+		return fetch5xx
+	case status >= http.StatusBadRequest:
+		return fetch4xx
+	}
+	return fetchOK
+}
+
+// fetchFrom gets a JWT from one primary and saves it
+func (server *AccountServer) fetchFrom(primary string, httpClient *http.Client, pubKey string, path string, cached string) (string, error) {
 	if strings.HasSuffix(primary, "/") {
 		primary = primary[:len(primary)-1]
 	}
 
 	url := fmt.Sprintf("%s/%s/%s", primary, path, pubKey)
 
-	resp, err := server.httpClient.Get(url)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	// let the primary answer with a 304 if our copy is still current
+	if cached != "" {
+		if claims, err := jwt.DecodeGeneric(cached); err == nil {
+			req.Header.Set("If-None-Match", jwtETag(claims.ID))
+		}
+	}
 
-	// if we can't contact the primary, fallback to what we have on disk
+	if err := server.signPrimaryRequest(req); err != nil {
+		return "", err
+	}
+
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), server.primaryConnTrace()))
+	start := time.Now()
+	resp, err := httpClient.Do(req)
 	if err != nil {
-		theJWT, err := server.jwtStore.Load(pubKey)
-		return theJWT, err
+		server.metrics.primaryFetchLatency.observe(fetchOutcome(0, err), time.Since(start))
+		return "", errPrimaryUnreachable
+	}
+	defer resp.Body.Close()
+
+	// the body is read before the latency is recorded, unless the status ends the fetch
+	observed := false
+	observe := func(err error) {
+		if !observed {
+			observed = true
+			server.metrics.primaryFetchLatency.observe(fetchOutcome(resp.StatusCode, err), time.Since(start))
+		}
+	}
+	defer observe(nil)
+
+	if resp.StatusCode == http.StatusNotModified && cached != "" {
+		atomic.StoreInt32(&server.primaryFetched, 1)
+		server.primaryContacted()
+		server.markValid(pubKey, server.cacheTTLForPath(path))
+		return cached, nil
+	}
+
+	// the account was deleted, the primary's tombstone is kept so the next lookup doesn't ask again
+	if resp.StatusCode == http.StatusGone {
+		atomic.StoreInt32(&server.primaryFetched, 1)
+		server.primaryContacted()
+		if tombstone, ok := readTombstone(pubKey, resp.Body); ok {
+			if err := server.saveTombstone(tombstone); err != nil {
+				atomic.AddUint64(&server.metrics.storeErrors, 1)
+				return "", err
+			}
+			server.markValid(pubKey, server.cacheTTLForPath(path))
+		}
+		return "", store.ErrDeleted
+	}
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return "", errPrimaryServerError
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		atomic.StoreInt32(&server.primaryFetched, 1)
+		server.primaryContacted()
+		return "", store.ErrNotFound
 	}
 
 	// but if the primary wasn't happy with the request, return an error
@@ -324,30 +793,161 @@ func (server *AccountServer) loadReplicatedJWT(pubKey string, path string) (stri
 		return "", fmt.Errorf("primary did not return with status OK")
 	}
 
+	// a primary that stops sending, or hits the deadline, part way through is as good as unreachable
 	body, err := ioutil.ReadAll(resp.Body)
+	observe(err)
 	if err != nil {
-		return "", err
+		return "", errPrimaryUnreachable
 	}
 
 	theJWT := string(body)
+	atomic.StoreInt32(&server.primaryFetched, 1)
+	server.primaryContacted()
+
+	if err := server.verifyFetchedJWT(pubKey, theJWT); err != nil {
+		return "", server.rejectPrimaryJWT(primary, pubKey, err)
+	}
 
-	err = server.jwtStore.Save(pubKey, theJWT)
+	err = server.saveJWT(pubKey, theJWT)
 	if err != nil {
+		atomic.AddUint64(&server.metrics.storeErrors, 1)
 		return "", err
 	}
+	server.indexJWT(pubKey, theJWT)
+
+	server.markValid(pubKey, server.cacheTTLForPath(path))
+
+	return theJWT, nil
+}
 
-	// Default cache time is 1 hour (see cacheControl)
+// refreshInBackground fetches a stale JWT from the primary without holding up the request
+// that found it, one fetch per key runs at a time
+func (server *AccountServer) refreshInBackground(pubKey string, path string) {
+	if !server.startRefresh(pubKey) {
+		return
+	}
+
+	go func() {
+		defer server.endRefresh(pubKey)
+
+		if !server.checkRunning() {
+			return
+		}
+
+		cached, _ := server.jwtStore.Load(pubKey)
+		if _, err := server.fetchFromPrimary(pubKey, path, cached); err != nil {
+			server.logger.WithFields(logging.Fields{"account": pubKey, "error": err}).Debugf("unable to refresh stale JWT for %s, %s", ShortKey(pubKey), err.Error())
+		}
+	}()
+}
+
+// startRefresh returns false if the JWT is already being fetched in the background
+func (server *AccountServer) startRefresh(pubKey string) bool {
 	server.cacheLock.Lock()
-	server.validUntil[pubKey] = time.Now().Add(time.Hour)
+	defer server.cacheLock.Unlock()
+	if server.refreshing[pubKey] {
+		return false
+	}
+	server.refreshing[pubKey] = true
+	return true
+}
+
+func (server *AccountServer) endRefresh(pubKey string) {
+	server.cacheLock.Lock()
+	delete(server.refreshing, pubKey)
 	server.cacheLock.Unlock()
+}
 
-	return theJWT, nil
+// markValid resets the stale time for a replicated JWT using the replica cache TTL, or the
+// cache TTL for its type if that is shorter, a zero stale time never expires
+func (server *AccountServer) markValid(pubKey string, cacheTTL int) {
+	var staleAt time.Time
+	ttl := server.replicaTTL(cacheTTL)
+	if ttl > 0 {
+		staleAt = time.Now().Add(time.Duration(ttl) * time.Second)
+	}
+
+	server.cacheLock.Lock()
+	server.validUntil[pubKey] = staleAt
+	server.cacheLock.Unlock()
+	atomic.StoreInt32(&server.replicaCacheDirty, 1)
+}
+
+// replicaTTL is the seconds a replicated JWT stays fresh, 0 means it never goes stale
+func (server *AccountServer) replicaTTL(cacheTTL int) int {
+	ttl := server.currentConfig().ReplicaCacheTTL
+	if ttl > 0 && cacheTTL > 0 && cacheTTL < ttl {
+		ttl = cacheTTL
+	}
+	return ttl
+}
+
+// cacheTTLForPath returns the cache TTL for the JWTs fetched from a primary path
+func (server *AccountServer) cacheTTLForPath(path string) int {
+	config := server.currentConfig()
+	if path == activationsPath {
+		return config.ActivationCacheTTL
+	}
+	return config.AccountCacheTTL
+}
+
+// forgetValid drops the stale time for a JWT that was deleted
+func (server *AccountServer) forgetValid(pubKey string) {
+	server.cacheLock.Lock()
+	delete(server.validUntil, pubKey)
+	server.cacheLock.Unlock()
+	atomic.StoreInt32(&server.replicaCacheDirty, 1)
+}
+
+// loadAccountJWT loads an account JWT, falling back to the configured system account
+func (server *AccountServer) loadAccountJWT(pubKey string) (string, error) {
+	theJWT, _, err := server.loadAccount(pubKey)
+	return theJWT, err
 }
 
-func (server *AccountServer) loadJWT(pubKey string, path string) (string, error) {
-	if server.primary != "" {
+// loadAccount loads an account JWT like loadAccountJWT, and returns true if it is a stale
+// copy served while the primary is down
+func (server *AccountServer) loadAccount(pubKey string) (string, bool, error) {
+	now := time.Now()
+	var theJWT string
+	var stale bool
+	var err error
+
+	// a recent miss isn't looked up again until it expires or the account is saved
+	if server.misses.missing(pubKey, now) {
+		atomic.AddUint64(&server.metrics.negativeHits, 1)
+		err = store.ErrNotFound
+	} else {
+		theJWT, stale, err = server.loadJWT(pubKey, accountsPath)
+		if err == store.ErrNotFound {
+			server.misses.add(pubKey, now)
+		}
+	}
+
+	if err != nil && server.systemAccountClaims != nil && pubKey == server.systemAccountClaims.Subject && server.systemAccountJWT != "" {
+		server.logger.Tracef("returning system JWT from configuration")
+		theJWT, err = server.systemAccountJWT, nil
+	}
+
+	countLookup(&server.metrics.accountHits, &server.metrics.accountMisses, err)
+
+	if err != nil {
+		return "", false, err
+	}
+	server.lookups.add(pubKey, now)
+
+	return theJWT, stale, nil
+}
+
+func (server *AccountServer) loadJWT(pubKey string, path string) (string, bool, error) {
+	if primaries, _ := server.currentPrimaries(); primaries != nil {
 		return server.loadReplicatedJWT(pubKey, path)
 	}
 
-	return server.jwtStore.Load(pubKey)
+	if server.currentConfig().Relay.UpstreamSubjectPrefix != "" {
+		return server.loadRelayedJWT(pubKey, path)
+	}
+
+	theJWT, err := server.loadStored(pubKey)
+	return theJWT, false, err
 }
@@ -17,103 +17,414 @@
 package core
 
 import (
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/logging"
+	"github.com/nats-io/nats-account-server/server/store"
 	"github.com/nats-io/nkeys"
 )
 
+const (
+	accountUnchanged = "unchanged"
+	accountUpdated   = "updated"
+)
+
+// accountUpdateResponse is the body of a successful account POST, previous_jti is the JTI of
+// the JWT that was replaced, if there was one
+type accountUpdateResponse struct {
+	Status      string `json:"status"`
+	JTI         string `json:"jti"`
+	PreviousJTI string `json:"previous_jti,omitempty"`
+}
+
 // UpdateAccountJWT is the target of the post request that updates an account JWT
-// Sends a nats notification
+// Sends a nats notification, unless the JWT is already stored
 func (server *AccountServer) UpdateAccountJWT(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	server.logger.Tracef("%s: %s", r.RemoteAddr, r.URL.String())
-	theJWT, err := ioutil.ReadAll(r.Body)
+	logger := server.logger.WithContext(r.Context())
+	logger.Tracef("%s: %s", r.RemoteAddr, r.URL.String())
+	theJWT, err := server.readJWTBody(w, r)
 	defer r.Body.Close()
 	if err != nil {
-		server.sendErrorResponse(http.StatusBadRequest, "bad JWT in request", "", err, w)
+		server.sendBodyError("bad JWT in request", err, w)
 		return
 	}
 
 	claim, err := jwt.DecodeAccountClaims(string(theJWT))
 
 	if err != nil || claim == nil {
-		server.sendErrorResponse(http.StatusBadRequest, "bad JWT in request", "", err, w)
+		server.sendError(http.StatusBadRequest, CodeInvalidJWT, "bad JWT in request", "", err, w)
 		return
 	}
 
-	issuer := claim.Issuer
+	server.applyAccountJWT(w, claim, theJWT, "http")
+}
 
-	if !nkeys.IsValidPublicOperatorKey(claim.Issuer) {
-		server.sendErrorResponse(http.StatusBadRequest, "bad JWT Issuer in request", claim.Issuer, err, w)
+// applyAccountJWT validates and saves an account JWT, then sends the notification and writes
+// the response. source is recorded in the audit log.
+func (server *AccountServer) applyAccountJWT(w http.ResponseWriter, claim *jwt.AccountClaims, theJWT []byte, source string) {
+	pubKey := claim.Subject
+	shortCode := ShortKey(pubKey)
+	logger := server.logger.WithContext(requestContext(w)).WithFields(logging.Fields{"account": pubKey, "jti": claim.ID})
+
+	if status, err := server.validateAccountClaim(claim); err != nil {
+		code := CodeInvalidJWT
+		if status == http.StatusForbidden {
+			code = CodeUntrustedIssuer
+		}
+		server.sendError(status, code, err.Error(), pubKey, nil, w)
 		return
 	}
 
-	if !nkeys.IsValidPublicAccountKey(claim.Subject) {
-		server.sendErrorResponse(http.StatusBadRequest, "bad JWT Subject in request", claim.Subject, err, w)
+	if err := server.checkPolicies(claim); err != nil {
+		server.sendPolicyError(pubKey, err.(policyError), w)
 		return
 	}
 
-	ok := false
-
-	for _, k := range server.trustedKeys {
-		if k == issuer {
-			ok = true
-			break
+	previous, _ := server.loadStored(pubKey)
+	previousJTI := ""
+	if previous != "" {
+		if stored, err := jwt.DecodeGeneric(previous); err == nil {
+			previousJTI = stored.ID
 		}
 	}
 
-	if !ok {
-		server.sendErrorResponse(http.StatusBadRequest, "untrusted issuer in request", claim.Subject, err, w)
+	// nsc push sends every account each time, a JWT that is already stored isn't saved or sent
+	// again. The bytes are compared, the JTI doesn't cover the account's limits, exports and so on.
+	if previous == string(theJWT) {
+		atomic.AddUint64(&server.metrics.accountsUnchanged, 1)
+		logger.Debugf("JWT for account - %s - %s is unchanged", shortCode, claim.ID)
+		server.writeAccountUpdate(w, pubKey, accountUpdateResponse{Status: accountUnchanged, JTI: claim.ID})
 		return
 	}
 
-	pubKey := claim.Subject
-	shortCode := ShortKey(pubKey)
+	changed := server.accounts.changed(claim)
+
+	if err := server.saveJWT(pubKey, string(theJWT)); err != nil {
+		server.sendSaveError("error saving JWT", pubKey, err, w)
+		return
+	}
+	server.webhooks.add(claim, server.accountWebhookAction(pubKey))
+	server.indexAccount(claim)
+	server.audit.add(source, previous, string(theJWT))
+
+	atomic.AddUint64(&server.metrics.accountUpdates, 1)
+
+	if err := server.sendAccountNotification(claim, theJWT, traceHeaders(w)); err != nil {
+		server.sendError(http.StatusInternalServerError, CodeNotificationError, "error sending notification of change", pubKey, err, w)
+		return
+	}
+
+	if changed {
+		go server.replayActivations(pubKey)
+	}
+
+	logger.Noticef("updated JWT for account - %s - %s", shortCode, claim.ID)
+	server.writeAccountUpdate(w, pubKey, accountUpdateResponse{Status: accountUpdated, JTI: claim.ID, PreviousJTI: previousJTI})
+}
+
+func (server *AccountServer) writeAccountUpdate(w http.ResponseWriter, pubKey string, resp accountUpdateResponse) {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		server.sendErrorResponse(http.StatusInternalServerError, "unable to encode response", pubKey, err, w)
+		return
+	}
+
+	w.Header().Set(ContentType, ApplicationJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// validateAccountClaim runs the checks an account JWT has to pass before it is saved,
+// returning the HTTP status to use if it fails
+func (server *AccountServer) validateAccountClaim(claim *jwt.AccountClaims) (int, error) {
+	if !nkeys.IsValidPublicOperatorKey(claim.Issuer) {
+		return http.StatusBadRequest, fmt.Errorf("bad JWT Issuer in request")
+	}
+
+	if !nkeys.IsValidPublicAccountKey(claim.Subject) {
+		return http.StatusBadRequest, fmt.Errorf("bad JWT Subject in request")
+	}
+
+	if err := server.checkTrustedIssuer(claim.Issuer); err != nil {
+		return http.StatusForbidden, fmt.Errorf("untrusted issuer in request, %s", err.Error())
+	}
 
 	vr := &jwt.ValidationResults{}
 
 	claim.Validate(vr)
 
-	if vr.IsBlocking(true) {
+	// the time checks in Validate don't allow for clock skew, so they are replaced with the server's
+	if err := server.checkClaimTimes(claim.Expires, claim.NotBefore); err != nil {
+		vr.AddError(err.Error())
+	}
+
+	if vr.IsBlocking(false) {
 		var lines []string
 		lines = append(lines, "The server was unable to update your account JWT. One more more validation issues occurred.")
 		for _, vi := range vr.Issues {
+			if vi.TimeCheck {
+				continue
+			}
 			lines = append(lines, fmt.Sprintf("\t - %s\n", vi.Description))
 		}
-		msg := strings.Join(lines, "\n")
-		server.logger.Errorf("attempt to update JWT %s with blocking validation errors", shortCode)
-		http.Error(w, msg, http.StatusBadRequest)
+		return http.StatusBadRequest, fmt.Errorf("%s", strings.Join(lines, "\n"))
+	}
+
+	return http.StatusOK, nil
+}
+
+// checkTrustedIssuer returns an error if issuer isn't a trusted operator key,
+// the trusted keys include the operator's signing keys
+func (server *AccountServer) checkTrustedIssuer(issuer string) error {
+	keys := server.currentTrustedKeys()
+	for _, k := range keys {
+		if k == issuer {
+			return nil
+		}
+	}
+
+	if len(keys) == 0 {
+		return fmt.Errorf("no trusted operator keys are configured")
+	}
+
+	return fmt.Errorf("%s is not a trusted operator key", issuer)
+}
+
+// readDeleteAuthorization decodes the JWT in the body of a delete request, returning it with the
+// claims, or the status and an error if there isn't one, it doesn't decode or isn't valid now
+func (server *AccountServer) readDeleteAuthorization(w http.ResponseWriter, r *http.Request, required string) (*jwt.GenericClaims, string, int, error) {
+	body, err := server.readJWTBody(w, r)
+	if _, ok := err.(jwtTooLargeError); ok {
+		return nil, "", http.StatusRequestEntityTooLarge, err
+	}
+	if err != nil {
+		return nil, "", http.StatusBadRequest, err
+	}
+
+	if len(body) == 0 {
+		return nil, "", http.StatusUnauthorized, fmt.Errorf("a JWT signed by the %s is required", required)
+	}
+
+	// decoding checks the signature
+	token := strings.TrimSpace(string(body))
+	claim, err := jwt.DecodeGeneric(token)
+	if err != nil {
+		return nil, "", http.StatusBadRequest, err
+	}
+
+	if err := server.checkClaimTimes(claim.Expires, claim.NotBefore); err != nil {
+		return nil, "", http.StatusForbidden, err
+	}
+
+	return claim, token, http.StatusOK, nil
+}
+
+// checkDeleteAuthorization returns the issuer and the JWT if the request body is a JWT, signed by
+// a trusted operator key, with the account to delete as its subject, otherwise the status and an error
+func (server *AccountServer) checkDeleteAuthorization(w http.ResponseWriter, r *http.Request, pubKey string) (string, string, int, error) {
+	claim, token, status, err := server.readDeleteAuthorization(w, r, "operator")
+	if err != nil {
+		return "", "", status, err
+	}
+
+	if err := server.checkDeleteClaim(claim, pubKey); err != nil {
+		return "", "", http.StatusForbidden, err
+	}
+
+	return claim.Issuer, token, http.StatusOK, nil
+}
+
+// checkDeleteClaim returns an error unless the claim is signed by a trusted operator key and has
+// the account as its subject, for deletes over HTTP and in notifications
+func (server *AccountServer) checkDeleteClaim(claim *jwt.GenericClaims, pubKey string) error {
+	if err := server.checkTrustedIssuer(claim.Issuer); err != nil {
+		return err
+	}
+
+	if claim.Subject != pubKey {
+		return fmt.Errorf("JWT subject %s doesn't match the account", claim.Subject)
+	}
+	return nil
+}
+
+// DeleteAccountJWT replaces an account JWT with a tombstone, the body must be a JWT signed
+// by a trusted operator key with the account as the subject. Lookups for the account get a
+// 410 until garbage collection removes the tombstone.
+// Sends a nats notification
+func (server *AccountServer) DeleteAccountJWT(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logger := server.logger.WithContext(r.Context())
+	logger.Tracef("%s: %s", r.RemoteAddr, r.URL.String())
+	defer r.Body.Close()
+	pubKey := string(params.ByName("pubkey"))
+	shortCode := ShortKey(pubKey)
+
+	if !nkeys.IsValidPublicAccountKey(pubKey) {
+		server.sendErrorResponse(http.StatusBadRequest, "bad account public key in request", pubKey, nil, w)
+		return
+	}
+
+	deletedBy, deleteClaim, status, err := server.checkDeleteAuthorization(w, r, pubKey)
+	if err != nil {
+		server.sendErrorResponse(status, fmt.Sprintf("delete not authorized, %s", err.Error()), pubKey, nil, w)
 		return
 	}
 
-	if err := server.jwtStore.Save(pubKey, string(theJWT)); err != nil {
-		server.sendErrorResponse(http.StatusInternalServerError, "error saving JWT", shortCode, err, w)
+	if _, err := server.loadStored(pubKey); err == store.ErrNotFound {
+		server.sendErrorResponse(http.StatusNotFound, "no matching JWT found", pubKey, err, w)
+		return
+	} else if err == store.ErrDeleted {
+		server.writeTombstone(w, pubKey)
+		return
+	} else if err != nil {
+		server.sendError(http.StatusInternalServerError, CodeStoreError, "error loading JWT", pubKey, err, w)
+		return
+	}
+
+	tombstone := store.Tombstone{PubKey: pubKey, DeletedAt: time.Now().Unix(), DeletedBy: deletedBy}
+	if err := server.saveTombstone(tombstone); err != nil {
+		server.sendSaveError("error deleting JWT", pubKey, err, w)
+		return
+	}
+
+	if err := server.sendAccountDeleteNotification(tombstone, deleteClaim, traceHeaders(w)); err != nil {
+		server.sendError(http.StatusInternalServerError, CodeNotificationError, "error sending notification of delete", pubKey, err, w)
+		return
+	}
+
+	logger.WithFields(logging.Fields{"account": pubKey}).Noticef("deleted JWT for account - %s", shortCode)
+	w.WriteHeader(http.StatusOK)
+}
+
+// account listing page sizes
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// ListAccounts returns a JSON array with a summary of each account, in public key order, from
+// the account index. The after query parameter skips keys up to and including the one provided,
+// and limit sets the page size. With expired=true only expired accounts are listed, with false
+// only unexpired ones. A name query parameter looks up the account like GetAccountJWT.
+func (server *AccountServer) ListAccounts(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	query := r.URL.Query()
+	if query.Get("name") != "" {
+		server.GetAccountJWT(w, r, params)
 		return
 	}
 
-	if err := server.sendAccountNotification(claim, theJWT); err != nil {
-		server.sendErrorResponse(http.StatusInternalServerError, "error sending notification of change", shortCode, err, w)
+	limit := defaultListLimit
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			server.sendErrorResponse(http.StatusBadRequest, fmt.Sprintf("bad limit %q", value), "", err, w)
+			return
+		}
+		limit = parsed
+	}
+	if limit > maxListLimit {
+		limit = maxListLimit
+	}
+
+	filter := accountFilter{}
+	if value := query.Get("expired"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			server.sendErrorResponse(http.StatusBadRequest, fmt.Sprintf("bad expired filter %q", value), "", err, w)
+			return
+		}
+		filter.expired = &parsed
+	}
+
+	if value := query.Get("signedBy"); value != "" {
+		if !nkeys.IsValidPublicOperatorKey(value) {
+			server.sendErrorResponse(http.StatusBadRequest, fmt.Sprintf("signedBy %q is not an operator public key", value), "", nil, w)
+			return
+		}
+		filter.signedBy = value
+	}
+
+	summaries := server.accounts.list(query.Get("after"), limit, filter, time.Now().Unix())
+
+	data, err := json.Marshal(summaries)
+	if err != nil {
+		server.sendErrorResponse(http.StatusInternalServerError, "unable to encode accounts", "", err, w)
 		return
 	}
 
-	server.logger.Noticef("updated JWT for account - %s - %s", shortCode, claim.ID)
+	w.Header().Set(ContentType, ApplicationJSON)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// accountName is returned when more than one account has the requested name
+type accountName struct {
+	PubKey string `json:"pubkey"`
+	Name   string `json:"name"`
+}
+
+// accountForName finds the account with a name, if there isn't exactly one the response
+// is written and false is returned
+func (server *AccountServer) accountForName(w http.ResponseWriter, name string) (string, bool) {
+	pubKeys := server.accountNames.lookup(name)
+
+	switch len(pubKeys) {
+	case 0:
+		server.sendErrorResponse(http.StatusNotFound, fmt.Sprintf("no account named %q", name), "", nil, w)
+		return "", false
+	case 1:
+		return pubKeys[0], true
+	}
+
+	matches := make([]accountName, 0, len(pubKeys))
+	for _, pubKey := range pubKeys {
+		matches = append(matches, accountName{PubKey: pubKey, Name: name})
+	}
+
+	data, err := json.Marshal(matches)
+	if err != nil {
+		server.sendErrorResponse(http.StatusInternalServerError, "unable to encode matching accounts", "", err, w)
+		return "", false
+	}
+
+	w.Header().Set(ContentType, ApplicationJSON)
 	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+	return "", false
 }
 
-// GetAccountJWT looks up an account JWT by public key and returns it
+// GetAccountJWT looks up an account JWT by public key, or by name, and returns it
 // Supports cache control
 func (server *AccountServer) GetAccountJWT(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	server.logger.Tracef("%s: %s", r.RemoteAddr, r.URL.String())
+	logger := server.logger.WithContext(r.Context())
+	logger.Tracef("%s: %s", r.RemoteAddr, r.URL.String())
 	pubKey := string(params.ByName("pubkey"))
+
+	// httprouter can't have a static path beside :pubkey, so the report is routed here
+	if pubKey == "expiring" {
+		server.ListExpiringAccounts(w, r, params)
+		return
+	}
+
+	if name := r.URL.Query().Get("name"); pubKey == "" && name != "" {
+		var found bool
+		if pubKey, found = server.accountForName(w, name); !found {
+			return
+		}
+	}
+
 	shortCode := ShortKey(pubKey)
 
 	if pubKey == "" {
-		server.logger.Tracef("server sent resolver check")
+		logger.Tracef("server sent resolver check")
 		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
 		w.Header().Set("Pragma", "no-cache")
 		w.Header().Set("Expires", "0")
@@ -121,23 +432,39 @@ func (server *AccountServer) GetAccountJWT(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	server.logger.Tracef("request for JWT for - %s", ShortKey(pubKey))
+	logger.Tracef("request for JWT for - %s", ShortKey(pubKey))
 
 	check := strings.ToLower(r.URL.Query().Get("check")) == "true"
 	notify := strings.ToLower(r.URL.Query().Get("notify")) == "true"
 	decode := strings.ToLower(r.URL.Query().Get("decode")) == "true"
 	text := strings.ToLower(r.URL.Query().Get("text")) == "true"
+	pretty := strings.ToLower(r.URL.Query().Get("pretty")) == "true"
+
+	fields, err := parseClaimFields(r.URL.Query().Get("fields"), accountClaimFields)
+	if err != nil {
+		server.sendErrorResponse(http.StatusBadRequest, err.Error(), pubKey, nil, w)
+		return
+	}
+
+	theJWT, stale, err := server.loadAccount(pubKey)
 
-	theJWT, err := server.loadJWT(pubKey, "jwt/v1/accounts")
+	if err == store.ErrDeleted {
+		server.writeTombstone(w, pubKey)
+		return
+	}
 
 	if err != nil {
-		if server.systemAccountClaims != nil && pubKey == server.systemAccountClaims.Subject && server.systemAccountJWT != "" {
-			theJWT = server.systemAccountJWT
-			server.logger.Tracef("returning system JWT from configuration")
-		} else {
-			server.sendErrorResponse(http.StatusInternalServerError, "error loading JWT", shortCode, err, w)
-			return
-		}
+		server.sendError(lookupErrorStatus(err, http.StatusInternalServerError), lookupErrorCode(err), "error loading JWT", pubKey, err, w)
+		return
+	}
+
+	if server.refuseLegacy(pubKey, theJWT) {
+		writeError(w, http.StatusNotFound, CodeLegacyJWT, "JWT is in a legacy format", pubKey)
+		return
+	}
+
+	if stale {
+		w.Header().Set("Warning", staleWarning)
 	}
 
 	if text {
@@ -145,60 +472,59 @@ func (server *AccountServer) GetAccountJWT(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	if decode && (pretty || len(fields) > 0) {
+		server.writeDecodedAccountClaims(w, pubKey, theJWT, fields, pretty)
+		return
+	}
+
 	if decode {
-		server.writeDecodedJWT(w, pubKey, theJWT)
+		server.writeDecodedJWT(w, pubKey, theJWT, nil)
 		return
 	}
 
 	decoded, err := jwt.DecodeAccountClaims(theJWT)
 
 	if err != nil {
-		server.sendErrorResponse(http.StatusInternalServerError, "error loading JWT", shortCode, err, w)
+		server.sendError(http.StatusInternalServerError, CodeStoreError, "error loading JWT", pubKey, err, w)
 		return
 	}
 
 	if check {
 		now := time.Now().UTC().Unix()
 		if decoded.Expires < now && decoded.Expires > 0 {
-			w.WriteHeader(http.StatusNotFound)
+			writeError(w, http.StatusNotFound, CodeNotFound, "JWT has expired", pubKey)
 			return
 		}
 	}
 
-	// Check for if not modified, and also set etag and cache control
-	e := `"` + decoded.ID + `"`
+	// Set etag and cache control, a 304 carries them too so clients can keep using their copy
+	e := jwtETag(decoded.ID)
+	w.Header().Set("Etag", e)
 
-	if match := r.Header.Get("If-None-Match"); match != "" {
-		if strings.Contains(match, e) {
-			w.WriteHeader(http.StatusNotModified)
-			return
-		}
+	server.setCacheHeaders(w, pubKey, decoded.Expires, server.currentConfig().AccountCacheTTL)
+
+	if etagMatches(r.Header.Get("If-None-Match"), e) {
+		w.WriteHeader(http.StatusNotModified)
+		return
 	}
 
 	// send notification if requested, even though this is a GET request
 	if notify {
-		server.logger.Tracef("trying to send notification for - %s", shortCode)
-		if err := server.sendAccountNotification(decoded, []byte(theJWT)); err != nil {
-			server.sendErrorResponse(http.StatusInternalServerError, "error sending notification of change", shortCode, err, w)
+		logger.WithFields(logging.Fields{"account": pubKey}).Tracef("trying to send notification for - %s", shortCode)
+		if err := server.sendAccountNotification(decoded, []byte(theJWT), traceHeaders(w)); err != nil {
+			server.sendError(http.StatusInternalServerError, CodeNotificationError, "error sending notification of change", pubKey, err, w)
 			return
 		}
 	}
 
-	w.Header().Set("Etag", e)
-
-	cacheControl := server.cacheControlForExpiration(pubKey, decoded.Expires)
-
-	if cacheControl != "" {
-		w.Header().Set("Cache-Control", cacheControl)
-	}
-
 	w.Header().Add(ContentType, ApplicationJWT)
 	w.WriteHeader(http.StatusOK)
 	_, err = w.Write([]byte(theJWT))
 
+	logger = logger.WithFields(logging.Fields{"account": pubKey})
 	if err != nil {
-		server.logger.Errorf("error writing JWT for %s - %s", shortCode, err.Error())
+		logger.WithFields(logging.Fields{"error": err}).Errorf("error writing JWT for %s - %s", shortCode, err.Error())
 	} else {
-		server.logger.Tracef("returning JWT for - %s", shortCode)
+		logger.Tracef("returning JWT for - %s", shortCode)
 	}
 }
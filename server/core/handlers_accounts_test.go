@@ -18,16 +18,19 @@ package core
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/nats-io/jwt"
 	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/store"
 	nats "github.com/nats-io/nats.go"
 	"github.com/nats-io/nkeys"
 	"github.com/stretchr/testify/require"
@@ -115,7 +118,7 @@ func TestUploadGetAccountJWT(t *testing.T) {
 	acctJWT, err := account.Encode(operatorKey)
 	require.NoError(t, err)
 	notificationJWT := ""
-	subject := fmt.Sprintf(accountNotificationFormat, pubKey)
+	subject := testEnv.Server.accountNotificationSubject(pubKey)
 	_, err = testEnv.NC.Subscribe(subject, func(m *nats.Msg) {
 		lock.Lock()
 		notificationJWT = string(m.Data)
@@ -386,13 +389,122 @@ func TestUnknownSigner(t *testing.T) {
 
 	resp, err := testEnv.HTTP.Post(url, "application/json", bytes.NewBuffer([]byte(acctJWT)))
 	require.NoError(t, err)
-	require.False(t, resp.StatusCode == http.StatusOK)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
 
 	resp, err = testEnv.HTTP.Get(url)
 	require.NoError(t, err)
 	require.False(t, resp.StatusCode == http.StatusOK)
 }
 
+func TestTrustedOperatorKeys(t *testing.T) {
+	signingKey, err := nkeys.CreateOperator()
+	require.NoError(t, err)
+
+	signingPubKey, err := signingKey.PublicKey()
+	require.NoError(t, err)
+
+	config := conf.DefaultServerConfig()
+	config.TrustedOperatorKeys = []string{signingPubKey}
+
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	unknownKey, err := nkeys.CreateOperator()
+	require.NoError(t, err)
+
+	unknownPubKey, err := unknownKey.PublicKey()
+	require.NoError(t, err)
+
+	post := func(signer nkeys.KeyPair) *http.Response {
+		accountKey, err := nkeys.CreateAccount()
+		require.NoError(t, err)
+
+		pubKey, err := accountKey.PublicKey()
+		require.NoError(t, err)
+
+		acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(signer)
+		require.NoError(t, err)
+
+		url := testEnv.URLForPath(fmt.Sprintf("/jwt/v1/accounts/%s", pubKey))
+		resp, err := testEnv.HTTP.Post(url, "application/json", bytes.NewBuffer([]byte(acctJWT)))
+		require.NoError(t, err)
+		return resp
+	}
+
+	// keys from the config are trusted along with the operator JWT
+	resp := post(signingKey)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = post(testEnv.OperatorKey)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = post(unknownKey)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), unknownPubKey)
+}
+
+func TestNotYetValidJWT(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+
+	url := testEnv.URLForPath(fmt.Sprintf("/jwt/v1/accounts/%s", pubKey))
+
+	account := jwt.NewAccountClaims(pubKey)
+	account.NotBefore = time.Now().Unix() + 3600
+	acctJWT, err := account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	resp, err := testEnv.HTTP.Post(url, "application/json", bytes.NewBuffer([]byte(acctJWT)))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), "not yet valid")
+
+	// within the default clock skew
+	account.NotBefore = time.Now().Unix() + 10
+	acctJWT, err = account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	resp, err = testEnv.HTTP.Post(url, "application/json", bytes.NewBuffer([]byte(acctJWT)))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestAllowExpired(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.AllowExpired = true
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+
+	account := jwt.NewAccountClaims(pubKey)
+	account.Expires = time.Now().Unix() - 1000
+	acctJWT, err := account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	url := testEnv.URLForPath(fmt.Sprintf("/jwt/v1/accounts/%s", pubKey))
+	resp, err := testEnv.HTTP.Post(url, "application/json", bytes.NewBuffer([]byte(acctJWT)))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
 func TestExpiredAccount(t *testing.T) {
 	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
 	defer testEnv.Cleanup()
@@ -464,4 +576,418 @@ func TestCacheHeader(t *testing.T) {
 	resp, err = testEnv.HTTP.Do(request)
 	require.NoError(t, err)
 	require.Equal(t, http.StatusNotModified, resp.StatusCode)
+	require.Equal(t, etag, resp.Header.Get("Etag"))
+
+	// lists and weak tags match too
+	request.Header.Set("If-None-Match", `"other", W/`+etag)
+	resp, err = testEnv.HTTP.Do(request)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	request.Header.Set("If-None-Match", `"other"`)
+	resp, err = testEnv.HTTP.Do(request)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestCacheTTLs(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.AccountCacheTTL = 300
+	config.ActivationCacheTTL = 0
+	config.OperatorCacheTTL = 60
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+
+	account := jwt.NewAccountClaims(pubKey)
+	account.Expires = time.Now().Add(time.Minute).Unix()
+	acctJWT, err := account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	url := testEnv.URLForPath("/jwt/v1/accounts/" + pubKey)
+	resp, err := testEnv.HTTP.Post(url, "application/json", bytes.NewBuffer([]byte(acctJWT)))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// a JWT that expires before the TTL is only cached until it expires
+	resp, err = testEnv.HTTP.Get(url)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	cacheControl := resp.Header.Get("Cache-Control")
+	require.True(t, strings.HasPrefix(cacheControl, "max-age=6") || strings.HasPrefix(cacheControl, "max-age=5"), cacheControl)
+	require.Contains(t, cacheControl, "stale-while-revalidate=300")
+	expires, err := http.ParseTime(resp.Header.Get("Expires"))
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now().Add(time.Minute), expires, 5*time.Second)
+
+	account.Expires = 0
+	acctJWT, err = account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	resp, err = testEnv.HTTP.Post(url, "application/json", bytes.NewBuffer([]byte(acctJWT)))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = testEnv.HTTP.Get(url)
+	require.NoError(t, err)
+	require.Equal(t, "max-age=300, stale-while-revalidate=300, stale-if-error=300", resp.Header.Get("Cache-Control"))
+
+	// a zero TTL sends no-cache
+	importer, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	importerPubKey, err := importer.PublicKey()
+	require.NoError(t, err)
+
+	act := jwt.NewActivationClaims(importerPubKey)
+	act.ImportType = jwt.Stream
+	act.ImportSubject = "times.*"
+	actJWT, err := act.Encode(accountKey)
+	require.NoError(t, err)
+	act, err = jwt.DecodeActivationClaims(actJWT)
+	require.NoError(t, err)
+	hash, err := act.HashID()
+	require.NoError(t, err)
+
+	resp, err = testEnv.HTTP.Post(testEnv.URLForPath("/jwt/v1/activations"), "application/json", bytes.NewBuffer([]byte(actJWT)))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/activations/" + hash))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "no-cache", resp.Header.Get("Cache-Control"))
+	require.Empty(t, resp.Header.Get("Expires"))
+
+	resp, err = testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/operator"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "max-age=60, stale-while-revalidate=60, stale-if-error=60", resp.Header.Get("Cache-Control"))
+
+	// negative TTLs are rejected
+	bad := *config
+	bad.AccountCacheTTL = -1
+	require.Error(t, testEnv.Server.ReloadConfig(&bad))
+}
+
+func TestClaimExpiryHeaders(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.AccountCacheTTL = 3600
+	config.AllowExpired = true
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	_, pubKey, _ := CreateAccountKey(t)
+	url := testEnv.URLForPath("/jwt/v1/accounts/" + pubKey)
+	upload := func(expires int64) {
+		account := jwt.NewAccountClaims(pubKey)
+		account.Expires = expires
+		acctJWT, err := account.Encode(testEnv.OperatorKey)
+		require.NoError(t, err)
+		resp, err := testEnv.HTTP.Post(url, "application/json", bytes.NewBuffer([]byte(acctJWT)))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// an account expiring in 90 seconds isn't cached for the hour
+	expires := time.Now().Add(90 * time.Second).Unix()
+	upload(expires)
+	resp, err := testEnv.HTTP.Get(url)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Regexp(t, `^max-age=(89|90), `, resp.Header.Get("Cache-Control"))
+	require.Equal(t, time.Unix(expires, 0).UTC().Format(time.RFC3339), resp.Header.Get(ClaimExpiresHeader))
+	require.Empty(t, resp.Header.Get("Warning"))
+
+	// an expired account is still served, without caching
+	upload(time.Now().Add(-time.Minute).Unix())
+	resp, err = testEnv.HTTP.Get(url)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "no-cache", resp.Header.Get("Cache-Control"))
+	require.Equal(t, expiredWarning, resp.Header.Get("Warning"))
+	require.NotEmpty(t, resp.Header.Get(ClaimExpiresHeader))
+
+	upload(0)
+	resp, err = testEnv.HTTP.Get(url)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, "max-age=3600, stale-while-revalidate=3600, stale-if-error=3600", resp.Header.Get("Cache-Control"))
+	require.Empty(t, resp.Header.Get(ClaimExpiresHeader))
+}
+
+func TestDeleteAccountJWT(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+
+	account := jwt.NewAccountClaims(pubKey)
+	acctJWT, err := account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	deleted := make(chan *nats.Msg, 1)
+	subject := testEnv.Server.deleteNotificationSubject(pubKey)
+	_, err = testEnv.NC.Subscribe(subject, func(m *nats.Msg) {
+		deleted <- m
+	})
+	require.NoError(t, err)
+	testEnv.NC.Flush()
+
+	path := fmt.Sprintf("/jwt/v1/accounts/%s", pubKey)
+	url := testEnv.URLForPath(path)
+
+	resp, err := testEnv.HTTP.Post(url, "application/json", bytes.NewBuffer([]byte(acctJWT)))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	auth := deleteAuthorization(t, testEnv.OperatorKey, pubKey)
+	resp, err = testEnv.HTTP.Do(deleteRequest(t, url, auth))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	operatorKey := testEnv.OperatorPubKey
+
+	select {
+	case msg := <-deleted:
+		require.Equal(t, pubKey, string(msg.Data))
+		tombstone := tombstoneFromNotification(pubKey, msg)
+		require.Equal(t, operatorKey, tombstone.DeletedBy)
+		require.Equal(t, auth, msg.Header.Get(DeleteClaimHeader))
+	case <-time.After(2 * time.Second):
+		t.Fatal("delete notification not received")
+	}
+
+	// the account is gone, not missing
+	var tombstone store.Tombstone
+	resp, err = testEnv.HTTP.Get(url)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusGone, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&tombstone))
+	resp.Body.Close()
+	require.Equal(t, pubKey, tombstone.PubKey)
+	require.Equal(t, operatorKey, tombstone.DeletedBy)
+	require.WithinDuration(t, time.Now(), time.Unix(tombstone.DeletedAt, 0), 5*time.Second)
+
+	_, err = testEnv.Server.loadAccountJWT(pubKey)
+	require.Equal(t, store.ErrDeleted, err)
+	require.False(t, testEnv.Server.accounts.has(pubKey))
+
+	resp, err = testEnv.HTTP.Do(deleteRequest(t, url, auth))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusGone, resp.StatusCode)
+
+	// uploading the account again brings it back
+	resp, err = testEnv.HTTP.Post(url, "application/json", bytes.NewBuffer([]byte(acctJWT)))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = testEnv.HTTP.Get(url)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = testEnv.HTTP.Do(deleteRequest(t, testEnv.URLForPath("/jwt/v1/accounts/notakey"), auth))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+// deleteAuthorization returns a JWT for the body of a delete request
+func deleteAuthorization(t *testing.T, signer nkeys.KeyPair, pubKey string) string {
+	token, err := jwt.NewGenericClaims(pubKey).Encode(signer)
+	require.NoError(t, err)
+	return token
+}
+
+func deleteRequest(t *testing.T, url string, token string) *http.Request {
+	req, err := http.NewRequest(http.MethodDelete, url, strings.NewReader(token))
+	require.NoError(t, err)
+	return req
+}
+
+func TestDeleteAccountJWTAuthorization(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+
+	acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	url := testEnv.URLForPath(fmt.Sprintf("/jwt/v1/accounts/%s", pubKey))
+	resp, err := testEnv.HTTP.Post(url, "application/json", bytes.NewBuffer([]byte(acctJWT)))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	otherOperator, err := nkeys.CreateOperator()
+	require.NoError(t, err)
+
+	otherAccount, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+
+	otherPubKey, err := otherAccount.PublicKey()
+	require.NoError(t, err)
+
+	// break the signature by changing its last characters
+	good := deleteAuthorization(t, testEnv.OperatorKey, pubKey)
+	badSignature := good[:len(good)-4] + "AAAA"
+	if badSignature == good {
+		badSignature = good[:len(good)-4] + "BBBB"
+	}
+
+	expired := jwt.NewGenericClaims(pubKey)
+	expired.Expires = time.Now().Unix() - 1000
+	expiredToken, err := expired.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"missing", "", http.StatusUnauthorized},
+		{"not a JWT", "notajwt", http.StatusBadRequest},
+		{"bad signature", badSignature, http.StatusBadRequest},
+		{"signed by the account", deleteAuthorization(t, accountKey, pubKey), http.StatusForbidden},
+		{"signed by another operator", deleteAuthorization(t, otherOperator, pubKey), http.StatusForbidden},
+		{"for another account", deleteAuthorization(t, testEnv.OperatorKey, otherPubKey), http.StatusForbidden},
+		{"expired", expiredToken, http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		resp, err := testEnv.HTTP.Do(deleteRequest(t, url, test.token))
+		require.NoError(t, err)
+		require.Equal(t, test.status, resp.StatusCode, test.name)
+
+		_, err = testEnv.Server.jwtStore.Load(pubKey)
+		require.NoError(t, err, test.name)
+	}
+
+	resp, err = testEnv.HTTP.Do(deleteRequest(t, url, good))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestMaxJWTSize(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.MaxJWTSize = 1024
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+
+	account := jwt.NewAccountClaims(pubKey)
+	account.Tags.Add(strings.Repeat("a", 2048))
+	bigJWT, err := account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	url := testEnv.URLForPath(fmt.Sprintf("/jwt/v1/accounts/%s", pubKey))
+	resp, err := testEnv.HTTP.Post(url, "application/json", bytes.NewBufferString(bigJWT))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	require.Contains(t, string(body), "1024 byte limit")
+
+	resp, err = testEnv.HTTP.Post(testEnv.URLForPath("/jwt/v1/activations"), "application/json", bytes.NewBufferString(bigJWT))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	// under the limit is fine
+	account = jwt.NewAccountClaims(pubKey)
+	smallJWT, err := account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	resp, err = testEnv.HTTP.Post(url, "application/json", bytes.NewBufferString(smallJWT))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestUpdateAccountJWTUnchanged(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	_, pubKey, _ := CreateAccountKey(t)
+
+	notifications := int32(0)
+	_, err = testEnv.NC.Subscribe(testEnv.Server.accountNotificationSubject(pubKey), func(m *nats.Msg) {
+		atomic.AddInt32(&notifications, 1)
+	})
+	require.NoError(t, err)
+	testEnv.NC.Flush()
+
+	post := func(theJWT string) accountUpdateResponse {
+		resp, err := testEnv.HTTP.Post(testEnv.URLForPath("/jwt/v1/accounts/"+pubKey), "application/json", bytes.NewBuffer([]byte(theJWT)))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, ApplicationJSON, resp.Header.Get(ContentType))
+
+		var update accountUpdateResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&update))
+		testEnv.Server.nats.Flush()
+		testEnv.NC.Flush()
+		return update
+	}
+
+	account := jwt.NewAccountClaims(pubKey)
+	first, err := account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	firstClaims, err := jwt.DecodeAccountClaims(first)
+	require.NoError(t, err)
+
+	update := post(first)
+	require.Equal(t, accountUpdated, update.Status)
+	require.Equal(t, firstClaims.ID, update.JTI)
+	require.Empty(t, update.PreviousJTI)
+
+	update = post(first)
+	require.Equal(t, accountUnchanged, update.Status)
+	require.Equal(t, firstClaims.ID, update.JTI)
+	require.Equal(t, uint64(1), atomic.LoadUint64(&testEnv.Server.metrics.accountsUnchanged))
+	require.Equal(t, uint64(1), atomic.LoadUint64(&testEnv.Server.metrics.accountUpdates))
+
+	account.Limits.Conn = 10
+	second, err := account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	secondClaims, err := jwt.DecodeAccountClaims(second)
+	require.NoError(t, err)
+
+	update = post(second)
+	require.Equal(t, accountUpdated, update.Status)
+	require.Equal(t, secondClaims.ID, update.JTI)
+	require.Equal(t, firstClaims.ID, update.PreviousJTI)
+
+	// the unchanged upload wasn't sent
+	for i := 0; i < 50 && atomic.LoadInt32(&notifications) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, int32(2), atomic.LoadInt32(&notifications))
+
+	stored, err := testEnv.Server.jwtStore.Load(pubKey)
+	require.NoError(t, err)
+	require.Equal(t, second, stored)
 }
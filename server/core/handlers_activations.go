@@ -17,131 +17,427 @@
 package core
 
 import (
-	"io/ioutil"
+	"fmt"
 	"net/http"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/logging"
+	"github.com/nats-io/nats-account-server/server/store"
 	"github.com/nats-io/nkeys"
 )
 
 // UpdateActivationJWT is the handler for POST requests that update an activation JWT
 func (server *AccountServer) UpdateActivationJWT(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	theJWT, err := ioutil.ReadAll(r.Body)
+	logger := server.logger.WithContext(r.Context())
+	theJWT, err := server.readJWTBody(w, r)
 	defer r.Body.Close()
 	if err != nil {
-		server.sendErrorResponse(http.StatusBadRequest, "bad activation JWT in request", "", err, w)
+		server.sendBodyError("bad activation JWT in request", err, w)
 		return
 	}
 
 	claim, err := jwt.DecodeActivationClaims(string(theJWT))
 
 	if err != nil || claim == nil {
-		server.sendErrorResponse(http.StatusBadRequest, "bad activation JWT in request", "", err, w)
+		server.sendError(http.StatusBadRequest, CodeInvalidJWT, "bad activation JWT in request", "", err, w)
 		return
 	}
 
-	if !nkeys.IsValidPublicOperatorKey(claim.Issuer) && !nkeys.IsValidPublicAccountKey(claim.Issuer) {
-		server.sendErrorResponse(http.StatusBadRequest, "bad activation JWT Issuer in request", claim.Issuer, err, w)
+	hash, err := server.validateActivationClaim(claim)
+
+	if err != nil {
+		server.sendError(http.StatusBadRequest, CodeInvalidJWT, err.Error(), claim.Issuer, nil, w)
 		return
 	}
 
-	if !nkeys.IsValidPublicAccountKey(claim.Subject) {
-		server.sendErrorResponse(http.StatusBadRequest, "bad activation JWT Subject in request", claim.Subject, err, w)
+	if err := server.checkActivationCollision(hash, claim); err != nil {
+		server.sendError(http.StatusConflict, CodeActivationCollision, err.Error(), claim.Issuer, nil, w)
+		return
+	}
+
+	if err := server.saveJWT(hash, string(theJWT)); err != nil {
+		server.sendSaveError("error saving activation JWT", claim.Issuer, err, w)
+		return
+	}
+	server.activations.set(hash, claim)
+
+	atomic.AddUint64(&server.metrics.activationSaves, 1)
+
+	if err := server.sendActivationNotification(hash, claim.Issuer, theJWT, traceHeaders(w)); err != nil {
+		server.sendError(http.StatusInternalServerError, CodeNotificationError, "error sending notification of change", claim.Issuer, err, w)
 		return
 	}
 
+	// hash insures that exports has len > 0
+	logger.WithFields(logging.Fields{
+		"activation": hash,
+		"account":    claim.Issuer,
+		"jti":        claim.ID,
+	}).Noticef("updated activation JWT - %s-%s - %q", ShortKey(claim.Issuer), ShortKey(claim.Subject), claim.ImportSubject)
+	w.WriteHeader(http.StatusOK)
+}
+
+// validateActivationClaim runs the checks an activation JWT has to pass before it is saved,
+// returning the hash it is stored under
+func (server *AccountServer) validateActivationClaim(claim *jwt.ActivationClaims) (string, error) {
+	if !nkeys.IsValidPublicOperatorKey(claim.Issuer) && !nkeys.IsValidPublicAccountKey(claim.Issuer) {
+		return "", fmt.Errorf("bad activation JWT Issuer in request")
+	}
+
+	if !nkeys.IsValidPublicAccountKey(claim.Subject) {
+		return "", fmt.Errorf("bad activation JWT Subject in request")
+	}
+
+	if err := server.checkClaimTimes(claim.Expires, claim.NotBefore); err != nil {
+		return "", fmt.Errorf("bad activation JWT in request, %s", err.Error())
+	}
+
 	hash, err := claim.HashID()
 
 	if err != nil {
-		server.sendErrorResponse(http.StatusBadRequest, "bad activation hash in request", claim.Issuer, err, w)
+		return "", fmt.Errorf("bad activation hash in request, %s", err.Error())
+	}
+
+	if err := server.verifyActivationIssuer(claim); err != nil {
+		return "", err
+	}
+
+	return hash, nil
+}
+
+// activationIdentity is what an activation hash is calculated from, it is included when
+// an activation is decoded so hash collisions can be debugged
+type activationIdentity struct {
+	Hash          string `json:"hash"`
+	HashID        string `json:"hash_id"` // calculated from the claims, it differs from hash if the activation was stored under another one
+	Issuer        string `json:"issuer"`
+	Subject       string `json:"subject"`
+	ImportSubject string `json:"import_subject"`
+}
+
+func identityForActivation(hash string, claim *jwt.ActivationClaims) activationIdentity {
+	hashID, _ := claim.HashID()
+	return activationIdentity{
+		Hash:          hash,
+		HashID:        hashID,
+		Issuer:        claim.Issuer,
+		Subject:       claim.Subject,
+		ImportSubject: string(claim.ImportSubject),
+	}
+}
+
+// checkActivationCollision refuses to overwrite an activation stored under the same hash for a
+// different issuer and subject, collisions are logged and counted
+func (server *AccountServer) checkActivationCollision(hash string, claim *jwt.ActivationClaims) error {
+	stored, err := server.jwtStore.Load(hash)
+	if err != nil {
+		return nil
+	}
+
+	existing, err := jwt.DecodeActivationClaims(stored)
+	if err != nil || (existing.Issuer == claim.Issuer && existing.Subject == claim.Subject) {
+		return nil
+	}
+
+	atomic.AddUint64(&server.metrics.activationCollisions, 1)
+	server.logger.WithFields(logging.Fields{
+		"activation":     hash,
+		"issuer":         claim.Issuer,
+		"subject":        claim.Subject,
+		"stored_issuer":  existing.Issuer,
+		"stored_subject": existing.Subject,
+		"stored_jti":     existing.ID,
+		"jti":            claim.ID,
+	}).Errorf("activation hash collision for %s, stored for %s-%s, refusing to save one for %s-%s",
+		hash, existing.Issuer, existing.Subject, claim.Issuer, claim.Subject)
+
+	return fmt.Errorf("activation hash %s is already used by an activation from %s to %s", hash, existing.Issuer, existing.Subject)
+}
+
+// verifyActivationIssuer checks, when StrictActivations is set, that the account issuing an
+// activation is stored, hasn't expired and signed the activation with its own key or one of its
+// signing keys. Activations that fail are counted as rejected.
+func (server *AccountServer) verifyActivationIssuer(claim *jwt.ActivationClaims) error {
+	config := server.currentConfig()
+	if !config.StrictActivations {
+		return nil
+	}
+
+	err := server.checkActivationIssuer(claim, config.AcceptUnknownIssuers)
+	if err != nil {
+		atomic.AddUint64(&server.metrics.activationsRejected, 1)
+	}
+	return err
+}
+
+func (server *AccountServer) checkActivationIssuer(claim *jwt.ActivationClaims, acceptUnknown bool) error {
+	exporter := exporterForActivation(claim)
+	if !nkeys.IsValidPublicAccountKey(exporter) {
+		return fmt.Errorf("activation isn't issued by an account")
+	}
+
+	accountJWT, err := server.loadStored(exporter)
+	if err == store.ErrDeleted {
+		return fmt.Errorf("activation issuer account %s was deleted", ShortKey(exporter))
+	}
+	if err == store.ErrNotFound {
+		if acceptUnknown {
+			server.logger.WithFields(logging.Fields{"account": exporter}).Warnf("accepting activation from unknown account %s", ShortKey(exporter))
+			return nil
+		}
+		return fmt.Errorf("activation issuer account %s is unknown", ShortKey(exporter))
+	}
+	if err != nil {
+		atomic.AddUint64(&server.metrics.storeErrors, 1)
+		return fmt.Errorf("unable to load activation issuer account %s, %s", ShortKey(exporter), err.Error())
+	}
+
+	account, err := jwt.DecodeAccountClaims(accountJWT)
+	if err != nil {
+		return fmt.Errorf("activation issuer account %s doesn't decode, %s", ShortKey(exporter), err.Error())
+	}
+
+	if err := server.checkClaimTimes(account.Expires, account.NotBefore); err != nil {
+		return fmt.Errorf("activation issuer account %s is not valid, %s", ShortKey(exporter), err.Error())
+	}
+
+	// decoding checked the signature against the issuer, so it only has to belong to the account
+	if !account.DidSign(claim) {
+		return fmt.Errorf("activation isn't signed by account %s or one of its signing keys", ShortKey(exporter))
+	}
+	return nil
+}
+
+// activationForImport finds the hash of the activation that lets account import subject, if there
+// isn't exactly one the response is written and false is returned
+func (server *AccountServer) activationForImport(w http.ResponseWriter, r *http.Request) (string, bool) {
+	query := r.URL.Query()
+	account := query.Get("account")
+	subject := query.Get("subject")
+	exporter := query.Get("issuer")
+
+	if account == "" || subject == "" {
+		server.sendErrorResponse(http.StatusBadRequest, "activation lookups need a hash, or an account and subject", "", nil, w)
+		return "", false
+	}
+
+	hashes := server.activations.lookup(account, subject, exporter)
+
+	switch len(hashes) {
+	case 0:
+		server.sendErrorResponse(http.StatusNotFound, fmt.Sprintf("no activation for %s to import %q", ShortKey(account), subject), account, nil, w)
+		return "", false
+	case 1:
+		return hashes[0], true
+	}
+
+	server.sendErrorResponse(http.StatusConflict, fmt.Sprintf("%d accounts export %q to %s, add the issuer", len(hashes), subject, ShortKey(account)), account, nil, w)
+	return "", false
+}
+
+// checkActivationDeleteAuthorization returns the issuer and the JWT if the request body is a JWT that
+// passes checkActivationDeleteClaim, otherwise the status and an error
+func (server *AccountServer) checkActivationDeleteAuthorization(w http.ResponseWriter, r *http.Request, hash string, activation *jwt.ActivationClaims) (string, string, int, error) {
+	claim, token, status, err := server.readDeleteAuthorization(w, r, "operator or exporting account")
+	if err != nil {
+		return "", "", status, err
+	}
+
+	if err := server.checkActivationDeleteClaim(claim, hash, activation); err != nil {
+		return "", "", http.StatusForbidden, err
+	}
+	return claim.Issuer, token, http.StatusOK, nil
+}
+
+// checkActivationDeleteClaim returns an error unless the claim has the activation hash or the importing
+// account as its subject, and is signed by a trusted operator key or the exporting account or one of
+// its signing keys, for deletes over HTTP and in notifications
+func (server *AccountServer) checkActivationDeleteClaim(claim *jwt.GenericClaims, hash string, activation *jwt.ActivationClaims) error {
+	if claim.Subject != hash && claim.Subject != activation.Subject {
+		return fmt.Errorf("JWT subject %s doesn't match the activation or the importing account", claim.Subject)
+	}
+
+	if server.checkTrustedIssuer(claim.Issuer) == nil {
+		return nil
+	}
+
+	exporter := exporterForActivation(activation)
+	if claim.Issuer == exporter {
+		return nil
+	}
+
+	// signing keys are only known from the exporter's stored JWT
+	if accountJWT, err := server.loadStored(exporter); err == nil {
+		if account, err := jwt.DecodeAccountClaims(accountJWT); err == nil && account.SigningKeys.Contains(claim.Issuer) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s is not a trusted operator key, the exporting account or one of its signing keys", claim.Issuer)
+}
+
+// DeleteActivationJWT replaces an activation with a tombstone, it is found by hash or by the
+// importing account and subject like GetActivationJWT. Lookups for the activation by hash get
+// a 410 until garbage collection removes the tombstone.
+// Sends a nats notification
+func (server *AccountServer) DeleteActivationJWT(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logger := server.logger.WithContext(r.Context())
+	logger.Tracef("%s: %s", r.RemoteAddr, r.URL.String())
+	defer r.Body.Close()
+	hash := string(params.ByName("hash"))
+
+	if hash == "" {
+		var found bool
+		if hash, found = server.activationForImport(w, r); !found {
+			return
+		}
+	}
+
+	stored, err := server.loadStored(hash)
+	if err == store.ErrNotFound {
+		server.sendErrorResponse(http.StatusNotFound, "no matching JWT found", hash, err, w)
+		return
+	} else if err == store.ErrDeleted {
+		server.writeTombstone(w, hash)
+		return
+	} else if err != nil {
+		server.sendError(http.StatusInternalServerError, CodeStoreError, "error loading JWT", hash, err, w)
 		return
 	}
 
-	if err := server.jwtStore.Save(hash, string(theJWT)); err != nil {
-		server.sendErrorResponse(http.StatusInternalServerError, "error saving activation JWT", claim.Issuer, err, w)
+	activation, err := jwt.DecodeActivationClaims(stored)
+	if err != nil {
+		server.sendError(http.StatusInternalServerError, CodeStoreError, "error loading JWT", hash, err, w)
 		return
 	}
 
-	if err := server.sendActivationNotification(hash, claim.Issuer, theJWT); err != nil {
-		server.sendErrorResponse(http.StatusInternalServerError, "error saving activation JWT", claim.Issuer, err, w)
+	deletedBy, deleteClaim, status, err := server.checkActivationDeleteAuthorization(w, r, hash, activation)
+	if err != nil {
+		server.sendErrorResponse(status, fmt.Sprintf("delete not authorized, %s", err.Error()), hash, nil, w)
 		return
 	}
 
-	// hash insures that exports has len > 0
-	server.logger.Noticef("updated activation JWT - %s-%s - %q", ShortKey(claim.Issuer), ShortKey(claim.Subject), claim.ImportSubject)
+	tombstone := store.Tombstone{PubKey: hash, DeletedAt: time.Now().Unix(), DeletedBy: deletedBy}
+	if err := server.saveTombstone(tombstone); err != nil {
+		server.sendSaveError("error deleting JWT", hash, err, w)
+		return
+	}
+
+	if err := server.sendActivationDeleteNotification(tombstone, activation.Issuer, deleteClaim, traceHeaders(w)); err != nil {
+		server.sendError(http.StatusInternalServerError, CodeNotificationError, "error sending notification of delete", hash, err, w)
+		return
+	}
+
+	logger.WithFields(logging.Fields{
+		"activation": hash,
+		"account":    activation.Issuer,
+		"jti":        activation.ID,
+	}).Noticef("deleted activation JWT - %s-%s - %q", ShortKey(activation.Issuer), ShortKey(activation.Subject), activation.ImportSubject)
 	w.WriteHeader(http.StatusOK)
 }
 
-// GetActivationJWT looks for an activation token by hash
+// GetActivationJWT looks for an activation token by hash, or by the importing account and subject
 func (server *AccountServer) GetActivationJWT(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logger := server.logger.WithContext(r.Context())
 	hash := string(params.ByName("hash"))
+
+	if hash == "" {
+		var found bool
+		if hash, found = server.activationForImport(w, r); !found {
+			return
+		}
+	}
+
 	shortCode := ShortKey(hash)
 
 	decode := strings.ToLower(r.URL.Query().Get("decode")) == "true"
 	text := strings.ToLower(r.URL.Query().Get("text")) == "true"
 	notify := strings.ToLower(r.URL.Query().Get("notify")) == "true"
+	pretty := strings.ToLower(r.URL.Query().Get("pretty")) == "true"
 
-	theJWT, err := server.loadJWT(hash, "jwt/v1/activations")
+	fields, err := parseClaimFields(r.URL.Query().Get("fields"), activationClaimFields)
+	if err != nil {
+		server.sendErrorResponse(http.StatusBadRequest, err.Error(), shortCode, nil, w)
+		return
+	}
+
+	theJWT, stale, err := server.loadJWT(hash, activationsPath)
+	countLookup(&server.metrics.activationHits, &server.metrics.activationMisses, err)
+
+	if err == store.ErrDeleted {
+		server.writeTombstone(w, hash)
+		return
+	}
 
 	if err != nil {
-		server.logger.Errorf("unable to find requested activation JWT for %s - %s", hash, err.Error())
-		http.Error(w, "No Matching JWT", http.StatusNotFound)
+		logger.WithFields(logging.Fields{"activation": hash, "error": err}).Errorf("unable to find requested activation JWT for %s - %s", hash, err.Error())
+		writeError(w, lookupErrorStatus(err, http.StatusNotFound), lookupErrorCode(err), "No Matching JWT", "")
+		return
+	}
+
+	if server.refuseLegacy(hash, theJWT) {
+		writeError(w, http.StatusNotFound, CodeLegacyJWT, "JWT is in a legacy format", "")
 		return
 	}
 
+	if stale {
+		w.Header().Set("Warning", staleWarning)
+	}
+
 	if text {
 		server.writeJWTAsText(w, hash, theJWT)
 		return
 	}
 
-	if decode {
-		server.writeDecodedJWT(w, hash, theJWT)
+	if decode && (pretty || len(fields) > 0) {
+		server.writeDecodedActivationClaims(w, hash, theJWT, fields, pretty)
 		return
 	}
 
 	decoded, err := jwt.DecodeActivationClaims(theJWT)
 
 	if err != nil {
-		server.sendErrorResponse(http.StatusInternalServerError, "error loading JWT", shortCode, err, w)
+		server.sendError(http.StatusInternalServerError, CodeStoreError, "error loading JWT", shortCode, err, w)
 		return
 	}
 
-	// Check for if not modified, and also set etag and cache control
-	e := `"` + decoded.ID + `"`
+	if decode {
+		server.writeDecodedJWT(w, hash, theJWT, identityForActivation(hash, decoded))
+		return
+	}
 
-	if match := r.Header.Get("If-None-Match"); match != "" {
-		if strings.Contains(match, e) {
-			w.WriteHeader(http.StatusNotModified)
-			return
-		}
+	// Set etag and cache control, a 304 carries them too so clients can keep using their copy
+	e := jwtETag(decoded.ID)
+	w.Header().Set("Etag", e)
+
+	server.setCacheHeaders(w, hash, decoded.Expires, server.currentConfig().ActivationCacheTTL)
+
+	if etagMatches(r.Header.Get("If-None-Match"), e) {
+		w.WriteHeader(http.StatusNotModified)
+		return
 	}
 
 	// send notification if requested, even though this is a GET request
 	if notify {
-		server.logger.Tracef("trying to send notification for - %s", shortCode)
-		if err := server.sendActivationNotification(hash, decoded.Issuer, []byte(theJWT)); err != nil {
-			server.sendErrorResponse(http.StatusInternalServerError, "error sending notification of change", shortCode, err, w)
+		logger.WithFields(logging.Fields{"activation": hash}).Tracef("trying to send notification for - %s", shortCode)
+		if err := server.sendActivationNotification(hash, decoded.Issuer, []byte(theJWT), traceHeaders(w)); err != nil {
+			server.sendError(http.StatusInternalServerError, CodeNotificationError, "error sending notification of change", shortCode, err, w)
 			return
 		}
 	}
 
-	w.Header().Set("Etag", e)
-
-	cacheControl := server.cacheControlForExpiration(hash, decoded.Expires)
-
-	if cacheControl != "" {
-		w.Header().Set("Cache-Control", cacheControl)
-	}
-
 	w.Header().Add(ContentType, ApplicationJWT)
 	w.WriteHeader(http.StatusOK)
 	_, err = w.Write([]byte(theJWT))
 
+	logger = logger.WithFields(logging.Fields{"activation": hash})
 	if err != nil {
-		server.logger.Errorf("error writing JWT for %s - %s", shortCode, err.Error())
+		logger.WithFields(logging.Fields{"error": err}).Errorf("error writing JWT for %s - %s", shortCode, err.Error())
 	} else {
-		server.logger.Tracef("returning JWT for - %s", shortCode)
+		logger.Tracef("returning JWT for - %s", shortCode)
 	}
 }
@@ -23,11 +23,13 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/nats-io/jwt"
 	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/store"
 	nats "github.com/nats-io/nats.go"
 	"github.com/nats-io/nkeys"
 	"github.com/stretchr/testify/require"
@@ -66,7 +68,7 @@ func TestUploadGetActivationJWT(t *testing.T) {
 	require.NoError(t, err)
 
 	notificationJWT := ""
-	subject := fmt.Sprintf(activationNotificationFormat, acctPubKey, hash)
+	subject := testEnv.Server.activationNotificationSubject(acctPubKey, hash)
 	_, err = testEnv.NC.Subscribe(subject, func(m *nats.Msg) {
 		lock.Lock()
 		notificationJWT = string(m.Data)
@@ -266,3 +268,301 @@ func TestInvalidJWTType(t *testing.T) {
 	require.NoError(t, err)
 	require.False(t, resp.StatusCode == http.StatusOK)
 }
+
+func TestExpiredActivationJWT(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	account2Key, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+
+	acct2PubKey, err := account2Key.PublicKey()
+	require.NoError(t, err)
+
+	act := jwt.NewActivationClaims(acct2PubKey)
+	act.ImportType = jwt.Stream
+	act.ImportSubject = "times.*"
+	act.Expires = time.Now().Unix() - 1000
+	actJWT, err := act.Encode(accountKey)
+	require.NoError(t, err)
+
+	resp, err := testEnv.HTTP.Post(testEnv.URLForPath("/jwt/v1/activations"), "application/json", bytes.NewBuffer([]byte(actJWT)))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), "expired")
+}
+
+func TestStrictActivations(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.StrictActivations = true
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	exporterKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	exporter, err := exporterKey.PublicKey()
+	require.NoError(t, err)
+	signingKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	signingPubKey, err := signingKey.PublicKey()
+	require.NoError(t, err)
+	importerKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	importer, err := importerKey.PublicKey()
+	require.NoError(t, err)
+
+	newActivation := func(subject string, signer nkeys.KeyPair, issuerAccount string) (string, string) {
+		act := jwt.NewActivationClaims(importer)
+		act.ImportType = jwt.Stream
+		act.ImportSubject = jwt.Subject(subject)
+		act.IssuerAccount = issuerAccount
+		actJWT, err := act.Encode(signer)
+		require.NoError(t, err)
+		act, err = jwt.DecodeActivationClaims(actJWT)
+		require.NoError(t, err)
+		hash, err := act.HashID()
+		require.NoError(t, err)
+		return actJWT, hash
+	}
+
+	post := func(actJWT string) int {
+		resp, err := testEnv.HTTP.Post(testEnv.URLForPath("/jwt/v1/activations"), "application/json", bytes.NewBuffer([]byte(actJWT)))
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// the issuer account isn't stored yet
+	actJWT, _ := newActivation("times.*", exporterKey, "")
+	require.Equal(t, http.StatusBadRequest, post(actJWT))
+	require.Equal(t, uint64(1), atomic.LoadUint64(&testEnv.Server.metrics.activationsRejected))
+
+	lenient := *config
+	lenient.AcceptUnknownIssuers = true
+	require.NoError(t, testEnv.Server.ReloadConfig(&lenient))
+	require.Equal(t, http.StatusOK, post(actJWT))
+	require.NoError(t, testEnv.Server.ReloadConfig(config))
+
+	account := jwt.NewAccountClaims(exporter)
+	account.SigningKeys.Add(signingPubKey)
+	acctJWT, err := account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	require.NoError(t, testEnv.Server.jwtStore.Save(exporter, acctJWT))
+
+	require.Equal(t, http.StatusOK, post(actJWT))
+
+	// signed with one of the account's signing keys
+	actJWT, _ = newActivation("dates.*", signingKey, exporter)
+	require.Equal(t, http.StatusOK, post(actJWT))
+
+	// signed by a key the account doesn't know
+	actJWT, hash := newActivation("prices.*", importerKey, exporter)
+	require.Equal(t, http.StatusBadRequest, post(actJWT))
+
+	// notifications are checked too
+	testEnv.Server.handleActivationNotification(&nats.Msg{Data: []byte(actJWT)})
+	_, err = testEnv.Server.jwtStore.Load(hash)
+	require.Error(t, err)
+	require.Equal(t, uint64(3), atomic.LoadUint64(&testEnv.Server.metrics.activationsRejected))
+}
+
+func TestActivationHashCollision(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	_, exporter, exporterKey := CreateAccountKey(t)
+	_, importer, _ := CreateAccountKey(t)
+	_, other, otherKey := CreateAccountKey(t)
+
+	act := jwt.NewActivationClaims(importer)
+	act.ImportType = jwt.Stream
+	act.ImportSubject = "times.*"
+	actJWT, err := act.Encode(exporterKey)
+	require.NoError(t, err)
+	hash, err := act.HashID()
+	require.NoError(t, err)
+
+	// fake a collision by storing an activation from another account under the hash
+	otherAct := jwt.NewActivationClaims(importer)
+	otherAct.ImportType = jwt.Stream
+	otherAct.ImportSubject = "other.*"
+	otherJWT, err := otherAct.Encode(otherKey)
+	require.NoError(t, err)
+	require.NoError(t, testEnv.Server.saveJWT(hash, otherJWT))
+
+	url := testEnv.URLForPath("/jwt/v1/activations")
+	resp, err := testEnv.HTTP.Post(url, "application/json", bytes.NewBuffer([]byte(actJWT)))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+	require.Equal(t, CodeActivationCollision, decodeError(t, resp).Code)
+	require.Equal(t, uint64(1), atomic.LoadUint64(&testEnv.Server.metrics.activationCollisions))
+
+	stored, err := testEnv.Server.jwtStore.Load(hash)
+	require.NoError(t, err)
+	require.Equal(t, otherJWT, stored)
+
+	// notifications are dropped too
+	testEnv.Server.handleActivationNotification(&nats.Msg{
+		Data:    []byte(actJWT),
+		Subject: testEnv.Server.activationNotificationSubject(exporter, hash),
+	})
+	require.Equal(t, uint64(2), atomic.LoadUint64(&testEnv.Server.metrics.activationCollisions))
+
+	// the decoded activation shows what the hash was calculated from
+	resp, err = testEnv.HTTP.Get(testEnv.URLForPath(fmt.Sprintf("/jwt/v1/activations/%s?decode=true", hash)))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	decoded := string(body)
+	require.True(t, strings.Contains(decoded, fmt.Sprintf(`"hash": "%s"`, hash)))
+	require.True(t, strings.Contains(decoded, fmt.Sprintf(`"issuer": "%s"`, other)))
+	require.True(t, strings.Contains(decoded, fmt.Sprintf(`"subject": "%s"`, importer)))
+	require.True(t, strings.Contains(decoded, `"import_subject": "other.*"`))
+	otherHash, err := otherAct.HashID()
+	require.NoError(t, err)
+	require.True(t, strings.Contains(decoded, fmt.Sprintf(`"hash_id": "%s"`, otherHash)))
+
+	// the same issuer and subject can replace the stored activation
+	require.NoError(t, testEnv.Server.saveJWT(hash, actJWT))
+	resp, err = testEnv.HTTP.Post(url, "application/json", bytes.NewBuffer([]byte(actJWT)))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, uint64(2), atomic.LoadUint64(&testEnv.Server.metrics.activationCollisions))
+}
+
+// postTestActivation saves an activation from exporter to importer for subject, returning its hash
+func postTestActivation(t *testing.T, testEnv *TestSetup, exporter nkeys.KeyPair, importer string, subject string) (string, *jwt.ActivationClaims) {
+	act := jwt.NewActivationClaims(importer)
+	act.ImportType = jwt.Service
+	act.ImportSubject = jwt.Subject(subject)
+	actJWT, err := act.Encode(exporter)
+	require.NoError(t, err)
+
+	act, err = jwt.DecodeActivationClaims(actJWT)
+	require.NoError(t, err)
+	hash, err := act.HashID()
+	require.NoError(t, err)
+
+	resp, err := testEnv.HTTP.Post(testEnv.URLForPath("/jwt/v1/activations"), "application/jwt", bytes.NewBuffer([]byte(actJWT)))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	return hash, act
+}
+
+func TestDeleteActivationJWT(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	_, exporterPub, exporterKP := CreateAccountKey(t)
+	_, importerPub, _ := CreateAccountKey(t)
+	hash, act := postTestActivation(t, testEnv, exporterKP, importerPub, "help")
+
+	deleted := make(chan *nats.Msg, 1)
+	_, err = testEnv.NC.Subscribe(testEnv.Server.activationNotificationSubject(exporterPub, hash), func(m *nats.Msg) {
+		deleted <- m
+	})
+	require.NoError(t, err)
+	testEnv.NC.Flush()
+
+	url := testEnv.URLForPath("/jwt/v1/activations/" + hash)
+	auth := deleteAuthorization(t, exporterKP, hash)
+	resp, err := testEnv.HTTP.Do(deleteRequest(t, url, auth))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	select {
+	case msg := <-deleted:
+		require.Equal(t, hash, string(msg.Data))
+		require.True(t, isActivationDelete(msg))
+		require.Equal(t, exporterPub, tombstoneFromNotification(hash, msg).DeletedBy)
+		require.Equal(t, auth, msg.Header.Get(DeleteClaimHeader))
+	case <-time.After(2 * time.Second):
+		t.Fatal("delete notification not received")
+	}
+
+	resp, err = testEnv.HTTP.Get(url)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusGone, resp.StatusCode)
+	require.Empty(t, testEnv.Server.activations.lookup(importerPub, string(act.ImportSubject), ""))
+
+	resp, err = testEnv.HTTP.Do(deleteRequest(t, url, deleteAuthorization(t, exporterKP, hash)))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusGone, resp.StatusCode)
+
+	// by the importing account and subject, with the importer as the subject of the authorization
+	hash, _ = postTestActivation(t, testEnv, exporterKP, importerPub, "other")
+	queryURL := testEnv.URLForPath(fmt.Sprintf("/jwt/v1/activations?account=%s&subject=other", importerPub))
+	resp, err = testEnv.HTTP.Do(deleteRequest(t, queryURL, deleteAuthorization(t, testEnv.OperatorKey, importerPub)))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	_, err = testEnv.Server.loadStored(hash)
+	require.Equal(t, store.ErrDeleted, err)
+
+	resp, err = testEnv.HTTP.Do(deleteRequest(t, queryURL, deleteAuthorization(t, testEnv.OperatorKey, importerPub)))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestDeleteActivationJWTAuthorization(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	_, exporterPub, exporterKP := CreateAccountKey(t)
+	_, signingPub, signingKP := CreateAccountKey(t)
+	_, importerPub, importerKP := CreateAccountKey(t)
+	_, _, otherKP := CreateAccountKey(t)
+
+	// the exporter's signing keys are read from its stored JWT
+	account := jwt.NewAccountClaims(exporterPub)
+	account.SigningKeys.Add(signingPub)
+	accountJWT, err := account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	resp, err := testEnv.HTTP.Post(testEnv.URLForPath("/jwt/v1/accounts/"+exporterPub), "application/jwt", bytes.NewBuffer([]byte(accountJWT)))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	hash, _ := postTestActivation(t, testEnv, exporterKP, importerPub, "help")
+	url := testEnv.URLForPath("/jwt/v1/activations/" + hash)
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"missing", "", http.StatusUnauthorized},
+		{"not a JWT", "notajwt", http.StatusBadRequest},
+		{"signed by the importer", deleteAuthorization(t, importerKP, hash), http.StatusForbidden},
+		{"signed by another account", deleteAuthorization(t, otherKP, hash), http.StatusForbidden},
+		{"for another activation", deleteAuthorization(t, exporterKP, exporterPub), http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		resp, err := testEnv.HTTP.Do(deleteRequest(t, url, test.token))
+		require.NoError(t, err)
+		require.Equal(t, test.status, resp.StatusCode, test.name)
+
+		_, err = testEnv.Server.loadStored(hash)
+		require.NoError(t, err, test.name)
+	}
+
+	resp, err = testEnv.HTTP.Do(deleteRequest(t, url, deleteAuthorization(t, signingKP, hash)))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = testEnv.HTTP.Do(deleteRequest(t, testEnv.URLForPath("/jwt/v1/activations/missing"), deleteAuthorization(t, exporterKP, "missing")))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
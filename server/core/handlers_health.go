@@ -0,0 +1,159 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/nats-account-server/server/store"
+)
+
+const (
+	statusOK       = "ok"
+	statusError    = "error"
+	statusDisabled = "disabled"
+
+	// readyProbeTimeout limits the store read done by /readyz, so a hung store fails the check
+	readyProbeTimeout = 2 * time.Second
+
+	// readyProbeKey is loaded from the store by /readyz, it isn't expected to exist
+	readyProbeKey = "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+)
+
+// dependencyStatus is the result of one readiness check
+type dependencyStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// healthResponse is the body for /healthz and /readyz
+type healthResponse struct {
+	Status string                      `json:"status"`
+	Uptime string                      `json:"uptime,omitempty"`
+	Checks map[string]dependencyStatus `json:"checks,omitempty"`
+}
+
+// GetHealthz answers liveness probes, it only checks that the server is running
+func (server *AccountServer) GetHealthz(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	server.Lock()
+	running := server.running
+	startTime := server.startTime
+	server.Unlock()
+
+	if !running {
+		server.writeHealth(w, http.StatusServiceUnavailable, healthResponse{Status: statusError})
+		return
+	}
+
+	server.writeHealth(w, http.StatusOK, healthResponse{
+		Status: statusOK,
+		Uptime: time.Since(startTime).Round(time.Second).String(),
+	})
+}
+
+// GetReadyz answers readiness probes, checking the store, the NATS connection and, for
+// replicas, that JWTs have been copied from the primary
+func (server *AccountServer) GetReadyz(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	server.Lock()
+	running := server.running
+	jwtStore := server.jwtStore
+	nc := server.nats
+	natsConfigured := len(server.config.NATS.Servers) > 0
+	primary := server.primary
+	synced := server.synced
+	server.Unlock()
+
+	checks := map[string]dependencyStatus{
+		"store": checkStore(jwtStore),
+	}
+
+	switch {
+	case !natsConfigured:
+		checks["nats"] = dependencyStatus{Status: statusDisabled}
+	case nc == nil || !nc.IsConnected():
+		checks["nats"] = dependencyStatus{Status: statusError, Error: "not connected"}
+	default:
+		checks["nats"] = dependencyStatus{Status: statusOK}
+	}
+
+	switch {
+	case primary == "":
+		checks["primary"] = dependencyStatus{Status: statusDisabled}
+	case synced || atomic.LoadInt32(&server.primaryFetched) == 1:
+		checks["primary"] = dependencyStatus{Status: statusOK}
+	default:
+		checks["primary"] = dependencyStatus{Status: statusError, Error: "no JWTs have been copied from the primary yet"}
+	}
+
+	status := http.StatusOK
+	resp := healthResponse{Status: statusOK, Checks: checks}
+
+	if !running {
+		resp.Status = statusError
+		status = http.StatusServiceUnavailable
+	}
+
+	for _, check := range checks {
+		if check.Status == statusError {
+			resp.Status = statusError
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	server.writeHealth(w, status, resp)
+}
+
+// checkStore loads a key that shouldn't exist, not found means the store is reachable
+func checkStore(jwtStore store.JWTStore) dependencyStatus {
+	if jwtStore == nil {
+		return dependencyStatus{Status: statusError, Error: "no store"}
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := jwtStore.Load(readyProbeKey)
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		if err != nil && err != store.ErrNotFound {
+			return dependencyStatus{Status: statusError, Error: err.Error()}
+		}
+		return dependencyStatus{Status: statusOK}
+	case <-time.After(readyProbeTimeout):
+		return dependencyStatus{Status: statusError, Error: fmt.Sprintf("store did not answer in %s", readyProbeTimeout)}
+	}
+}
+
+func (server *AccountServer) writeHealth(w http.ResponseWriter, status int, resp healthResponse) {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		server.sendErrorResponse(http.StatusInternalServerError, "unable to encode health", "", err, w)
+		return
+	}
+
+	w.Header().Set(ContentType, ApplicationJSON)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(data)
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/store"
+	"github.com/stretchr/testify/require"
+)
+
+func getHealth(t *testing.T, client *http.Client, url string) (int, healthResponse) {
+	resp, err := client.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, ApplicationJSON, resp.Header.Get(ContentType))
+
+	var health healthResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&health))
+	return resp.StatusCode, health
+}
+
+func TestHealthz(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	status, health := getHealth(t, testEnv.HTTP, testEnv.URLForPath("/healthz"))
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, statusOK, health.Status)
+	require.NotEmpty(t, health.Uptime)
+}
+
+func TestReadyz(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	status, health := getHealth(t, testEnv.HTTP, testEnv.URLForPath("/readyz"))
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, statusOK, health.Status)
+	require.Equal(t, statusOK, health.Checks["store"].Status)
+	require.Equal(t, statusOK, health.Checks["nats"].Status)
+	require.Equal(t, statusDisabled, health.Checks["primary"].Status)
+
+	testEnv.Server.Lock()
+	testEnv.Server.jwtStore = store.NewErrJWTStore()
+	testEnv.Server.Unlock()
+
+	status, health = getHealth(t, testEnv.HTTP, testEnv.URLForPath("/readyz"))
+	require.Equal(t, http.StatusServiceUnavailable, status)
+	require.Equal(t, statusError, health.Status)
+	require.Equal(t, statusError, health.Checks["store"].Status)
+	require.Equal(t, "always error", health.Checks["store"].Error)
+
+	// liveness doesn't check the store
+	status, _ = getHealth(t, testEnv.HTTP, testEnv.URLForPath("/healthz"))
+	require.Equal(t, http.StatusOK, status)
+}
+
+func TestReadyzWithoutNATS(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	testEnv.Server.Lock()
+	config := *testEnv.Server.config
+	config.NATS.Servers = nil
+	testEnv.Server.config = &config
+	testEnv.Server.Unlock()
+
+	status, health := getHealth(t, testEnv.HTTP, testEnv.URLForPath("/readyz"))
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, statusDisabled, health.Checks["nats"].Status)
+
+	// configured but not connected
+	unreachable := config
+	unreachable.NATS.Servers = []string{"nats://localhost:1"}
+	testEnv.Server.Lock()
+	testEnv.Server.config = &unreachable
+	testEnv.Server.Unlock()
+
+	status, health = getHealth(t, testEnv.HTTP, testEnv.URLForPath("/readyz"))
+	require.Equal(t, http.StatusServiceUnavailable, status)
+	require.Equal(t, statusError, health.Checks["nats"].Status)
+}
+
+func TestReadyzReplica(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	// a replica that can't reach its primary isn't ready
+	config := testEnv.CreateReplicaConfig("")
+	config.Primary = []string{"http://localhost:1"}
+	config.NATS.Servers = nil
+	replica := NewAccountServer()
+	replica.InitializeFromConfig(config)
+	require.NoError(t, replica.Start())
+	defer replica.Stop()
+
+	url := fmt.Sprintf("http://localhost:%d/readyz", replica.port)
+	status, health := getHealth(t, testEnv.HTTP, url)
+	require.Equal(t, http.StatusServiceUnavailable, status)
+	require.Equal(t, statusError, health.Checks["primary"].Status)
+
+	// one fetch from the primary is enough
+	atomic.StoreInt32(&replica.primaryFetched, 1)
+	status, health = getHealth(t, testEnv.HTTP, url)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, statusOK, health.Checks["primary"].Status)
+}
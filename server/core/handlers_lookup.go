@@ -0,0 +1,169 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/nats-account-server/server/logging"
+	"github.com/nats-io/nats-account-server/server/store"
+	"github.com/nats-io/nkeys"
+)
+
+const (
+	// maxLookupKeys limits the number of accounts in one POST /jwt/v1/accounts/lookup
+	maxLookupKeys = 1000
+
+	// maxLookupBody limits the request body, an account public key is 56 characters
+	maxLookupBody = maxLookupKeys * 64
+)
+
+// lookupConcurrency is the number of accounts a batch lookup loads at once, on a replica
+// these are fetches from the primary
+var lookupConcurrency = 8
+
+// accountsPost is the target of POST /jwt/v1/accounts/:pubkey, lookup is the batch lookup and
+// any other key is an upload, update is nil if the server doesn't take uploads
+func accountsPost(lookup httprouter.Handle, update httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		if params.ByName("pubkey") == "lookup" {
+			lookup(w, r, params)
+			return
+		}
+
+		if update == nil {
+			w.Header().Set("Allow", "GET")
+			writeError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed), "")
+			return
+		}
+		update(w, r, params)
+	}
+}
+
+// readLookupKeys reads the JSON list of public keys in a batch lookup, duplicates are dropped
+func readLookupKeys(w http.ResponseWriter, r *http.Request) ([]string, int, error) {
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxLookupBody))
+	if err != nil {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("request is larger than %d bytes", maxLookupBody)
+	}
+
+	var keys []string
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("request must be a JSON list of account public keys")
+	}
+
+	if len(keys) > maxLookupKeys {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("at most %d accounts can be looked up at once", maxLookupKeys)
+	}
+
+	seen := map[string]bool{}
+	unique := keys[:0]
+	for _, key := range keys {
+		if !nkeys.IsValidPublicAccountKey(key) {
+			return nil, http.StatusBadRequest, fmt.Errorf("%q is not an account public key", key)
+		}
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, key)
+		}
+	}
+	return unique, http.StatusOK, nil
+}
+
+// LookupAccounts is the target of POST /jwt/v1/accounts/lookup. The body is a JSON list of account
+// public keys and the response is a JSON object of each key's JWT, null if it wasn't found. The
+// accounts are loaded by a few workers, and written in order as they resolve.
+func (server *AccountServer) LookupAccounts(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logger := server.logger.WithContext(r.Context())
+	logger.Tracef("%s: %s", r.RemoteAddr, r.URL.String())
+	defer r.Body.Close()
+
+	keys, status, err := readLookupKeys(w, r)
+	if err != nil {
+		server.sendErrorResponse(status, err.Error(), "", nil, w)
+		return
+	}
+
+	atomic.AddUint64(&server.metrics.batchLookups, 1)
+
+	// a slot is taken for each load and handed back once its JWT is written,
+	// so only a few JWTs are held however many keys there are
+	results := make([]chan string, len(keys))
+	for i := range results {
+		results[i] = make(chan string, 1)
+	}
+	slots := make(chan struct{}, lookupConcurrency)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for i, key := range keys {
+			select {
+			case slots <- struct{}{}:
+			case <-done:
+				return
+			}
+			go func(key string, result chan string) {
+				theJWT, _, err := server.loadAccount(key)
+				if err != nil && err != store.ErrNotFound && err != store.ErrDeleted {
+					logger.WithFields(logging.Fields{"account": key, "error": err}).Debugf("batch lookup unable to load %s, %s", ShortKey(key), err.Error())
+				}
+				if err == nil && server.refuseLegacy(key, theJWT) {
+					theJWT = ""
+				}
+				result <- theJWT
+			}(key, results[i])
+		}
+	}()
+
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set(ContentType, ApplicationJSON)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("{"))
+
+	for i, key := range keys {
+		theJWT := <-results[i]
+		<-slots
+
+		value := []byte("null")
+		if theJWT != "" {
+			value, _ = json.Marshal(theJWT)
+		}
+		name, _ := json.Marshal(key)
+
+		if i > 0 {
+			w.Write([]byte(","))
+		}
+		w.Write(name)
+		w.Write([]byte(":"))
+		if _, err := w.Write(value); err != nil {
+			logger.Debugf("batch lookup stopped, %s", err.Error())
+			return
+		}
+
+		if flusher != nil && (i+1)%packFlushInterval == 0 {
+			flusher.Flush()
+		}
+	}
+	w.Write([]byte("}"))
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func postLookup(t *testing.T, client *http.Client, url string, keys interface{}) (*http.Response, map[string]*string) {
+	data, err := json.Marshal(keys)
+	require.NoError(t, err)
+	resp, err := client.Post(url, "application/json", bytes.NewBuffer(data))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var found map[string]*string
+	if resp.StatusCode == http.StatusOK {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&found))
+	}
+	return resp, found
+}
+
+func TestBatchLookup(t *testing.T) {
+	defer func(old int) { lookupConcurrency = old }(lookupConcurrency)
+	lookupConcurrency = 2
+
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	var keys []string
+	jwts := map[string]string{}
+	for i := 0; i < 5; i++ {
+		_, pubKey, _ := CreateAccountKey(t)
+		acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+		require.NoError(t, err)
+		require.NoError(t, testEnv.Server.jwtStore.Save(pubKey, acctJWT))
+		keys = append(keys, pubKey)
+		jwts[pubKey] = acctJWT
+	}
+	_, missing, _ := CreateAccountKey(t)
+
+	url := testEnv.URLForPath("/jwt/v1/accounts/lookup")
+	resp, found := postLookup(t, testEnv.HTTP, url, append(append(keys, missing), keys[0]))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, ApplicationJSON, resp.Header.Get(ContentType))
+	require.Len(t, found, 6)
+	for _, key := range keys {
+		require.NotNil(t, found[key])
+		require.Equal(t, jwts[key], *found[key])
+	}
+	v, ok := found[missing]
+	require.True(t, ok)
+	require.Nil(t, v)
+
+	resp, _ = postLookup(t, testEnv.HTTP, url, []string{"notakey"})
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, _ = postLookup(t, testEnv.HTTP, url, map[string]string{})
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	tooMany := make([]string, maxLookupKeys+1)
+	for i := range tooMany {
+		tooMany[i] = keys[0]
+	}
+	resp, _ = postLookup(t, testEnv.HTTP, url, tooMany)
+	require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	resp, err = testEnv.HTTP.Post(url, "application/json", strings.NewReader(strings.Repeat(" ", maxLookupBody+1)))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+}
+
+func TestBatchLookupOnReplica(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	var keys []string
+	for i := 0; i < 20; i++ {
+		_, pubKey, _ := CreateAccountKey(t)
+		acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+		require.NoError(t, err)
+		require.NoError(t, testEnv.Server.jwtStore.Save(pubKey, acctJWT))
+		keys = append(keys, pubKey)
+	}
+
+	replica, err := testEnv.CreateReplica("")
+	require.NoError(t, err)
+	defer replica.Stop()
+
+	url := fmt.Sprintf("%s://%s/jwt/v1/accounts/lookup", replica.protocol, replica.hostPort)
+	resp, found := postLookup(t, testEnv.HTTP, url, keys)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Len(t, found, len(keys))
+	for _, key := range keys {
+		require.NotNil(t, found[key])
+		stored, err := replica.jwtStore.Load(key)
+		require.NoError(t, err)
+		require.Equal(t, stored, *found[key])
+	}
+
+	// replicas don't take uploads, the lookup shares the route
+	resp, err = testEnv.HTTP.Post(fmt.Sprintf("%s://%s/jwt/v1/accounts/%s", replica.protocol, replica.hostPort, keys[0]), "application/json", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
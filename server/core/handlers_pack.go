@@ -0,0 +1,441 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/store"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+// packSeparator splits the key from the JWT on each line of a pack
+const packSeparator = "|"
+
+// packTombstonePrefix marks a line holding a tombstone as JSON in place of the JWT, JWTs never contain a ':'
+const packTombstonePrefix = "tombstone:"
+
+// packFlushInterval is the number of lines written between flushes to the client
+const packFlushInterval = 100
+
+// pack trailers, sent after the last line so the client can check it got everything
+const (
+	packCountTrailer    = "X-Pack-Count"
+	packChecksumTrailer = "X-Pack-Sha256"
+)
+
+// pack type filters
+const (
+	packAccounts    = "accounts"
+	packActivations = "activations"
+)
+
+// GetPack streams every JWT in the store, one "key|jwt" line per JWT, in key order.
+// Deleted keys are sent as "key|tombstone:{json}" so they are deleted on the other side.
+// The after query parameter skips keys up to and including the one provided, so
+// an interrupted download can be resumed. The type query parameter limits the pack
+// to accounts or activations. The number of lines and the SHA-256 of the body are
+// sent as trailers.
+func (server *AccountServer) GetPack(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logger := server.logger.WithContext(r.Context())
+	after := r.URL.Query().Get("after")
+	packType := r.URL.Query().Get("type")
+
+	if packType != "" && packType != packAccounts && packType != packActivations {
+		server.sendErrorResponse(http.StatusBadRequest, fmt.Sprintf("bad pack type %q, use %s or %s", packType, packAccounts, packActivations), "", nil, w)
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	out := bufio.NewWriter(server.deadlineWriter(w))
+	checksum := sha256.New()
+	body := io.MultiWriter(out, checksum)
+	count := 0
+
+	w.Header().Set(ContentType, TextPlain)
+	w.Header().Set("Trailer", packCountTrailer+", "+packChecksumTrailer)
+	w.WriteHeader(http.StatusOK)
+
+	err := server.jwtStore.Iterate(func(publicKey string, theJWT string) error {
+		if after != "" && publicKey <= after {
+			return nil
+		}
+
+		// accounts are stored by public key, activations by hash, users are only in full packs
+		if packType != "" && (nkeys.IsValidPublicUserKey(publicKey) || nkeys.IsValidPublicAccountKey(publicKey) != (packType == packAccounts)) {
+			return nil
+		}
+
+		if store.IsTombstone(theJWT) {
+			line, ok := packTombstone(theJWT)
+			if !ok {
+				logger.Warnf("skipping bad tombstone for %s in pack", ShortKey(publicKey))
+				return nil
+			}
+			theJWT = line
+		}
+
+		if _, err := fmt.Fprintf(body, "%s%s%s\n", publicKey, packSeparator, theJWT); err != nil {
+			return err
+		}
+
+		count++
+		if count%packFlushInterval == 0 {
+			if err := out.Flush(); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return nil
+	})
+
+	if err == nil {
+		err = out.Flush()
+	}
+
+	if err != nil {
+		logger.Errorf("error writing pack after %d JWTs, %s", count, err.Error())
+		// abort the response so the client doesn't mistake it for a complete pack
+		panic(http.ErrAbortHandler)
+	}
+
+	w.Header().Set(packCountTrailer, strconv.Itoa(count))
+	w.Header().Set(packChecksumTrailer, hex.EncodeToString(checksum.Sum(nil)))
+
+	logger.Tracef("returned pack with %d JWTs", count)
+}
+
+// packTombstone turns a stored tombstone into the single line value sent in a pack
+func packTombstone(data string) (string, bool) {
+	tombstone, ok := store.DecodeTombstone(data)
+	if !ok {
+		return "", false
+	}
+	encoded, err := json.Marshal(tombstone)
+	if err != nil {
+		return "", false
+	}
+	return packTombstonePrefix + string(encoded), true
+}
+
+// unpackTombstone parses the value of a pack line written by packTombstone, the tombstone has to be for pubKey
+func unpackTombstone(pubKey string, value string) (store.Tombstone, bool, error) {
+	var tombstone store.Tombstone
+	if !strings.HasPrefix(value, packTombstonePrefix) {
+		return tombstone, false, nil
+	}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(value, packTombstonePrefix)), &tombstone); err != nil {
+		return tombstone, true, fmt.Errorf("bad tombstone, %s", err.Error())
+	}
+	if tombstone.PubKey != pubKey {
+		return tombstone, true, fmt.Errorf("tombstone is for %s", tombstone.PubKey)
+	}
+	return tombstone, true, nil
+}
+
+// writeDeadlineWriter moves the connection's write deadline forward before each write, so a big
+// pack isn't cut off by the write timeout while the client keeps reading, but a client that
+// stops reading is still dropped
+type writeDeadlineWriter struct {
+	w          http.ResponseWriter
+	controller *http.ResponseController
+	timeout    time.Duration
+}
+
+// deadlineWriter wraps w with the HTTP write timeout, without one w is returned as is
+func (server *AccountServer) deadlineWriter(w http.ResponseWriter) io.Writer {
+	timeout := time.Duration(server.currentConfig().HTTP.WriteTimeout) * time.Millisecond
+	if timeout <= 0 {
+		return w
+	}
+	return &writeDeadlineWriter{w: w, controller: http.NewResponseController(w), timeout: timeout}
+}
+
+func (dw *writeDeadlineWriter) Write(data []byte) (int, error) {
+	// writers that can't change the deadline keep the one for the whole response
+	dw.controller.SetWriteDeadline(time.Now().Add(dw.timeout))
+	return dw.w.Write(data)
+}
+
+// maxPackLineLength limits one line of an uploaded pack, longer lines are skipped as failures
+const maxPackLineLength = 1024 * 1024
+
+// packEntry explains what happened to one line of an uploaded pack
+type packEntry struct {
+	Line   int    `json:"line"`
+	Key    string `json:"key,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// packImportSummary is the response to a pack upload
+type packImportSummary struct {
+	Saved   int         `json:"saved"`
+	Skipped []packEntry `json:"skipped"`
+	Failed  []packEntry `json:"failed"`
+}
+
+// readPackLine returns the next line without the newline, longer lines than max are read
+// to the end and reported as too long
+func readPackLine(reader *bufio.Reader, max int) ([]byte, bool, error) {
+	var line []byte
+	tooLong := false
+	for {
+		part, isPrefix, err := reader.ReadLine()
+		if err != nil {
+			return line, tooLong, err
+		}
+
+		if len(line)+len(part) > max {
+			tooLong = true
+			line = nil
+		} else if !tooLong {
+			line = append(line, part...)
+		}
+
+		if !isPrefix {
+			return line, tooLong, nil
+		}
+	}
+}
+
+// PostPack imports a pack, one JWT per line with or without the "key|" prefix used by GetPack.
+// Each JWT is validated like a single upload and saved, lines that fail don't stop the import.
+// JWTs that are already stored, or older than the stored copy, are skipped. Tombstones replace
+// the stored JWT unless it was issued after the delete, they aren't sent as notifications. If the notify query
+// parameter is true a notification is sent for each JWT saved. The response is a JSON summary.
+func (server *AccountServer) PostPack(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logger := server.logger.WithContext(r.Context())
+	logger.Tracef("%s: %s", r.RemoteAddr, r.URL.String())
+	defer r.Body.Close()
+
+	notify := strings.ToLower(r.URL.Query().Get("notify")) == "true"
+	trace := traceHeaders(w)
+
+	var body io.Reader = r.Body
+	switch encoding := strings.ToLower(r.Header.Get("Content-Encoding")); encoding {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			server.sendErrorResponse(http.StatusBadRequest, "bad gzip body", "", err, w)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	default:
+		server.sendErrorResponse(http.StatusUnsupportedMediaType, fmt.Sprintf("unsupported content encoding %q, use gzip", encoding), "", nil, w)
+		return
+	}
+
+	reader := bufio.NewReader(body)
+	summary := packImportSummary{
+		Skipped: []packEntry{},
+		Failed:  []packEntry{},
+	}
+
+	for lineNumber := 1; ; lineNumber++ {
+		line, tooLong, err := readPackLine(reader, maxPackLineLength)
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			summary.Failed = append(summary.Failed, packEntry{Line: lineNumber, Reason: fmt.Sprintf("unable to read pack, %s", err.Error())})
+			break
+		}
+
+		if tooLong {
+			summary.Failed = append(summary.Failed, packEntry{Line: lineNumber, Reason: "line is too long"})
+			continue
+		}
+
+		text := strings.TrimSpace(string(line))
+		if text == "" {
+			continue
+		}
+
+		entry := packEntry{Line: lineNumber}
+		saved, err := server.importPackLine(text, notify, trace, &entry)
+
+		switch {
+		case err != nil:
+			entry.Reason = err.Error()
+			summary.Failed = append(summary.Failed, entry)
+		case !saved:
+			summary.Skipped = append(summary.Skipped, entry)
+		default:
+			summary.Saved++
+		}
+	}
+
+	logger.Noticef("imported pack, %d saved, %d skipped, %d failed", summary.Saved, len(summary.Skipped), len(summary.Failed))
+
+	data, err := json.Marshal(summary)
+	if err != nil {
+		server.sendErrorResponse(http.StatusInternalServerError, "unable to encode pack summary", "", err, w)
+		return
+	}
+
+	w.Header().Set(ContentType, ApplicationJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// importPackLine validates and saves one JWT from a pack, entry gets the key and the reason
+// the JWT was skipped. Returns true if the JWT was saved.
+func (server *AccountServer) importPackLine(line string, notify bool, trace nats.Header, entry *packEntry) (bool, error) {
+	expectedKey := ""
+	theJWT := line
+	if parts := strings.SplitN(line, packSeparator, 2); len(parts) == 2 {
+		expectedKey, theJWT = parts[0], parts[1]
+	}
+	entry.Key = expectedKey
+
+	if tombstone, ok, err := unpackTombstone(expectedKey, theJWT); ok {
+		if err != nil {
+			return false, err
+		}
+		return server.importPackTombstone(tombstone, entry)
+	}
+
+	if limit := server.currentConfig().MaxJWTSize; limit > 0 && len(theJWT) > limit {
+		return false, jwtTooLargeError{limit: limit}
+	}
+
+	generic, err := jwt.DecodeGeneric(theJWT)
+	if err != nil {
+		return false, fmt.Errorf("bad JWT, %s", err.Error())
+	}
+
+	var key string
+	var issuedAt int64
+	var send func() error
+
+	switch generic.Type {
+	case jwt.AccountClaim:
+		claim, err := jwt.DecodeAccountClaims(theJWT)
+		if err != nil {
+			return false, fmt.Errorf("bad account JWT, %s", err.Error())
+		}
+		if entry.Key == "" {
+			entry.Key = claim.Subject
+		}
+		if _, err := server.validateAccountClaim(claim); err != nil {
+			return false, err
+		}
+		if err := server.checkPolicies(claim); err != nil {
+			return false, err
+		}
+		key, issuedAt = claim.Subject, claim.IssuedAt
+		send = func() error {
+			if err := server.sendAccountNotification(claim, []byte(theJWT), trace); err != nil {
+				return err
+			}
+			go server.replayActivations(claim.Subject)
+			return nil
+		}
+	case jwt.ActivationClaim:
+		claim, err := jwt.DecodeActivationClaims(theJWT)
+		if err != nil {
+			return false, fmt.Errorf("bad activation JWT, %s", err.Error())
+		}
+		if key, err = server.validateActivationClaim(claim); err != nil {
+			return false, err
+		}
+		if err := server.checkActivationCollision(key, claim); err != nil {
+			return false, err
+		}
+		issuedAt = claim.IssuedAt
+		send = func() error { return server.sendActivationNotification(key, claim.Issuer, []byte(theJWT), trace) }
+	default:
+		return false, fmt.Errorf("unsupported JWT type %q", generic.Type)
+	}
+
+	if expectedKey != "" && expectedKey != key {
+		return false, fmt.Errorf("JWT is for %s", key)
+	}
+	entry.Key = key
+
+	if stored, err := server.jwtStore.Load(key); err == nil {
+		if stored == theJWT {
+			entry.Reason = "already stored"
+			return false, nil
+		}
+		if storedClaims, err := jwt.DecodeGeneric(stored); err == nil && storedClaims.IssuedAt > issuedAt {
+			entry.Reason = "older than the stored JWT"
+			return false, nil
+		}
+	}
+
+	if err := server.saveJWT(key, theJWT); err != nil {
+		atomic.AddUint64(&server.metrics.storeErrors, 1)
+		return false, fmt.Errorf("error saving JWT, %s", err.Error())
+	}
+	server.indexJWT(key, theJWT)
+
+	if generic.Type == jwt.AccountClaim {
+		atomic.AddUint64(&server.metrics.accountUpdates, 1)
+	} else {
+		atomic.AddUint64(&server.metrics.activationSaves, 1)
+	}
+
+	if notify {
+		if err := send(); err != nil {
+			return false, fmt.Errorf("saved, but unable to send notification, %s", err.Error())
+		}
+	}
+
+	return true, nil
+}
+
+// importPackTombstone saves a tombstone from a pack, unless the key is already deleted or the
+// stored JWT is newer than the delete. Returns true if the tombstone was saved.
+func (server *AccountServer) importPackTombstone(tombstone store.Tombstone, entry *packEntry) (bool, error) {
+	if stored, err := server.jwtStore.Load(tombstone.PubKey); err == nil {
+		if store.IsTombstone(stored) {
+			entry.Reason = "already deleted"
+			return false, nil
+		}
+		if storedClaims, err := jwt.DecodeGeneric(stored); err == nil && storedClaims.IssuedAt > tombstone.DeletedAt {
+			entry.Reason = "older than the stored JWT"
+			return false, nil
+		}
+	}
+
+	if err := server.saveTombstone(tombstone); err != nil {
+		atomic.AddUint64(&server.metrics.storeErrors, 1)
+		return false, fmt.Errorf("error saving tombstone, %s", err.Error())
+	}
+	return true, nil
+}
@@ -0,0 +1,367 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/store"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func saveTestAccounts(t *testing.T, testEnv *TestSetup, count int) map[string]string {
+	jwts := map[string]string{}
+	for i := 0; i < count; i++ {
+		accountKey, err := nkeys.CreateAccount()
+		require.NoError(t, err)
+
+		pubKey, err := accountKey.PublicKey()
+		require.NoError(t, err)
+
+		account := jwt.NewAccountClaims(pubKey)
+		acctJWT, err := account.Encode(testEnv.OperatorKey)
+		require.NoError(t, err)
+
+		require.NoError(t, testEnv.Server.jwtStore.Save(pubKey, acctJWT))
+		jwts[pubKey] = acctJWT
+	}
+	return jwts
+}
+
+func TestGetPack(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	jwts := saveTestAccounts(t, testEnv, 5)
+
+	keys := []string{}
+	for k := range jwts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/pack"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+	require.Len(t, lines, 5)
+	for i, line := range lines {
+		require.Equal(t, fmt.Sprintf("%s|%s", keys[i], jwts[keys[i]]), line)
+	}
+
+	resp, err = testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/pack?after=" + keys[2]))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err = ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	lines = strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+	require.Equal(t, []string{
+		fmt.Sprintf("%s|%s", keys[3], jwts[keys[3]]),
+		fmt.Sprintf("%s|%s", keys[4], jwts[keys[4]]),
+	}, lines)
+}
+
+func TestGetPackTrailersAndFilter(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	jwts := saveTestAccounts(t, testEnv, 3)
+	require.NoError(t, testEnv.Server.jwtStore.Save("ACTIVATIONHASH", "activationjwt"))
+
+	resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/pack"))
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	// trailers are only available once the body is read
+	sum := sha256.Sum256(body)
+	require.Equal(t, "4", resp.Trailer.Get(packCountTrailer))
+	require.Equal(t, hex.EncodeToString(sum[:]), resp.Trailer.Get(packChecksumTrailer))
+
+	resp, err = testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/pack?type=accounts"))
+	require.NoError(t, err)
+	body, err = ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+	require.Len(t, lines, 3)
+	for _, line := range lines {
+		parts := strings.SplitN(line, packSeparator, 2)
+		require.Equal(t, jwts[parts[0]], parts[1])
+	}
+	require.Equal(t, "3", resp.Trailer.Get(packCountTrailer))
+
+	resp, err = testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/pack?type=activations"))
+	require.NoError(t, err)
+	body, err = ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "ACTIVATIONHASH|activationjwt\n", string(body))
+	require.Equal(t, "1", resp.Trailer.Get(packCountTrailer))
+
+	resp, err = testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/pack?type=users"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestReplicaChecksPackTrailers(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	// a primary that claims to have sent more than it did
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", packCountTrailer)
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "AKEY|ajwt\n")
+		w.Header().Set(packCountTrailer, "2")
+	}))
+	defer primary.Close()
+
+	config := testEnv.CreateReplicaConfig("")
+	config.Primary = []string{primary.URL}
+	replica := NewAccountServer()
+	replica.InitializeFromConfig(config)
+	require.NoError(t, replica.Start())
+	defer replica.Stop()
+
+	count, err := replica.syncFromPrimary()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "pack should have 2 JWTs")
+	require.Equal(t, 1, count)
+	require.False(t, replica.isSynced())
+}
+
+func postPack(t *testing.T, testEnv *TestSetup, path string, body string) packImportSummary {
+	resp, err := testEnv.HTTP.Post(testEnv.URLForPath(path), "text/plain", strings.NewReader(body))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, ApplicationJSON, resp.Header.Get(ContentType))
+
+	var summary packImportSummary
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&summary))
+	return summary
+}
+
+func TestPostPack(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	// export from one server
+	jwts := saveTestAccounts(t, testEnv, 3)
+	resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/pack"))
+	require.NoError(t, err)
+	pack, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	for k := range jwts {
+		require.NoError(t, testEnv.Server.jwtStore.Delete(k))
+	}
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	importerKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	importer, err := importerKey.PublicKey()
+	require.NoError(t, err)
+
+	act := jwt.NewActivationClaims(importer)
+	act.ImportType = jwt.Stream
+	act.ImportSubject = "times.*"
+	actJWT, err := act.Encode(accountKey)
+	require.NoError(t, err)
+	decodedAct, err := jwt.DecodeActivationClaims(actJWT)
+	require.NoError(t, err)
+	hash, err := decodedAct.HashID()
+	require.NoError(t, err)
+
+	otherOperator, err := nkeys.CreateOperator()
+	require.NoError(t, err)
+	untrusted := saveTestAccounts(t, testEnv, 1)
+	var untrustedJWT, untrustedKey string
+	for k := range untrusted {
+		untrustedKey = k
+		untrustedJWT, err = jwt.NewAccountClaims(k).Encode(otherOperator)
+		require.NoError(t, err)
+		require.NoError(t, testEnv.Server.jwtStore.Delete(k))
+	}
+
+	lines := []string{
+		strings.TrimSuffix(string(pack), "\n"),
+		actJWT, // bare JWTs are fine too
+		"",
+		"notajwt",
+		untrustedJWT,
+		fmt.Sprintf("%s|%s", untrustedKey, actJWT), // key doesn't match
+		strings.Repeat("x", maxPackLineLength+1),
+	}
+
+	subject := testEnv.Server.accountNotificationSubject("*")
+	notifications, err := testEnv.NC.SubscribeSync(subject)
+	require.NoError(t, err)
+	require.NoError(t, testEnv.NC.Flush())
+
+	summary := postPack(t, testEnv, "/jwt/v1/pack?notify=true", strings.Join(lines, "\n"))
+	require.Equal(t, 4, summary.Saved)
+	require.Empty(t, summary.Skipped)
+	require.Len(t, summary.Failed, 4)
+	require.Equal(t, 6, summary.Failed[0].Line)
+	require.Contains(t, summary.Failed[0].Reason, "bad JWT")
+	require.Contains(t, summary.Failed[1].Reason, "untrusted issuer")
+	require.Equal(t, untrustedKey, summary.Failed[1].Key)
+	require.Contains(t, summary.Failed[2].Reason, "JWT is for "+hash)
+	require.Equal(t, "line is too long", summary.Failed[3].Reason)
+
+	for k, v := range jwts {
+		got, err := testEnv.Server.jwtStore.Load(k)
+		require.NoError(t, err)
+		require.Equal(t, v, got)
+	}
+	got, err := testEnv.Server.jwtStore.Load(hash)
+	require.NoError(t, err)
+	require.Equal(t, actJWT, got)
+
+	for i := 0; i < 3; i++ {
+		msg, err := notifications.NextMsg(2 * time.Second)
+		require.NoError(t, err)
+		require.Equal(t, jwts[strings.Split(msg.Subject, ".")[2]], string(msg.Data))
+	}
+
+	// importing the same pack again saves nothing
+	summary = postPack(t, testEnv, "/jwt/v1/pack", string(pack))
+	require.Equal(t, 0, summary.Saved)
+	require.Len(t, summary.Skipped, 3)
+	require.Equal(t, "already stored", summary.Skipped[0].Reason)
+}
+
+func TestPackTombstones(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	jwts := saveTestAccounts(t, testEnv, 2)
+	keys := []string{}
+	for k := range jwts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	deleted := keys[0]
+
+	url := testEnv.URLForPath(fmt.Sprintf("/jwt/v1/accounts/%s", deleted))
+	resp, err := testEnv.HTTP.Do(deleteRequest(t, url, deleteAuthorization(t, testEnv.OperatorKey, deleted)))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	tombstone, ok := testEnv.Server.loadTombstone(deleted)
+	require.True(t, ok)
+
+	// the tombstone is one line, and isn't counted as a JWT
+	resp, err = testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/pack"))
+	require.NoError(t, err)
+	pack, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "2", resp.Trailer.Get(packCountTrailer))
+
+	lines := strings.Split(strings.TrimSuffix(string(pack), "\n"), "\n")
+	require.Len(t, lines, 2)
+	require.True(t, strings.HasPrefix(lines[0], deleted+packSeparator+packTombstonePrefix))
+	require.Equal(t, fmt.Sprintf("%s|%s", keys[1], jwts[keys[1]]), lines[1])
+
+	count, err := testEnv.Server.jwtCount()
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+
+	// importing the pack deletes the account again
+	require.NoError(t, testEnv.Server.jwtStore.Save(deleted, jwts[deleted]))
+	summary := postPack(t, testEnv, "/jwt/v1/pack", string(pack))
+	require.Equal(t, 1, summary.Saved)
+	require.Len(t, summary.Skipped, 1)
+	require.Empty(t, summary.Failed)
+	saved, ok := testEnv.Server.loadTombstone(deleted)
+	require.True(t, ok)
+	require.Equal(t, tombstone, saved)
+
+	summary = postPack(t, testEnv, "/jwt/v1/pack", lines[0])
+	require.Equal(t, 0, summary.Saved)
+	require.Equal(t, "already deleted", summary.Skipped[0].Reason)
+
+	// but not if the stored JWT was issued after the delete
+	require.NoError(t, testEnv.Server.jwtStore.Save(deleted, jwts[deleted]))
+	old, ok := packTombstone(store.Tombstone{PubKey: deleted, DeletedAt: 1}.Encode())
+	require.True(t, ok)
+	summary = postPack(t, testEnv, "/jwt/v1/pack", deleted+packSeparator+old)
+	require.Equal(t, 0, summary.Saved)
+	require.Equal(t, "older than the stored JWT", summary.Skipped[0].Reason)
+
+	summary = postPack(t, testEnv, "/jwt/v1/pack", keys[1]+packSeparator+packTombstonePrefix+"{")
+	require.Len(t, summary.Failed, 1)
+	require.Contains(t, summary.Failed[0].Reason, "bad tombstone")
+}
+
+// deadlineRecorder records the write deadlines set through http.ResponseController
+type deadlineRecorder struct {
+	*httptest.ResponseRecorder
+	deadlines []time.Time
+}
+
+func (r *deadlineRecorder) SetWriteDeadline(deadline time.Time) error {
+	r.deadlines = append(r.deadlines, deadline)
+	return nil
+}
+
+func TestPackWriteDeadline(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.HTTP.WriteTimeout = 1000
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	saveTestAccounts(t, testEnv, 3*packFlushInterval)
+
+	req := httptest.NewRequest(http.MethodGet, "/jwt/v1/pack", nil)
+	rec := &deadlineRecorder{ResponseRecorder: httptest.NewRecorder()}
+	start := time.Now()
+	testEnv.Server.GetPack(rec, req, nil)
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, strconv.Itoa(3*packFlushInterval), rec.Header().Get(packCountTrailer))
+
+	// each write moves the deadline, rather than one for the whole response
+	require.True(t, len(rec.deadlines) > 1)
+	for _, deadline := range rec.deadlines {
+		require.True(t, !deadline.Before(start.Add(time.Second)))
+	}
+}
@@ -21,12 +21,17 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/nats-io/jwt"
 	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/store"
+	nats "github.com/nats-io/nats.go"
 	"github.com/nats-io/nkeys"
 	"github.com/stretchr/testify/require"
 )
@@ -376,3 +381,982 @@ func TestGetReplicatedActivationJWT(t *testing.T) {
 
 	require.Equal(t, savedJWT, forcedReload)
 }
+
+func TestReplicaHandlesDeleteNotification(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+
+	account := jwt.NewAccountClaims(pubKey)
+	acctJWT, err := account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	path := fmt.Sprintf("/jwt/v1/accounts/%s", pubKey)
+	url := testEnv.URLForPath(path)
+
+	resp, err := testEnv.HTTP.Post(url, "application/json", bytes.NewBuffer([]byte(acctJWT)))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	replica, err := testEnv.CreateReplica("")
+	require.NoError(t, err)
+	defer replica.Stop()
+
+	replicaURL := fmt.Sprintf("%s://%s%s", replica.protocol, replica.hostPort, path)
+	resp, err = testEnv.HTTP.Get(replicaURL)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = testEnv.HTTP.Do(deleteRequest(t, url, deleteAuthorization(t, testEnv.OperatorKey, pubKey)))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Let the nats notification propagate
+	for i := 0; i < 20; i++ {
+		if _, err := replica.loadStored(pubKey); err != nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	_, err = replica.loadStored(pubKey)
+	require.Equal(t, store.ErrDeleted, err)
+
+	replica.cacheLock.Lock()
+	_, ok := replica.validUntil[pubKey]
+	replica.cacheLock.Unlock()
+	require.False(t, ok)
+
+	// the replica keeps the primary's tombstone
+	primaryTombstone, ok := testEnv.Server.loadTombstone(pubKey)
+	require.True(t, ok)
+	replicaTombstone, ok := replica.loadTombstone(pubKey)
+	require.True(t, ok)
+	require.Equal(t, primaryTombstone, replicaTombstone)
+
+	resp, err = testEnv.HTTP.Get(replicaURL)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusGone, resp.StatusCode)
+}
+
+func TestReplicaIgnoresUnauthorizedDeleteNotification(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	newAccount := func() string {
+		accountKey, err := nkeys.CreateAccount()
+		require.NoError(t, err)
+		pubKey, err := accountKey.PublicKey()
+		require.NoError(t, err)
+		acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+		require.NoError(t, err)
+		resp, err := testEnv.HTTP.Post(testEnv.URLForPath("/jwt/v1/accounts/"+pubKey), "application/json", bytes.NewBuffer([]byte(acctJWT)))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		return pubKey
+	}
+	kept := newAccount()
+	other := newAccount()
+
+	replica, err := testEnv.CreateReplica("")
+	require.NoError(t, err)
+	defer replica.Stop()
+
+	for _, pubKey := range []string{kept, other} {
+		resp, err := testEnv.HTTP.Get(fmt.Sprintf("%s://%s/jwt/v1/accounts/%s", replica.protocol, replica.hostPort, pubKey))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	rogueKey, err := nkeys.CreateOperator()
+	require.NoError(t, err)
+
+	publish := func(pubKey string, deleteClaim string) {
+		msg := nats.NewMsg(replica.deleteNotificationSubject(pubKey))
+		msg.Data = []byte(pubKey)
+		if deleteClaim != "" {
+			msg.Header.Set(DeleteClaimHeader, deleteClaim)
+		}
+		require.NoError(t, testEnv.NC.PublishMsg(msg))
+	}
+
+	publish(kept, "")
+	publish(kept, deleteAuthorization(t, rogueKey, kept))
+	publish(kept, deleteAuthorization(t, testEnv.OperatorKey, other))
+	publish(other, deleteAuthorization(t, testEnv.OperatorKey, other))
+	require.NoError(t, testEnv.NC.Flush())
+
+	// the notifications arrive in order, once the signed one is applied the others were ignored
+	for i := 0; i < 20; i++ {
+		if _, err := replica.loadStored(other); err == store.ErrDeleted {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	_, err = replica.loadStored(other)
+	require.Equal(t, store.ErrDeleted, err)
+
+	_, err = replica.loadStored(kept)
+	require.NoError(t, err)
+	_, err = testEnv.Server.loadStored(kept)
+	require.NoError(t, err)
+}
+
+func TestReplicaHandlesActivationDeleteNotification(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	_, _, exporterKP := CreateAccountKey(t)
+	_, importerPub, _ := CreateAccountKey(t)
+	hash, _ := postTestActivation(t, testEnv, exporterKP, importerPub, "help")
+	path := "/jwt/v1/activations/" + hash
+
+	replica, err := testEnv.CreateReplica("")
+	require.NoError(t, err)
+	defer replica.Stop()
+
+	replicaURL := fmt.Sprintf("%s://%s%s", replica.protocol, replica.hostPort, path)
+	resp, err := testEnv.HTTP.Get(replicaURL)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = testEnv.HTTP.Do(deleteRequest(t, testEnv.URLForPath(path), deleteAuthorization(t, exporterKP, hash)))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Let the nats notification propagate
+	for i := 0; i < 20; i++ {
+		if _, err := replica.loadStored(hash); err != nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	_, err = replica.loadStored(hash)
+	require.Equal(t, store.ErrDeleted, err)
+	require.Empty(t, replica.activations.lookup(importerPub, "help", ""))
+
+	resp, err = testEnv.HTTP.Get(replicaURL)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusGone, resp.StatusCode)
+}
+
+func TestReplicaIgnoresUnauthorizedActivationDeleteNotification(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	_, exporterPub, exporterKP := CreateAccountKey(t)
+	_, importerPub, _ := CreateAccountKey(t)
+	kept, _ := postTestActivation(t, testEnv, exporterKP, importerPub, "help")
+	other, _ := postTestActivation(t, testEnv, exporterKP, importerPub, "info")
+
+	replica, err := testEnv.CreateReplica("")
+	require.NoError(t, err)
+	defer replica.Stop()
+
+	for _, hash := range []string{kept, other} {
+		resp, err := testEnv.HTTP.Get(fmt.Sprintf("%s://%s/jwt/v1/activations/%s", replica.protocol, replica.hostPort, hash))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	_, _, rogueKP := CreateAccountKey(t)
+
+	publish := func(hash string, deleteClaim string) {
+		msg := nats.NewMsg(replica.activationNotificationSubject(exporterPub, hash))
+		msg.Data = []byte(hash)
+		if deleteClaim != "" {
+			msg.Header.Set(DeleteClaimHeader, deleteClaim)
+		}
+		require.NoError(t, testEnv.NC.PublishMsg(msg))
+	}
+
+	publish(kept, "")
+	publish(kept, deleteAuthorization(t, rogueKP, kept))
+	publish(kept, deleteAuthorization(t, exporterKP, other))
+	publish(other, deleteAuthorization(t, exporterKP, other))
+	require.NoError(t, testEnv.NC.Flush())
+
+	// the notifications arrive in order, once the signed one is applied the others were ignored
+	for i := 0; i < 20; i++ {
+		if _, err := replica.loadStored(other); err == store.ErrDeleted {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	_, err = replica.loadStored(other)
+	require.Equal(t, store.ErrDeleted, err)
+
+	_, err = replica.loadStored(kept)
+	require.NoError(t, err)
+	resp, err := testEnv.HTTP.Get(fmt.Sprintf("%s://%s/jwt/v1/activations/%s", replica.protocol, replica.hostPort, kept))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestReplicaFetchesTombstone(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	_, pubKey, _ := CreateAccountKey(t)
+	tombstone := store.Tombstone{PubKey: pubKey, DeletedAt: time.Now().Unix(), DeletedBy: "OPERATOR"}
+	require.NoError(t, testEnv.Server.saveTombstone(tombstone))
+
+	replica, err := testEnv.CreateReplica("")
+	require.NoError(t, err)
+	defer replica.Stop()
+
+	// without NATS the replica learns about the delete from the primary's 410
+	replicaURL := fmt.Sprintf("%s://%s/jwt/v1/accounts/%s", replica.protocol, replica.hostPort, pubKey)
+	resp, err := testEnv.HTTP.Get(replicaURL)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusGone, resp.StatusCode)
+
+	saved, ok := replica.loadTombstone(pubKey)
+	require.True(t, ok)
+	require.Equal(t, tombstone, saved)
+
+	// the tombstone is cached like a JWT
+	replica.cacheLock.Lock()
+	_, ok = replica.validUntil[pubKey]
+	replica.cacheLock.Unlock()
+	require.True(t, ok)
+}
+
+func TestReplicaInitialSync(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	jwts := saveTestAccounts(t, testEnv, 250)
+
+	replica, err := testEnv.CreateReplica("")
+	require.NoError(t, err)
+	defer replica.Stop()
+
+	for i := 0; i < 50 && !replica.isSynced(); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.True(t, replica.isSynced())
+
+	for k, v := range jwts {
+		got, err := replica.jwtStore.Load(k)
+		require.NoError(t, err)
+		require.Equal(t, v, got)
+	}
+
+	// a second sync resumes after the last key, so there is nothing left to save
+	count, err := replica.syncFromPrimary()
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+
+	// the synced copy is served when the primary goes away
+	testEnv.Server.Stop()
+
+	for k, v := range jwts {
+		url := fmt.Sprintf("%s://%s/jwt/v1/accounts/%s", replica.protocol, replica.hostPort, k)
+		resp, err := testEnv.HTTP.Get(url)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, v, string(body))
+	}
+}
+
+func TestReplicaSyncsDeletedAccounts(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	jwts := saveTestAccounts(t, testEnv, 3)
+	var deleted string
+	for k := range jwts {
+		deleted = k
+		break
+	}
+
+	url := testEnv.URLForPath(fmt.Sprintf("/jwt/v1/accounts/%s", deleted))
+	resp, err := testEnv.HTTP.Do(deleteRequest(t, url, deleteAuthorization(t, testEnv.OperatorKey, deleted)))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	tombstone, ok := testEnv.Server.loadTombstone(deleted)
+	require.True(t, ok)
+
+	replica, err := testEnv.CreateReplica("")
+	require.NoError(t, err)
+	defer replica.Stop()
+
+	for i := 0; i < 50 && !replica.isSynced(); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.True(t, replica.isSynced())
+
+	// the delete is copied, so the replica doesn't serve the account even without the primary
+	saved, ok := replica.loadTombstone(deleted)
+	require.True(t, ok)
+	require.Equal(t, tombstone, saved)
+	_, err = replica.loadStored(deleted)
+	require.Equal(t, store.ErrDeleted, err)
+
+	for k, v := range jwts {
+		if k == deleted {
+			continue
+		}
+		got, err := replica.jwtStore.Load(k)
+		require.NoError(t, err)
+		require.Equal(t, v, got)
+	}
+}
+
+func TestReplicaCacheTTL(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	jwts := saveTestAccounts(t, testEnv, 2)
+	keys := []string{}
+	for k := range jwts {
+		keys = append(keys, k)
+	}
+
+	for _, ttl := range []int{0, 120} {
+		config := testEnv.CreateReplicaConfig("")
+		config.ReplicaCacheTTL = ttl
+		replica := NewAccountServer()
+		replica.InitializeFromConfig(config)
+		require.NoError(t, replica.Start())
+
+		for i := 0; i < 50 && !replica.isSynced(); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		// fetched from the primary
+		before := time.Now()
+		_, err := replica.loadAccountJWT(keys[0])
+		require.NoError(t, err)
+
+		// from a notification
+		replica.handleAccountNotification(&nats.Msg{Data: []byte(jwts[keys[1]])})
+
+		replica.cacheLock.Lock()
+		for _, k := range keys {
+			staleAt, ok := replica.validUntil[k]
+			require.True(t, ok)
+			if ttl == 0 {
+				require.True(t, staleAt.IsZero())
+			} else {
+				require.False(t, staleAt.Before(before.Add(time.Duration(ttl)*time.Second)))
+				require.True(t, staleAt.Before(time.Now().Add(time.Duration(ttl+1)*time.Second)))
+			}
+		}
+		replica.cacheLock.Unlock()
+
+		if ttl == 0 {
+			// entries that never expire are served without asking the primary
+			require.NoError(t, replica.jwtStore.Save(keys[0], "local"))
+			theJWT, err := replica.loadAccountJWT(keys[0])
+			require.NoError(t, err)
+			require.Equal(t, "local", theJWT)
+		}
+
+		replica.Stop()
+	}
+}
+
+func TestReplicaIgnoresUntrustedNotification(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	replica, err := testEnv.CreateReplica("")
+	require.NoError(t, err)
+	defer replica.Stop()
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+
+	rogueKey, err := nkeys.CreateOperator()
+	require.NoError(t, err)
+
+	account := jwt.NewAccountClaims(pubKey)
+	rogueJWT, err := account.Encode(rogueKey)
+	require.NoError(t, err)
+
+	replica.handleAccountNotification(&nats.Msg{Data: []byte(rogueJWT)})
+	_, err = replica.jwtStore.Load(pubKey)
+	require.Error(t, err)
+
+	acctJWT, err := account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	replica.handleAccountNotification(&nats.Msg{Data: []byte(acctJWT)})
+	saved, err := replica.jwtStore.Load(pubKey)
+	require.NoError(t, err)
+	require.Equal(t, acctJWT, saved)
+}
+
+func TestReplicaIgnoresExpiredNotification(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	replica, err := testEnv.CreateReplica("")
+	require.NoError(t, err)
+	defer replica.Stop()
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+
+	account := jwt.NewAccountClaims(pubKey)
+	account.Expires = time.Now().Unix() - 1000
+	acctJWT, err := account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	replica.handleAccountNotification(&nats.Msg{Data: []byte(acctJWT)})
+	_, err = replica.jwtStore.Load(pubKey)
+	require.Error(t, err)
+}
+
+func TestReplicaRevalidatesWithETag(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+
+	account := jwt.NewAccountClaims(pubKey)
+	acctJWT, err := account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	decoded, err := jwt.DecodeAccountClaims(acctJWT)
+	require.NoError(t, err)
+
+	lock := sync.Mutex{}
+	downloads := 0
+	notModified := 0
+
+	// a primary that answers with a 304 when the replica's copy is current
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/jwt/v1/accounts/"+pubKey {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		if etagMatches(r.Header.Get("If-None-Match"), jwtETag(decoded.ID)) {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		downloads++
+		w.Write([]byte(acctJWT))
+	}))
+	defer primary.Close()
+
+	config := testEnv.CreateReplicaConfig("")
+	config.Primary = []string{primary.URL}
+	replica := NewAccountServer()
+	replica.InitializeFromConfig(config)
+	require.NoError(t, replica.Start())
+	defer replica.Stop()
+
+	url := fmt.Sprintf("%s://%s/jwt/v1/accounts/%s", replica.protocol, replica.hostPort, pubKey)
+
+	for i := 0; i < 2; i++ {
+		resp, err := testEnv.HTTP.Get(url)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, acctJWT, string(body))
+
+		// make the copy stale so the next request goes to the primary
+		replica.cacheLock.Lock()
+		replica.validUntil[pubKey] = time.Now().Add(-time.Hour)
+		replica.cacheLock.Unlock()
+	}
+
+	lock.Lock()
+	require.Equal(t, 1, downloads)
+	require.Equal(t, 1, notModified)
+	lock.Unlock()
+}
+
+func TestReplicaServesStaleJWTs(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+
+	account := jwt.NewAccountClaims(pubKey)
+	acctJWT, err := account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	lock := sync.Mutex{}
+	down := false
+	requests := 0
+
+	// a primary that answers with a 503 while it is down
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/jwt/v1/accounts/"+pubKey {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		requests++
+
+		if down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Write([]byte(acctJWT))
+	}))
+	defer primary.Close()
+
+	config := testEnv.CreateReplicaConfig("")
+	config.Primary = []string{primary.URL}
+	config.NATS.Servers = nil
+	config.ReplicaServeStale = true
+	replica := NewAccountServer()
+	replica.InitializeFromConfig(config)
+	require.NoError(t, replica.Start())
+	defer replica.Stop()
+
+	url := fmt.Sprintf("%s://%s/jwt/v1/accounts/%s", replica.protocol, replica.hostPort, pubKey)
+
+	get := func() *http.Response {
+		resp, err := testEnv.HTTP.Get(url)
+		require.NoError(t, err)
+		return resp
+	}
+
+	makeStale := func(d time.Duration) {
+		replica.cacheLock.Lock()
+		replica.validUntil[pubKey] = time.Now().Add(-d)
+		replica.cacheLock.Unlock()
+	}
+
+	waitForRefresh := func() {
+		for i := 0; i < 50; i++ {
+			replica.cacheLock.Lock()
+			refreshing := len(replica.refreshing)
+			replica.cacheLock.Unlock()
+			if refreshing == 0 {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatal("background refresh didn't finish")
+	}
+
+	resp := get()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Empty(t, resp.Header.Get("Warning"))
+	resp.Body.Close()
+
+	lock.Lock()
+	down = true
+	lock.Unlock()
+	makeStale(10 * time.Second)
+
+	resp = get()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, staleWarning, resp.Header.Get("Warning"))
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, acctJWT, string(body))
+	require.Equal(t, uint64(1), atomic.LoadUint64(&replica.metrics.staleServed))
+
+	// the request plus the background refresh
+	waitForRefresh()
+	lock.Lock()
+	require.Equal(t, 3, requests)
+	lock.Unlock()
+
+	// too far past stale
+	config.ReplicaMaxStale = 60
+	require.NoError(t, replica.ReloadConfig(config))
+	makeStale(time.Hour)
+
+	resp = get()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	resp.Body.Close()
+
+	// once the primary is back, the refresh clears the warning
+	lock.Lock()
+	down = false
+	lock.Unlock()
+
+	resp = get()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Empty(t, resp.Header.Get("Warning"))
+	resp.Body.Close()
+}
+
+func TestReplicaDoesNotServeStaleByDefault(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+
+	account := jwt.NewAccountClaims(pubKey)
+	acctJWT, err := account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer primary.Close()
+
+	config := testEnv.CreateReplicaConfig("")
+	config.Primary = []string{primary.URL}
+	config.NATS.Servers = nil
+	replica := NewAccountServer()
+	replica.InitializeFromConfig(config)
+	require.NoError(t, replica.Start())
+	defer replica.Stop()
+
+	require.NoError(t, replica.jwtStore.Save(pubKey, acctJWT))
+
+	url := fmt.Sprintf("%s://%s/jwt/v1/accounts/%s", replica.protocol, replica.hostPort, pubKey)
+	resp, err := testEnv.HTTP.Get(url)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.Equal(t, uint64(0), atomic.LoadUint64(&replica.metrics.staleServed))
+
+	bad := *config
+	bad.ReplicaMaxStale = -1
+	require.Error(t, replica.ReloadConfig(&bad))
+}
+
+func TestReplicaStaleTimeUsesShorterCacheTTL(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	jwts := saveTestAccounts(t, testEnv, 1)
+
+	config := testEnv.CreateReplicaConfig("")
+	config.AccountCacheTTL = 60
+	replica := NewAccountServer()
+	replica.InitializeFromConfig(config)
+	require.NoError(t, replica.Start())
+	defer replica.Stop()
+
+	for k := range jwts {
+		_, err := replica.loadAccountJWT(k)
+		require.NoError(t, err)
+
+		replica.cacheLock.Lock()
+		staleAt := replica.validUntil[k]
+		replica.cacheLock.Unlock()
+		require.True(t, staleAt.Before(time.Now().Add(61*time.Second)))
+	}
+}
+
+func TestReplicaRejectsBadJWTsFromPrimary(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	_, pubKey, _ := CreateAccountKey(t)
+	_, otherKey, _ := CreateAccountKey(t)
+	_, _, untrusted := CreateOperatorKey(t)
+
+	wrongSubject, err := jwt.NewAccountClaims(otherKey).Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	wrongIssuer, err := jwt.NewAccountClaims(pubKey).Encode(untrusted)
+	require.NoError(t, err)
+	good, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	lock := sync.Mutex{}
+	served := ""
+
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		w.Write([]byte(served))
+	}))
+	defer primary.Close()
+
+	config := testEnv.CreateReplicaConfig("")
+	config.Primary = []string{primary.URL}
+	config.NATS.Servers = nil
+	replica := NewAccountServer()
+	replica.InitializeFromConfig(config)
+	require.NoError(t, replica.Start())
+	defer replica.Stop()
+
+	url := fmt.Sprintf("%s://%s/jwt/v1/accounts/%s", replica.protocol, replica.hostPort, pubKey)
+
+	for i, bad := range []string{wrongSubject, wrongIssuer, good[:len(good)-4] + "AAAA", "notajwt"} {
+		lock.Lock()
+		served = bad
+		lock.Unlock()
+
+		resp, err := testEnv.HTTP.Get(url)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusBadGateway, resp.StatusCode)
+		require.Equal(t, uint64(i+1), atomic.LoadUint64(&replica.metrics.primaryJWTsRejected))
+
+		_, err = replica.jwtStore.Load(pubKey)
+		require.Error(t, err)
+	}
+
+	lock.Lock()
+	served = good
+	lock.Unlock()
+
+	resp, err := testEnv.HTTP.Get(url)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	saved, err := replica.jwtStore.Load(pubKey)
+	require.NoError(t, err)
+	require.Equal(t, good, saved)
+}
+
+func TestReplicaSyncSkipsBadJWTs(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	jwts := saveTestAccounts(t, testEnv, 3)
+
+	// one of the primary's JWTs is stored under the wrong key
+	_, badKey, _ := CreateAccountKey(t)
+	for _, v := range jwts {
+		require.NoError(t, testEnv.Server.jwtStore.Save(badKey, v))
+		break
+	}
+
+	replica, err := testEnv.CreateReplica("")
+	require.NoError(t, err)
+	defer replica.Stop()
+
+	for i := 0; i < 50 && !replica.isSynced(); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.True(t, replica.isSynced())
+	require.Equal(t, uint64(1), atomic.LoadUint64(&replica.metrics.primaryJWTsRejected))
+
+	for k, v := range jwts {
+		got, err := replica.jwtStore.Load(k)
+		require.NoError(t, err)
+		require.Equal(t, v, got)
+	}
+
+	_, err = replica.jwtStore.Load(badKey)
+	require.Error(t, err)
+}
+
+func TestReplicaTimesOutHungPrimary(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	_, pubKey, _ := CreateAccountKey(t)
+	acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	lock := sync.Mutex{}
+	hang := ""
+	release := make(chan struct{})
+
+	// a primary that stops answering, before the headers or part way through the body
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/jwt/v1/accounts/"+pubKey {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		lock.Lock()
+		mode := hang
+		lock.Unlock()
+
+		switch mode {
+		case "headers":
+			<-release
+		case "body":
+			w.Write([]byte(acctJWT[:10]))
+			w.(http.Flusher).Flush()
+			<-release
+		default:
+			w.Write([]byte(acctJWT))
+		}
+	}))
+	defer primary.Close()
+	defer close(release)
+
+	config := testEnv.CreateReplicaConfig("")
+	config.Primary = []string{primary.URL}
+	config.NATS.Servers = nil
+	config.ReplicaServeStale = true
+	config.ReplicationTimeout = 200
+	replica := NewAccountServer()
+	replica.InitializeFromConfig(config)
+	require.NoError(t, replica.Start())
+	defer replica.Stop()
+
+	url := fmt.Sprintf("%s://%s/jwt/v1/accounts/%s", replica.protocol, replica.hostPort, pubKey)
+
+	resp, err := testEnv.HTTP.Get(url)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp.Body.Close()
+
+	for _, mode := range []string{"headers", "body"} {
+		lock.Lock()
+		hang = mode
+		lock.Unlock()
+
+		replica.cacheLock.Lock()
+		replica.validUntil[pubKey] = time.Now().Add(-time.Second)
+		replica.cacheLock.Unlock()
+
+		start := time.Now()
+		resp, err = testEnv.HTTP.Get(url)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode, mode)
+		require.Equal(t, staleWarning, resp.Header.Get("Warning"), mode)
+		resp.Body.Close()
+		require.True(t, time.Since(start) < 2*time.Second, mode)
+	}
+}
+
+func TestReplicaReusesPrimaryConnections(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	_, pubKey, _ := CreateAccountKey(t)
+	acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	resp, err := testEnv.HTTP.Post(testEnv.URLForPath("/jwt/v1/accounts/"+pubKey), "application/jwt", bytes.NewBuffer([]byte(acctJWT)))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	replica, err := testEnv.CreateReplica("")
+	require.NoError(t, err)
+	defer replica.Stop()
+
+	reused := atomic.LoadUint64(&replica.metrics.primaryConnsReused)
+	created := atomic.LoadUint64(&replica.metrics.primaryConnsNew)
+
+	for i := 0; i < 5; i++ {
+		replica.forgetValid(pubKey)
+		_, err := replica.loadAccountJWT(pubKey)
+		require.NoError(t, err)
+	}
+
+	require.True(t, atomic.LoadUint64(&replica.metrics.primaryConnsNew)-created <= 1)
+	require.True(t, atomic.LoadUint64(&replica.metrics.primaryConnsReused)-reused >= 4)
+
+	resp, err = testEnv.HTTP.Get(fmt.Sprintf("%s://%s/metrics", replica.protocol, replica.hostPort))
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Contains(t, string(body), `nats_account_server_primary_connections_total{connection="reused"}`)
+}
+
+// BenchmarkPrimaryFetch compares fetches from a TLS primary over the replica's pooled connections
+// with fetches that open a new connection, and do a TLS handshake, every time
+func BenchmarkPrimaryFetch(b *testing.B) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	accountKey, _ := nkeys.CreateAccount()
+	pubKey, _ := accountKey.PublicKey()
+	acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	primary := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(acctJWT))
+	}))
+	defer primary.Close()
+
+	config := testEnv.CreateReplicaConfig("")
+	config.Primary = []string{primary.URL}
+	config.NATS.Servers = nil
+	config.Logging.Debug = false
+	config.Logging.Trace = false
+	replica := NewAccountServer()
+	replica.InitializeFromConfig(config)
+	if err := replica.Start(); err != nil {
+		b.Fatal(err)
+	}
+	defer replica.Stop()
+
+	fetch := func(b *testing.B, client *http.Client) {
+		for i := 0; i < b.N; i++ {
+			if _, err := replica.fetchFrom(primary.URL, client, pubKey, accountsPath, ""); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	replica.Lock()
+	pooled := replica.createHTTPTransport()
+	unpooled := replica.createHTTPTransport()
+	replica.Unlock()
+	pooled.TLSClientConfig = primary.Client().Transport.(*http.Transport).TLSClientConfig
+	unpooled.TLSClientConfig = pooled.TLSClientConfig
+	unpooled.DisableKeepAlives = true
+	defer pooled.CloseIdleConnections()
+
+	b.Run("Pooled", func(b *testing.B) {
+		fetch(b, &http.Client{Transport: pooled})
+	})
+
+	b.Run("NewConnections", func(b *testing.B) {
+		fetch(b, &http.Client{Transport: unpooled})
+	})
+}
@@ -0,0 +1,188 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/nats-account-server/server/conf"
+)
+
+// lookupCounts are the hits and misses for one kind of JWT since the server started
+type lookupCounts struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+}
+
+// natsStatus is the state of the NATS connection
+type natsStatus struct {
+	Configured bool   `json:"configured"`
+	Connected  bool   `json:"connected"`
+	Reconnects uint64 `json:"reconnects"`
+	LameDucks  uint64 `json:"lame_ducks"`
+	natsActivity
+}
+
+// primaryStatus is only sent by replicas
+type primaryStatus struct {
+	URLs         []string   `json:"urls"`
+	Unhealthy    []string   `json:"unhealthy,omitempty"`
+	LastServedBy string     `json:"last_served_by,omitempty"`
+	Synced       bool       `json:"synced"`
+	LastContact  *time.Time `json:"last_contact,omitempty"`
+}
+
+// serverStatus is the body for /jwt/v1/status
+type serverStatus struct {
+	Version           string               `json:"version"`
+	Now               time.Time            `json:"now"`
+	Uptime            string               `json:"uptime"`
+	Store             string               `json:"store"`
+	ReadOnly          bool                 `json:"read_only"`
+	Accounts          int                  `json:"accounts"`
+	AccountIssuers    map[string]int       `json:"account_issuers,omitempty"`
+	Activations       int                  `json:"activations"`
+	CacheEntries      int                  `json:"cache_entries"`
+	AccountLookups    lookupCounts         `json:"account_lookups"`
+	ActivationLookups lookupCounts         `json:"activation_lookups"`
+	TopAccounts       *accountLookupStatus `json:"top_accounts,omitempty"` // the most looked up accounts since the counts were reset
+	NATS              natsStatus           `json:"nats"`
+	Primary           *primaryStatus       `json:"primary,omitempty"`
+	Mirror            *mirrorStatus        `json:"mirror,omitempty"`
+	Operators         []operatorStatus     `json:"operators,omitempty"`      // accounts hosted for each operator in the operators list
+	Renotify          *renotifyStatus      `json:"renotify,omitempty"`       // the latest POST /jwt/v1/notify job
+	Dirty             []dirtyJWT           `json:"dirty,omitempty"`          // JWTs from notifications that couldn't be saved
+	PolicyFlagged     []flaggedAccount     `json:"policy_flagged,omitempty"` // accounts from notifications saved though they failed a policy
+	LegacyJWTs        []legacyJWT          `json:"legacy_jwts,omitempty"`    // JWTs in a format newer nats-servers reject, found by a scan or lookup
+	ErrorCodes        map[string]string    `json:"error_codes"`              // the codes sent in error responses
+}
+
+// storeType names the kind of store createStore makes for the config
+func storeType(config conf.StoreConfig) string {
+	switch {
+	case config.Dir != "":
+		return "directory"
+	case config.NSC != "":
+		return "nsc"
+	case config.S3.Bucket != "":
+		return "s3"
+	case config.Postgres.DSN != "":
+		return "postgres"
+	case config.Redis.Address != "":
+		return "redis"
+	case len(config.Etcd.Endpoints) > 0:
+		return "etcd"
+	default:
+		return "memory"
+	}
+}
+
+// primaryContacted records a successful response from the primary
+func (server *AccountServer) primaryContacted() {
+	atomic.StoreInt64(&server.primaryContact, time.Now().UnixNano())
+}
+
+// GetStatus returns the server's state as JSON. Everything in it is kept up to date as the
+// server runs, the store isn't read, so it is cheap enough to poll.
+func (server *AccountServer) GetStatus(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	server.Lock()
+	config := server.config
+	startTime := server.startTime
+	jwtStore := server.jwtStore
+	nc := server.nats
+	primaries := server.primaries
+	synced := server.synced
+	renotify := server.renotify
+	server.Unlock()
+
+	server.cacheLock.Lock()
+	cacheEntries := len(server.validUntil)
+	server.cacheLock.Unlock()
+
+	m := server.metrics
+	status := serverStatus{
+		Version:        version,
+		Now:            time.Now().UTC(),
+		Uptime:         time.Since(startTime).Round(time.Second).String(),
+		Store:          storeType(config.Store),
+		ReadOnly:       jwtStore != nil && jwtStore.IsReadOnly(),
+		Accounts:       server.accounts.size(),
+		AccountIssuers: server.accounts.issuerCounts(),
+		Activations:    server.activations.size(),
+		CacheEntries:   cacheEntries,
+		AccountLookups: lookupCounts{
+			Hits:   atomic.LoadUint64(&m.accountHits),
+			Misses: atomic.LoadUint64(&m.accountMisses),
+		},
+		ActivationLookups: lookupCounts{
+			Hits:   atomic.LoadUint64(&m.activationHits),
+			Misses: atomic.LoadUint64(&m.activationMisses),
+		},
+		NATS: natsStatus{
+			Configured: len(config.NATS.Servers) > 0,
+			Connected:  nc != nil && nc.IsConnected(),
+			Reconnects: atomic.LoadUint64(&m.natsReconnects),
+			LameDucks:  atomic.LoadUint64(&m.natsLameDucks),
+
+			natsActivity: server.natsState.snapshot(),
+		},
+		Dirty:         server.dirty.list(),
+		PolicyFlagged: server.policyFlags.list(),
+		LegacyJWTs:    server.legacy.list(),
+		ErrorCodes:    errorCodes,
+		Mirror:        server.mirrorState(config),
+		Operators:     server.operatorCounts(),
+	}
+
+	if top := config.LookupCounts.Top; top > 0 {
+		accounts := server.lookups.top(top, time.Now())
+		status.TopAccounts = &accounts
+	}
+
+	if renotify != nil {
+		job := renotify.snapshot()
+		status.Renotify = &job
+	}
+
+	if primaries != nil {
+		status.Primary = &primaryStatus{
+			URLs:         primaries.urls(),
+			Unhealthy:    primaries.unhealthy(),
+			LastServedBy: primaries.last(),
+			Synced:       synced,
+		}
+		if contact := atomic.LoadInt64(&server.primaryContact); contact != 0 {
+			lastContact := time.Unix(0, contact).UTC()
+			status.Primary.LastContact = &lastContact
+		}
+	}
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		server.sendErrorResponse(http.StatusInternalServerError, "unable to encode status", "", err, w)
+		return
+	}
+
+	w.Header().Set(ContentType, ApplicationJSON)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func getStatus(t *testing.T, client *http.Client, url string) serverStatus {
+	resp, err := client.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, ApplicationJSON, resp.Header.Get(ContentType))
+
+	var status serverStatus
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	return status
+}
+
+func TestStatus(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	jwts := saveTestAccounts(t, testEnv, 2)
+	testEnv.Server.buildIndexes(testEnv.Server.jwtStore)
+
+	for pubKey := range jwts {
+		resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/accounts/" + pubKey))
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	status := getStatus(t, testEnv.HTTP, testEnv.URLForPath("/jwt/v1/status"))
+	require.Equal(t, version, status.Version)
+	require.Equal(t, "memory", status.Store)
+	require.False(t, status.ReadOnly)
+	require.Equal(t, 2, status.Accounts)
+	require.Equal(t, 0, status.Activations)
+	require.True(t, status.AccountLookups.Hits >= 2)
+	require.True(t, status.NATS.Configured)
+	require.True(t, status.NATS.Connected)
+	require.Nil(t, status.Primary)
+	require.NotEmpty(t, status.Uptime)
+}
+
+func TestStatusReplica(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	jwts := saveTestAccounts(t, testEnv, 1)
+
+	config := testEnv.CreateReplicaConfig("")
+	config.NATS.Servers = nil
+	replica := NewAccountServer()
+	replica.InitializeFromConfig(config)
+	require.NoError(t, replica.Start())
+	defer replica.Stop()
+
+	for pubKey := range jwts {
+		_, err := replica.loadAccountJWT(pubKey)
+		require.NoError(t, err)
+	}
+
+	status := getStatus(t, testEnv.HTTP, fmt.Sprintf("http://localhost:%d/jwt/v1/status", replica.port))
+	require.NotNil(t, status.Primary)
+	require.Equal(t, config.Primary, status.Primary.URLs)
+	require.Equal(t, config.Primary[0], status.Primary.LastServedBy)
+	require.Empty(t, status.Primary.Unhealthy)
+	require.NotNil(t, status.Primary.LastContact)
+	require.Equal(t, 1, status.CacheEntries)
+	require.Equal(t, 1, status.Accounts)
+	require.False(t, status.NATS.Configured)
+	require.False(t, status.NATS.Connected)
+}
+
+func TestStoreType(t *testing.T) {
+	require.Equal(t, "memory", storeType(conf.StoreConfig{}))
+	require.Equal(t, "directory", storeType(conf.StoreConfig{Dir: "/tmp"}))
+	require.Equal(t, "nsc", storeType(conf.StoreConfig{NSC: "/tmp"}))
+	require.Equal(t, "s3", storeType(conf.StoreConfig{S3: conf.S3Config{Bucket: "jwts"}}))
+	require.Equal(t, "postgres", storeType(conf.StoreConfig{Postgres: conf.PostgresConfig{DSN: "postgres://"}}))
+	require.Equal(t, "redis", storeType(conf.StoreConfig{Redis: conf.RedisConfig{Address: "localhost:6379"}}))
+	require.Equal(t, "etcd", storeType(conf.StoreConfig{Etcd: conf.EtcdConfig{Endpoints: []string{"http://localhost:2379"}}}))
+}
@@ -0,0 +1,221 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync/atomic"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/store"
+	"github.com/nats-io/nkeys"
+)
+
+// accountVersion is an entry in the GET /jwt/v1/accounts/:pubkey/versions response
+type accountVersion struct {
+	JTI      string `json:"jti"`
+	IssuedAt int64  `json:"iat"`
+}
+
+// startHistory turns on account history if it is configured, stores that can't keep versions
+// are logged, lock should be held
+func (server *AccountServer) startHistory(jwtStore store.JWTStore) error {
+	keep := server.config.Store.History
+	if keep < 0 {
+		return fmt.Errorf("store history cannot be negative, use 0 to keep no versions")
+	}
+
+	if _, ok := jwtStore.(store.JWTHistory); keep > 0 && !ok {
+		server.logger.Warnf("this store can't keep account history, ignoring store history")
+		keep = 0
+	}
+
+	atomic.StoreInt32(&server.historyKeep, int32(keep))
+	return nil
+}
+
+// jwtHistory returns the store's history and the number of versions to keep, nil if
+// history is off or the store can't keep versions
+func (server *AccountServer) jwtHistory() (store.JWTHistory, int) {
+	keep := int(atomic.LoadInt32(&server.historyKeep))
+	if keep <= 0 {
+		return nil, 0
+	}
+	history, ok := server.jwtStore.(store.JWTHistory)
+	if !ok {
+		return nil, 0
+	}
+	return history, keep
+}
+
+// saveVersion keeps the stored account JWT that theJWT is about to replace, it is called by
+// saveJWT. Tombstones and identical JWTs aren't kept, and a failure doesn't stop the save.
+func (server *AccountServer) saveVersion(key string, theJWT string) {
+	history, keep := server.jwtHistory()
+	if history == nil || !nkeys.IsValidPublicAccountKey(key) {
+		return
+	}
+
+	previous, err := server.loadStored(key)
+	if err != nil || previous == theJWT {
+		return
+	}
+
+	claim, err := jwt.DecodeGeneric(previous)
+	if err != nil {
+		return
+	}
+
+	if err := history.SaveVersion(key, claim.ID, previous, keep); err != nil {
+		atomic.AddUint64(&server.metrics.storeErrors, 1)
+		server.logger.Errorf("unable to keep version %s of account %s, %s", claim.ID, ShortKey(key), err.Error())
+	}
+}
+
+// findVersion returns the kept version of the account with the JWT ID, false if there isn't one
+func (server *AccountServer) findVersion(pubKey string, id string) (string, bool, error) {
+	history, _ := server.jwtHistory()
+	if history == nil {
+		return "", false, nil
+	}
+
+	versions, err := history.Versions(pubKey)
+	if err != nil {
+		return "", false, err
+	}
+
+	for _, v := range versions {
+		if v.ID == id {
+			return v.JWT, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// GetAccountVersions is the target of GET /jwt/v1/accounts/:pubkey/versions, it lists the
+// kept versions of an account, newest first
+func (server *AccountServer) GetAccountVersions(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logger := server.logger.WithContext(r.Context())
+	logger.Tracef("%s: %s", r.RemoteAddr, r.URL.String())
+
+	pubKey := params.ByName("pubkey")
+	if !nkeys.IsValidPublicAccountKey(pubKey) {
+		server.sendErrorResponse(http.StatusBadRequest, "bad account public key", pubKey, nil, w)
+		return
+	}
+
+	history, _ := server.jwtHistory()
+	if history == nil {
+		server.sendErrorResponse(http.StatusNotFound, "account history is not enabled", pubKey, nil, w)
+		return
+	}
+
+	versions, err := history.Versions(pubKey)
+	if err != nil {
+		atomic.AddUint64(&server.metrics.storeErrors, 1)
+		server.sendError(http.StatusInternalServerError, CodeStoreError, "error loading account history", pubKey, err, w)
+		return
+	}
+
+	list := make([]accountVersion, 0, len(versions))
+	for i := len(versions) - 1; i >= 0; i-- {
+		entry := accountVersion{JTI: versions[i].ID}
+		if claim, err := jwt.DecodeGeneric(versions[i].JWT); err == nil {
+			entry.IssuedAt = claim.IssuedAt
+		}
+		list = append(list, entry)
+	}
+
+	// versions are kept in the order they were replaced, a revert can put an older JWT after a newer one
+	sort.SliceStable(list, func(i, j int) bool { return list[i].IssuedAt > list[j].IssuedAt })
+
+	data, err := json.Marshal(list)
+	if err != nil {
+		server.sendErrorResponse(http.StatusInternalServerError, "unable to encode response", pubKey, err, w)
+		return
+	}
+
+	w.Header().Set(ContentType, ApplicationJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// GetAccountVersion is the target of GET /jwt/v1/accounts/:pubkey/versions/:jti, it returns
+// a kept version of an account JWT
+func (server *AccountServer) GetAccountVersion(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logger := server.logger.WithContext(r.Context())
+	logger.Tracef("%s: %s", r.RemoteAddr, r.URL.String())
+
+	pubKey := params.ByName("pubkey")
+	id := params.ByName("jti")
+	if !nkeys.IsValidPublicAccountKey(pubKey) {
+		server.sendErrorResponse(http.StatusBadRequest, "bad account public key", pubKey, nil, w)
+		return
+	}
+
+	theJWT, ok, err := server.findVersion(pubKey, id)
+	if err != nil {
+		atomic.AddUint64(&server.metrics.storeErrors, 1)
+		server.sendError(http.StatusInternalServerError, CodeStoreError, "error loading account history", pubKey, err, w)
+		return
+	}
+	if !ok {
+		server.sendErrorResponse(http.StatusNotFound, fmt.Sprintf("no version %s of the account", id), pubKey, nil, w)
+		return
+	}
+
+	w.Header().Set(ContentType, ApplicationJWT)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(theJWT))
+}
+
+// RevertAccountJWT is the target of POST /jwt/v1/accounts/:pubkey/revert/:jti, it saves a
+// kept version of the account again and sends the notification, like an upload would
+func (server *AccountServer) RevertAccountJWT(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logger := server.logger.WithContext(r.Context())
+	logger.Tracef("%s: %s", r.RemoteAddr, r.URL.String())
+
+	pubKey := params.ByName("pubkey")
+	id := params.ByName("jti")
+	if !nkeys.IsValidPublicAccountKey(pubKey) {
+		server.sendErrorResponse(http.StatusBadRequest, "bad account public key", pubKey, nil, w)
+		return
+	}
+
+	theJWT, ok, err := server.findVersion(pubKey, id)
+	if err != nil {
+		atomic.AddUint64(&server.metrics.storeErrors, 1)
+		server.sendError(http.StatusInternalServerError, CodeStoreError, "error loading account history", pubKey, err, w)
+		return
+	}
+	if !ok {
+		server.sendErrorResponse(http.StatusNotFound, fmt.Sprintf("no version %s of the account", id), pubKey, nil, w)
+		return
+	}
+
+	claim, err := jwt.DecodeAccountClaims(theJWT)
+	if err != nil || claim == nil || claim.Subject != pubKey {
+		server.sendErrorResponse(http.StatusInternalServerError, "kept version is not a JWT for the account", pubKey, err, w)
+		return
+	}
+
+	server.applyAccountJWT(w, claim, []byte(theJWT), "revert")
+}
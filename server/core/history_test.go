@@ -0,0 +1,127 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccountHistory(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Store.History = 2
+	testEnv, err := SetupTestServer(config, false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	_, pubKey, _ := CreateAccountKey(t)
+	var jwts []string
+	var ids []string
+	for i := 0; i < 3; i++ {
+		account := jwt.NewAccountClaims(pubKey)
+		account.Name = fmt.Sprintf("version %d", i)
+		acctJWT, err := account.Encode(testEnv.OperatorKey)
+		require.NoError(t, err)
+		resp, err := testEnv.HTTP.Post(testEnv.URLForPath("/jwt/v1/accounts/"+pubKey), "application/json", bytes.NewBuffer([]byte(acctJWT)))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		jwts = append(jwts, acctJWT)
+		ids = append(ids, account.ID)
+	}
+
+	resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/accounts/" + pubKey + "/versions"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var versions []accountVersion
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&versions))
+	resp.Body.Close()
+	require.Len(t, versions, 2)
+	require.Equal(t, ids[1], versions[0].JTI)
+	require.Equal(t, ids[0], versions[1].JTI)
+	require.NotZero(t, versions[0].IssuedAt)
+
+	resp, err = testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/accounts/" + pubKey + "/versions/" + ids[0]))
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, ApplicationJWT, resp.Header.Get(ContentType))
+	require.Equal(t, jwts[0], string(body))
+
+	resp, err = testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/accounts/" + pubKey + "/versions/" + ids[2]))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	sub, err := testEnv.NC.SubscribeSync(testEnv.Server.accountNotificationSubject(pubKey))
+	require.NoError(t, err)
+	require.NoError(t, testEnv.NC.Flush())
+
+	resp, err = testEnv.HTTP.Post(testEnv.URLForPath("/jwt/v1/accounts/"+pubKey+"/revert/"+ids[0]), "", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	msg, err := sub.NextMsg(5 * time.Second)
+	require.NoError(t, err)
+	require.Equal(t, jwts[0], string(msg.Data))
+
+	stored, err := testEnv.Server.jwtStore.Load(pubKey)
+	require.NoError(t, err)
+	require.Equal(t, jwts[0], stored)
+
+	// the reverted JWT is kept, so the revert can be undone
+	_, ok, err := testEnv.Server.findVersion(pubKey, ids[2])
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	resp, err = testEnv.HTTP.Post(testEnv.URLForPath("/jwt/v1/accounts/"+pubKey+"/revert/AAAA"), "", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestAccountHistoryDisabled(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	_, pubKey, _ := CreateAccountKey(t)
+	for i := 0; i < 2; i++ {
+		account := jwt.NewAccountClaims(pubKey)
+		account.Name = fmt.Sprintf("version %d", i)
+		acctJWT, err := account.Encode(testEnv.OperatorKey)
+		require.NoError(t, err)
+		require.NoError(t, testEnv.Server.saveJWT(pubKey, acctJWT))
+	}
+
+	resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/accounts/" + pubKey + "/versions"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
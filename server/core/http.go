@@ -19,7 +19,6 @@ package core
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"fmt"
 	"net"
 	"net/http"
@@ -31,36 +30,85 @@ import (
 	"github.com/rs/cors"
 )
 
+// endpoint access for a listener
+const (
+	accessFull = "full"
+	accessRead = "read"
+)
+
+// extraListener is one of the HTTP listeners after the first, with its own http.Server
+type extraListener struct {
+	listener net.Listener
+	http     *http.Server
+	protocol string
+	hostPort string
+}
+
 func (server *AccountServer) startHTTP() error {
 	var err error
 
 	config := server.config.HTTP
 
+	if err := checkListeners(config); err != nil {
+		server.logger.Errorf("error creating listener: %v", err)
+		return err
+	}
+
 	err = server.createHTTPListener(config)
 	if err != nil {
 		server.logger.Errorf("error creating listener: %v", err)
 		return err
 	}
 
-	router := server.buildRouter()
+	extras := []*extraListener{}
+	for _, listenerConfig := range config.Listeners {
+		extra, err := server.createExtraListener(config, listenerConfig)
+		if err != nil {
+			server.logger.Errorf("error creating listener: %v", err)
+			for _, created := range extras {
+				created.listener.Close()
+			}
+			server.listener.Close()
+			server.listener = nil
+			return err
+		}
+		extras = append(extras, extra)
+	}
 
 	xrs := cors.New(cors.Options{
 		AllowOriginFunc: func(orig string) bool {
 			return true
 		},
-		AllowedMethods:   []string{"GET", "POST"},
+		AllowedMethods:   []string{"GET", "POST", "DELETE"},
 		AllowedHeaders:   []string{"*"},
 		ExposedHeaders:   []string{"Authorization"},
 		AllowCredentials: false,
 	})
 
-	httpServer := &http.Server{
-		Handler:      xrs.Handler(router),
-		ReadTimeout:  time.Duration(config.ReadTimeout) * time.Millisecond,
-		WriteTimeout: time.Duration(config.WriteTimeout) * time.Millisecond,
+	// canceled when requests are still running at the end of the shutdown timeout
+	requests, cancel := context.WithCancel(context.Background())
+
+	// listeners with the same access share a router
+	handlers := map[bool]http.Handler{}
+	newServer := func(access string) *http.Server {
+		full := access != accessRead
+		if handlers[full] == nil {
+			handlers[full] = server.traced(server.accessLogged(plainErrors(xrs.Handler(server.buildRouter(full)))))
+		}
+
+		return &http.Server{
+			Handler:      handlers[full],
+			ReadTimeout:  time.Duration(config.ReadTimeout) * time.Millisecond,
+			WriteTimeout: time.Duration(config.WriteTimeout) * time.Millisecond,
+			IdleTimeout:  time.Duration(config.IdleTimeout) * time.Millisecond,
+			BaseContext: func(net.Listener) context.Context {
+				return requests
+			},
+		}
 	}
 
-	server.http = httpServer
+	server.http = newServer(config.Access)
+	server.cancelRequests = cancel
 
 	go func() {
 		if err := server.http.Serve(server.listener); err != nil {
@@ -68,7 +116,7 @@ func (server *AccountServer) startHTTP() error {
 				if server.logger != nil {
 					server.logger.Errorf("error attempting to serve requests: %v", err)
 				}
-				go server.Stop()
+				go server.stop(fmt.Errorf("unable to serve requests, %v", err))
 			}
 			server.http = nil
 		}
@@ -76,24 +124,120 @@ func (server *AccountServer) startHTTP() error {
 
 	server.logger.Noticef("%s listening on port %d\n", server.protocol, server.port)
 
+	for i, extra := range extras {
+		extra.http = newServer(config.Listeners[i].Access)
+
+		go func(extra *extraListener) {
+			if err := extra.http.Serve(extra.listener); err != nil && err != http.ErrServerClosed {
+				server.logger.Errorf("error attempting to serve requests on %s: %v", extra.hostPort, err)
+				go server.stop(fmt.Errorf("unable to serve requests on %s, %v", extra.hostPort, err))
+			}
+		}(extra)
+
+		server.logger.Noticef("%s listening on %s with %s access", extra.protocol, extra.hostPort, listenerAccess(config.Listeners[i].Access))
+	}
+	server.listeners = extras
+
+	return nil
+}
+
+func listenerAccess(access string) string {
+	if access == "" {
+		return accessFull
+	}
+	return access
+}
+
+// checkListeners rejects unknown access settings and listeners that would collide, a host that
+// is empty or unspecified, like 0.0.0.0, collides with every host on the same port
+func checkListeners(config conf.HTTPConfig) error {
+	type address struct {
+		name string
+		host string
+		port int
+	}
+
+	if access := listenerAccess(config.Access); access != accessFull && access != accessRead {
+		return fmt.Errorf("unknown http access %q, use %q or %q", config.Access, accessFull, accessRead)
+	}
+
+	addresses := []address{{name: "http", host: config.Host, port: config.Port}}
+	for i, listener := range config.Listeners {
+		if access := listenerAccess(listener.Access); access != accessFull && access != accessRead {
+			return fmt.Errorf("unknown access %q for listener %d, use %q or %q", listener.Access, i+1, accessFull, accessRead)
+		}
+		addresses = append(addresses, address{name: fmt.Sprintf("listener %d", i+1), host: listener.Host, port: listener.Port})
+	}
+
+	for i, a := range addresses {
+		for _, b := range addresses[:i] {
+			if a.port == 0 || a.port != b.port {
+				continue
+			}
+			if strings.EqualFold(a.host, b.host) || unspecifiedHost(a.host) || unspecifiedHost(b.host) {
+				return fmt.Errorf("%s and %s both listen on %s", b.name, a.name, net.JoinHostPort(a.host, fmt.Sprintf("%d", a.port)))
+			}
+		}
+	}
 	return nil
 }
 
+func unspecifiedHost(host string) bool {
+	if host == "" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsUnspecified()
+}
+
+// stopHTTP stops accepting connections right away and gives the requests in flight the shutdown
+// timeout to finish, requests still running after that are canceled and their connections closed.
+// The lock should not be held, so the requests can finish.
 func (server *AccountServer) stopHTTP() {
-	if server.http != nil {
-		server.logger.Noticef("stopping http server")
-		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(5*time.Second))
-		defer cancel()
+	server.Lock()
+	httpServer := server.http
+	listener := server.listener
+	extras := server.listeners
+	server.listeners = nil
+	cancel := server.cancelRequests
+	timeout := time.Duration(server.config.HTTP.ShutdownTimeout) * time.Millisecond
+	server.Unlock()
+
+	httpServers := []*http.Server{}
+	if httpServer != nil {
+		httpServers = append(httpServers, httpServer)
+	}
+	for _, extra := range extras {
+		httpServers = append(httpServers, extra.http)
+	}
+
+	if len(httpServers) > 0 {
+		server.logger.Noticef("stopping http server, waiting up to %s for requests to finish", timeout)
+		ctx, cancelShutdown := context.WithTimeout(context.Background(), timeout)
+		defer cancelShutdown()
+
+		// the listeners share the timeout, and their requests are canceled together
+		var err error
+		for _, s := range httpServers {
+			if shutdownErr := s.Shutdown(ctx); shutdownErr != nil {
+				err = shutdownErr
+			}
+		}
 
-		if err := server.http.Shutdown(ctx); err != nil {
-			server.logger.Errorf("error closing http server: %v", err)
+		if err != nil {
+			server.logger.Warnf("requests were still running after %s, canceling them", timeout)
+			cancel()
+			for _, s := range httpServers {
+				s.Close()
+			}
 		} else {
 			server.logger.Noticef("http server stopped")
 		}
+		cancel()
 	}
 
-	if server.listener != nil {
-		if err := server.listener.Close(); err != nil {
+	if listener != nil {
+		if err := listener.Close(); err != nil {
 			server.logger.Errorf("error closing listener: %v", err)
 		}
 	}
@@ -102,44 +246,66 @@ func (server *AccountServer) stopHTTP() {
 }
 
 func (server *AccountServer) createHTTPListener(config conf.HTTPConfig) error {
+	if err := checkClientCertConfig(config); err != nil {
+		return err
+	}
+
+	listen, protocol, hostPort, err := server.listen(config.Host, config.Port, config.TLS, config.ClientCerts)
+	if err != nil {
+		return err
+	}
+
+	server.protocol = protocol
+	server.port = listen.Addr().(*net.TCPAddr).Port
+	server.hostPort = hostPort
+	server.listener = listen
+	return nil
+}
+
+// createExtraListener listens on one of the HTTP listeners, using the HTTP client certificate settings
+func (server *AccountServer) createExtraListener(config conf.HTTPConfig, listenerConfig conf.ListenerConfig) (*extraListener, error) {
+	listen, protocol, hostPort, err := server.listen(listenerConfig.Host, listenerConfig.Port, listenerConfig.TLS, config.ClientCerts)
+	if err != nil {
+		return nil, err
+	}
+	return &extraListener{listener: listen, protocol: protocol, hostPort: hostPort}, nil
+}
+
+// listen returns the listener with its protocol, and the host and port to reach it on
+func (server *AccountServer) listen(host string, port int, tlsConf conf.TLSConf, clientCerts conf.ClientCertConfig) (net.Listener, string, string, error) {
 	var listen net.Listener
+	var err error
 
-	hp := net.JoinHostPort(config.Host, fmt.Sprintf("%d", config.Port))
-	tlsConf := config.TLS
+	hp := net.JoinHostPort(host, fmt.Sprintf("%d", port))
+	protocol := "http"
 
 	if tlsConf.Cert == "" {
-		listen, err := net.Listen("tcp", hp)
+		listen, err = net.Listen("tcp", hp)
+	} else {
+		var tlsConfig *tls.Config
+		tlsConfig, err = server.makeTLSConfig(tlsConf)
 		if err != nil {
-			return err
+			return nil, "", "", err
 		}
-		server.protocol = "http"
-		server.port = listen.Addr().(*net.TCPAddr).Port
-		server.hostPort = hp
-		if strings.HasPrefix(hp, ":") {
-			server.hostPort = fmt.Sprintf("127.0.0.1:%d", server.port)
+
+		if clientCerts.CA != "" && tlsConfig != nil {
+			if err := addClientCA(tlsConfig, clientCerts.CA); err != nil {
+				return nil, "", "", err
+			}
 		}
-		server.listener = listen
-		return nil
-	}
 
-	tlsConfig, err := server.makeTLSConfig(tlsConf)
-	if err != nil {
-		return err
+		listen, err = tls.Listen("tcp", hp, tlsConfig)
+		protocol = "https"
 	}
-
-	listen, err = tls.Listen("tcp", hp, tlsConfig)
 	if err != nil {
-		return err
+		return nil, "", "", err
 	}
 
-	server.protocol = "https"
-	server.port = listen.Addr().(*net.TCPAddr).Port
-	server.hostPort = hp
+	hostPort := hp
 	if strings.HasPrefix(hp, ":") {
-		server.hostPort = fmt.Sprintf("127.0.0.1:%d", server.port)
+		hostPort = fmt.Sprintf("127.0.0.1:%d", listen.Addr().(*net.TCPAddr).Port)
 	}
-	server.listener = listen
-	return nil
+	return listen, protocol, hostPort, nil
 }
 
 func (server *AccountServer) makeTLSConfig(tlsConf conf.TLSConf) (*tls.Config, error) {
@@ -148,16 +314,13 @@ func (server *AccountServer) makeTLSConfig(tlsConf conf.TLSConf) (*tls.Config, e
 		return nil, nil
 	}
 
-	cert, err := tls.LoadX509KeyPair(tlsConf.Cert, tlsConf.Key)
+	// the certificate is loaded again when its files change, connections that are open keep the old one
+	loader, err := newCertificateLoader(tlsConf.Cert, tlsConf.Key, server.logger)
 	if err != nil {
-		return nil, fmt.Errorf("error loading X509 certificate/key pair: %v", err)
-	}
-	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
-	if err != nil {
-		return nil, fmt.Errorf("error parsing certificate: %v", err)
+		return nil, err
 	}
 	config := tls.Config{
-		Certificates:             []tls.Certificate{cert},
+		GetCertificate:           loader.getCertificate,
 		MinVersion:               tls.VersionTLS12,
 		ClientAuth:               tls.NoClientCert,
 		PreferServerCipherSuites: true,
@@ -165,28 +328,77 @@ func (server *AccountServer) makeTLSConfig(tlsConf conf.TLSConf) (*tls.Config, e
 	return &config, nil
 }
 
-// BuildRouter creates the http.Router for the NGS server
-func (server *AccountServer) buildRouter() *httprouter.Router {
+// BuildRouter creates the http.Router for the NGS server, without full access the POST, DELETE
+// and admin endpoints are left out
+func (server *AccountServer) buildRouter(full bool) *httprouter.Router {
 	r := httprouter.New()
+	r.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, CodeNotFound, "no such path", "")
+	})
+	r.MethodNotAllowed = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "method not allowed", "")
+	})
+
+	// lookups and uploads are rate limited, help, health checks, metrics and status aren't
+	read := func(handle httprouter.Handle) httprouter.Handle {
+		return server.rateLimited(readRequests, server.gzipResponses(handle))
+	}
+	write := func(handle httprouter.Handle) httprouter.Handle {
+		return server.rateLimited(writeRequests, server.authorizeWrites(handle))
+	}
 
 	r.GET("/jwt/v1/help", server.JWTHelp)
 
 	if server.operatorJWT != "" {
-		r.GET("/jwt/v1/operator", server.GetOperatorJWT)
+		r.GET("/jwt/v1/operator", read(server.GetOperatorJWT))
 	}
 
 	// replicas and readonly stores cannot accept post requests
-	// replicas use a writable store, thus the extra check
-	if !server.jwtStore.IsReadOnly() && server.primary == "" {
-		r.POST("/jwt/v1/accounts/:pubkey", server.UpdateAccountJWT)
-		r.POST("/jwt/v1/activations", server.UpdateActivationJWT)
+	// replicas and relays use a writable store, thus the extra checks
+	// the batch lookup shares its path with uploads, so the route is always there
+	var updateAccount httprouter.Handle
+	if full && !server.jwtStore.IsReadOnly() && server.primary == "" && !server.relayMode() {
+		updateAccount = write(server.UpdateAccountJWT)
+		r.DELETE("/jwt/v1/accounts/:pubkey", write(server.DeleteAccountJWT))
+		r.POST("/jwt/v1/accounts/:pubkey/revert/:jti", write(server.RevertAccountJWT))
+		r.POST("/jwt/v1/activations", write(server.UpdateActivationJWT))
+		r.DELETE("/jwt/v1/activations/:hash", write(server.DeleteActivationJWT))
+		r.DELETE("/jwt/v1/activations", write(server.DeleteActivationJWT))
+		r.POST("/jwt/v1/pack", write(server.PostPack))
+		if server.config.EnableUserJWTs {
+			r.POST("/jwt/v1/users/:pubkey", write(server.UpdateUserJWT))
+		}
 	}
+	r.POST("/jwt/v1/accounts/:pubkey", accountsPost(read(server.LookupAccounts), updateAccount))
+
+	r.GET("/jwt/v1/accounts/:pubkey", read(server.GetAccountJWT))
+	r.GET("/jwt/v1/accounts/", read(server.GetAccountJWT)) // Server test point
+	r.GET("/jwt/v1/accounts/:pubkey/versions", read(server.GetAccountVersions))
+	r.GET("/jwt/v1/accounts/:pubkey/versions/:jti", read(server.GetAccountVersion))
+	r.GET("/jwt/v1/accounts", read(server.requireReplicaSignature(server.ListAccounts)))
 
-	r.GET("/jwt/v1/accounts/:pubkey", server.GetAccountJWT)
-	r.GET("/jwt/v1/accounts/", server.GetAccountJWT) // Server test point
-	r.GET("/jwt/v1/accounts", server.GetAccountJWT)  // Server test point
+	r.GET("/jwt/v1/activations/:hash", read(server.GetActivationJWT))
+	r.GET("/jwt/v1/activations", read(server.GetActivationJWT))
 
-	r.GET("/jwt/v1/activations/:hash", server.GetActivationJWT)
+	// relays only resolve accounts and activations over NATS, users aren't sent there
+	if server.config.EnableUserJWTs && !server.relayMode() {
+		r.GET("/jwt/v1/users/:pubkey", read(server.GetUserJWT))
+	}
+
+	r.GET("/jwt/v1/pack", read(server.requireReplicaSignature(server.GetPack)))
+	r.GET("/jwt/v1/bootstrap", read(server.GetBootstrap))
+
+	r.GET("/jwt/v1/status", server.GetStatus)
+	r.GET("/metrics", server.GetMetrics)
+	r.GET("/healthz", server.GetHealthz)
+	r.GET("/readyz", server.GetReadyz)
+
+	if full {
+		r.POST("/admin/reload", server.authorizeWrites(server.ReloadHandler))
+		r.POST("/admin/retry-dirty", server.authorizeWrites(server.RetryDirtyHandler))
+		r.POST("/admin/legacy-scan", server.authorizeWrites(server.LegacyScanHandler))
+		r.POST("/jwt/v1/notify", server.authorizeWrites(server.PostNotify))
+	}
 
 	return r
 }
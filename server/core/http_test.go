@@ -17,13 +17,135 @@
 package core
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/nats-io/jwt"
 	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/store"
+	"github.com/nats-io/nkeys"
 	"github.com/stretchr/testify/require"
 )
 
+// blockingJWTStore holds loads until release is closed
+type blockingJWTStore struct {
+	store.JWTStore
+	loading chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingJWTStore) Load(publicKey string) (string, error) {
+	b.loading <- struct{}{}
+	<-b.release
+	return b.JWTStore.Load(publicKey)
+}
+
+func startBlockedLookup(t *testing.T, testEnv *TestSetup, pubKey string) (*blockingJWTStore, chan error) {
+	blocking := &blockingJWTStore{
+		loading: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	testEnv.Server.Lock()
+	blocking.JWTStore = testEnv.Server.jwtStore
+	testEnv.Server.jwtStore = blocking
+	testEnv.Server.Unlock()
+
+	result := make(chan error, 1)
+	go func() {
+		resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/accounts/" + pubKey))
+		if err == nil {
+			defer resp.Body.Close()
+			_, err = ioutil.ReadAll(resp.Body)
+			if err == nil && resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("unexpected status %d", resp.StatusCode)
+			}
+		}
+		result <- err
+	}()
+
+	select {
+	case <-blocking.loading:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lookup didn't reach the store")
+	}
+	return blocking, result
+}
+
+func TestStopWaitsForRequests(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	var pubKey string
+	for key := range saveTestAccounts(t, testEnv, 1) {
+		pubKey = key
+	}
+
+	blocking, result := startBlockedLookup(t, testEnv, pubKey)
+
+	stopped := make(chan struct{})
+	go func() {
+		testEnv.Server.Stop()
+		close(stopped)
+	}()
+
+	// new connections are refused while the lookup runs
+	refused := false
+	for i := 0; i < 500 && !refused; i++ {
+		resp, err := http.Get(testEnv.URLForPath("/healthz"))
+		if err != nil {
+			refused = true
+		} else {
+			resp.Body.Close()
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	require.True(t, refused)
+
+	select {
+	case <-stopped:
+		t.Fatal("stop didn't wait for the lookup")
+	default:
+	}
+
+	close(blocking.release)
+	require.NoError(t, <-result)
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stop didn't return after the lookup finished")
+	}
+}
+
+func TestStopCancelsRequestsAfterTimeout(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.HTTP.ShutdownTimeout = 200
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	blocking, result := startBlockedLookup(t, testEnv, "notakey")
+	defer close(blocking.release)
+
+	start := time.Now()
+	testEnv.Server.Stop()
+	require.True(t, time.Since(start) < 5*time.Second)
+
+	select {
+	case err := <-result:
+		require.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the lookup wasn't canceled")
+	}
+}
+
 func TestListenWithoutHost(t *testing.T) {
 	config := conf.DefaultServerConfig()
 	config.HTTP.Host = ""
@@ -82,3 +204,110 @@ func TestBadTLSConfigOnStart(t *testing.T) {
 	defer testEnv.Cleanup()
 	require.Error(t, err)
 }
+
+func TestMultipleListeners(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.HTTP.Access = accessRead
+	tlsPort := int(atomic.AddUint64(&port, 1))
+	config.HTTP.Listeners = []conf.ListenerConfig{{
+		Host: "localhost",
+		Port: tlsPort,
+		TLS:  conf.TLSConf{Cert: certFile, Key: keyFile},
+	}}
+
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+	require.Len(t, testEnv.Server.listeners, 1)
+	require.Equal(t, "https", testEnv.Server.listeners[0].protocol)
+
+	tlsClient, err := testHTTPClient(true)
+	require.NoError(t, err)
+	tlsURL := fmt.Sprintf("https://localhost:%d", tlsPort)
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+	acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	// the plaintext listener is read only
+	resp, err := testEnv.HTTP.Post(testEnv.URLForPath("/jwt/v1/accounts/"+pubKey), "application/json", bytes.NewBuffer([]byte(acctJWT)))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	resp, err = testEnv.HTTP.Post(testEnv.URLForPath("/admin/reload"), "application/json", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, err = tlsClient.Post(tlsURL+"/jwt/v1/accounts/"+pubKey, "application/json", bytes.NewBuffer([]byte(acctJWT)))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// both serve lookups from the same store
+	for _, get := range []func() (*http.Response, error){
+		func() (*http.Response, error) {
+			return testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/accounts/" + pubKey))
+		},
+		func() (*http.Response, error) { return tlsClient.Get(tlsURL + "/jwt/v1/accounts/" + pubKey) },
+	} {
+		resp, err := get()
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, acctJWT, string(body))
+	}
+
+	// stopping closes every listener
+	testEnv.Server.Stop()
+	_, err = tlsClient.Get(tlsURL + "/healthz")
+	require.Error(t, err)
+}
+
+func TestCheckListeners(t *testing.T) {
+	config := conf.DefaultServerConfig().HTTP
+	config.Listeners = []conf.ListenerConfig{{Host: "localhost", Port: 9091, Access: accessRead}}
+	require.NoError(t, checkListeners(config))
+
+	for _, bad := range [][]conf.ListenerConfig{
+		{{Host: "localhost", Port: 9090}},
+		{{Host: "LOCALHOST", Port: 9090}},
+		{{Host: "0.0.0.0", Port: 9090}},
+		{{Port: 9090}},
+		{{Host: "localhost", Port: 9091}, {Host: "::", Port: 9091}},
+		{{Host: "localhost", Port: 9091, Access: "write"}},
+	} {
+		config.Listeners = bad
+		require.Error(t, checkListeners(config))
+	}
+
+	// different hosts, and ports picked by the system, don't collide
+	config.Listeners = []conf.ListenerConfig{{Host: "127.0.0.2", Port: 9090}}
+	config.Host = "127.0.0.1"
+	require.NoError(t, checkListeners(config))
+	config.Port = 0
+	config.Listeners = []conf.ListenerConfig{{Port: 0}}
+	require.NoError(t, checkListeners(config))
+
+	config.Access = "none"
+	require.Error(t, checkListeners(config))
+}
+
+func TestListenerFailureClosesListeners(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.HTTP.Listeners = []conf.ListenerConfig{{Host: "abc", Port: 1}}
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.Error(t, err)
+
+	// the first listener was closed, so its port can be used again
+	listener, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", config.HTTP.Port))
+	require.NoError(t, err)
+	listener.Close()
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/logging"
+	"github.com/nats-io/nats-account-server/server/store"
+	"github.com/nats-io/nkeys"
+)
+
+// indexJWT updates the account name, or activation, index after a JWT is saved under key.
+// An account JWT that doesn't decode is removed from the names.
+func (server *AccountServer) indexJWT(key string, theJWT string) {
+	if nkeys.IsValidPublicUserKey(key) {
+		return
+	}
+
+	if nkeys.IsValidPublicAccountKey(key) {
+		claim, err := jwt.DecodeAccountClaims(theJWT)
+		if err != nil || claim.Subject != key {
+			server.unindexAccount(key)
+			return
+		}
+		server.indexAccount(claim)
+		return
+	}
+
+	if claim, err := jwt.DecodeActivationClaims(theJWT); err == nil {
+		if hash, err := claim.HashID(); err == nil && hash == key {
+			server.activations.set(hash, claim)
+		}
+	}
+}
+
+// indexAccount records a saved account in the name index and the account listing
+func (server *AccountServer) indexAccount(claim *jwt.AccountClaims) {
+	server.accountNames.set(claim.Subject, claim.Name)
+	server.accounts.set(summaryForAccount(claim))
+	server.policyFlags.clear(claim.Subject, claim.ID)
+}
+
+// unindexAccount drops a deleted account from the name index and the account listing
+func (server *AccountServer) unindexAccount(pubKey string) {
+	server.accountNames.remove(pubKey)
+	server.accounts.remove(pubKey)
+	server.policyFlags.clear(pubKey, "")
+}
+
+// buildIndexes replaces the account name, account listing and activation indexes with ones
+// for every JWT in the store, they are only kept in memory so this runs at startup
+func (server *AccountServer) buildIndexes(jwtStore store.JWTStore) {
+	names := newAccountNameIndex()
+	accounts := newAccountIndex()
+	activations := newActivationIndex()
+
+	err := jwtStore.Iterate(func(key string, theJWT string) error {
+		if nkeys.IsValidPublicAccountKey(key) {
+			if claim, err := jwt.DecodeAccountClaims(theJWT); err == nil && claim.Subject == key {
+				names.set(key, claim.Name)
+				accounts.set(summaryForAccount(claim))
+			}
+			return nil
+		}
+
+		if claim, err := jwt.DecodeActivationClaims(theJWT); err == nil {
+			if hash, err := claim.HashID(); err == nil && hash == key {
+				activations.set(hash, claim)
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		server.logger.WithFields(logging.Fields{"error": err}).Warnf("unable to index the store, %s", err.Error())
+	} else {
+		server.logger.Noticef("indexed %d accounts, %d account names and %d activations", accounts.size(), names.size(), activations.size())
+	}
+
+	server.accountNames.replace(names)
+	server.accounts.replace(accounts)
+	server.activations.replace(activations)
+}
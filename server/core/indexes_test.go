@@ -0,0 +1,82 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/store"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildIndexes(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	jwtStore := store.NewMemJWTStore()
+	accounts := map[string]string{}
+	keys := []nkeys.KeyPair{}
+	for i := 0; i < 3; i++ {
+		accountKey, err := nkeys.CreateAccount()
+		require.NoError(t, err)
+		pubKey, err := accountKey.PublicKey()
+		require.NoError(t, err)
+
+		account := jwt.NewAccountClaims(pubKey)
+		account.Name = fmt.Sprintf("account %d", i)
+		acctJWT, err := account.Encode(testEnv.OperatorKey)
+		require.NoError(t, err)
+		require.NoError(t, jwtStore.Save(pubKey, acctJWT))
+		accounts[account.Name] = pubKey
+		keys = append(keys, accountKey)
+	}
+
+	importer := accounts["account 1"]
+	act := jwt.NewActivationClaims(importer)
+	act.ImportType = jwt.Stream
+	act.ImportSubject = "times.*"
+	actJWT, err := act.Encode(keys[0])
+	require.NoError(t, err)
+	act, err = jwt.DecodeActivationClaims(actJWT)
+	require.NoError(t, err)
+	hash, err := act.HashID()
+	require.NoError(t, err)
+	require.NoError(t, jwtStore.Save(hash, actJWT))
+
+	// JWTs that don't decode, or are saved under the wrong key, aren't indexed
+	require.NoError(t, jwtStore.Save("activationhash", "eyactivation"))
+	require.NoError(t, jwtStore.Save("wronghash", actJWT))
+	badKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	badPubKey, err := badKey.PublicKey()
+	require.NoError(t, err)
+	require.NoError(t, jwtStore.Save(badPubKey, "notajwt"))
+
+	testEnv.Server.buildIndexes(jwtStore)
+	require.Equal(t, 3, testEnv.Server.accountNames.size())
+	for name, pubKey := range accounts {
+		require.Equal(t, []string{pubKey}, testEnv.Server.accountNames.lookup(name))
+	}
+
+	require.Equal(t, 1, testEnv.Server.activations.size())
+	require.Equal(t, []string{hash}, testEnv.Server.activations.lookup(importer, "times.*", ""))
+}
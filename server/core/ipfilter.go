@@ -0,0 +1,150 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/logging"
+)
+
+// parseIPBlocks parses a list of IPs and CIDR blocks, IPs become blocks with a full mask
+func parseIPBlocks(entries []string, what string) ([]*net.IPNet, error) {
+	blocks := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		_, block, err := net.ParseCIDR(entry)
+		if err != nil {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("%s %q is not an IP or CIDR block", what, entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			block = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+func blocksContain(blocks []*net.IPNet, ip net.IP) bool {
+	for _, block := range blocks {
+		if block.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeFilter holds the IP lists for the requests that change the store
+type writeFilter struct {
+	allow   []*net.IPNet
+	deny    []*net.IPNet
+	trusted []*net.IPNet
+}
+
+// newWriteFilter parses the allow, deny and trusted proxy lists, nil is returned if
+// there are no allow or deny lists
+func newWriteFilter(config conf.HTTPConfig) (*writeFilter, error) {
+	allow, err := parseIPBlocks(config.WriteAllowList, "write allow list entry")
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parseIPBlocks(config.WriteDenyList, "write deny list entry")
+	if err != nil {
+		return nil, err
+	}
+	trusted, err := parseIPBlocks(config.TrustedProxies, "trusted proxy")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+
+	return &writeFilter{allow: allow, deny: deny, trusted: trusted}, nil
+}
+
+// clientAddress is the IP a request came from. X-Forwarded-For is only used when the
+// connection is from a trusted proxy, the entries are read from the right, skipping other
+// trusted proxies, so a client can't choose its address by sending the header itself.
+func (filter *writeFilter) clientAddress(r *http.Request) net.IP {
+	ip := net.ParseIP(clientIP(r))
+	if ip == nil || !blocksContain(filter.trusted, ip) {
+		return ip
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			// can't tell where the request came from past a bad entry
+			return ip
+		}
+		ip = hop
+		if !blocksContain(filter.trusted, hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// allowed checks an IP against the lists, the deny list wins and an empty allow list
+// allows every IP that isn't denied
+func (filter *writeFilter) allowed(ip net.IP) bool {
+	if ip == nil {
+		return len(filter.allow) == 0 && len(filter.deny) == 0
+	}
+	if blocksContain(filter.deny, ip) {
+		return false
+	}
+	return len(filter.allow) == 0 || blocksContain(filter.allow, ip)
+}
+
+// requireAllowedIP wraps a handler that changes the store, requests from IPs that aren't
+// allowed by the write allow and deny lists get a 403
+func (server *AccountServer) requireAllowedIP(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		server.Lock()
+		filter := server.writeFilter
+		server.Unlock()
+
+		if filter == nil {
+			handle(w, r, params)
+			return
+		}
+
+		ip := filter.clientAddress(r)
+		if !filter.allowed(ip) {
+			atomic.AddUint64(&server.metrics.writesDenied, 1)
+			server.logger.WithFields(logging.Fields{"remote": r.RemoteAddr, "client": ip.String()}).Warnf("rejected %s %s from %s, not allowed by the write IP lists", r.Method, r.URL.Path, ip.String())
+			server.sendErrorResponse(http.StatusForbidden, "writes are not allowed from this address", "", nil, w)
+			return
+		}
+
+		handle(w, r, params)
+	}
+}
@@ -0,0 +1,145 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteFilter(t *testing.T) {
+	filter, err := newWriteFilter(conf.HTTPConfig{})
+	require.NoError(t, err)
+	require.Nil(t, filter)
+
+	_, err = newWriteFilter(conf.HTTPConfig{WriteAllowList: []string{"10.0.0.0/33"}})
+	require.Error(t, err)
+	_, err = newWriteFilter(conf.HTTPConfig{WriteDenyList: []string{"bogus"}})
+	require.Error(t, err)
+	_, err = newWriteFilter(conf.HTTPConfig{WriteAllowList: []string{"10.0.0.0/8"}, TrustedProxies: []string{"proxy"}})
+	require.Error(t, err)
+
+	filter, err = newWriteFilter(conf.HTTPConfig{
+		WriteAllowList: []string{"10.1.0.0/16", "2001:db8::/32"},
+		WriteDenyList:  []string{"10.1.2.3", "2001:db8:bad::/48"},
+	})
+	require.NoError(t, err)
+
+	require.True(t, filter.allowed(net.ParseIP("10.1.0.1")))
+	require.True(t, filter.allowed(net.ParseIP("2001:db8::1")))
+	require.False(t, filter.allowed(net.ParseIP("10.1.2.3")))
+	require.False(t, filter.allowed(net.ParseIP("2001:db8:bad::1")))
+	require.False(t, filter.allowed(net.ParseIP("10.2.0.1")))
+	require.False(t, filter.allowed(net.ParseIP("::1")))
+	require.False(t, filter.allowed(nil))
+
+	// without an allow list everything that isn't denied is allowed
+	filter, err = newWriteFilter(conf.HTTPConfig{WriteDenyList: []string{"192.168.0.0/16"}})
+	require.NoError(t, err)
+	require.True(t, filter.allowed(net.ParseIP("10.2.0.1")))
+	require.False(t, filter.allowed(net.ParseIP("192.168.1.1")))
+}
+
+func TestWriteFilterForwardedFor(t *testing.T) {
+	request := func(remote string, forwarded ...string) *http.Request {
+		r, err := http.NewRequest(http.MethodPost, "http://localhost/jwt/v1/pack", nil)
+		require.NoError(t, err)
+		r.RemoteAddr = remote
+		for _, f := range forwarded {
+			r.Header.Add("X-Forwarded-For", f)
+		}
+		return r
+	}
+
+	filter, err := newWriteFilter(conf.HTTPConfig{WriteAllowList: []string{"10.0.0.0/8"}})
+	require.NoError(t, err)
+
+	// the header is ignored without trusted proxies
+	require.Equal(t, "192.168.1.1", filter.clientAddress(request("192.168.1.1:4000", "10.0.0.1")).String())
+
+	filter, err = newWriteFilter(conf.HTTPConfig{
+		WriteAllowList: []string{"10.0.0.0/8"},
+		TrustedProxies: []string{"192.168.1.0/24", "fd00::/8"},
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, "10.0.0.1", filter.clientAddress(request("192.168.1.1:4000", "10.0.0.1")).String())
+	require.Equal(t, "10.0.0.1", filter.clientAddress(request("[fd00::1]:4000", "10.0.0.1, 192.168.1.2")).String())
+	require.Equal(t, "10.0.0.1", filter.clientAddress(request("192.168.1.1:4000", "172.16.0.1", "10.0.0.1")).String())
+	require.Equal(t, "2001:db8::1", filter.clientAddress(request("192.168.1.1:4000", "2001:db8::1")).String())
+
+	// a client can't add itself to the front of the header
+	require.Equal(t, "172.16.0.1", filter.clientAddress(request("192.168.1.1:4000", "10.0.0.1, 172.16.0.1")).String())
+
+	// untrusted connections and bad entries fall back to the closest known address
+	require.Equal(t, "172.16.0.1", filter.clientAddress(request("172.16.0.1:4000", "10.0.0.1")).String())
+	require.Equal(t, "192.168.1.1", filter.clientAddress(request("192.168.1.1:4000", "garbage")).String())
+	require.Equal(t, "192.168.1.1", filter.clientAddress(request("192.168.1.1:4000")).String())
+}
+
+func TestWriteAllowList(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.HTTP.WriteAllowList = []string{"10.0.0.0/8"}
+
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	_, pubKey, _ := CreateAccountKey(t)
+	acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	url := testEnv.URLForPath("/jwt/v1/accounts/" + pubKey)
+	post := func() int {
+		resp, err := testEnv.HTTP.Post(url, "application/json", bytes.NewBuffer([]byte(acctJWT)))
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	require.Equal(t, http.StatusForbidden, post())
+	require.Equal(t, uint64(1), atomic.LoadUint64(&testEnv.Server.metrics.writesDenied))
+
+	// reads aren't filtered
+	resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/help"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// the lists are applied on a reload
+	next := *testEnv.Server.currentConfig()
+	next.HTTP.WriteAllowList = []string{"10.0.0.0/8", "127.0.0.0/8", "::1"}
+	require.NoError(t, testEnv.Server.ReloadConfig(&next))
+	require.Equal(t, http.StatusOK, post())
+
+	next.HTTP.WriteDenyList = []string{"127.0.0.1", "::1"}
+	require.NoError(t, testEnv.Server.ReloadConfig(&next))
+	require.Equal(t, http.StatusForbidden, post())
+
+	// a bad list is rejected and the current lists are kept
+	next.HTTP.WriteDenyList = []string{"not an ip"}
+	require.Error(t, testEnv.Server.ReloadConfig(&next))
+	require.Equal(t, http.StatusForbidden, post())
+	require.Equal(t, uint64(3), atomic.LoadUint64(&testEnv.Server.metrics.writesDenied))
+}
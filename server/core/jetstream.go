@@ -0,0 +1,206 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	nats "github.com/nats-io/nats.go"
+)
+
+// notificationStream holds the JetStream context for the connection notifications are
+// published on, when the configured stream is available
+type notificationStream struct {
+	sync.Mutex
+	nc *nats.Conn
+	js nats.JetStreamContext
+}
+
+func (stream *notificationStream) set(nc *nats.Conn, js nats.JetStreamContext) {
+	stream.Lock()
+	defer stream.Unlock()
+	stream.nc = nc
+	stream.js = js
+}
+
+// context returns the JetStream context for nc, or nil if notifications on nc use core NATS
+func (stream *notificationStream) context(nc *nats.Conn) nats.JetStreamContext {
+	stream.Lock()
+	defer stream.Unlock()
+	if stream.nc != nc {
+		return nil
+	}
+	return stream.js
+}
+
+// streamSubject captures the account, activation and delete notifications under prefix
+func streamSubject(prefix string) string {
+	return prefix + ".*.CLAIMS.>"
+}
+
+// streamConfig is the configuration for a missing notification stream
+func streamConfig(config conf.JetStreamConfig, prefix string) (*nats.StreamConfig, error) {
+	cfg := &nats.StreamConfig{
+		Name:              config.Stream,
+		Subjects:          []string{streamSubject(prefix)},
+		MaxAge:            time.Duration(config.MaxAge) * time.Second,
+		MaxMsgs:           int64(config.MaxMsgs),
+		MaxBytes:          int64(config.MaxBytes),
+		MaxMsgsPerSubject: int64(config.MaxMsgsPerSubject),
+		Replicas:          config.Replicas,
+	}
+
+	switch strings.ToLower(config.Retention) {
+	case "", "limits":
+		cfg.Retention = nats.LimitsPolicy
+	case "interest":
+		cfg.Retention = nats.InterestPolicy
+	default:
+		return nil, fmt.Errorf("JetStream retention %q is not limits or interest", config.Retention)
+	}
+
+	switch strings.ToLower(config.Storage) {
+	case "", "file":
+		cfg.Storage = nats.FileStorage
+	case "memory":
+		cfg.Storage = nats.MemoryStorage
+	default:
+		return nil, fmt.Errorf("JetStream storage %q is not file or memory", config.Storage)
+	}
+
+	if config.MaxAge < 0 || config.MaxMsgs < 0 || config.MaxBytes < 0 || config.MaxMsgsPerSubject < 0 || config.Replicas < 0 {
+		return nil, fmt.Errorf("JetStream limits cannot be negative, use 0 for no limit")
+	}
+
+	if config.Consumer != "" && strings.ContainsAny(config.Consumer, ".*> ") {
+		return nil, fmt.Errorf("JetStream consumer %q can't contain '.', wildcards or spaces", config.Consumer)
+	}
+
+	return cfg, nil
+}
+
+// setupJetStream finds, or creates, the notification stream. Notifications stay on core NATS,
+// with a warning, if the nats-server doesn't have JetStream. Lock should be held.
+func (server *AccountServer) setupJetStream(nc *nats.Conn) {
+	server.jetStream.set(nil, nil)
+
+	config := server.config.NATS.JetStream
+	if config.Stream == "" {
+		return
+	}
+
+	cfg, _ := streamConfig(config, subjectPrefix(server.config)) // checked before connecting
+
+	jsOpts := []nats.JSOpt{}
+	if timeout := server.config.NATS.ConnectTimeout; timeout > 0 {
+		jsOpts = append(jsOpts, nats.MaxWait(time.Duration(timeout)*time.Millisecond))
+	}
+
+	js, err := nc.JetStream(jsOpts...)
+	if err == nil {
+		_, err = js.StreamInfo(config.Stream)
+		if err == nats.ErrStreamNotFound {
+			if _, err = js.AddStream(cfg); err == nil {
+				server.logger.Noticef("created JetStream stream %s for notifications under %s", config.Stream, cfg.Subjects[0])
+			}
+		}
+	}
+
+	if err != nil {
+		server.logger.Warnf("JetStream is not available, publishing notifications with core NATS, %s", err.Error())
+		return
+	}
+
+	server.logger.Noticef("publishing notifications to JetStream stream %s", config.Stream)
+	server.jetStream.set(nc, js)
+}
+
+// publishMsg publishes a notification to the stream when there is one, and with core NATS
+// when there isn't or the stream doesn't acknowledge it
+func (server *AccountServer) publishMsg(nc *nats.Conn, msg *nats.Msg) error {
+	if js := server.jetStream.context(nc); js != nil {
+		_, err := js.PublishMsg(msg)
+		if err == nil {
+			server.natsState.published(nil)
+			return nil
+		}
+		server.logger.Warnf("unable to publish %s to JetStream, publishing with core NATS, %s", msg.Subject, err.Error())
+	}
+
+	err := nc.PublishMsg(msg)
+	server.natsState.published(err)
+	return err
+}
+
+// consumeNotifications reads notifications from the configured durable consumer, creating it
+// to start with the oldest notification in the stream if it is missing. The consumer outlives
+// the subscription, so a replica that restarts carries on where it stopped. Lock should be held.
+func (server *AccountServer) consumeNotifications(nc *nats.Conn, prefix string) (*nats.Subscription, error) {
+	js := server.jetStream.context(nc)
+	if js == nil {
+		return nil, fmt.Errorf("JetStream is not available")
+	}
+
+	config := server.config.NATS.JetStream
+	subject := streamSubject(prefix)
+
+	_, err := js.ConsumerInfo(config.Stream, config.Consumer)
+	if err == nats.ErrConsumerNotFound {
+		_, err = js.AddConsumer(config.Stream, &nats.ConsumerConfig{
+			Durable:        config.Consumer,
+			DeliverSubject: consumerDeliverSubject(server.config.NATS, config.Consumer),
+			DeliverPolicy:  nats.DeliverAllPolicy,
+			AckPolicy:      nats.AckExplicitPolicy,
+			FilterSubject:  subject,
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// bound to an existing consumer, unsubscribing leaves it in place
+	return js.Subscribe(subject, server.natsState.counted(subject, server.handleStreamNotification),
+		nats.Bind(config.Stream, config.Consumer), nats.ManualAck())
+}
+
+// consumerDeliverSubject is the subject a durable consumer pushes notifications to, under the
+// connection's inbox prefix
+func consumerDeliverSubject(config conf.NATSConfig, consumer string) string {
+	prefix := strings.TrimSuffix(nats.InboxPrefix, ".")
+	if config.InboxPrefix != "" {
+		prefix = config.InboxPrefix
+	}
+	return fmt.Sprintf("%s.%s", prefix, consumer)
+}
+
+// handleStreamNotification passes a notification from the consumer to the handler for its
+// subject, and acknowledges it
+func (server *AccountServer) handleStreamNotification(msg *nats.Msg) {
+	switch {
+	case strings.HasSuffix(msg.Subject, ".CLAIMS.UPDATE"):
+		server.handleAccountNotification(msg)
+	case strings.HasSuffix(msg.Subject, ".CLAIMS.DELETE"):
+		server.handleAccountDeleteNotification(msg)
+	case strings.Contains(msg.Subject, ".CLAIMS.ACTIVATE."):
+		server.handleActivationNotification(msg)
+	}
+	msg.Ack()
+}
@@ -0,0 +1,200 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	gnatsd "github.com/nats-io/nats-server/v2/test"
+	nats "github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamConfig(t *testing.T) {
+	config := conf.DefaultServerConfig().NATS.JetStream
+	config.Stream = "NOTIFICATIONS"
+	config.MaxMsgs = 100
+
+	cfg, err := streamConfig(config, "$SYS.ACCOUNT")
+	require.NoError(t, err)
+	require.Equal(t, []string{"$SYS.ACCOUNT.*.CLAIMS.>"}, cfg.Subjects)
+	require.Equal(t, nats.LimitsPolicy, cfg.Retention)
+	require.Equal(t, nats.FileStorage, cfg.Storage)
+	require.Equal(t, 7*24*time.Hour, cfg.MaxAge)
+	require.Equal(t, int64(100), cfg.MaxMsgs)
+
+	config.Retention = "interest"
+	config.Storage = "memory"
+	cfg, err = streamConfig(config, "STAGING.ACCOUNT")
+	require.NoError(t, err)
+	require.Equal(t, []string{"STAGING.ACCOUNT.*.CLAIMS.>"}, cfg.Subjects)
+	require.Equal(t, nats.InterestPolicy, cfg.Retention)
+	require.Equal(t, nats.MemoryStorage, cfg.Storage)
+
+	for _, bad := range []conf.JetStreamConfig{
+		{Retention: "workqueue"},
+		{Storage: "disk"},
+		{MaxAge: -1},
+		{Consumer: "replica.east"},
+	} {
+		_, err := streamConfig(bad, "$SYS.ACCOUNT")
+		require.Error(t, err, "%+v", bad)
+	}
+
+	require.Equal(t, "_INBOX.replica-1", consumerDeliverSubject(conf.NATSConfig{}, "replica-1"))
+	require.Equal(t, "_AS.replica-1", consumerDeliverSubject(conf.NATSConfig{InboxPrefix: "_AS"}, "replica-1"))
+}
+
+func TestJetStreamNotificationReplay(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "jetstream_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	natsPort := int(atomic.AddUint64(&port, 1))
+	opts := gnatsd.DefaultTestOptions
+	opts.Port = natsPort
+	opts.JetStream = true
+	opts.StoreDir = dir
+	gnatsServer := gnatsd.RunServer(&opts)
+	defer gnatsServer.Shutdown()
+	natsURL := fmt.Sprintf("nats://localhost:%d", natsPort)
+
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	config := conf.DefaultServerConfig()
+	config.HTTP.Port = 0
+	config.NATS.Servers = []string{natsURL}
+	config.NATS.JetStream.Stream = "NOTIFICATIONS"
+	config.NATS.JetStream.Storage = "memory"
+
+	publisher := NewAccountServer()
+	publisher.InitializeFromConfig(config)
+	require.NoError(t, publisher.Start())
+	defer publisher.Stop()
+
+	nc := publisher.getNatsConnection()
+	require.NotNil(t, nc)
+	require.NotNil(t, publisher.jetStream.context(nc))
+
+	// sent before the replica is running
+	_, pubKey, _ := CreateAccountKey(t)
+	account := jwt.NewAccountClaims(pubKey)
+	acctJWT, err := account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	require.NoError(t, publisher.sendAccountNotification(account, []byte(acctJWT), nil))
+
+	js, err := nc.JetStream()
+	require.NoError(t, err)
+	info, err := js.StreamInfo("NOTIFICATIONS")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), info.State.Msgs)
+
+	replicaConfig := testEnv.CreateReplicaConfig("")
+	replicaConfig.NATS = conf.DefaultServerConfig().NATS
+	replicaConfig.NATS.Servers = []string{natsURL}
+	replicaConfig.NATS.JetStream.Stream = "NOTIFICATIONS"
+	replicaConfig.NATS.JetStream.Consumer = "replica-1"
+
+	replica := NewAccountServer()
+	replica.InitializeFromConfig(replicaConfig)
+	require.NoError(t, replica.Start())
+
+	for i := 0; i < 20; i++ {
+		if _, err := replica.jwtStore.Load(pubKey); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	saved, err := replica.jwtStore.Load(pubKey)
+	require.NoError(t, err)
+	require.Equal(t, acctJWT, saved)
+	replica.Stop()
+
+	// the durable consumer outlives the replica, with the notification acknowledged
+	var consumer *nats.ConsumerInfo
+	for i := 0; i < 20; i++ {
+		consumer, err = js.ConsumerInfo("NOTIFICATIONS", "replica-1")
+		require.NoError(t, err)
+		if consumer.AckFloor.Consumer == 1 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Equal(t, uint64(1), consumer.AckFloor.Consumer)
+	require.Equal(t, 0, consumer.NumAckPending)
+}
+
+func TestJetStreamUnavailable(t *testing.T) {
+	natsPort := int(atomic.AddUint64(&port, 1))
+	opts := gnatsd.DefaultTestOptions
+	opts.Port = natsPort
+	gnatsServer := gnatsd.RunServer(&opts)
+	defer gnatsServer.Shutdown()
+
+	config := conf.DefaultServerConfig()
+	config.HTTP.Port = 0
+	config.NATS.Servers = []string{fmt.Sprintf("nats://localhost:%d", natsPort)}
+	config.NATS.ConnectTimeout = 500
+	config.NATS.JetStream.Stream = "NOTIFICATIONS"
+
+	server := NewAccountServer()
+	server.InitializeFromConfig(config)
+	require.NoError(t, server.Start())
+	defer server.Stop()
+
+	nc := server.getNatsConnection()
+	require.NotNil(t, nc)
+
+	logger := newRecordingLogger()
+	server.Lock()
+	server.logger = logger
+	server.setupJetStream(nc)
+	server.Unlock()
+
+	require.Nil(t, server.jetStream.context(nc))
+	require.Len(t, logger.find("JetStream is not available, publishing notifications with core NATS"), 1)
+
+	// notifications still go out with core NATS
+	received := make(chan *nats.Msg, 1)
+	sub, err := nc.ChanSubscribe("$SYS.ACCOUNT.*.CLAIMS.UPDATE", received)
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	nc.Flush()
+
+	_, _, operatorKey := CreateOperatorKey(t)
+	_, pubKey, _ := CreateAccountKey(t)
+	account := jwt.NewAccountClaims(pubKey)
+	acctJWT, err := account.Encode(operatorKey)
+	require.NoError(t, err)
+	require.NoError(t, server.sendAccountNotification(account, []byte(acctJWT), nil))
+
+	select {
+	case msg := <-received:
+		require.Equal(t, acctJWT, string(msg.Data))
+	case <-time.After(2 * time.Second):
+		t.Fatal("notification not published with core NATS")
+	}
+}
@@ -28,7 +28,15 @@ Returns this page.
 
 ## GET /jwt/v1/operator
 
-If the server is configured with an operator JWT path, this URL will return the Operator JWT loaded at startup to find the trusted keys.
+If the server is configured with an operator JWT path, or uses an NSC store, this URL will return the Operator JWT.
+The file is re-read when it changes, the trusted keys are only loaded at startup.
+
+The response uses the JTI as the ETag, and the optional query parameters text and decode work as they do for accounts.
+
+## GET /jwt/v1/bootstrap
+
+Returns a nats-server configuration snippet, as text, with the operator JWT, the system account, preloaded,
+and a resolver URL pointing at this server. A status 404 is returned if there is no operator JWT.
 
 ## GET /jwt/v1/accounts/<pubkey>
 
@@ -52,15 +60,66 @@ Four optional query parameters are supported:
   * decode - can be set to "true" to display the JSON for the JWT header and body
   * noticy - can be set to "true" to trigger a notification event if NATS is configured
 
+With decode, fields can list the claims to return, such as fields=exports,limits,signing_keys, and
+pretty can be set to "true" to indent them. Either one returns the claims as application/json, fields
+from the nats section are returned next to the standard claims. An unknown field returns a 400.
+
+## GET /jwt/v1/accounts?name=<name>
+
+Retrieve an account JWT by the name in its claims, the query parameters above are supported.
+If more than one account has the name, a JSON list of pubkey and name pairs is returned.
+
+A status 404 is returned if no account has the name.
+
+## GET /jwt/v1/accounts/expiring?within=<duration>
+
+Returns a JSON list of the accounts whose JWT expires within the duration, 720h by default, sorted by
+expiry. Accounts that have already expired are included with expired set to true.
+
+## POST /jwt/v1/accounts/lookup
+
+Retrieve up to 1000 account JWTs at once. The body is a JSON list of public keys and the
+response is a JSON object of each key's JWT, or null if the account isn't found.
+
 ## POST /jwt/v1/accounts/<pubkey> (optional)
 
 Update, or store, an account JWT. The JWT Subject should match the pubkey.
 
-The JWT must be signed by the operator specified in the server's configuration.
+The JWT must be signed by the operator specified in the server's configuration, or one of the trusted operator keys.
 
-A status 400 is returned if there is a problem with the JWT or the server is in read-only mode. In rare
+A status 403 is returned if the issuer isn't trusted. A status 400 is returned if there is a problem with the JWT or the server is in read-only mode. In rare
 cases a status 500 may be returned if there was an issue saving the JWT.
 
+A status 200 is returned with a JSON body. The status is "unchanged" if the JWT is the one
+already stored, it isn't saved or sent again, otherwise "updated", with the previous_jti
+of the JWT that was replaced.
+
+## DELETE /jwt/v1/accounts/<pubkey> (optional)
+
+Replace an account JWT with a tombstone. If NATS is configured a delete notification is published
+so replicas can replace their copy. Lookups for a deleted account return a 410 with the tombstone as JSON.
+
+The body must be a JWT signed by a trusted operator key, with the account's public key as the subject.
+
+A status 401 is returned if the body is empty, 400 if the pubkey or JWT is invalid, 403 if the JWT isn't
+signed by a trusted operator key or is for another account, 404 if the JWT is not found and 410 if it
+was already deleted. In rare
+cases a status 500 may be returned if there was an issue deleting the JWT.
+
+## GET /jwt/v1/accounts/<pubkey>/versions
+
+With store history on, returns the kept versions of the account as a JSON list of jti and iat,
+newest first. A status 404 is returned if history is off.
+
+## GET /jwt/v1/accounts/<pubkey>/versions/<jti>
+
+Retrieve a kept version of the account JWT. A status 404 is returned if it isn't kept.
+
+## POST /jwt/v1/accounts/<pubkey>/revert/<jti> (optional)
+
+Save a kept version of the account JWT again and publish a notification, as an upload would.
+The response is the same as an upload's, and the replaced JWT is kept.
+
 ## GET /jwt/v1/activations/<hash>
 
 Retrieve an activation token by its hash.
@@ -73,13 +132,34 @@ export starts with "*" or is ">" the <subject> will be set to "_".
 Three optional query parameters are supported:
 
   * text - can be set to "true" to change the content type to text/plain
-  * decode - can be set to "true" to display the JSON for the JWT header and body
+  * decode - can be set to "true" to display the JSON for the JWT header and body, preceded by the hash and what it was calculated from
   * noticy - can be set to "true" to trigger a notification event if NATS is configured
 
 The response contains cache control headers, and uses the JTI as the ETag.
 
 A 304 is returned if the request contains the appropriate If-None-Match header.
 
+## GET /jwt/v1/activations?account=<importer>&subject=<export subject>
+
+Retrieve an activation token by the account it was issued to and the subject it
+imports. Add issuer=<exporter> if more than one account exports the subject to the
+importer, otherwise a 409 is returned. A 404 is returned if no activation matches.
+
+A status 410 is returned, with the tombstone as JSON, for a deleted activation.
+
+## DELETE /jwt/v1/activations/<hash> (optional)
+## DELETE /jwt/v1/activations?account=<importer>&subject=<export subject> (optional)
+
+Replace an activation with a tombstone. If NATS is configured the hash is published on the
+activation subject so replicas can replace their copy.
+
+The body must be a JWT with the hash, or the importing account, as the subject, signed by a
+trusted operator key, the exporting account or one of its signing keys.
+
+A status 401 is returned if the body is empty, 400 if the JWT is invalid, 403 if it isn't signed
+by an allowed key or is for another activation, 404 if the activation is not found and 410 if it
+was already deleted.
+
 ## POST /jwt/v1/activations
 
 Post a new activation token a JWT.
@@ -88,9 +168,54 @@ The body of the POST should be a valid activation token, with an account subject
 
 Activation tokens are stored by their hash, so two tokens with the same hash will overwrite each other,
 however this should only happen if the accounts and subjects match which requires either the
-same export or a matching one.
+same export or a matching one. If the activation stored under the hash has a different issuer or subject, the
+save is refused with a 409, the collision is logged as an error and counted in the activation_collisions_total
+metric.
 
 A status 400 is returned if there is a problem with the JWT or saving it. In rare
 cases a status 500 may be returned if there was an issue saving the JWT. Otherwise
 a status 200 is returned.
+
+## POST /jwt/v1/users/<pubkey> and GET /jwt/v1/users/<pubkey>
+
+Only with enableuserjwts. Post a user JWT signed by a stored account, or one of its signing
+keys, and retrieve it with the account cache headers. User JWTs are never sent over NATS.
+
+## GET /jwt/v1/pack
+
+Stream every JWT in the store, one <key>|<jwt> line per JWT, sorted by key. Accounts are
+keyed by their public key and activations by their hash.
+
+Two optional query parameters are supported:
+
+  * after - skip all keys up to and including this one, used to resume an interrupted download
+  * type - can be set to "accounts" or "activations" to only return one kind of JWT
+
+The number of lines and the SHA-256 of the body are sent in the X-Pack-Count and X-Pack-Sha256
+trailers.
+
+Replicas use this endpoint to copy the primary's store at startup.
+
+## POST /jwt/v1/pack (optional)
+
+Import a pack, one JWT per line, with or without the <key>| prefix. Each JWT is checked like
+a single account or activation upload. Lines that fail don't stop the import. JWTs that are
+already stored, or older than the stored copy, are skipped.
+
+One optional query parameter is supported:
+
+  * notify - can be set to "true" to send a notification for each JWT saved, if NATS is configured
+
+A status 200 is returned with a JSON summary of the number of JWTs saved, and the line, key and
+reason for each JWT skipped or failed.
+
+## POST /jwt/v1/notify
+
+Re-send the notification for every account in the store, paced by the notifyrate setting. A status
+202 is returned with a JSON job, its progress is shown by GET /jwt/v1/status. Only one job runs at a
+time, a 409 is returned with the running job. A status 503 is returned if NATS isn't connected.
+
+One optional query parameter is supported:
+
+  * account - a public key, only that account is notified, before the response is sent
 `
@@ -0,0 +1,234 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/nats-account-server/server/logging"
+	"github.com/nats-io/nats-account-server/server/store"
+)
+
+const (
+	// currentJWTAlgorithm is the algorithm newer jwt libraries sign with, nats-server 2.2 and
+	// later reject the plain ed25519 used before it
+	currentJWTAlgorithm    = "ed25519-nkey"
+	deprecatedJWTAlgorithm = "ed25519"
+
+	// currentClaimsVersion is the nats.version of claims in the current format, v1 claims don't set it
+	currentClaimsVersion = 2
+)
+
+// legacyJWT is a stored JWT that newer nats-servers reject, and why
+type legacyJWT struct {
+	Key       string    `json:"key"`
+	Reasons   []string  `json:"reasons"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// legacyCheck is the cached result for a key, sig identifies the JWT it was for
+type legacyCheck struct {
+	sig       string
+	reasons   []string
+	checkedAt time.Time
+}
+
+// legacyJWTs caches the legacy check for each key, a JWT is only decoded again once the key
+// has another JWT
+type legacyJWTs struct {
+	sync.Mutex
+	checks map[string]legacyCheck
+}
+
+func newLegacyJWTs() *legacyJWTs {
+	return &legacyJWTs{
+		checks: map[string]legacyCheck{},
+	}
+}
+
+// legacyReasons decodes the header and the claims version of a JWT, without checking the
+// signature or validating the claims, and returns why it is legacy. JWTs that don't decode
+// are corrupt rather than legacy and have no reasons.
+func legacyReasons(theJWT string) []string {
+	header, err := decodeJWTHeader(theJWT)
+	if err != nil {
+		return nil
+	}
+
+	reasons := []string{}
+	switch alg := strings.ToLower(header.Algorithm); alg {
+	case currentJWTAlgorithm:
+	case deprecatedJWTAlgorithm:
+		reasons = append(reasons, fmt.Sprintf("deprecated %s algorithm", deprecatedJWTAlgorithm))
+	default:
+		reasons = append(reasons, fmt.Sprintf("unknown %q algorithm", header.Algorithm))
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.Split(theJWT, ".")[1])
+	if err != nil {
+		return nil
+	}
+	claims := struct {
+		Nats struct {
+			Version int `json:"version"`
+		} `json:"nats"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil
+	}
+	if claims.Nats.Version < currentClaimsVersion {
+		reasons = append(reasons, "v1 claim format")
+	}
+
+	if len(reasons) == 0 {
+		return nil
+	}
+	return reasons
+}
+
+// check returns why the JWT for key is legacy, nil if it isn't
+func (l *legacyJWTs) check(key string, theJWT string) []string {
+	sig := theJWT[strings.LastIndex(theJWT, ".")+1:]
+
+	l.Lock()
+	cached, ok := l.checks[key]
+	l.Unlock()
+	if ok && cached.sig == sig {
+		return cached.reasons
+	}
+
+	reasons := legacyReasons(theJWT)
+
+	l.Lock()
+	defer l.Unlock()
+	l.checks[key] = legacyCheck{sig: sig, reasons: reasons, checkedAt: time.Now().UTC()}
+	return reasons
+}
+
+// forget drops the result for a key that was saved or deleted
+func (l *legacyJWTs) forget(key string) {
+	l.Lock()
+	defer l.Unlock()
+	delete(l.checks, key)
+}
+
+// list returns the legacy JWTs found so far, sorted by key
+func (l *legacyJWTs) list() []legacyJWT {
+	l.Lock()
+	defer l.Unlock()
+	legacy := []legacyJWT{}
+	for key, check := range l.checks {
+		if len(check.reasons) > 0 {
+			legacy = append(legacy, legacyJWT{Key: key, Reasons: check.reasons, CheckedAt: check.checkedAt})
+		}
+	}
+	sort.Slice(legacy, func(i, j int) bool { return legacy[i].Key < legacy[j].Key })
+	return legacy
+}
+
+// legacyScan is the result of checking every JWT in the store
+type legacyScan struct {
+	Total  int         `json:"total"`
+	Legacy int         `json:"legacy"`
+	JWTs   []legacyJWT `json:"jwts"`
+}
+
+// scanLegacyJWTs checks every JWT in the store, logging each legacy one and a summary
+func (server *AccountServer) scanLegacyJWTs(jwtStore store.JWTStore) (legacyScan, error) {
+	scan := legacyScan{JWTs: []legacyJWT{}}
+	legacy := map[string][]string{}
+
+	err := jwtStore.Iterate(func(key string, theJWT string) error {
+		if store.IsTombstone(theJWT) {
+			return nil
+		}
+		scan.Total++
+		if reasons := server.legacy.check(key, theJWT); len(reasons) > 0 {
+			legacy[key] = reasons
+		}
+		return nil
+	})
+	if err != nil {
+		return scan, fmt.Errorf("unable to scan the store for legacy JWTs, %s", err.Error())
+	}
+
+	for _, found := range server.legacy.list() {
+		if _, ok := legacy[found.Key]; ok {
+			scan.JWTs = append(scan.JWTs, found)
+		}
+	}
+	scan.Legacy = len(scan.JWTs)
+
+	for _, found := range scan.JWTs {
+		server.logger.WithFields(logging.Fields{"key": found.Key, "reasons": found.Reasons}).Warnf("legacy JWT in the store for %s, %s", ShortKey(found.Key), strings.Join(found.Reasons, ", "))
+	}
+	server.logger.Noticef("scanned %d JWTs in the store for legacy formats, %d are legacy", scan.Total, scan.Legacy)
+
+	return scan, nil
+}
+
+// refuseLegacy is true, and counts the refusal, if strict legacy checks are on and the JWT for
+// key is legacy
+func (server *AccountServer) refuseLegacy(key string, theJWT string) bool {
+	if !server.currentConfig().LegacyJWTs.Strict {
+		return false
+	}
+
+	reasons := server.legacy.check(key, theJWT)
+	if len(reasons) == 0 {
+		return false
+	}
+
+	atomic.AddUint64(&server.metrics.legacyRefused, 1)
+	server.logger.WithFields(logging.Fields{"key": key, "reasons": reasons}).Debugf("refusing legacy JWT for %s, %s", ShortKey(key), strings.Join(reasons, ", "))
+	return true
+}
+
+// LegacyScanHandler checks every JWT in the store for legacy formats, it is the target of POST /admin/legacy-scan
+func (server *AccountServer) LegacyScanHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	server.logger.Tracef("%s: %s", r.RemoteAddr, r.URL.String())
+
+	server.Lock()
+	jwtStore := server.jwtStore
+	server.Unlock()
+
+	scan, err := server.scanLegacyJWTs(jwtStore)
+	if err != nil {
+		server.sendError(http.StatusInternalServerError, CodeStoreError, "unable to scan the store", "", err, w)
+		return
+	}
+
+	data, err := json.Marshal(scan)
+	if err != nil {
+		server.sendErrorResponse(http.StatusInternalServerError, "unable to encode scan result", "", err, w)
+		return
+	}
+
+	w.Header().Set(ContentType, ApplicationJSON)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
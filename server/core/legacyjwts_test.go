@@ -0,0 +1,146 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeJWT builds a JWT from a header and claims, the signature isn't valid
+func fakeJWT(header string, claims string) string {
+	encode := base64.RawURLEncoding.EncodeToString
+	return encode([]byte(header)) + "." + encode([]byte(claims)) + ".c2ln"
+}
+
+func TestLegacyReasons(t *testing.T) {
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+	operatorKey, err := nkeys.CreateOperator()
+	require.NoError(t, err)
+
+	v1JWT, err := jwt.NewAccountClaims(pubKey).Encode(operatorKey)
+	require.NoError(t, err)
+	require.Equal(t, []string{"deprecated ed25519 algorithm", "v1 claim format"}, legacyReasons(v1JWT))
+
+	current := fakeJWT(`{"typ":"JWT","alg":"ed25519-nkey"}`, `{"sub":"A","nats":{"version":2}}`)
+	require.Nil(t, legacyReasons(current))
+
+	oldClaims := fakeJWT(`{"typ":"JWT","alg":"ed25519-nkey"}`, `{"sub":"A","nats":{}}`)
+	require.Equal(t, []string{"v1 claim format"}, legacyReasons(oldClaims))
+
+	unknown := fakeJWT(`{"typ":"JWT","alg":"HS256"}`, `{"sub":"A","nats":{"version":2}}`)
+	require.Equal(t, []string{`unknown "HS256" algorithm`}, legacyReasons(unknown))
+
+	require.Nil(t, legacyReasons("not a JWT"))
+	require.Nil(t, legacyReasons(fakeJWT(`{"typ":"JWT","alg":"ed25519"}`, "not json")))
+}
+
+func TestLegacyJWTsCache(t *testing.T) {
+	legacy := newLegacyJWTs()
+	old := fakeJWT(`{"typ":"JWT","alg":"ed25519"}`, `{"sub":"A","nats":{"version":2}}`)
+	current := fakeJWT(`{"typ":"JWT","alg":"ed25519-nkey"}`, `{"sub":"A","nats":{"version":2}}`)
+
+	require.Len(t, legacy.check("A", old), 1)
+	require.Len(t, legacy.list(), 1)
+
+	// the result is cached until the key has another JWT
+	legacy.Lock()
+	cached := legacy.checks["A"]
+	cached.reasons = []string{"cached"}
+	legacy.checks["A"] = cached
+	legacy.Unlock()
+	require.Equal(t, []string{"cached"}, legacy.check("A", old))
+
+	require.Nil(t, legacy.check("A", current[:strings.LastIndex(current, ".")]+".b3RoZXI"))
+	require.Empty(t, legacy.list())
+
+	legacy.check("B", old)
+	legacy.check("C", old)
+	legacy.forget("B")
+	list := legacy.list()
+	require.Len(t, list, 1)
+	require.Equal(t, "C", list[0].Key)
+}
+
+func TestLegacyScanAndStrictLookups(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+	acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	require.NoError(t, testEnv.Server.saveJWT(pubKey, acctJWT))
+
+	resp, err := testEnv.HTTP.Post(testEnv.URLForPath("/admin/legacy-scan"), "application/json", bytes.NewBuffer(nil))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+
+	scan := legacyScan{}
+	require.NoError(t, json.Unmarshal(body, &scan))
+	require.Equal(t, 1, scan.Legacy)
+	require.Equal(t, pubKey, scan.JWTs[0].Key)
+
+	resp, err = testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/status"))
+	require.NoError(t, err)
+	body, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.True(t, strings.Contains(string(body), fmt.Sprintf(`"legacy_jwts":[{"key":"%s"`, pubKey)))
+
+	// without strict the JWT is still served
+	url := testEnv.URLForPath("/jwt/v1/accounts/" + pubKey)
+	resp, err = testEnv.HTTP.Get(url)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	testEnv.Server.config.LegacyJWTs.Strict = true
+	resp, err = testEnv.HTTP.Get(url)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	var apiErr errorResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&apiErr))
+	resp.Body.Close()
+	require.Equal(t, CodeLegacyJWT, apiErr.Code)
+	require.Equal(t, uint64(1), atomic.LoadUint64(&testEnv.Server.metrics.legacyRefused))
+
+	// saving the account again forgets the result until it is checked
+	require.NoError(t, testEnv.Server.saveJWT(pubKey, acctJWT))
+	require.Empty(t, testEnv.Server.legacy.list())
+}
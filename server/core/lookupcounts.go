@@ -0,0 +1,152 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+)
+
+// accountLookupCount is the number of lookups for one account
+type accountLookupCount struct {
+	PubKey  string `json:"pubkey"`
+	Lookups uint64 `json:"lookups"`
+}
+
+// lookupCountWindow holds the counts since the last reset. Accounts that have been seen are
+// counted with an atomic add, only new accounts touch the map's lock.
+type lookupCountWindow struct {
+	counts  sync.Map // public key to *uint64
+	size    int64
+	started time.Time
+}
+
+// accountLookups counts the lookups for each account, it doesn't use the server lock so it can
+// be called for every lookup. Once max accounts are tracked new ones are ignored until the
+// counts are reset, every reset interval.
+type accountLookups struct {
+	window atomic.Value // *lookupCountWindow
+	max    int64
+	reset  int64 // nanoseconds, 0 never resets
+}
+
+func newAccountLookups() *accountLookups {
+	lookups := &accountLookups{}
+	lookups.window.Store(&lookupCountWindow{started: time.Now()})
+	return lookups
+}
+
+// configure applies the limits, they are used from the next lookup
+func (lookups *accountLookups) configure(config conf.LookupCountsConfig) {
+	atomic.StoreInt64(&lookups.max, int64(config.MaxAccounts))
+	atomic.StoreInt64(&lookups.reset, int64(time.Duration(config.Reset)*time.Second))
+}
+
+// current returns the window for now, replacing it if it is older than the reset interval
+func (lookups *accountLookups) current(now time.Time) *lookupCountWindow {
+	window := lookups.window.Load().(*lookupCountWindow)
+	reset := time.Duration(atomic.LoadInt64(&lookups.reset))
+	if reset <= 0 || now.Sub(window.started) < reset {
+		return window
+	}
+
+	next := &lookupCountWindow{started: now}
+	if lookups.window.CompareAndSwap(window, next) {
+		return next
+	}
+	return lookups.window.Load().(*lookupCountWindow)
+}
+
+func (lookups *accountLookups) add(pubKey string, now time.Time) {
+	window := lookups.current(now)
+
+	count, ok := window.counts.Load(pubKey)
+	if !ok {
+		if atomic.LoadInt64(&window.size) >= atomic.LoadInt64(&lookups.max) {
+			return
+		}
+		var loaded bool
+		if count, loaded = window.counts.LoadOrStore(pubKey, new(uint64)); !loaded {
+			atomic.AddInt64(&window.size, 1)
+		}
+	}
+	atomic.AddUint64(count.(*uint64), 1)
+}
+
+// snapshot returns the counts, the most looked up first, and when counting started
+func (lookups *accountLookups) snapshot(now time.Time) ([]accountLookupCount, time.Time) {
+	window := lookups.current(now)
+
+	counts := []accountLookupCount{}
+	window.counts.Range(func(key, value interface{}) bool {
+		counts = append(counts, accountLookupCount{PubKey: key.(string), Lookups: atomic.LoadUint64(value.(*uint64))})
+		return true
+	})
+
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Lookups != counts[j].Lookups {
+			return counts[i].Lookups > counts[j].Lookups
+		}
+		return counts[i].PubKey < counts[j].PubKey
+	})
+	return counts, window.started
+}
+
+// accountLookupStatus is the busiest accounts, for the status endpoint
+type accountLookupStatus struct {
+	Since    time.Time            `json:"since"`
+	Tracked  int                  `json:"tracked"`
+	Accounts []accountLookupCount `json:"accounts"`
+}
+
+func (lookups *accountLookups) top(n int, now time.Time) accountLookupStatus {
+	counts, since := lookups.snapshot(now)
+	status := accountLookupStatus{Since: since.UTC(), Tracked: len(counts), Accounts: counts}
+	if len(counts) > n {
+		status.Accounts = counts[:n]
+	}
+	return status
+}
+
+// metricValues labels the accounts with at least threshold lookups, the others are added up
+// under account="other" so the number of labels stays bounded
+func (lookups *accountLookups) metricValues(threshold uint64, now time.Time) []string {
+	counts, _ := lookups.snapshot(now)
+
+	values := []string{}
+	other := uint64(0)
+	for _, count := range counts {
+		if count.Lookups >= threshold {
+			values = append(values, fmt.Sprintf(`{account=%q} %d`, count.PubKey, count.Lookups))
+		} else {
+			other += count.Lookups
+		}
+	}
+	return append(values, fmt.Sprintf(`{account="other"} %d`, other))
+}
+
+func validateLookupCounts(config conf.LookupCountsConfig) error {
+	if config.MaxAccounts < 0 || config.Reset < 0 || config.Top < 0 || config.MetricThreshold < 0 {
+		return fmt.Errorf("lookup count settings cannot be negative")
+	}
+	return nil
+}
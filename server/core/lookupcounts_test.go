@@ -0,0 +1,134 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccountLookups(t *testing.T) {
+	lookups := newAccountLookups()
+	lookups.configure(conf.LookupCountsConfig{MaxAccounts: 3, Reset: 60})
+	now := time.Now()
+
+	for i := 0; i < 5; i++ {
+		lookups.add("A", now)
+	}
+	lookups.add("B", now)
+	lookups.add("B", now)
+	lookups.add("C", now)
+	// full, new accounts are ignored until the reset
+	lookups.add("D", now)
+
+	status := lookups.top(2, now)
+	require.Equal(t, 3, status.Tracked)
+	require.Equal(t, []accountLookupCount{{PubKey: "A", Lookups: 5}, {PubKey: "B", Lookups: 2}}, status.Accounts)
+
+	require.Equal(t, []string{`{account="A"} 5`, `{account="B"} 2`, `{account="other"} 1`}, lookups.metricValues(2, now))
+
+	later := now.Add(time.Minute)
+	lookups.add("D", later)
+	status = lookups.top(2, later)
+	require.Equal(t, 1, status.Tracked)
+	require.Equal(t, []accountLookupCount{{PubKey: "D", Lookups: 1}}, status.Accounts)
+	require.Equal(t, later.UTC(), status.Since)
+
+	require.Error(t, validateLookupCounts(conf.LookupCountsConfig{Top: -1}))
+	require.NoError(t, validateLookupCounts(conf.DefaultServerConfig().LookupCounts))
+}
+
+func TestAccountLookupsConcurrent(t *testing.T) {
+	lookups := newAccountLookups()
+	lookups.configure(conf.LookupCountsConfig{MaxAccounts: 100})
+	now := time.Now()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				lookups.add(fmt.Sprintf("ACCOUNT%d", j%10), now)
+			}
+		}()
+	}
+	wg.Wait()
+
+	status := lookups.top(20, now)
+	require.Equal(t, 10, status.Tracked)
+	for _, count := range status.Accounts {
+		require.Equal(t, uint64(1000), count.Lookups)
+	}
+}
+
+func TestAccountLookupsEndpoints(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.LookupCounts.MetricThreshold = 2
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	jwts := saveTestAccounts(t, testEnv, 2)
+	keys := []string{}
+	for pubKey := range jwts {
+		keys = append(keys, pubKey)
+	}
+	busy, quiet := keys[0], keys[1]
+
+	get := func(pubKey string) {
+		resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/accounts/" + pubKey))
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+	get(busy)
+	get(busy)
+	get(busy)
+	get(quiet)
+	// misses aren't counted
+	_, missing, _ := CreateAccountKey(t)
+	get(missing)
+
+	status := getStatus(t, testEnv.HTTP, testEnv.URLForPath("/jwt/v1/status"))
+	require.NotNil(t, status.TopAccounts)
+	require.Equal(t, 2, status.TopAccounts.Tracked)
+	require.Equal(t, []accountLookupCount{{PubKey: busy, Lookups: 3}, {PubKey: quiet, Lookups: 1}}, status.TopAccounts.Accounts)
+
+	resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/metrics"))
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	metrics := string(body)
+	require.True(t, strings.Contains(metrics, fmt.Sprintf(`nats_account_server_account_lookups{account="%s"} 3`, busy)))
+	require.True(t, strings.Contains(metrics, `nats_account_server_account_lookups{account="other"} 1`))
+	require.False(t, strings.Contains(metrics, quiet))
+
+	// the top accounts can be left out of the status
+	next := *testEnv.Server.currentConfig()
+	next.LookupCounts.Top = 0
+	require.NoError(t, testEnv.Server.ReloadConfig(&next))
+	status = getStatus(t, testEnv.HTTP, testEnv.URLForPath("/jwt/v1/status"))
+	require.Nil(t, status.TopAccounts)
+}
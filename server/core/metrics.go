@@ -0,0 +1,410 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/nats-account-server/server/store"
+)
+
+const (
+	metricsPrefix = "nats_account_server_"
+
+	// counting the store means reading it, so the result is reused between scrapes
+	storeCountInterval = 30 * time.Second
+)
+
+// serverMetrics holds the counters exposed on /metrics, all fields are updated
+// atomically so they never need the server lock
+type serverMetrics struct {
+	accountHits              uint64
+	accountMisses            uint64
+	negativeHits             uint64
+	activationHits           uint64
+	activationMisses         uint64
+	userHits                 uint64
+	userMisses               uint64
+	userSaves                uint64
+	accountUpdates           uint64
+	activationSaves          uint64
+	notificationsSent        uint64
+	notificationsReceived    uint64
+	notificationsQueued      uint64
+	notificationsDropped     uint64
+	notificationsOversized   uint64
+	natsReconnects           uint64
+	natsLameDucks            uint64
+	storeErrors              uint64
+	storeFullRejections      uint64
+	staleServed              uint64
+	activationsRejected      uint64
+	activationsReplayed      uint64
+	activationCollisions     uint64
+	writesDenied             uint64
+	accountsUnchanged        uint64
+	batchLookups             uint64
+	relayRequests            uint64
+	relayFetches             uint64
+	relayTimeouts            uint64
+	notificationSaveFailures uint64
+	primaryJWTsRejected      uint64
+	replicaRefreshes         uint64
+	primaryConnsReused       uint64
+	primaryConnsNew          uint64
+	gossipDigestsSent        uint64
+	gossipDigestsReceived    uint64
+	gossipPrimaryFetches     uint64
+	gossipReplicaFetches     uint64
+	notificationsDuplicate   uint64
+	packRequests             uint64
+	packRequestsUpToDate     uint64
+	webhookDeliveries        uint64
+	webhookFailures          uint64
+	webhookDropped           uint64
+	throttledReads           uint64
+	throttledWrites          uint64
+	gcAccounts               uint64
+	gcActivations            uint64
+	gcTombstones             uint64
+	mirrorReceived           uint64
+	mirrorRepublished        uint64
+	mirrorLooped             uint64
+	legacyRefused            uint64
+	natsConnected            int32
+	mirrorConnected          int32
+
+	countLock    sync.Mutex
+	storeCount   int
+	storeCountAt time.Time
+
+	primaryFetchLatency latencyHistogram // replica fetches from a primary, by outcome
+}
+
+// latencyBuckets are the upper bounds, in seconds, of latency histograms
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// the outcomes of a fetch from a primary, labels for the latency histogram
+const (
+	fetchOK        = "ok"
+	fetchTimeout   = "timeout"
+	fetch4xx       = "4xx"
+	fetch5xx       = "5xx"
+	fetchConnError = "conn-error"
+)
+
+var fetchOutcomes = []string{fetchOK, fetchTimeout, fetch4xx, fetch5xx, fetchConnError}
+
+// latencyHistogram counts durations into latencyBuckets for each label value, the zero value is ready to use
+type latencyHistogram struct {
+	sync.Mutex
+	series map[string]*latencySeries
+}
+
+type latencySeries struct {
+	buckets []uint64 // durations up to each bound and above the one before, the exposition adds them up
+	count   uint64
+	sum     float64
+}
+
+func (h *latencyHistogram) observe(label string, d time.Duration) {
+	seconds := d.Seconds()
+
+	h.Lock()
+	defer h.Unlock()
+
+	if h.series == nil {
+		h.series = map[string]*latencySeries{}
+	}
+	s, ok := h.series[label]
+	if !ok {
+		s = &latencySeries{buckets: make([]uint64, len(latencyBuckets))}
+		h.series[label] = s
+	}
+
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			s.buckets[i]++
+			break
+		}
+	}
+	s.count++
+	s.sum += seconds
+}
+
+// values returns the bucket, sum and count lines for writeMetric, every label value is included
+func (h *latencyHistogram) values(name string, labels []string) []string {
+	h.Lock()
+	defer h.Unlock()
+
+	values := []string{}
+	for _, label := range labels {
+		s, ok := h.series[label]
+		if !ok {
+			s = &latencySeries{buckets: make([]uint64, len(latencyBuckets))}
+		}
+
+		cumulative := uint64(0)
+		for i, bound := range latencyBuckets {
+			cumulative += s.buckets[i]
+			values = append(values, fmt.Sprintf(`_bucket{%s=%q,le="%s"} %d`, name, label, strconv.FormatFloat(bound, 'g', -1, 64), cumulative))
+		}
+		values = append(values,
+			fmt.Sprintf(`_bucket{%s=%q,le="+Inf"} %d`, name, label, s.count),
+			fmt.Sprintf(`_sum{%s=%q} %g`, name, label, s.sum),
+			fmt.Sprintf(`_count{%s=%q} %d`, name, label, s.count))
+	}
+	return values
+}
+
+// countLookup adds a lookup to the hit or miss counter, depending on err
+func countLookup(hit *uint64, miss *uint64, err error) {
+	if err != nil {
+		atomic.AddUint64(miss, 1)
+	} else {
+		atomic.AddUint64(hit, 1)
+	}
+}
+
+func (m *serverMetrics) setNATSConnected(connected bool) {
+	if connected {
+		atomic.StoreInt32(&m.natsConnected, 1)
+	} else {
+		atomic.StoreInt32(&m.natsConnected, 0)
+	}
+}
+
+// resetStoreCount makes the next scrape count the store again, after it has changed
+func (m *serverMetrics) resetStoreCount() {
+	m.countLock.Lock()
+	m.storeCountAt = time.Time{}
+	m.countLock.Unlock()
+}
+
+// jwtCount returns the number of JWTs in the store, recounting at most once per storeCountInterval
+func (server *AccountServer) jwtCount() (int, error) {
+	m := server.metrics
+	m.countLock.Lock()
+	defer m.countLock.Unlock()
+
+	if !m.storeCountAt.IsZero() && time.Since(m.storeCountAt) < storeCountInterval {
+		return m.storeCount, nil
+	}
+
+	jwtStore := server.jwtStore
+	if jwtStore == nil {
+		return 0, fmt.Errorf("no store")
+	}
+
+	var count int
+	var err error
+	if counter, ok := jwtStore.(store.JWTCounter); ok {
+		count, err = counter.Count()
+	} else {
+		err = jwtStore.Iterate(func(publicKey string, theJWT string) error {
+			if !store.IsTombstone(theJWT) {
+				count++
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		atomic.AddUint64(&m.storeErrors, 1)
+		return 0, err
+	}
+
+	m.storeCount = count
+	m.storeCountAt = time.Now()
+	return count, nil
+}
+
+func writeMetric(buf *bytes.Buffer, name string, kind string, help string, values ...string) {
+	fmt.Fprintf(buf, "# HELP %s%s %s\n", metricsPrefix, name, help)
+	fmt.Fprintf(buf, "# TYPE %s%s %s\n", metricsPrefix, name, kind)
+	for _, v := range values {
+		fmt.Fprintf(buf, "%s%s%s\n", metricsPrefix, name, v)
+	}
+}
+
+// GetMetrics returns the server metrics in the Prometheus text format
+func (server *AccountServer) GetMetrics(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logger := server.logger.WithContext(r.Context())
+	m := server.metrics
+	load := func(v *uint64) uint64 { return atomic.LoadUint64(v) }
+	buf := bytes.NewBuffer(nil)
+
+	writeMetric(buf, "jwt_lookups_total", "counter", "JWT lookups by type and result.",
+		fmt.Sprintf(`{type="account",result="hit"} %d`, load(&m.accountHits)),
+		fmt.Sprintf(`{type="account",result="miss"} %d`, load(&m.accountMisses)),
+		fmt.Sprintf(`{type="activation",result="hit"} %d`, load(&m.activationHits)),
+		fmt.Sprintf(`{type="activation",result="miss"} %d`, load(&m.activationMisses)),
+		fmt.Sprintf(`{type="user",result="hit"} %d`, load(&m.userHits)),
+		fmt.Sprintf(`{type="user",result="miss"} %d`, load(&m.userMisses)))
+	writeMetric(buf, "negative_cache_hits_total", "counter", "Account lookups answered as not found from the negative cache, each is also counted as a miss.",
+		fmt.Sprintf(" %d", load(&m.negativeHits)))
+	writeMetric(buf, "negative_cache_entries", "gauge", "Missing accounts in the negative cache.",
+		fmt.Sprintf(" %d", server.misses.size()))
+	writeMetric(buf, "account_updates_total", "counter", "Account JWTs saved from POST requests.",
+		fmt.Sprintf(" %d", load(&m.accountUpdates)))
+	writeMetric(buf, "account_updates_unchanged_total", "counter", "Account JWTs posted that were already stored, they aren't saved or sent again.",
+		fmt.Sprintf(" %d", load(&m.accountsUnchanged)))
+	writeMetric(buf, "batch_lookups_total", "counter", "POST /jwt/v1/accounts/lookup requests, each account is also counted in jwt_lookups_total.",
+		fmt.Sprintf(" %d", load(&m.batchLookups)))
+	writeMetric(buf, "activation_saves_total", "counter", "Activation JWTs saved from POST requests.",
+		fmt.Sprintf(" %d", load(&m.activationSaves)))
+	writeMetric(buf, "user_saves_total", "counter", "User JWTs saved from POST requests, with enableuserjwts.",
+		fmt.Sprintf(" %d", load(&m.userSaves)))
+	writeMetric(buf, "notifications_sent_total", "counter", "NATS notifications published.",
+		fmt.Sprintf(" %d", load(&m.notificationsSent)))
+	writeMetric(buf, "notifications_received_total", "counter", "NATS notifications received.",
+		fmt.Sprintf(" %d", load(&m.notificationsReceived)))
+	writeMetric(buf, "notifications_queued_total", "counter", "Account notifications queued while NATS was unavailable.",
+		fmt.Sprintf(" %d", load(&m.notificationsQueued)))
+	writeMetric(buf, "notifications_dropped_total", "counter", "Queued account notifications dropped because the queue was full.",
+		fmt.Sprintf(" %d", load(&m.notificationsDropped)))
+	writeMetric(buf, "notifications_duplicate_total", "counter", "Notifications dropped because their JWT was already stored or seen recently.",
+		fmt.Sprintf(" %d", load(&m.notificationsDuplicate)))
+	writeMetric(buf, "pack_requests_total", "counter", "Full resolver pack requests answered over NATS.",
+		fmt.Sprintf(" %d", load(&m.packRequests)))
+	writeMetric(buf, "pack_requests_up_to_date_total", "counter", "Pack requests whose hash matched the store, answered without sending JWTs.",
+		fmt.Sprintf(" %d", load(&m.packRequestsUpToDate)))
+	writeMetric(buf, "notifications_oversized_total", "counter", "Notifications dropped because the JWT was over the size limit.",
+		fmt.Sprintf(" %d", load(&m.notificationsOversized)))
+	writeMetric(buf, "notifications_pending", "gauge", "Account notifications waiting for NATS.",
+		fmt.Sprintf(" %d", server.pendingNotifications.size()))
+	writeMetric(buf, "nats_reconnects_total", "counter", "NATS reconnects.",
+		fmt.Sprintf(" %d", load(&m.natsReconnects)))
+	writeMetric(buf, "nats_lame_duck_total", "counter", "Moves to another NATS server after a lame duck mode announcement.",
+		fmt.Sprintf(" %d", load(&m.natsLameDucks)))
+	writeMetric(buf, "store_errors_total", "counter", "Errors returned by the JWT store.",
+		fmt.Sprintf(" %d", load(&m.storeErrors)))
+	writeMetric(buf, "legacy_jwts_refused_total", "counter", "Lookups refused because the JWT is in a legacy format and legacyjwts.strict is set.",
+		fmt.Sprintf(" %d", load(&m.legacyRefused)))
+	writeMetric(buf, "store_full_rejections_total", "counter", "Saves rejected because they would take the store over its entry or byte limit.",
+		fmt.Sprintf(" %d", load(&m.storeFullRejections)))
+	if usage := server.storeUsage; usage != nil {
+		entries, bytes := usage.totals()
+		writeMetric(buf, "store_usage_entries", "gauge", "Entries in the store, counted for its limits.", fmt.Sprintf(" %d", entries))
+		writeMetric(buf, "store_usage_bytes", "gauge", "Bytes in the store, keys and JWTs, counted for its limits.", fmt.Sprintf(" %d", bytes))
+	}
+	writeMetric(buf, "notification_save_failures_total", "counter", "JWTs from NATS notifications that couldn't be saved after retrying.",
+		fmt.Sprintf(" %d", load(&m.notificationSaveFailures)))
+	writeMetric(buf, "dirty_jwts", "gauge", "JWTs from NATS notifications waiting to be saved.",
+		fmt.Sprintf(" %d", server.dirty.size()))
+	writeMetric(buf, "primary_jwts_rejected_total", "counter", "JWTs from the primary that failed verification.",
+		fmt.Sprintf(" %d", load(&m.primaryJWTsRejected)))
+	writeMetric(buf, "replica_refreshes_total", "counter", "JWTs a replica refreshed from the primary before they went stale.",
+		fmt.Sprintf(" %d", load(&m.replicaRefreshes)))
+	writeMetric(buf, "primary_connections_total", "counter", "Requests a replica sent to a primary, by whether the connection was reused from the pool or new.",
+		fmt.Sprintf(`{connection="reused"} %d`, load(&m.primaryConnsReused)),
+		fmt.Sprintf(`{connection="new"} %d`, load(&m.primaryConnsNew)))
+	writeMetric(buf, "primary_fetch_duration_seconds", "histogram", "Time taken by replica fetches from a primary, by outcome.",
+		m.primaryFetchLatency.values("outcome", fetchOutcomes)...)
+	if primaries, _ := server.currentPrimaries(); primaries != nil {
+		failures := primaries.failures()
+		values := []string{}
+		for _, primary := range primaries.urls() {
+			values = append(values, fmt.Sprintf(`{primary=%q} %d`, primary, failures[primary]))
+		}
+		writeMetric(buf, "primary_consecutive_failures", "gauge", fmt.Sprintf("Failures in a row for each primary, it is unhealthy after %d.", primaryFailureLimit), values...)
+	}
+	writeMetric(buf, "gossip_digests_total", "counter", "Gossip digests of recently saved accounts, by direction.",
+		fmt.Sprintf(`{direction="sent"} %d`, load(&m.gossipDigestsSent)),
+		fmt.Sprintf(`{direction="received"} %d`, load(&m.gossipDigestsReceived)))
+	writeMetric(buf, "gossip_fetches_total", "counter", "Accounts a replica fetched because a gossip digest had a different JTI, by source.",
+		fmt.Sprintf(`{source="primary"} %d`, load(&m.gossipPrimaryFetches)),
+		fmt.Sprintf(`{source="replica"} %d`, load(&m.gossipReplicaFetches)))
+	writeMetric(buf, "webhook_deliveries_total", "counter", "Account changes delivered to webhooks.",
+		fmt.Sprintf(" %d", load(&m.webhookDeliveries)))
+	writeMetric(buf, "webhook_failures_total", "counter", "Account changes that could not be delivered to a webhook after every attempt.",
+		fmt.Sprintf(" %d", load(&m.webhookFailures)))
+	writeMetric(buf, "webhook_dropped_total", "counter", "Account changes dropped because a webhook queue was full.",
+		fmt.Sprintf(" %d", load(&m.webhookDropped)))
+	writeMetric(buf, "stale_served_total", "counter", "Stale JWTs served by a replica while the primary was down.",
+		fmt.Sprintf(" %d", load(&m.staleServed)))
+	writeMetric(buf, "activations_rejected_total", "counter", "Activation JWTs dropped by strict activation checks.",
+		fmt.Sprintf(" %d", load(&m.activationsRejected)))
+	writeMetric(buf, "activation_collisions_total", "counter", "Activation JWTs refused because their hash is stored for a different issuer and subject.",
+		fmt.Sprintf(" %d", load(&m.activationCollisions)))
+	writeMetric(buf, "activations_replayed_total", "counter", "Activation notifications sent again after the account they involve was saved.",
+		fmt.Sprintf(" %d", load(&m.activationsReplayed)))
+	writeMetric(buf, "requests_throttled_total", "counter", "Requests rejected by the rate limits, by class.",
+		fmt.Sprintf(`{class="read"} %d`, load(&m.throttledReads)),
+		fmt.Sprintf(`{class="write"} %d`, load(&m.throttledWrites)))
+	writeMetric(buf, "relay_requests_total", "counter", "Lookups from relays answered over NATS.",
+		fmt.Sprintf(" %d", load(&m.relayRequests)))
+	writeMetric(buf, "relay_upstream_lookups_total", "counter", "Lookups a relay requested from its upstream, by result.",
+		fmt.Sprintf(`{result="answered"} %d`, load(&m.relayFetches)),
+		fmt.Sprintf(`{result="timeout"} %d`, load(&m.relayTimeouts)))
+	writeMetric(buf, "writes_denied_total", "counter", "POST and DELETE requests refused by the write IP allow and deny lists.",
+		fmt.Sprintf(" %d", load(&m.writesDenied)))
+	writeMetric(buf, "store_gc_removed_total", "counter", "Expired JWTs and old tombstones removed by garbage collection, by type.",
+		fmt.Sprintf(`{type="account"} %d`, load(&m.gcAccounts)),
+		fmt.Sprintf(`{type="activation"} %d`, load(&m.gcActivations)),
+		fmt.Sprintf(`{type="tombstone"} %d`, load(&m.gcTombstones)))
+	writeMetric(buf, "nats_connected", "gauge", "1 if the server is connected to NATS.",
+		fmt.Sprintf(" %d", atomic.LoadInt32(&m.natsConnected)))
+	if mirrorMode(server.currentConfig()) {
+		writeMetric(buf, "mirror_connected", "gauge", "1 if the server is connected to the NATS it mirrors notifications from.",
+			fmt.Sprintf(" %d", atomic.LoadInt32(&m.mirrorConnected)))
+		writeMetric(buf, "mirror_notifications_total", "counter", "Notifications received from the mirrored server, by result.",
+			fmt.Sprintf(`{result="received"} %d`, load(&m.mirrorReceived)),
+			fmt.Sprintf(`{result="looped"} %d`, load(&m.mirrorLooped)))
+		writeMetric(buf, "mirror_republished_total", "counter", "Mirrored notifications saved and sent on this server's NATS.",
+			fmt.Sprintf(" %d", load(&m.mirrorRepublished)))
+	}
+
+	activity := server.natsState.snapshot()
+	writeMetric(buf, "nats_publish_errors_total", "counter", "NATS publishes that returned an error.",
+		fmt.Sprintf(" %d", activity.PublishErrors))
+	if activity.LastPublish != nil {
+		writeMetric(buf, "nats_last_publish_timestamp_seconds", "gauge", "The time of the last successful NATS publish.",
+			fmt.Sprintf(" %d", activity.LastPublish.Unix()))
+	}
+	received := []string{}
+	for _, subject := range activity.receivedSubjects() {
+		received = append(received, fmt.Sprintf(`{subject=%q} %d`, subject, activity.Received[subject]))
+	}
+	writeMetric(buf, "nats_messages_received_total", "counter", "Messages received on each NATS subscription.", received...)
+
+	if threshold := server.currentConfig().LookupCounts.MetricThreshold; threshold > 0 {
+		writeMetric(buf, "account_lookups", "gauge", "Lookups for each account since the counts were reset, accounts under the threshold are added up as other.",
+			server.lookups.metricValues(uint64(threshold), time.Now())...)
+	}
+
+	if counter, ok := server.jwtStore.(store.JWTEvictionCounter); ok {
+		writeMetric(buf, "store_evictions_total", "counter", "JWTs evicted from the memory store to stay under its limits.",
+			fmt.Sprintf(" %d", counter.Evictions()))
+	}
+
+	if count, err := server.jwtCount(); err == nil {
+		writeMetric(buf, "store_jwts", "gauge", "JWTs in the store.", fmt.Sprintf(" %d", count))
+	} else {
+		logger.Errorf("unable to count JWTs for metrics, %s", err.Error())
+	}
+
+	w.Header().Set(ContentType, "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
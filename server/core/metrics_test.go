@@ -0,0 +1,156 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/store"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+
+	account := jwt.NewAccountClaims(pubKey)
+	acctJWT, err := account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	url := testEnv.URLForPath(fmt.Sprintf("/jwt/v1/accounts/%s", pubKey))
+	resp, err := testEnv.HTTP.Post(url, "application/json", bytes.NewBuffer([]byte(acctJWT)))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = testEnv.HTTP.Get(url)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	missingKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	missingPubKey, err := missingKey.PublicKey()
+	require.NoError(t, err)
+
+	resp, err = testEnv.HTTP.Get(testEnv.URLForPath(fmt.Sprintf("/jwt/v1/accounts/%s", missingPubKey)))
+	require.NoError(t, err)
+	require.NotEqual(t, http.StatusOK, resp.StatusCode)
+
+	testEnv.Server.handleAccountNotification(&nats.Msg{Data: []byte(acctJWT)})
+
+	resp, err = testEnv.HTTP.Get(testEnv.URLForPath("/metrics"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	metrics := string(body)
+
+	require.Contains(t, metrics, "# TYPE nats_account_server_jwt_lookups_total counter\n")
+	// the nats-server can look up accounts too, so only check that ours were counted
+	m := testEnv.Server.metrics
+	require.True(t, m.accountHits >= 1)
+	require.True(t, m.accountMisses >= 1)
+	require.Contains(t, metrics, fmt.Sprintf("nats_account_server_jwt_lookups_total{type=\"account\",result=\"hit\"} %d\n", m.accountHits))
+	require.Contains(t, metrics, fmt.Sprintf("nats_account_server_jwt_lookups_total{type=\"account\",result=\"miss\"} %d\n", m.accountMisses))
+	require.Contains(t, metrics, "nats_account_server_account_updates_total 1\n")
+	require.Contains(t, metrics, "nats_account_server_notifications_sent_total 1\n")
+	require.Contains(t, metrics, "nats_account_server_notifications_received_total 1\n")
+	require.Contains(t, metrics, "nats_account_server_store_errors_total 0\n")
+	require.Contains(t, metrics, "nats_account_server_nats_connected 1\n")
+	require.Contains(t, metrics, "nats_account_server_nats_publish_errors_total 0\n")
+	require.Contains(t, metrics, "# TYPE nats_account_server_nats_last_publish_timestamp_seconds gauge\n")
+	require.Contains(t, metrics, "# TYPE nats_account_server_nats_messages_received_total counter\n")
+	require.Contains(t, metrics, "nats_account_server_store_jwts 1\n")
+}
+
+func TestMetricsCountStoreErrors(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	testEnv.Server.jwtStore = store.NewErrJWTStore()
+
+	_, err = testEnv.Server.jwtCount()
+	require.Error(t, err)
+	require.Equal(t, uint64(1), testEnv.Server.metrics.storeErrors)
+
+	resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/metrics"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NotContains(t, string(body), "store_jwts")
+	require.Contains(t, string(body), "nats_account_server_nats_connected 0\n")
+}
+
+func TestMetricsCountMemoryStoreEvictions(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	config := testEnv.CreateReplicaConfig("")
+	config.NATS.Servers = nil
+	config.Store.Memory.MaxEntries = 1
+	replica := NewAccountServer()
+	replica.InitializeFromConfig(config)
+	require.NoError(t, replica.Start())
+	defer replica.Stop()
+
+	pubKeys := []string{}
+	for i := 0; i < 2; i++ {
+		accountKey, err := nkeys.CreateAccount()
+		require.NoError(t, err)
+		postNamedAccount(t, testEnv, accountKey, fmt.Sprintf("account %d", i))
+		pubKey, err := accountKey.PublicKey()
+		require.NoError(t, err)
+		pubKeys = append(pubKeys, pubKey)
+
+		resp, err := testEnv.HTTP.Get(fmt.Sprintf("http://localhost:%d/jwt/v1/accounts/%s", replica.port, pubKey))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// the evicted JWT isn't marked valid any more
+	replica.cacheLock.Lock()
+	_, first := replica.validUntil[pubKeys[0]]
+	_, second := replica.validUntil[pubKeys[1]]
+	replica.cacheLock.Unlock()
+	require.False(t, first)
+	require.True(t, second)
+
+	resp, err := testEnv.HTTP.Get(fmt.Sprintf("http://localhost:%d/metrics", replica.port))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), "nats_account_server_store_evictions_total 1\n")
+}
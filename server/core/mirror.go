@@ -0,0 +1,331 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/logging"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+// mirrorStatus is only sent by servers in mirror mode
+type mirrorStatus struct {
+	SubjectPrefix string `json:"subject_prefix"`
+	Connected     bool   `json:"connected"`
+	Received      uint64 `json:"received"`
+	Republished   uint64 `json:"republished"`
+	Looped        uint64 `json:"looped"`
+}
+
+// mirrorMode is true if the server follows another account server's notifications
+func mirrorMode(config *conf.AccountServerConfig) bool {
+	return len(config.Mirror.NATS.Servers) > 0
+}
+
+// mirrorPrefix is the other server's notification prefix, or $SYS.ACCOUNT
+func mirrorPrefix(config *conf.AccountServerConfig) string {
+	if prefix := config.Mirror.NATS.SubjectPrefix; prefix != "" {
+		return prefix
+	}
+	return defaultSubjectPrefix
+}
+
+func validateMirror(config *conf.AccountServerConfig) error {
+	if !mirrorMode(config) {
+		return nil
+	}
+
+	if len(config.Primary) > 0 {
+		return fmt.Errorf("mirror mode cannot be used by a replica")
+	}
+
+	if config.Relay.UpstreamSubjectPrefix != "" {
+		return fmt.Errorf("mirror mode cannot be used with relay mode")
+	}
+
+	if config.Store.ReadOnly || config.Store.NSC != "" {
+		return fmt.Errorf("mirror mode needs a writable store")
+	}
+
+	mirror := config.Mirror.NATS
+	if mirror.UserCredentials != "" && mirror.NKeySeedFile != "" {
+		return fmt.Errorf("mirror NATS user credentials and nkey seed file are mutually exclusive")
+	}
+
+	if mirror.Token != "" && (mirror.Username != "" || mirror.Password != "") {
+		return fmt.Errorf("mirror NATS token and username/password are mutually exclusive")
+	}
+
+	if _, err := normalizeNATSURLs(mirror.Servers); err != nil {
+		return fmt.Errorf("mirror %s", err.Error())
+	}
+	return nil
+}
+
+// connectToMirror connects to the other server's NATS and subscribes to its notifications. The
+// connection is separate from the one notifications are sent on, each reconnects on its own.
+// Lock should be held.
+func (server *AccountServer) connectToMirror() error {
+	if !server.running || !mirrorMode(server.config) {
+		return nil
+	}
+
+	config := server.config.Mirror.NATS
+	servers, err := normalizeNATSURLs(config.Servers)
+	if err != nil {
+		return err
+	}
+
+	name := connectionName(config) + " mirror"
+	if config.Name != "" {
+		name = config.Name
+	}
+	server.logger.Noticef("connecting to NATS to mirror notifications under %s as %q", mirrorPrefix(server.config), name)
+	server.logger.Debugf("mirror NATS configuration %+v", config.Redacted())
+
+	options := []nats.Option{nats.Name(name),
+		nats.MaxReconnects(config.MaxReconnects),
+		nats.ReconnectWait(time.Duration(config.ReconnectWait) * time.Millisecond),
+		nats.Timeout(time.Duration(config.ConnectTimeout) * time.Millisecond),
+		nats.ErrorHandler(server.mirrorError),
+		nats.DisconnectHandler(server.mirrorDisconnected),
+		nats.ReconnectHandler(server.mirrorReconnected),
+		nats.ClosedHandler(server.mirrorClosed),
+	}
+
+	if config.TLS.Cert != "" {
+		options = append(options, nats.ClientCert(config.TLS.Cert, config.TLS.Key))
+	}
+
+	authOptions, err := server.natsAuthOptions(config)
+	if err != nil {
+		return err
+	}
+	options = append(options, authOptions...)
+
+	nc, err := nats.Connect(strings.Join(servers, ","), options...)
+	if err != nil {
+		server.logger.Errorf("failed to connect to NATS for the mirror, %v", err)
+		server.scheduleMirrorReconnect()
+		return nil // we will retry, don't stop server running
+	}
+
+	prefix := mirrorPrefix(server.config)
+	handlers := map[string]nats.MsgHandler{
+		fmt.Sprintf(accountNotificationFormat, prefix, "*"):         server.handleMirrorAccount,
+		fmt.Sprintf(activationNotificationFormat, prefix, "*", "*"): server.handleMirrorActivation,
+		fmt.Sprintf(deleteNotificationFormat, prefix, "*"):          server.handleMirrorDelete,
+	}
+	for subject, handler := range handlers {
+		if _, err := nc.Subscribe(subject, server.natsState.counted(subject, handler)); err != nil {
+			nc.Close()
+			server.logger.Errorf("unable to subscribe to mirror notifications on %s, %s", subject, err.Error())
+			server.scheduleMirrorReconnect()
+			return nil
+		}
+	}
+
+	// notifications published once the mirror is connected aren't missed
+	flushTimeout := time.Duration(config.ConnectTimeout) * time.Millisecond
+	if flushTimeout <= 0 {
+		flushTimeout = nats.DefaultTimeout
+	}
+	if err := nc.FlushTimeout(flushTimeout); err != nil {
+		server.logger.Warnf("unable to flush the mirror subscriptions, %s", err.Error())
+	}
+
+	server.mirror = nc
+	server.mirrorBackoff = 0
+	atomic.StoreInt32(&server.metrics.mirrorConnected, 1)
+	server.logger.Noticef("mirroring notifications under %s", prefix)
+	return nil
+}
+
+// scheduleMirrorReconnect starts a timer that calls connectToMirror again, with the same backoff
+// as the NATS connection. Lock should be held.
+func (server *AccountServer) scheduleMirrorReconnect() {
+	config := server.config.Mirror.NATS
+	base := time.Duration(config.ReconnectWait) * time.Millisecond
+	max := time.Duration(config.MaxReconnectWait) * time.Millisecond
+
+	server.mirrorBackoff = nextBackoff(server.mirrorBackoff, base, max)
+	wait := jitter(server.mirrorBackoff, randomFraction())
+	server.logger.Errorf("will try to connect to NATS for the mirror again in %s", wait)
+
+	var timer *time.Timer
+	timer = time.AfterFunc(wait, func() {
+		server.Lock()
+		defer server.Unlock()
+
+		// Stop, or another schedule, replaced the timer after it fired
+		if server.mirrorTimer != timer {
+			return
+		}
+		server.mirrorTimer = nil
+
+		if server.running && server.mirror == nil {
+			server.connectToMirror()
+		}
+	})
+	server.mirrorTimer = timer
+}
+
+func (server *AccountServer) mirrorError(nc *nats.Conn, sub *nats.Subscription, err error) {
+	server.logger.Warnf("mirror nats error %s", err.Error())
+}
+
+func (server *AccountServer) mirrorDisconnected(nc *nats.Conn) {
+	if !server.checkRunning() {
+		return
+	}
+	atomic.StoreInt32(&server.metrics.mirrorConnected, 0)
+	server.logger.Warnf("mirror nats disconnected")
+}
+
+func (server *AccountServer) mirrorReconnected(nc *nats.Conn) {
+	atomic.StoreInt32(&server.metrics.mirrorConnected, 1)
+	server.logger.Warnf("mirror nats reconnected")
+}
+
+func (server *AccountServer) mirrorClosed(nc *nats.Conn) {
+	server.Lock()
+	defer server.Unlock()
+
+	if !server.running || server.mirror != nc {
+		return
+	}
+
+	server.logger.Errorf("mirror nats connection closed, notifications will be missed until it is re-established")
+	server.mirror = nil
+	atomic.StoreInt32(&server.metrics.mirrorConnected, 0)
+	server.scheduleMirrorReconnect()
+}
+
+// fromMirrorSelf drops, and counts, a notification we sent, it reached the other server's NATS
+// after we republished it. Anything else is counted as received.
+func (server *AccountServer) fromMirrorSelf(msg *nats.Msg) bool {
+	if server.fromSelf(msg) {
+		atomic.AddUint64(&server.metrics.mirrorLooped, 1)
+		return true
+	}
+	atomic.AddUint64(&server.metrics.mirrorReceived, 1)
+	return false
+}
+
+// handleMirrorAccount saves an account JWT from the other server and sends it on our NATS, the
+// JWT is only sent if it was saved so copies of a notification aren't sent twice
+func (server *AccountServer) handleMirrorAccount(msg *nats.Msg) {
+	if server.fromMirrorSelf(msg) {
+		return
+	}
+
+	claim := server.applyAccountNotification(msg)
+	if claim == nil {
+		return
+	}
+	server.mirrored(claim.Subject, server.sendAccountNotification(claim, msg.Data, nil))
+}
+
+func (server *AccountServer) handleMirrorDelete(msg *nats.Msg) {
+	if server.fromMirrorSelf(msg) {
+		return
+	}
+
+	pubKey := string(msg.Data)
+	if !nkeys.IsValidPublicAccountKey(pubKey) || msg.Subject != fmt.Sprintf(deleteNotificationFormat, mirrorPrefix(server.currentConfig()), pubKey) {
+		server.logger.WithFields(logging.Fields{"subject": msg.Subject}).Errorf("ignoring bad mirrored delete notification on %s", msg.Subject)
+		return
+	}
+
+	tombstone, saved := server.applyAccountDelete(pubKey, msg)
+	if !saved {
+		return
+	}
+	server.mirrored(pubKey, server.sendAccountDeleteNotification(tombstone, deleteClaimFromNotification(msg), nil))
+}
+
+func (server *AccountServer) handleMirrorActivation(msg *nats.Msg) {
+	if server.fromMirrorSelf(msg) {
+		return
+	}
+
+	hash := server.applyActivationNotification(msg)
+	if hash == "" {
+		return
+	}
+
+	// the account is the token before the hash, it is kept when the subject prefix changes
+	pattern := fmt.Sprintf(activationNotificationFormat, mirrorPrefix(server.currentConfig()), "*", hash)
+	account := lookupKeyFromSubject(pattern, msg.Subject)
+
+	if isActivationDelete(msg) {
+		server.mirrored(hash, server.sendActivationDeleteNotification(tombstoneFromNotification(hash, msg), account, deleteClaimFromNotification(msg), nil))
+		return
+	}
+	server.mirrored(hash, server.sendActivationNotification(hash, account, msg.Data, nil))
+}
+
+// mirrored counts a notification sent on our NATS, or logs the error sending it
+func (server *AccountServer) mirrored(key string, err error) {
+	if err != nil {
+		server.logger.WithFields(logging.Fields{"key": key, "error": err}).Errorf("unable to republish mirrored notification for %s, %s", ShortKey(key), err.Error())
+		return
+	}
+	atomic.AddUint64(&server.metrics.mirrorRepublished, 1)
+}
+
+// stopMirror closes the mirror connection, the closed handler sees the server is stopped.
+// The lock should not be held.
+func (server *AccountServer) stopMirror() {
+	server.Lock()
+	if server.mirrorTimer != nil {
+		server.mirrorTimer.Stop()
+		server.mirrorTimer = nil
+	}
+	server.mirrorBackoff = 0
+	nc := server.mirror
+	server.mirror = nil
+	server.Unlock()
+
+	if nc != nil {
+		server.logger.Noticef("draining mirror NATS connection")
+		server.drainNATS(nc)
+		atomic.StoreInt32(&server.metrics.mirrorConnected, 0)
+	}
+}
+
+// mirrorState is the mirror section of the status, nil unless the server is in mirror mode
+func (server *AccountServer) mirrorState(config *conf.AccountServerConfig) *mirrorStatus {
+	if !mirrorMode(config) {
+		return nil
+	}
+
+	m := server.metrics
+	return &mirrorStatus{
+		SubjectPrefix: mirrorPrefix(config),
+		Connected:     atomic.LoadInt32(&m.mirrorConnected) == 1,
+		Received:      atomic.LoadUint64(&m.mirrorReceived),
+		Republished:   atomic.LoadUint64(&m.mirrorRepublished),
+		Looped:        atomic.LoadUint64(&m.mirrorLooped),
+	}
+}
@@ -0,0 +1,249 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/store"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func createMirror(testEnv *TestSetup) (*AccountServer, error) {
+	config := testEnv.CreateReplicaConfig("")
+	config.Primary = nil
+	config.NATS.SubjectPrefix = "REGION.ACCOUNT"
+	config.Mirror.NATS = testEnv.Server.config.NATS
+	config.Mirror.NATS.SubjectPrefix = "CENTRAL.ACCOUNT"
+
+	mirror := NewAccountServer()
+	mirror.InitializeFromConfig(config)
+	return mirror, mirror.Start()
+}
+
+func waitForMirror(t *testing.T, mirror *AccountServer) {
+	for i := 0; i < 20; i++ {
+		if atomic.LoadInt32(&mirror.metrics.mirrorConnected) == 1 {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("mirror didn't connect")
+}
+
+func TestMirrorSavesAndRepublishes(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	mirror, err := createMirror(testEnv)
+	require.NoError(t, err)
+	defer mirror.Stop()
+	waitForMirror(t, mirror)
+
+	republished := make(chan *nats.Msg, 4)
+	_, err = testEnv.NC.Subscribe("REGION.ACCOUNT.>", func(m *nats.Msg) {
+		republished <- m
+	})
+	require.NoError(t, err)
+	testEnv.NC.Flush()
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+
+	acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	require.NoError(t, testEnv.NC.Publish(fmt.Sprintf(accountNotificationFormat, "CENTRAL.ACCOUNT", pubKey), []byte(acctJWT)))
+
+	select {
+	case m := <-republished:
+		require.Equal(t, fmt.Sprintf(accountNotificationFormat, "REGION.ACCOUNT", pubKey), m.Subject)
+		require.Equal(t, acctJWT, string(m.Data))
+	case <-time.After(2 * time.Second):
+		t.Fatal("notification not republished")
+	}
+
+	saved, err := mirror.jwtStore.Load(pubKey)
+	require.NoError(t, err)
+	require.Equal(t, acctJWT, saved)
+	require.Equal(t, uint64(1), atomic.LoadUint64(&mirror.metrics.mirrorRepublished))
+
+	// the same notification again is saved already, so it isn't sent twice
+	require.NoError(t, testEnv.NC.Publish(fmt.Sprintf(accountNotificationFormat, "CENTRAL.ACCOUNT", pubKey), []byte(acctJWT)))
+	testEnv.NC.Flush()
+	time.Sleep(200 * time.Millisecond)
+	select {
+	case m := <-republished:
+		t.Fatalf("duplicate notification republished on %s", m.Subject)
+	default:
+	}
+	require.Equal(t, uint64(2), atomic.LoadUint64(&mirror.metrics.mirrorReceived))
+
+	w := httptest.NewRecorder()
+	mirror.GetMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil), nil)
+	metrics := w.Body.String()
+	require.True(t, strings.Contains(metrics, "nats_account_server_mirror_connected 1"))
+	require.True(t, strings.Contains(metrics, "nats_account_server_mirror_republished_total 1"))
+}
+
+func TestMirrorDropsItsOwnNotifications(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	mirror, err := createMirror(testEnv)
+	require.NoError(t, err)
+	defer mirror.Stop()
+	waitForMirror(t, mirror)
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+
+	acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	msg := nats.NewMsg(fmt.Sprintf(accountNotificationFormat, "CENTRAL.ACCOUNT", pubKey))
+	msg.Header.Set(InstanceHeader, mirror.instanceID)
+	msg.Data = []byte(acctJWT)
+	require.NoError(t, testEnv.NC.PublishMsg(msg))
+	testEnv.NC.Flush()
+
+	for i := 0; i < 20; i++ {
+		if atomic.LoadUint64(&mirror.metrics.mirrorLooped) == 1 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	require.Equal(t, uint64(1), atomic.LoadUint64(&mirror.metrics.mirrorLooped))
+	require.Equal(t, uint64(0), atomic.LoadUint64(&mirror.metrics.mirrorReceived))
+
+	_, err = mirror.jwtStore.Load(pubKey)
+	require.Error(t, err)
+}
+
+func TestMirrorConfigValidation(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	require.NoError(t, validateMirror(config))
+
+	config.Mirror.NATS.Servers = []string{"nats://localhost:4222"}
+	require.NoError(t, validateMirror(config))
+	require.Equal(t, defaultSubjectPrefix, mirrorPrefix(config))
+
+	config.Primary = []string{"http://localhost:9090"}
+	require.Error(t, validateMirror(config))
+	config.Primary = nil
+
+	config.Relay.UpstreamSubjectPrefix = "ACCOUNTSERVER.RELAY"
+	require.Error(t, validateMirror(config))
+	config.Relay.UpstreamSubjectPrefix = ""
+
+	config.Store.ReadOnly = true
+	require.Error(t, validateMirror(config))
+	config.Store.ReadOnly = false
+
+	config.Mirror.NATS.Token = "secret"
+	config.Mirror.NATS.Username = "user"
+	require.Error(t, validateMirror(config))
+	config.Mirror.NATS.Username = ""
+
+	config.Mirror.NATS.Servers = []string{"nats://localhost:notaport"}
+	require.Error(t, validateMirror(config))
+}
+
+func TestMirrorRepublishesActivationDeleteClaims(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	mirror, err := createMirror(testEnv)
+	require.NoError(t, err)
+	defer mirror.Stop()
+	waitForMirror(t, mirror)
+
+	republished := make(chan *nats.Msg, 4)
+	_, err = testEnv.NC.Subscribe("REGION.ACCOUNT.>", func(m *nats.Msg) {
+		republished <- m
+	})
+	require.NoError(t, err)
+	testEnv.NC.Flush()
+
+	_, exporterPub, exporterKP := CreateAccountKey(t)
+	_, importerPub, _ := CreateAccountKey(t)
+	act := jwt.NewActivationClaims(importerPub)
+	act.ImportType = jwt.Stream
+	act.ImportSubject = "help"
+	actJWT, err := act.Encode(exporterKP)
+	require.NoError(t, err)
+	decoded, err := jwt.DecodeActivationClaims(actJWT)
+	require.NoError(t, err)
+	hash, err := decoded.HashID()
+	require.NoError(t, err)
+
+	subject := fmt.Sprintf(activationNotificationFormat, "CENTRAL.ACCOUNT", exporterPub, hash)
+	require.NoError(t, testEnv.NC.Publish(subject, []byte(actJWT)))
+
+	select {
+	case m := <-republished:
+		require.Equal(t, actJWT, string(m.Data))
+	case <-time.After(2 * time.Second):
+		t.Fatal("activation not republished")
+	}
+
+	// a delete without the claim isn't saved, so it isn't spread to the region
+	require.NoError(t, testEnv.NC.Publish(subject, []byte(hash)))
+	testEnv.NC.Flush()
+	time.Sleep(200 * time.Millisecond)
+	select {
+	case m := <-republished:
+		t.Fatalf("unauthorized delete republished on %s", m.Subject)
+	default:
+	}
+	_, err = mirror.loadStored(hash)
+	require.NoError(t, err)
+
+	auth := deleteAuthorization(t, exporterKP, hash)
+	msg := nats.NewMsg(subject)
+	msg.Data = []byte(hash)
+	msg.Header.Set(DeleteClaimHeader, auth)
+	require.NoError(t, testEnv.NC.PublishMsg(msg))
+
+	select {
+	case m := <-republished:
+		require.Equal(t, fmt.Sprintf(activationNotificationFormat, "REGION.ACCOUNT", exporterPub, hash), m.Subject)
+		require.Equal(t, hash, string(m.Data))
+		require.Equal(t, auth, m.Header.Get(DeleteClaimHeader))
+	case <-time.After(2 * time.Second):
+		t.Fatal("delete not republished")
+	}
+	_, err = mirror.loadStored(hash)
+	require.Equal(t, store.ErrDeleted, err)
+}
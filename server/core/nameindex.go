@@ -0,0 +1,109 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"sort"
+	"sync"
+)
+
+// accountNameIndex maps account names to public keys. Names aren't unique, so a name
+// can have more than one key, and an account that is renamed moves to its new name.
+type accountNameIndex struct {
+	sync.RWMutex
+	names map[string]string              // public key to name
+	keys  map[string]map[string]struct{} // name to public keys
+}
+
+func newAccountNameIndex() *accountNameIndex {
+	return &accountNameIndex{
+		names: map[string]string{},
+		keys:  map[string]map[string]struct{}{},
+	}
+}
+
+// set records the name for an account, replacing its old name, an empty name removes it
+func (idx *accountNameIndex) set(pubKey string, name string) {
+	idx.Lock()
+	defer idx.Unlock()
+
+	if old, ok := idx.names[pubKey]; ok {
+		if old == name {
+			return
+		}
+		idx.removeLocked(pubKey, old)
+	}
+
+	if name == "" {
+		return
+	}
+
+	idx.names[pubKey] = name
+	if idx.keys[name] == nil {
+		idx.keys[name] = map[string]struct{}{}
+	}
+	idx.keys[name][pubKey] = struct{}{}
+}
+
+// remove drops an account from the index
+func (idx *accountNameIndex) remove(pubKey string) {
+	idx.Lock()
+	defer idx.Unlock()
+
+	if old, ok := idx.names[pubKey]; ok {
+		idx.removeLocked(pubKey, old)
+	}
+}
+
+func (idx *accountNameIndex) removeLocked(pubKey string, name string) {
+	delete(idx.names, pubKey)
+	delete(idx.keys[name], pubKey)
+	if len(idx.keys[name]) == 0 {
+		delete(idx.keys, name)
+	}
+}
+
+// lookup returns the sorted public keys for accounts with the name
+func (idx *accountNameIndex) lookup(name string) []string {
+	idx.RLock()
+	defer idx.RUnlock()
+
+	found := make([]string, 0, len(idx.keys[name]))
+	for pubKey := range idx.keys[name] {
+		found = append(found, pubKey)
+	}
+	sort.Strings(found)
+	return found
+}
+
+// size returns the number of indexed accounts
+func (idx *accountNameIndex) size() int {
+	idx.RLock()
+	defer idx.RUnlock()
+	return len(idx.names)
+}
+
+// replace swaps in the contents of another index
+func (idx *accountNameIndex) replace(other *accountNameIndex) {
+	other.RLock()
+	names, keys := other.names, other.keys
+	other.RUnlock()
+
+	idx.Lock()
+	idx.names, idx.keys = names, keys
+	idx.Unlock()
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccountNameIndex(t *testing.T) {
+	idx := newAccountNameIndex()
+
+	idx.set("A", "one")
+	idx.set("B", "one")
+	idx.set("C", "two")
+	require.Equal(t, []string{"A", "B"}, idx.lookup("one"))
+	require.Equal(t, []string{"C"}, idx.lookup("two"))
+	require.Empty(t, idx.lookup("three"))
+
+	// a rename moves the key
+	idx.set("B", "two")
+	require.Equal(t, []string{"A"}, idx.lookup("one"))
+	require.Equal(t, []string{"B", "C"}, idx.lookup("two"))
+
+	idx.remove("A")
+	idx.remove("missing")
+	require.Empty(t, idx.lookup("one"))
+
+	// no name, no entry
+	idx.set("C", "")
+	require.Equal(t, []string{"B"}, idx.lookup("two"))
+	require.Equal(t, 1, idx.size())
+}
+
+func postNamedAccount(t *testing.T, testEnv *TestSetup, accountKey nkeys.KeyPair, name string) string {
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+
+	account := jwt.NewAccountClaims(pubKey)
+	account.Name = name
+	acctJWT, err := account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	resp, err := testEnv.HTTP.Post(testEnv.URLForPath("/jwt/v1/accounts/"+pubKey), "application/json", bytes.NewBuffer([]byte(acctJWT)))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	return acctJWT
+}
+
+func getAccountByName(t *testing.T, testEnv *TestSetup, name string) (*http.Response, string) {
+	resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/accounts?name=" + url.QueryEscape(name)))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func TestGetAccountByName(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	keys := []nkeys.KeyPair{}
+	pubKeys := []string{}
+	for i := 0; i < 2; i++ {
+		accountKey, err := nkeys.CreateAccount()
+		require.NoError(t, err)
+		pubKey, err := accountKey.PublicKey()
+		require.NoError(t, err)
+		keys = append(keys, accountKey)
+		pubKeys = append(pubKeys, pubKey)
+	}
+
+	firstJWT := postNamedAccount(t, testEnv, keys[0], "billing team")
+
+	resp, body := getAccountByName(t, testEnv, "billing team")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, ApplicationJWT, resp.Header.Get(ContentType))
+	require.Equal(t, firstJWT, body)
+
+	resp, _ = getAccountByName(t, testEnv, "nobody")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// two accounts with the same name get a list
+	postNamedAccount(t, testEnv, keys[1], "billing team")
+	resp, body = getAccountByName(t, testEnv, "billing team")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, ApplicationJSON, resp.Header.Get(ContentType))
+
+	var matches []accountName
+	require.NoError(t, json.Unmarshal([]byte(body), &matches))
+	require.Len(t, matches, 2)
+	for _, m := range matches {
+		require.Contains(t, pubKeys, m.PubKey)
+		require.Equal(t, "billing team", m.Name)
+	}
+
+	// renaming one leaves a single match
+	renamedJWT := postNamedAccount(t, testEnv, keys[1], "payments")
+	resp, body = getAccountByName(t, testEnv, "billing team")
+	require.Equal(t, ApplicationJWT, resp.Header.Get(ContentType))
+	require.Equal(t, firstJWT, body)
+
+	resp, body = getAccountByName(t, testEnv, "payments")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, renamedJWT, body)
+
+	// deleted accounts aren't found
+	auth := deleteAuthorization(t, testEnv.OperatorKey, pubKeys[0])
+	resp, err = testEnv.HTTP.Do(deleteRequest(t, testEnv.URLForPath("/jwt/v1/accounts/"+pubKeys[0]), auth))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, _ = getAccountByName(t, testEnv, "billing team")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
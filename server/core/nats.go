@@ -17,43 +17,240 @@
 package core
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/logging"
+	"github.com/nats-io/nats-account-server/server/store"
 	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
 )
 
 const (
-	accountNotificationFormat    = "$SYS.ACCOUNT.%s.CLAIMS.UPDATE"
-	activationNotificationFormat = "$SYS.ACCOUNT.%s.CLAIMS.ACTIVATE.%s"
+	// the nats-server listens for account updates under the default prefix
+	defaultSubjectPrefix = "$SYS.ACCOUNT"
+
+	// notification formats take the subject prefix first
+	accountNotificationFormat    = "%s.%s.CLAIMS.UPDATE"
+	activationNotificationFormat = "%s.%s.CLAIMS.ACTIVATE.%s"
+	deleteNotificationFormat     = "%s.%s.CLAIMS.DELETE"
+
+	// defaultQueueGroup is used by primaries, replicas add a hash of the primary URL
+	defaultQueueGroup = "nats-account-server"
 )
 
+// subjectPrefix returns the configured prefix for notification subjects, or $SYS.ACCOUNT
+func subjectPrefix(config *conf.AccountServerConfig) string {
+	if prefix := config.NATS.SubjectPrefix; prefix != "" {
+		return prefix
+	}
+	return defaultSubjectPrefix
+}
+
+func (server *AccountServer) accountNotificationSubject(pubKey string) string {
+	return fmt.Sprintf(accountNotificationFormat, subjectPrefix(server.currentConfig()), pubKey)
+}
+
+func (server *AccountServer) activationNotificationSubject(account string, hash string) string {
+	return fmt.Sprintf(activationNotificationFormat, subjectPrefix(server.currentConfig()), account, hash)
+}
+
+func (server *AccountServer) deleteNotificationSubject(pubKey string) string {
+	return fmt.Sprintf(deleteNotificationFormat, subjectPrefix(server.currentConfig()), pubKey)
+}
+
+// subscribeToNotifications replaces any existing notification subscriptions with ones for the
+// current subject prefix, replicas use them to keep up with the primary. Lock should be held.
+func (server *AccountServer) subscribeToNotifications(nc *nats.Conn) error {
+	for _, sub := range server.notificationSubs {
+		sub.Unsubscribe()
+	}
+	server.notificationSubs = nil
+
+	if server.primary == "" {
+		return nil
+	}
+
+	prefix := subjectPrefix(server.config)
+	if consumer := server.config.NATS.JetStream.Consumer; consumer != "" {
+		sub, err := server.consumeNotifications(nc, prefix)
+		if err == nil {
+			server.notificationSubs = append(server.notificationSubs, sub)
+			server.logger.Noticef("reading notifications under %s from JetStream consumer %s", prefix, consumer)
+			return server.subscribeToGossip(nc)
+		}
+		server.logger.Warnf("unable to read notifications from JetStream consumer %s, subscribing with core NATS, %s", consumer, err.Error())
+	}
+
+	handlers := map[string]nats.MsgHandler{
+		fmt.Sprintf(accountNotificationFormat, prefix, "*"):         server.handleAccountNotification,
+		fmt.Sprintf(activationNotificationFormat, prefix, "*", "*"): server.handleActivationNotification,
+		fmt.Sprintf(deleteNotificationFormat, prefix, "*"):          server.handleAccountDeleteNotification,
+	}
+
+	for subject, handler := range handlers {
+		sub, err := nc.Subscribe(subject, server.natsState.counted(subject, handler))
+		if err != nil {
+			return err
+		}
+		server.notificationSubs = append(server.notificationSubs, sub)
+	}
+
+	server.logger.Noticef("listening for notifications under %s", prefix)
+	return server.subscribeToGossip(nc)
+}
+
+// queueGroup returns the queue group for request/reply subscriptions. Unless one is configured,
+// replicas use a group named for their primary so replicas of different primaries don't share
+// a queue. Lock should be held.
+func (server *AccountServer) queueGroup() string {
+	if group := server.config.NATS.QueueGroup; group != "" {
+		return group
+	}
+
+	if server.primary == "" {
+		return defaultQueueGroup
+	}
+
+	sum := sha256.Sum256([]byte(strings.TrimSuffix(server.primary, "/")))
+	return fmt.Sprintf("%s.%s", defaultQueueGroup, hex.EncodeToString(sum[:4]))
+}
+
+// subscribeToRequests replaces any request/reply subscriptions, these use a queue group so
+// only one server answers each request. Notifications are broadcast and use subscribeToNotifications.
+// Lock should be held.
+func (server *AccountServer) subscribeToRequests(nc *nats.Conn) {
+	for _, sub := range server.requestSubs {
+		sub.Unsubscribe()
+	}
+	server.requestSubs = nil
+
+	group := server.queueGroup()
+	lookupSubject := server.config.NATS.LookupSubject
+
+	if lookupSubject != "" {
+		if sub, err := nc.QueueSubscribe(lookupSubject, group, server.natsState.counted(lookupSubject, server.handleLookupRequest)); err != nil {
+			server.logger.Errorf("unable to subscribe to lookup requests on %s, %s", lookupSubject, err.Error())
+		} else {
+			server.requestSubs = append(server.requestSubs, sub)
+			server.logger.Noticef("answering account lookup requests on %s in queue group %s", lookupSubject, group)
+		}
+	}
+
+	if relayPrefix := server.config.NATS.RelaySubjectPrefix; relayPrefix != "" {
+		relaySubject := relayPrefix + ".>"
+		if sub, err := nc.QueueSubscribe(relaySubject, group, server.natsState.counted(relaySubject, server.handleRelayRequest)); err != nil {
+			server.logger.Errorf("unable to subscribe to relay requests on %s, %s", relaySubject, err.Error())
+		} else {
+			server.requestSubs = append(server.requestSubs, sub)
+			server.logger.Noticef("answering relay lookups on %s in queue group %s", relaySubject, group)
+		}
+	}
+
+	if packSubject := server.config.NATS.PackSubject; packSubject != "" {
+		if sub, err := nc.QueueSubscribe(packSubject, group, server.natsState.counted(packSubject, server.handlePackRequest)); err != nil {
+			server.logger.Errorf("unable to subscribe to pack requests on %s, %s", packSubject, err.Error())
+		} else {
+			server.requestSubs = append(server.requestSubs, sub)
+			server.logger.Noticef("answering pack requests on %s in queue group %s", packSubject, group)
+		}
+	}
+}
+
 func (server *AccountServer) natsError(nc *nats.Conn, sub *nats.Subscription, err error) {
+	server.natsState.asyncError(err)
 	server.logger.Warnf("nats error %s", err.Error())
 }
 
 func (server *AccountServer) natsDisconnected(nc *nats.Conn) {
-	if !server.checkRunning() {
+	// a connection replaced after a lame duck announcement is drained and closed
+	if !server.checkRunning() || server.getNatsConnection() != nc {
 		return
 	}
+	server.metrics.setNATSConnected(false)
+	server.natsState.setState(natsStateReconnecting)
 	server.logger.Warnf("nats disconnected")
 }
 
 func (server *AccountServer) natsReconnected(nc *nats.Conn) {
+	if server.getNatsConnection() != nc {
+		return
+	}
+	atomic.AddUint64(&server.metrics.natsReconnects, 1)
+	server.metrics.setNATSConnected(true)
+	server.natsState.setState(natsStateConnected)
 	server.logger.Warnf("nats reconnected")
+	go server.flushNotifications(nc)
 }
 
 func (server *AccountServer) natsClosed(nc *nats.Conn) {
-	if server.checkRunning() {
+	// a connection replaced by a new one is closed on purpose
+	if !server.checkRunning() || server.getNatsConnection() != nc {
+		return
+	}
+
+	if server.currentConfig().NATS.ExitOnClose {
 		server.logger.Errorf("nats connection closed, shutting down bridge")
-		go func() {
-			server.Stop()
-			os.Exit(-1)
-		}()
+		go server.stop(fmt.Errorf("nats connection closed"))
+		return
+	}
+
+	server.Lock()
+	defer server.Unlock()
+
+	if !server.running || server.nats != nc {
+		return
 	}
+
+	server.logger.Errorf("nats connection closed, notifications will be skipped until it is re-established")
+	server.nats = nil
+	server.metrics.setNATSConnected(false)
+	server.natsState.setState(natsStateClosed)
+	server.scheduleNATSReconnect()
+}
+
+// natsLameDuck moves to another server as soon as the one we are connected to announces it is
+// going away, instead of waiting for it to close the connection. The new connection is made
+// first, if no other server takes it the lame duck server is used until it closes the connection.
+func (server *AccountServer) natsLameDuck(nc *nats.Conn) {
+	server.Lock()
+
+	if !server.running || server.nats != nc {
+		server.Unlock()
+		return
+	}
+
+	atomic.AddUint64(&server.metrics.natsLameDucks, 1)
+	server.logger.Noticef("nats server %s is entering lame duck mode, connecting to another server", nc.ConnectedServerId())
+
+	if !server.replaceNATS(nc) {
+		server.Unlock()
+		server.logger.Warnf("no other nats server is available, staying on %s until it closes the connection", nc.ConnectedServerId())
+		return
+	}
+
+	replacement := server.nats.ConnectedServerId()
+	server.Unlock()
+
+	server.logger.Noticef("moved to nats server %s, draining the connection to %s", replacement, nc.ConnectedServerId())
+
+	// this runs on the connection's callback goroutine, which the drain shouldn't hold up
+	go server.drainNATS(nc)
 }
 
 func (server *AccountServer) natsDiscoveredServers(nc *nats.Conn) {
@@ -61,6 +258,70 @@ func (server *AccountServer) natsDiscoveredServers(nc *nats.Conn) {
 	server.logger.Debugf("known servers: %v\n", nc.Servers())
 }
 
+// loadNKeySeed reads a user seed from a file, the file can contain the bare seed
+// or the decorated format produced by nsc
+func loadNKeySeed(seedFile string) (nkeys.KeyPair, error) {
+	data, err := ioutil.ReadFile(seedFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading nkey seed file: %v", err)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if bytes.HasPrefix(line, []byte("SU")) {
+			kp, err := nkeys.FromSeed(line)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing nkey seed file: %v", err)
+			}
+			return kp, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no user nkey seed found in %s", seedFile)
+}
+
+// nkeyOption creates the nats option for nkey authentication, the seed file is
+// read again each time the server asks for a signature so that rotated seeds
+// are picked up on reconnect. The public key is part of the option, so a seed
+// for a new key replaces the connection with one that presents it.
+func (server *AccountServer) nkeyOption(seedFile string) (nats.Option, error) {
+	kp, err := loadNKeySeed(seedFile)
+	if err != nil {
+		return nil, err
+	}
+	defer kp.Wipe()
+
+	pubKey, err := kp.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+
+	// set while the connection is replaced, so each attempt to sign doesn't start another
+	var rotating int32
+
+	sigCB := func(nonce []byte) ([]byte, error) {
+		kp, err := loadNKeySeed(seedFile)
+		if err != nil {
+			server.logger.Errorf("unable to sign nonce for NATS, %s", err.Error())
+			return nil, err
+		}
+		defer kp.Wipe()
+
+		if current, err := kp.PublicKey(); err == nil && current != pubKey && atomic.CompareAndSwapInt32(&rotating, 0, 1) {
+			// the callback can run with the server lock held, by the first connect
+			go func() {
+				defer atomic.StoreInt32(&rotating, 0)
+				server.reconnectNATS(fmt.Sprintf("the nkey seed file contains a new public key %s", ShortKey(current)))
+			}()
+		}
+
+		return kp.Sign(nonce)
+	}
+
+	return nats.Nkey(pubKey, sigCB), nil
+}
+
 // assumes the lock is held by the caller
 func (server *AccountServer) connectToNATS() error {
 	if !server.running {
@@ -74,64 +335,382 @@ func (server *AccountServer) connectToNATS() error {
 		return nil
 	}
 
-	server.logger.Noticef("connecting to NATS for notifications")
+	if config.UserCredentials != "" && config.NKeySeedFile != "" {
+		return fmt.Errorf("NATS user credentials and nkey seed file are mutually exclusive")
+	}
+
+	if config.Token != "" && (config.Username != "" || config.Password != "") {
+		return fmt.Errorf("NATS token and username/password are mutually exclusive")
+	}
+
+	servers, err := normalizeNATSURLs(config.Servers)
+	if err != nil {
+		return err
+	}
 
-	options := []nats.Option{nats.MaxReconnects(config.MaxReconnects),
+	if config.InboxPrefix != "" && !validInboxPrefix(config.InboxPrefix) {
+		return fmt.Errorf("NATS inbox prefix %q can't contain wildcards or end with a '.'", config.InboxPrefix)
+	}
+
+	if _, err := streamConfig(config.JetStream, subjectPrefix(server.config)); err != nil {
+		return err
+	}
+
+	name := connectionName(config)
+	if config.InboxPrefix != "" {
+		server.logger.Noticef("connecting to NATS for notifications as %q, with inbox prefix %s", name, config.InboxPrefix)
+	} else {
+		server.logger.Noticef("connecting to NATS for notifications as %q", name)
+	}
+	server.logger.Debugf("NATS configuration %+v", config.Redacted())
+
+	options := []nats.Option{nats.Name(name),
+		nats.MaxReconnects(config.MaxReconnects),
 		nats.ReconnectWait(time.Duration(config.ReconnectWait) * time.Millisecond),
 		nats.Timeout(time.Duration(config.ConnectTimeout) * time.Millisecond),
+		nats.DrainTimeout(time.Duration(config.DrainTimeout) * time.Millisecond),
 		nats.ErrorHandler(server.natsError),
 		nats.DiscoveredServersHandler(server.natsDiscoveredServers),
 		nats.DisconnectHandler(server.natsDisconnected),
 		nats.ReconnectHandler(server.natsReconnected),
 		nats.ClosedHandler(server.natsClosed),
+		nats.LameDuckModeHandler(server.natsLameDuck),
 	}
 
-	if config.TLS.Root != "" {
-		options = append(options, nats.RootCAs(config.TLS.Root))
+	if config.InboxPrefix != "" {
+		options = append(options, nats.CustomInboxPrefix(config.InboxPrefix))
 	}
 
 	if config.TLS.Cert != "" {
-		options = append(options, nats.ClientCert(config.TLS.Cert, config.TLS.Key))
+		// the loader is kept between connections, the watcher loads a rotated certificate into it
+		if server.natsCert == nil {
+			loader, err := newCertificateLoader(config.TLS.Cert, config.TLS.Key, server.logger)
+			if err != nil {
+				server.logger.Errorf("failed to connect to NATS, %v", err)
+				server.natsState.setState(natsStateDisconnected)
+				server.scheduleNATSReconnect()
+				return nil
+			}
+			server.natsCert = loader
+		}
+		options = append(options, natsClientCert(server.natsCert))
 	}
 
-	if config.UserCredentials != "" {
-		options = append(options, nats.UserCredentials(config.UserCredentials))
+	authOptions, err := server.natsAuthOptions(config)
+	if err != nil {
+		return err
 	}
+	options = append(options, authOptions...)
 
-	nc, err := nats.Connect(strings.Join(config.Servers, ","),
+	nc, err := nats.Connect(strings.Join(servers, ","),
 		options...,
 	)
 
 	if err != nil {
-		reconnectWait := config.ReconnectWait
 		server.logger.Errorf("failed to connect to NATS, %v", err)
-		server.logger.Errorf("will try to connect again in %d milliseconds", reconnectWait)
-		server.natsTimer = time.NewTimer(time.Duration(reconnectWait) * time.Millisecond)
-		go func() {
-			<-server.natsTimer.C
-
-			server.natsTimer = nil
-			if server.checkRunning() {
-				server.Lock()
-				server.connectToNATS()
-				server.Unlock()
-			}
-		}()
+		server.natsState.setState(natsStateDisconnected)
+		server.scheduleNATSReconnect()
 		return nil // we will retry, don't stop server running
 	}
 
-	if server.primary != "" {
-		subject := strings.Replace(accountNotificationFormat, "%s", "*", -1)
-		nc.Subscribe(subject, server.handleAccountNotification)
+	server.setupJetStream(nc)
 
-		subject = strings.Replace(activationNotificationFormat, "%s", "*", -1)
-		nc.Subscribe(subject, server.handleActivationNotification)
+	if err := server.subscribeToNotifications(nc); err != nil {
+		server.logger.Errorf("unable to subscribe to notifications, %s", err.Error())
+	}
+
+	server.subscribeToRequests(nc)
+
+	// the nats-server has the subscriptions before Start returns, so a request sent right away finds them
+	flushTimeout := time.Duration(config.ConnectTimeout) * time.Millisecond
+	if flushTimeout <= 0 {
+		flushTimeout = nats.DefaultTimeout
+	}
+	if err := nc.FlushTimeout(flushTimeout); err != nil {
+		server.logger.Warnf("unable to flush the NATS subscriptions, %s", err.Error())
 	}
 
 	server.nats = nc
+	server.natsBackoff = 0
+	server.metrics.setNATSConnected(true)
+	server.natsState.setState(natsStateConnected)
+	go server.flushNotifications(nc)
 	return nil
 }
 
+// natsAuthOptions returns the options for the CA and credentials in config, the client
+// certificate is left to the caller
+func (server *AccountServer) natsAuthOptions(config conf.NATSConfig) ([]nats.Option, error) {
+	options := []nats.Option{}
+
+	if config.TLS.Root != "" {
+		options = append(options, nats.RootCAs(config.TLS.Root))
+	}
+
+	if config.UserCredentials != "" {
+		options = append(options, nats.UserCredentials(config.UserCredentials))
+	}
+
+	if config.Username != "" || config.Password != "" {
+		options = append(options, nats.UserInfo(config.Username, config.Password))
+	}
+
+	if config.Token != "" {
+		options = append(options, nats.Token(config.Token))
+	}
+
+	if config.NKeySeedFile != "" {
+		nkeyOpt, err := server.nkeyOption(config.NKeySeedFile)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, nkeyOpt)
+	}
+	return options, nil
+}
+
+// connectionName is the configured name, or one with the version and host so the
+// account server stands out in the nats-server's connection list
+func connectionName(config conf.NATSConfig) string {
+	if config.Name != "" {
+		return config.Name
+	}
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return fmt.Sprintf("nats-account-server %s", version)
+	}
+	return fmt.Sprintf("nats-account-server %s %s", version, host)
+}
+
+// defaultNATSPort is used for nats and tls URLs without a port, nats.go picks 80 and 443 for ws and wss
+const defaultNATSPort = "4222"
+
+// normalizeNATSURLs parses each server, entries can hold a comma separated list, and returns them
+// with a scheme, a port and IPv6 hosts in brackets, so a typo fails Start instead of every connect.
+// nats.go can't mix websocket URLs with the others.
+func normalizeNATSURLs(servers []string) ([]string, error) {
+	normalized := []string{}
+	websocket, other := 0, 0
+
+	for _, entry := range servers {
+		for _, server := range strings.Split(entry, ",") {
+			server = strings.TrimSpace(server)
+			if server == "" {
+				continue
+			}
+
+			u, err := normalizeNATSURL(server)
+			if err != nil {
+				return nil, fmt.Errorf("NATS server URL %q %s", redactNATSURL(server), err.Error())
+			}
+
+			if u.Scheme == "ws" || u.Scheme == "wss" {
+				websocket++
+			} else {
+				other++
+			}
+			normalized = append(normalized, u.String())
+		}
+	}
+
+	if websocket > 0 && other > 0 {
+		return nil, fmt.Errorf("NATS server URLs can't mix websocket, ws or wss, and nats or tls schemes")
+	}
+	return normalized, nil
+}
+
+// normalizeNATSURL parses one server URL, the error says what is wrong with it
+func normalizeNATSURL(server string) (*url.URL, error) {
+	// nats.go treats a URL without a scheme as nats://, a bare IPv6 address is the host
+	if !strings.Contains(server, "://") {
+		if strings.Count(server, ":") > 1 && !strings.Contains(server, "[") {
+			if net.ParseIP(server) == nil {
+				return nil, fmt.Errorf("is invalid, put IPv6 addresses in brackets, like [2001:db8::1]:4222")
+			}
+			server = "[" + server + "]"
+		}
+		server = "nats://" + server
+	}
+
+	u, err := url.Parse(server)
+	if err != nil {
+		// url.Error repeats the URL, credentials and all
+		if uerr, ok := err.(*url.Error); ok {
+			err = uerr.Err
+		}
+		return nil, fmt.Errorf("is invalid, %s", err.Error())
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	port := u.Port()
+	switch u.Scheme {
+	case "nats", "tls":
+		if port == "" {
+			port = defaultNATSPort
+		}
+	case "ws", "wss":
+	default:
+		return nil, fmt.Errorf("has unsupported scheme %q, use nats, tls, ws or wss", u.Scheme)
+	}
+
+	host := u.Hostname()
+	if host == "" {
+		return nil, fmt.Errorf("has no host")
+	}
+	if strings.Contains(host, ":") && net.ParseIP(strings.SplitN(host, "%", 2)[0]) == nil {
+		return nil, fmt.Errorf("has an invalid IPv6 address %q", host)
+	}
+
+	if port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return nil, fmt.Errorf("has an invalid port %q", port)
+		}
+		u.Host = net.JoinHostPort(host, port)
+	}
+
+	if u.Path != "" && u.Path != "/" {
+		return nil, fmt.Errorf("has a path, %s, NATS URLs are only a host and port", u.Path)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("has a query or fragment, NATS URLs are only a host and port")
+	}
+	u.Path = ""
+	u.RawPath = ""
+
+	return u, nil
+}
+
+// redactNATSURL hides the credentials in a server URL for errors, even one that doesn't parse.
+// The user is hidden too, NATS URLs can carry a token there.
+func redactNATSURL(server string) string {
+	const hidden = "xxxxx"
+
+	if u, err := url.Parse(server); err == nil {
+		if u.User != nil {
+			u.User = url.User(hidden)
+		}
+		return u.String()
+	}
+
+	scheme := strings.Index(server, "://")
+	if at := strings.LastIndex(server, "@"); scheme >= 0 && at > scheme {
+		return server[:scheme+len("://")] + hidden + server[at:]
+	}
+	return server
+}
+
+// replaceNATS connects again and returns true once the new connection is the server's, the caller
+// drains nc. If the connect fails nc is kept. Lock should be held.
+func (server *AccountServer) replaceNATS(nc *nats.Conn) bool {
+	server.nats = nil
+	server.connectToNATS()
+
+	if server.nats == nil {
+		// connectToNATS scheduled a retry, the current connection still works
+		if server.natsTimer != nil {
+			server.natsTimer.Stop()
+			server.natsTimer = nil
+		}
+		server.natsBackoff = 0
+		server.nats = nc
+		return false
+	}
+	return true
+}
+
+// validInboxPrefix rejects prefixes that aren't usable as a subject, so a bad prefix fails Start instead of every connect
+func validInboxPrefix(prefix string) bool {
+	return !strings.ContainsAny(prefix, "*> ") && !strings.HasSuffix(prefix, ".") && !strings.HasPrefix(prefix, ".")
+}
+
+// scheduleNATSReconnect starts a timer that calls connectToNATS again, assumes the lock is held by the caller.
+// The wait doubles after each attempt, up to the max reconnect wait, with jitter so servers that lost
+// NATS together don't reconnect together.
+func (server *AccountServer) scheduleNATSReconnect() {
+	config := server.config.NATS
+	base := time.Duration(config.ReconnectWait) * time.Millisecond
+	max := time.Duration(config.MaxReconnectWait) * time.Millisecond
+
+	server.natsBackoff = nextBackoff(server.natsBackoff, base, max)
+	wait := jitter(server.natsBackoff, randomFraction())
+	server.logger.Errorf("will try to connect again in %s", wait)
+
+	var timer *time.Timer
+	timer = time.AfterFunc(wait, func() {
+		server.Lock()
+		defer server.Unlock()
+
+		// Stop, or another schedule, replaced the timer after it fired
+		if server.natsTimer != timer {
+			return
+		}
+		server.natsTimer = nil
+
+		if server.running && server.nats == nil {
+			server.connectToNATS()
+		}
+	})
+	server.natsTimer = timer
+}
+
+// nextBackoff doubles the current wait, starting at base and capped at max, a max
+// below base keeps the wait at base
+func nextBackoff(current time.Duration, base time.Duration, max time.Duration) time.Duration {
+	if max < base {
+		max = base
+	}
+
+	next := 2 * current
+	if current == 0 {
+		next = base
+	}
+
+	if next > max {
+		next = max
+	}
+	return next
+}
+
+// the jitter source is seeded per process, so servers started together don't share a sequence
+var (
+	jitterLock sync.Mutex
+	jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+func randomFraction() float64 {
+	jitterLock.Lock()
+	defer jitterLock.Unlock()
+	return jitterRand.Float64()
+}
+
+// jitter moves d up to 20% either way, r is a random number in [0, 1)
+func jitter(d time.Duration, r float64) time.Duration {
+	return time.Duration(float64(d) * (0.8 + 0.4*r))
+}
+
+// drainNATS lets pending messages and notifications published by in-flight requests reach
+// NATS before the connection is closed. The closed handler takes the lock, so the caller
+// must not hold it.
+func (server *AccountServer) drainNATS(nc *nats.Conn) {
+	if err := nc.Drain(); err != nil {
+		server.logger.Errorf("unable to drain NATS connection, %s", err.Error())
+		nc.Close()
+		return
+	}
+
+	// subscriptions get the drain timeout, then pending publishes are flushed
+	drainTimeout := time.Duration(server.currentConfig().NATS.DrainTimeout) * time.Millisecond
+	deadline := time.Now().Add(2*drainTimeout + time.Second)
+	for !nc.IsClosed() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if !nc.IsClosed() {
+		server.logger.Warnf("NATS connection did not drain in time, closing it")
+		nc.Close()
+	}
+}
+
 func (server *AccountServer) getNatsConnection() *nats.Conn {
 	server.Lock()
 	defer server.Unlock()
@@ -139,72 +718,392 @@ func (server *AccountServer) getNatsConnection() *nats.Conn {
 	return conn
 }
 
-func (server *AccountServer) sendAccountNotification(claim *jwt.AccountClaims, theJWT []byte) error {
+// sendAccountNotification publishes the JWT for an account, or queues it if NATS is down. The
+// trace headers of the request that changed the account go with it, nil outside of requests.
+func (server *AccountServer) sendAccountNotification(claim *jwt.AccountClaims, theJWT []byte, trace nats.Header) error {
 	pubKey := claim.Subject
+	logger := server.logger.WithFields(logging.Fields{"account": pubKey, "jti": claim.ID})
 
-	if server.nats == nil {
-		server.logger.Noticef("skipping notification for %s, no NATS configured", ShortKey(pubKey))
+	nc := server.getNatsConnection()
+	if nc == nil {
+		if server.queueAccountNotification(pubKey, theJWT, trace) {
+			logger.Noticef("queued notification for %s, no NATS connection", ShortKey(pubKey))
+		} else {
+			logger.Noticef("skipping notification for %s, no NATS connection", ShortKey(pubKey))
+		}
 		return nil
 	}
 
-	subject := fmt.Sprintf(accountNotificationFormat, pubKey)
-	return server.nats.Publish(subject, theJWT)
+	subject := server.accountNotificationSubject(pubKey)
+	if err := server.publishJWT(nc, subject, theJWT, trace); err != nil {
+		if server.queueAccountNotification(pubKey, theJWT, trace) {
+			logger.WithFields(logging.Fields{"subject": subject, "error": err}).Warnf("queued notification for %s, %s", ShortKey(pubKey), err.Error())
+			return nil
+		}
+		return err
+	}
+
+	// an older JWT still in the queue would undo this one
+	server.pendingNotifications.remove(pubKey)
+	atomic.AddUint64(&server.metrics.notificationsSent, 1)
+	return nil
+}
+
+// oversizedNotification drops, and counts, notifications with a JWT over the size limit
+func (server *AccountServer) oversizedNotification(msg *nats.Msg) bool {
+	limit := server.currentConfig().MaxJWTSize
+	if limit <= 0 || len(msg.Data) <= limit {
+		return false
+	}
+
+	atomic.AddUint64(&server.metrics.notificationsOversized, 1)
+	server.logger.WithFields(logging.Fields{"subject": msg.Subject, "size": len(msg.Data)}).Warnf("dropped a %d byte notification on %s, %s", len(msg.Data), msg.Subject, jwtTooLargeError{limit: limit}.Error())
+	return true
 }
 
 func (server *AccountServer) handleAccountNotification(msg *nats.Msg) {
+	if server.fromSelf(msg) {
+		return
+	}
+	atomic.AddUint64(&server.metrics.notificationsReceived, 1)
+	server.applyAccountNotification(msg)
+}
+
+// applyAccountNotification checks and saves the account JWT in a notification, the claim is
+// returned if it was saved
+func (server *AccountServer) applyAccountNotification(msg *nats.Msg) *jwt.AccountClaims {
+	if server.oversizedNotification(msg) {
+		return nil
+	}
 	jwtBytes := msg.Data
 	theJWT := string(jwtBytes)
 	claim, err := jwt.DecodeAccountClaims(theJWT)
 
 	if err != nil || claim == nil {
-		return
+		return nil
 	}
 
 	pubKey := claim.Subject
-	err = server.jwtStore.Save(pubKey, theJWT)
-	if err != nil {
+	logger := server.logger.WithFields(logging.Fields{"account": pubKey, "jti": claim.ID, "subject": msg.Subject})
+
+	// the account exists somewhere, even if this copy isn't saved the next lookup should look for it
+	server.misses.forget(pubKey)
+
+	if server.duplicateNotification(claim.ID, func() bool { return !server.accounts.changed(claim) }) {
+		logger.Tracef("ignoring notification for account %s, the JWT is already stored", ShortKey(pubKey))
+		server.confirmReplicated(pubKey, server.currentConfig().AccountCacheTTL)
+		return nil
+	}
+
+	if err := server.checkTrustedIssuer(claim.Issuer); err != nil {
+		logger.WithFields(logging.Fields{"error": err}).Errorf("ignoring notification for account %s, %s", ShortKey(pubKey), err.Error())
+		return nil
+	}
+
+	if err := server.checkClaimTimes(claim.Expires, claim.NotBefore); err != nil {
+		logger.WithFields(logging.Fields{"error": err}).Errorf("ignoring notification for account %s, %s", ShortKey(pubKey), err.Error())
+		return nil
+	}
+
+	// the primary checks uploads, a JWT that fails here is saved and flagged unless policies are strict
+	violation := server.checkPolicies(claim)
+	if violation != nil && server.currentConfig().Policies.Strict {
+		logger.WithFields(logging.Fields{"error": violation}).Errorf("ignoring notification for account %s, %s", ShortKey(pubKey), violation.Error())
+		return nil
+	}
+
+	previous := server.previousJWT(pubKey)
+	changed := server.accounts.changed(claim)
+
+	if err := server.saveNotifiedJWT(dirtyAccount, pubKey, theJWT); err != nil {
+		return nil
+	}
+	server.seenNotifications.add(claim.ID)
+	server.accountNotificationSaved(claim, previous, theJWT, changed)
+
+	if violation != nil {
+		server.policyFlags.flag(flaggedAccount{Account: pubKey, JTI: claim.ID, Failures: violation.(policyError).failures, FlaggedAt: time.Now()})
+		logger.WithFields(logging.Fields{"error": violation}).Warnf("saved account %s from a notification, flagged, %s", ShortKey(pubKey), violation.Error())
+	}
+	return claim
+}
+
+// accountNotificationSaved updates the indexes and cache once an account JWT from a notification
+// is in the store
+func (server *AccountServer) accountNotificationSaved(claim *jwt.AccountClaims, previous string, theJWT string, changed bool) {
+	pubKey := claim.Subject
+	server.webhooks.add(claim, server.accountWebhookAction(pubKey))
+	server.indexAccount(claim)
+	server.audit.add("nats", previous, theJWT)
+
+	server.markValid(pubKey, server.currentConfig().AccountCacheTTL)
+
+	if changed {
+		go server.replayActivations(pubKey)
+	}
+}
+
+// replayActivations sends the notifications for activations issued by, or to, an account that
+// is new or changed. An activation saved before its account arrived was ignored by nats-servers
+// that couldn't check it yet, so they are told to look again. Account saves that change nothing
+// don't replay, so servers passing notifications around can't loop.
+func (server *AccountServer) replayActivations(pubKey string) {
+	sent := 0
+	for _, hash := range server.activations.involving(pubKey) {
+		theJWT, err := server.jwtStore.Load(hash)
+		if err != nil {
+			continue
+		}
+
+		claim, err := jwt.DecodeActivationClaims(theJWT)
+		if err != nil {
+			continue
+		}
+
+		if err := server.sendActivationNotification(hash, claim.Issuer, []byte(theJWT), nil); err != nil {
+			server.logger.WithFields(logging.Fields{"activation": hash, "account": pubKey, "error": err}).Warnf("unable to replay activation %s for %s, %s", ShortKey(hash), ShortKey(pubKey), err.Error())
+			continue
+		}
+		atomic.AddUint64(&server.metrics.activationsReplayed, 1)
+		sent++
+	}
+
+	if sent > 0 {
+		server.logger.WithFields(logging.Fields{"account": pubKey}).Noticef("replayed %d activation notifications for account %s", sent, ShortKey(pubKey))
+	}
+}
+
+// sendAccountDeleteNotification publishes the account's public key, the tombstone and the claim
+// that authorized the delete, other account servers ignore a delete without one
+func (server *AccountServer) sendAccountDeleteNotification(tombstone store.Tombstone, deleteClaim string, trace nats.Header) error {
+	pubKey := tombstone.PubKey
+	nc := server.getNatsConnection()
+	if nc == nil {
+		server.logger.WithFields(logging.Fields{"account": pubKey}).Noticef("skipping delete notification for %s, no NATS connection", ShortKey(pubKey))
+		return nil
+	}
+
+	subject := server.deleteNotificationSubject(pubKey)
+	atomic.AddUint64(&server.metrics.notificationsSent, 1)
+	return server.publishTombstone(nc, subject, tombstone, deleteClaim, trace)
+}
+
+func (server *AccountServer) handleAccountDeleteNotification(msg *nats.Msg) {
+	if server.fromSelf(msg) {
+		return
+	}
+	atomic.AddUint64(&server.metrics.notificationsReceived, 1)
+	pubKey := string(msg.Data)
+
+	if !nkeys.IsValidPublicAccountKey(pubKey) || msg.Subject != server.deleteNotificationSubject(pubKey) {
+		server.logger.WithFields(logging.Fields{"subject": msg.Subject}).Errorf("ignoring bad delete notification on %s", msg.Subject)
 		return
 	}
 
-	// Default cache time is 1 hour (see cacheControl)
-	server.cacheLock.Lock()
-	server.validUntil[pubKey] = time.Now().Add(time.Hour)
-	server.cacheLock.Unlock()
+	server.applyAccountDelete(pubKey, msg)
 }
 
-func (server *AccountServer) sendActivationNotification(hash string, account string, theJWT []byte) error {
-	if server.nats == nil {
-		server.logger.Noticef("skipping activation notification for %s, no NATS configured", ShortKey(hash))
+// applyAccountDelete saves the tombstone for an account deleted by a notification, it is
+// returned with true if it was saved. The notification has to carry the operator signed claim
+// that authorized the delete.
+func (server *AccountServer) applyAccountDelete(pubKey string, msg *nats.Msg) (store.Tombstone, bool) {
+	logger := server.logger.WithFields(logging.Fields{"account": pubKey, "subject": msg.Subject})
+
+	if err := server.checkDeleteNotification(pubKey, msg); err != nil {
+		logger.WithFields(logging.Fields{"error": err}).Errorf("ignoring delete notification for account %s, %s", ShortKey(pubKey), err.Error())
+		return store.Tombstone{}, false
+	}
+
+	server.forgetValid(pubKey)
+
+	// the primary's tombstone is kept, so lookups here get the same 410
+	tombstone := tombstoneFromNotification(pubKey, msg)
+	if err := server.saveTombstone(tombstone); err != nil {
+		atomic.AddUint64(&server.metrics.storeErrors, 1)
+		logger.WithFields(logging.Fields{"error": err}).Tracef("unable to delete JWT in notification for %s, %s", ShortKey(pubKey), err.Error())
+		return tombstone, false
+	}
+
+	logger.Noticef("deleted JWT for account from notification - %s", ShortKey(pubKey))
+	return tombstone, true
+}
+
+func (server *AccountServer) sendActivationNotification(hash string, account string, theJWT []byte, trace nats.Header) error {
+	nc := server.getNatsConnection()
+	if nc == nil {
+		server.logger.WithFields(logging.Fields{"activation": hash, "account": account}).Noticef("skipping activation notification for %s, no NATS connection", ShortKey(hash))
+		return nil
+	}
+
+	subject := server.activationNotificationSubject(account, hash)
+	atomic.AddUint64(&server.metrics.notificationsSent, 1)
+	return server.publishJWT(nc, subject, theJWT, trace)
+}
+
+// sendActivationDeleteNotification publishes the hash, the tombstone and the claim that authorized
+// the delete on the activation's subject
+func (server *AccountServer) sendActivationDeleteNotification(tombstone store.Tombstone, account string, deleteClaim string, trace nats.Header) error {
+	hash := tombstone.PubKey
+	nc := server.getNatsConnection()
+	if nc == nil {
+		server.logger.WithFields(logging.Fields{"activation": hash, "account": account}).Noticef("skipping activation delete notification for %s, no NATS connection", ShortKey(hash))
 		return nil
 	}
 
-	subject := fmt.Sprintf(activationNotificationFormat, account, hash)
-	return server.nats.Publish(subject, theJWT)
+	subject := server.activationNotificationSubject(account, hash)
+	atomic.AddUint64(&server.metrics.notificationsSent, 1)
+	return server.publishTombstone(nc, subject, tombstone, deleteClaim, trace)
+}
+
+// isActivationDelete is true for a notification carrying the hash at the end of its subject,
+// rather than a JWT. Public keys are never activation hashes, so accounts can't be deleted this way.
+func isActivationDelete(msg *nats.Msg) bool {
+	hash := string(msg.Data)
+	return hash != "" && !nkeys.IsValidPublicKey(hash) && strings.HasSuffix(msg.Subject, ".CLAIMS.ACTIVATE."+hash)
+}
+
+// handleActivationDeleteNotification saves the tombstone for an activation deleted by a
+// notification, the hash is returned if it was saved. The notification has to carry the claim
+// that authorized the delete.
+func (server *AccountServer) handleActivationDeleteNotification(msg *nats.Msg) string {
+	hash := string(msg.Data)
+	logger := server.logger.WithFields(logging.Fields{"activation": hash, "subject": msg.Subject})
+
+	if err := server.checkActivationDeleteNotification(hash, msg); err != nil {
+		logger.WithFields(logging.Fields{"error": err}).Errorf("ignoring delete notification for activation %s, %s", ShortKey(hash), err.Error())
+		return ""
+	}
+
+	// the primary's tombstone is kept, so lookups here get the same 410
+	if err := server.saveTombstone(tombstoneFromNotification(hash, msg)); err != nil {
+		atomic.AddUint64(&server.metrics.storeErrors, 1)
+		logger.WithFields(logging.Fields{"error": err}).Tracef("unable to delete activation in notification for %s, %s", ShortKey(hash), err.Error())
+		return ""
+	}
+
+	logger.Noticef("deleted activation JWT from notification - %s", ShortKey(hash))
+	return hash
 }
 
 func (server *AccountServer) handleActivationNotification(msg *nats.Msg) {
+	if server.fromSelf(msg) {
+		return
+	}
+	atomic.AddUint64(&server.metrics.notificationsReceived, 1)
+	server.applyActivationNotification(msg)
+}
+
+// applyActivationNotification checks and saves the activation JWT, or tombstone, in a
+// notification, the hash is returned if it was saved
+func (server *AccountServer) applyActivationNotification(msg *nats.Msg) string {
+	if server.oversizedNotification(msg) {
+		return ""
+	}
+	if isActivationDelete(msg) {
+		return server.handleActivationDeleteNotification(msg)
+	}
 	jwtBytes := msg.Data
 	theJWT := string(jwtBytes)
 	claim, err := jwt.DecodeActivationClaims(theJWT)
 
 	if err != nil || claim == nil {
-		return
+		return ""
 	}
 
 	hash, err := claim.HashID()
 	if err != nil {
-		server.logger.Errorf("unable to calculate hash id from activation token in notification")
+		server.logger.WithFields(logging.Fields{"subject": msg.Subject, "error": err}).Errorf("unable to calculate hash id from activation token in notification")
+		return ""
+	}
+
+	logger := server.logger.WithFields(logging.Fields{"activation": hash, "jti": claim.ID, "subject": msg.Subject})
+
+	if server.duplicateNotification(claim.ID, func() bool { return server.storedJTI(hash, claim.ID) }) {
+		logger.Tracef("ignoring notification for activation %s, the JWT is already stored", ShortKey(hash))
+		server.confirmReplicated(hash, server.currentConfig().ActivationCacheTTL)
+		return ""
+	}
+
+	if err := server.checkClaimTimes(claim.Expires, claim.NotBefore); err != nil {
+		logger.WithFields(logging.Fields{"error": err}).Errorf("ignoring notification for activation %s, %s", ShortKey(hash), err.Error())
+		return ""
+	}
+
+	if err := server.verifyActivationIssuer(claim); err != nil {
+		logger.WithFields(logging.Fields{"error": err}).Errorf("ignoring notification for activation %s, %s", ShortKey(hash), err.Error())
+		return ""
+	}
+
+	if err := server.checkActivationCollision(hash, claim); err != nil {
+		return ""
+	}
+
+	if err := server.saveNotifiedJWT(dirtyActivation, hash, theJWT); err != nil {
+		return ""
+	}
+	server.seenNotifications.add(claim.ID)
+	server.activationNotificationSaved(hash, claim)
+	return hash
+}
+
+// activationNotificationSaved updates the index and cache once an activation from a notification
+// is in the store
+func (server *AccountServer) activationNotificationSaved(hash string, claim *jwt.ActivationClaims) {
+	server.activations.set(hash, claim)
+	server.markValid(hash, server.currentConfig().ActivationCacheTTL)
+}
+
+// lookupKeyFromSubject finds the token in subject that matches the wildcard in pattern
+func lookupKeyFromSubject(pattern string, subject string) string {
+	patternTokens := strings.Split(pattern, ".")
+	subjectTokens := strings.Split(subject, ".")
+
+	if len(patternTokens) != len(subjectTokens) {
+		return ""
+	}
+
+	for i, t := range patternTokens {
+		if t == "*" {
+			return subjectTokens[i]
+		}
+	}
+
+	return ""
+}
+
+// handleLookupRequest replies to a claims lookup with the account JWT, an empty reply is
+// sent if the account isn't found
+func (server *AccountServer) handleLookupRequest(msg *nats.Msg) {
+	if msg.Reply == "" {
+		return
+	}
+
+	pubKey := lookupKeyFromSubject(server.currentConfig().NATS.LookupSubject, msg.Subject)
+
+	if !nkeys.IsValidPublicAccountKey(pubKey) {
+		server.logger.WithFields(logging.Fields{"subject": msg.Subject}).Tracef("ignoring lookup request on %s, no account public key", msg.Subject)
+		msg.Respond([]byte{})
 		return
 	}
 
-	err = server.jwtStore.Save(hash, theJWT)
+	logger := server.logger.WithFields(logging.Fields{"account": pubKey, "subject": msg.Subject})
+
+	theJWT, err := server.loadAccountJWT(pubKey)
 	if err != nil {
-		server.logger.Errorf("unable to save activation token in notification, %s", hash)
+		logger.WithFields(logging.Fields{"error": err}).Tracef("lookup request for unknown account %s, %s", ShortKey(pubKey), err.Error())
+		msg.Respond([]byte{})
+		return
+	}
+
+	if server.refuseLegacy(pubKey, theJWT) {
+		msg.Respond([]byte{})
+		return
+	}
+
+	if err := msg.Respond([]byte(theJWT)); err != nil {
+		logger.WithFields(logging.Fields{"error": err}).Errorf("error responding to lookup request for %s, %s", ShortKey(pubKey), err.Error())
 		return
 	}
 
-	// Default cache time is 1 hour (see cacheControl)
-	server.cacheLock.Lock()
-	server.validUntil[hash] = time.Now().Add(time.Hour)
-	server.cacheLock.Unlock()
+	logger.Tracef("answered lookup request for %s", ShortKey(pubKey))
 }
@@ -0,0 +1,125 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/jwt"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+// accountPack reads the account JWTs that would be sent in a pack response, expired JWTs are
+// left out like the nats-server does. The hash is the XOR of the SHA-256 of each JWT, the digest
+// the full resolver sends with its requests.
+func (server *AccountServer) accountPack() ([][]byte, [sha256.Size]byte, error) {
+	var hash [sha256.Size]byte
+	messages := [][]byte{}
+
+	err := server.jwtStore.Iterate(func(publicKey string, theJWT string) error {
+		// activations are stored by hash, the nats-server doesn't keep them in its resolver
+		if !nkeys.IsValidPublicAccountKey(publicKey) {
+			return nil
+		}
+
+		claims, err := jwt.DecodeAccountClaims(theJWT)
+		if err != nil || server.checkClaimTimes(claims.Expires, 0) != nil {
+			return nil
+		}
+
+		sum := sha256.Sum256([]byte(theJWT))
+		for i := range hash {
+			hash[i] ^= sum[i]
+		}
+
+		messages = append(messages, []byte(publicKey+packSeparator+theJWT))
+		return nil
+	})
+	return messages, hash, err
+}
+
+// handlePackRequest answers a full resolver pack request. The request holds the hash of the
+// requester's store, if it matches ours only the empty message that ends a pack is sent.
+// Otherwise every account JWT is sent in its own message, paced by packrate, followed by the
+// empty message. The messages are sent in the background so the subscription isn't held.
+func (server *AccountServer) handlePackRequest(msg *nats.Msg) {
+	if msg.Reply == "" {
+		return
+	}
+
+	atomic.AddUint64(&server.metrics.packRequests, 1)
+
+	messages, hash, err := server.accountPack()
+	if err != nil {
+		// like the nats-server, let the requester time out
+		server.logger.Errorf("unable to read the store for pack request, %s", err.Error())
+		return
+	}
+
+	if bytes.Equal(msg.Data, hash[:]) {
+		atomic.AddUint64(&server.metrics.packRequestsUpToDate, 1)
+		server.logger.Tracef("pack request matches hash %x", hash[:])
+		msg.Respond([]byte{})
+		return
+	}
+
+	server.Lock()
+	done := server.done
+	server.Unlock()
+
+	go server.sendPack(msg.Reply, messages, done)
+}
+
+func (server *AccountServer) sendPack(reply string, messages [][]byte, done <-chan struct{}) {
+	var pace <-chan time.Time
+	if rate := server.currentConfig().NATS.PackRate; rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(rate))
+		defer ticker.Stop()
+		pace = ticker.C
+	}
+
+	nc := server.getNatsConnection()
+	if nc == nil {
+		return
+	}
+
+	for i, m := range messages {
+		if i > 0 && pace != nil {
+			select {
+			case <-pace:
+			case <-done:
+				return
+			}
+		}
+
+		if err := nc.Publish(reply, m); err != nil {
+			server.logger.Warnf("stopped sending pack after %d of %d accounts, %s", i, len(messages), err.Error())
+			return
+		}
+	}
+
+	if err := nc.Publish(reply, []byte{}); err != nil {
+		server.logger.Warnf("unable to end pack response, %s", err.Error())
+		return
+	}
+
+	server.logger.Tracef("sent pack with %d accounts", len(messages))
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"crypto/sha256"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/require"
+)
+
+// testPackSubject is unique to each test, so servers left over from other tests don't answer
+func testPackSubject() string {
+	return "$SYS.REQ.CLAIMS.PACK." + strings.TrimPrefix(nats.NewInbox(), "_INBOX.")
+}
+
+// requestPack sends a pack request and collects the responses up to the empty message
+func requestPack(t *testing.T, nc *nats.Conn, subject string, hash []byte) []string {
+	inbox := nats.NewInbox()
+	sub, err := nc.SubscribeSync(inbox)
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+
+	require.NoError(t, nc.PublishRequest(subject, inbox, hash))
+
+	lines := []string{}
+	for {
+		msg, err := sub.NextMsg(2 * time.Second)
+		require.NoError(t, err)
+		if len(msg.Data) == 0 {
+			return lines
+		}
+		lines = append(lines, string(msg.Data))
+	}
+}
+
+func TestPackRequest(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	server := testEnv.Server
+	server.Lock()
+	config := *server.config
+	config.NATS.PackSubject = testPackSubject()
+	server.config = &config
+	server.subscribeToRequests(server.nats)
+	nc := server.nats
+	server.Unlock()
+	require.NoError(t, nc.Flush())
+
+	jwts := map[string]string{}
+	for i := 0; i < 3; i++ {
+		_, pubKey, _ := CreateAccountKey(t)
+		account := jwt.NewAccountClaims(pubKey)
+		acctJWT, err := account.Encode(testEnv.OperatorKey)
+		require.NoError(t, err)
+		require.NoError(t, server.jwtStore.Save(pubKey, acctJWT))
+		jwts[pubKey] = acctJWT
+	}
+
+	// expired accounts and activations aren't sent
+	_, expiredKey, _ := CreateAccountKey(t)
+	expired := jwt.NewAccountClaims(expiredKey)
+	expired.Expires = time.Now().Add(-time.Hour).Unix()
+	expiredJWT, err := expired.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	require.NoError(t, server.jwtStore.Save(expiredKey, expiredJWT))
+	require.NoError(t, server.jwtStore.Save("activationhash", "eyactivation"))
+
+	lines := requestPack(t, testEnv.NC, config.NATS.PackSubject, nil)
+	require.Len(t, lines, len(jwts))
+
+	var hash [sha256.Size]byte
+	for _, line := range lines {
+		parts := strings.SplitN(line, packSeparator, 2)
+		require.Len(t, parts, 2)
+		require.Equal(t, jwts[parts[0]], parts[1])
+
+		sum := sha256.Sum256([]byte(parts[1]))
+		for i := range hash {
+			hash[i] ^= sum[i]
+		}
+	}
+
+	// a store with the same hash is up to date
+	lines = requestPack(t, testEnv.NC, config.NATS.PackSubject, hash[:])
+	require.Empty(t, lines)
+
+	require.Equal(t, uint64(2), atomic.LoadUint64(&server.metrics.packRequests))
+	require.Equal(t, uint64(1), atomic.LoadUint64(&server.metrics.packRequestsUpToDate))
+}
+
+func TestPackRequestRate(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	server := testEnv.Server
+	server.Lock()
+	config := *server.config
+	config.NATS.PackSubject = testPackSubject()
+	config.NATS.PackRate = 20
+	server.config = &config
+	server.subscribeToRequests(server.nats)
+	nc := server.nats
+	server.Unlock()
+	require.NoError(t, nc.Flush())
+
+	for i := 0; i < 5; i++ {
+		_, pubKey, _ := CreateAccountKey(t)
+		acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+		require.NoError(t, err)
+		require.NoError(t, server.jwtStore.Save(pubKey, acctJWT))
+	}
+
+	start := time.Now()
+	lines := requestPack(t, testEnv.NC, config.NATS.PackSubject, nil)
+	require.Len(t, lines, 5)
+	require.True(t, time.Since(start) >= 4*time.Second/20)
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+)
+
+// NATS connection states reported by /jwt/v1/status
+const (
+	natsStateDisconnected = "disconnected" // not connected yet, or waiting to try again
+	natsStateConnected    = "connected"
+	natsStateReconnecting = "reconnecting" // nats.go lost the connection and is trying to get it back
+	natsStateClosed       = "closed"
+)
+
+// natsTracker records connection state changes, publish results and the messages received on
+// each subscription. It has its own lock, and the receive counters are atomic, so the
+// bookkeeping never waits on the server lock.
+type natsTracker struct {
+	sync.Mutex
+	state            string
+	stateSince       time.Time
+	lastPublish      time.Time
+	lastPublishError string
+	lastErrorAt      time.Time
+	lastAsyncError   string // from the connection's error handler, like a permissions violation
+	publishErrors    uint64
+	received         map[string]*uint64 // by subscription subject
+}
+
+func newNATSTracker() *natsTracker {
+	return &natsTracker{
+		state:      natsStateDisconnected,
+		stateSince: time.Now(),
+		received:   map[string]*uint64{},
+	}
+}
+
+func (t *natsTracker) setState(state string) {
+	t.Lock()
+	defer t.Unlock()
+	if t.state != state {
+		t.state = state
+		t.stateSince = time.Now()
+	}
+}
+
+// published records the result of a publish
+func (t *natsTracker) published(err error) {
+	t.Lock()
+	defer t.Unlock()
+	if err != nil {
+		t.publishErrors++
+		t.lastPublishError = err.Error()
+		t.lastErrorAt = time.Now()
+		return
+	}
+	t.lastPublish = time.Now()
+}
+
+func (t *natsTracker) asyncError(err error) {
+	t.Lock()
+	defer t.Unlock()
+	t.lastAsyncError = err.Error()
+}
+
+// counted wraps a subscription handler so the messages it gets are counted under subject
+func (t *natsTracker) counted(subject string, handler nats.MsgHandler) nats.MsgHandler {
+	t.Lock()
+	count, ok := t.received[subject]
+	if !ok {
+		count = new(uint64)
+		t.received[subject] = count
+	}
+	t.Unlock()
+
+	return func(msg *nats.Msg) {
+		atomic.AddUint64(count, 1)
+		handler(msg)
+	}
+}
+
+// natsActivity is the tracker's part of the NATS status
+type natsActivity struct {
+	State            string            `json:"state"`
+	StateSince       time.Time         `json:"state_since"`
+	LastPublish      *time.Time        `json:"last_publish,omitempty"`
+	LastPublishError string            `json:"last_publish_error,omitempty"`
+	LastErrorAt      *time.Time        `json:"last_publish_error_at,omitempty"`
+	LastAsyncError   string            `json:"last_async_error,omitempty"`
+	PublishErrors    uint64            `json:"publish_errors"`
+	Received         map[string]uint64 `json:"received,omitempty"`
+}
+
+func (t *natsTracker) snapshot() natsActivity {
+	t.Lock()
+	defer t.Unlock()
+
+	activity := natsActivity{
+		State:            t.state,
+		StateSince:       t.stateSince.UTC(),
+		LastPublishError: t.lastPublishError,
+		LastAsyncError:   t.lastAsyncError,
+		PublishErrors:    t.publishErrors,
+	}
+	if !t.lastPublish.IsZero() {
+		lastPublish := t.lastPublish.UTC()
+		activity.LastPublish = &lastPublish
+	}
+	if !t.lastErrorAt.IsZero() {
+		lastErrorAt := t.lastErrorAt.UTC()
+		activity.LastErrorAt = &lastErrorAt
+	}
+	if len(t.received) > 0 {
+		activity.Received = map[string]uint64{}
+		for subject, count := range t.received {
+			activity.Received[subject] = atomic.LoadUint64(count)
+		}
+	}
+	return activity
+}
+
+// receivedSubjects returns the subscription subjects in order, for stable metrics output
+func (activity natsActivity) receivedSubjects() []string {
+	subjects := make([]string, 0, len(activity.Received))
+	for subject := range activity.Received {
+		subjects = append(subjects, subject)
+	}
+	sort.Strings(subjects)
+	return subjects
+}
+
+// publish sends a message on nc and records the result for the status
+func (server *AccountServer) publish(nc *nats.Conn, subject string, data []byte) error {
+	err := nc.Publish(subject, data)
+	server.natsState.published(err)
+	return err
+}
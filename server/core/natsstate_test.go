@@ -0,0 +1,100 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNATSTracker(t *testing.T) {
+	tracker := newNATSTracker()
+	activity := tracker.snapshot()
+	require.Equal(t, natsStateDisconnected, activity.State)
+	require.Nil(t, activity.LastPublish)
+	require.Nil(t, activity.Received)
+
+	since := activity.StateSince
+	tracker.setState(natsStateDisconnected)
+	require.Equal(t, since, tracker.snapshot().StateSince)
+	tracker.setState(natsStateConnected)
+	require.Equal(t, natsStateConnected, tracker.snapshot().State)
+
+	tracker.published(nil)
+	tracker.published(fmt.Errorf("nats: connection closed"))
+	tracker.asyncError(fmt.Errorf("nats: permissions violation"))
+	activity = tracker.snapshot()
+	require.NotNil(t, activity.LastPublish)
+	require.NotNil(t, activity.LastErrorAt)
+	require.Equal(t, "nats: connection closed", activity.LastPublishError)
+	require.Equal(t, "nats: permissions violation", activity.LastAsyncError)
+	require.Equal(t, uint64(1), activity.PublishErrors)
+
+	handled := 0
+	handler := tracker.counted("b.*", func(msg *nats.Msg) { handled++ })
+	handler(&nats.Msg{})
+	handler(&nats.Msg{})
+	tracker.counted("a.*", func(msg *nats.Msg) {})(&nats.Msg{})
+
+	activity = tracker.snapshot()
+	require.Equal(t, 2, handled)
+	require.Equal(t, map[string]uint64{"a.*": 1, "b.*": 2}, activity.Received)
+	require.Equal(t, []string{"a.*", "b.*"}, activity.receivedSubjects())
+}
+
+func TestNATSActivityInStatus(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	testEnv, err := SetupTestServer(config, false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	server := testEnv.Server
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+
+	require.NoError(t, server.sendAccountNotification(jwt.NewAccountClaims(pubKey), []byte("jwt"), nil))
+
+	lookupSubject := config.NATS.LookupSubject
+	_, err = testEnv.NC.Request(strings.Replace(lookupSubject, "*", pubKey, 1), nil, 2*time.Second)
+	require.NoError(t, err)
+
+	status := getStatus(t, testEnv.HTTP, testEnv.URLForPath("/jwt/v1/status"))
+	require.Equal(t, natsStateConnected, status.NATS.State)
+	require.NotNil(t, status.NATS.LastPublish)
+	require.Empty(t, status.NATS.LastPublishError)
+	require.Equal(t, uint64(1), status.NATS.Received[lookupSubject])
+
+	testEnv.GNATSD.Shutdown()
+	for i := 0; i < 50 && server.natsState.snapshot().State == natsStateConnected; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	status = getStatus(t, testEnv.HTTP, testEnv.URLForPath("/jwt/v1/status"))
+	require.False(t, status.NATS.Connected)
+	require.NotEqual(t, natsStateConnected, status.NATS.State)
+}
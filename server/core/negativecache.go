@@ -0,0 +1,132 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+)
+
+// negativeEntry is an account that wasn't found, and when that stops being trusted
+type negativeEntry struct {
+	pubKey  string
+	expires time.Time
+}
+
+// negativeCache remembers accounts that weren't found for a short time, so repeated lookups for
+// a missing account don't go to the store, or the primary, every time. Entries are kept in the
+// order they were added, they all have the same TTL so the oldest expires first and is the
+// one dropped once max entries are cached.
+type negativeCache struct {
+	sync.Mutex
+	ttl     time.Duration // 0 turns the cache off
+	max     int
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+func newNegativeCache() *negativeCache {
+	return &negativeCache{
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+// configure applies the TTL and size, turning the cache off empties it
+func (cache *negativeCache) configure(config conf.NegativeCacheConfig) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	cache.ttl = time.Duration(config.TTL) * time.Second
+	cache.max = config.MaxEntries
+	if cache.ttl <= 0 || cache.max <= 0 {
+		cache.entries = map[string]*list.Element{}
+		cache.order.Init()
+		return
+	}
+	for cache.order.Len() > cache.max {
+		cache.removeElement(cache.order.Back())
+	}
+}
+
+// missing is true if pubKey wasn't found less than the TTL ago
+func (cache *negativeCache) missing(pubKey string, now time.Time) bool {
+	cache.Lock()
+	defer cache.Unlock()
+
+	element, ok := cache.entries[pubKey]
+	if !ok {
+		return false
+	}
+	if now.Before(element.Value.(*negativeEntry).expires) {
+		return true
+	}
+	cache.removeElement(element)
+	return false
+}
+
+// add remembers that pubKey wasn't found
+func (cache *negativeCache) add(pubKey string, now time.Time) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	if cache.ttl <= 0 || cache.max <= 0 {
+		return
+	}
+
+	if element, ok := cache.entries[pubKey]; ok {
+		cache.removeElement(element)
+	}
+
+	for cache.order.Len() >= cache.max {
+		cache.removeElement(cache.order.Back())
+	}
+	cache.entries[pubKey] = cache.order.PushFront(&negativeEntry{pubKey: pubKey, expires: now.Add(cache.ttl)})
+}
+
+// forget drops pubKey, called whenever a JWT is saved for it
+func (cache *negativeCache) forget(pubKey string) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	if element, ok := cache.entries[pubKey]; ok {
+		cache.removeElement(element)
+	}
+}
+
+func (cache *negativeCache) size() int {
+	cache.Lock()
+	defer cache.Unlock()
+	return cache.order.Len()
+}
+
+// removeElement drops an entry, the lock should be held by the caller
+func (cache *negativeCache) removeElement(element *list.Element) {
+	cache.order.Remove(element)
+	delete(cache.entries, element.Value.(*negativeEntry).pubKey)
+}
+
+func validateNegativeCache(config conf.NegativeCacheConfig) error {
+	if config.TTL < 0 || config.MaxEntries < 0 {
+		return fmt.Errorf("negative cache TTL and max entries cannot be below 0, use 0 to turn the cache off")
+	}
+	return nil
+}
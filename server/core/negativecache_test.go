@@ -0,0 +1,164 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegativeCache(t *testing.T) {
+	cache := newNegativeCache()
+	cache.configure(conf.NegativeCacheConfig{TTL: 10, MaxEntries: 2})
+	now := time.Now()
+
+	require.False(t, cache.missing("A", now))
+	cache.add("A", now)
+	require.True(t, cache.missing("A", now))
+	require.False(t, cache.missing("A", now.Add(10*time.Second)))
+	require.Equal(t, 0, cache.size())
+
+	// full, the oldest is dropped
+	cache.add("A", now)
+	cache.add("B", now.Add(time.Second))
+	cache.add("C", now.Add(2*time.Second))
+	require.Equal(t, 2, cache.size())
+	require.False(t, cache.missing("A", now))
+	require.True(t, cache.missing("B", now))
+
+	cache.forget("B")
+	require.False(t, cache.missing("B", now))
+	require.True(t, cache.missing("C", now))
+
+	// turning it off empties it
+	cache.configure(conf.NegativeCacheConfig{TTL: 0, MaxEntries: 2})
+	require.Equal(t, 0, cache.size())
+	cache.add("A", now)
+	require.False(t, cache.missing("A", now))
+
+	require.Error(t, validateNegativeCache(conf.NegativeCacheConfig{TTL: -1}))
+	require.NoError(t, validateNegativeCache(conf.DefaultServerConfig().NegativeCache))
+}
+
+func TestNegativeCacheLookups(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	_, pubKey, _ := CreateAccountKey(t)
+	url := testEnv.URLForPath("/jwt/v1/accounts/" + pubKey)
+
+	get := func() int {
+		resp, err := testEnv.HTTP.Get(url)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusNotFound, get())
+	require.Equal(t, http.StatusNotFound, get())
+	require.Equal(t, http.StatusNotFound, get())
+
+	resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/metrics"))
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.True(t, strings.Contains(string(body), "nats_account_server_negative_cache_hits_total 2"))
+	require.True(t, strings.Contains(string(body), "nats_account_server_negative_cache_entries 1"))
+
+	// saving the account forgets the miss
+	acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	resp, err = testEnv.HTTP.Post(url, "application/json", bytes.NewBufferString(acctJWT))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, http.StatusOK, get())
+}
+
+func TestNegativeCacheReplica(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	_, pubKey, _ := CreateAccountKey(t)
+	acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	lock := sync.Mutex{}
+	requests := 0
+	exists := false
+
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/jwt/v1/accounts/"+pubKey {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		requests++
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(acctJWT))
+	}))
+	defer primary.Close()
+
+	config := testEnv.CreateReplicaConfig("")
+	config.Primary = []string{primary.URL}
+	config.NATS.Servers = nil
+	replica := NewAccountServer()
+	replica.InitializeFromConfig(config)
+	require.NoError(t, replica.Start())
+	defer replica.Stop()
+
+	url := fmt.Sprintf("%s://%s/jwt/v1/accounts/%s", replica.protocol, replica.hostPort, pubKey)
+	get := func() int {
+		resp, err := testEnv.HTTP.Get(url)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// the primary's 404 is passed on, and only asked for once
+	for i := 0; i < 5; i++ {
+		require.Equal(t, http.StatusNotFound, get())
+	}
+	lock.Lock()
+	require.Equal(t, 1, requests)
+	exists = true
+	lock.Unlock()
+	require.Equal(t, http.StatusNotFound, get())
+
+	// a notification for the account forgets the miss
+	replica.handleAccountNotification(&nats.Msg{Subject: replica.accountNotificationSubject(pubKey), Data: []byte(acctJWT)})
+	require.Equal(t, http.StatusOK, get())
+}
@@ -0,0 +1,172 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/nats-io/nats-account-server/server/logging"
+	nats "github.com/nats-io/nats.go"
+)
+
+// pendingNotification is an account notification waiting to be published
+type pendingNotification struct {
+	pubKey string
+	jwt    []byte
+	trace  nats.Header // from the request that changed the account, if there was one
+}
+
+// notificationQueue holds account notifications that couldn't be published while NATS was
+// unavailable. Only the latest JWT for each account is kept, in the order the accounts were
+// first queued.
+type notificationQueue struct {
+	sync.Mutex
+	pending map[string]pendingNotification
+	order   []string
+}
+
+func newNotificationQueue() *notificationQueue {
+	return &notificationQueue{
+		pending: map[string]pendingNotification{},
+	}
+}
+
+// add queues the JWT for the account, replacing one already queued. If the queue is full
+// the oldest accounts are dropped and returned.
+func (q *notificationQueue) add(pubKey string, theJWT []byte, trace nats.Header, max int) (dropped []string) {
+	q.Lock()
+	defer q.Unlock()
+
+	n := pendingNotification{pubKey: pubKey, jwt: theJWT, trace: trace}
+	if _, ok := q.pending[pubKey]; ok {
+		q.pending[pubKey] = n
+		return nil
+	}
+
+	// the max can shrink on reload, so more than one may go
+	for len(q.order) >= max {
+		dropped = append(dropped, q.order[0])
+		delete(q.pending, q.order[0])
+		q.order = q.order[1:]
+	}
+
+	q.pending[pubKey] = n
+	q.order = append(q.order, pubKey)
+	return dropped
+}
+
+// requeue puts back a notification that failed to publish again, unless a newer JWT was queued
+// for the account meanwhile. Returns false if the queue is full.
+func (q *notificationQueue) requeue(n pendingNotification, max int) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	if _, ok := q.pending[n.pubKey]; ok {
+		return true
+	}
+
+	if len(q.order) >= max {
+		return false
+	}
+
+	q.pending[n.pubKey] = n
+	q.order = append(q.order, n.pubKey)
+	return true
+}
+
+// remove drops the notification for an account, used when a newer JWT was published directly
+func (q *notificationQueue) remove(pubKey string) {
+	q.Lock()
+	defer q.Unlock()
+
+	if _, ok := q.pending[pubKey]; !ok {
+		return
+	}
+
+	delete(q.pending, pubKey)
+	for i, k := range q.order {
+		if k == pubKey {
+			q.order = append(q.order[:i], q.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// take empties the queue, returning its contents in order
+func (q *notificationQueue) take() []pendingNotification {
+	q.Lock()
+	defer q.Unlock()
+
+	taken := make([]pendingNotification, 0, len(q.order))
+	for _, pubKey := range q.order {
+		taken = append(taken, q.pending[pubKey])
+	}
+
+	q.pending = map[string]pendingNotification{}
+	q.order = nil
+	return taken
+}
+
+func (q *notificationQueue) size() int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.order)
+}
+
+// queueAccountNotification keeps a notification that couldn't be published so it can be sent
+// once NATS is available again, returns false if queueing is disabled or NATS isn't configured
+func (server *AccountServer) queueAccountNotification(pubKey string, theJWT []byte, trace nats.Header) bool {
+	config := server.currentConfig().NATS
+	if config.NotificationQueueSize <= 0 || len(config.Servers) == 0 {
+		return false
+	}
+
+	atomic.AddUint64(&server.metrics.notificationsQueued, 1)
+
+	for _, dropped := range server.pendingNotifications.add(pubKey, theJWT, trace, config.NotificationQueueSize) {
+		atomic.AddUint64(&server.metrics.notificationsDropped, 1)
+		server.logger.WithFields(logging.Fields{"account": dropped}).Warnf("notification queue is full, dropped notification for %s", ShortKey(dropped))
+	}
+	return true
+}
+
+// flushNotifications publishes the queued notifications on nc, anything that fails is queued again
+func (server *AccountServer) flushNotifications(nc *nats.Conn) {
+	pending := server.pendingNotifications.take()
+	if len(pending) == 0 {
+		return
+	}
+
+	server.logger.Noticef("sending %d queued notifications", len(pending))
+	max := server.currentConfig().NATS.NotificationQueueSize
+
+	for i, n := range pending {
+		if err := server.publishJWT(nc, server.accountNotificationSubject(n.pubKey), n.jwt, n.trace); err != nil {
+			server.logger.WithFields(logging.Fields{"account": n.pubKey, "error": err}).Errorf("unable to send queued notification for %s, %s", ShortKey(n.pubKey), err.Error())
+
+			for _, failed := range pending[i:] {
+				if !server.pendingNotifications.requeue(failed, max) {
+					atomic.AddUint64(&server.metrics.notificationsDropped, 1)
+					server.logger.WithFields(logging.Fields{"account": failed.pubKey}).Warnf("notification queue is full, dropped notification for %s", ShortKey(failed.pubKey))
+				}
+			}
+			return
+		}
+		atomic.AddUint64(&server.metrics.notificationsSent, 1)
+	}
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	gnatsd "github.com/nats-io/nats-server/v2/test"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotificationQueue(t *testing.T) {
+	q := newNotificationQueue()
+
+	require.Empty(t, q.add("a", []byte("1"), nil, 2))
+	require.Empty(t, q.add("b", []byte("1"), nil, 2))
+
+	// the latest JWT wins, and keeps its place
+	require.Empty(t, q.add("a", []byte("2"), nil, 2))
+	require.Equal(t, 2, q.size())
+
+	// the oldest is dropped when full
+	require.Equal(t, []string{"a"}, q.add("c", []byte("1"), nil, 2))
+
+	q.remove("b")
+	q.remove("notqueued")
+	require.True(t, q.requeue(pendingNotification{pubKey: "d", jwt: []byte("1")}, 2))
+	require.False(t, q.requeue(pendingNotification{pubKey: "e", jwt: []byte("1")}, 2))
+
+	// a requeue doesn't replace a newer JWT
+	require.True(t, q.requeue(pendingNotification{pubKey: "c", jwt: []byte("0")}, 2))
+
+	require.Equal(t, []pendingNotification{
+		{pubKey: "c", jwt: []byte("1")},
+		{pubKey: "d", jwt: []byte("1")},
+	}, q.take())
+	require.Equal(t, 0, q.size())
+
+	// a smaller max drops everything over it
+	q.add("a", nil, nil, 3)
+	q.add("b", nil, nil, 3)
+	q.add("c", nil, nil, 3)
+	require.Equal(t, []string{"a", "b", "c"}, q.add("d", nil, nil, 1))
+}
+
+func TestNotificationsQueuedWhileDisconnected(t *testing.T) {
+	natsPort := int(atomic.AddUint64(&port, 1))
+	opts := gnatsd.DefaultTestOptions
+	opts.Port = natsPort
+	gnatsServer := gnatsd.RunServer(&opts)
+
+	config := conf.DefaultServerConfig()
+	config.HTTP.Port = 0
+	config.NATS.Servers = []string{fmt.Sprintf("nats://localhost:%d", natsPort)}
+	config.NATS.MaxReconnects = 1
+	config.NATS.ReconnectWait = 500
+	config.NATS.NotificationQueueSize = 2
+
+	server := NewAccountServer()
+	server.InitializeFromConfig(config)
+	require.NoError(t, server.Start())
+	defer server.Stop()
+
+	gnatsServer.Shutdown()
+
+	for i := 0; i < 50 && server.getNatsConnection() != nil; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	require.Nil(t, server.getNatsConnection())
+
+	pubKeys := []string{}
+	for i := 0; i < 3; i++ {
+		accountKey, err := nkeys.CreateAccount()
+		require.NoError(t, err)
+		pubKey, err := accountKey.PublicKey()
+		require.NoError(t, err)
+		pubKeys = append(pubKeys, pubKey)
+	}
+
+	require.NoError(t, server.sendAccountNotification(jwt.NewAccountClaims(pubKeys[0]), []byte("first"), nil))
+	require.NoError(t, server.sendAccountNotification(jwt.NewAccountClaims(pubKeys[1]), []byte("old"), nil))
+	require.NoError(t, server.sendAccountNotification(jwt.NewAccountClaims(pubKeys[1]), []byte("new"), nil))
+	require.NoError(t, server.sendAccountNotification(jwt.NewAccountClaims(pubKeys[2]), []byte("last"), nil))
+	require.Equal(t, 2, server.pendingNotifications.size())
+	require.Equal(t, uint64(1), atomic.LoadUint64(&server.metrics.notificationsDropped))
+
+	gnatsServer = gnatsd.RunServer(&opts)
+	defer gnatsServer.Shutdown()
+
+	nc, err := nats.Connect(fmt.Sprintf("nats://localhost:%d", natsPort))
+	require.NoError(t, err)
+	defer nc.Close()
+
+	received := make(chan *nats.Msg, 10)
+	_, err = nc.ChanSubscribe(server.accountNotificationSubject("*"), received)
+	require.NoError(t, err)
+	require.NoError(t, nc.Flush())
+
+	got := map[string]string{}
+	for len(got) < 2 {
+		select {
+		case msg := <-received:
+			got[msg.Subject] = string(msg.Data)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("queued notifications weren't sent, got %v", got)
+		}
+	}
+
+	require.Equal(t, map[string]string{
+		server.accountNotificationSubject(pubKeys[1]): "new",
+		server.accountNotificationSubject(pubKeys[2]): "last",
+	}, got)
+	require.Equal(t, 0, server.pendingNotifications.size())
+}
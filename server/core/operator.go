@@ -0,0 +1,170 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/logging"
+)
+
+// operatorFile is the operator JWT served at /jwt/v1/operator, it is checked against the
+// file's modification time and size on each request so edits are picked up without a restart
+type operatorFile struct {
+	path    string
+	modTime time.Time
+	size    int64
+	id      string
+}
+
+// nscOperatorJWTPath is where an NSC folder keeps its operator JWT
+func nscOperatorJWTPath(folder string) string {
+	return filepath.Join(folder, fmt.Sprintf("%s.jwt", filepath.Base(folder)))
+}
+
+// operatorJWTPath is the configured operator JWT, or the one in the NSC store if there is one
+func (server *AccountServer) operatorJWTPath() string {
+	if server.config.OperatorJWTPath != "" {
+		return server.config.OperatorJWTPath
+	}
+
+	if server.config.Store.NSC == "" {
+		return ""
+	}
+
+	nscPath := nscOperatorJWTPath(server.config.Store.NSC)
+	if _, err := os.Stat(nscPath); err != nil {
+		return ""
+	}
+	return nscPath
+}
+
+// readOperatorJWT reads and decodes an operator JWT file
+func readOperatorJWT(path string) (string, *jwt.OperatorClaims, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+
+	claims, err := jwt.DecodeOperatorClaims(string(data))
+	if err != nil {
+		return "", nil, err
+	}
+
+	return string(data), claims, nil
+}
+
+// trustedKeysFor returns the configured keys with the operator's identity and signing keys
+func trustedKeysFor(configured []string, operator *jwt.OperatorClaims) []string {
+	keys := append([]string{}, configured...)
+	keys = append(keys, operator.Subject)
+	return append(keys, operator.SigningKeys...)
+}
+
+// currentOperatorJWT returns the operator JWT and its ID, re-reading the file if it changed.
+// If the new file can't be read, or isn't an operator JWT, the last good copy is kept.
+func (server *AccountServer) currentOperatorJWT() (string, string) {
+	server.operatorLock.Lock()
+	changed := server.refreshOperator()
+	theJWT, id := server.operatorJWT, server.operator.id
+	server.operatorLock.Unlock()
+
+	if changed {
+		server.revalidateAccounts()
+	}
+	return theJWT, id
+}
+
+// currentTrustedKeys returns the keys that can sign account JWTs, re-reading the operator
+// JWT first so a new signing key is trusted as soon as the file is updated
+func (server *AccountServer) currentTrustedKeys() []string {
+	server.operatorLock.Lock()
+	changed := server.refreshOperator()
+	keys := server.trustedKeys
+	server.operatorLock.Unlock()
+
+	if changed {
+		server.revalidateAccounts()
+	}
+	return keys
+}
+
+// refreshOperator reads the operator JWT again if the file changed, and returns true if that
+// changed the trusted keys. The operator lock should be held.
+func (server *AccountServer) refreshOperator() bool {
+	file := &server.operator
+	if file.path == "" {
+		return false
+	}
+
+	info, err := os.Stat(file.path)
+	if err != nil || (info.ModTime().Equal(file.modTime) && info.Size() == file.size) {
+		return false
+	}
+
+	// don't read the file again until it changes
+	file.modTime = info.ModTime()
+	file.size = info.Size()
+
+	theJWT, claims, err := readOperatorJWT(file.path)
+	if err != nil {
+		server.logger.WithFields(logging.Fields{"error": err}).Errorf("unable to reload operator from %s, serving the previous copy - %s", file.path, err.Error())
+		return false
+	}
+
+	server.logger.Noticef("reloaded operator from %s", file.path)
+	server.operatorJWT = theJWT
+	file.id = claims.ID
+
+	keys := trustedKeysFor(server.configuredKeys, claims)
+	changed := !reflect.DeepEqual(keys, server.trustedKeys)
+	server.trustedKeys = keys
+	return changed
+}
+
+// revalidateAccounts logs the stored accounts that aren't signed by a trusted key, it is run
+// when the operator's keys change so accounts signed by a removed signing key can be found
+func (server *AccountServer) revalidateAccounts() {
+	server.operatorLock.Lock()
+	keys := server.trustedKeys
+	server.operatorLock.Unlock()
+
+	trusted := map[string]bool{}
+	for _, k := range keys {
+		trusted[k] = true
+	}
+
+	untrusted := 0
+	for issuer, count := range server.accounts.issuerCounts() {
+		if !trusted[issuer] {
+			untrusted += count
+			server.logger.Warnf("%d accounts are signed by %s, which is no longer a trusted operator key", count, issuer)
+		}
+	}
+
+	if untrusted > 0 {
+		server.logger.Warnf("%d accounts aren't signed by a trusted operator key, they can be listed with GET /jwt/v1/accounts?signedBy=<key>", untrusted)
+	} else {
+		server.logger.Noticef("operator keys changed, all accounts are signed by a trusted key")
+	}
+}
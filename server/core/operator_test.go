@@ -0,0 +1,204 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func getOperator(t *testing.T, testEnv *TestSetup, etag string) (*http.Response, string) {
+	req, err := http.NewRequest(http.MethodGet, testEnv.URLForPath("/jwt/v1/operator"), nil)
+	require.NoError(t, err)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	resp, err := testEnv.HTTP.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+// touch moves a file's modification time forward, so a rewrite is noticed even on coarse clocks
+func touch(t *testing.T, path string, by time.Duration) {
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	mtime := info.ModTime().Add(by)
+	require.NoError(t, os.Chtimes(path, mtime, mtime))
+}
+
+func TestOperatorJWTCacheHeaders(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	resp, body := getOperator(t, testEnv, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, ApplicationJWT, resp.Header.Get(ContentType))
+	require.Equal(t, "no-cache", resp.Header.Get("Cache-Control"))
+
+	decoded, err := jwt.DecodeOperatorClaims(body)
+	require.NoError(t, err)
+	etag := resp.Header.Get("Etag")
+	require.Equal(t, jwtETag(decoded.ID), etag)
+
+	resp, body = getOperator(t, testEnv, etag)
+	require.Equal(t, http.StatusNotModified, resp.StatusCode)
+	require.Empty(t, body)
+}
+
+func TestOperatorJWTReloadsWhenFileChanges(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	resp, original := getOperator(t, testEnv, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	claims := jwt.NewOperatorClaims(testEnv.OperatorPubKey)
+	claims.Name = "renamed"
+	updated, err := claims.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	require.NotEqual(t, original, updated)
+
+	require.NoError(t, ioutil.WriteFile(testEnv.OperatorJWTFile, []byte(updated), 0644))
+	touch(t, testEnv.OperatorJWTFile, time.Second)
+
+	resp, body := getOperator(t, testEnv, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, updated, body)
+	require.Equal(t, jwtETag(claims.ID), resp.Header.Get("Etag"))
+
+	// a broken file keeps the last good copy
+	require.NoError(t, ioutil.WriteFile(testEnv.OperatorJWTFile, []byte("not a jwt"), 0644))
+	touch(t, testEnv.OperatorJWTFile, 2*time.Second)
+
+	resp, body = getOperator(t, testEnv, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, updated, body)
+
+	// as does a missing one
+	require.NoError(t, os.Remove(testEnv.OperatorJWTFile))
+	resp, body = getOperator(t, testEnv, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, updated, body)
+}
+
+func TestOperatorJWTPathFromNSC(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "operator_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	folder := filepath.Join(dir, "myoperator")
+	require.NoError(t, os.Mkdir(folder, 0755))
+	require.Equal(t, filepath.Join(folder, "myoperator.jwt"), nscOperatorJWTPath(folder))
+
+	server := NewAccountServer()
+	server.config = conf.DefaultServerConfig()
+	server.config.Store = conf.StoreConfig{NSC: folder}
+
+	// nothing to serve until the folder has an operator
+	require.Empty(t, server.operatorJWTPath())
+
+	require.NoError(t, ioutil.WriteFile(nscOperatorJWTPath(folder), []byte("jwt"), 0644))
+	require.Equal(t, nscOperatorJWTPath(folder), server.operatorJWTPath())
+
+	// an explicit path wins
+	server.config.OperatorJWTPath = "/other/operator.jwt"
+	require.Equal(t, "/other/operator.jwt", server.operatorJWTPath())
+}
+
+func TestOperatorSigningKeyRotation(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	writeOperator := func(signingKeys ...string) {
+		claims := jwt.NewOperatorClaims(testEnv.OperatorPubKey)
+		claims.SigningKeys = signingKeys
+		theJWT, err := claims.Encode(testEnv.OperatorKey)
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(testEnv.OperatorJWTFile, []byte(theJWT), 0644))
+		touch(t, testEnv.OperatorJWTFile, time.Duration(len(signingKeys)+1)*time.Second)
+	}
+
+	postAccount := func(signer nkeys.KeyPair) (string, int) {
+		accountKey, err := nkeys.CreateAccount()
+		require.NoError(t, err)
+		pubKey, err := accountKey.PublicKey()
+		require.NoError(t, err)
+		acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(signer)
+		require.NoError(t, err)
+
+		resp, err := testEnv.HTTP.Post(testEnv.URLForPath("/jwt/v1/accounts/"+pubKey), "application/json", bytes.NewBuffer([]byte(acctJWT)))
+		require.NoError(t, err)
+		resp.Body.Close()
+		return pubKey, resp.StatusCode
+	}
+
+	signingKey, err := nkeys.CreateOperator()
+	require.NoError(t, err)
+	signingPub, err := signingKey.PublicKey()
+	require.NoError(t, err)
+
+	_, status := postAccount(signingKey)
+	require.Equal(t, http.StatusForbidden, status)
+
+	// a signing key added to the operator file is trusted right away
+	writeOperator(signingPub)
+	signed, status := postAccount(signingKey)
+	require.Equal(t, http.StatusOK, status)
+	_, status = postAccount(testEnv.OperatorKey)
+	require.Equal(t, http.StatusOK, status)
+
+	status, summaries := listAccounts(t, testEnv, "?signedBy="+signingPub)
+	require.Equal(t, http.StatusOK, status)
+	require.Len(t, summaries, 1)
+	require.Equal(t, signed, summaries[0].PubKey)
+	require.Equal(t, signingPub, summaries[0].Issuer)
+
+	status, _ = listAccounts(t, testEnv, "?signedBy=notakey")
+	require.Equal(t, http.StatusBadRequest, status)
+
+	server := getStatus(t, testEnv.HTTP, testEnv.URLForPath("/jwt/v1/status"))
+	require.Equal(t, 1, server.AccountIssuers[signingPub])
+	require.Equal(t, 1, server.AccountIssuers[testEnv.OperatorPubKey])
+
+	// removing the key stops it being trusted, the accounts it signed are still listed
+	writeOperator()
+	require.NoError(t, testEnv.Server.ReloadConfig(testEnv.Server.currentConfig()))
+	require.NotContains(t, testEnv.Server.currentTrustedKeys(), signingPub)
+
+	_, status = postAccount(signingKey)
+	require.Equal(t, http.StatusForbidden, status)
+	_, summaries = listAccounts(t, testEnv, "?signedBy="+signingPub)
+	require.Len(t, summaries, 1)
+}
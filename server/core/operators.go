@@ -0,0 +1,175 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/store"
+	"github.com/nats-io/nkeys"
+)
+
+// hostedOperator is an operator from the operators list, the accounts it signs are kept in
+// its namespace
+type hostedOperator struct {
+	name    string
+	subject string   // empty if the operator is only configured with keys
+	keys    []string // the identity, signing keys and configured keys
+}
+
+// operatorStatus is the number of accounts hosted for an operator
+type operatorStatus struct {
+	Name     string `json:"name"`
+	Operator string `json:"operator,omitempty"`
+	Accounts int    `json:"accounts"`
+}
+
+func validateOperators(config *conf.AccountServerConfig) error {
+	if len(config.Operators) == 0 {
+		return nil
+	}
+
+	if config.Store.NSC != "" {
+		return fmt.Errorf("an NSC store has a single operator, operators can't be listed")
+	}
+
+	names := map[string]bool{}
+	for _, operator := range config.Operators {
+		if !store.ValidNamespace(operator.Name) {
+			return fmt.Errorf("invalid operator name %q, names need at least 3 letters, digits, '-' or '_'", operator.Name)
+		}
+		if names[operator.Name] {
+			return fmt.Errorf("operator %q is listed twice", operator.Name)
+		}
+		names[operator.Name] = true
+
+		if operator.JWTPath == "" && len(operator.TrustedKeys) == 0 {
+			return fmt.Errorf("operator %q needs a jwtpath or trustedkeys", operator.Name)
+		}
+		for _, k := range operator.TrustedKeys {
+			if !nkeys.IsValidPublicOperatorKey(k) {
+				return fmt.Errorf("operator %q trusted key %q is not an operator public key", operator.Name, k)
+			}
+		}
+	}
+	return nil
+}
+
+// loadOperators reads the JWT of each listed operator, a key can only belong to one of them
+func loadOperators(configs []conf.OperatorConfig) ([]hostedOperator, error) {
+	operators := []hostedOperator{}
+	owners := map[string]string{}
+
+	for _, config := range configs {
+		operator := hostedOperator{
+			name: config.Name,
+			keys: append([]string{}, config.TrustedKeys...),
+		}
+
+		if config.JWTPath != "" {
+			_, claims, err := readOperatorJWT(config.JWTPath)
+			if err != nil {
+				return nil, fmt.Errorf("unable to load operator %q from %s, %s", config.Name, config.JWTPath, err.Error())
+			}
+			operator.subject = claims.Subject
+			operator.keys = trustedKeysFor(config.TrustedKeys, claims)
+		}
+
+		for _, k := range operator.keys {
+			if owner, ok := owners[k]; ok && owner != config.Name {
+				return nil, fmt.Errorf("key %s belongs to operators %q and %q", ShortKey(k), owner, config.Name)
+			}
+			owners[k] = config.Name
+		}
+		operators = append(operators, operator)
+	}
+	return operators, nil
+}
+
+// hostedOperators returns the operators from the operators list
+func (server *AccountServer) hostedOperators() []hostedOperator {
+	server.operatorLock.Lock()
+	defer server.operatorLock.Unlock()
+	return server.operators
+}
+
+// operatorForIssuer returns the name of the listed operator that owns key, empty if none does
+func (server *AccountServer) operatorForIssuer(key string) string {
+	for _, operator := range server.hostedOperators() {
+		for _, k := range operator.keys {
+			if k == key {
+				return operator.name
+			}
+		}
+	}
+	return ""
+}
+
+// namespaceFor is the store namespace for a JWT, the operator that signed the account, or the
+// account that issued an activation or user. Tombstones, JWTs that don't decode and those for
+// accounts that aren't stored yet get an empty namespace, leaving them where they are.
+func (server *AccountServer) namespaceFor(publicKey string, theJWT string) string {
+	if store.IsTombstone(theJWT) {
+		return ""
+	}
+
+	claim, err := jwt.DecodeGeneric(theJWT)
+	if err != nil {
+		return ""
+	}
+
+	if nkeys.IsValidPublicAccountKey(publicKey) {
+		return server.operatorForIssuer(claim.Issuer)
+	}
+
+	account := claim.Issuer
+	if issuerAccount, ok := claim.Data["issuer_account"].(string); ok && issuerAccount != "" {
+		account = issuerAccount
+	}
+	if nkeys.IsValidPublicUserKey(publicKey) && !nkeys.IsValidPublicAccountKey(account) {
+		return ""
+	}
+
+	issuer, ok := server.accounts.issuer(account)
+	if !ok {
+		return ""
+	}
+	return server.operatorForIssuer(issuer)
+}
+
+// operatorCounts returns the number of accounts signed by each listed operator
+func (server *AccountServer) operatorCounts() []operatorStatus {
+	operators := server.hostedOperators()
+	if len(operators) == 0 {
+		return nil
+	}
+
+	issuers := server.accounts.issuerCounts()
+	counts := make([]operatorStatus, 0, len(operators))
+	for _, operator := range operators {
+		status := operatorStatus{Name: operator.name, Operator: operator.subject}
+		for _, k := range operator.keys {
+			status.Accounts += issuers[k]
+		}
+		counts = append(counts, status)
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i].Name < counts[j].Name })
+	return counts
+}
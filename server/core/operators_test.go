@@ -0,0 +1,157 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateOperators(t *testing.T) {
+	operatorKey, err := nkeys.CreateOperator()
+	require.NoError(t, err)
+	operatorPubKey, err := operatorKey.PublicKey()
+	require.NoError(t, err)
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	accountPubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+
+	config := conf.DefaultServerConfig()
+	require.NoError(t, validateOperators(config))
+
+	config.Operators = []conf.OperatorConfig{{Name: "acme", TrustedKeys: []string{operatorPubKey}}}
+	require.NoError(t, validateOperators(config))
+
+	config.Operators = []conf.OperatorConfig{{Name: "ab", TrustedKeys: []string{operatorPubKey}}}
+	require.Error(t, validateOperators(config))
+
+	config.Operators = []conf.OperatorConfig{{Name: "acme", TrustedKeys: []string{operatorPubKey}}, {Name: "acme", TrustedKeys: []string{operatorPubKey}}}
+	require.Error(t, validateOperators(config))
+
+	config.Operators = []conf.OperatorConfig{{Name: "acme"}}
+	require.Error(t, validateOperators(config))
+
+	config.Operators = []conf.OperatorConfig{{Name: "acme", TrustedKeys: []string{accountPubKey}}}
+	require.Error(t, validateOperators(config))
+
+	config.Operators = []conf.OperatorConfig{{Name: "acme", TrustedKeys: []string{operatorPubKey}}}
+	config.Store.NSC = "/tmp/nsc"
+	require.Error(t, validateOperators(config))
+
+	// a key can only belong to one operator
+	_, err = loadOperators([]conf.OperatorConfig{{Name: "acme", TrustedKeys: []string{operatorPubKey}}, {Name: "globex", TrustedKeys: []string{operatorPubKey}}})
+	require.Error(t, err)
+}
+
+func TestOperatorNamespaces(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "operators_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	acmeKey, err := nkeys.CreateOperator()
+	require.NoError(t, err)
+	acmePubKey, err := acmeKey.PublicKey()
+	require.NoError(t, err)
+	acmeJWT, err := jwt.NewOperatorClaims(acmePubKey).Encode(acmeKey)
+	require.NoError(t, err)
+	acmeFile := filepath.Join(dir, "acme.jwt")
+	require.NoError(t, ioutil.WriteFile(acmeFile, []byte(acmeJWT), 0644))
+
+	storeDir := filepath.Join(dir, "store")
+	config := conf.DefaultServerConfig()
+	config.Store.Dir = storeDir
+	config.Operators = []conf.OperatorConfig{{Name: "acme", JWTPath: acmeFile}}
+
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	post := func(pubKey string, theJWT string) {
+		resp, err := testEnv.HTTP.Post(testEnv.URLForPath("/jwt/v1/accounts/"+pubKey), "application/json", bytes.NewBuffer([]byte(theJWT)))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// an account of the hosted operator goes in its namespace
+	acmeAccountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	acmeAccount, err := acmeAccountKey.PublicKey()
+	require.NoError(t, err)
+	acmeAccountJWT, err := jwt.NewAccountClaims(acmeAccount).Encode(acmeKey)
+	require.NoError(t, err)
+	post(acmeAccount, acmeAccountJWT)
+
+	_, err = os.Stat(filepath.Join(storeDir, "acme", acmeAccount+".jwt"))
+	require.NoError(t, err)
+
+	// the main operator's accounts stay at the top of the store
+	mainAccountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	mainAccount, err := mainAccountKey.PublicKey()
+	require.NoError(t, err)
+	mainAccountJWT, err := jwt.NewAccountClaims(mainAccount).Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	post(mainAccount, mainAccountJWT)
+
+	_, err = os.Stat(filepath.Join(storeDir, mainAccount+".jwt"))
+	require.NoError(t, err)
+
+	// lookups search every namespace
+	for pubKey, theJWT := range map[string]string{acmeAccount: acmeAccountJWT, mainAccount: mainAccountJWT} {
+		resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/accounts/" + pubKey))
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, theJWT, string(body))
+	}
+
+	// activations follow the operator of the account that issued them
+	importerKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	importer, err := importerKey.PublicKey()
+	require.NoError(t, err)
+	act := jwt.NewActivationClaims(importer)
+	act.ImportType = jwt.Stream
+	act.ImportSubject = "acme.times"
+	actJWT, err := act.Encode(acmeAccountKey)
+	require.NoError(t, err)
+	hash, err := act.HashID()
+	require.NoError(t, err)
+	require.Equal(t, "acme", testEnv.Server.namespaceFor(hash, actJWT))
+
+	resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/status"))
+	require.NoError(t, err)
+	status := serverStatus{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	resp.Body.Close()
+	require.Equal(t, []operatorStatus{{Name: "acme", Operator: acmePubKey, Accounts: 1}}, status.Operators)
+	require.Equal(t, 2, status.Accounts)
+}
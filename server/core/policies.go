@@ -0,0 +1,203 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/logging"
+)
+
+// AccountValidator checks an account JWT against an organization policy, the error says what
+// is wrong with the JWT if it fails
+type AccountValidator func(claim *jwt.AccountClaims) error
+
+// accountPolicy is a validator and the name its failures are reported under
+type accountPolicy struct {
+	name     string
+	validate AccountValidator
+}
+
+// policyError lists the policies an account JWT failed
+type policyError struct {
+	failures []string
+}
+
+func (e policyError) Error() string {
+	return fmt.Sprintf("account JWT failed %d policies, %s", len(e.failures), strings.Join(e.failures, "; "))
+}
+
+// AddAccountValidator registers a policy, checked along with the ones turned on in the config,
+// for servers embedded as a library. Uploads that fail it are rejected with a 422.
+func (server *AccountServer) AddAccountValidator(name string, validator AccountValidator) {
+	server.Lock()
+	defer server.Unlock()
+	server.validators = append(server.validators, accountPolicy{name: name, validate: validator})
+}
+
+// builtinPolicies are the policies turned on in config
+func builtinPolicies(config conf.PolicyConfig) []accountPolicy {
+	policies := []accountPolicy{}
+
+	if config.RequireMaxConnections {
+		policies = append(policies, accountPolicy{name: "max-connections-required", validate: func(claim *jwt.AccountClaims) error {
+			if claim.Limits.Conn < 0 {
+				return fmt.Errorf("limits.conn must be set")
+			}
+			return nil
+		}})
+	}
+
+	if len(config.ForbiddenExports) > 0 {
+		forbidden := config.ForbiddenExports
+		policies = append(policies, accountPolicy{name: "forbidden-exports", validate: func(claim *jwt.AccountClaims) error {
+			for _, export := range claim.Exports {
+				for _, subject := range forbidden {
+					if subjectsOverlap(string(export.Subject), subject) {
+						return fmt.Errorf("export %s overlaps %s", export.Subject, subject)
+					}
+				}
+			}
+			return nil
+		}})
+	}
+
+	if max := config.MaxSigningKeys; max > 0 {
+		policies = append(policies, accountPolicy{name: "max-signing-keys", validate: func(claim *jwt.AccountClaims) error {
+			if len(claim.SigningKeys) > max {
+				return fmt.Errorf("%d signing keys, the limit is %d", len(claim.SigningKeys), max)
+			}
+			return nil
+		}})
+	}
+
+	return policies
+}
+
+// subjectsOverlap is true if a message could be published to a subject matching both a and b
+func subjectsOverlap(a string, b string) bool {
+	aTokens := strings.Split(a, ".")
+	bTokens := strings.Split(b, ".")
+
+	for i := 0; i < len(aTokens) && i < len(bTokens); i++ {
+		at, bt := aTokens[i], bTokens[i]
+		if at == ">" || bt == ">" {
+			return true
+		}
+		if at != bt && at != "*" && bt != "*" {
+			return false
+		}
+	}
+	return len(aTokens) == len(bTokens)
+}
+
+// checkPolicies runs the configured and registered policies, returning a policyError with
+// every failure
+func (server *AccountServer) checkPolicies(claim *jwt.AccountClaims) error {
+	server.Lock()
+	policies := append(builtinPolicies(server.config.Policies), server.validators...)
+	server.Unlock()
+
+	failures := []string{}
+	for _, policy := range policies {
+		if err := policy.validate(claim); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", policy.name, err.Error()))
+		}
+	}
+
+	if len(failures) == 0 {
+		return nil
+	}
+	return policyError{failures: failures}
+}
+
+// sendPolicyError rejects an account JWT that failed policies with a 422 listing the failures
+func (server *AccountServer) sendPolicyError(account string, err policyError, w http.ResponseWriter) {
+	fields := logging.Fields{"status": http.StatusUnprocessableEntity, "account": account, "error": err}
+	server.logger.WithContext(requestContext(w)).WithFields(fields).Errorf("%s - %s", ShortKey(account), err.Error())
+
+	if wantsPlainErrors(w) {
+		writeError(w, http.StatusUnprocessableEntity, CodePolicyViolation, err.Error(), account)
+		return
+	}
+
+	data, _ := json.Marshal(errorResponse{
+		Code:     CodePolicyViolation,
+		Message:  err.Error(),
+		Account:  account,
+		Failures: err.failures,
+	})
+
+	w.Header().Set(ContentType, ApplicationJSON)
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	w.Write(data)
+}
+
+// flaggedAccount is an account JWT from a notification that failed a policy and was saved anyway
+type flaggedAccount struct {
+	Account   string    `json:"account"`
+	JTI       string    `json:"jti"`
+	Failures  []string  `json:"failures"`
+	FlaggedAt time.Time `json:"flagged_at"`
+}
+
+// policyFlags holds the flagged accounts, a flag is cleared when the account gets another JWT
+type policyFlags struct {
+	sync.Mutex
+	entries map[string]flaggedAccount
+}
+
+func newPolicyFlags() *policyFlags {
+	return &policyFlags{
+		entries: map[string]flaggedAccount{},
+	}
+}
+
+func (f *policyFlags) flag(entry flaggedAccount) {
+	f.Lock()
+	defer f.Unlock()
+	f.entries[entry.Account] = entry
+}
+
+// clear drops the flag for account unless it is for the JWT with jti
+func (f *policyFlags) clear(account string, jti string) {
+	f.Lock()
+	defer f.Unlock()
+	if entry, ok := f.entries[account]; ok && (jti == "" || entry.JTI != jti) {
+		delete(f.entries, account)
+	}
+}
+
+// list returns the flagged accounts, sorted by account
+func (f *policyFlags) list() []flaggedAccount {
+	f.Lock()
+	defer f.Unlock()
+	flagged := make([]flaggedAccount, 0, len(f.entries))
+	for _, entry := range f.entries {
+		flagged = append(flagged, entry)
+	}
+	sort.Slice(flagged, func(i, j int) bool { return flagged[i].Account < flagged[j].Account })
+	return flagged
+}
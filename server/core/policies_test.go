@@ -0,0 +1,188 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubjectsOverlap(t *testing.T) {
+	tests := []struct {
+		a, b    string
+		overlap bool
+	}{
+		{"$SYS.REQ.ACCOUNT", "$SYS.>", true},
+		{">", "$SYS.>", true},
+		{"*.REQ", "$SYS.>", true},
+		{"$SYS", "$SYS.>", false},
+		{"orders.*", "orders.new", true},
+		{"orders.new", "orders.old", false},
+		{"orders.*", "orders.new.eu", false},
+		{"orders", "orders", true},
+	}
+
+	for _, test := range tests {
+		require.Equal(t, test.overlap, subjectsOverlap(test.a, test.b), "%s and %s", test.a, test.b)
+		require.Equal(t, test.overlap, subjectsOverlap(test.b, test.a), "%s and %s", test.b, test.a)
+	}
+}
+
+func TestUploadPolicies(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Policies = conf.PolicyConfig{
+		RequireMaxConnections: true,
+		ForbiddenExports:      []string{"$SYS.>"},
+		MaxSigningKeys:        1,
+	}
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	post := func(account *jwt.AccountClaims) *http.Response {
+		acctJWT, err := account.Encode(testEnv.OperatorKey)
+		require.NoError(t, err)
+		url := testEnv.URLForPath(fmt.Sprintf("/jwt/v1/accounts/%s", account.Subject))
+		resp, err := testEnv.HTTP.Post(url, "application/json", bytes.NewBuffer([]byte(acctJWT)))
+		require.NoError(t, err)
+		return resp
+	}
+
+	_, pubKey, _ := CreateAccountKey(t)
+	_, signingKey1, _ := CreateAccountKey(t)
+	_, signingKey2, _ := CreateAccountKey(t)
+
+	account := jwt.NewAccountClaims(pubKey)
+	account.Exports.Add(&jwt.Export{Subject: "$SYS.REQ.>", Type: jwt.Service})
+	account.SigningKeys.Add(signingKey1, signingKey2)
+
+	resp := post(account)
+	require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	apiErr := decodeError(t, resp)
+	require.Equal(t, CodePolicyViolation, apiErr.Code)
+	require.Equal(t, pubKey, apiErr.Account)
+	require.Equal(t, []string{
+		"max-connections-required: limits.conn must be set",
+		"forbidden-exports: export $SYS.REQ.> overlaps $SYS.>",
+		"max-signing-keys: 2 signing keys, the limit is 1",
+	}, apiErr.Failures)
+
+	_, err = testEnv.Server.jwtStore.Load(pubKey)
+	require.Error(t, err)
+
+	account = jwt.NewAccountClaims(pubKey)
+	account.Limits.Conn = 100
+	account.Exports.Add(&jwt.Export{Subject: "orders.>", Type: jwt.Stream})
+	account.SigningKeys.Add(signingKey1)
+	resp = post(account)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// registered validators run with the configured policies
+	testEnv.Server.AddAccountValidator("name-required", func(claim *jwt.AccountClaims) error {
+		if claim.Name == "" {
+			return fmt.Errorf("accounts must be named")
+		}
+		return nil
+	})
+
+	account.Limits.Conn = 200
+	resp = post(account)
+	require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	require.Equal(t, []string{"name-required: accounts must be named"}, decodeError(t, resp).Failures)
+
+	account.Name = "orders"
+	resp = post(account)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestNotifiedPolicyViolations(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	config := testEnv.CreateReplicaConfig("")
+	config.Policies.RequireMaxConnections = true
+	replica := NewAccountServer()
+	replica.InitializeFromConfig(config)
+	require.NoError(t, replica.Start())
+	defer replica.Stop()
+
+	for i := 0; i < 20 && !replica.isSynced(); i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	require.True(t, replica.isSynced())
+
+	post := func(account *jwt.AccountClaims) string {
+		acctJWT, err := account.Encode(testEnv.OperatorKey)
+		require.NoError(t, err)
+		url := testEnv.URLForPath(fmt.Sprintf("/jwt/v1/accounts/%s", account.Subject))
+		resp, err := testEnv.HTTP.Post(url, "application/json", bytes.NewBuffer([]byte(acctJWT)))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		return acctJWT
+	}
+
+	waitForJWT := func(pubKey string, expected string) {
+		for i := 0; i < 20; i++ {
+			if saved, err := replica.jwtStore.Load(pubKey); err == nil && saved == expected {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatalf("replica didn't save the JWT for %s", pubKey)
+	}
+
+	// the primary has no policies, the replica saves the JWT and flags it
+	_, pubKey, _ := CreateAccountKey(t)
+	account := jwt.NewAccountClaims(pubKey)
+	acctJWT := post(account)
+	waitForJWT(pubKey, acctJWT)
+
+	flagged := replica.policyFlags.list()
+	require.Len(t, flagged, 1)
+	require.Equal(t, pubKey, flagged[0].Account)
+	require.Equal(t, account.ID, flagged[0].JTI)
+	require.Equal(t, []string{"max-connections-required: limits.conn must be set"}, flagged[0].Failures)
+
+	// a JWT that passes clears the flag
+	account.Limits.Conn = 10
+	acctJWT = post(account)
+	waitForJWT(pubKey, acctJWT)
+	require.Empty(t, replica.policyFlags.list())
+
+	// strict replicas drop the JWT
+	replica.Lock()
+	strict := *replica.config
+	strict.Policies.Strict = true
+	replica.config = &strict
+	replica.Unlock()
+
+	account.Limits.Conn = -1
+	post(account)
+	time.Sleep(500 * time.Millisecond)
+	require.Empty(t, replica.policyFlags.list())
+	saved, err := replica.jwtStore.Load(pubKey)
+	require.NoError(t, err)
+	require.Equal(t, acctJWT, saved)
+}
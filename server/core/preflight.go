@@ -0,0 +1,245 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+)
+
+// natsURLSchemes are the schemes the NATS client connects with
+var natsURLSchemes = map[string]bool{"nats": true, "tls": true, "ws": true, "wss": true}
+
+// PreflightError lists every problem the preflight checks found
+type PreflightError struct {
+	Problems []string
+}
+
+func (e *PreflightError) Error() string {
+	return fmt.Sprintf("configuration has %d problem(s): %s", len(e.Problems), strings.Join(e.Problems, "; "))
+}
+
+// Preflight checks the settings that otherwise fail after the server has started: the NATS
+// server URLs, credentials and TLS files, the HTTP TLS files, that a directory store can be
+// written and that the primaries answer. Every problem is returned in a PreflightError.
+func (server *AccountServer) Preflight() error {
+	server.Lock()
+	config := server.config
+	server.Unlock()
+
+	if config == nil {
+		return fmt.Errorf("server is not initialized")
+	}
+
+	problems := []string{}
+	add := func(format string, v ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, v...))
+	}
+
+	for _, serverURL := range config.NATS.Servers {
+		if err := checkNATSURL(serverURL); err != nil {
+			add("NATS server %q %s", serverURL, err.Error())
+		}
+	}
+
+	if creds := config.NATS.UserCredentials; creds != "" {
+		if err := checkCredsFile(creds); err != nil {
+			add("NATS credentials %s, %s", creds, err.Error())
+		}
+	}
+
+	if seedFile := config.NATS.NKeySeedFile; seedFile != "" {
+		if kp, err := loadNKeySeed(seedFile); err != nil {
+			add("NATS nkey seed %s, %s", seedFile, err.Error())
+		} else {
+			kp.Wipe()
+		}
+	}
+
+	tlsConfigs := map[string]conf.TLSConf{
+		"NATS TLS": config.NATS.TLS,
+		"HTTP TLS": config.HTTP.TLS,
+	}
+	for i, listener := range config.HTTP.Listeners {
+		tlsConfigs[fmt.Sprintf("HTTP listener %d TLS", i+1)] = listener.TLS
+	}
+	for _, name := range sortedKeys(tlsConfigs) {
+		for _, err := range checkTLSFiles(tlsConfigs[name]) {
+			add("%s %s", name, err.Error())
+		}
+	}
+
+	if config.Store.Dir != "" && !config.Store.ReadOnly {
+		if err := checkWritableDir(config.Store.Dir); err != nil {
+			add("store directory %s %s", config.Store.Dir, err.Error())
+		}
+	}
+
+	if len(config.Primary) > 0 {
+		server.Lock()
+		client := server.createHTTPClient()
+		server.Unlock()
+		for _, primary := range config.Primary {
+			if err := checkPrimary(client, primary); err != nil {
+				add("primary %s %s", primary, err.Error())
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return &PreflightError{Problems: problems}
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]conf.TLSConf) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// checkNATSURL checks a NATS server URL is well formed, the scheme can be left out
+func checkNATSURL(serverURL string) error {
+	if !strings.Contains(serverURL, "://") {
+		serverURL = "nats://" + serverURL
+	}
+
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return fmt.Errorf("is not a valid URL, %s", err.Error())
+	}
+	if !natsURLSchemes[strings.ToLower(u.Scheme)] {
+		return fmt.Errorf("has unsupported scheme %q, use nats, tls, ws or wss", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("has no host")
+	}
+	return nil
+}
+
+// checkCredsFile checks a credentials file has a user JWT and seed
+func checkCredsFile(creds string) error {
+	contents, err := ioutil.ReadFile(creds)
+	if err != nil {
+		return fmt.Errorf("can't be read, %s", err.Error())
+	}
+
+	userJWT, err := jwt.ParseDecoratedJWT(contents)
+	if err != nil {
+		return fmt.Errorf("has no user JWT, %s", err.Error())
+	}
+	if _, err := jwt.DecodeUserClaims(userJWT); err != nil {
+		return fmt.Errorf("has a bad user JWT, %s", err.Error())
+	}
+
+	kp, err := jwt.ParseDecoratedUserNKey(contents)
+	if err != nil {
+		return fmt.Errorf("has no user seed, %s", err.Error())
+	}
+	kp.Wipe()
+	return nil
+}
+
+// checkTLSFiles checks the certificate and key load as a key pair, and the root has certificates
+func checkTLSFiles(tlsConf conf.TLSConf) []error {
+	errs := []error{}
+
+	if tlsConf.Cert != "" || tlsConf.Key != "" {
+		if tlsConf.Cert == "" || tlsConf.Key == "" {
+			errs = append(errs, fmt.Errorf("needs both a certificate and a key"))
+		} else if _, err := tls.LoadX509KeyPair(tlsConf.Cert, tlsConf.Key); err != nil {
+			errs = append(errs, fmt.Errorf("certificate %s and key %s don't load, %s", tlsConf.Cert, tlsConf.Key, err.Error()))
+		}
+	}
+
+	if tlsConf.Root != "" {
+		data, err := ioutil.ReadFile(tlsConf.Root)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("root %s can't be read, %s", tlsConf.Root, err.Error()))
+		} else if !x509.NewCertPool().AppendCertsFromPEM(data) {
+			errs = append(errs, fmt.Errorf("root %s has no certificates", tlsConf.Root))
+		}
+	}
+	return errs
+}
+
+// checkWritableDir creates and removes a file in dir, or in the closest parent if dir doesn't
+// exist yet, since the store creates it
+func checkWritableDir(dir string) error {
+	for {
+		info, err := os.Stat(dir)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("is not a directory")
+			}
+			break
+		}
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("can't be read, %s", err.Error())
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return fmt.Errorf("has no existing parent")
+		}
+		dir = parent
+	}
+
+	f, err := ioutil.TempFile(dir, ".preflight")
+	if err != nil {
+		return fmt.Errorf("is not writable, %s", err.Error())
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkPrimary requests the help page from a primary, any answer but a server error will do
+func checkPrimary(client *http.Client, primary string) error {
+	helpURL := fmt.Sprintf("%s/jwt/v1/help", strings.TrimSuffix(primary, "/"))
+	if _, err := url.Parse(helpURL); err != nil {
+		return fmt.Errorf("is not a valid URL, %s", err.Error())
+	}
+
+	if client.Timeout <= 0 {
+		client.Timeout = 5 * time.Second
+	}
+
+	resp, err := client.Get(helpURL)
+	if err != nil {
+		return fmt.Errorf("didn't respond, %s", err.Error())
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("returned status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestCreds(t *testing.T, dir string) string {
+	_, _, accountKP := CreateAccountKey(t)
+	userKP, err := nkeys.CreateUser()
+	require.NoError(t, err)
+	userKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+	userSeed, err := userKP.Seed()
+	require.NoError(t, err)
+
+	userJWT, err := jwt.NewUserClaims(userKey).Encode(accountKP)
+	require.NoError(t, err)
+	creds, err := jwt.FormatUserConfig(userJWT, userSeed)
+	require.NoError(t, err)
+
+	path := filepath.Join(dir, "user.creds")
+	require.NoError(t, ioutil.WriteFile(path, creds, 0600))
+	return path
+}
+
+func preflightServer(config *conf.AccountServerConfig) *AccountServer {
+	server := NewAccountServer()
+	server.config = config
+	return server
+}
+
+func TestPreflight(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "preflight_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/jwt/v1/help", r.URL.Path)
+	}))
+	defer primary.Close()
+
+	config := conf.DefaultServerConfig()
+	config.NATS.Servers = []string{"nats://localhost:4222", "localhost:4223", "tls://demo.nats.io:4443"}
+	config.NATS.UserCredentials = writeTestCreds(t, dir)
+	config.HTTP.TLS = conf.TLSConf{Cert: certFile, Key: keyFile, Root: caFile}
+	config.Store.Dir = filepath.Join(dir, "store", "jwts")
+	config.Primary = []string{primary.URL}
+
+	require.NoError(t, preflightServer(config).Preflight())
+	_, err = os.Stat(config.Store.Dir)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestPreflightReportsAllProblems(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "preflight_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+
+	notADir := filepath.Join(dir, "file")
+	require.NoError(t, ioutil.WriteFile(notADir, []byte("x"), 0644))
+	badCreds := filepath.Join(dir, "bad.creds")
+	require.NoError(t, ioutil.WriteFile(badCreds, []byte("not creds"), 0644))
+
+	config := conf.DefaultServerConfig()
+	config.NATS.Servers = []string{"nats://localhost:4222", "http://localhost:4222", "nats://"}
+	config.NATS.UserCredentials = badCreds
+	config.NATS.NKeySeedFile = filepath.Join(dir, "missing.nk")
+	config.HTTP.TLS = conf.TLSConf{Cert: certFile, Key: caFile}
+	config.HTTP.Listeners = []conf.ListenerConfig{{TLS: conf.TLSConf{Cert: certFile}}}
+	config.NATS.TLS = conf.TLSConf{Root: badCreds}
+	config.Store.Dir = notADir
+	config.Primary = []string{failing.URL, "http://127.0.0.1:1"}
+
+	err = preflightServer(config).Preflight()
+	require.Error(t, err)
+	pfe, ok := err.(*PreflightError)
+	require.True(t, ok)
+	require.Len(t, pfe.Problems, 10)
+	require.Contains(t, pfe.Problems[0], `"http://localhost:4222" has unsupported scheme`)
+	require.Contains(t, pfe.Problems[1], `"nats://" has no host`)
+	require.Contains(t, pfe.Problems[2], "has a bad user JWT")
+	require.Contains(t, pfe.Problems[3], "missing.nk")
+	require.Contains(t, pfe.Problems[4], "HTTP TLS certificate")
+	require.Contains(t, pfe.Problems[5], "HTTP listener 1 TLS needs both a certificate and a key")
+	require.Contains(t, pfe.Problems[6], "NATS TLS root")
+	require.Contains(t, pfe.Problems[7], "is not a directory")
+	require.Contains(t, pfe.Problems[8], "returned status 502")
+	require.Contains(t, pfe.Problems[9], "didn't respond")
+	require.Contains(t, err.Error(), "configuration has 10 problem(s)")
+
+	// read only stores aren't written
+	config.Store.ReadOnly = true
+	pfe = preflightServer(config).Preflight().(*PreflightError)
+	require.Len(t, pfe.Problems, 9)
+}
@@ -0,0 +1,201 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/logging"
+)
+
+const (
+	// primaryFailureLimit is the number of failures in a row that mark a primary unhealthy
+	primaryFailureLimit = 3
+
+	// primaryProbeInterval is how long an unhealthy primary is skipped before it is tried again
+	primaryProbeInterval = 30 * time.Second
+)
+
+// primaryState is the health of one primary
+type primaryState struct {
+	url      string
+	failures int
+	retryAt  time.Time // set while unhealthy, the primary is skipped until then
+}
+
+// primaryPool holds a replica's primaries in the order they are tried
+type primaryPool struct {
+	sync.Mutex
+	primaries []*primaryState
+	lastUsed  string // the primary that answered the last successful fetch
+}
+
+// newPrimaryPool returns a pool for the URLs, empty entries are dropped.
+// Nil is returned if there aren't any URLs, so a nil pool means the server is a primary.
+func newPrimaryPool(urls []string) *primaryPool {
+	pool := &primaryPool{}
+	for _, url := range urls {
+		url = strings.TrimSpace(url)
+		if url != "" {
+			pool.primaries = append(pool.primaries, &primaryState{url: url})
+		}
+	}
+	if len(pool.primaries) == 0 {
+		return nil
+	}
+	return pool
+}
+
+// urls returns every primary, in order
+func (pool *primaryPool) urls() []string {
+	urls := make([]string, len(pool.primaries))
+	for i, p := range pool.primaries {
+		urls[i] = p.url
+	}
+	return urls
+}
+
+// candidates returns the primaries to try, in order, skipping unhealthy ones that aren't due
+// to be probed again. If every primary is unhealthy they are all returned, so a fetch is always tried.
+func (pool *primaryPool) candidates(now time.Time) []string {
+	pool.Lock()
+	defer pool.Unlock()
+
+	urls := []string{}
+	for _, p := range pool.primaries {
+		if p.retryAt.IsZero() || !now.Before(p.retryAt) {
+			urls = append(urls, p.url)
+		}
+	}
+	if len(urls) == 0 {
+		return pool.urls()
+	}
+	return urls
+}
+
+// answered marks the primary healthy, any response other than a server error counts. True is
+// returned if the primary was unhealthy.
+func (pool *primaryPool) answered(url string) bool {
+	pool.Lock()
+	defer pool.Unlock()
+
+	p := pool.find(url)
+	if p == nil {
+		return false
+	}
+
+	wasUnhealthy := !p.retryAt.IsZero()
+	p.failures = 0
+	p.retryAt = time.Time{}
+	return wasUnhealthy
+}
+
+// served records the primary as the one that answered the last successful fetch
+func (pool *primaryPool) served(url string) {
+	pool.Lock()
+	defer pool.Unlock()
+	pool.lastUsed = url
+}
+
+// failed counts a failure, and returns true if it made the primary unhealthy. An unhealthy
+// primary that fails a probe waits for the next one.
+func (pool *primaryPool) failed(url string, now time.Time) bool {
+	pool.Lock()
+	defer pool.Unlock()
+
+	p := pool.find(url)
+	if p == nil {
+		return false
+	}
+
+	p.failures++
+	if p.failures < primaryFailureLimit {
+		return false
+	}
+
+	wasHealthy := p.retryAt.IsZero()
+	p.retryAt = now.Add(primaryProbeInterval)
+	return wasHealthy
+}
+
+// failures returns the consecutive failures of each primary, in order
+func (pool *primaryPool) failures() map[string]int {
+	pool.Lock()
+	defer pool.Unlock()
+
+	failures := map[string]int{}
+	for _, p := range pool.primaries {
+		failures[p.url] = p.failures
+	}
+	return failures
+}
+
+// primaryFailed counts a failure for the primary, and logs when it becomes unhealthy. Both state
+// changes are logged as "primary state changed" with the primary and its state as fields.
+func (server *AccountServer) primaryFailed(primaries *primaryPool, primary string) {
+	if primaries.failed(primary, time.Now()) {
+		server.logger.WithFields(logging.Fields{"primary": primary, "primary_state": "unhealthy"}).Warnf("primary state changed, %s is unhealthy after %d failures, will try it again in %s", primary, primaryFailureLimit, primaryProbeInterval)
+	}
+}
+
+// primaryAnswered marks the primary healthy, and logs when it was unhealthy
+func (server *AccountServer) primaryAnswered(primaries *primaryPool, primary string) {
+	if primaries.answered(primary) {
+		server.logger.WithFields(logging.Fields{"primary": primary, "primary_state": "healthy"}).Noticef("primary state changed, %s is healthy", primary)
+	}
+}
+
+// unhealthy returns the primaries that are being skipped
+func (pool *primaryPool) unhealthy() []string {
+	pool.Lock()
+	defer pool.Unlock()
+
+	urls := []string{}
+	for _, p := range pool.primaries {
+		if !p.retryAt.IsZero() {
+			urls = append(urls, p.url)
+		}
+	}
+	return urls
+}
+
+// last returns the primary that answered the last successful fetch, empty if none has
+func (pool *primaryPool) last() string {
+	pool.Lock()
+	defer pool.Unlock()
+	return pool.lastUsed
+}
+
+// find returns the state for a URL, lock should be held
+func (pool *primaryPool) find(url string) *primaryState {
+	for _, p := range pool.primaries {
+		if p.url == url {
+			return p
+		}
+	}
+	return nil
+}
+
+// String returns the primaries joined with commas, empty for a nil pool
+func (pool *primaryPool) String() string {
+	if pool == nil {
+		return ""
+	}
+	return strings.Join(pool.urls(), ",")
+}
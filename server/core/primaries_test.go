@@ -0,0 +1,218 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrimaryPool(t *testing.T) {
+	require.Nil(t, newPrimaryPool(nil))
+	require.Nil(t, newPrimaryPool([]string{"", " "}))
+
+	pool := newPrimaryPool([]string{"http://a", " http://b ", ""})
+	require.Equal(t, []string{"http://a", "http://b"}, pool.urls())
+	require.Equal(t, "http://a,http://b", pool.String())
+
+	now := time.Now()
+	require.Equal(t, []string{"http://a", "http://b"}, pool.candidates(now))
+
+	// unhealthy after the failure limit
+	for i := 1; i < primaryFailureLimit; i++ {
+		require.False(t, pool.failed("http://a", now))
+	}
+	require.True(t, pool.failed("http://a", now))
+	require.Equal(t, []string{"http://a"}, pool.unhealthy())
+	require.Equal(t, []string{"http://b"}, pool.candidates(now))
+
+	// a failed probe doesn't report it again
+	require.False(t, pool.failed("http://a", now))
+
+	// probed again after the interval
+	require.Equal(t, []string{"http://a", "http://b"}, pool.candidates(now.Add(primaryProbeInterval)))
+
+	// everything is tried when nothing is healthy
+	for i := 0; i < primaryFailureLimit; i++ {
+		pool.failed("http://b", now)
+	}
+	require.Equal(t, []string{"http://a", "http://b"}, pool.candidates(now))
+
+	pool.answered("http://a")
+	pool.served("http://a")
+	require.Equal(t, []string{"http://b"}, pool.unhealthy())
+	require.Equal(t, "http://a", pool.last())
+}
+
+func TestReplicaFailsOverToNextPrimary(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	jwts := saveTestAccounts(t, testEnv, 1)
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	config := testEnv.CreateReplicaConfig("")
+	config.Primary = []string{down.URL, testEnv.URLForPath("/")}
+	config.NATS.Servers = nil
+	replica := NewAccountServer()
+	replica.InitializeFromConfig(config)
+	require.NoError(t, replica.Start())
+	defer replica.Stop()
+
+	for pubKey, expected := range jwts {
+		for i := 0; i < primaryFailureLimit; i++ {
+			theJWT, err := replica.fetchFromPrimary(pubKey, accountsPath, "")
+			require.NoError(t, err)
+			require.Equal(t, expected, theJWT)
+		}
+	}
+
+	primaries, _ := replica.currentPrimaries()
+	require.Equal(t, []string{down.URL}, primaries.unhealthy())
+	require.Equal(t, testEnv.URLForPath("/"), primaries.last())
+	require.Equal(t, []string{testEnv.URLForPath("/")}, primaries.candidates(time.Now()))
+
+	// the initial sync also skips the primary that is down
+	replica.Lock()
+	replica.syncAfter = ""
+	replica.Unlock()
+	count, err := replica.syncFromPrimary()
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+}
+
+func TestFetchOutcome(t *testing.T) {
+	require.Equal(t, fetchOK, fetchOutcome(http.StatusOK, nil))
+	require.Equal(t, fetchOK, fetchOutcome(http.StatusNotModified, nil))
+	require.Equal(t, fetch4xx, fetchOutcome(http.StatusNotFound, nil))
+	require.Equal(t, fetch5xx, fetchOutcome(http.StatusServiceUnavailable, nil))
+	require.Equal(t, fetchConnError, fetchOutcome(0, fmt.Errorf("connection refused")))
+
+	client := &http.Client{Timeout: 10 * time.Millisecond}
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer slow.Close()
+	_, err := client.Get(slow.URL)
+	require.Error(t, err)
+	require.Equal(t, fetchTimeout, fetchOutcome(0, err))
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	var h latencyHistogram
+	h.observe(fetchOK, 3*time.Millisecond)
+	h.observe(fetchOK, 40*time.Millisecond)
+	h.observe(fetchOK, time.Minute)
+
+	values := h.values("outcome", []string{fetchOK, fetch5xx})
+	require.Contains(t, values, `_bucket{outcome="ok",le="0.005"} 1`)
+	require.Contains(t, values, `_bucket{outcome="ok",le="0.05"} 2`)
+	require.Contains(t, values, `_bucket{outcome="ok",le="10"} 2`)
+	require.Contains(t, values, `_bucket{outcome="ok",le="+Inf"} 3`)
+	require.Contains(t, values, `_count{outcome="ok"} 3`)
+	require.Contains(t, values, `_count{outcome="5xx"} 0`)
+	require.Len(t, values, 2*(len(latencyBuckets)+3))
+}
+
+func TestPrimaryFetchMetrics(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	jwts := saveTestAccounts(t, testEnv, 1)
+
+	var down int32 = 1
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// no pack, so the initial sync doesn't count as a failure
+		if r.URL.Path == "/jwt/v1/pack" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if atomic.LoadInt32(&down) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		for _, theJWT := range jwts {
+			w.Write([]byte(theJWT))
+		}
+	}))
+	defer primary.Close()
+
+	config := testEnv.CreateReplicaConfig("")
+	config.Primary = []string{primary.URL}
+	config.NATS.Servers = nil
+	replica := NewAccountServer()
+	replica.InitializeFromConfig(config)
+	require.NoError(t, replica.Start())
+	defer replica.Stop()
+
+	// the 404 for the pack resets the failure count, so wait for the initial sync to give up first
+	for i := 0; i < 50 && !replica.isSynced(); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.True(t, replica.isSynced())
+
+	logger := newRecordingLogger()
+	replica.Lock()
+	replica.logger = logger
+	replica.Unlock()
+
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		replica.GetMetrics(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil), nil)
+		return rec.Body.String()
+	}
+
+	for pubKey := range jwts {
+		for i := 0; i < primaryFailureLimit; i++ {
+			_, err := replica.fetchFromPrimary(pubKey, accountsPath, "")
+			require.Error(t, err)
+		}
+
+		metrics := scrape()
+		require.Contains(t, metrics, fmt.Sprintf(`nats_account_server_primary_consecutive_failures{primary=%q} %d`, primary.URL, primaryFailureLimit))
+		require.Contains(t, metrics, fmt.Sprintf(`nats_account_server_primary_fetch_duration_seconds_count{outcome="5xx"} %d`, primaryFailureLimit))
+
+		unhealthy := logger.find("primary state changed")
+		require.Len(t, unhealthy, 1)
+		require.Equal(t, "unhealthy", unhealthy[0].fields["primary_state"])
+
+		atomic.StoreInt32(&down, 0)
+		_, err := replica.fetchFromPrimary(pubKey, accountsPath, "")
+		require.NoError(t, err)
+
+		metrics = scrape()
+		require.Contains(t, metrics, fmt.Sprintf(`nats_account_server_primary_consecutive_failures{primary=%q} 0`, primary.URL))
+		require.Contains(t, metrics, `nats_account_server_primary_fetch_duration_seconds_count{outcome="ok"} 1`)
+
+		changes := logger.find("primary state changed")
+		require.Len(t, changes, 2)
+		require.Equal(t, "healthy", changes[1].fields["primary_state"])
+	}
+}
@@ -0,0 +1,197 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/nats-account-server/server/conf"
+)
+
+// request classes with their own rate limit
+const (
+	readRequests  = "read"
+	writeRequests = "write"
+)
+
+// clientBucket is the token bucket for one client IP
+type clientBucket struct {
+	ip     string
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a token bucket per client IP, only the most recently seen clients are kept
+// so the state stays bounded. A forgotten client starts again with a full bucket.
+type rateLimiter struct {
+	sync.Mutex
+	rate       float64
+	burst      float64
+	maxClients int
+	clients    map[string]*list.Element
+	lru        *list.List
+}
+
+// newRateLimiter returns nil if the config doesn't set a rate
+func newRateLimiter(config conf.RateLimitConfig, maxClients int) *rateLimiter {
+	if config.Rate <= 0 {
+		return nil
+	}
+
+	burst := float64(config.Burst)
+	if burst <= 0 {
+		burst = math.Max(1, config.Rate)
+	}
+
+	return &rateLimiter{
+		rate:       config.Rate,
+		burst:      burst,
+		maxClients: maxClients,
+		clients:    map[string]*list.Element{},
+		lru:        list.New(),
+	}
+}
+
+// allow takes a token from the client's bucket, if the bucket is empty false is returned with
+// the time until the next token
+func (limiter *rateLimiter) allow(ip string, now time.Time) (bool, time.Duration) {
+	limiter.Lock()
+	defer limiter.Unlock()
+
+	var bucket *clientBucket
+	if e, ok := limiter.clients[ip]; ok {
+		limiter.lru.MoveToFront(e)
+		bucket = e.Value.(*clientBucket)
+		bucket.tokens = math.Min(limiter.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*limiter.rate)
+		bucket.last = now
+	} else {
+		bucket = &clientBucket{ip: ip, tokens: limiter.burst, last: now}
+		limiter.clients[ip] = limiter.lru.PushFront(bucket)
+
+		for limiter.maxClients > 0 && limiter.lru.Len() > limiter.maxClients {
+			oldest := limiter.lru.Back()
+			limiter.lru.Remove(oldest)
+			delete(limiter.clients, oldest.Value.(*clientBucket).ip)
+		}
+	}
+
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / limiter.rate * float64(time.Second))
+	}
+
+	bucket.tokens--
+	return true, 0
+}
+
+// size returns the number of clients being tracked
+func (limiter *rateLimiter) size() int {
+	limiter.Lock()
+	defer limiter.Unlock()
+	return limiter.lru.Len()
+}
+
+// rateLimits holds the limiters for each request class, a nil limiter doesn't limit
+type rateLimits struct {
+	reads  *rateLimiter
+	writes *rateLimiter
+	exempt []*net.IPNet
+}
+
+// newRateLimits parses the config, the exempt entries can be IPs or CIDR blocks
+func newRateLimits(config conf.RateLimitsConfig) (*rateLimits, error) {
+	if config.Reads.Rate < 0 || config.Writes.Rate < 0 {
+		return nil, fmt.Errorf("rate limits cannot be negative, use 0 for no limit")
+	}
+
+	limits := &rateLimits{
+		reads:  newRateLimiter(config.Reads, config.MaxClients),
+		writes: newRateLimiter(config.Writes, config.MaxClients),
+	}
+
+	exempt, err := parseIPBlocks(config.Exempt, "rate limit exemption")
+	if err != nil {
+		return nil, err
+	}
+	limits.exempt = exempt
+
+	return limits, nil
+}
+
+// allow checks a request against the limiter for its class, requests from exempt IPs and
+// classes without a limit are always allowed
+func (limits *rateLimits) allow(class string, r *http.Request, now time.Time) (bool, time.Duration) {
+	limiter := limits.reads
+	if class == writeRequests {
+		limiter = limits.writes
+	}
+	if limiter == nil {
+		return true, 0
+	}
+
+	ip := clientIP(r)
+	if parsed := net.ParseIP(ip); parsed != nil && blocksContain(limits.exempt, parsed) {
+		return true, 0
+	}
+
+	return limiter.allow(ip, now)
+}
+
+// clientIP returns the IP a request came from, without the port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimited wraps a handler with the rate limit for its class, requests over the limit get
+// a 429 with a Retry-After header
+func (server *AccountServer) rateLimited(class string, handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		server.Lock()
+		limits := server.rateLimits
+		server.Unlock()
+
+		if limits != nil {
+			if ok, wait := limits.allow(class, r, time.Now()); !ok {
+				if class == writeRequests {
+					atomic.AddUint64(&server.metrics.throttledWrites, 1)
+				} else {
+					atomic.AddUint64(&server.metrics.throttledReads, 1)
+				}
+
+				// a client over its limit can send a lot of these, so they aren't logged as errors
+				server.logger.Debugf("throttled %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				writeError(w, http.StatusTooManyRequests, CodeRateLimited, "too many requests", "")
+				return
+			}
+		}
+
+		handle(w, r, params)
+	}
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter(t *testing.T) {
+	require.Nil(t, newRateLimiter(conf.RateLimitConfig{}, 10))
+
+	limiter := newRateLimiter(conf.RateLimitConfig{Rate: 2, Burst: 3}, 2)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		ok, _ := limiter.allow("a", now)
+		require.True(t, ok)
+	}
+	ok, wait := limiter.allow("a", now)
+	require.False(t, ok)
+	require.Equal(t, 500*time.Millisecond, wait)
+
+	// other clients have their own bucket
+	ok, _ = limiter.allow("b", now)
+	require.True(t, ok)
+
+	// tokens come back at the rate
+	ok, _ = limiter.allow("a", now.Add(500*time.Millisecond))
+	require.True(t, ok)
+	ok, _ = limiter.allow("a", now.Add(500*time.Millisecond))
+	require.False(t, ok)
+
+	// the least recently seen client is forgotten
+	limiter.allow("c", now)
+	require.Equal(t, 2, limiter.size())
+	_, tracked := limiter.clients["b"]
+	require.False(t, tracked)
+
+	// the burst defaults to the rate
+	limiter = newRateLimiter(conf.RateLimitConfig{Rate: 0.5}, 0)
+	ok, _ = limiter.allow("a", now)
+	require.True(t, ok)
+	ok, wait = limiter.allow("a", now)
+	require.False(t, ok)
+	require.Equal(t, 2*time.Second, wait)
+}
+
+func TestRateLimitsConfig(t *testing.T) {
+	_, err := newRateLimits(conf.RateLimitsConfig{Reads: conf.RateLimitConfig{Rate: -1}})
+	require.Error(t, err)
+
+	_, err = newRateLimits(conf.RateLimitsConfig{Exempt: []string{"not an ip"}})
+	require.Error(t, err)
+
+	limits, err := newRateLimits(conf.RateLimitsConfig{
+		Reads:  conf.RateLimitConfig{Rate: 1},
+		Exempt: []string{"10.0.0.0/8", "192.168.1.1", "::1"},
+	})
+	require.NoError(t, err)
+
+	request := func(remote string) *http.Request {
+		r, err := http.NewRequest(http.MethodGet, "/", nil)
+		require.NoError(t, err)
+		r.RemoteAddr = remote
+		return r
+	}
+
+	now := time.Now()
+	for _, remote := range []string{"10.1.2.3:4000", "192.168.1.1:4000", "[::1]:4000"} {
+		for i := 0; i < 3; i++ {
+			ok, _ := limits.allow(readRequests, request(remote), now)
+			require.True(t, ok, remote)
+		}
+	}
+
+	ok, _ := limits.allow(readRequests, request("192.168.1.2:4000"), now)
+	require.True(t, ok)
+	ok, _ = limits.allow(readRequests, request("192.168.1.2:4001"), now)
+	require.False(t, ok)
+
+	// writes aren't limited
+	ok, _ = limits.allow(writeRequests, request("192.168.1.2:4000"), now)
+	require.True(t, ok)
+}
+
+func TestRateLimitedRequests(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.HTTP.RateLimits.Reads = conf.RateLimitConfig{Rate: 0.01, Burst: 2}
+	config.HTTP.RateLimits.Writes = conf.RateLimitConfig{Rate: 0.01, Burst: 1}
+	config.HTTP.RateLimits.Exempt = nil
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	get := func(path string) *http.Response {
+		resp, err := testEnv.HTTP.Get(testEnv.URLForPath(path))
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	require.Equal(t, http.StatusOK, get("/jwt/v1/accounts/").StatusCode)
+	require.Equal(t, http.StatusOK, get("/jwt/v1/accounts/").StatusCode)
+
+	resp := get("/jwt/v1/accounts/")
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.Equal(t, "100", resp.Header.Get("Retry-After"))
+
+	// health checks and metrics aren't limited
+	for i := 0; i < 3; i++ {
+		require.Equal(t, http.StatusOK, get("/healthz").StatusCode)
+	}
+
+	// writes have their own bucket
+	post := func() int {
+		resp, err := testEnv.HTTP.Post(testEnv.URLForPath("/jwt/v1/activations"), "application/json", bytes.NewBufferString("not a jwt"))
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusBadRequest, post())
+	require.Equal(t, http.StatusTooManyRequests, post())
+
+	resp, err = testEnv.HTTP.Get(testEnv.URLForPath("/metrics"))
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.True(t, strings.Contains(string(body), `nats_account_server_requests_throttled_total{class="read"} 1`))
+	require.True(t, strings.Contains(string(body), `nats_account_server_requests_throttled_total{class="write"} 1`))
+
+	// localhost is exempt by default
+	next := *testEnv.Server.currentConfig()
+	next.HTTP.RateLimits.Exempt = conf.DefaultServerConfig().HTTP.RateLimits.Exempt
+	require.NoError(t, testEnv.Server.ReloadConfig(&next))
+	require.Equal(t, http.StatusOK, get("/jwt/v1/accounts/").StatusCode)
+}
@@ -0,0 +1,246 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/logging"
+)
+
+// maxHitKeys bounds the JWTs the hit counter tracks between resets, new keys are ignored once it is full
+const maxHitKeys = 100000
+
+// hotJWT is the request count for a replicated JWT and the primary path it is fetched from
+type hotJWT struct {
+	key  string
+	path string
+	hits uint64
+}
+
+// hitCounter counts the lookups for each replicated JWT, so the refresher can pick the hottest
+type hitCounter struct {
+	sync.Mutex
+	jwts map[string]*hotJWT
+}
+
+func newHitCounter() *hitCounter {
+	return &hitCounter{jwts: map[string]*hotJWT{}}
+}
+
+func (counter *hitCounter) hit(key string, path string) {
+	counter.Lock()
+	defer counter.Unlock()
+
+	hot, ok := counter.jwts[key]
+	if !ok {
+		if len(counter.jwts) >= maxHitKeys {
+			return
+		}
+		hot = &hotJWT{key: key, path: path}
+		counter.jwts[key] = hot
+	}
+	hot.hits++
+}
+
+// hottest returns the counts, the most requested first
+func (counter *hitCounter) hottest() []hotJWT {
+	counter.Lock()
+	jwts := make([]hotJWT, 0, len(counter.jwts))
+	for _, hot := range counter.jwts {
+		jwts = append(jwts, *hot)
+	}
+	counter.Unlock()
+
+	sort.Slice(jwts, func(i, j int) bool {
+		if jwts[i].hits != jwts[j].hits {
+			return jwts[i].hits > jwts[j].hits
+		}
+		return jwts[i].key < jwts[j].key
+	})
+	return jwts
+}
+
+func (counter *hitCounter) reset() {
+	counter.Lock()
+	counter.jwts = map[string]*hotJWT{}
+	counter.Unlock()
+}
+
+func validateReplicaRefresh(config conf.ReplicaRefreshConfig) error {
+	if config.Hottest < 0 || config.Interval < 0 || config.Window < 0 || config.Concurrency < 0 || config.Rate < 0 || config.HitsReset < 0 {
+		return fmt.Errorf("replica refresh settings cannot be negative")
+	}
+
+	if config.Hottest == 0 {
+		return nil
+	}
+
+	if config.Interval == 0 || config.Concurrency == 0 {
+		return fmt.Errorf("replica refresh needs an interval and a concurrency")
+	}
+
+	if config.Window == 0 || config.Window > 100 {
+		return fmt.Errorf("replica refresh window must be between 1 and 100 percent of the cache TTL")
+	}
+	return nil
+}
+
+// startRefresher runs refresh passes until the server stops, the server lock is held. The
+// settings are read for each pass, so a reload can turn the refresher on or off.
+func (server *AccountServer) startRefresher() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	server.refreshStop = stop
+	server.refreshDone = done
+
+	go func() {
+		defer close(done)
+
+		resetAt := time.Now()
+
+		for {
+			config := server.currentConfig().ReplicaRefresh
+			interval := time.Duration(config.Interval) * time.Second
+			if interval <= 0 {
+				interval = time.Second
+			}
+
+			select {
+			case <-time.After(interval):
+			case <-stop:
+				return
+			}
+
+			if config = server.currentConfig().ReplicaRefresh; config.Hottest == 0 {
+				continue
+			}
+
+			server.refreshHottest(config, time.Now(), stop)
+
+			if reset := time.Duration(config.HitsReset) * time.Second; reset > 0 && time.Since(resetAt) >= reset {
+				server.hits.reset()
+				resetAt = time.Now()
+			}
+		}
+	}()
+}
+
+// stopRefresher waits for a pass in progress to notice the server is stopping
+func (server *AccountServer) stopRefresher(stop chan struct{}, done chan struct{}) {
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
+
+// refreshCandidates returns up to config.Hottest of the requested JWTs that go stale within the
+// refresh window, or already have, the most requested first
+func (server *AccountServer) refreshCandidates(config conf.ReplicaRefreshConfig, now time.Time) []hotJWT {
+	candidates := []hotJWT{}
+
+	for _, hot := range server.hits.hottest() {
+		if len(candidates) >= config.Hottest {
+			break
+		}
+
+		ttl := server.replicaTTL(server.cacheTTLForPath(hot.path))
+		if ttl <= 0 {
+			continue
+		}
+		window := time.Duration(ttl) * time.Second * time.Duration(config.Window) / 100
+		if window < time.Second {
+			window = time.Second
+		}
+
+		server.cacheLock.Lock()
+		staleAt, ok := server.validUntil[hot.key]
+		server.cacheLock.Unlock()
+
+		if !ok || staleAt.IsZero() || staleAt.Sub(now) > window {
+			continue
+		}
+		candidates = append(candidates, hot)
+	}
+	return candidates
+}
+
+// refreshHottest fetches the candidates from the primary, config.Concurrency at a time and at
+// most config.Rate a second, and returns the number refreshed
+func (server *AccountServer) refreshHottest(config conf.ReplicaRefreshConfig, now time.Time, stop chan struct{}) int {
+	candidates := server.refreshCandidates(config, now)
+	if len(candidates) == 0 {
+		return 0
+	}
+
+	var pace <-chan time.Time
+	if config.Rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(config.Rate))
+		defer ticker.Stop()
+		pace = ticker.C
+	}
+
+	var refreshed int64
+	wg := sync.WaitGroup{}
+	slots := make(chan struct{}, config.Concurrency)
+
+	for i, hot := range candidates {
+		if i > 0 && pace != nil {
+			select {
+			case <-pace:
+			case <-stop:
+				wg.Wait()
+				return int(refreshed)
+			}
+		}
+
+		if !server.startRefresh(hot.key) {
+			continue
+		}
+
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(hot hotJWT) {
+			defer func() {
+				server.endRefresh(hot.key)
+				<-slots
+				wg.Done()
+			}()
+
+			cached, _ := server.jwtStore.Load(hot.key)
+			if _, err := server.fetchFromPrimary(hot.key, hot.path, cached); err != nil {
+				server.logger.WithFields(logging.Fields{"key": hot.key, "error": err}).Debugf("unable to refresh JWT for %s ahead of time, %s", ShortKey(hot.key), err.Error())
+				return
+			}
+			atomic.AddInt64(&refreshed, 1)
+			atomic.AddUint64(&server.metrics.replicaRefreshes, 1)
+		}(hot)
+	}
+
+	wg.Wait()
+
+	if refreshed > 0 {
+		server.logger.Debugf("refreshed %d of the most requested JWTs before they went stale", refreshed)
+	}
+	return int(refreshed)
+}
@@ -0,0 +1,237 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateReplicaRefresh(t *testing.T) {
+	config := conf.DefaultServerConfig().ReplicaRefresh
+	require.NoError(t, validateReplicaRefresh(config))
+
+	config.Hottest = 100
+	require.NoError(t, validateReplicaRefresh(config))
+
+	bad := config
+	bad.Window = 101
+	require.Error(t, validateReplicaRefresh(bad))
+
+	bad = config
+	bad.Concurrency = 0
+	require.Error(t, validateReplicaRefresh(bad))
+
+	bad = config
+	bad.Rate = -1
+	require.Error(t, validateReplicaRefresh(bad))
+
+	// nothing else matters while the refresher is off
+	bad.Rate = 0
+	bad.Hottest = 0
+	bad.Interval = 0
+	require.NoError(t, validateReplicaRefresh(bad))
+}
+
+func TestHitCounter(t *testing.T) {
+	counter := newHitCounter()
+	counter.hit("b", accountsPath)
+	counter.hit("a", accountsPath)
+	counter.hit("c", activationsPath)
+	counter.hit("c", activationsPath)
+
+	hottest := counter.hottest()
+	require.Len(t, hottest, 3)
+	require.Equal(t, hotJWT{key: "c", path: activationsPath, hits: 2}, hottest[0])
+	require.Equal(t, "a", hottest[1].key)
+	require.Equal(t, "b", hottest[2].key)
+
+	counter.reset()
+	require.Empty(t, counter.hottest())
+}
+
+func TestRefreshHottest(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	jwts := saveTestAccounts(t, testEnv, 3)
+	keys := []string{}
+	for k := range jwts {
+		keys = append(keys, k)
+	}
+
+	config := testEnv.CreateReplicaConfig("")
+	config.NATS.Servers = nil
+	replica := NewAccountServer()
+	replica.InitializeFromConfig(config)
+	require.NoError(t, replica.Start())
+	defer replica.Stop()
+
+	// the first key is the most requested, the last is the least and isn't close to going stale
+	for i, k := range keys {
+		for j := i; j < len(keys); j++ {
+			_, err := replica.loadAccountJWT(k)
+			require.NoError(t, err)
+		}
+	}
+
+	now := time.Now()
+	soon := now.Add(time.Minute) // within 10% of the hour long TTL
+	replica.cacheLock.Lock()
+	replica.validUntil[keys[0]] = soon
+	replica.validUntil[keys[1]] = now.Add(-time.Second)
+	replica.cacheLock.Unlock()
+
+	refresh := conf.DefaultServerConfig().ReplicaRefresh
+	refresh.Hottest = 1
+	require.Equal(t, 1, replica.refreshHottest(refresh, now, nil))
+
+	replica.cacheLock.Lock()
+	require.True(t, replica.validUntil[keys[0]].After(soon))
+	require.True(t, replica.validUntil[keys[1]].Before(now))
+	replica.cacheLock.Unlock()
+
+	refresh.Hottest = 3
+	require.Equal(t, 1, replica.refreshHottest(refresh, now, nil))
+	require.Equal(t, 0, replica.refreshHottest(refresh, now, nil))
+	require.Equal(t, uint64(2), atomic.LoadUint64(&replica.metrics.replicaRefreshes))
+
+	replica.cacheLock.Lock()
+	require.True(t, replica.validUntil[keys[1]].After(soon))
+	replica.cacheLock.Unlock()
+
+	// keys already being fetched are skipped
+	replica.cacheLock.Lock()
+	replica.validUntil[keys[0]] = soon
+	replica.cacheLock.Unlock()
+	require.True(t, replica.startRefresh(keys[0]))
+	require.Equal(t, 0, replica.refreshHottest(refresh, now, nil))
+	replica.endRefresh(keys[0])
+	require.Equal(t, 1, replica.refreshHottest(refresh, now, nil))
+}
+
+func TestRefresherRunsInBackground(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	jwts := saveTestAccounts(t, testEnv, 1)
+
+	config := testEnv.CreateReplicaConfig("")
+	config.NATS.Servers = nil
+	config.ReplicaRefresh.Hottest = 10
+	config.ReplicaRefresh.Interval = 1
+	replica := NewAccountServer()
+	replica.InitializeFromConfig(config)
+	require.NoError(t, replica.Start())
+	defer replica.Stop()
+
+	for k := range jwts {
+		_, err := replica.loadAccountJWT(k)
+		require.NoError(t, err)
+
+		replica.cacheLock.Lock()
+		replica.validUntil[k] = time.Now().Add(time.Second)
+		replica.cacheLock.Unlock()
+	}
+
+	for i := 0; i < 50 && atomic.LoadUint64(&replica.metrics.replicaRefreshes) == 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Equal(t, uint64(1), atomic.LoadUint64(&replica.metrics.replicaRefreshes))
+}
+
+// BenchmarkReplicaLookup compares lookups of a JWT that went stale, which wait on a primary that
+// takes a few milliseconds to answer, with lookups of a JWT the refresher fetched ahead of time
+func BenchmarkReplicaLookup(b *testing.B) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	accountKey, _ := nkeys.CreateAccount()
+	pubKey, _ := accountKey.PublicKey()
+	acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(5 * time.Millisecond)
+		w.Write([]byte(acctJWT))
+	}))
+	defer primary.Close()
+
+	config := testEnv.CreateReplicaConfig("")
+	config.Primary = []string{primary.URL}
+	config.NATS.Servers = nil
+	config.Logging.Debug = false
+	config.Logging.Trace = false
+	replica := NewAccountServer()
+	replica.InitializeFromConfig(config)
+	if err := replica.Start(); err != nil {
+		b.Fatal(err)
+	}
+	defer replica.Stop()
+
+	makeStale := func() {
+		replica.cacheLock.Lock()
+		replica.validUntil[pubKey] = time.Now().Add(-time.Second)
+		replica.cacheLock.Unlock()
+	}
+
+	lookup := func(b *testing.B) {
+		if _, err := replica.loadAccountJWT(pubKey); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.Run("OnDemand", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			makeStale()
+			b.StartTimer()
+			lookup(b)
+		}
+	})
+
+	b.Run("Refreshed", func(b *testing.B) {
+		lookup(b)
+		makeStale()
+
+		refresh := conf.DefaultServerConfig().ReplicaRefresh
+		refresh.Hottest = 1
+		if count := replica.refreshHottest(refresh, time.Now(), nil); count != 1 {
+			b.Fatalf("refreshed %d JWTs", count)
+		}
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			lookup(b)
+		}
+	})
+}
@@ -0,0 +1,241 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/logging"
+	"github.com/nats-io/nats-account-server/server/store"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+const (
+	// relays request account JWTs on <prefix>.ACCOUNT.<pubkey> and activations on <prefix>.ACTIVATION.<hash>
+	relayAccountToken    = "ACCOUNT"
+	relayActivationToken = "ACTIVATION"
+
+	// RelayErrorHeader carries the error when the upstream can't load a JWT for a relay. An empty
+	// reply without it, or a tombstone header, means the JWT isn't stored.
+	RelayErrorHeader = "Nats-Relay-Error"
+)
+
+// errUpstreamTimeout is returned when a relay's upstream doesn't answer, lookups return a 504 for it
+var errUpstreamTimeout = errors.New("upstream account server did not answer")
+
+// relaySubject is the subject a relay requests the JWT for key on
+func relaySubject(prefix string, path string, key string) string {
+	token := relayAccountToken
+	if path == activationsPath {
+		token = relayActivationToken
+	}
+	return fmt.Sprintf("%s.%s.%s", prefix, token, key)
+}
+
+func validRelayPrefix(prefix string) bool {
+	return !strings.ContainsAny(prefix, "*> \t") && !strings.HasPrefix(prefix, ".") && !strings.HasSuffix(prefix, ".")
+}
+
+// validateRelay checks the relay settings, relays have no store of their own, they only keep the
+// JWTs from the upstream in memory, and can't be replicas
+func validateRelay(config *conf.AccountServerConfig) error {
+	if prefix := config.NATS.RelaySubjectPrefix; prefix != "" && !validRelayPrefix(prefix) {
+		return fmt.Errorf("relay subject prefix %q is not a valid subject", prefix)
+	}
+
+	relay := config.Relay
+	if relay.UpstreamSubjectPrefix == "" {
+		return nil
+	}
+
+	if !validRelayPrefix(relay.UpstreamSubjectPrefix) {
+		return fmt.Errorf("relay upstream subject prefix %q is not a valid subject", relay.UpstreamSubjectPrefix)
+	}
+
+	if relay.UpstreamSubjectPrefix == config.NATS.RelaySubjectPrefix {
+		return fmt.Errorf("a relay cannot answer its own lookups, the upstream and relay subject prefixes are the same")
+	}
+
+	if relay.Timeout <= 0 {
+		return fmt.Errorf("relay timeout must be positive")
+	}
+
+	if len(config.Primary) > 0 {
+		return fmt.Errorf("relay mode cannot be used with a primary")
+	}
+
+	if len(config.NATS.Servers) == 0 {
+		return fmt.Errorf("relay mode requires NATS servers")
+	}
+
+	s := config.Store
+	if s.Dir != "" || s.NSC != "" || s.S3.Bucket != "" || s.Postgres.DSN != "" || s.Redis.Address != "" || len(s.Etcd.Endpoints) > 0 || s.ReadOnly {
+		return fmt.Errorf("relays keep JWTs from the upstream in memory and cannot have a store configured")
+	}
+
+	return nil
+}
+
+// relayMode is true if lookups are requested from an upstream account server over NATS. Lock should be held.
+func (server *AccountServer) relayMode() bool {
+	return server.config.Relay.UpstreamSubjectPrefix != ""
+}
+
+// loadRelayedJWT returns the relay's copy of a JWT if it isn't stale, and requests it from the
+// upstream if it is. A stale copy is returned, with true, if the upstream doesn't answer.
+func (server *AccountServer) loadRelayedJWT(pubKey string, path string) (string, bool, error) {
+	server.cacheLock.Lock()
+	staleAt, ok := server.validUntil[pubKey]
+	server.cacheLock.Unlock()
+	fresh := ok && (staleAt.IsZero() || staleAt.After(time.Now()))
+
+	cached, err := server.loadStored(pubKey)
+	if fresh && (err == nil || err == store.ErrDeleted) {
+		return cached, false, err
+	}
+
+	theJWT, err := server.fetchFromUpstream(pubKey, path)
+	if err == errUpstreamTimeout && cached != "" {
+		atomic.AddUint64(&server.metrics.staleServed, 1)
+		return cached, true, nil
+	}
+	return theJWT, false, err
+}
+
+// fetchFromUpstream requests a JWT from the upstream over NATS and keeps it, along with
+// tombstones for deleted accounts, until it goes stale
+func (server *AccountServer) fetchFromUpstream(pubKey string, path string) (string, error) {
+	relay := server.currentConfig().Relay
+	subject := relaySubject(relay.UpstreamSubjectPrefix, path, pubKey)
+
+	nc := server.getNatsConnection()
+	if nc == nil || !nc.IsConnected() {
+		atomic.AddUint64(&server.metrics.relayTimeouts, 1)
+		return "", errUpstreamTimeout
+	}
+
+	msg, err := nc.Request(subject, nil, time.Duration(relay.Timeout)*time.Millisecond)
+	if err == nats.ErrTimeout || err == nats.ErrNoResponders {
+		atomic.AddUint64(&server.metrics.relayTimeouts, 1)
+		server.logger.WithFields(logging.Fields{"key": pubKey, "subject": subject, "error": err}).Warnf("upstream did not answer the lookup for %s, %s", ShortKey(pubKey), err.Error())
+		return "", errUpstreamTimeout
+	}
+	if err != nil {
+		return "", err
+	}
+	atomic.AddUint64(&server.metrics.relayFetches, 1)
+
+	if msg.Header != nil {
+		if upstreamErr := msg.Header.Get(RelayErrorHeader); upstreamErr != "" {
+			return "", fmt.Errorf("upstream could not load the JWT, %s", upstreamErr)
+		}
+
+		var tombstone store.Tombstone
+		if data := msg.Header.Get(TombstoneHeader); data != "" && json.Unmarshal([]byte(data), &tombstone) == nil && tombstone.PubKey == pubKey {
+			if err := server.saveTombstone(tombstone); err != nil {
+				atomic.AddUint64(&server.metrics.storeErrors, 1)
+				return "", err
+			}
+			server.markValid(pubKey, server.cacheTTLForPath(path))
+			return "", store.ErrDeleted
+		}
+	}
+
+	if len(msg.Data) == 0 {
+		return "", store.ErrNotFound
+	}
+
+	theJWT := string(msg.Data)
+	if err := server.verifyFetchedJWT(pubKey, theJWT); err != nil {
+		return "", server.rejectPrimaryJWT(subject, pubKey, err)
+	}
+
+	if err := server.saveJWT(pubKey, theJWT); err != nil {
+		atomic.AddUint64(&server.metrics.storeErrors, 1)
+		return "", err
+	}
+	server.indexJWT(pubKey, theJWT)
+	server.markValid(pubKey, server.cacheTTLForPath(path))
+
+	return theJWT, nil
+}
+
+// handleRelayRequest answers a lookup from a relay with the JWT. Unknown JWTs get an empty reply,
+// deleted accounts get their tombstone in a header and errors loading the JWT are sent in RelayErrorHeader.
+func (server *AccountServer) handleRelayRequest(msg *nats.Msg) {
+	if msg.Reply == "" {
+		return
+	}
+
+	prefix := server.currentConfig().NATS.RelaySubjectPrefix
+	tokens := strings.Split(strings.TrimPrefix(msg.Subject, prefix+"."), ".")
+
+	var theJWT string
+	var err error
+
+	switch {
+	case len(tokens) == 2 && tokens[0] == relayAccountToken && nkeys.IsValidPublicAccountKey(tokens[1]):
+		theJWT, err = server.loadAccountJWT(tokens[1])
+	case len(tokens) == 2 && tokens[0] == relayActivationToken && tokens[1] != "":
+		theJWT, _, err = server.loadJWT(tokens[1], activationsPath)
+		countLookup(&server.metrics.activationHits, &server.metrics.activationMisses, err)
+	default:
+		server.logger.WithFields(logging.Fields{"subject": msg.Subject}).Tracef("ignoring relay request on %s, no account public key or activation hash", msg.Subject)
+		msg.Respond([]byte{})
+		return
+	}
+
+	atomic.AddUint64(&server.metrics.relayRequests, 1)
+	key := tokens[1]
+	logger := server.logger.WithFields(logging.Fields{"key": key, "subject": msg.Subject})
+
+	reply := nats.NewMsg(msg.Reply)
+	switch err {
+	case nil:
+		reply.Data = []byte(theJWT)
+	case store.ErrNotFound:
+	case store.ErrDeleted:
+		tombstone, ok := server.loadTombstone(key)
+		if !ok {
+			tombstone = store.Tombstone{PubKey: key}
+		}
+		data, _ := json.Marshal(tombstone)
+		reply.Header.Set(TombstoneHeader, string(data))
+	default:
+		logger.WithFields(logging.Fields{"error": err}).Errorf("unable to load %s for a relay, %s", ShortKey(key), err.Error())
+		reply.Header.Set(RelayErrorHeader, err.Error())
+	}
+
+	err = msg.RespondMsg(reply)
+	if err == nats.ErrHeadersNotSupported {
+		// without headers the relay only sees an empty reply
+		err = msg.Respond([]byte{})
+	}
+	if err != nil {
+		logger.WithFields(logging.Fields{"error": err}).Errorf("error responding to relay request for %s, %s", ShortKey(key), err.Error())
+		return
+	}
+
+	logger.Tracef("answered relay request for %s", ShortKey(key))
+}
@@ -0,0 +1,215 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/store"
+	nats "github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/require"
+)
+
+func testRelayPrefix() string {
+	return "TEST.RELAY." + strings.TrimPrefix(nats.NewInbox(), "_INBOX.")
+}
+
+// startRelay starts a relay for the test server's NATS, requesting JWTs under prefix
+func startRelay(t *testing.T, testEnv *TestSetup, prefix string) *AccountServer {
+	config := testEnv.CreateReplicaConfig("")
+	config.Primary = nil
+	config.NATS.RelaySubjectPrefix = ""
+	config.Relay.UpstreamSubjectPrefix = prefix
+	config.Relay.Timeout = 500
+
+	relay := NewAccountServer()
+	relay.InitializeFromConfig(config)
+	require.NoError(t, relay.Start())
+
+	for i := 0; i < 100; i++ {
+		if nc := relay.getNatsConnection(); nc != nil && nc.IsConnected() {
+			return relay
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	relay.Stop()
+	t.Fatal("relay did not connect to NATS")
+	return nil
+}
+
+func relayGet(t *testing.T, client *http.Client, relay *AccountServer, path string) (*http.Response, string) {
+	resp, err := client.Get(fmt.Sprintf("http://localhost:%d/jwt/v1/%s", relay.Port(), path))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func TestRelay(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	prefix := testRelayPrefix()
+	upstream := testEnv.Server
+	upstream.Lock()
+	config := *upstream.config
+	config.NATS.RelaySubjectPrefix = prefix
+	upstream.config = &config
+	upstream.subscribeToRequests(upstream.nats)
+	upstream.Unlock()
+
+	_, pubKey, _ := CreateAccountKey(t)
+	acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	require.NoError(t, upstream.jwtStore.Save(pubKey, acctJWT))
+
+	_, importerKey, _ := CreateAccountKey(t)
+	_, exporterKey, exporterKP := CreateAccountKey(t)
+	activation := jwt.NewActivationClaims(importerKey)
+	activation.ImportSubject = "test"
+	activation.ImportType = jwt.Stream
+	activation.IssuerAccount = exporterKey
+	actJWT, err := activation.Encode(exporterKP)
+	require.NoError(t, err)
+	hash, err := activation.HashID()
+	require.NoError(t, err)
+	require.NoError(t, upstream.jwtStore.Save(hash, actJWT))
+
+	_, deletedKey, _ := CreateAccountKey(t)
+	require.NoError(t, upstream.saveTombstone(store.Tombstone{PubKey: deletedKey, DeletedAt: time.Now().Unix()}))
+
+	relay := startRelay(t, testEnv, prefix)
+	defer relay.Stop()
+
+	resp, body := relayGet(t, testEnv.HTTP, relay, "accounts/"+pubKey)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, acctJWT, body)
+
+	resp, body = relayGet(t, testEnv.HTTP, relay, "activations/"+hash)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, actJWT, body)
+
+	resp, _ = relayGet(t, testEnv.HTTP, relay, "accounts/"+deletedKey)
+	require.Equal(t, http.StatusGone, resp.StatusCode)
+
+	// fresh JWTs are served from the relay's cache
+	require.NoError(t, upstream.jwtStore.Save(pubKey, "eynotajwt"))
+	resp, body = relayGet(t, testEnv.HTTP, relay, "accounts/"+pubKey)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, acctJWT, body)
+	require.Equal(t, uint64(3), relay.metrics.relayFetches)
+	require.Equal(t, uint64(3), upstream.metrics.relayRequests)
+
+	// relays don't accept writes
+	postResp, err := testEnv.HTTP.Post(fmt.Sprintf("http://localhost:%d/jwt/v1/accounts/%s", relay.Port(), pubKey), "application/jwt", strings.NewReader(acctJWT))
+	require.NoError(t, err)
+	postResp.Body.Close()
+	require.Equal(t, http.StatusMethodNotAllowed, postResp.StatusCode)
+
+	// a stale JWT is fetched again, and the bad one from the upstream is refused
+	relay.cacheLock.Lock()
+	relay.validUntil[pubKey] = time.Now().Add(-time.Second)
+	relay.cacheLock.Unlock()
+	resp, _ = relayGet(t, testEnv.HTTP, relay, "accounts/"+pubKey)
+	require.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+	_, unknownKey, _ := CreateAccountKey(t)
+	resp, _ = relayGet(t, testEnv.HTTP, relay, "accounts/"+unknownKey)
+	require.NotEqual(t, http.StatusOK, resp.StatusCode)
+	require.NotEqual(t, http.StatusGatewayTimeout, resp.StatusCode)
+	_, err = relay.jwtStore.Load(unknownKey)
+	require.Equal(t, store.ErrNotFound, err)
+}
+
+func TestRelayUpstreamTimeout(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	// a responder that never answers
+	prefix := testRelayPrefix()
+	sub, err := testEnv.NC.Subscribe(prefix+".>", func(msg *nats.Msg) {})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, testEnv.NC.Flush())
+
+	relay := startRelay(t, testEnv, prefix)
+	defer relay.Stop()
+
+	_, pubKey, _ := CreateAccountKey(t)
+	start := time.Now()
+	resp, _ := relayGet(t, testEnv.HTTP, relay, "accounts/"+pubKey)
+	require.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	require.True(t, time.Since(start) < 5*time.Second)
+	require.Equal(t, uint64(1), relay.metrics.relayTimeouts)
+
+	// with a stale copy the relay serves it while the upstream is down
+	acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	require.NoError(t, relay.jwtStore.Save(pubKey, acctJWT))
+	relay.markValid(pubKey, 1)
+	relay.cacheLock.Lock()
+	relay.validUntil[pubKey] = time.Now().Add(-time.Second)
+	relay.cacheLock.Unlock()
+
+	resp, body := relayGet(t, testEnv.HTTP, relay, "accounts/"+pubKey)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, acctJWT, body)
+	require.Equal(t, staleWarning, resp.Header.Get("Warning"))
+
+	// activations nobody answers for time out too
+	resp, _ = relayGet(t, testEnv.HTTP, relay, "activations/NOSUCHHASH")
+	require.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+}
+
+func TestValidateRelay(t *testing.T) {
+	valid := func() *conf.AccountServerConfig {
+		config := conf.DefaultServerConfig()
+		config.NATS.Servers = []string{"nats://localhost:4222"}
+		config.Relay.UpstreamSubjectPrefix = "EDGE.RELAY"
+		return config
+	}
+
+	require.NoError(t, validateRelay(valid()))
+	require.NoError(t, validateRelay(conf.DefaultServerConfig()))
+
+	for name, change := range map[string]func(*conf.AccountServerConfig){
+		"wildcard":     func(c *conf.AccountServerConfig) { c.Relay.UpstreamSubjectPrefix = "EDGE.*" },
+		"own prefix":   func(c *conf.AccountServerConfig) { c.NATS.RelaySubjectPrefix = "EDGE.RELAY" },
+		"bad serve":    func(c *conf.AccountServerConfig) { c.NATS.RelaySubjectPrefix = "EDGE.>" },
+		"timeout":      func(c *conf.AccountServerConfig) { c.Relay.Timeout = 0 },
+		"primary":      func(c *conf.AccountServerConfig) { c.Primary = []string{"http://localhost:9090"} },
+		"no nats":      func(c *conf.AccountServerConfig) { c.NATS.Servers = nil },
+		"dir store":    func(c *conf.AccountServerConfig) { c.Store.Dir = "/tmp/jwts" },
+		"read only":    func(c *conf.AccountServerConfig) { c.Store.ReadOnly = true },
+		"redis store":  func(c *conf.AccountServerConfig) { c.Store.Redis.Address = "localhost:6379" },
+		"trailing dot": func(c *conf.AccountServerConfig) { c.Relay.UpstreamSubjectPrefix = "EDGE." },
+	} {
+		config := valid()
+		change(config)
+		require.Error(t, validateRelay(config), name)
+	}
+}
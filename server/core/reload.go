@@ -0,0 +1,281 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/logging"
+)
+
+// reconfigurable is implemented by loggers that can change their settings in place
+type reconfigurable interface {
+	Reconfigure(conf logging.Config)
+}
+
+// Reload reads the config file and flags the server was initialized with again, and applies
+// the settings that can change while the server is running
+func (server *AccountServer) Reload() error {
+	server.Lock()
+	flags := server.flags
+	server.Unlock()
+
+	if flags == nil {
+		return fmt.Errorf("server was not initialized from flags, nothing to reload")
+	}
+
+	config, err := server.configFromFlags(*flags)
+	if err != nil {
+		return err
+	}
+
+	return server.ReloadConfig(config)
+}
+
+// ReloadConfig applies the logging, cache, clock skew, NATS reconnect, write token and primary settings
+// from config. Settings that need a restart are logged and left alone. Nothing is applied
+// if the new settings are invalid.
+func (server *AccountServer) ReloadConfig(config *conf.AccountServerConfig) error {
+	server.Lock()
+	defer server.Unlock()
+
+	if !server.running {
+		return fmt.Errorf("server is not running")
+	}
+
+	if err := logging.ValidateFormat(config.Logging.Format); err != nil {
+		return err
+	}
+
+	if config.ReplicaCacheTTL < 0 {
+		return fmt.Errorf("replica cache TTL cannot be negative, use 0 to never expire")
+	}
+
+	if config.ReplicaMaxStale < 0 {
+		return fmt.Errorf("replica max stale cannot be negative, use 0 for no limit")
+	}
+
+	if err := validateReplicaRefresh(config.ReplicaRefresh); err != nil {
+		return err
+	}
+
+	if err := validateLookupCounts(config.LookupCounts); err != nil {
+		return err
+	}
+
+	if err := validateNegativeCache(config.NegativeCache); err != nil {
+		return err
+	}
+
+	if server.relayMode() && config.Relay.Timeout <= 0 {
+		return fmt.Errorf("relay timeout must be positive")
+	}
+
+	if config.AccountCacheTTL < 0 || config.ActivationCacheTTL < 0 || config.OperatorCacheTTL < 0 {
+		return fmt.Errorf("cache TTLs cannot be negative, use 0 to send no-cache")
+	}
+
+	if config.ClockSkew < 0 {
+		return fmt.Errorf("clock skew cannot be negative")
+	}
+
+	if gc := config.GC; gc.Interval < 0 || gc.ActivationGrace < 0 || gc.AccountGrace < 0 || gc.TombstoneGrace < 0 {
+		return fmt.Errorf("gc interval and grace periods cannot be negative")
+	}
+
+	tokens, err := loadWriteTokens(config.HTTP)
+	if err != nil {
+		return err
+	}
+
+	limits, err := newRateLimits(config.HTTP.RateLimits)
+	if err != nil {
+		return err
+	}
+
+	filter, err := newWriteFilter(config.HTTP)
+	if err != nil {
+		return err
+	}
+
+	replicaKeys, err := parseReplicaKeys(config.ReplicaAuth)
+	if err != nil {
+		return err
+	}
+
+	old := server.config
+	next := *old
+
+	next.Logging = config.Logging
+	next.ReplicaCacheTTL = config.ReplicaCacheTTL
+	next.ReplicaServeStale = config.ReplicaServeStale
+	next.ReplicaMaxStale = config.ReplicaMaxStale
+	next.ReplicaRefresh = config.ReplicaRefresh
+	next.LookupCounts = config.LookupCounts
+	next.NegativeCache = config.NegativeCache
+	next.LegacyJWTs.Strict = config.LegacyJWTs.Strict
+	next.Relay.Timeout = config.Relay.Timeout
+	next.AccountCacheTTL = config.AccountCacheTTL
+	next.ActivationCacheTTL = config.ActivationCacheTTL
+	next.OperatorCacheTTL = config.OperatorCacheTTL
+	next.ReplicationTimeout = config.ReplicationTimeout
+	next.ReplicationMaxIdle = config.ReplicationMaxIdle
+	next.ClockSkew = config.ClockSkew
+	next.AllowExpired = config.AllowExpired
+	next.StrictActivations = config.StrictActivations
+	next.AcceptUnknownIssuers = config.AcceptUnknownIssuers
+	next.MaxJWTSize = config.MaxJWTSize
+	next.Policies = config.Policies
+
+	// replica keys can be rotated, the seed file is read for every request anyway
+	next.ReplicaAuth = config.ReplicaAuth
+
+	// a new interval needs a restart, the rest is read by each collection
+	next.GC.ActivationGrace = config.GC.ActivationGrace
+	next.GC.Accounts = config.GC.Accounts
+	next.GC.AccountGrace = config.GC.AccountGrace
+	next.GC.TombstoneGrace = config.GC.TombstoneGrace
+	next.ExpiryWarnings.Within = config.ExpiryWarnings.Within
+	next.Bootstrap.ResolverURL = config.Bootstrap.ResolverURL
+
+	// the token file is read again, so tokens can be rotated without a restart
+	next.HTTP.WriteTokens = config.HTTP.WriteTokens
+	next.HTTP.WriteTokenFile = config.HTTP.WriteTokenFile
+	next.HTTP.WriteAllowList = config.HTTP.WriteAllowList
+	next.HTTP.WriteDenyList = config.HTTP.WriteDenyList
+	next.HTTP.TrustedProxies = config.HTTP.TrustedProxies
+
+	// changed rate limits start with full buckets
+	next.HTTP.RateLimits = config.HTTP.RateLimits
+	next.HTTP.ShutdownTimeout = config.HTTP.ShutdownTimeout
+	next.HTTP.AccessLog = config.HTTP.AccessLog
+	next.HTTP.SlowRequestThreshold = config.HTTP.SlowRequestThreshold
+
+	// reconnect settings are used the next time the server connects
+	next.NATS.ConnectTimeout = config.NATS.ConnectTimeout
+	next.NATS.ReconnectWait = config.NATS.ReconnectWait
+	next.NATS.MaxReconnectWait = config.NATS.MaxReconnectWait
+	next.NATS.MaxReconnects = config.NATS.MaxReconnects
+	next.NATS.DrainTimeout = config.NATS.DrainTimeout
+	next.NATS.NotificationQueueSize = config.NATS.NotificationQueueSize
+	next.NATS.NotifyRate = config.NATS.NotifyRate
+	next.NATS.PackRate = config.NATS.PackRate
+	next.NATS.SubjectPrefix = config.NATS.SubjectPrefix
+	next.NATS.QueueGroup = config.NATS.QueueGroup
+
+	// a replica can switch primaries, but not stop being a replica
+	if (len(config.Primary) == 0) == (len(old.Primary) == 0) {
+		next.Primary = config.Primary
+	}
+
+	server.logRestartRequired(&next, config)
+
+	oldGroup := server.queueGroup()
+	server.config = &next
+	server.writeTokens = tokens
+	server.writeFilter = filter
+	server.lookups.configure(next.LookupCounts)
+	server.misses.configure(next.NegativeCache)
+	server.replicaKeys.setKeys(replicaKeys)
+	if !reflect.DeepEqual(next.HTTP.RateLimits, old.HTTP.RateLimits) {
+		server.rateLimits = limits
+	}
+
+	if l, ok := server.logger.(reconfigurable); ok {
+		l.Reconfigure(next.Logging)
+	}
+
+	// a new timeout keeps the pooled connections, a new pool size replaces them
+	if next.ReplicationMaxIdle != old.ReplicationMaxIdle {
+		server.httpClient.CloseIdleConnections()
+		server.httpClient = server.createHTTPClient()
+	} else if next.ReplicationTimeout != old.ReplicationTimeout {
+		client := *server.httpClient
+		client.Timeout = time.Duration(next.ReplicationTimeout) * time.Millisecond
+		server.httpClient = &client
+	}
+
+	if primaries := newPrimaryPool(next.Primary); primaries.String() != server.primary {
+		server.logger.Noticef("replicating from new primary at %s", primaries.String())
+		server.primaries = primaries
+		server.primary = primaries.String()
+	}
+
+	if subjectPrefix(&next) != subjectPrefix(old) && server.nats != nil {
+		if err := server.subscribeToNotifications(server.nats); err != nil {
+			server.logger.Errorf("unable to subscribe to notifications after reload, %s", err.Error())
+		}
+	}
+
+	if server.queueGroup() != oldGroup && server.nats != nil {
+		server.subscribeToRequests(server.nats)
+	}
+
+	// an updated operator JWT brings new signing keys, and the accounts are checked against them
+	server.currentTrustedKeys()
+
+	server.logger.Noticef("configuration reloaded")
+	return nil
+}
+
+// logRestartRequired logs the settings in config that differ from the applied config
+func (server *AccountServer) logRestartRequired(applied *conf.AccountServerConfig, config *conf.AccountServerConfig) {
+	changed := map[string]bool{
+		"http":                 !reflect.DeepEqual(applied.HTTP, config.HTTP),
+		"store":                !reflect.DeepEqual(applied.Store, config.Store),
+		"nats":                 !reflect.DeepEqual(applied.NATS, config.NATS),
+		"operatorjwtpath":      applied.OperatorJWTPath != config.OperatorJWTPath,
+		"systemaccountjwtpath": applied.SystemAccountJWTPath != config.SystemAccountJWTPath,
+		"trustedoperatorkeys":  !reflect.DeepEqual(applied.TrustedOperatorKeys, config.TrustedOperatorKeys),
+		"primary":              !reflect.DeepEqual(applied.Primary, config.Primary),
+		"auditlogpath":         applied.AuditLogPath != config.AuditLogPath,
+		"gc":                   applied.GC.Interval != config.GC.Interval,
+		"expirywarnings":       applied.ExpiryWarnings.Interval != config.ExpiryWarnings.Interval,
+		"bootstrap":            applied.Bootstrap != config.Bootstrap,
+		"webhooks":             !reflect.DeepEqual(applied.Webhooks, config.Webhooks),
+		"debug":                applied.Debug != config.Debug,
+		"relay":                applied.Relay.UpstreamSubjectPrefix != config.Relay.UpstreamSubjectPrefix,
+		"enableuserjwts":       applied.EnableUserJWTs != config.EnableUserJWTs,
+		"gossip":               applied.Gossip != config.Gossip,
+		"mirror":               !reflect.DeepEqual(applied.Mirror, config.Mirror),
+		"operators":            !reflect.DeepEqual(applied.Operators, config.Operators),
+	}
+
+	for _, name := range []string{"http", "store", "nats", "operatorjwtpath", "systemaccountjwtpath", "trustedoperatorkeys", "primary", "auditlogpath", "gc", "expirywarnings", "bootstrap", "webhooks", "debug", "relay", "enableuserjwts", "gossip", "mirror", "operators"} {
+		if changed[name] {
+			server.logger.Warnf("configuration change to %s requires a restart, ignoring it", name)
+		}
+	}
+}
+
+// ReloadHandler reloads the configuration, it is the target of POST /admin/reload
+func (server *AccountServer) ReloadHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logger := server.logger.WithContext(r.Context())
+	logger.Tracef("%s: %s", r.RemoteAddr, r.URL.String())
+
+	if err := server.Reload(); err != nil {
+		server.sendErrorResponse(http.StatusBadRequest, fmt.Sprintf("unable to reload configuration, %s", err.Error()), "", nil, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
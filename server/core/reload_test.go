@@ -0,0 +1,158 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/logging"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReloadConfig(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	server := testEnv.Server
+	old := server.currentConfig()
+
+	config := *old
+	config.ReplicaCacheTTL = 60
+	config.ClockSkew = 5
+	config.Logging.Debug = false
+	config.NATS.ReconnectWait = 250
+	config.HTTP.Port = old.HTTP.Port + 1000
+	config.Store.ReadOnly = true
+
+	require.NoError(t, server.ReloadConfig(&config))
+
+	current := server.currentConfig()
+	require.Equal(t, 60, current.ReplicaCacheTTL)
+	require.Equal(t, 5, current.ClockSkew)
+	require.False(t, current.Logging.Debug)
+	require.Equal(t, 250, current.NATS.ReconnectWait)
+
+	// these need a restart
+	require.Equal(t, old.HTTP.Port, current.HTTP.Port)
+	require.False(t, current.Store.ReadOnly)
+
+	// the old config isn't changed, so code using it doesn't see a partial reload
+	require.Equal(t, 3600, old.ReplicaCacheTTL)
+}
+
+func TestReloadRejectsBadConfig(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	config := *testEnv.Server.currentConfig()
+	config.ReplicaCacheTTL = -1
+	config.ClockSkew = 5
+	require.Error(t, testEnv.Server.ReloadConfig(&config))
+
+	require.Equal(t, 3600, testEnv.Server.currentConfig().ReplicaCacheTTL)
+	require.Equal(t, 30, testEnv.Server.currentConfig().ClockSkew)
+
+	config = *testEnv.Server.currentConfig()
+	config.Logging.Format = "xml"
+	require.Error(t, testEnv.Server.ReloadConfig(&config))
+
+	config.Logging.Format = logging.JSONFormat
+	require.NoError(t, testEnv.Server.ReloadConfig(&config))
+	require.Equal(t, logging.JSONFormat, testEnv.Server.currentConfig().Logging.Format)
+}
+
+func TestReloadPrimary(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	replica, err := testEnv.CreateReplica("")
+	require.NoError(t, err)
+	defer replica.Stop()
+
+	config := *replica.currentConfig()
+	config.Primary = []string{"http://localhost:1/"}
+	config.NATS.SubjectPrefix = "STAGING.ACCOUNT"
+	require.NoError(t, replica.ReloadConfig(&config))
+
+	primary, _ := replica.currentPrimary()
+	require.Equal(t, "http://localhost:1/", primary)
+
+	replica.Lock()
+	subjects := []string{}
+	for _, sub := range replica.notificationSubs {
+		subjects = append(subjects, sub.Subject)
+	}
+	replica.Unlock()
+	require.Contains(t, subjects, "STAGING.ACCOUNT.*.CLAIMS.UPDATE")
+
+	// a replica can't become a primary without a restart
+	config.Primary = nil
+	require.NoError(t, replica.ReloadConfig(&config))
+	primary, _ = replica.currentPrimary()
+	require.Equal(t, "http://localhost:1/", primary)
+}
+
+func TestReloadFromConfigFile(t *testing.T) {
+	file, err := ioutil.TempFile(os.TempDir(), "config")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+
+	writeConfig := func(ttl int) {
+		configString := fmt.Sprintf("{ replicacachettl: %d, http: { host: localhost, port: 0 } }", ttl)
+		require.NoError(t, ioutil.WriteFile(file.Name(), []byte(configString), 0644))
+	}
+	writeConfig(120)
+
+	server := NewAccountServer()
+	require.NoError(t, server.InitializeFromFlags(Flags{ConfigFile: file.Name()}))
+	require.NoError(t, server.Start())
+	defer server.Stop()
+
+	require.Equal(t, 120, server.currentConfig().ReplicaCacheTTL)
+
+	writeConfig(240)
+
+	httpClient, err := testHTTPClient(false)
+	require.NoError(t, err)
+
+	resp, err := httpClient.Post(fmt.Sprintf("http://localhost:%d/admin/reload", server.port), "text/plain", nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, 240, server.currentConfig().ReplicaCacheTTL)
+
+	writeConfig(-5)
+	require.Error(t, server.Reload())
+	require.Equal(t, 240, server.currentConfig().ReplicaCacheTTL)
+}
+
+func TestReloadWithoutFlags(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	resp, err := testEnv.HTTP.Post(testEnv.URLForPath("/admin/reload"), "text/plain", nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
@@ -0,0 +1,253 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/store"
+	"github.com/nats-io/nkeys"
+)
+
+// renotifyJob re-publishes the notifications for every account, or one, in the store
+type renotifyJob struct {
+	sync.Mutex
+	status renotifyStatus
+}
+
+// renotifyStatus is the progress of a job, it is returned by POST /jwt/v1/notify and in the status
+type renotifyStatus struct {
+	ID       string     `json:"id"`
+	Account  string     `json:"account,omitempty"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Total    int        `json:"total"`
+	Sent     int        `json:"sent"`
+	Failed   int        `json:"failed"`
+	Error    string     `json:"error,omitempty"`
+}
+
+func newRenotifyJob(account string) *renotifyJob {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &renotifyJob{status: renotifyStatus{
+		ID:      hex.EncodeToString(id),
+		Account: account,
+		Started: time.Now().UTC(),
+	}}
+}
+
+func (job *renotifyJob) snapshot() renotifyStatus {
+	job.Lock()
+	defer job.Unlock()
+	return job.status
+}
+
+func (job *renotifyJob) running() bool {
+	job.Lock()
+	defer job.Unlock()
+	return job.status.Finished == nil
+}
+
+func (job *renotifyJob) setTotal(total int) {
+	job.Lock()
+	job.status.Total = total
+	job.Unlock()
+}
+
+func (job *renotifyJob) count(err error) {
+	job.Lock()
+	if err != nil {
+		job.status.Failed++
+	} else {
+		job.status.Sent++
+	}
+	job.Unlock()
+}
+
+func (job *renotifyJob) finish(err error) {
+	job.Lock()
+	now := time.Now().UTC()
+	job.status.Finished = &now
+	if err != nil {
+		job.status.Error = err.Error()
+	}
+	job.Unlock()
+}
+
+// currentRenotifyJob returns the latest job, nil if there hasn't been one
+func (server *AccountServer) currentRenotifyJob() *renotifyJob {
+	server.Lock()
+	defer server.Unlock()
+	return server.renotify
+}
+
+// PostNotify re-publishes the account notifications, so nats-servers that lost their resolver caches
+// pick the accounts up again. Every account in the store is sent, paced by notifyrate, by a job that
+// runs in the background, with ?account=<pubkey> only that account is sent, before returning.
+func (server *AccountServer) PostNotify(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logger := server.logger.WithContext(r.Context())
+	logger.Tracef("%s: %s", r.RemoteAddr, r.URL.String())
+
+	if len(server.currentConfig().NATS.Servers) == 0 {
+		server.sendErrorResponse(http.StatusBadRequest, "NATS is not configured", "", nil, w)
+		return
+	}
+
+	if server.getNatsConnection() == nil {
+		server.sendErrorResponse(http.StatusServiceUnavailable, "not connected to NATS", "", nil, w)
+		return
+	}
+
+	if pubKey := r.URL.Query().Get("account"); pubKey != "" {
+		if !nkeys.IsValidPublicAccountKey(pubKey) {
+			server.sendErrorResponse(http.StatusBadRequest, "bad account public key in request", pubKey, nil, w)
+			return
+		}
+
+		job := newRenotifyJob(pubKey)
+		job.setTotal(1)
+		err := server.renotifyAccount(pubKey)
+		if err == store.ErrNotFound || err == store.ErrDeleted {
+			server.sendErrorResponse(http.StatusNotFound, "account not found", pubKey, nil, w)
+			return
+		}
+		job.count(err)
+		job.finish(err)
+
+		if err != nil {
+			server.sendError(http.StatusInternalServerError, CodeNotificationError, "error sending notification", pubKey, err, w)
+			return
+		}
+		server.writeRenotifyStatus(w, http.StatusOK, job.snapshot())
+		return
+	}
+
+	server.Lock()
+	if server.renotify != nil && server.renotify.running() {
+		status := server.renotify.snapshot()
+		server.Unlock()
+		logger.Warnf("notifications are already being re-sent by job %s", status.ID)
+		server.writeRenotifyStatus(w, http.StatusConflict, status)
+		return
+	}
+	job := newRenotifyJob("")
+	server.renotify = job
+	done := server.done
+	server.Unlock()
+
+	pubKeys, err := server.accountKeys()
+	if err != nil {
+		job.finish(err)
+		server.sendError(http.StatusInternalServerError, CodeStoreError, "error reading accounts", "", err, w)
+		return
+	}
+	job.setTotal(len(pubKeys))
+
+	logger.Noticef("re-sending notifications for %d accounts, job %s", len(pubKeys), job.snapshot().ID)
+	go server.runRenotifyJob(job, pubKeys, done)
+
+	server.writeRenotifyStatus(w, http.StatusAccepted, job.snapshot())
+}
+
+// accountKeys lists the accounts in the store, the keys are read up front so the store
+// isn't held while the notifications are paced
+func (server *AccountServer) accountKeys() ([]string, error) {
+	pubKeys := []string{}
+	err := server.jwtStore.Iterate(func(publicKey string, theJWT string) error {
+		// activations are stored by hash, deleted accounts have tombstones
+		if nkeys.IsValidPublicAccountKey(publicKey) && !store.IsTombstone(theJWT) {
+			pubKeys = append(pubKeys, publicKey)
+		}
+		return nil
+	})
+	return pubKeys, err
+}
+
+func (server *AccountServer) runRenotifyJob(job *renotifyJob, pubKeys []string, done <-chan struct{}) {
+	var pace <-chan time.Time
+	if rate := server.currentConfig().NATS.NotifyRate; rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(rate))
+		defer ticker.Stop()
+		pace = ticker.C
+	}
+
+	for i, pubKey := range pubKeys {
+		if i > 0 && pace != nil {
+			select {
+			case <-pace:
+			case <-done:
+				job.finish(fmt.Errorf("the server stopped"))
+				return
+			}
+		}
+
+		if server.getNatsConnection() == nil {
+			err := fmt.Errorf("lost the NATS connection")
+			server.logger.Warnf("stopped re-sending notifications after %d of %d accounts, %s", i, len(pubKeys), err.Error())
+			job.finish(err)
+			return
+		}
+
+		err := server.renotifyAccount(pubKey)
+		if err == store.ErrNotFound || err == store.ErrDeleted {
+			err = nil // deleted since the job started
+		}
+		if err != nil {
+			server.logger.Warnf("unable to re-send the notification for %s, %s", ShortKey(pubKey), err.Error())
+		}
+		job.count(err)
+	}
+
+	job.finish(nil)
+	status := job.snapshot()
+	server.logger.Noticef("re-sent notifications for %d accounts, %d failed, job %s", status.Sent, status.Failed, status.ID)
+}
+
+// renotifyAccount publishes the notification for the account's current JWT
+func (server *AccountServer) renotifyAccount(pubKey string) error {
+	theJWT, err := server.loadStored(pubKey)
+	if err != nil {
+		return err
+	}
+
+	claims, err := jwt.DecodeAccountClaims(theJWT)
+	if err != nil {
+		return err
+	}
+	return server.sendAccountNotification(claims, []byte(theJWT), nil)
+}
+
+func (server *AccountServer) writeRenotifyStatus(w http.ResponseWriter, httpStatus int, status renotifyStatus) {
+	data, err := json.Marshal(status)
+	if err != nil {
+		server.sendErrorResponse(http.StatusInternalServerError, "unable to encode job status", "", err, w)
+		return
+	}
+
+	w.Header().Set(ContentType, ApplicationJSON)
+	w.WriteHeader(httpStatus)
+	w.Write(data)
+}
@@ -0,0 +1,169 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func postNotify(t *testing.T, testEnv *TestSetup, query string) (int, renotifyStatus) {
+	resp, err := testEnv.HTTP.Post(testEnv.URLForPath("/jwt/v1/notify"+query), "text/plain", nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var status renotifyStatus
+	if resp.Header.Get(ContentType) == ApplicationJSON {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	}
+	return resp.StatusCode, status
+}
+
+func TestRenotifyAllAccounts(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	jwts := saveTestAccounts(t, testEnv, 5)
+
+	received := make(chan *nats.Msg, 10)
+	_, err = testEnv.NC.ChanSubscribe(testEnv.Server.accountNotificationSubject("*"), received)
+	require.NoError(t, err)
+	require.NoError(t, testEnv.NC.Flush())
+
+	code, job := postNotify(t, testEnv, "")
+	require.Equal(t, http.StatusAccepted, code)
+	require.NotEmpty(t, job.ID)
+	require.Equal(t, 5, job.Total)
+
+	got := map[string]string{}
+	for len(got) < len(jwts) {
+		select {
+		case msg := <-received:
+			got[msg.Subject] = string(msg.Data)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("notifications weren't re-sent, got %d", len(got))
+		}
+	}
+	for pubKey, acctJWT := range jwts {
+		require.Equal(t, acctJWT, got[testEnv.Server.accountNotificationSubject(pubKey)])
+	}
+
+	var status serverStatus
+	for i := 0; i < 50; i++ {
+		status = getStatus(t, testEnv.HTTP, testEnv.URLForPath("/jwt/v1/status"))
+		if status.Renotify != nil && status.Renotify.Finished != nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	require.NotNil(t, status.Renotify)
+	require.NotNil(t, status.Renotify.Finished)
+	require.Equal(t, job.ID, status.Renotify.ID)
+	require.Equal(t, 5, status.Renotify.Sent)
+	require.Equal(t, 0, status.Renotify.Failed)
+}
+
+func TestRenotifyOneAccount(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	var pubKey string
+	for key := range saveTestAccounts(t, testEnv, 2) {
+		pubKey = key
+	}
+
+	received := make(chan *nats.Msg, 10)
+	_, err = testEnv.NC.ChanSubscribe(testEnv.Server.accountNotificationSubject("*"), received)
+	require.NoError(t, err)
+	require.NoError(t, testEnv.NC.Flush())
+
+	code, job := postNotify(t, testEnv, "?account="+pubKey)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, pubKey, job.Account)
+	require.Equal(t, 1, job.Sent)
+	require.NotNil(t, job.Finished)
+
+	select {
+	case msg := <-received:
+		require.Equal(t, testEnv.Server.accountNotificationSubject(pubKey), msg.Subject)
+	case <-time.After(5 * time.Second):
+		t.Fatal("notification wasn't re-sent")
+	}
+
+	code, _ = postNotify(t, testEnv, "?account=notakey")
+	require.Equal(t, http.StatusBadRequest, code)
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	unknown, err := accountKey.PublicKey()
+	require.NoError(t, err)
+	code, _ = postNotify(t, testEnv, "?account="+unknown)
+	require.Equal(t, http.StatusNotFound, code)
+
+	// single accounts aren't shown in the status
+	require.Nil(t, getStatus(t, testEnv.HTTP, testEnv.URLForPath("/jwt/v1/status")).Renotify)
+}
+
+func TestRenotifyOneJobAtATime(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	// the test setup replaces the NATS config
+	testEnv.Server.Lock()
+	config := *testEnv.Server.config
+	config.NATS.NotifyRate = 1
+	testEnv.Server.config = &config
+	testEnv.Server.Unlock()
+
+	saveTestAccounts(t, testEnv, 3)
+
+	code, first := postNotify(t, testEnv, "")
+	require.Equal(t, http.StatusAccepted, code)
+
+	code, running := postNotify(t, testEnv, "")
+	require.Equal(t, http.StatusConflict, code)
+	require.Equal(t, first.ID, running.ID)
+	require.Nil(t, running.Finished)
+}
+
+func TestRenotifyWithoutNATS(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	code, _ := postNotify(t, testEnv, "")
+	require.Equal(t, http.StatusServiceUnavailable, code)
+
+	testEnv.Server.Lock()
+	config := *testEnv.Server.config
+	config.NATS.Servers = nil
+	testEnv.Server.config = &config
+	testEnv.Server.Unlock()
+
+	code, _ = postNotify(t, testEnv, "")
+	require.Equal(t, http.StatusBadRequest, code)
+}
@@ -0,0 +1,220 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// syncRetryWait is the delay between attempts to finish the initial sync with the primary
+const syncRetryWait = 5 * time.Second
+
+// errPackNotSupported is returned when the primary doesn't have a pack endpoint
+var errPackNotSupported = fmt.Errorf("primary does not support /jwt/v1/pack")
+
+// startInitialSync downloads every JWT from the primary in the background, retrying until
+// it succeeds or the server stops. Lock should be held by the caller.
+func (server *AccountServer) startInitialSync() {
+	server.synced = false
+	server.syncAfter = ""
+
+	go func() {
+		for server.checkRunning() {
+			count, err := server.syncFromPrimary()
+
+			if err == errPackNotSupported {
+				server.logger.Noticef("%s, skipping initial sync", err.Error())
+				break
+			}
+
+			if err == nil {
+				server.logger.Noticef("initial sync with primary complete, saved %d JWTs", count)
+				break
+			}
+
+			server.logger.Errorf("initial sync with primary failed after %d JWTs, will resume in %s, %s", count, syncRetryWait, err.Error())
+			time.Sleep(syncRetryWait)
+		}
+
+		server.Lock()
+		server.synced = server.running
+		server.Unlock()
+	}()
+}
+
+// isSynced returns true once a replica has finished its initial sync, primaries are always synced
+func (server *AccountServer) isSynced() bool {
+	server.Lock()
+	defer server.Unlock()
+	return server.primary == "" || server.synced
+}
+
+// syncFromPrimary streams the pack from the first primary that answers into the store, starting
+// after the last key saved by a previous attempt. The number of JWTs saved by this attempt is returned.
+func (server *AccountServer) syncFromPrimary() (int, error) {
+	server.Lock()
+	jwtStore := server.jwtStore
+	after := server.syncAfter
+	primaries := server.primaries
+	// the pack can be large, so no timeout, and a separate transport so the connection
+	// isn't left open once the sync is done
+	tr := server.createHTTPTransport()
+	server.Unlock()
+
+	defer tr.CloseIdleConnections()
+	client := &http.Client{Transport: tr}
+
+	if primaries == nil {
+		return 0, errPrimaryUnreachable
+	}
+
+	var resp *http.Response
+	var err error
+	for _, primary := range primaries.candidates(time.Now()) {
+		packURL := fmt.Sprintf("%s/jwt/v1/pack", strings.TrimSuffix(primary, "/"))
+		if after != "" {
+			packURL = fmt.Sprintf("%s?after=%s", packURL, url.QueryEscape(after))
+		}
+
+		var req *http.Request
+		req, err = http.NewRequest(http.MethodGet, packURL, nil)
+		if err != nil {
+			return 0, err
+		}
+		if err = server.signPrimaryRequest(req); err != nil {
+			return 0, err
+		}
+
+		resp, err = client.Do(req)
+		if err == nil && resp.StatusCode < http.StatusInternalServerError {
+			server.primaryAnswered(primaries, primary)
+			if resp.StatusCode == http.StatusOK {
+				primaries.served(primary)
+			}
+			break
+		}
+
+		if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("primary returned status %d for pack", resp.StatusCode)
+			resp = nil
+		}
+		server.primaryFailed(primaries, primary)
+	}
+	if resp == nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, errPackNotSupported
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("primary returned status %d for pack", resp.StatusCode)
+	}
+	server.primaryContacted()
+
+	count := 0
+	checksum := sha256.New()
+	reader := bufio.NewReader(io.TeeReader(resp.Body, checksum))
+
+	for {
+		line, err := reader.ReadString('\n')
+
+		if err == io.EOF && line == "" {
+			return count, server.checkPackTrailers(resp, count, checksum.Sum(nil))
+		}
+
+		if err != nil {
+			// includes a partial last line
+			return count, err
+		}
+
+		parts := strings.SplitN(strings.TrimSuffix(line, "\n"), packSeparator, 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return count, fmt.Errorf("bad line in pack after %q", after)
+		}
+
+		if !server.checkRunning() {
+			return count, fmt.Errorf("server stopped")
+		}
+
+		// deleted keys come as tombstones, a JWT or tombstone that fails verification is
+		// skipped, the rest of the pack is still copied
+		if tombstone, ok, err := unpackTombstone(parts[0], parts[1]); ok {
+			if err != nil {
+				server.rejectPrimaryJWT(resp.Request.URL.Host, parts[0], err)
+			} else if err := server.saveTombstone(tombstone); err != nil {
+				atomic.AddUint64(&server.metrics.storeErrors, 1)
+				return count, err
+			}
+		} else if err := server.verifyFetchedJWT(parts[0], parts[1]); err != nil {
+			server.rejectPrimaryJWT(resp.Request.URL.Host, parts[0], err)
+		} else {
+			undo, err := server.reserveStoreSpace(parts[0], parts[1])
+			if err != nil {
+				return count, err
+			}
+			if err := jwtStore.Save(parts[0], parts[1]); err != nil {
+				undo()
+				atomic.AddUint64(&server.metrics.storeErrors, 1)
+				return count, err
+			}
+			server.misses.forget(parts[0])
+			server.indexJWT(parts[0], parts[1])
+		}
+
+		count++
+		after = parts[0]
+
+		server.Lock()
+		server.syncAfter = after
+		server.Unlock()
+	}
+}
+
+// checkPackTrailers compares the count and checksum sent by the primary with the pack that was
+// read, primaries that don't send them are trusted. On a mismatch the next attempt starts over.
+func (server *AccountServer) checkPackTrailers(resp *http.Response, count int, checksum []byte) error {
+	var err error
+
+	if expected := resp.Trailer.Get(packCountTrailer); expected != "" && expected != strconv.Itoa(count) {
+		err = fmt.Errorf("pack should have %s JWTs, read %d", expected, count)
+	}
+
+	if expected := resp.Trailer.Get(packChecksumTrailer); err == nil && expected != "" && expected != hex.EncodeToString(checksum) {
+		err = fmt.Errorf("pack checksum doesn't match")
+	}
+
+	if err != nil {
+		server.Lock()
+		server.syncAfter = ""
+		server.Unlock()
+	}
+	return err
+}
@@ -0,0 +1,235 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/logging"
+	"github.com/nats-io/nkeys"
+)
+
+const (
+	replicaKeyHeader       = "Nats-Replica-Key"
+	replicaTimeHeader      = "Nats-Replica-Time"
+	replicaNonceHeader     = "Nats-Replica-Nonce"
+	replicaSignatureHeader = "Nats-Replica-Signature"
+
+	// minReplicaSkew is the smallest window for a signed request's time, even with a 0 clockskew
+	minReplicaSkew = 5 * time.Second
+
+	// replicaNonceSize is the number of random bytes in a request nonce
+	replicaNonceSize = 16
+)
+
+// replicaSigningPayload is what a replica signs, the method and request URI tie the signature
+// to one request, the time and nonce keep it from being replayed
+func replicaSigningPayload(method string, uri string, timestamp string, nonce string) []byte {
+	return []byte(strings.Join([]string{method, uri, timestamp, nonce}, "\n"))
+}
+
+// signReplicaRequest adds the replica signature headers to a request for the primary. The seed
+// is read for each request, like the NATS nkey, so it isn't kept in memory and can be replaced.
+func signReplicaRequest(req *http.Request, seedFile string, now time.Time) error {
+	kp, err := loadNKeySeed(seedFile)
+	if err != nil {
+		return err
+	}
+	defer kp.Wipe()
+
+	pubKey, err := kp.PublicKey()
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, replicaNonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	encodedNonce := hex.EncodeToString(nonce)
+	sig, err := kp.Sign(replicaSigningPayload(req.Method, req.URL.RequestURI(), timestamp, encodedNonce))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set(replicaKeyHeader, pubKey)
+	req.Header.Set(replicaTimeHeader, timestamp)
+	req.Header.Set(replicaNonceHeader, encodedNonce)
+	req.Header.Set(replicaSignatureHeader, base64.RawURLEncoding.EncodeToString(sig))
+	return nil
+}
+
+// signPrimaryRequest signs a request for the primary if the replica has a seed configured
+func (server *AccountServer) signPrimaryRequest(req *http.Request) error {
+	seedFile := server.currentConfig().ReplicaAuth.SeedFile
+	if seedFile == "" {
+		return nil
+	}
+	if err := signReplicaRequest(req, seedFile, time.Now()); err != nil {
+		return fmt.Errorf("unable to sign request for the primary, %s", err.Error())
+	}
+	return nil
+}
+
+// parseReplicaKeys checks the replica seed file can be read and returns the allowed replica keys
+func parseReplicaKeys(config conf.ReplicaAuthConfig) (map[string]bool, error) {
+	if config.SeedFile != "" {
+		kp, err := loadNKeySeed(config.SeedFile)
+		if err != nil {
+			return nil, err
+		}
+		kp.Wipe()
+	}
+
+	keys := map[string]bool{}
+	for _, key := range config.AllowedKeys {
+		if !nkeys.IsValidPublicUserKey(key) {
+			return nil, fmt.Errorf("replica key %s is not a valid user public key", key)
+		}
+		keys[key] = true
+	}
+	return keys, nil
+}
+
+// replicaVerifier checks signed replica requests, the nonces it has seen are kept until their
+// request would be too old anyway, so a captured request can't be sent again
+type replicaVerifier struct {
+	sync.Mutex
+	keys      map[string]bool
+	seen      map[string]time.Time // nonce to when it can be forgotten
+	lastPrune time.Time
+}
+
+func newReplicaVerifier() *replicaVerifier {
+	return &replicaVerifier{
+		keys: map[string]bool{},
+		seen: map[string]time.Time{},
+	}
+}
+
+// setKeys replaces the allowed keys, the nonces seen are kept so rotation doesn't open a replay window
+func (v *replicaVerifier) setKeys(keys map[string]bool) {
+	v.Lock()
+	defer v.Unlock()
+	v.keys = keys
+}
+
+func (v *replicaVerifier) enabled() bool {
+	v.Lock()
+	defer v.Unlock()
+	return len(v.keys) > 0
+}
+
+// verify checks the signature headers on a request, skew is how far the request time can be
+// from now either way
+func (v *replicaVerifier) verify(r *http.Request, now time.Time, skew time.Duration) error {
+	pubKey := r.Header.Get(replicaKeyHeader)
+	timestamp := r.Header.Get(replicaTimeHeader)
+	nonce := r.Header.Get(replicaNonceHeader)
+	encodedSig := r.Header.Get(replicaSignatureHeader)
+
+	if pubKey == "" || timestamp == "" || nonce == "" || encodedSig == "" {
+		return fmt.Errorf("a signed replica request is required")
+	}
+
+	v.Lock()
+	defer v.Unlock()
+
+	if !v.keys[pubKey] {
+		return fmt.Errorf("replica key %s is not allowed", ShortKey(pubKey))
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad replica request time")
+	}
+	sent := time.Unix(seconds, 0)
+	if sent.Before(now.Add(-skew)) || sent.After(now.Add(skew)) {
+		return fmt.Errorf("replica request time is more than %s from the primary's clock", skew)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(encodedSig)
+	if err != nil {
+		return fmt.Errorf("bad replica signature encoding")
+	}
+
+	kp, err := nkeys.FromPublicKey(pubKey)
+	if err != nil {
+		return err
+	}
+	if err := kp.Verify(replicaSigningPayload(r.Method, r.URL.RequestURI(), timestamp, nonce), sig); err != nil {
+		return fmt.Errorf("replica signature doesn't match the request")
+	}
+
+	if now.Sub(v.lastPrune) > time.Second {
+		for n, until := range v.seen {
+			if now.After(until) {
+				delete(v.seen, n)
+			}
+		}
+		v.lastPrune = now
+	}
+
+	seenKey := pubKey + " " + nonce
+	if _, ok := v.seen[seenKey]; ok {
+		return fmt.Errorf("replica request nonce was already used")
+	}
+	v.seen[seenKey] = sent.Add(skew)
+
+	return nil
+}
+
+// replicaSkew is the window for signed request times, the clock skew allowed for JWTs with a floor
+func (server *AccountServer) replicaSkew() time.Duration {
+	skew := time.Duration(server.currentConfig().ClockSkew) * time.Second
+	if skew < minReplicaSkew {
+		return minReplicaSkew
+	}
+	return skew
+}
+
+// requireReplicaSignature wraps a handler that lists the store, if replica keys are configured
+// requests that aren't signed by one of them get a 401
+func (server *AccountServer) requireReplicaSignature(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		if !server.replicaKeys.enabled() {
+			handle(w, r, params)
+			return
+		}
+
+		if err := server.replicaKeys.verify(r, time.Now(), server.replicaSkew()); err != nil {
+			server.logger.WithFields(logging.Fields{"remote": r.RemoteAddr, "error": err}).Warnf("rejected %s %s from %s, %s", r.Method, r.URL.Path, r.RemoteAddr, err.Error())
+			server.sendErrorResponse(http.StatusUnauthorized, err.Error(), "", nil, w)
+			return
+		}
+
+		handle(w, r, params)
+	}
+}
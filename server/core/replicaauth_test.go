@@ -0,0 +1,140 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+// writeReplicaSeed saves a new user nkey seed in a temp file and returns the file and public key
+func writeReplicaSeed(t *testing.T) (string, string) {
+	kp, err := nkeys.CreateUser()
+	require.NoError(t, err)
+	seed, err := kp.Seed()
+	require.NoError(t, err)
+	pubKey, err := kp.PublicKey()
+	require.NoError(t, err)
+
+	file, err := ioutil.TempFile(os.TempDir(), "replica_seed")
+	require.NoError(t, err)
+	defer file.Close()
+	_, err = file.Write(seed)
+	require.NoError(t, err)
+	return file.Name(), pubKey
+}
+
+func TestReplicaVerifier(t *testing.T) {
+	seedFile, pubKey := writeReplicaSeed(t)
+	defer os.Remove(seedFile)
+	otherSeed, _ := writeReplicaSeed(t)
+	defer os.Remove(otherSeed)
+
+	now := time.Now()
+	skew := 10 * time.Second
+	v := newReplicaVerifier()
+	keys, err := parseReplicaKeys(conf.ReplicaAuthConfig{SeedFile: seedFile, AllowedKeys: []string{pubKey}})
+	require.NoError(t, err)
+	v.setKeys(keys)
+
+	signed := func(seed string, url string, at time.Time) *http.Request {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err)
+		require.NoError(t, signReplicaRequest(req, seed, at))
+		return req
+	}
+
+	req := signed(seedFile, "http://primary/jwt/v1/pack?after=A", now)
+	require.NoError(t, v.verify(req, now, skew))
+
+	// the same request can't be sent twice
+	require.Error(t, v.verify(req, now, skew))
+
+	unsigned, err := http.NewRequest(http.MethodGet, "http://primary/jwt/v1/pack", nil)
+	require.NoError(t, err)
+	require.Error(t, v.verify(unsigned, now, skew))
+
+	require.Error(t, v.verify(signed(otherSeed, "http://primary/jwt/v1/pack", now), now, skew))
+	require.Error(t, v.verify(signed(seedFile, "http://primary/jwt/v1/pack", now.Add(-time.Minute)), now, skew))
+	require.Error(t, v.verify(signed(seedFile, "http://primary/jwt/v1/pack", now.Add(time.Minute)), now, skew))
+
+	// the signature covers the path and query
+	tampered := signed(seedFile, "http://primary/jwt/v1/pack?after=A", now)
+	tampered.URL.RawQuery = "after=B"
+	require.Error(t, v.verify(tampered, now, skew))
+
+	// rotating keys
+	_, err = parseReplicaKeys(conf.ReplicaAuthConfig{AllowedKeys: []string{"bad"}})
+	require.Error(t, err)
+	_, err = parseReplicaKeys(conf.ReplicaAuthConfig{SeedFile: "/a/b/c"})
+	require.Error(t, err)
+	v.setKeys(map[string]bool{})
+	require.False(t, v.enabled())
+}
+
+func TestSignedReplicaSync(t *testing.T) {
+	seedFile, pubKey := writeReplicaSeed(t)
+	defer os.Remove(seedFile)
+
+	config := conf.DefaultServerConfig()
+	config.ReplicaAuth.AllowedKeys = []string{pubKey}
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	jwts := saveTestAccounts(t, testEnv, 5)
+
+	for _, path := range []string{"/jwt/v1/pack", "/jwt/v1/accounts"} {
+		resp, err := testEnv.HTTP.Get(testEnv.URLForPath(path))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	// lookups by nats-servers aren't signed
+	for k := range jwts {
+		resp, err := testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/accounts/" + k))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	replicaConfig := testEnv.CreateReplicaConfig("")
+	replicaConfig.ReplicaAuth.SeedFile = seedFile
+	replica := NewAccountServer()
+	replica.InitializeFromConfig(replicaConfig)
+	require.NoError(t, replica.Start())
+	defer replica.Stop()
+
+	for i := 0; i < 50 && !replica.isSynced(); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.True(t, replica.isSynced())
+
+	for k, v := range jwts {
+		got, err := replica.jwtStore.Load(k)
+		require.NoError(t, err)
+		require.Equal(t, v, got)
+	}
+}
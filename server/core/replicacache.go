@@ -0,0 +1,152 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// replicaCacheFile is written next to the JWTs in a directory store, without the
+	// JWT extension so the store ignores it
+	replicaCacheFile = "replica-cache.json"
+
+	// replicaCacheSaveInterval is how often changes to the cache are written
+	replicaCacheSaveInterval = 30 * time.Second
+)
+
+// replicaCachePath returns where a replica keeps its stale times, empty if the store
+// isn't a directory or the server is a primary
+func (server *AccountServer) replicaCachePath() string {
+	if len(server.config.Primary) == 0 || server.config.Store.Dir == "" {
+		return ""
+	}
+	return filepath.Join(server.config.Store.Dir, replicaCacheFile)
+}
+
+// loadReplicaCache reads the stale times saved by a previous run, entries that have gone
+// stale are dropped. A missing or unreadable file is an empty cache.
+func loadReplicaCache(path string) map[string]time.Time {
+	validUntil := map[string]time.Time{}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return validUntil
+	}
+
+	saved := map[string]time.Time{}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return validUntil
+	}
+
+	now := time.Now()
+	for pubKey, staleAt := range saved {
+		// zero never goes stale
+		if staleAt.IsZero() || staleAt.After(now) {
+			validUntil[pubKey] = staleAt
+		}
+	}
+	return validUntil
+}
+
+// saveReplicaCache writes the stale times if they changed since the last save, it replaces
+// the file with a rename so a crash doesn't leave it half written
+func (server *AccountServer) saveReplicaCache(path string) error {
+	if !atomic.CompareAndSwapInt32(&server.replicaCacheDirty, 1, 0) {
+		return nil
+	}
+
+	server.cacheLock.Lock()
+	data, err := json.Marshal(server.validUntil)
+	server.cacheLock.Unlock()
+
+	if err == nil {
+		tmp := path + ".tmp"
+		if err = ioutil.WriteFile(tmp, data, 0644); err == nil {
+			if err = os.Rename(tmp, path); err != nil {
+				os.Remove(tmp)
+			}
+		}
+	}
+
+	if err != nil {
+		// try again next time
+		atomic.StoreInt32(&server.replicaCacheDirty, 1)
+	}
+	return err
+}
+
+// startReplicaCache loads the saved stale times and saves changes until the server stops,
+// the server lock is held
+func (server *AccountServer) startReplicaCache() {
+	path := server.replicaCachePath()
+	if path == "" {
+		return
+	}
+
+	server.cacheLock.Lock()
+	server.validUntil = loadReplicaCache(path)
+	count := len(server.validUntil)
+	server.cacheLock.Unlock()
+
+	if count > 0 {
+		server.logger.Noticef("loaded %d cached JWT stale times from %s", count, path)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	server.replicaCacheStop = stop
+	server.replicaCacheDone = done
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(replicaCacheSaveInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				if err := server.saveReplicaCache(path); err != nil {
+					server.logger.Warnf("unable to save the replica cache, %s", err.Error())
+				}
+				return
+			}
+
+			if err := server.saveReplicaCache(path); err != nil {
+				server.logger.Warnf("unable to save the replica cache, %s", err.Error())
+			}
+		}
+	}()
+}
+
+// stopReplicaCache saves the stale times one last time
+func (server *AccountServer) stopReplicaCache() {
+	if server.replicaCacheStop == nil {
+		return
+	}
+	close(server.replicaCacheStop)
+	<-server.replicaCacheDone
+	server.replicaCacheStop = nil
+	server.replicaCacheDone = nil
+}
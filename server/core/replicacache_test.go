@@ -0,0 +1,120 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadReplicaCache(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "replicacache_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, replicaCacheFile)
+
+	// missing
+	require.Empty(t, loadReplicaCache(path))
+
+	// corrupted
+	require.NoError(t, ioutil.WriteFile(path, []byte("{not json"), 0644))
+	require.Empty(t, loadReplicaCache(path))
+}
+
+func TestReplicaCacheSurvivesRestart(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir(os.TempDir(), "replicacache_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	replica, err := testEnv.CreateReplica(dir)
+	require.NoError(t, err)
+
+	future := time.Now().Add(time.Hour).Round(0)
+	replica.markValid("fresh", 0)
+	replica.cacheLock.Lock()
+	replica.validUntil["fresh"] = future
+	replica.validUntil["forever"] = time.Time{}
+	replica.validUntil["stale"] = time.Now().Add(-time.Hour)
+	replica.cacheLock.Unlock()
+
+	replica.markValid("deleted", 0)
+	replica.forgetValid("deleted")
+
+	replica.Stop()
+	require.FileExists(t, filepath.Join(dir, replicaCacheFile))
+
+	replica, err = testEnv.CreateReplica(dir)
+	require.NoError(t, err)
+	defer replica.Stop()
+
+	replica.cacheLock.Lock()
+	defer replica.cacheLock.Unlock()
+	require.Len(t, replica.validUntil, 2)
+	require.True(t, future.Equal(replica.validUntil["fresh"]))
+	staleAt, ok := replica.validUntil["forever"]
+	require.True(t, ok)
+	require.True(t, staleAt.IsZero())
+}
+
+func TestReplicaCacheIgnoresCorruptFile(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir(os.TempDir(), "replicacache_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, replicaCacheFile), []byte("garbage"), 0644))
+
+	replica, err := testEnv.CreateReplica(dir)
+	require.NoError(t, err)
+	defer replica.Stop()
+
+	replica.cacheLock.Lock()
+	require.Empty(t, replica.validUntil)
+	replica.cacheLock.Unlock()
+}
+
+func TestPrimaryDoesNotWriteReplicaCache(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "replicacache_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := conf.DefaultServerConfig()
+	config.Store.Dir = dir
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	testEnv.Server.markValid("key", 0)
+	testEnv.Server.Stop()
+
+	_, err = os.Stat(filepath.Join(dir, replicaCacheFile))
+	require.True(t, os.IsNotExist(err))
+}
@@ -17,13 +17,15 @@
 package core
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
-	"path/filepath"
+	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -41,40 +43,147 @@ const version = "0.8.0"
 type AccountServer struct {
 	sync.Mutex
 	running bool
+	done    chan struct{} // closed when the server stops
+	stopErr error         // why the server stopped on its own, nil after a call to Stop
 
 	startTime time.Time
 
 	logger logging.Logger
-	config *conf.AccountServerConfig
+	config *conf.AccountServerConfig // replaced, not changed, on reload
+	flags  *Flags
+
+	nats             *nats.Conn
+	natsTimer        *time.Timer
+	natsBackoff      time.Duration // the last wait between connect attempts, reset on connect
+	notificationSubs []*nats.Subscription
+	requestSubs      []*nats.Subscription
+	jetStream        *notificationStream // set when notifications go to a JetStream stream
+
+	mirror        *nats.Conn // the other server's NATS, in mirror mode
+	mirrorTimer   *time.Timer
+	mirrorBackoff time.Duration
+
+	pendingNotifications *notificationQueue
+	natsState            *natsTracker
+	dirty                *dirtyList // JWTs from notifications that couldn't be saved
+	seenNotifications    *seenJTIs  // JTIs of recent notifications, to drop copies
+	instanceID           string     // random id set on our notifications, so we can drop our own
+
+	listener    net.Listener
+	listeners   []*extraListener // HTTP.Listeners, the first listener is listener
+	writeTokens [][]byte         // hashes of the bearer tokens for POST and DELETE requests
+	writeFilter *writeFilter     // nil unless there are write allow or deny lists
+	replicaKeys *replicaVerifier
+	rateLimits  *rateLimits
+	http        *http.Server
+	debugServer *http.Server // pprof and /debug/cache, nil unless Debug.Port is set
+	// cancels the context of requests still running when the shutdown timeout ends
+	cancelRequests context.CancelFunc
+
+	renotify *renotifyJob // the latest POST /jwt/v1/notify job
+
+	validators  []accountPolicy // registered with AddAccountValidator
+	policyFlags *policyFlags    // accounts from notifications saved though they failed a policy
 
-	nats      *nats.Conn
-	natsTimer *time.Timer
-
-	listener net.Listener
-	http     *http.Server
 	protocol string
 	port     int
 	hostPort string
 
 	jwtStore            store.JWTStore
-	trustedKeys         []string
+	historyKeep         int32    // Store.History, read by saveJWT without the lock
+	trustedKeys         []string // the configured keys and the operator's, guarded by operatorLock
+	configuredKeys      []string // TrustedOperatorKeys, kept so the operator's keys can be replaced
 	operatorJWT         string
+	operator            operatorFile
+	operators           []hostedOperator // the operators list, each has a namespace in the store
+	operatorLock        sync.Mutex
 	systemAccountClaims *jwt.AccountClaims
 	systemAccountJWT    string
+	accountNames        *accountNameIndex
+	accounts            *accountIndex // summaries for the account listing
+	audit               *auditLog     // nil unless AuditLogPath is set
+	webhooks            *webhooks     // nil unless webhook endpoints are configured
+	activations         *activationIndex
 
 	// In replica mode the server uses a directory or memory for storage. Requests
 	// are checked against the http cache settings and try to update from the primary
 	// if necessary. However, if a version of the JWT is available in the persistent store
 	// it will be returned if the primary is down, regarldess of the cache situation.
+	// primary is the primary URLs joined with commas, primaries tracks their health.
 	primary    string
+	primaries  *primaryPool
 	cacheLock  sync.Mutex
 	validUntil map[string]time.Time // map of pubkey to stale time
+	refreshing map[string]bool      // stale JWTs being fetched in the background
 	httpClient *http.Client
+
+	// the refresher fetches the most requested JWTs before they go stale
+	hits    *hitCounter
+	lookups *accountLookups // lookups for each account, for the status endpoint and metrics
+	misses  *negativeCache  // accounts that weren't found recently
+	legacy  *legacyJWTs     // cached legacy format checks, for the status and strict lookups
+
+	storeUsage  *storeUsage // nil unless the store has limits
+	refreshStop chan struct{}
+	refreshDone chan struct{}
+
+	// replicas with Gossip.Subject set publish the accounts they saved recently
+	gossip     *gossip
+	gossipStop chan struct{}
+	gossipDone chan struct{}
+
+	// replicas with a directory store save validUntil, so a restart doesn't refetch everything
+	replicaCacheDirty int32 // set atomically when validUntil changes
+	replicaCacheStop  chan struct{}
+	replicaCacheDone  chan struct{}
+
+	// saves hold saveLock for reading, garbage collection holds it while it deletes an entry
+	saveLock sync.RWMutex
+	gcStop   chan struct{}
+	gcDone   chan struct{}
+
+	// stop and done for the periodic expiring account warnings
+	expiryStop chan struct{}
+	expiryDone chan struct{}
+
+	// stop and done for the bootstrap file writer
+	bootstrapStop chan struct{}
+	bootstrapDone chan struct{}
+
+	// the NATS client certificate, stop and done for the watcher that reconnects when it changes
+	natsCert     *certificateLoader
+	natsCertStop chan struct{}
+	natsCertDone chan struct{}
+
+	metrics *serverMetrics
+
+	// Replicas copy the primary's store at startup, syncAfter is the last key saved
+	// so an interrupted sync can resume
+	synced    bool
+	syncAfter string
+
+	primaryFetched int32 // set atomically once a replica gets a JWT, or a 304, from the primary
+	primaryContact int64 // set atomically to the time, in unix nanoseconds, the primary last answered
 }
 
 // NewAccountServer creates a new account server with a default logger
 func NewAccountServer() *AccountServer {
 	return &AccountServer{
+		metrics:              &serverMetrics{},
+		pendingNotifications: newNotificationQueue(),
+		natsState:            newNATSTracker(),
+		jetStream:            &notificationStream{},
+		policyFlags:          newPolicyFlags(),
+		dirty:                newDirtyList(),
+		replicaKeys:          newReplicaVerifier(),
+		accountNames:         newAccountNameIndex(),
+		accounts:             newAccountIndex(),
+		seenNotifications:    newSeenJTIs(seenJTIsSize),
+		instanceID:           newTraceID(),
+		activations:          newActivationIndex(),
+		lookups:              newAccountLookups(),
+		misses:               newNegativeCache(),
+		legacy:               newLegacyJWTs(),
 		logger: logging.NewNATSLogger(logging.Config{
 			Colors: true,
 			Time:   true,
@@ -84,77 +193,157 @@ func NewAccountServer() *AccountServer {
 	}
 }
 
+// NewAccountServerFromConfig creates an account server to run in-process, the config is copied
+// so later changes to it are ignored, use DefaultServerConfig() to create a default config
+func NewAccountServerFromConfig(config *conf.AccountServerConfig) (*AccountServer, error) {
+	if config == nil {
+		return nil, fmt.Errorf("a config is required")
+	}
+
+	copied := *config
+	server := NewAccountServer()
+	server.logger = logging.NewNATSLogger(copied.Logging)
+	if err := server.InitializeFromConfig(&copied); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
 // Logger hosts a shared logger
 func (server *AccountServer) Logger() logging.Logger {
 	return server.logger
 }
 
+// Port returns the port the HTTP server is bound to, useful when it is configured as 0
+func (server *AccountServer) Port() int {
+	server.Lock()
+	defer server.Unlock()
+	return server.port
+}
+
+// Store returns the JWT store, nil if the server isn't running
+func (server *AccountServer) Store() store.JWTStore {
+	server.Lock()
+	defer server.Unlock()
+	return server.jwtStore
+}
+
+// Done returns a channel that is closed when the server stops, after a call to Stop or on its own,
+// it is nil until the server is started
+func (server *AccountServer) Done() <-chan struct{} {
+	server.Lock()
+	defer server.Unlock()
+	return server.done
+}
+
+// Err returns why the server stopped on its own, such as the NATS connection closing with
+// exitonclose set, or why Start failed, it is nil while running and after a call to Stop
+func (server *AccountServer) Err() error {
+	server.Lock()
+	defer server.Unlock()
+	return server.stopErr
+}
+
 func (server *AccountServer) checkRunning() bool {
 	server.Lock()
 	defer server.Unlock()
 	return server.running
 }
 
+// currentConfig returns the config for code that runs without the lock, a reload replaces
+// the config so the result doesn't change while it is used
+func (server *AccountServer) currentConfig() *conf.AccountServerConfig {
+	server.Lock()
+	defer server.Unlock()
+	return server.config
+}
+
+// currentPrimary returns the primary URLs, empty if this isn't a replica, and the client used to reach them
+func (server *AccountServer) currentPrimary() (string, *http.Client) {
+	server.Lock()
+	defer server.Unlock()
+	return server.primary, server.httpClient
+}
+
+// currentPrimaries returns the replica's primaries, nil if this isn't a replica, and the client used to reach them
+func (server *AccountServer) currentPrimaries() (*primaryPool, *http.Client) {
+	server.Lock()
+	defer server.Unlock()
+	return server.primaries, server.httpClient
+}
+
 // InitializeFromFlags is called from main to configure the server, the server
-// will decide what needs to happen based on the flags. On reload the same flags are
-// passed
+// will decide what needs to happen based on the flags. The flags are kept so
+// Reload can apply them again
 func (server *AccountServer) InitializeFromFlags(flags Flags) error {
-	server.config = conf.DefaultServerConfig()
+	config, err := server.configFromFlags(flags)
+	if err != nil {
+		return err
+	}
+
+	server.config = config
+	server.flags = &flags
+	return nil
+}
+
+// configFromFlags builds a config from the defaults, the config file and then the other flags
+func (server *AccountServer) configFromFlags(flags Flags) (*conf.AccountServerConfig, error) {
+	config := conf.DefaultServerConfig()
 
 	if flags.ConfigFile != "" {
-		server.ApplyConfigFile(flags.ConfigFile)
+		server.logger.Noticef("loading configuration from %q", flags.ConfigFile)
+		if err := conf.LoadConfigFromFile(flags.ConfigFile, config, false); err != nil {
+			return nil, err
+		}
 	}
 
 	if flags.NSCFolder != "" {
-		server.config.Store = conf.StoreConfig{
+		config.Store = conf.StoreConfig{
 			NSC: flags.NSCFolder,
 		}
 
-		operatorName := filepath.Base(flags.NSCFolder)
-		operatorPath := filepath.Join(flags.NSCFolder, fmt.Sprintf("%s.jwt", operatorName))
-
-		server.config.OperatorJWTPath = operatorPath
+		config.OperatorJWTPath = nscOperatorJWTPath(flags.NSCFolder)
 	} else if flags.Directory != "" {
-		server.config.Store = conf.StoreConfig{
+		config.Store = conf.StoreConfig{
 			Dir:      flags.Directory,
 			ReadOnly: flags.ReadOnly,
 		}
 	}
 
 	if flags.NATSURL != "" {
-		server.config.NATS.Servers = []string{flags.NATSURL}
+		config.NATS.Servers = []string{flags.NATSURL}
 	}
 
 	if flags.Creds != "" {
-		server.config.NATS.UserCredentials = flags.Creds
+		config.NATS.UserCredentials = flags.Creds
 	}
 
 	if flags.Debug || flags.DebugAndVerbose {
-		server.config.Logging.Debug = true
+		config.Logging.Debug = true
 	}
 
 	if flags.Verbose || flags.DebugAndVerbose {
-		server.config.Logging.Trace = true
+		config.Logging.Trace = true
 	}
 
 	if flags.HostPort != "" {
 		h, p, err := net.SplitHostPort(flags.HostPort)
 		if err != nil {
-			return fmt.Errorf("error parsing hostport: %v", err)
+			return nil, fmt.Errorf("error parsing hostport: %v", err)
 		}
-		server.config.HTTP.Host = h
-		server.config.HTTP.Port, err = strconv.Atoi(p)
+		config.HTTP.Host = h
+		config.HTTP.Port, err = strconv.Atoi(p)
 		if err != nil {
-			return fmt.Errorf("error parsing hostport: %v", err)
+			return nil, fmt.Errorf("error parsing hostport: %v", err)
 
 		}
 	}
 
 	if flags.Primary != "" {
-		server.config.Primary = flags.Primary
+		config.Primary = strings.Split(flags.Primary, ",")
 	}
 
-	return nil
+	return config, nil
 }
 
 // ApplyConfigFile applies the config file to the server's config
@@ -178,8 +367,17 @@ func (server *AccountServer) InitializeFromConfig(config *conf.AccountServerConf
 	return nil
 }
 
-// Start the server, will lock the server, assumes the config is loaded
+// Start the server, will lock the server, assumes the config is loaded. If it fails whatever
+// was started is stopped again, so nothing is left running.
 func (server *AccountServer) Start() error {
+	if err := server.start(); err != nil {
+		server.stop(err)
+		return err
+	}
+	return nil
+}
+
+func (server *AccountServer) start() error {
 	server.Lock()
 	defer server.Unlock()
 
@@ -188,15 +386,83 @@ func (server *AccountServer) Start() error {
 	}
 
 	server.running = true
+	server.done = make(chan struct{})
+	server.stopErr = nil
 	server.startTime = time.Now()
 	server.logger = logging.NewNATSLogger(server.config.Logging)
 	server.validUntil = map[string]time.Time{}
+	server.refreshing = map[string]bool{}
+	server.hits = newHitCounter()
 
 	server.logger.Noticef("starting NATS Account server, version %s", version)
 	server.logger.Noticef("server time is %s", server.startTime.Format(time.UnixDate))
 
 	server.httpClient = server.createHTTPClient()
-	server.primary = server.config.Primary
+	server.primaries = newPrimaryPool(server.config.Primary)
+	server.primary = server.primaries.String()
+
+	if err := logging.ValidateFormat(server.config.Logging.Format); err != nil {
+		return err
+	}
+
+	if server.config.ReplicaCacheTTL < 0 {
+		return fmt.Errorf("replica cache TTL cannot be negative, use 0 to never expire")
+	}
+
+	if server.config.ReplicaMaxStale < 0 {
+		return fmt.Errorf("replica max stale cannot be negative, use 0 for no limit")
+	}
+
+	if err := validateReplicaRefresh(server.config.ReplicaRefresh); err != nil {
+		return err
+	}
+
+	if err := validateLookupCounts(server.config.LookupCounts); err != nil {
+		return err
+	}
+
+	if err := validateNegativeCache(server.config.NegativeCache); err != nil {
+		return err
+	}
+
+	if err := validateStoreLimits(server.config.Store); err != nil {
+		return err
+	}
+
+	if err := validateRelay(server.config); err != nil {
+		return err
+	}
+
+	if err := validateMirror(server.config); err != nil {
+		return err
+	}
+
+	if err := validateOperators(server.config); err != nil {
+		return err
+	}
+
+	if err := validateGossip(server.config); err != nil {
+		return err
+	}
+	gossip, err := newGossip(server.config.Gossip)
+	if err != nil {
+		return err
+	}
+	server.gossip = gossip
+	server.lookups.configure(server.config.LookupCounts)
+	server.misses.configure(server.config.NegativeCache)
+
+	if server.config.AccountCacheTTL < 0 || server.config.ActivationCacheTTL < 0 || server.config.OperatorCacheTTL < 0 {
+		return fmt.Errorf("cache TTLs cannot be negative, use 0 to send no-cache")
+	}
+
+	if server.config.ClockSkew < 0 {
+		return fmt.Errorf("clock skew cannot be negative")
+	}
+
+	if gc := server.config.GC; gc.Interval < 0 || gc.ActivationGrace < 0 || gc.AccountGrace < 0 || gc.TombstoneGrace < 0 {
+		return fmt.Errorf("gc interval and grace periods cannot be negative")
+	}
 
 	if server.primary != "" {
 		server.logger.Noticef("starting in replicated mode, with primary at %s", server.primary)
@@ -206,6 +472,10 @@ func (server *AccountServer) Start() error {
 		}
 	}
 
+	if server.relayMode() {
+		server.logger.Noticef("starting in relay mode, requesting JWTs under %s", server.config.Relay.UpstreamSubjectPrefix)
+	}
+
 	if err := server.initializeTrustedKeys(); err != nil {
 		return err
 	}
@@ -214,21 +484,118 @@ func (server *AccountServer) Start() error {
 		return err
 	}
 
+	tokens, err := loadWriteTokens(server.config.HTTP)
+	if err != nil {
+		return err
+	}
+	server.writeTokens = tokens
+
+	filter, err := newWriteFilter(server.config.HTTP)
+	if err != nil {
+		return err
+	}
+	server.writeFilter = filter
+
+	replicaKeys, err := parseReplicaKeys(server.config.ReplicaAuth)
+	if err != nil {
+		return err
+	}
+	server.replicaKeys.setKeys(replicaKeys)
+
+	limits, err := newRateLimits(server.config.HTTP.RateLimits)
+	if err != nil {
+		return err
+	}
+	server.rateLimits = limits
+
+	server.audit = nil
+	if path := server.config.AuditLogPath; path != "" {
+		audit, err := newAuditLog(path, server.logger)
+		if err != nil {
+			return err
+		}
+		server.audit = audit
+		server.logger.Noticef("writing account changes to audit log %s", path)
+	}
+
+	hooks, err := newWebhooks(server.config.Webhooks, server.metrics, server.logger)
+	if err != nil {
+		return err
+	}
+	server.webhooks = hooks
+	if hooks != nil {
+		server.logger.Noticef("sending account changes to %d webhooks", len(hooks.endpoints))
+	}
+
 	store, err := server.createStore()
 
 	if err != nil {
 		return err
 	}
 
+	if server.config.Store.VerifyOnStart {
+		if _, err := server.verifyStore(store, server.config.Store); err != nil {
+			store.Close()
+			return err
+		}
+	}
+
+	if server.config.LegacyJWTs.ScanOnStart {
+		if _, err := server.scanLegacyJWTs(store); err != nil {
+			store.Close()
+			return err
+		}
+	}
+
+	if err := server.startHistory(store); err != nil {
+		store.Close()
+		return err
+	}
+
+	usage, err := newStoreUsage(server.config.Store, store)
+	if err != nil {
+		store.Close()
+		return fmt.Errorf("unable to count the store for its limits, %s", err.Error())
+	}
+	server.storeUsage = usage
+	if usage != nil {
+		entries, bytes := usage.totals()
+		server.logger.Noticef("store limits are %d entries and %d bytes, 0 means no limit, %d entries and %d bytes are used", usage.maxEntries, usage.maxBytes, entries, bytes)
+		if usage.warned {
+			server.logStoreUsage()
+		}
+	}
+
 	server.jwtStore = store
+	server.buildIndexes(store)
+	server.startReplicaCache()
+	server.startGC()
+	server.startExpiryWarnings()
 
+	server.natsCert = nil
 	if err := server.connectToNATS(); err != nil {
 		return err
 	}
 
+	if err := server.connectToMirror(); err != nil {
+		return err
+	}
+	server.startNATSCertWatcher()
+
+	if err := server.startDebug(server.config.Debug); err != nil {
+		return err
+	}
+
 	if err := server.startHTTP(); err != nil {
 		return err
 	}
+	server.startBootstrap()
+
+	if server.primary != "" {
+		server.startInitialSync()
+		server.startRefresher()
+		server.startGossip()
+	}
 
 	server.logger.Noticef("nats-account-server is running")
 	server.logger.Noticef("configure the nats-server with:")
@@ -237,26 +604,67 @@ func (server *AccountServer) Start() error {
 	return nil
 }
 
+// jwtChangedCallback is called by stores that watch their files when a JWT is changed or
+// removed, the indexes are updated and, unless the store skips them, notifications sent
 func (server *AccountServer) jwtChangedCallback(pubKey string) {
+	server.forgetValid(pubKey)
+	server.misses.forget(pubKey)
+	server.legacy.forget(pubKey)
+	server.metrics.resetStoreCount()
+	notify := !server.currentConfig().Store.SkipNotifications
+
 	if nkeys.IsValidPublicAccountKey(pubKey) {
+		logger := server.logger.WithFields(logging.Fields{"account": pubKey})
+
 		theJWT, err := server.jwtStore.Load(pubKey)
+		tombstone, deleted := store.DecodeTombstone(theJWT)
+		if err == store.ErrNotFound || deleted {
+			server.unindexAccount(pubKey)
+			logger.Noticef("JWT for account %s was removed", ShortKey(pubKey))
+			if !notify {
+				return
+			}
+			if !deleted {
+				tombstone = store.Tombstone{PubKey: pubKey, DeletedAt: time.Now().Unix()}
+			}
+			if err := server.sendAccountDeleteNotification(tombstone, "", nil); err != nil {
+				logger.WithFields(logging.Fields{"error": err}).Noticef("error trying to send delete notification from file change for %s, %s", ShortKey(pubKey), err.Error())
+			}
+			return
+		}
 		if err != nil {
-			server.logger.Noticef("error trying to send notification from file change for %s, %s", ShortKey(pubKey), err.Error())
+			server.unindexAccount(pubKey)
+			logger.WithFields(logging.Fields{"error": err}).Noticef("error trying to send notification from file change for %s, %s", ShortKey(pubKey), err.Error())
+			return
+		}
+
+		server.indexJWT(pubKey, theJWT)
+
+		if !notify {
 			return
 		}
 
 		decoded, err := jwt.DecodeAccountClaims(theJWT)
 		if err != nil {
-			server.logger.Noticef("error trying to send notification from file change for %s, %s", ShortKey(pubKey), err.Error())
+			logger.WithFields(logging.Fields{"error": err}).Noticef("error trying to send notification from file change for %s, %s", ShortKey(pubKey), err.Error())
 			return
 		}
 
-		err = server.sendAccountNotification(decoded, []byte(theJWT))
+		err = server.sendAccountNotification(decoded, []byte(theJWT), nil)
 		if err != nil {
-			server.logger.Noticef("error trying to send notification from file change for %s, %s", ShortKey(pubKey), err.Error())
+			logger.WithFields(logging.Fields{"error": err}).Noticef("error trying to send notification from file change for %s, %s", ShortKey(pubKey), err.Error())
 			return
 		}
+		return
 	}
+
+	// activations don't send notifications, but are indexed by account and subject
+	theJWT, err := server.jwtStore.Load(pubKey)
+	if err != nil {
+		server.activations.remove(pubKey)
+		return
+	}
+	server.indexJWT(pubKey, theJWT)
 }
 
 func (server *AccountServer) storeErrorCallback(err error) {
@@ -264,6 +672,35 @@ func (server *AccountServer) storeErrorCallback(err error) {
 	server.Stop()
 }
 
+// sharedStoreInvalidated is called when another server saves or deletes a JWT in a shared redis,
+// or etcd, store, the cached stale time is dropped and the indexes updated. That server sends the
+// NATS notification, so this one doesn't.
+func (server *AccountServer) sharedStoreInvalidated(pubKey string) {
+	server.forgetValid(pubKey)
+
+	jwtStore := server.jwtStore
+	if jwtStore == nil {
+		return
+	}
+
+	theJWT, err := jwtStore.Load(pubKey)
+	if err == nil {
+		server.indexJWT(pubKey, theJWT)
+		return
+	}
+
+	if err == store.ErrNotFound {
+		server.unindexAccount(pubKey)
+		server.activations.remove(pubKey)
+	}
+}
+
+// sharedStoreErrorCallback logs problems with the redis invalidation channel, or etcd watch, the
+// store keeps working and resubscribes
+func (server *AccountServer) sharedStoreErrorCallback(err error) {
+	server.logger.WithFields(logging.Fields{"error": err}).Warnf("%s", err.Error())
+}
+
 func (server *AccountServer) createStore() (store.JWTStore, error) {
 	config := server.config.Store
 
@@ -275,14 +712,71 @@ func (server *AccountServer) createStore() (store.JWTStore, error) {
 		return nil, fmt.Errorf("replica mode cannot be used in read-only mode, but will not allow POST operations")
 	}
 
+	if config.S3.Bucket != "" && (config.Dir != "" || config.NSC != "") {
+		return nil, fmt.Errorf("an S3 bucket cannot be used with a directory or NSC store")
+	}
+
+	if config.Postgres.DSN != "" && (config.Dir != "" || config.NSC != "" || config.S3.Bucket != "") {
+		return nil, fmt.Errorf("a postgres database cannot be used with a directory, NSC or S3 store")
+	}
+
+	if config.Redis.Address != "" && (config.Dir != "" || config.NSC != "" || config.S3.Bucket != "" || config.Postgres.DSN != "") {
+		return nil, fmt.Errorf("a redis server cannot be used with a directory, NSC, S3 or postgres store")
+	}
+
+	if len(config.Etcd.Endpoints) > 0 && (config.Dir != "" || config.NSC != "" || config.S3.Bucket != "" || config.Postgres.DSN != "" || config.Redis.Address != "") {
+		return nil, fmt.Errorf("an etcd cluster cannot be used with a directory, NSC, S3, postgres or redis store")
+	}
+
+	key, err := store.LoadEncryptionKey(config.Encryption)
+	if err != nil {
+		return nil, err
+	}
+
+	if key != nil && config.Dir == "" {
+		return nil, fmt.Errorf("encryption is only supported for directory stores")
+	}
+
 	if config.Dir != "" {
+		var dirStore store.JWTStore
 		if config.ReadOnly {
 			server.logger.Noticef("creating a read-only store at %s", config.Dir)
-			return store.NewImmutableDirJWTStore(config.Dir, config.Shard, server.jwtChangedCallback, server.storeErrorCallback)
+			dirStore, err = store.NewImmutableDirJWTStore(config.Dir, config.Shard, server.jwtChangedCallback, server.storeErrorCallback)
+		} else {
+			server.logger.Noticef("creating a store at %s", config.Dir)
+			dirStore, err = store.NewDirJWTStore(config.Dir, config.Shard, true, nil, nil)
 		}
 
-		server.logger.Noticef("creating a store at %s", config.Dir)
-		return store.NewDirJWTStore(config.Dir, config.Shard, true, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := dirStore.(*store.DirJWTStore).SetShardDepth(config.ShardDepth); err != nil {
+			dirStore.Close()
+			return nil, err
+		}
+
+		if operators := server.hostedOperators(); len(operators) > 0 {
+			names := make([]string, 0, len(operators))
+			for _, operator := range operators {
+				names = append(names, operator.name)
+			}
+			if err := dirStore.(*store.DirJWTStore).SetNamespaces(names, server.namespaceFor); err != nil {
+				dirStore.Close()
+				return nil, err
+			}
+		}
+
+		if key == nil {
+			return dirStore, nil
+		}
+
+		if err := dirStore.(*store.DirJWTStore).SetEncryptionKey(key); err != nil {
+			dirStore.Close()
+			return nil, err
+		}
+		server.logger.Noticef("JWTs in %s are encrypted", config.Dir)
+		return dirStore, nil
 	}
 
 	if config.NSC != "" {
@@ -290,17 +784,127 @@ func (server *AccountServer) createStore() (store.JWTStore, error) {
 		return store.NewNSCJWTStore(config.NSC, server.jwtChangedCallback, server.storeErrorCallback)
 	}
 
+	if config.S3.Bucket != "" {
+		if config.ReadOnly {
+			server.logger.Noticef("creating a read-only store in S3 bucket %s", config.S3.Bucket)
+		} else {
+			server.logger.Noticef("creating a store in S3 bucket %s", config.S3.Bucket)
+		}
+		return store.NewS3JWTStore(config.S3, config.ReadOnly)
+	}
+
+	if config.Postgres.DSN != "" {
+		if config.ReadOnly {
+			server.logger.Noticef("creating a read-only postgres store")
+		} else {
+			server.logger.Noticef("creating a postgres store")
+		}
+		return store.NewPostgresJWTStore(config.Postgres, config.ReadOnly)
+	}
+
+	if config.Redis.Address != "" {
+		if config.ReadOnly {
+			server.logger.Noticef("creating a read-only redis store at %s", config.Redis.Address)
+		} else {
+			server.logger.Noticef("creating a redis store at %s", config.Redis.Address)
+		}
+		return store.NewRedisJWTStore(config.Redis, config.ReadOnly, server.sharedStoreInvalidated, server.sharedStoreErrorCallback)
+	}
+
+	if len(config.Etcd.Endpoints) > 0 {
+		endpoints := strings.Join(config.Etcd.Endpoints, ",")
+		if config.ReadOnly {
+			server.logger.Noticef("creating a read-only etcd store at %s", endpoints)
+		} else {
+			server.logger.Noticef("creating an etcd store at %s", endpoints)
+		}
+		return store.NewEtcdJWTStore(config.Etcd, config.ReadOnly, server.sharedStoreInvalidated, server.sharedStoreErrorCallback)
+	}
+
 	if config.ReadOnly {
 		server.logger.Noticef("creating a read-only, empty, in-memory store")
 		return store.NewImmutableMemJWTStore(map[string]string{}), nil
 	}
 
+	if config.Memory.MaxEntries > 0 || config.Memory.MaxBytes > 0 {
+		server.logger.Noticef("creating an in-memory store, limited to %d JWTs and %d bytes", config.Memory.MaxEntries, config.Memory.MaxBytes)
+		return store.NewLimitedMemJWTStore(config.Memory, server.forgetValid)
+	}
+
 	server.logger.Noticef("creating an in-memory store")
 	return store.NewMemJWTStore(), nil
 }
 
+// ReEncryptStore encrypts every JWT in the configured directory store with the configured key.
+// It is used offline, to migrate a plaintext store, instead of calling Start.
+func (server *AccountServer) ReEncryptStore() (int, error) {
+	config := server.currentConfig().Store
+
+	if config.Dir == "" {
+		return 0, fmt.Errorf("re-encrypting requires a directory store")
+	}
+
+	key, err := store.LoadEncryptionKey(config.Encryption)
+	if err != nil {
+		return 0, err
+	}
+
+	if key == nil {
+		return 0, fmt.Errorf("no encryption key is configured")
+	}
+
+	return store.ReEncryptDir(config.Dir, config.Shard, config.ShardDepth, key)
+}
+
+// MigrateStoreShards moves the files in the configured directory store to match its shard
+// settings. It is used offline, after changing the settings, instead of calling Start.
+func (server *AccountServer) MigrateStoreShards() (int, error) {
+	config := server.currentConfig().Store
+
+	if config.Dir == "" {
+		return 0, fmt.Errorf("migrating shards requires a directory store")
+	}
+
+	return store.MigrateDirShards(config.Dir, config.Shard, config.ShardDepth)
+}
+
+// checkClaimTimes checks a JWT's expiration and not before times with the configured clock skew,
+// unless the server allows expired JWTs
+func (server *AccountServer) checkClaimTimes(expires int64, notBefore int64) error {
+	config := server.currentConfig()
+	if config.AllowExpired {
+		return nil
+	}
+	skew := time.Duration(config.ClockSkew) * time.Second
+	return checkClaimTimes(expires, notBefore, time.Now(), skew)
+}
+
 func (server *AccountServer) initializeTrustedKeys() error {
-	opPath := server.config.OperatorJWTPath
+	keys := []string{}
+
+	for _, k := range server.config.TrustedOperatorKeys {
+		if !nkeys.IsValidPublicOperatorKey(k) {
+			return fmt.Errorf("trusted key %q is not an operator public key", k)
+		}
+		keys = append(keys, k)
+	}
+
+	operators, err := loadOperators(server.config.Operators)
+	if err != nil {
+		return err
+	}
+	for _, operator := range operators {
+		server.logger.Noticef("hosting accounts for operator %q", operator.name)
+		keys = append(keys, operator.keys...)
+	}
+
+	server.operatorLock.Lock()
+	server.configuredKeys = keys
+	server.trustedKeys = keys
+	server.operators = operators
+	server.operatorLock.Unlock()
+
+	opPath := server.operatorJWTPath()
 
 	if opPath == "" {
 		return nil
@@ -308,23 +912,26 @@ func (server *AccountServer) initializeTrustedKeys() error {
 
 	server.logger.Noticef("loading operator from %s", opPath)
 
-	data, err := ioutil.ReadFile(opPath)
+	info, err := os.Stat(opPath)
 	if err != nil {
 		return err
 	}
 
-	operatorJWT, err := jwt.DecodeOperatorClaims(string(data))
+	data, operatorJWT, err := readOperatorJWT(opPath)
 	if err != nil {
 		return err
 	}
 
-	keys := []string{}
-
-	keys = append(keys, operatorJWT.Subject)
-	keys = append(keys, operatorJWT.SigningKeys...)
-
-	server.trustedKeys = keys
-	server.operatorJWT = string(data)
+	server.operatorLock.Lock()
+	server.trustedKeys = trustedKeysFor(keys, operatorJWT)
+	server.operatorJWT = data
+	server.operator = operatorFile{
+		path:    opPath,
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		id:      operatorJWT.ID,
+	}
+	server.operatorLock.Unlock()
 
 	return nil
 }
@@ -355,13 +962,39 @@ func (server *AccountServer) initializeSystemAccount() error {
 }
 
 func (server *AccountServer) createHTTPClient() *http.Client {
-	config := server.config.HTTP
+	timeout := time.Duration(time.Duration(server.config.ReplicationTimeout) * time.Millisecond)
 
-	tlsConf := config.TLS
+	client := http.Client{
+		Transport: server.createHTTPTransport(),
+		Timeout:   timeout,
+	}
+
+	return &client
+}
+
+// createHTTPTransport reads the TLS config, lock should be held by the caller. Connections
+// to the primaries are kept alive and pooled, and use HTTP/2 when the primary supports it.
+func (server *AccountServer) createHTTPTransport() *http.Transport {
+	tlsConf := server.config.HTTP.TLS
+
+	maxIdle := server.config.ReplicationMaxIdle
+	if maxIdle <= 0 {
+		maxIdle = 1
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
 
-	timeout := time.Duration(time.Duration(server.config.ReplicationTimeout) * time.Millisecond)
 	tr := &http.Transport{
-		MaxIdleConnsPerHost: 1,
+		DialContext:         dialer.DialContext,
+		MaxIdleConnsPerHost: maxIdle,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+
+		// a custom TLS config turns HTTP/2 off unless it is asked for
+		ForceAttemptHTTP2: true,
 	}
 
 	if tlsConf.Cert != "" {
@@ -370,42 +1003,93 @@ func (server *AccountServer) createHTTPClient() *http.Client {
 		}
 	}
 
-	client := http.Client{
-		Transport: tr,
-		Timeout:   timeout,
-	}
-
-	return &client
+	return tr
 }
 
 // Stop the account server
 func (server *AccountServer) Stop() {
+	server.stop(nil)
+}
+
+// stop shuts the server down, err is the reason it stopped on its own and is returned by Err
+func (server *AccountServer) stop(err error) {
 	server.Lock()
-	defer server.Unlock()
 
 	if !server.running {
+		server.Unlock()
 		return // already stopped
 	}
 
 	server.logger.Noticef("stopping account server")
 
 	server.running = false
+	server.stopErr = err
 
+	// a timer that already fired sees it was replaced and returns
 	if server.natsTimer != nil {
 		server.natsTimer.Stop()
+		server.natsTimer = nil
+	}
+	server.natsBackoff = 0
+
+	nc := server.nats
+	gcStop, gcDone := server.gcStop, server.gcDone
+	server.gcStop, server.gcDone = nil, nil
+	expiryStop, expiryDone := server.expiryStop, server.expiryDone
+	server.expiryStop, server.expiryDone = nil, nil
+	bootstrapStop, bootstrapDone := server.bootstrapStop, server.bootstrapDone
+	server.bootstrapStop, server.bootstrapDone = nil, nil
+	natsCertStop, natsCertDone := server.natsCertStop, server.natsCertDone
+	server.natsCertStop, server.natsCertDone = nil, nil
+	refreshStop, refreshDone := server.refreshStop, server.refreshDone
+	server.refreshStop, server.refreshDone = nil, nil
+	gossipStop, gossipDone := server.gossipStop, server.gossipDone
+	server.gossipStop, server.gossipDone = nil, nil
+	server.Unlock()
+
+	server.stopGC(gcStop, gcDone)
+	server.stopExpiryWarnings(expiryStop, expiryDone)
+	server.stopBootstrap(bootstrapStop, bootstrapDone)
+	server.stopNATSCertWatcher(natsCertStop, natsCertDone)
+	server.stopRefresher(refreshStop, refreshDone)
+	server.stopGossip(gossipStop, gossipDone)
+
+	// requests in flight finish before NATS is drained, so they can still publish notifications
+	server.stopHTTP()
+
+	// mirrored notifications in flight are republished before the local connection is drained
+	server.stopMirror()
+
+	if nc != nil {
+		server.logger.Noticef("draining NATS connection")
+		server.drainNATS(nc)
 	}
 
-	if server.nats != nil {
-		server.nats.Close()
+	server.Lock()
+	defer server.Unlock()
+
+	if nc != nil {
 		server.nats = nil
+		server.notificationSubs = nil
+		server.requestSubs = nil
+		server.metrics.setNATSConnected(false)
+		server.natsState.setState(natsStateClosed)
 		server.logger.Noticef("disconnected from NATS")
 	}
 
-	server.stopHTTP()
+	server.stopReplicaCache()
+	server.stopDebug()
+	if server.httpClient != nil {
+		server.httpClient.CloseIdleConnections()
+	}
+	server.audit.close()
+	server.webhooks.close()
 
 	if server.jwtStore != nil {
 		server.jwtStore.Close()
 		server.jwtStore = nil
 		server.logger.Noticef("closed JWT store")
 	}
+
+	close(server.done)
 }
@@ -22,11 +22,13 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 
 	"github.com/nats-io/jwt"
 	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/store"
 	nats "github.com/nats-io/nats.go"
 	"github.com/nats-io/nkeys"
 	nsc "github.com/nats-io/nsc/cmd/store"
@@ -261,7 +263,7 @@ func TestStartWithConfigFileFlag(t *testing.T) {
 
 	require.Equal(t, "X:/some_path/NATS.jwt", server.config.OperatorJWTPath)
 	require.Equal(t, "X:/some_path/SYS.jwt", server.config.SystemAccountJWTPath)
-	require.Equal(t, "http://primary.nats.io:5222", server.config.Primary)
+	require.Equal(t, []string{"http://primary.nats.io:5222"}, server.config.Primary)
 
 	require.Equal(t, "D:/nats/as_store", server.config.Store.Dir)
 	require.False(t, server.config.Store.ReadOnly)
@@ -327,7 +329,7 @@ func TestNATSFlags(t *testing.T) {
 	require.NoError(t, err)
 
 	notificationJWT := ""
-	subject := fmt.Sprintf(accountNotificationFormat, apub)
+	subject := testEnv.Server.accountNotificationSubject(apub)
 	_, err = testEnv.NC.Subscribe(subject, func(m *nats.Msg) {
 		lock.Lock()
 		notificationJWT = string(m.Data)
@@ -420,3 +422,145 @@ func TestFlagOverridesConfig(t *testing.T) {
 	require.Equal(t, server.config.HTTP.ReadTimeout, 2000)
 	require.True(t, server.jwtStore.IsReadOnly())
 }
+
+func TestNegativeReplicaCacheTTL(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.HTTP.Port = 0
+	config.ReplicaCacheTTL = -1
+
+	server := NewAccountServer()
+	server.InitializeFromConfig(config)
+	err := server.Start()
+	defer server.Stop()
+	require.Error(t, err)
+}
+
+func TestShardDepthCannotBeCombinedWithShard(t *testing.T) {
+	path, err := ioutil.TempDir(os.TempDir(), "store")
+	require.NoError(t, err)
+	defer os.RemoveAll(path)
+
+	config := conf.DefaultServerConfig()
+	config.HTTP.Port = 0
+	config.Store.Dir = path
+	config.Store.Shard = true
+	config.Store.ShardDepth = 2
+
+	server := NewAccountServer()
+	server.InitializeFromConfig(config)
+	err = server.Start()
+	defer server.Stop()
+	require.Error(t, err)
+}
+
+func TestS3StoreCannotBeCombinedWithDir(t *testing.T) {
+	path, err := ioutil.TempDir(os.TempDir(), "store")
+	require.NoError(t, err)
+
+	config := conf.DefaultServerConfig()
+	config.HTTP.Port = 0
+	config.Store.Dir = path
+	config.Store.S3.Bucket = "jwts"
+
+	server := NewAccountServer()
+	server.InitializeFromConfig(config)
+	err = server.Start()
+	defer server.Stop()
+	require.Error(t, err)
+}
+
+func TestPostgresStoreCannotBeCombinedWithS3(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.HTTP.Port = 0
+	config.Store.S3.Bucket = "jwts"
+	config.Store.Postgres.DSN = "postgres://localhost/jwts"
+
+	server := NewAccountServer()
+	server.InitializeFromConfig(config)
+	err := server.Start()
+	defer server.Stop()
+	require.Error(t, err)
+}
+
+func TestRedisStoreCannotBeCombinedWithPostgres(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.HTTP.Port = 0
+	config.Store.Postgres.DSN = "postgres://localhost/jwts"
+	config.Store.Redis.Address = "localhost:6379"
+
+	server := NewAccountServer()
+	server.InitializeFromConfig(config)
+	err := server.Start()
+	defer server.Stop()
+	require.Error(t, err)
+}
+
+func TestBadTrustedOperatorKey(t *testing.T) {
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+
+	config := conf.DefaultServerConfig()
+	config.HTTP.Port = 0
+	config.TrustedOperatorKeys = []string{pubKey}
+
+	server := NewAccountServer()
+	server.InitializeFromConfig(config)
+	err = server.Start()
+	defer server.Stop()
+	require.Error(t, err)
+}
+
+func TestEncryptedStoreConfig(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// a missing key is a startup error
+	config := conf.DefaultServerConfig()
+	config.HTTP.Port = 0
+	config.Store.Dir = dir
+	config.Store.Encryption.KeyEnv = "NAS_TEST_STORE_KEY"
+
+	server := NewAccountServer()
+	server.InitializeFromConfig(config)
+	require.Error(t, server.Start())
+	server.Stop()
+
+	// encryption is only for directory stores
+	config.Store.Dir = ""
+	os.Setenv("NAS_TEST_STORE_KEY", strings.Repeat("ab", 32))
+	defer os.Unsetenv("NAS_TEST_STORE_KEY")
+
+	server = NewAccountServer()
+	server.InitializeFromConfig(config)
+	require.Error(t, server.Start())
+	server.Stop()
+
+	// a plaintext JWT written before encryption is migrated offline
+	plainStore, err := store.NewDirJWTStore(dir, false, false, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, plainStore.Save("plain", "eyplain"))
+	plainStore.Close()
+
+	config.Store.Dir = dir
+	server = NewAccountServer()
+	server.InitializeFromConfig(config)
+	count, err := server.ReEncryptStore()
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+
+	require.NoError(t, server.Start())
+	defer server.Stop()
+
+	require.NoError(t, server.jwtStore.Save("secret", "eysecret"))
+	data, err := ioutil.ReadFile(filepath.Join(dir, "secret.jwt"))
+	require.NoError(t, err)
+	require.NotContains(t, string(data), "eysecret")
+
+	got, err := server.jwtStore.Load("plain")
+	require.NoError(t, err)
+	require.Equal(t, "eyplain", got)
+}
@@ -207,7 +207,7 @@ func (ts *TestSetup) initKeys() error {
 
 func (ts *TestSetup) CreateReplicaConfig(dir string) *conf.AccountServerConfig {
 	config := conf.DefaultServerConfig()
-	config.Primary = ts.URLForPath("/")
+	config.Primary = []string{ts.URLForPath("/")}
 	config.NATS = ts.Server.config.NATS
 	config.HTTP.Port = int(atomic.AddUint64(&port, 1))
 	config.OperatorJWTPath = ts.OperatorJWTFile
@@ -252,6 +252,7 @@ func SetupTestServer(config *conf.AccountServerConfig, useTLS bool, enableNats b
 		MaxReconnects:   -1, // keep trying, since we start account server before the gnatsd
 		ReconnectWait:   100,
 		UserCredentials: testSetup.SystemUserCredsFile,
+		LookupSubject:   conf.DefaultServerConfig().NATS.LookupSubject,
 	}
 
 	if useTLS {
@@ -70,7 +70,7 @@ func TestServerFileWatchNotification(t *testing.T) {
 	require.Equal(t, cd, jwt)
 
 	notificationJWT := ""
-	subject := fmt.Sprintf(accountNotificationFormat, apub)
+	subject := testEnv.Server.accountNotificationSubject(apub)
 	_, err = testEnv.NC.Subscribe(subject, func(m *nats.Msg) {
 		lock.Lock()
 		notificationJWT = string(m.Data)
@@ -102,3 +102,41 @@ func TestServerFileWatchNotification(t *testing.T) {
 	require.Equal(t, notificationJWT, jwt)
 	lock.Unlock()
 }
+
+func TestReadOnlyDirWatchUpdatesIndexes(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "jwtstore_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := conf.DefaultServerConfig()
+	config.Store.Dir = dir
+	config.Store.ReadOnly = true
+	config.Store.SkipNotifications = true
+
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	_, apub, _ := CreateAccountKey(t)
+	c := jwt.NewAccountClaims(apub)
+	c.Name = "watched"
+	cd, err := c.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	waitFor := func(expected []string) {
+		for i := 0; i < 50; i++ {
+			if len(testEnv.Server.accountNames.lookup("watched")) == len(expected) {
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		require.Equal(t, expected, testEnv.Server.accountNames.lookup("watched"))
+	}
+
+	path := filepath.Join(dir, apub+".jwt")
+	require.NoError(t, ioutil.WriteFile(path, []byte(cd), 0644))
+	waitFor([]string{apub})
+
+	require.NoError(t, os.Remove(path))
+	waitFor([]string{})
+}
@@ -0,0 +1,419 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/store"
+	"github.com/nats-io/nkeys"
+)
+
+const storeCommandUsage = `usage: nats-account-server store <command> [-c config] [-dir path | -nsc path] [args]
+
+commands:
+  list               print the key, kind, name and expiration of each stored JWT
+  get <key>          print the raw JWT stored for key
+  put <key> <file>   save the JWT in file, or - for stdin, checking it is for key unless -force is set
+  rm <key>           remove the JWT stored for key
+  verify             decode every stored JWT, the exit code is 1 if any are corrupt
+`
+
+// storeCommand works on a store directly, without starting the HTTP server or connecting to NATS
+type storeCommand struct {
+	server *AccountServer
+	store  store.JWTStore
+	in     io.Reader
+	out    io.Writer
+	force  bool
+}
+
+// storeEntry is a stored JWT, or the error loading it
+type storeEntry struct {
+	key string
+	jwt string
+	err error
+}
+
+// RunStoreCommand runs one of the offline store commands, args are the arguments after "store".
+// Only directory and NSC stores are supported, from the flags or the store in a config file.
+// The server should not be running when the store is changed. Returns the exit code.
+func RunStoreCommand(args []string, in io.Reader, out io.Writer, errOut io.Writer) int {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		fmt.Fprint(errOut, storeCommandUsage)
+		return 2
+	}
+
+	name := args[0]
+	flags := flag.NewFlagSet("store "+name, flag.ContinueOnError)
+	flags.SetOutput(errOut)
+	configFile := flags.String("c", "", "configuration filepath, for the store settings")
+	dir := flags.String("dir", "", "the store directory, instead of the one in the config file")
+	nsc := flags.String("nsc", "", "the nsc folder, instead of the store in the config file")
+	force := flags.Bool("force", false, "put a JWT even if it doesn't decode or isn't for the key")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	run := map[string]func(*storeCommand, []string) error{
+		"list":   (*storeCommand).list,
+		"get":    (*storeCommand).get,
+		"put":    (*storeCommand).put,
+		"rm":     (*storeCommand).rm,
+		"verify": (*storeCommand).verify,
+	}[name]
+
+	if run == nil {
+		fmt.Fprintf(errOut, "unknown store command %q\n", name)
+		fmt.Fprint(errOut, storeCommandUsage)
+		return 2
+	}
+
+	cmd, err := openStoreCommand(*configFile, *dir, *nsc)
+	if err != nil {
+		fmt.Fprintf(errOut, "unable to open the store, %s\n", err.Error())
+		return 1
+	}
+	defer cmd.store.Close()
+
+	cmd.in = in
+	cmd.out = out
+	cmd.force = *force
+
+	if err := run(cmd, flags.Args()); err != nil {
+		fmt.Fprintf(errOut, "%s\n", err.Error())
+		return 1
+	}
+	return 0
+}
+
+// openStoreCommand opens the store from the flags or the config file, the same way the server
+// does but without watching it for changes
+func openStoreCommand(configFile string, dir string, nsc string) (*storeCommand, error) {
+	config := conf.DefaultServerConfig()
+	if configFile != "" {
+		if err := conf.LoadConfigFromFile(configFile, config, false); err != nil {
+			return nil, err
+		}
+	}
+
+	if nsc != "" {
+		config.Store = conf.StoreConfig{NSC: nsc}
+	} else if dir != "" {
+		config.Store = conf.StoreConfig{Dir: dir}
+	}
+
+	server := NewAccountServer()
+	server.config = config
+
+	if config.Store.NSC != "" {
+		jwtStore, err := store.NewNSCJWTStore(config.Store.NSC, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		return &storeCommand{server: server, store: jwtStore}, nil
+	}
+
+	if config.Store.Dir == "" {
+		return nil, fmt.Errorf("a directory or NSC store is required, use -dir, -nsc or a config file with one")
+	}
+
+	key, err := store.LoadEncryptionKey(config.Store.Encryption)
+	if err != nil {
+		return nil, err
+	}
+
+	jwtStore, err := store.NewDirJWTStore(config.Store.Dir, config.Store.Shard, false, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	dirStore := jwtStore.(*store.DirJWTStore)
+
+	if err := dirStore.SetShardDepth(config.Store.ShardDepth); err != nil {
+		dirStore.Close()
+		return nil, err
+	}
+
+	if key != nil {
+		if err := dirStore.SetEncryptionKey(key); err != nil {
+			dirStore.Close()
+			return nil, err
+		}
+	}
+
+	if len(config.Operators) > 0 {
+		if err := validateOperators(config); err != nil {
+			dirStore.Close()
+			return nil, err
+		}
+		operators, err := loadOperators(config.Operators)
+		if err != nil {
+			dirStore.Close()
+			return nil, err
+		}
+		server.operators = operators
+
+		names := make([]string, 0, len(operators))
+		for _, operator := range operators {
+			names = append(names, operator.name)
+		}
+		if err := dirStore.SetNamespaces(names, server.namespaceFor); err != nil {
+			dirStore.Close()
+			return nil, err
+		}
+
+		// put routes activations and users by their account's operator, like the server
+		err = dirStore.Iterate(func(key string, theJWT string) error {
+			if !nkeys.IsValidPublicAccountKey(key) || store.IsTombstone(theJWT) {
+				return nil
+			}
+			if claim, err := jwt.DecodeAccountClaims(theJWT); err == nil {
+				server.accounts.set(summaryForAccount(claim))
+			}
+			return nil
+		})
+		if err != nil {
+			dirStore.Close()
+			return nil, err
+		}
+	}
+
+	return &storeCommand{server: server, store: dirStore}, nil
+}
+
+// entries loads every stored JWT in key order, stores that list their keys let each JWT fail
+// to load without stopping the others
+func (cmd *storeCommand) entries() ([]storeEntry, error) {
+	entries := []storeEntry{}
+
+	if lister, ok := cmd.store.(store.JWTKeyLister); ok {
+		keys, err := lister.Keys()
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			theJWT, err := cmd.store.Load(key)
+			if err == store.ErrNotFound {
+				continue
+			}
+			entries = append(entries, storeEntry{key: key, jwt: theJWT, err: err})
+		}
+		return entries, nil
+	}
+
+	err := cmd.store.Iterate(func(key string, theJWT string) error {
+		entries = append(entries, storeEntry{key: key, jwt: theJWT})
+		return nil
+	})
+	return entries, err
+}
+
+// load returns the JWT stored for key, or an error if there isn't one
+func (cmd *storeCommand) load(key string) (string, error) {
+	theJWT, err := cmd.store.Load(key)
+	if err == store.ErrNotFound || (err == nil && theJWT == "") {
+		return "", fmt.Errorf("no JWT is stored for %s", key)
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to load %s, %s", key, err.Error())
+	}
+	return theJWT, nil
+}
+
+// describeEntry returns the kind, name and expiration columns for list
+func describeEntry(entry storeEntry, now int64) (string, string, string) {
+	if entry.err != nil {
+		return "corrupt", "-", "-"
+	}
+	if store.IsTombstone(entry.jwt) {
+		return "deleted", "-", "-"
+	}
+	if _, err := checkStoredJWT(entry.key, entry.jwt); err != nil {
+		return "corrupt", "-", "-"
+	}
+
+	// checkStoredJWT already decoded it
+	claim, _ := jwt.DecodeGeneric(entry.jwt)
+
+	kind := "activation"
+	switch {
+	case nkeys.IsValidPublicAccountKey(entry.key):
+		kind = "account"
+	case nkeys.IsValidPublicUserKey(entry.key):
+		kind = "user"
+	}
+
+	name := claim.Name
+	if name == "" {
+		name = "-"
+	}
+
+	expires := "never"
+	if claim.Expires > 0 {
+		expires = time.Unix(claim.Expires, 0).UTC().Format(time.RFC3339)
+		if claim.Expires < now {
+			expires += " (expired)"
+		}
+	}
+	return kind, name, expires
+}
+
+func (cmd *storeCommand) list(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("list doesn't take any arguments")
+	}
+
+	entries, err := cmd.entries()
+	if err != nil {
+		return fmt.Errorf("unable to list the store, %s", err.Error())
+	}
+
+	now := time.Now().Unix()
+	w := tabwriter.NewWriter(cmd.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tKIND\tNAME\tEXPIRES")
+	for _, entry := range entries {
+		kind, name, expires := describeEntry(entry, now)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", entry.key, kind, name, expires)
+	}
+	return w.Flush()
+}
+
+func (cmd *storeCommand) get(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("get takes the key to print")
+	}
+
+	theJWT, err := cmd.load(args[0])
+	if err != nil {
+		return err
+	}
+	if store.IsTombstone(theJWT) {
+		return fmt.Errorf("the JWT for %s was deleted", args[0])
+	}
+	fmt.Fprintln(cmd.out, theJWT)
+	return nil
+}
+
+func (cmd *storeCommand) put(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("put takes the key and the file with the JWT, or - for stdin")
+	}
+	key := args[0]
+
+	if cmd.store.IsReadOnly() {
+		return fmt.Errorf("the store is read-only")
+	}
+
+	var data []byte
+	var err error
+	if args[1] == "-" {
+		data, err = ioutil.ReadAll(cmd.in)
+	} else {
+		data, err = ioutil.ReadFile(args[1])
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read the JWT, %s", err.Error())
+	}
+
+	theJWT := strings.TrimSpace(string(data))
+	if theJWT == "" {
+		return fmt.Errorf("the JWT is empty")
+	}
+
+	if _, err := checkStoredJWT(key, theJWT); err != nil {
+		if !cmd.force {
+			return fmt.Errorf("refusing to save the JWT for %s, %s, use -force to save it anyway", key, err.Error())
+		}
+		fmt.Fprintf(cmd.out, "saving the JWT for %s anyway, %s\n", key, err.Error())
+	}
+
+	if err := cmd.store.Save(key, theJWT); err != nil {
+		return fmt.Errorf("unable to save the JWT for %s, %s", key, err.Error())
+	}
+	fmt.Fprintf(cmd.out, "saved the JWT for %s\n", key)
+	return nil
+}
+
+func (cmd *storeCommand) rm(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("rm takes the key to remove")
+	}
+	key := args[0]
+
+	if cmd.store.IsReadOnly() {
+		return fmt.Errorf("the store is read-only")
+	}
+
+	if _, err := cmd.load(key); err != nil {
+		return err
+	}
+
+	if err := cmd.store.Delete(key); err != nil {
+		return fmt.Errorf("unable to remove the JWT for %s, %s", key, err.Error())
+	}
+	fmt.Fprintf(cmd.out, "removed the JWT for %s\n", key)
+	return nil
+}
+
+func (cmd *storeCommand) verify(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("verify doesn't take any arguments")
+	}
+
+	entries, err := cmd.entries()
+	if err != nil {
+		return fmt.Errorf("unable to verify the store, %s", err.Error())
+	}
+
+	report := storeReport{}
+	now := time.Now().Unix()
+	for _, entry := range entries {
+		report.total++
+		if entry.err == nil && store.IsTombstone(entry.jwt) {
+			report.tombstones++
+			continue
+		}
+		err := entry.err
+		var expires int64
+		if err == nil {
+			expires, err = checkStoredJWT(entry.key, entry.jwt)
+		}
+		switch {
+		case err != nil:
+			report.corrupt++
+			fmt.Fprintf(cmd.out, "corrupt JWT for %s, %s\n", entry.key, err.Error())
+		case expires > 0 && expires < now:
+			report.expired++
+		default:
+			report.valid++
+		}
+	}
+
+	fmt.Fprintf(cmd.out, "verified %d JWTs, %d valid, %d corrupt, %d expired, %d deleted\n", report.total, report.valid, report.corrupt, report.expired, report.tombstones)
+	if report.corrupt > 0 {
+		return fmt.Errorf("found %d corrupt JWTs", report.corrupt)
+	}
+	return nil
+}
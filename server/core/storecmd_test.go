@@ -0,0 +1,126 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/store"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreCommand(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "storecmd_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	operatorKey, err := nkeys.CreateOperator()
+	require.NoError(t, err)
+
+	newAccount := func(name string, expires time.Time) (string, string) {
+		accountKey, err := nkeys.CreateAccount()
+		require.NoError(t, err)
+		pubKey, err := accountKey.PublicKey()
+		require.NoError(t, err)
+		account := jwt.NewAccountClaims(pubKey)
+		account.Name = name
+		if !expires.IsZero() {
+			account.Expires = expires.Unix()
+		}
+		acctJWT, err := account.Encode(operatorKey)
+		require.NoError(t, err)
+		return pubKey, acctJWT
+	}
+
+	run := func(stdin string, args ...string) (int, string, string) {
+		out := &bytes.Buffer{}
+		errOut := &bytes.Buffer{}
+		code := RunStoreCommand(args, strings.NewReader(stdin), out, errOut)
+		return code, out.String(), errOut.String()
+	}
+
+	jwtStore, err := store.NewDirJWTStore(dir, false, false, nil, nil)
+	require.NoError(t, err)
+	alpha, alphaJWT := newAccount("alpha", time.Time{})
+	require.NoError(t, jwtStore.Save(alpha, alphaJWT))
+	old, oldJWT := newAccount("old", time.Now().Add(-time.Hour))
+	require.NoError(t, jwtStore.Save(old, oldJWT))
+	jwtStore.Close()
+
+	code, out, _ := run("", "list", "-dir", dir)
+	require.Equal(t, 0, code)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	require.Len(t, lines, 3)
+	require.True(t, strings.HasPrefix(lines[0], "KEY"))
+	require.Contains(t, out, alpha)
+	require.Contains(t, out, "alpha")
+	require.Contains(t, out, "never")
+	require.Contains(t, out, "(expired)")
+
+	code, out, _ = run("", "get", "-dir", dir, alpha)
+	require.Equal(t, 0, code)
+	require.Equal(t, alphaJWT+"\n", out)
+
+	code, _, errOut := run("", "get", "-dir", dir, "AMISSING")
+	require.Equal(t, 1, code)
+	require.Contains(t, errOut, "no JWT is stored")
+
+	// the subject has to match the key unless forced
+	beta, betaJWT := newAccount("beta", time.Time{})
+	code, _, errOut = run(betaJWT, "put", "-dir", dir, alpha, "-")
+	require.Equal(t, 1, code)
+	require.Contains(t, errOut, "refusing")
+
+	code, _, _ = run(betaJWT+"\n", "put", "-dir", dir, beta, "-")
+	require.Equal(t, 0, code)
+
+	file := filepath.Join(dir, "bad.txt")
+	require.NoError(t, ioutil.WriteFile(file, []byte("not a JWT"), 0644))
+	code, _, _ = run("", "put", "-dir", dir, "-force", "garbage", file)
+	require.Equal(t, 0, code)
+
+	code, out, _ = run("", "verify", "-dir", dir)
+	require.Equal(t, 1, code)
+	require.Contains(t, out, "corrupt JWT for garbage")
+	require.Contains(t, out, "verified 4 JWTs, 2 valid, 1 corrupt, 1 expired, 0 deleted")
+
+	code, out, _ = run("", "rm", "-dir", dir, "garbage")
+	require.Equal(t, 0, code)
+	require.Contains(t, out, "removed")
+
+	code, _, _ = run("", "rm", "-dir", dir, "garbage")
+	require.Equal(t, 1, code)
+
+	code, out, _ = run("", "verify", "-dir", dir)
+	require.Equal(t, 0, code)
+	require.Contains(t, out, "verified 3 JWTs, 2 valid, 0 corrupt, 1 expired, 0 deleted")
+
+	code, _, _ = run("", "list")
+	require.Equal(t, 1, code)
+	code, _, _ = run("", "unknown", "-dir", dir)
+	require.Equal(t, 2, code)
+	code, _, _ = run("")
+	require.Equal(t, 2, code)
+}
@@ -0,0 +1,224 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/logging"
+	"github.com/nats-io/nats-account-server/server/store"
+)
+
+// storeUsageWarning is the percent of a store limit that logs a warning
+const storeUsageWarning = 80
+
+// storeFullError is returned by saves that would take the store over one of its limits
+type storeFullError struct {
+	limit string
+	used  int64
+	max   int64
+}
+
+func (e storeFullError) Error() string {
+	return fmt.Sprintf("the store is full, %d of %d %s used", e.used, e.max, e.limit)
+}
+
+// storeUsage counts the entries in the store, and their size, so saves can be checked against
+// the store limits without reading the store. The size of each key's JWT is kept so a save that
+// replaces one, or a delete, changes the totals by the difference. A nil storeUsage means there
+// are no limits.
+type storeUsage struct {
+	sync.Mutex
+	maxEntries int
+	maxBytes   int64
+	sizes      map[string]int // key to the size of the key and its JWT
+	entries    int
+	bytes      int64
+	warned     bool // usage is over storeUsageWarning percent of a limit
+}
+
+// newStoreUsage returns nil if there are no limits, otherwise the usage of the store from one
+// pass over it
+func newStoreUsage(config conf.StoreConfig, jwtStore store.JWTStore) (*storeUsage, error) {
+	if config.MaxEntries <= 0 && config.MaxBytes <= 0 {
+		return nil, nil
+	}
+
+	usage := &storeUsage{
+		maxEntries: config.MaxEntries,
+		maxBytes:   config.MaxBytes,
+		sizes:      map[string]int{},
+	}
+	err := jwtStore.Iterate(func(key string, theJWT string) error {
+		usage.set(key, entrySize(key, theJWT))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	usage.warned = usage.high()
+	return usage, nil
+}
+
+func validateStoreLimits(config conf.StoreConfig) error {
+	if config.MaxEntries < 0 || config.MaxBytes < 0 {
+		return fmt.Errorf("store max entries and max bytes cannot be negative, use 0 for no limit")
+	}
+	return nil
+}
+
+// entrySize counts an entry the way the memory store does, the key and the JWT
+func entrySize(key string, theJWT string) int {
+	return len(key) + len(theJWT)
+}
+
+// reserve adds a save to the totals, or returns an error if it would take the store over a
+// limit. Saves that don't add an entry or bytes, like a smaller replacement, are always allowed
+// so the store can be cleaned up once it is full. undo takes the save back out if it fails,
+// warn is true if usage just went over, or back under, the warning level.
+func (usage *storeUsage) reserve(key string, size int) (undo func(), warn bool, err error) {
+	if usage == nil {
+		return func() {}, false, nil
+	}
+
+	usage.Lock()
+	defer usage.Unlock()
+
+	previous, existed := usage.sizes[key]
+	entries := usage.entries
+	if !existed {
+		entries++
+	}
+	bytes := usage.bytes - int64(previous) + int64(size)
+
+	if entries > usage.entries && usage.maxEntries > 0 && entries > usage.maxEntries {
+		return nil, false, storeFullError{limit: "entries", used: int64(usage.entries), max: int64(usage.maxEntries)}
+	}
+	if bytes > usage.bytes && usage.maxBytes > 0 && bytes > usage.maxBytes {
+		return nil, false, storeFullError{limit: "bytes", used: usage.bytes, max: usage.maxBytes}
+	}
+
+	usage.set(key, size)
+	undo = func() {
+		usage.Lock()
+		defer usage.Unlock()
+		if existed {
+			usage.set(key, previous)
+		} else {
+			usage.remove(key)
+		}
+	}
+	return undo, usage.checkWarning(), nil
+}
+
+// deleted takes a key removed from the store out of the totals, warn is true if usage crossed
+// the warning level
+func (usage *storeUsage) deleted(key string) bool {
+	if usage == nil {
+		return false
+	}
+	usage.Lock()
+	defer usage.Unlock()
+	usage.remove(key)
+	return usage.checkWarning()
+}
+
+// totals returns the entries and bytes used
+func (usage *storeUsage) totals() (int, int64) {
+	usage.Lock()
+	defer usage.Unlock()
+	return usage.entries, usage.bytes
+}
+
+// set and remove change the totals, the lock should be held by the caller
+func (usage *storeUsage) set(key string, size int) {
+	if previous, ok := usage.sizes[key]; ok {
+		usage.bytes -= int64(previous)
+	} else {
+		usage.entries++
+	}
+	usage.sizes[key] = size
+	usage.bytes += int64(size)
+}
+
+func (usage *storeUsage) remove(key string) {
+	if previous, ok := usage.sizes[key]; ok {
+		usage.bytes -= int64(previous)
+		usage.entries--
+		delete(usage.sizes, key)
+	}
+}
+
+// high is true if either total is over the warning level of its limit, the lock should be held by the caller
+func (usage *storeUsage) high() bool {
+	return (usage.maxEntries > 0 && int64(usage.entries)*100 > int64(usage.maxEntries)*storeUsageWarning) ||
+		(usage.maxBytes > 0 && usage.bytes*100 > usage.maxBytes*storeUsageWarning)
+}
+
+// checkWarning returns true if usage crossed the warning level since the last check, the lock
+// should be held by the caller
+func (usage *storeUsage) checkWarning() bool {
+	high := usage.high()
+	if high == usage.warned {
+		return false
+	}
+	usage.warned = high
+	return true
+}
+
+// reserveStoreSpace checks a save against the store limits, logging and counting saves that are
+// rejected and logging when usage goes over, or back under, the warning level
+func (server *AccountServer) reserveStoreSpace(key string, theJWT string) (func(), error) {
+	usage := server.storeUsage
+	undo, warn, err := usage.reserve(key, entrySize(key, theJWT))
+	if err != nil {
+		atomic.AddUint64(&server.metrics.storeFullRejections, 1)
+		server.logger.WithFields(logging.Fields{"key": key, "error": err}).Errorf("rejected saving the JWT for %s, %s", ShortKey(key), err.Error())
+		return nil, err
+	}
+
+	if warn {
+		server.logStoreUsage()
+	}
+	return undo, nil
+}
+
+// storeDeleted updates the usage for a key deleted without going through saveJWT
+func (server *AccountServer) storeDeleted(key string) {
+	if server.storeUsage.deleted(key) {
+		server.logStoreUsage()
+	}
+}
+
+// logStoreUsage logs a warning if the store is over the warning level of a limit, and a notice
+// once it is back under
+func (server *AccountServer) logStoreUsage() {
+	usage := server.storeUsage
+	usage.Lock()
+	entries, bytes, high := usage.entries, usage.bytes, usage.high()
+	usage.Unlock()
+
+	logger := server.logger.WithFields(logging.Fields{"entries": entries, "bytes": bytes})
+	if high {
+		logger.Warnf("the store is over %d%% of its limits, %d of %d entries and %d of %d bytes used", storeUsageWarning, entries, usage.maxEntries, bytes, usage.maxBytes)
+	} else {
+		logger.Noticef("the store is back under %d%% of its limits, %d of %d entries and %d of %d bytes used", storeUsageWarning, entries, usage.maxEntries, bytes, usage.maxBytes)
+	}
+}
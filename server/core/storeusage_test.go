@@ -0,0 +1,142 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreUsage(t *testing.T) {
+	jwtStore := store.NewMemJWTStore()
+	require.NoError(t, jwtStore.Save("A", "0123456789"))
+
+	usage, err := newStoreUsage(conf.StoreConfig{}, jwtStore)
+	require.NoError(t, err)
+	require.Nil(t, usage)
+
+	// the scan counts what is already stored
+	usage, err = newStoreUsage(conf.StoreConfig{MaxEntries: 5, MaxBytes: 50}, jwtStore)
+	require.NoError(t, err)
+	entries, size := usage.totals()
+	require.Equal(t, 1, entries)
+	require.Equal(t, int64(11), size)
+	require.False(t, usage.warned)
+
+	_, warn, err := usage.reserve("B", 20)
+	require.NoError(t, err)
+	require.False(t, warn)
+
+	// a replacement only adds the difference, this one crosses 80% of the bytes
+	undo, warn, err := usage.reserve("B", 30)
+	require.NoError(t, err)
+	require.True(t, warn)
+	entries, size = usage.totals()
+	require.Equal(t, 2, entries)
+	require.Equal(t, int64(41), size)
+
+	_, _, err = usage.reserve("C", 10)
+	require.Error(t, err)
+	require.Equal(t, "bytes", err.(storeFullError).limit)
+
+	// a failed save is taken back out
+	undo()
+	entries, size = usage.totals()
+	require.Equal(t, 2, entries)
+	require.Equal(t, int64(31), size)
+
+	// shrinking is allowed when full
+	usage.maxBytes = 10
+	_, _, err = usage.reserve("B", 5)
+	require.NoError(t, err)
+	_, _, err = usage.reserve("B", 6)
+	require.Error(t, err)
+
+	usage.maxBytes = 0
+	usage.maxEntries = 2
+	_, _, err = usage.reserve("C", 1)
+	require.Error(t, err)
+	require.Equal(t, "entries", err.(storeFullError).limit)
+	usage.deleted("B")
+	_, _, err = usage.reserve("C", 1)
+	require.NoError(t, err)
+
+	require.Error(t, validateStoreLimits(conf.StoreConfig{MaxBytes: -1}))
+	require.NoError(t, validateStoreLimits(conf.StoreConfig{}))
+}
+
+func TestStoreLimitsRejectUploads(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.Store.MaxEntries = 2
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	post := func(pubKey string, acctJWT string) *http.Response {
+		resp, err := testEnv.HTTP.Post(testEnv.URLForPath("/jwt/v1/accounts/"+pubKey), "application/json", bytes.NewBufferString(acctJWT))
+		require.NoError(t, err)
+		return resp
+	}
+
+	keys := []string{}
+	for i := 0; i < 3; i++ {
+		_, pubKey, _ := CreateAccountKey(t)
+		keys = append(keys, pubKey)
+	}
+
+	for _, pubKey := range keys[:2] {
+		acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+		require.NoError(t, err)
+		resp := post(pubKey, acctJWT)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	acctJWT, err := jwt.NewAccountClaims(keys[2]).Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	resp := post(keys[2], acctJWT)
+	require.Equal(t, http.StatusInsufficientStorage, resp.StatusCode)
+	require.Equal(t, CodeStoreFull, decodeError(t, resp).Code)
+
+	_, err = testEnv.Server.jwtStore.Load(keys[2])
+	require.Equal(t, store.ErrNotFound, err)
+
+	// stored accounts can still be updated
+	claim := jwt.NewAccountClaims(keys[0])
+	claim.Name = "renamed"
+	acctJWT, err = claim.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	resp = post(keys[0], acctJWT)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = testEnv.HTTP.Get(testEnv.URLForPath("/metrics"))
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.True(t, strings.Contains(string(body), "nats_account_server_store_full_rejections_total 1\n"))
+	require.True(t, strings.Contains(string(body), "nats_account_server_store_usage_entries 2\n"))
+}
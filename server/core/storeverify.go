@@ -0,0 +1,166 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/logging"
+	"github.com/nats-io/nats-account-server/server/store"
+	"github.com/nats-io/nkeys"
+)
+
+// storeReport is the result of checking every JWT in the store at startup
+type storeReport struct {
+	total       int
+	valid       int
+	corrupt     int
+	expired     int
+	tombstones  int
+	quarantined int
+}
+
+// corruptJWT is a key whose JWT couldn't be loaded or decoded
+type corruptJWT struct {
+	key string
+	err error
+}
+
+// checkStoredJWT decodes a JWT the way lookups will, as an account for account keys and an
+// activation for everything else, and returns when it expires. User keys are decoded as users.
+func checkStoredJWT(key string, theJWT string) (int64, error) {
+	if nkeys.IsValidPublicUserKey(key) {
+		claim, err := decodeStoredUser(key, theJWT)
+		if err != nil {
+			return 0, err
+		}
+		return claim.Expires, nil
+	}
+
+	if nkeys.IsValidPublicAccountKey(key) {
+		claim, err := jwt.DecodeAccountClaims(theJWT)
+		if err != nil {
+			return 0, err
+		}
+		if claim.Subject != key {
+			return 0, fmt.Errorf("JWT is for account %s", ShortKey(claim.Subject))
+		}
+		return claim.Expires, nil
+	}
+
+	claim, err := jwt.DecodeActivationClaims(theJWT)
+	if err != nil {
+		return 0, err
+	}
+	hash, err := claim.HashID()
+	if err != nil {
+		return 0, err
+	}
+	if hash != key {
+		return 0, fmt.Errorf("activation hash is %s", ShortKey(hash))
+	}
+	return claim.Expires, nil
+}
+
+// verifyStore decodes every JWT in the store, logging the corrupt ones and a summary. With
+// repair set, corrupt JWTs are quarantined if the store supports it. If there are more corrupt
+// JWTs than the limit nothing is moved and an error is returned, that many usually means the
+// wrong directory or encryption key rather than a crash.
+func (server *AccountServer) verifyStore(jwtStore store.JWTStore, config conf.StoreConfig) (storeReport, error) {
+	report := storeReport{}
+	corrupt := []corruptJWT{}
+	now := time.Now().Unix()
+
+	check := func(key string, theJWT string) {
+		report.total++
+		if store.IsTombstone(theJWT) {
+			report.tombstones++
+			return
+		}
+		expires, err := checkStoredJWT(key, theJWT)
+		switch {
+		case err != nil:
+			corrupt = append(corrupt, corruptJWT{key: key, err: err})
+		case expires > 0 && expires < now:
+			report.expired++
+		default:
+			report.valid++
+		}
+	}
+
+	// stores that list their keys let each JWT fail to load without stopping the check
+	if lister, ok := jwtStore.(store.JWTKeyLister); ok {
+		keys, err := lister.Keys()
+		if err != nil {
+			return report, fmt.Errorf("unable to verify the store, %s", err.Error())
+		}
+		for _, key := range keys {
+			theJWT, err := jwtStore.Load(key)
+			if err == store.ErrNotFound {
+				continue
+			}
+			if err != nil {
+				report.total++
+				corrupt = append(corrupt, corruptJWT{key: key, err: err})
+				continue
+			}
+			check(key, theJWT)
+		}
+	} else {
+		err := jwtStore.Iterate(func(key string, theJWT string) error {
+			check(key, theJWT)
+			return nil
+		})
+		if err != nil {
+			return report, fmt.Errorf("unable to verify the store, %s", err.Error())
+		}
+	}
+	report.corrupt = len(corrupt)
+
+	for _, c := range corrupt {
+		server.logger.WithFields(logging.Fields{"key": c.key, "error": c.err}).Warnf("corrupt JWT in the store for %s, %s", ShortKey(c.key), c.err.Error())
+	}
+	server.logger.Noticef("verified %d JWTs in the store, %d valid, %d corrupt, %d expired, %d deleted", report.total, report.valid, report.corrupt, report.expired, report.tombstones)
+
+	if config.MaxCorrupt > 0 && report.corrupt > config.MaxCorrupt {
+		return report, fmt.Errorf("found %d corrupt JWTs in the store, more than maxcorrupt allows (%d)", report.corrupt, config.MaxCorrupt)
+	}
+
+	if !config.Repair || report.corrupt == 0 {
+		return report, nil
+	}
+
+	quarantiner, ok := jwtStore.(store.JWTQuarantiner)
+	if !ok || jwtStore.IsReadOnly() {
+		server.logger.Warnf("the store can't quarantine corrupt JWTs, they were only reported")
+		return report, nil
+	}
+
+	for _, c := range corrupt {
+		if err := quarantiner.Quarantine(c.key); err != nil {
+			server.logger.WithFields(logging.Fields{"key": c.key, "error": err}).Errorf("unable to quarantine %s, %s", ShortKey(c.key), err.Error())
+			continue
+		}
+		report.quarantined++
+	}
+	server.logger.Noticef("quarantined %d corrupt JWTs", report.quarantined)
+
+	return report, nil
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/store"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyStore(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir(os.TempDir(), "verify_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	jwtStore, err := store.NewDirJWTStore(dir, false, false, nil, nil)
+	require.NoError(t, err)
+	defer jwtStore.Close()
+
+	newAccount := func(expires time.Time) (string, string) {
+		accountKey, err := nkeys.CreateAccount()
+		require.NoError(t, err)
+		pubKey, err := accountKey.PublicKey()
+		require.NoError(t, err)
+		account := jwt.NewAccountClaims(pubKey)
+		if !expires.IsZero() {
+			account.Expires = expires.Unix()
+		}
+		acctJWT, err := account.Encode(testEnv.OperatorKey)
+		require.NoError(t, err)
+		return pubKey, acctJWT
+	}
+
+	valid, validJWT := newAccount(time.Time{})
+	require.NoError(t, jwtStore.Save(valid, validJWT))
+	expired, expiredJWT := newAccount(time.Now().Add(-time.Hour))
+	require.NoError(t, jwtStore.Save(expired, expiredJWT))
+	truncated, truncatedJWT := newAccount(time.Time{})
+	require.NoError(t, jwtStore.Save(truncated, truncatedJWT[:len(truncatedJWT)/2]))
+	require.NoError(t, jwtStore.Save("garbage", "not a JWT"))
+
+	server := testEnv.Server
+	report, err := server.verifyStore(jwtStore, conf.StoreConfig{})
+	require.NoError(t, err)
+	require.Equal(t, storeReport{total: 4, valid: 1, corrupt: 2, expired: 1}, report)
+
+	// too many corrupt JWTs, nothing is moved
+	_, err = server.verifyStore(jwtStore, conf.StoreConfig{Repair: true, MaxCorrupt: 1})
+	require.Error(t, err)
+	_, err = os.Stat(filepath.Join(dir, ".bad"))
+	require.True(t, os.IsNotExist(err))
+
+	report, err = server.verifyStore(jwtStore, conf.StoreConfig{Repair: true, MaxCorrupt: 2})
+	require.NoError(t, err)
+	require.Equal(t, 2, report.quarantined)
+
+	_, err = jwtStore.Load(truncated)
+	require.Equal(t, store.ErrNotFound, err)
+	_, err = os.Stat(filepath.Join(dir, ".bad", truncated+".jwt"))
+	require.NoError(t, err)
+
+	report, err = server.verifyStore(jwtStore, conf.StoreConfig{})
+	require.NoError(t, err)
+	require.Equal(t, storeReport{total: 2, valid: 1, expired: 1}, report)
+
+	// a memory store can only report
+	memStore := store.NewMemJWTStore()
+	require.NoError(t, memStore.Save("garbage", "not a JWT"))
+	report, err = server.verifyStore(memStore, conf.StoreConfig{Repair: true})
+	require.NoError(t, err)
+	require.Equal(t, 1, report.corrupt)
+	require.Equal(t, 0, report.quarantined)
+}
+
+func TestVerifyOnStartRefusesCorruptStore(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "verify_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "one.jwt"), []byte("bad"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "two.jwt"), []byte("bad"), 0644))
+
+	config := conf.DefaultServerConfig()
+	config.Store.Dir = dir
+	config.Store.VerifyOnStart = true
+	config.Store.MaxCorrupt = 1
+	config.HTTP.Port = 0
+
+	server := NewAccountServer()
+	server.InitializeFromConfig(config)
+	require.Error(t, server.Start())
+	server.Stop()
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/logging"
+)
+
+const bearerPrefix = "Bearer "
+
+// loadWriteTokens returns the sha-256 hashes of the configured write tokens, from the
+// config and the token file. Blank lines and lines starting with # are skipped in the file.
+func loadWriteTokens(config conf.HTTPConfig) ([][]byte, error) {
+	tokens := append([]string{}, config.WriteTokens...)
+
+	if config.WriteTokenFile != "" {
+		file, err := os.Open(config.WriteTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read write token file, %s", err.Error())
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			tokens = append(tokens, line)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("unable to read write token file, %s", err.Error())
+		}
+	}
+
+	hashes := make([][]byte, 0, len(tokens))
+	for _, token := range tokens {
+		if token == "" {
+			return nil, fmt.Errorf("write tokens can't be empty")
+		}
+		hash := sha256.Sum256([]byte(token))
+		hashes = append(hashes, hash[:])
+	}
+
+	if config.WriteTokenFile != "" && len(hashes) == 0 {
+		return nil, fmt.Errorf("write token file %s has no tokens", config.WriteTokenFile)
+	}
+
+	return hashes, nil
+}
+
+// validWriteToken compares the hash of the token with every configured hash, so the time
+// taken doesn't depend on the token or which one matched
+func validWriteToken(token string, hashes [][]byte) bool {
+	presented := sha256.Sum256([]byte(token))
+	match := 0
+	for _, hash := range hashes {
+		match |= subtle.ConstantTimeCompare(presented[:], hash)
+	}
+	return match == 1
+}
+
+// requireBearerToken wraps a handler that changes the store, if write tokens are configured
+// requests without one of them in the Authorization header get a 401
+func (server *AccountServer) requireBearerToken(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		server.Lock()
+		hashes := server.writeTokens
+		server.Unlock()
+
+		if len(hashes) == 0 {
+			handle(w, r, params)
+			return
+		}
+
+		auth := r.Header.Get("Authorization")
+		token := strings.TrimSpace(strings.TrimPrefix(auth, bearerPrefix))
+
+		if !strings.HasPrefix(auth, bearerPrefix) || !validWriteToken(token, hashes) {
+			// never log the token, just where it came from
+			server.logger.WithFields(logging.Fields{"remote": r.RemoteAddr}).Warnf("rejected %s %s from %s, missing or unknown bearer token", r.Method, r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="nats-account-server"`)
+			server.sendErrorResponse(http.StatusUnauthorized, "a valid bearer token is required", "", nil, w)
+			return
+		}
+
+		handle(w, r, params)
+	}
+}
+
+// authorizeWrites wraps a handler that changes the store with the IP list, client certificate
+// and bearer token checks
+func (server *AccountServer) authorizeWrites(handle httprouter.Handle) httprouter.Handle {
+	return server.requireAllowedIP(server.requireClientCert(server.requireBearerToken(handle)))
+}
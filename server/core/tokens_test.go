@@ -0,0 +1,126 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadWriteTokens(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "tokens_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "tokens")
+	require.NoError(t, ioutil.WriteFile(file, []byte("# writers\none\n\n  two  \n"), 0600))
+
+	hashes, err := loadWriteTokens(conf.HTTPConfig{WriteTokens: []string{"three"}, WriteTokenFile: file})
+	require.NoError(t, err)
+	require.Len(t, hashes, 3)
+
+	for _, token := range []string{"one", "two", "three"} {
+		require.True(t, validWriteToken(token, hashes), token)
+	}
+	require.False(t, validWriteToken("four", hashes))
+	require.False(t, validWriteToken("", hashes))
+	require.False(t, validWriteToken("one", nil))
+
+	hashes, err = loadWriteTokens(conf.HTTPConfig{})
+	require.NoError(t, err)
+	require.Empty(t, hashes)
+
+	_, err = loadWriteTokens(conf.HTTPConfig{WriteTokens: []string{""}})
+	require.Error(t, err)
+
+	_, err = loadWriteTokens(conf.HTTPConfig{WriteTokenFile: filepath.Join(dir, "missing")})
+	require.Error(t, err)
+
+	empty := filepath.Join(dir, "empty")
+	require.NoError(t, ioutil.WriteFile(empty, []byte("# nothing yet\n"), 0600))
+	_, err = loadWriteTokens(conf.HTTPConfig{WriteTokenFile: empty})
+	require.Error(t, err)
+}
+
+func TestWriteTokens(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "tokens_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "tokens")
+	require.NoError(t, ioutil.WriteFile(file, []byte("first\n"), 0600))
+
+	config := conf.DefaultServerConfig()
+	config.HTTP.WriteTokenFile = file
+
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+	acctJWT, err := jwt.NewAccountClaims(pubKey).Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+
+	url := testEnv.URLForPath("/jwt/v1/accounts/" + pubKey)
+	post := func(auth string) int {
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer([]byte(acctJWT)))
+		require.NoError(t, err)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := testEnv.HTTP.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	require.Equal(t, http.StatusUnauthorized, post(""))
+	require.Equal(t, http.StatusUnauthorized, post("Bearer wrong"))
+	require.Equal(t, http.StatusUnauthorized, post("Basic first"))
+	require.Equal(t, http.StatusOK, post("Bearer first"))
+
+	// reads don't need a token
+	resp, err := testEnv.HTTP.Get(url)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// rotate the token
+	require.NoError(t, ioutil.WriteFile(file, []byte("second\n"), 0600))
+	next := *testEnv.Server.currentConfig()
+	require.NoError(t, testEnv.Server.ReloadConfig(&next))
+
+	require.Equal(t, http.StatusUnauthorized, post("Bearer first"))
+	require.Equal(t, http.StatusOK, post("Bearer second"))
+
+	// a bad file is rejected and the current tokens are kept
+	next.HTTP.WriteTokenFile = filepath.Join(dir, "missing")
+	require.Error(t, testEnv.Server.ReloadConfig(&next))
+	require.Equal(t, http.StatusOK, post("Bearer second"))
+}
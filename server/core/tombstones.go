@@ -0,0 +1,197 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/store"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+// TombstoneHeader carries the tombstone, as JSON, in delete notifications so replicas save
+// the same one. The body is still the public key, for servers that don't read headers.
+const TombstoneHeader = "Nats-Tombstone"
+
+// DeleteClaimHeader carries the signed JWT that authorized an account or activation delete, servers
+// only apply delete notifications that have one so publishing on the subject isn't enough
+const DeleteClaimHeader = "Nats-Delete-Claim"
+
+// maxTombstoneSize limits the tombstone read from a primary's 410 response
+const maxTombstoneSize = 4096
+
+// loadStored loads a JWT from the store, a tombstone is returned as store.ErrDeleted
+func (server *AccountServer) loadStored(key string) (string, error) {
+	theJWT, err := server.jwtStore.Load(key)
+	if err != nil {
+		return "", err
+	}
+	if store.IsTombstone(theJWT) {
+		return "", store.ErrDeleted
+	}
+	return theJWT, nil
+}
+
+// loadTombstone returns the tombstone saved for a deleted account or activation, false if there isn't one
+func (server *AccountServer) loadTombstone(pubKey string) (store.Tombstone, bool) {
+	data, err := server.jwtStore.Load(pubKey)
+	if err != nil {
+		return store.Tombstone{}, false
+	}
+	return store.DecodeTombstone(data)
+}
+
+// saveTombstone replaces an account or activation JWT with a tombstone, the key is dropped from
+// the indexes and the replica cache
+func (server *AccountServer) saveTombstone(tombstone store.Tombstone) error {
+	if err := server.saveJWT(tombstone.PubKey, tombstone.Encode()); err != nil {
+		return err
+	}
+	if nkeys.IsValidPublicAccountKey(tombstone.PubKey) {
+		server.unindexAccount(tombstone.PubKey)
+	} else {
+		server.activations.remove(tombstone.PubKey)
+	}
+	server.forgetValid(tombstone.PubKey)
+	return nil
+}
+
+// writeTombstone answers a request for a deleted account or activation with a 410 and the tombstone as JSON
+func (server *AccountServer) writeTombstone(w http.ResponseWriter, pubKey string) {
+	tombstone, ok := server.loadTombstone(pubKey)
+	if !ok {
+		tombstone = store.Tombstone{PubKey: pubKey}
+	}
+
+	data, err := json.Marshal(tombstone)
+	if err != nil {
+		server.sendErrorResponse(http.StatusInternalServerError, "unable to encode tombstone", pubKey, err, w)
+		return
+	}
+
+	w.Header().Set(ContentType, ApplicationJSON)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusGone)
+	w.Write(data)
+}
+
+// readTombstone parses the tombstone in a primary's 410 response, the key must match
+func readTombstone(pubKey string, body io.Reader) (store.Tombstone, bool) {
+	var tombstone store.Tombstone
+	data, err := ioutil.ReadAll(io.LimitReader(body, maxTombstoneSize))
+	if err != nil || json.Unmarshal(data, &tombstone) != nil || tombstone.PubKey != pubKey {
+		return tombstone, false
+	}
+	return tombstone, true
+}
+
+// tombstoneFromNotification returns the tombstone in a delete notification's header, or one
+// deleted now if the header is missing or doesn't match the key
+func tombstoneFromNotification(pubKey string, msg *nats.Msg) store.Tombstone {
+	if msg.Header != nil {
+		var tombstone store.Tombstone
+		if err := json.Unmarshal([]byte(msg.Header.Get(TombstoneHeader)), &tombstone); err == nil && tombstone.PubKey == pubKey {
+			return tombstone
+		}
+	}
+	return store.Tombstone{PubKey: pubKey, DeletedAt: time.Now().Unix()}
+}
+
+// deleteClaimFromNotification returns the JWT in a delete notification's claim header, empty if there isn't one
+func deleteClaimFromNotification(msg *nats.Msg) string {
+	if msg.Header == nil {
+		return ""
+	}
+	return msg.Header.Get(DeleteClaimHeader)
+}
+
+// checkDeleteNotification returns an error unless an account delete notification carries a JWT,
+// signed by a trusted operator key, with the account as its subject. The times aren't checked,
+// a stream can deliver the notification long after the account was deleted.
+func (server *AccountServer) checkDeleteNotification(pubKey string, msg *nats.Msg) error {
+	token := deleteClaimFromNotification(msg)
+	if token == "" {
+		return fmt.Errorf("the notification has no %s header", DeleteClaimHeader)
+	}
+
+	claim, err := jwt.DecodeGeneric(token)
+	if err != nil {
+		return fmt.Errorf("the delete claim doesn't decode, %s", err.Error())
+	}
+	return server.checkDeleteClaim(claim, pubKey)
+}
+
+// checkActivationDeleteNotification returns an error unless an activation delete notification carries
+// a JWT that checkActivationDeleteClaim accepts for the activation stored here. Without the activation
+// the claim can't be checked, a replica learns about the delete from the primary's 410 instead.
+func (server *AccountServer) checkActivationDeleteNotification(hash string, msg *nats.Msg) error {
+	token := deleteClaimFromNotification(msg)
+	if token == "" {
+		return fmt.Errorf("the notification has no %s header", DeleteClaimHeader)
+	}
+
+	claim, err := jwt.DecodeGeneric(token)
+	if err != nil {
+		return fmt.Errorf("the delete claim doesn't decode, %s", err.Error())
+	}
+
+	stored, err := server.loadStored(hash)
+	if err != nil {
+		return fmt.Errorf("the activation can't be loaded to check the delete claim, %s", err.Error())
+	}
+	activation, err := jwt.DecodeActivationClaims(stored)
+	if err != nil {
+		return fmt.Errorf("the stored activation doesn't decode, %s", err.Error())
+	}
+	return server.checkActivationDeleteClaim(claim, hash, activation)
+}
+
+// publishTombstone publishes a delete notification, with the tombstone, the instance id, the
+// claim that authorized the delete and the trace of the request that deleted it in
+// headers if the server supports them
+func (server *AccountServer) publishTombstone(nc *nats.Conn, subject string, tombstone store.Tombstone, deleteClaim string, trace nats.Header) error {
+	if !nc.HeadersSupported() {
+		return server.publishMarked(nc, subject, []byte(tombstone.PubKey))
+	}
+
+	data, err := json.Marshal(tombstone)
+	if err != nil {
+		return err
+	}
+
+	msg := nats.NewMsg(subject)
+	msg.Data = []byte(tombstone.PubKey)
+	for key, values := range trace {
+		msg.Header[key] = values
+	}
+	msg.Header.Set(TombstoneHeader, string(data))
+	if deleteClaim != "" {
+		msg.Header.Set(DeleteClaimHeader, deleteClaim)
+	}
+	if server.instanceID != "" {
+		msg.Header.Set(InstanceHeader, server.instanceID)
+	}
+
+	return server.publishMsg(nc, msg)
+}
@@ -0,0 +1,177 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/nats-io/nats-account-server/server/logging"
+	nats "github.com/nats-io/nats.go"
+)
+
+const (
+	// RequestIDHeader carries the trace id of a request, it is returned on every response and set
+	// on the NATS notifications sent while handling the request
+	RequestIDHeader = "X-Request-Id"
+
+	// TraceParentHeader is a W3C trace context, its trace id is used when a request has one
+	TraceParentHeader = "Traceparent"
+
+	// maxRequestIDLength bounds the request ids accepted from clients
+	maxRequestIDLength = 128
+)
+
+// tracedWriter carries the trace of a request to the code that only has the response writer
+type tracedWriter struct {
+	http.ResponseWriter
+	ctx         context.Context
+	traceParent string
+}
+
+// Unwrap lets http.ResponseController reach the connection
+func (w *tracedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Flush passes flushes through for handlers that stream their response
+func (w *tracedWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack hands over the connection
+func (w *tracedWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the response writer can't be hijacked")
+	}
+	return hijacker.Hijack()
+}
+
+// traceIDFromParent returns the trace id in a version 00 traceparent, 00-<trace id>-<parent id>-<flags>
+func traceIDFromParent(traceParent string) (string, bool) {
+	parts := strings.Split(traceParent, "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return "", false
+	}
+	for _, part := range parts[1:] {
+		if _, err := hex.DecodeString(part); err != nil || strings.ToLower(part) != part {
+			return "", false
+		}
+	}
+	if strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// validRequestID is true for ids that can go in logs and headers as they are
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newTraceID returns a random id, in the same form as a W3C trace id
+func newTraceID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
+
+// traced gives each request a trace id, from its traceparent or X-Request-Id header or a new one.
+// The id is returned in the response, added to the log lines for the request and set on the
+// notifications it sends.
+func (server *AccountServer) traced(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceParent := r.Header.Get(TraceParentHeader)
+		traceID, ok := traceIDFromParent(traceParent)
+		if !ok {
+			traceParent = ""
+			traceID = r.Header.Get(RequestIDHeader)
+			if !validRequestID(traceID) {
+				traceID = newTraceID()
+			}
+		}
+
+		w.Header().Set(RequestIDHeader, traceID)
+		if traceParent != "" {
+			w.Header().Set(TraceParentHeader, traceParent)
+		}
+
+		ctx := logging.ContextWithTraceID(r.Context(), traceID)
+		handler.ServeHTTP(&tracedWriter{ResponseWriter: w, ctx: ctx, traceParent: traceParent}, r.WithContext(ctx))
+	})
+}
+
+// findTracedWriter walks the wrapped writers down to the tracedWriter, nil if there isn't one
+func findTracedWriter(w http.ResponseWriter) *tracedWriter {
+	for w != nil {
+		if traced, ok := w.(*tracedWriter); ok {
+			return traced
+		}
+		unwrapper, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil
+		}
+		w = unwrapper.Unwrap()
+	}
+	return nil
+}
+
+// requestContext returns the context with the trace id of the request w answers, for helpers
+// that only have the writer
+func requestContext(w http.ResponseWriter) context.Context {
+	if traced := findTracedWriter(w); traced != nil {
+		return traced.ctx
+	}
+	return context.Background()
+}
+
+// traceHeaders returns the headers that carry the trace of the request w answers to NATS
+// notifications, nil outside of a request
+func traceHeaders(w http.ResponseWriter) nats.Header {
+	traced := findTracedWriter(w)
+	if traced == nil {
+		return nil
+	}
+
+	header := nats.Header{}
+	if traceID := logging.TraceIDFromContext(traced.ctx); traceID != "" {
+		header.Set(RequestIDHeader, traceID)
+	}
+	if traced.traceParent != "" {
+		header.Set(TraceParentHeader, traced.traceParent)
+	}
+	return header
+}
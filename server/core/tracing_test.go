@@ -0,0 +1,132 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/logging"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTraceIDFromParent(t *testing.T) {
+	traceID, ok := traceIDFromParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.True(t, ok)
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", traceID)
+
+	for _, bad := range []string{
+		"",
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+	} {
+		_, ok := traceIDFromParent(bad)
+		require.False(t, ok, bad)
+	}
+
+	require.True(t, validRequestID("req-1"))
+	require.False(t, validRequestID(""))
+	require.False(t, validRequestID("has space"))
+	require.False(t, validRequestID(strings.Repeat("a", maxRequestIDLength+1)))
+	require.Len(t, newTraceID(), 32)
+}
+
+func TestRequestTracing(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	logger := newRecordingLogger()
+	testEnv.Server.Lock()
+	testEnv.Server.logger = logger
+	testEnv.Server.Unlock()
+
+	_, pubKey, _ := CreateAccountKey(t)
+	sub, err := testEnv.NC.SubscribeSync(testEnv.Server.accountNotificationSubject(pubKey))
+	require.NoError(t, err)
+	require.NoError(t, testEnv.NC.Flush())
+
+	post := func(name string, header http.Header) *http.Response {
+		account := jwt.NewAccountClaims(pubKey)
+		account.Name = name
+		acctJWT, err := account.Encode(testEnv.OperatorKey)
+		require.NoError(t, err)
+		req, err := http.NewRequest(http.MethodPost, testEnv.URLForPath("/jwt/v1/accounts/"+pubKey), bytes.NewBuffer([]byte(acctJWT)))
+		require.NoError(t, err)
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		resp, err := testEnv.HTTP.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		return resp
+	}
+
+	resp := post("one", http.Header{RequestIDHeader: []string{"push-1"}})
+	require.Equal(t, "push-1", resp.Header.Get(RequestIDHeader))
+	msg, err := sub.NextMsg(5 * time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "push-1", msg.Header.Get(RequestIDHeader))
+
+	entries := logger.find("updated JWT for account")
+	require.Len(t, entries, 1)
+	require.Equal(t, "push-1", entries[0].fields[logging.TraceIDField])
+
+	traceParent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	resp = post("two", http.Header{TraceParentHeader: []string{traceParent}, RequestIDHeader: []string{"ignored"}})
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", resp.Header.Get(RequestIDHeader))
+	require.Equal(t, traceParent, resp.Header.Get(TraceParentHeader))
+	msg, err = sub.NextMsg(5 * time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", msg.Header.Get(RequestIDHeader))
+	require.Equal(t, traceParent, msg.Header.Get(TraceParentHeader))
+
+	resp = post("three", nil)
+	generated := resp.Header.Get(RequestIDHeader)
+	require.Len(t, generated, 32)
+	msg, err = sub.NextMsg(5 * time.Second)
+	require.NoError(t, err)
+	require.Equal(t, generated, msg.Header.Get(RequestIDHeader))
+
+	// errors are logged with the trace id too
+	req, err := http.NewRequest(http.MethodPost, testEnv.URLForPath("/jwt/v1/accounts/"+pubKey), bytes.NewBuffer([]byte("bad")))
+	require.NoError(t, err)
+	req.Header.Set(RequestIDHeader, "bad-push")
+	resp, err = testEnv.HTTP.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.Equal(t, "bad-push", resp.Header.Get(RequestIDHeader))
+
+	traced := false
+	for _, entry := range logger.find("") {
+		if entry.level == "error" && entry.fields[logging.TraceIDField] == "bad-push" {
+			traced = true
+		}
+	}
+	require.True(t, traced)
+}
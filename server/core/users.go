@@ -0,0 +1,181 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/logging"
+	"github.com/nats-io/nats-account-server/server/store"
+	"github.com/nats-io/nkeys"
+)
+
+// decodeStoredUser decodes a user JWT stored, or fetched, under key
+func decodeStoredUser(key string, theJWT string) (*jwt.UserClaims, error) {
+	claim, err := jwt.DecodeUserClaims(theJWT)
+	if err != nil {
+		return nil, err
+	}
+	if claim.Subject != key {
+		return nil, fmt.Errorf("JWT is for user %s", ShortKey(claim.Subject))
+	}
+	return claim, nil
+}
+
+// validateUserClaim checks a user JWT before it is saved, the account that issued it has to be
+// stored and have signed it with its own key or one of its signing keys. The status to use
+// and the error code are returned if it fails.
+func (server *AccountServer) validateUserClaim(claim *jwt.UserClaims) (int, string, error) {
+	if !nkeys.IsValidPublicUserKey(claim.Subject) {
+		return http.StatusBadRequest, CodeInvalidJWT, fmt.Errorf("bad JWT Subject in request")
+	}
+
+	vr := &jwt.ValidationResults{}
+	claim.Validate(vr)
+	if err := server.checkClaimTimes(claim.Expires, claim.NotBefore); err != nil {
+		return http.StatusBadRequest, CodeInvalidJWT, err
+	}
+	for _, issue := range vr.Issues {
+		if issue.Blocking && !issue.TimeCheck {
+			return http.StatusBadRequest, CodeInvalidJWT, fmt.Errorf("%s", issue.Description)
+		}
+	}
+
+	issuer := claim.IssuerAccount
+	if issuer == "" {
+		issuer = claim.Issuer
+	}
+	if !nkeys.IsValidPublicAccountKey(issuer) {
+		return http.StatusBadRequest, CodeInvalidJWT, fmt.Errorf("user JWT isn't issued by an account")
+	}
+
+	accountJWT, err := server.loadStored(issuer)
+	if err == store.ErrNotFound || err == store.ErrDeleted {
+		return http.StatusForbidden, CodeUntrustedIssuer, fmt.Errorf("user issuer account %s isn't stored", ShortKey(issuer))
+	}
+	if err != nil {
+		atomic.AddUint64(&server.metrics.storeErrors, 1)
+		return http.StatusInternalServerError, CodeStoreError, fmt.Errorf("unable to load user issuer account %s, %s", ShortKey(issuer), err.Error())
+	}
+
+	account, err := jwt.DecodeAccountClaims(accountJWT)
+	if err != nil {
+		return http.StatusInternalServerError, CodeStoreError, fmt.Errorf("user issuer account %s doesn't decode, %s", ShortKey(issuer), err.Error())
+	}
+
+	// decoding checked the signature against the issuer, so it only has to belong to the account
+	if !account.DidSign(claim) {
+		return http.StatusForbidden, CodeUntrustedIssuer, fmt.Errorf("user JWT isn't signed by account %s or one of its signing keys", ShortKey(issuer))
+	}
+
+	if account.IsRevokedAt(claim.Subject, time.Unix(claim.IssuedAt, 0)) {
+		return http.StatusForbidden, CodeForbidden, fmt.Errorf("user is revoked by account %s", ShortKey(issuer))
+	}
+
+	return http.StatusOK, "", nil
+}
+
+// UpdateUserJWT is the target of POST /jwt/v1/users/:pubkey, with EnableUserJWTs. No notification
+// is sent, user JWTs are only served over HTTP.
+func (server *AccountServer) UpdateUserJWT(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logger := server.logger.WithContext(r.Context())
+	logger.Tracef("%s: %s", r.RemoteAddr, r.URL.String())
+	theJWT, err := server.readJWTBody(w, r)
+	defer r.Body.Close()
+	if err != nil {
+		server.sendBodyError("bad JWT in request", err, w)
+		return
+	}
+
+	claim, err := jwt.DecodeUserClaims(string(theJWT))
+	if err != nil || claim == nil {
+		server.sendError(http.StatusBadRequest, CodeInvalidJWT, "bad user JWT in request", "", err, w)
+		return
+	}
+
+	pubKey := params.ByName("pubkey")
+	if claim.Subject != pubKey {
+		server.sendError(http.StatusBadRequest, CodeInvalidJWT, "user JWT subject doesn't match the path", "", nil, w)
+		return
+	}
+
+	if status, code, err := server.validateUserClaim(claim); err != nil {
+		server.sendError(status, code, err.Error(), claim.IssuerAccount, nil, w)
+		return
+	}
+
+	if err := server.saveJWT(pubKey, string(theJWT)); err != nil {
+		server.sendSaveError("error saving user JWT", "", err, w)
+		return
+	}
+
+	atomic.AddUint64(&server.metrics.userSaves, 1)
+	logger.WithFields(logging.Fields{"user": pubKey, "jti": claim.ID}).Noticef("updated JWT for user - %s - %s", ShortKey(pubKey), claim.ID)
+	w.WriteHeader(http.StatusOK)
+}
+
+// GetUserJWT is the target of GET /jwt/v1/users/:pubkey, with EnableUserJWTs. The JWT is sent
+// with the account cache headers, replicas fetch it from their primary.
+func (server *AccountServer) GetUserJWT(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logger := server.logger.WithContext(r.Context())
+	logger.Tracef("%s: %s", r.RemoteAddr, r.URL.String())
+
+	pubKey := params.ByName("pubkey")
+	shortCode := ShortKey(pubKey)
+	if !nkeys.IsValidPublicUserKey(pubKey) {
+		server.sendErrorResponse(http.StatusBadRequest, "bad user public key", "", nil, w)
+		return
+	}
+
+	theJWT, stale, err := server.loadJWT(pubKey, usersPath)
+	countLookup(&server.metrics.userHits, &server.metrics.userMisses, err)
+	if err != nil {
+		logger.WithFields(logging.Fields{"user": pubKey, "error": err}).Debugf("unable to find requested user JWT for %s - %s", shortCode, err.Error())
+		writeError(w, lookupErrorStatus(err, http.StatusInternalServerError), lookupErrorCode(err), "No Matching JWT", "")
+		return
+	}
+
+	decoded, err := jwt.DecodeUserClaims(theJWT)
+	if err != nil {
+		server.sendError(http.StatusInternalServerError, CodeStoreError, "error loading JWT", shortCode, err, w)
+		return
+	}
+
+	if stale {
+		w.Header().Set("Warning", staleWarning)
+	}
+
+	e := jwtETag(decoded.ID)
+	w.Header().Set("Etag", e)
+	server.setCacheHeaders(w, pubKey, decoded.Expires, server.currentConfig().AccountCacheTTL)
+
+	if etagMatches(r.Header.Get("If-None-Match"), e) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Add(ContentType, ApplicationJWT)
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write([]byte(theJWT)); err != nil {
+		logger.WithFields(logging.Fields{"user": pubKey, "error": err}).Errorf("error writing JWT for %s - %s", shortCode, err.Error())
+	}
+}
@@ -0,0 +1,188 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func createUserKey(t *testing.T) string {
+	kp, err := nkeys.CreateUser()
+	require.NoError(t, err)
+	pub, err := kp.PublicKey()
+	require.NoError(t, err)
+	return pub
+}
+
+func TestUserJWTsDisabled(t *testing.T) {
+	testEnv, err := SetupTestServer(conf.DefaultServerConfig(), false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	_, _, accountKP := CreateAccountKey(t)
+	userKey := createUserKey(t)
+	userJWT, err := jwt.NewUserClaims(userKey).Encode(accountKP)
+	require.NoError(t, err)
+
+	resp, err := testEnv.HTTP.Post(testEnv.URLForPath("/jwt/v1/users/"+userKey), "application/jwt", bytes.NewBuffer([]byte(userJWT)))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, err = testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/users/" + userKey))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestUserJWTs(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.EnableUserJWTs = true
+	testEnv, err := SetupTestServer(config, false, true)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	_, accountPub, accountKP := CreateAccountKey(t)
+	signingKP, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	signingPub, err := signingKP.PublicKey()
+	require.NoError(t, err)
+
+	postUser := func(pubKey string, theJWT string) int {
+		resp, err := testEnv.HTTP.Post(testEnv.URLForPath("/jwt/v1/users/"+pubKey), "application/jwt", bytes.NewBuffer([]byte(theJWT)))
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	userKey := createUserKey(t)
+	userJWT, err := jwt.NewUserClaims(userKey).Encode(accountKP)
+	require.NoError(t, err)
+
+	// the account isn't stored yet
+	require.Equal(t, http.StatusForbidden, postUser(userKey, userJWT))
+
+	account := jwt.NewAccountClaims(accountPub)
+	account.SigningKeys.Add(signingPub)
+	accountJWT, err := account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	resp, err := testEnv.HTTP.Post(testEnv.URLForPath("/jwt/v1/accounts/"+accountPub), "application/jwt", bytes.NewBuffer([]byte(accountJWT)))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	sub, err := testEnv.NC.SubscribeSync(">")
+	require.NoError(t, err)
+	require.NoError(t, testEnv.NC.Flush())
+
+	require.Equal(t, http.StatusOK, postUser(userKey, userJWT))
+
+	// signed by a signing key of the account
+	signedKey := createUserKey(t)
+	signed := jwt.NewUserClaims(signedKey)
+	signed.IssuerAccount = accountPub
+	signed.Expires = time.Now().Add(time.Hour).Unix()
+	signedJWT, err := signed.Encode(signingKP)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, postUser(signedKey, signedJWT))
+
+	// a key the account doesn't know about
+	otherKP, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	rogueKey := createUserKey(t)
+	rogue := jwt.NewUserClaims(rogueKey)
+	rogue.IssuerAccount = accountPub
+	rogueJWT, err := rogue.Encode(otherKP)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusForbidden, postUser(rogueKey, rogueJWT))
+
+	require.Equal(t, http.StatusBadRequest, postUser(createUserKey(t), userJWT))
+	require.Equal(t, http.StatusBadRequest, postUser(accountPub, accountJWT))
+
+	_, err = sub.NextMsg(500 * time.Millisecond)
+	require.Error(t, err, "user JWTs shouldn't be sent over NATS")
+
+	resp, err = testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/users/" + signedKey))
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, signedJWT, string(body))
+	require.Equal(t, ApplicationJWT, resp.Header.Get(ContentType))
+	require.NotEmpty(t, resp.Header.Get("Cache-Control"))
+	require.NotEmpty(t, resp.Header.Get("Etag"))
+	require.NotEmpty(t, resp.Header.Get(ClaimExpiresHeader))
+
+	resp, err = testEnv.HTTP.Get(testEnv.URLForPath("/jwt/v1/users/" + rogueKey))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestUserJWTsOnReplica(t *testing.T) {
+	config := conf.DefaultServerConfig()
+	config.EnableUserJWTs = true
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	_, accountPub, accountKP := CreateAccountKey(t)
+	accountJWT, err := jwt.NewAccountClaims(accountPub).Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	require.NoError(t, testEnv.Server.jwtStore.Save(accountPub, accountJWT))
+
+	userKey := createUserKey(t)
+	userJWT, err := jwt.NewUserClaims(userKey).Encode(accountKP)
+	require.NoError(t, err)
+	resp, err := testEnv.HTTP.Post(testEnv.URLForPath("/jwt/v1/users/"+userKey), "application/jwt", bytes.NewBuffer([]byte(userJWT)))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	replicaConfig := testEnv.CreateReplicaConfig("")
+	replicaConfig.EnableUserJWTs = true
+	replica := NewAccountServer()
+	replica.InitializeFromConfig(replicaConfig)
+	require.NoError(t, replica.Start())
+	defer replica.Stop()
+
+	url := fmt.Sprintf("%s://%s/jwt/v1/users/%s", replica.protocol, replica.hostPort, userKey)
+	resp, err = testEnv.HTTP.Get(url)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, userJWT, string(body))
+
+	// replicas don't take uploads
+	resp, err = testEnv.HTTP.Post(url, "application/jwt", bytes.NewBuffer(body))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.NotEqual(t, http.StatusOK, resp.StatusCode)
+}
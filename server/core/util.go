@@ -17,6 +17,8 @@
 package core
 
 import (
+	"fmt"
+	"strings"
 	"time"
 )
 
@@ -29,6 +31,37 @@ func ShortKey(s string) string {
 	return s
 }
 
+// checkClaimTimes returns an error if a JWT with the expires and not before times, in unix seconds,
+// isn't valid at now, allowing for skew either way. Zero times aren't checked.
+func checkClaimTimes(expires int64, notBefore int64, now time.Time, skew time.Duration) error {
+	if expires > 0 && now.Add(-skew).After(time.Unix(expires, 0)) {
+		return fmt.Errorf("claim is expired")
+	}
+
+	if notBefore > 0 && now.Add(skew).Before(time.Unix(notBefore, 0)) {
+		return fmt.Errorf("claim is not yet valid")
+	}
+
+	return nil
+}
+
+// jwtETag returns the strong entity tag for a JWT, the JWT ID is a hash of its claims
+func jwtETag(id string) string {
+	return `"` + id + `"`
+}
+
+// etagMatches returns true if the If-None-Match header value lists etag, or is *
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		// If-None-Match uses the weak comparison
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
 // UnixToDate parses a unix date in UTC to a time
 func UnixToDate(d int64) string {
 	if d == 0 {
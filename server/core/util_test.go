@@ -18,6 +18,7 @@ package core
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -29,3 +30,33 @@ func TestUnixToDateEmptyString(t *testing.T) {
 func TestShortKeyTooShort(t *testing.T) {
 	require.Equal(t, "foo", ShortKey("foo"))
 }
+
+func TestCheckClaimTimes(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	skew := 30 * time.Second
+
+	require.NoError(t, checkClaimTimes(0, 0, now, skew))
+
+	// expired and not before are allowed up to the skew, but not past it
+	require.NoError(t, checkClaimTimes(now.Unix()-30, 0, now, skew))
+	require.Error(t, checkClaimTimes(now.Unix()-31, 0, now, skew))
+	require.NoError(t, checkClaimTimes(0, now.Unix()+30, now, skew))
+	require.Error(t, checkClaimTimes(0, now.Unix()+31, now, skew))
+
+	require.Error(t, checkClaimTimes(now.Unix()-1, 0, now, 0))
+	require.NoError(t, checkClaimTimes(now.Unix(), now.Unix(), now, 0))
+}
+
+func TestETagMatches(t *testing.T) {
+	etag := jwtETag("ABC")
+	require.Equal(t, `"ABC"`, etag)
+
+	require.True(t, etagMatches(`"ABC"`, etag))
+	require.True(t, etagMatches(`"XYZ", "ABC"`, etag))
+	require.True(t, etagMatches(`W/"ABC"`, etag))
+	require.True(t, etagMatches("*", etag))
+
+	require.False(t, etagMatches("", etag))
+	require.False(t, etagMatches(`"ABCD"`, etag))
+	require.False(t, etagMatches(`ABC`, etag))
+}
@@ -0,0 +1,295 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/logging"
+	"github.com/nats-io/nkeys"
+)
+
+// WebhookSignature is the header with the hex encoded HMAC-SHA256 of a webhook body
+const WebhookSignature = "Nats-Webhook-Signature"
+
+// webhook actions
+const (
+	webhookCreated = "created"
+	webhookUpdated = "updated"
+)
+
+// webhookBackoff is the wait before the second try of a delivery, it doubles for each try after that
+var webhookBackoff = 500 * time.Millisecond
+
+// webhookEvent is the body posted to a webhook
+type webhookEvent struct {
+	PubKey   string `json:"pubkey"`
+	Name     string `json:"name,omitempty"`
+	Action   string `json:"action"`
+	IssuedAt int64  `json:"iat"`
+	JTI      string `json:"jti"`
+}
+
+// webhookEndpoint delivers the events for one URL from its own queue
+type webhookEndpoint struct {
+	url      string
+	accounts map[string]bool
+	secret   []byte
+	queue    chan []byte
+}
+
+func (endpoint *webhookEndpoint) matches(pubKey string) bool {
+	return len(endpoint.accounts) == 0 || endpoint.accounts[pubKey]
+}
+
+// webhooks posts account changes to the configured endpoints without blocking the saves
+type webhooks struct {
+	sync.Mutex
+	closed    bool
+	endpoints []*webhookEndpoint
+	client    *http.Client
+	attempts  int
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	metrics   *serverMetrics
+	logger    logging.Logger
+}
+
+// newWebhooks returns nil if no endpoints are configured
+func newWebhooks(config conf.WebhooksConfig, metrics *serverMetrics, logger logging.Logger) (*webhooks, error) {
+	if len(config.Endpoints) == 0 {
+		return nil, nil
+	}
+
+	if config.QueueSize <= 0 || config.Attempts <= 0 || config.Timeout <= 0 {
+		return nil, fmt.Errorf("webhook queue size, attempts and timeout must be positive")
+	}
+
+	hooks := &webhooks{
+		client:   &http.Client{Timeout: time.Duration(config.Timeout) * time.Millisecond},
+		attempts: config.Attempts,
+		metrics:  metrics,
+		logger:   logger,
+	}
+
+	for _, endpointConfig := range config.Endpoints {
+		endpoint, err := newWebhookEndpoint(endpointConfig, config.QueueSize)
+		if err != nil {
+			return nil, err
+		}
+		hooks.endpoints = append(hooks.endpoints, endpoint)
+	}
+
+	hooks.ctx, hooks.cancel = context.WithCancel(context.Background())
+	for _, endpoint := range hooks.endpoints {
+		hooks.wg.Add(1)
+		go hooks.run(endpoint)
+	}
+	return hooks, nil
+}
+
+func newWebhookEndpoint(config conf.WebhookConfig, queueSize int) (*webhookEndpoint, error) {
+	parsed, err := url.Parse(config.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("bad webhook URL %q", config.URL)
+	}
+
+	if config.Secret != "" && config.SecretFile != "" {
+		return nil, fmt.Errorf("webhook secret and secret file are mutually exclusive for %s", config.URL)
+	}
+
+	secret := config.Secret
+	if config.SecretFile != "" {
+		data, err := ioutil.ReadFile(config.SecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read webhook secret for %s, %s", config.URL, err.Error())
+		}
+		secret = strings.TrimSpace(string(data))
+	}
+
+	endpoint := &webhookEndpoint{
+		url:      config.URL,
+		accounts: map[string]bool{},
+		secret:   []byte(secret),
+		queue:    make(chan []byte, queueSize),
+	}
+
+	for _, pubKey := range config.Accounts {
+		if !nkeys.IsValidPublicAccountKey(pubKey) {
+			return nil, fmt.Errorf("webhook for %s has a bad account public key %q", config.URL, pubKey)
+		}
+		endpoint.accounts[pubKey] = true
+	}
+	return endpoint, nil
+}
+
+// add queues the change for every endpoint that wants the account, without blocking
+func (hooks *webhooks) add(claim *jwt.AccountClaims, action string) {
+	if hooks == nil {
+		return
+	}
+
+	body, err := json.Marshal(webhookEvent{
+		PubKey:   claim.Subject,
+		Name:     claim.Name,
+		Action:   action,
+		IssuedAt: claim.IssuedAt,
+		JTI:      claim.ID,
+	})
+	if err != nil {
+		hooks.logger.Errorf("unable to encode webhook for %s, %s", ShortKey(claim.Subject), err.Error())
+		return
+	}
+
+	hooks.Lock()
+	defer hooks.Unlock()
+
+	if hooks.closed {
+		return
+	}
+
+	for _, endpoint := range hooks.endpoints {
+		if !endpoint.matches(claim.Subject) {
+			continue
+		}
+
+		select {
+		case endpoint.queue <- body:
+		default:
+			atomic.AddUint64(&hooks.metrics.webhookDropped, 1)
+			hooks.logger.Warnf("webhook queue for %s is full, dropping the change to %s", endpoint.url, ShortKey(claim.Subject))
+		}
+	}
+}
+
+func (hooks *webhooks) run(endpoint *webhookEndpoint) {
+	defer hooks.wg.Done()
+
+	for body := range endpoint.queue {
+		if hooks.ctx.Err() != nil {
+			continue
+		}
+
+		if err := hooks.deliver(endpoint, body); err != nil {
+			atomic.AddUint64(&hooks.metrics.webhookFailures, 1)
+			hooks.logger.WithFields(logging.Fields{"webhook": endpoint.url, "error": err}).Errorf("unable to deliver webhook to %s after %d attempts, %s", endpoint.url, hooks.attempts, err.Error())
+			continue
+		}
+		atomic.AddUint64(&hooks.metrics.webhookDeliveries, 1)
+	}
+}
+
+// deliver posts the body until the endpoint answers with a 2xx or the attempts run out
+func (hooks *webhooks) deliver(endpoint *webhookEndpoint, body []byte) error {
+	var err error
+	wait := webhookBackoff
+
+	for attempt := 1; attempt <= hooks.attempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-time.After(wait):
+			case <-hooks.ctx.Done():
+				return hooks.ctx.Err()
+			}
+			wait *= 2
+		}
+
+		if err = hooks.post(endpoint, body); err == nil {
+			return nil
+		}
+		hooks.logger.Debugf("webhook to %s failed on attempt %d, %s", endpoint.url, attempt, err.Error())
+	}
+	return err
+}
+
+func (hooks *webhooks) post(endpoint *webhookEndpoint, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, endpoint.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(hooks.ctx)
+	req.Header.Set(ContentType, ApplicationJSON)
+	if len(endpoint.secret) > 0 {
+		req.Header.Set(WebhookSignature, signWebhook(endpoint.secret, body))
+	}
+
+	resp, err := hooks.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// signWebhook is the value of the signature header, sha256= and the hex encoded HMAC of the body
+func signWebhook(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// close stops the deliveries, a try in progress is cancelled and queued changes are dropped
+func (hooks *webhooks) close() {
+	if hooks == nil {
+		return
+	}
+
+	hooks.Lock()
+	if hooks.closed {
+		hooks.Unlock()
+		return
+	}
+	hooks.closed = true
+	hooks.cancel()
+	for _, endpoint := range hooks.endpoints {
+		close(endpoint.queue)
+	}
+	hooks.Unlock()
+
+	hooks.wg.Wait()
+}
+
+// accountWebhookAction is the action for an account save, it has to be called before the
+// account is indexed
+func (server *AccountServer) accountWebhookAction(pubKey string) string {
+	if server.accounts.has(pubKey) {
+		return webhookUpdated
+	}
+	return webhookCreated
+}
@@ -0,0 +1,233 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/nats-io/nats-account-server/server/logging"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+type receivedWebhook struct {
+	event     webhookEvent
+	signature string
+	body      []byte
+}
+
+// webhookReceiver records the webhooks posted to it, failing the first failures requests
+func webhookReceiver(t *testing.T, failures int32) (*httptest.Server, chan receivedWebhook) {
+	received := make(chan receivedWebhook, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		var event webhookEvent
+		require.NoError(t, json.Unmarshal(body, &event))
+		received <- receivedWebhook{event: event, signature: r.Header.Get(WebhookSignature), body: body}
+	}))
+	return server, received
+}
+
+func nextWebhook(t *testing.T, received chan receivedWebhook) receivedWebhook {
+	select {
+	case hook := <-received:
+		return hook
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "no webhook received")
+		return receivedWebhook{}
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	all, allReceived := webhookReceiver(t, 0)
+	defer all.Close()
+	filtered, filteredReceived := webhookReceiver(t, 0)
+	defer filtered.Close()
+
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	pubKey, err := accountKey.PublicKey()
+	require.NoError(t, err)
+	_, otherKey, otherAccount := CreateAccountKey(t)
+
+	config := conf.DefaultServerConfig()
+	config.Webhooks.Endpoints = []conf.WebhookConfig{
+		{URL: all.URL, Secret: "shared"},
+		{URL: filtered.URL, Accounts: []string{otherKey}},
+	}
+
+	testEnv, err := SetupTestServer(config, false, false)
+	defer testEnv.Cleanup()
+	require.NoError(t, err)
+
+	first := postNamedAccount(t, testEnv, accountKey, "billing")
+
+	// the same JWT again is unchanged, so the update has a new limit
+	account := jwt.NewAccountClaims(pubKey)
+	account.Name = "billing"
+	account.Limits.Conn = 10
+	second, err := account.Encode(testEnv.OperatorKey)
+	require.NoError(t, err)
+	resp, err := testEnv.HTTP.Post(testEnv.URLForPath("/jwt/v1/accounts/"+pubKey), "application/json", bytes.NewBuffer([]byte(second)))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	for i, theJWT := range []string{first, second} {
+		claim, err := jwt.DecodeAccountClaims(theJWT)
+		require.NoError(t, err)
+
+		hook := nextWebhook(t, allReceived)
+		require.Equal(t, pubKey, hook.event.PubKey)
+		require.Equal(t, "billing", hook.event.Name)
+		require.Equal(t, claim.ID, hook.event.JTI)
+		require.Equal(t, claim.IssuedAt, hook.event.IssuedAt)
+		require.Equal(t, signWebhook([]byte("shared"), hook.body), hook.signature)
+
+		if i == 0 {
+			require.Equal(t, webhookCreated, hook.event.Action)
+		} else {
+			require.Equal(t, webhookUpdated, hook.event.Action)
+		}
+	}
+
+	// the filtered endpoint only hears about its account, and isn't signed
+	postNamedAccount(t, testEnv, otherAccount, "provisioning")
+	hook := nextWebhook(t, filteredReceived)
+	require.Equal(t, otherKey, hook.event.PubKey)
+	require.Equal(t, webhookCreated, hook.event.Action)
+	require.Empty(t, hook.signature)
+	require.Len(t, filteredReceived, 0)
+
+	hook = nextWebhook(t, allReceived)
+	require.Equal(t, otherKey, hook.event.PubKey)
+}
+
+func TestWebhookRetries(t *testing.T) {
+	defer func(backoff time.Duration) { webhookBackoff = backoff }(webhookBackoff)
+	webhookBackoff = 10 * time.Millisecond
+
+	flaky, received := webhookReceiver(t, 2)
+	defer flaky.Close()
+	dead, _ := webhookReceiver(t, 100)
+	defer dead.Close()
+
+	metrics := &serverMetrics{}
+	config := conf.DefaultServerConfig().Webhooks
+	config.Endpoints = []conf.WebhookConfig{{URL: flaky.URL}, {URL: dead.URL}}
+	hooks, err := newWebhooks(config, metrics, logging.NewNATSLogger(logging.Config{}))
+	require.NoError(t, err)
+	defer hooks.close()
+
+	_, pubKey, _ := CreateAccountKey(t)
+	hooks.add(jwt.NewAccountClaims(pubKey), webhookCreated)
+
+	hook := nextWebhook(t, received)
+	require.Equal(t, pubKey, hook.event.PubKey)
+
+	for i := 0; i < 50 && atomic.LoadUint64(&metrics.webhookFailures) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, uint64(1), atomic.LoadUint64(&metrics.webhookDeliveries))
+	require.Equal(t, uint64(1), atomic.LoadUint64(&metrics.webhookFailures))
+}
+
+func TestWebhookQueueIsBounded(t *testing.T) {
+	unblock := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer hung.Close()
+	defer close(unblock)
+
+	metrics := &serverMetrics{}
+	config := conf.DefaultServerConfig().Webhooks
+	config.QueueSize = 2
+	config.Endpoints = []conf.WebhookConfig{{URL: hung.URL}}
+	hooks, err := newWebhooks(config, metrics, logging.NewNATSLogger(logging.Config{}))
+	require.NoError(t, err)
+
+	// the endpoint never answers, adds still return straight away
+	_, pubKey, _ := CreateAccountKey(t)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		hooks.add(jwt.NewAccountClaims(pubKey), webhookUpdated)
+	}
+	require.True(t, time.Since(start) < time.Second)
+	require.True(t, atomic.LoadUint64(&metrics.webhookDropped) >= 7)
+
+	// closing cancels the delivery in progress
+	start = time.Now()
+	hooks.close()
+	require.True(t, time.Since(start) < time.Second)
+	hooks.add(jwt.NewAccountClaims(pubKey), webhookUpdated)
+}
+
+func TestNewWebhooks(t *testing.T) {
+	logger := logging.NewNATSLogger(logging.Config{})
+	config := conf.DefaultServerConfig().Webhooks
+
+	hooks, err := newWebhooks(config, &serverMetrics{}, logger)
+	require.NoError(t, err)
+	require.Nil(t, hooks)
+
+	dir, err := ioutil.TempDir(os.TempDir(), "webhooks_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	secretFile := filepath.Join(dir, "secret")
+	require.NoError(t, ioutil.WriteFile(secretFile, []byte("from a file\n"), 0600))
+
+	config.Endpoints = []conf.WebhookConfig{{URL: "https://example.com/hook", SecretFile: secretFile}}
+	hooks, err = newWebhooks(config, &serverMetrics{}, logger)
+	require.NoError(t, err)
+	require.Equal(t, []byte("from a file"), hooks.endpoints[0].secret)
+	hooks.close()
+
+	for _, bad := range []conf.WebhookConfig{
+		{URL: "example.com/hook"},
+		{URL: "ftp://example.com/hook"},
+		{URL: "https://example.com/hook", Secret: "a", SecretFile: secretFile},
+		{URL: "https://example.com/hook", SecretFile: filepath.Join(dir, "missing")},
+		{URL: "https://example.com/hook", Accounts: []string{"notakey"}},
+	} {
+		config.Endpoints = []conf.WebhookConfig{bad}
+		_, err := newWebhooks(config, &serverMetrics{}, logger)
+		require.Error(t, err)
+	}
+
+	config.Endpoints = []conf.WebhookConfig{{URL: "https://example.com/hook"}}
+	config.Attempts = 0
+	_, err = newWebhooks(config, &serverMetrics{}, logger)
+	require.Error(t, err)
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// jsonLogger writes one JSON record per line, with the level, the time if configured,
+// the message and the fields
+type jsonLogger struct {
+	sync.Mutex
+	out   io.Writer
+	time  bool
+	debug bool
+	trace bool
+	pid   int
+}
+
+func newJSONLogger(out io.Writer, conf Config) *jsonLogger {
+	l := &jsonLogger{
+		out:   out,
+		time:  conf.Time,
+		debug: conf.Debug,
+		trace: conf.Trace,
+	}
+	if conf.PID {
+		l.pid = os.Getpid()
+	}
+	return l
+}
+
+func (l *jsonLogger) log(level string, fields Fields, msg string) {
+	if (level == levelDebug && !l.debug) || (level == levelTrace && !l.trace) {
+		return
+	}
+
+	record := make(map[string]interface{}, len(fields)+4)
+	for k, v := range fields {
+		// errors marshal as empty objects
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		record[k] = v
+	}
+
+	record["level"] = level
+	record["msg"] = msg
+	if l.time {
+		record["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	if l.pid != 0 {
+		record["pid"] = l.pid
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		data, _ = json.Marshal(map[string]interface{}{
+			"level": level,
+			"msg":   msg,
+			"error": fmt.Sprintf("unable to encode log fields, %s", err.Error()),
+		})
+	}
+
+	l.Lock()
+	l.out.Write(append(data, '\n'))
+	l.Unlock()
+
+	if level == levelFatal {
+		os.Exit(1)
+	}
+}
@@ -16,6 +16,19 @@
 
 package logging
 
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// log formats
+const (
+	TextFormat = "text"
+	JSONFormat = "json"
+)
+
 // Config defines logging flags for the NATS logger
 type Config struct {
 	Time   bool
@@ -23,6 +36,78 @@ type Config struct {
 	Trace  bool
 	Colors bool
 	PID    bool
+	Format string // text, the default, or json
+}
+
+// Fields are attached to a log message, JSON records get them as keys and text lines
+// get them after the message
+type Fields map[string]interface{}
+
+// String formats the fields for a text line, sorted by key
+func (fields Fields) String() string {
+	if len(fields) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%v", k, fields[k]))
+	}
+	return "[" + strings.Join(parts, " ") + "]"
+}
+
+// merge returns a new set of fields with the values in other replacing the ones in fields
+func (fields Fields) merge(other Fields) Fields {
+	merged := make(Fields, len(fields)+len(other))
+	for k, v := range fields {
+		merged[k] = v
+	}
+	for k, v := range other {
+		merged[k] = v
+	}
+	return merged
+}
+
+// TraceIDField is the field the trace id of a request is logged under
+const TraceIDField = "trace_id"
+
+// traceIDKey is the context key for the trace id
+type traceIDKey struct{}
+
+// ContextWithTraceID returns a context carrying the trace id, for WithContext
+func ContextWithTraceID(ctx context.Context, traceID string) context.Context {
+	return context.WithValue(ctx, traceIDKey{}, traceID)
+}
+
+// TraceIDFromContext returns the trace id in ctx, or an empty string
+func TraceIDFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	traceID, _ := ctx.Value(traceIDKey{}).(string)
+	return traceID
+}
+
+// contextFields returns the fields WithContext adds for ctx, nil if there are none
+func contextFields(ctx context.Context) Fields {
+	if traceID := TraceIDFromContext(ctx); traceID != "" {
+		return Fields{TraceIDField: traceID}
+	}
+	return nil
+}
+
+// ValidateFormat returns an error if the format isn't text or json
+func ValidateFormat(format string) error {
+	if format != "" && format != TextFormat && format != JSONFormat {
+		return fmt.Errorf("unknown log format %q, use %s or %s", format, TextFormat, JSONFormat)
+	}
+	return nil
 }
 
 // Logger interface
@@ -34,5 +119,11 @@ type Logger interface {
 	Tracef(format string, v ...interface{})
 	Warnf(format string, v ...interface{})
 
+	// WithFields returns a logger that adds the fields to every message
+	WithFields(fields Fields) Logger
+
+	// WithContext returns a logger that adds the trace id in ctx, if it has one, to every message
+	WithContext(ctx context.Context) Logger
+
 	Close() error
 }
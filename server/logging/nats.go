@@ -17,53 +17,195 @@
 package logging
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
 	"github.com/nats-io/nats-server/v2/logger"
 )
 
-// NewNATSLogger creates a new logger that uses the gnatsd library
+// levels passed from the Logger methods to the text or JSON output
+const (
+	levelDebug = "debug"
+	levelTrace = "trace"
+	levelInfo  = "info"
+	levelWarn  = "warn"
+	levelError = "error"
+	levelFatal = "fatal"
+)
+
+// NewNATSLogger creates a new logger that uses the gnatsd library, or writes JSON records
+// if the format is json
 func NewNATSLogger(conf Config) Logger {
-	l := logger.NewStdLogger(conf.Time, conf.Debug, conf.Trace, conf.Colors, conf.PID)
-	return &NATSLogger{
-		logger: l,
-	}
+	nl := &NATSLogger{}
+	nl.Reconfigure(conf)
+	return nl
 }
 
-// NATSLogger - uses the gnatsd logging code
+// NATSLogger - uses the gnatsd logging code for text, and a JSON writer for json
 type NATSLogger struct {
+	sync.RWMutex
 	logger *logger.Logger
+	json   *jsonLogger
+}
+
+// Reconfigure replaces the underlying logger, messages logged afterwards use the new settings
+func (nl *NATSLogger) Reconfigure(conf Config) {
+	var text *logger.Logger
+	var json *jsonLogger
+
+	if conf.Format == JSONFormat {
+		json = newJSONLogger(os.Stderr, conf)
+	} else {
+		text = logger.NewStdLogger(conf.Time, conf.Debug, conf.Trace, conf.Colors, conf.PID)
+	}
+
+	nl.Lock()
+	nl.logger = text
+	nl.json = json
+	nl.Unlock()
+}
+
+func (nl *NATSLogger) current() (*logger.Logger, *jsonLogger) {
+	nl.RLock()
+	defer nl.RUnlock()
+	return nl.logger, nl.json
+}
+
+// log sends a message to the current output, text lines get the fields after the message
+func (nl *NATSLogger) log(level string, fields Fields, format string, v ...interface{}) {
+	text, json := nl.current()
+
+	if json != nil {
+		json.log(level, fields, fmt.Sprintf(format, v...))
+		return
+	}
+
+	if len(fields) > 0 {
+		format, v = "%s %s", []interface{}{fmt.Sprintf(format, v...), fields.String()}
+	}
+
+	switch level {
+	case levelDebug:
+		text.Debugf(format, v...)
+	case levelTrace:
+		text.Tracef(format, v...)
+	case levelInfo:
+		text.Noticef(format, v...)
+	case levelWarn:
+		text.Warnf(format, v...)
+	case levelError:
+		text.Errorf(format, v...)
+	case levelFatal:
+		text.Fatalf(format, v...)
+	}
+}
+
+// WithFields returns a logger that adds the fields to every message
+func (nl *NATSLogger) WithFields(fields Fields) Logger {
+	return &fieldLogger{parent: nl, fields: Fields{}.merge(fields)}
+}
+
+// WithContext returns a logger that adds the trace id in ctx to every message
+func (nl *NATSLogger) WithContext(ctx context.Context) Logger {
+	fields := contextFields(ctx)
+	if fields == nil {
+		return nl
+	}
+	return nl.WithFields(fields)
 }
 
 // Close forwards to the nats logger
-func (logger *NATSLogger) Close() error {
-	return logger.logger.Close()
+func (nl *NATSLogger) Close() error {
+	text, _ := nl.current()
+	if text == nil {
+		return nil
+	}
+	return text.Close()
 }
 
 // Debugf forwards to the nats logger
-func (logger *NATSLogger) Debugf(format string, v ...interface{}) {
-	logger.logger.Debugf(format, v...)
+func (nl *NATSLogger) Debugf(format string, v ...interface{}) {
+	nl.log(levelDebug, nil, format, v...)
 }
 
 // Errorf forwards to the nats logger
-func (logger *NATSLogger) Errorf(format string, v ...interface{}) {
-	logger.logger.Errorf(format, v...)
+func (nl *NATSLogger) Errorf(format string, v ...interface{}) {
+	nl.log(levelError, nil, format, v...)
 }
 
 // Fatalf forwards to the nats logger
-func (logger *NATSLogger) Fatalf(format string, v ...interface{}) {
-	logger.logger.Fatalf(format, v...)
+func (nl *NATSLogger) Fatalf(format string, v ...interface{}) {
+	nl.log(levelFatal, nil, format, v...)
 }
 
 // Noticef  forwards to the nats logger
-func (logger *NATSLogger) Noticef(format string, v ...interface{}) {
-	logger.logger.Noticef(format, v...)
+func (nl *NATSLogger) Noticef(format string, v ...interface{}) {
+	nl.log(levelInfo, nil, format, v...)
 }
 
 // Tracef forwards to the nats logger
-func (logger *NATSLogger) Tracef(format string, v ...interface{}) {
-	logger.logger.Tracef(format, v...)
+func (nl *NATSLogger) Tracef(format string, v ...interface{}) {
+	nl.log(levelTrace, nil, format, v...)
 }
 
 // Warnf forwards to the nats logger
-func (logger *NATSLogger) Warnf(format string, v ...interface{}) {
-	logger.logger.Warnf(format, v...)
+func (nl *NATSLogger) Warnf(format string, v ...interface{}) {
+	nl.log(levelWarn, nil, format, v...)
+}
+
+// fieldLogger adds fields to the messages it passes to a NATSLogger, so it follows Reconfigure
+type fieldLogger struct {
+	parent *NATSLogger
+	fields Fields
+}
+
+// WithFields returns a logger with these fields and the new ones
+func (fl *fieldLogger) WithFields(fields Fields) Logger {
+	return &fieldLogger{parent: fl.parent, fields: fl.fields.merge(fields)}
+}
+
+// WithContext returns a logger with these fields and the trace id in ctx
+func (fl *fieldLogger) WithContext(ctx context.Context) Logger {
+	fields := contextFields(ctx)
+	if fields == nil {
+		return fl
+	}
+	return fl.WithFields(fields)
+}
+
+// Close closes the parent logger
+func (fl *fieldLogger) Close() error {
+	return fl.parent.Close()
+}
+
+// Debugf logs with the fields
+func (fl *fieldLogger) Debugf(format string, v ...interface{}) {
+	fl.parent.log(levelDebug, fl.fields, format, v...)
+}
+
+// Errorf logs with the fields
+func (fl *fieldLogger) Errorf(format string, v ...interface{}) {
+	fl.parent.log(levelError, fl.fields, format, v...)
+}
+
+// Fatalf logs with the fields
+func (fl *fieldLogger) Fatalf(format string, v ...interface{}) {
+	fl.parent.log(levelFatal, fl.fields, format, v...)
+}
+
+// Noticef logs with the fields
+func (fl *fieldLogger) Noticef(format string, v ...interface{}) {
+	fl.parent.log(levelInfo, fl.fields, format, v...)
+}
+
+// Tracef logs with the fields
+func (fl *fieldLogger) Tracef(format string, v ...interface{}) {
+	fl.parent.log(levelTrace, fl.fields, format, v...)
+}
+
+// Warnf logs with the fields
+func (fl *fieldLogger) Warnf(format string, v ...interface{}) {
+	fl.parent.log(levelWarn, fl.fields, format, v...)
 }
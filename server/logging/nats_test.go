@@ -17,7 +17,14 @@
 package logging
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
 	"testing"
+
+	"github.com/stretchr/testify/require"
 )
 
 func TestNATSForCoverage(t *testing.T) {
@@ -30,3 +37,114 @@ func TestNATSForCoverage(t *testing.T) {
 	// skip fatal
 	logger.Close()
 }
+
+func TestNATSReconfigure(t *testing.T) {
+	logger := NewNATSLogger(Config{}).(*NATSLogger)
+	old, _ := logger.current()
+	logger.Reconfigure(Config{Debug: true, Trace: true})
+	text, _ := logger.current()
+	require.NotEqual(t, old, text)
+	logger.Debugf("test")
+	logger.Close()
+}
+
+func TestNATSReconfigureToJSON(t *testing.T) {
+	logger := NewNATSLogger(Config{}).(*NATSLogger)
+	fields := logger.WithFields(Fields{"account": "A"})
+
+	logger.Reconfigure(Config{Format: JSONFormat})
+	text, json := logger.current()
+	require.Nil(t, text)
+	require.NotNil(t, json)
+
+	// loggers with fields follow the reconfigure
+	var buf bytes.Buffer
+	json.out = &buf
+	fields.Noticef("test")
+	require.Contains(t, buf.String(), `"account":"A"`)
+	require.NoError(t, logger.Close())
+}
+
+func TestTextWithFields(t *testing.T) {
+	logger := NewNATSLogger(Config{})
+	fields := logger.WithFields(Fields{"account": "A"}).WithFields(Fields{"subject": "s"})
+	fields.Noticef("test %s", "100%")
+	fields.Debugf("test")
+	fields.Tracef("test")
+	fields.Errorf("test")
+	fields.Warnf("test")
+	require.NoError(t, fields.Close())
+}
+
+func TestWithContext(t *testing.T) {
+	logger := NewNATSLogger(Config{Format: JSONFormat}).(*NATSLogger)
+	var buf bytes.Buffer
+	_, json := logger.current()
+	json.out = &buf
+
+	require.Equal(t, Logger(logger), logger.WithContext(context.Background()))
+
+	ctx := ContextWithTraceID(context.Background(), "abc")
+	require.Equal(t, "abc", TraceIDFromContext(ctx))
+	logger.WithContext(ctx).Noticef("traced")
+	require.Contains(t, buf.String(), `"trace_id":"abc"`)
+
+	buf.Reset()
+	logger.WithFields(Fields{"account": "A"}).WithContext(ctx).Noticef("traced")
+	require.Contains(t, buf.String(), `"trace_id":"abc"`)
+	require.Contains(t, buf.String(), `"account":"A"`)
+}
+
+func TestFieldsString(t *testing.T) {
+	require.Equal(t, "", Fields{}.String())
+	require.Equal(t, "[account=A error=boom subject=s]", Fields{
+		"subject": "s",
+		"account": "A",
+		"error":   fmt.Errorf("boom"),
+	}.String())
+
+	base := Fields{"account": "A"}
+	merged := base.merge(Fields{"account": "B", "jti": "J"})
+	require.Equal(t, Fields{"account": "A"}, base)
+	require.Equal(t, Fields{"account": "B", "jti": "J"}, merged)
+}
+
+func TestValidateFormat(t *testing.T) {
+	require.NoError(t, ValidateFormat(""))
+	require.NoError(t, ValidateFormat(TextFormat))
+	require.NoError(t, ValidateFormat(JSONFormat))
+	require.Error(t, ValidateFormat("xml"))
+}
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newJSONLogger(&buf, Config{Time: true, PID: true})
+
+	logger.log(levelInfo, Fields{"account": "A", "error": fmt.Errorf("boom")}, "hello")
+	logger.log(levelDebug, nil, "skipped")
+	logger.log(levelTrace, nil, "skipped")
+	logger.log(levelWarn, nil, "warned")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+
+	record := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &record))
+	require.Equal(t, "info", record["level"])
+	require.Equal(t, "hello", record["msg"])
+	require.Equal(t, "A", record["account"])
+	require.Equal(t, "boom", record["error"])
+	require.NotEmpty(t, record["time"])
+	require.NotZero(t, record["pid"])
+
+	record = map[string]interface{}{}
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &record))
+	require.Equal(t, "warn", record["level"])
+
+	buf.Reset()
+	logger = newJSONLogger(&buf, Config{Debug: true, Trace: true})
+	logger.log(levelDebug, nil, "debug")
+	logger.log(levelTrace, nil, "trace")
+	require.Equal(t, 2, strings.Count(buf.String(), "\n"))
+	require.NotContains(t, buf.String(), `"time"`)
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package store
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// MigrateDirShards moves every JWT file in a directory store to where a store with the shard
+// setting and depth keeps it, so flat, sharded and deeper layouts can be converted to each
+// other. If a key has files in both places, the most recently modified one is kept. Directories
+// left empty are removed. Files in a namespace directory are moved within it, and hidden
+// directories, such as the history, are left alone. The server shouldn't be running on the directory.
+func MigrateDirShards(dirPath string, shard bool, depth int) (int, error) {
+	jwtStore, err := NewDirJWTStore(dirPath, shard, false, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer jwtStore.Close()
+
+	dirStore := jwtStore.(*DirJWTStore)
+	if err := dirStore.SetShardDepth(depth); err != nil {
+		return 0, err
+	}
+
+	var files []string
+	var dirs []string
+	err = filepath.Walk(dirStore.directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != dirStore.directory && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			if path != dirStore.directory {
+				dirs = append(dirs, path)
+			}
+			return nil
+		}
+		if filepath.Ext(path) == "."+extension {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, path := range files {
+		publicKey := strings.TrimSuffix(filepath.Base(path), "."+extension)
+		target := dirStore.pathIn(namespaceBase(dirStore.directory, path), publicKey)
+		if target == "" || target == path {
+			continue
+		}
+
+		if err := moveJWTFile(path, target); err != nil {
+			return count, fmt.Errorf("moved %d JWTs in %s before failing, %s", count, filepath.Clean(dirPath), err.Error())
+		}
+		count++
+	}
+
+	// deepest first, removing a directory that isn't empty fails and it is kept
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		os.Remove(dir)
+	}
+
+	return count, nil
+}
+
+// namespaceBase is the namespace directory a file is in, or the top of the store. Directories
+// at the top with names that can't be shards are namespaces.
+func namespaceBase(directory string, path string) string {
+	rel, err := filepath.Rel(directory, path)
+	if err != nil {
+		return directory
+	}
+	parts := strings.Split(rel, string(filepath.Separator))
+	if len(parts) > 1 && ValidNamespace(parts[0]) {
+		return filepath.Join(directory, parts[0])
+	}
+	return directory
+}
+
+// moveJWTFile renames path to target, unless target is newer, in which case path is removed
+func moveJWTFile(path string, target string) error {
+	if existing, err := os.Stat(target); err == nil {
+		source, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if !source.ModTime().After(existing.ModTime()) {
+			return os.Remove(path)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	return os.Rename(path, target)
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func dirKeys(t *testing.T, jwtStore JWTStore) map[string]string {
+	jwts := map[string]string{}
+	require.NoError(t, jwtStore.Iterate(func(publicKey string, theJWT string) error {
+		jwts[publicKey] = theJWT
+		return nil
+	}))
+	return jwts
+}
+
+func TestMigrateDirShards(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "jwtstore_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	expected := map[string]string{"oneab": "eyone", "twocd": "eytwo", "threeef": "eythree"}
+
+	jwtStore, err := NewDirJWTStore(dir, false, false, nil, nil)
+	require.NoError(t, err)
+	for k, v := range expected {
+		require.NoError(t, jwtStore.Save(k, v))
+	}
+	jwtStore.Close()
+
+	count, err := MigrateDirShards(dir, false, 2)
+	require.NoError(t, err)
+	require.Equal(t, 3, count)
+
+	_, err = os.Stat(filepath.Join(dir, "a", "b", "oneab.jwt"))
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dir, "oneab.jwt"))
+	require.True(t, os.IsNotExist(err))
+
+	sharded, err := NewDirJWTStore(dir, false, false, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, sharded.(*DirJWTStore).SetShardDepth(2))
+	require.Equal(t, expected, dirKeys(t, sharded))
+	sharded.Close()
+
+	// running it again has nothing to do
+	count, err = MigrateDirShards(dir, false, 2)
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+
+	// to the two character shards, a newer flat copy wins over the old sharded one
+	flat := filepath.Join(dir, "twocd.jwt")
+	require.NoError(t, ioutil.WriteFile(flat, []byte("eytwo2"), 0644))
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(flat, later, later))
+	expected["twocd"] = "eytwo2"
+
+	count, err = MigrateDirShards(dir, true, 0)
+	require.NoError(t, err)
+	require.Equal(t, 4, count)
+
+	sharded, err = NewDirJWTStore(dir, true, false, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, expected, dirKeys(t, sharded))
+	sharded.Close()
+
+	// and back to flat, the empty shard directories are removed
+	count, err = MigrateDirShards(dir, false, 0)
+	require.NoError(t, err)
+	require.Equal(t, 3, count)
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 3)
+
+	_, err = MigrateDirShards(dir, true, 2)
+	require.Error(t, err)
+}
@@ -17,12 +17,15 @@
 package store
 
 import (
+	"crypto/cipher"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/nats-io/nats-account-server/server/conf"
@@ -30,8 +33,20 @@ import (
 
 const (
 	extension = "jwt"
+
+	// quarantineDir holds corrupt JWT files moved aside by Quarantine
+	quarantineDir = ".bad"
+
+	// historyDir holds the versions kept by SaveVersion, as <public key>/<sequence>-<id>.jwt
+	historyDir = ".history"
+
+	// MaxShardDepth is the deepest directory tree SetShardDepth allows
+	MaxShardDepth = 4
 )
 
+// watchDebounce is how long a watched file has to go without changes before it is reported
+var watchDebounce = 100 * time.Millisecond
+
 // DirJWTStore implements the JWT Store interface, keeping JWTs in an optionally sharded
 // directory structure
 type DirJWTStore struct {
@@ -40,10 +55,34 @@ type DirJWTStore struct {
 	directory     string
 	readonly      bool
 	shard         bool
+	depth         int // levels of single character directories, 0 uses shard
 	changed       JWTChanged
 	errorOccurred JWTError
 	watcher       *fsnotify.Watcher
 	done          chan bool
+	pendingLock   sync.Mutex
+	pending       map[string]*time.Timer // changed files waiting for the debounce
+	aead          cipher.AEAD            // set if JWTs are encrypted on disk
+	namespaces    []string               // subdirectories JWTs are kept in, sorted
+	router        NamespaceRouter        // picks the namespace for a saved JWT
+}
+
+// NamespaceRouter returns the namespace a JWT is saved in, an empty string keeps the JWT in
+// the namespace it is already in, or at the top of the store for a new key
+type NamespaceRouter func(publicKey string, theJWT string) string
+
+// ValidNamespace is true for names that can be used as namespaces, they can't be mistaken for
+// a shard directory, which have one or two characters, or a hidden one
+func ValidNamespace(name string) bool {
+	if len(name) < 3 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'A' && c <= 'Z') && !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') && c != '-' && c != '_' {
+			return false
+		}
+	}
+	return true
 }
 
 // NewDirJWTStore returns an empty, mutable directory-based JWT store
@@ -135,7 +174,7 @@ func (store *DirJWTStore) startWatching() error {
 
 	var files []string
 	err = filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
-		if info.IsDir() && store.shard && filepath.Dir(path) == store.directory {
+		if info.IsDir() && store.isShardDir(path) {
 			files = append(files, path)
 		}
 
@@ -167,26 +206,36 @@ func (store *DirJWTStore) startWatching() error {
 					return
 				}
 
-				if event.Op&fsnotify.Write == fsnotify.Write {
+				isJWT := strings.HasSuffix(event.Name, "."+extension)
+
+				if event.Op&(fsnotify.Write|fsnotify.Remove|fsnotify.Rename) != 0 {
 					// Check for jwt change, ignore others
-					if strings.HasSuffix(event.Name, extension) {
-						fileName := filepath.Base(event.Name)
-						pubKey := strings.Replace(fileName, ".jwt", "", -1)
-						store.changed(pubKey)
+					if isJWT {
+						store.fileChanged(event.Name)
 					}
 				} else if event.Op&fsnotify.Create == fsnotify.Create {
-					if strings.HasSuffix(event.Name, extension) {
+					if isJWT {
 						err := watcher.Add(event.Name)
 						if err != nil {
 							store.errorOccurred(err)
 						}
-					} else if filepath.Dir(event.Name) == store.directory && store.shard { // Only go 1 level down
+						// files moved into place aren't written
+						if store.readonly {
+							store.fileChanged(event.Name)
+						}
+					} else if store.isShardDir(event.Name) { // Only go as deep as the shards
 						err := watcher.Add(event.Name)
 						if err != nil {
 							store.errorOccurred(err)
 						}
 						var files []string
 						err = filepath.Walk(event.Name, func(path string, info os.FileInfo, err error) error {
+							if err != nil {
+								return err
+							}
+							if info.IsDir() && path != event.Name && store.isShardDir(path) {
+								files = append(files, path)
+							}
 							if !info.IsDir() && strings.HasSuffix(path, extension) {
 								files = append(files, path)
 							}
@@ -200,6 +249,9 @@ func (store *DirJWTStore) startWatching() error {
 
 						for _, file := range files {
 							watcher.Add(file)
+							if store.readonly && strings.HasSuffix(file, "."+extension) {
+								store.fileChanged(file)
+							}
 						}
 					}
 				}
@@ -217,12 +269,42 @@ func (store *DirJWTStore) startWatching() error {
 	return nil
 }
 
+// fileChanged reports a changed, or removed, file to the change callback once the file has
+// been quiet for watchDebounce, so an editor or a checkout writing in several steps, and the
+// events from watching both the file and its directory, turn into one callback
+func (store *DirJWTStore) fileChanged(path string) {
+	pubKey := strings.TrimSuffix(filepath.Base(path), "."+extension)
+
+	store.pendingLock.Lock()
+	defer store.pendingLock.Unlock()
+
+	if timer, ok := store.pending[pubKey]; ok {
+		timer.Reset(watchDebounce)
+		return
+	}
+
+	if store.pending == nil {
+		store.pending = map[string]*time.Timer{}
+	}
+
+	store.pending[pubKey] = time.AfterFunc(watchDebounce, func() {
+		store.pendingLock.Lock()
+		delete(store.pending, pubKey)
+		stopped := store.pending == nil
+		store.pendingLock.Unlock()
+
+		if !stopped {
+			store.changed(pubKey)
+		}
+	})
+}
+
 // Load checks the memory store and returns the matching JWT or an error
 func (store *DirJWTStore) Load(publicKey string) (string, error) {
 	store.Lock()
 	defer store.Unlock()
 
-	path := store.pathForKey(publicKey)
+	path := store.existingPathForKey(publicKey)
 
 	if path == "" {
 		return "", fmt.Errorf("invalid public key")
@@ -230,11 +312,15 @@ func (store *DirJWTStore) Load(publicKey string) (string, error) {
 
 	data, err := ioutil.ReadFile(path)
 
+	if os.IsNotExist(err) {
+		return "", ErrNotFound
+	}
+
 	if err != nil {
 		return "", err
 	}
 
-	return string(data), nil
+	return openJWT(store.aead, publicKey, data)
 }
 
 // Save puts the JWT in a map by public key, no checks are performed
@@ -246,7 +332,7 @@ func (store *DirJWTStore) Save(publicKey string, theJWT string) error {
 		return fmt.Errorf("store is read-only")
 	}
 
-	path := store.pathForKey(publicKey)
+	path := store.savePathForKey(publicKey, theJWT)
 
 	if path == "" {
 		return fmt.Errorf("invalid public key")
@@ -261,7 +347,367 @@ func (store *DirJWTStore) Save(publicKey string, theJWT string) error {
 		}
 	}
 
-	return ioutil.WriteFile(path, []byte(theJWT), 0644)
+	data := []byte(theJWT)
+	if store.aead != nil {
+		data, err = sealJWT(store.aead, publicKey, theJWT)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return err
+	}
+
+	// the copy in the shard, or namespace, the key belongs in replaces any others
+	for _, other := range store.candidatePaths(publicKey) {
+		if other == path {
+			continue
+		}
+		if err := os.Remove(other); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes the file for the public key
+func (store *DirJWTStore) Delete(publicKey string) error {
+	store.Lock()
+	defer store.Unlock()
+
+	if store.readonly {
+		return fmt.Errorf("store is read-only")
+	}
+
+	paths := store.candidatePaths(publicKey)
+
+	if len(paths) == 0 {
+		return fmt.Errorf("invalid public key")
+	}
+
+	removed := false
+	for _, path := range paths {
+		err := os.Remove(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		removed = true
+	}
+
+	if !removed {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Iterate calls cb for each JWT file in the store, in public key order. Only the
+// file names are collected up front, each JWT is read as it is passed to cb.
+func (store *DirJWTStore) Iterate(cb JWTIterator) error {
+	keys, err := store.Keys()
+	if err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		theJWT, err := store.Load(k)
+		if err == ErrNotFound {
+			continue // removed since the walk
+		}
+		if err != nil {
+			return err
+		}
+		if err := cb(k, theJWT); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Keys returns the public key for each JWT file in the store, in order
+func (store *DirJWTStore) Keys() ([]string, error) {
+	found := map[string]bool{}
+	err := filepath.Walk(store.directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != store.directory && !store.isShardDir(path) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Ext(path) == "."+extension {
+			// a key can be flat and sharded while a store is migrated
+			found[strings.TrimSuffix(info.Name(), "."+extension)] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(found))
+	for k := range found {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Quarantine moves the file for the public key into the .bad directory, where the store no
+// longer sees it, so a corrupt file can be looked at later
+func (store *DirJWTStore) Quarantine(publicKey string) error {
+	store.Lock()
+	defer store.Unlock()
+
+	if store.readonly {
+		return fmt.Errorf("store is read-only")
+	}
+
+	path := store.existingPathForKey(publicKey)
+	if path == "" {
+		return fmt.Errorf("invalid public key")
+	}
+
+	badDir := filepath.Join(store.directory, quarantineDir)
+	if err := os.MkdirAll(badDir, 0755); err != nil {
+		return err
+	}
+
+	err := os.Rename(path, filepath.Join(badDir, filepath.Base(path)))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// historyPathForKey is the directory with the versions kept for the public key
+func (store *DirJWTStore) historyPathForKey(publicKey string) string {
+	if len(publicKey) < 2 || strings.ContainsAny(publicKey, `./\`) {
+		return ""
+	}
+	return filepath.Join(store.directory, historyDir, publicKey)
+}
+
+// versionFiles returns the names of the version files in dir, oldest first
+func versionFiles(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, info := range infos {
+		if !info.IsDir() && filepath.Ext(info.Name()) == "."+extension && strings.Contains(info.Name(), "-") {
+			names = append(names, info.Name())
+		}
+	}
+	return names, nil
+}
+
+// versionID is the JWT ID in a version file name
+func versionID(name string) string {
+	name = strings.TrimSuffix(name, "."+extension)
+	return name[strings.Index(name, "-")+1:]
+}
+
+// SaveVersion keeps a copy of theJWT in the .history directory, encrypted like the store's JWTs.
+// The file names start with the time they were saved, so they sort oldest first.
+func (store *DirJWTStore) SaveVersion(publicKey string, id string, theJWT string, keep int) error {
+	store.Lock()
+	defer store.Unlock()
+
+	if store.readonly {
+		return fmt.Errorf("store is read-only")
+	}
+
+	dir := store.historyPathForKey(publicKey)
+	if dir == "" {
+		return fmt.Errorf("invalid public key")
+	}
+
+	if !ValidVersionID(id) {
+		return fmt.Errorf("invalid version id %q", id)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	names, err := versionFiles(dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if versionID(name) == id {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	data := []byte(theJWT)
+	if store.aead != nil {
+		data, err = sealJWT(store.aead, publicKey, theJWT)
+		if err != nil {
+			return err
+		}
+	}
+
+	name := fmt.Sprintf("%020d-%s.%s", time.Now().UnixNano(), id, extension)
+	if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+		return err
+	}
+
+	names, err = versionFiles(dir)
+	if err != nil {
+		return err
+	}
+	for keep >= 0 && len(names) > keep {
+		if err := os.Remove(filepath.Join(dir, names[0])); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// Versions returns the copies in the .history directory for the public key, oldest first
+func (store *DirJWTStore) Versions(publicKey string) ([]JWTVersion, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	dir := store.historyPathForKey(publicKey)
+	if dir == "" {
+		return nil, fmt.Errorf("invalid public key")
+	}
+
+	names, err := versionFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]JWTVersion, 0, len(names))
+	for _, name := range names {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		theJWT, err := openJWT(store.aead, publicKey, data)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, JWTVersion{ID: versionID(name), JWT: theJWT})
+	}
+	return versions, nil
+}
+
+// SetEncryptionKey turns on encryption, JWTs are saved with AES-256-GCM from now on and
+// files that were saved in plaintext are still loaded
+func (store *DirJWTStore) SetEncryptionKey(key []byte) error {
+	aead, err := newJWTCipher(key)
+	if err != nil {
+		return err
+	}
+
+	store.Lock()
+	defer store.Unlock()
+	store.aead = aead
+	return nil
+}
+
+// SetShardDepth spreads the files over depth levels of directories, each named for one of
+// the last characters of the public key. The last characters are used because keys of the
+// same type share their first ones. Files at the top of the directory are still loaded, so
+// a flat store keeps working until MigrateDirShards moves them.
+func (store *DirJWTStore) SetShardDepth(depth int) error {
+	if depth < 0 || depth > MaxShardDepth {
+		return fmt.Errorf("shard depth must be between 0 and %d", MaxShardDepth)
+	}
+
+	if depth > 0 && store.shard {
+		return fmt.Errorf("shard depth can't be combined with shard")
+	}
+
+	store.Lock()
+	store.depth = depth
+	watching := store.watcher != nil
+	store.Unlock()
+
+	// the watcher has to add the new directories
+	if watching {
+		store.stopWatching()
+		return store.startWatching()
+	}
+	return nil
+}
+
+// SetNamespaces keeps JWTs in a subdirectory for each namespace, router picks the one each JWT
+// is saved in. JWTs at the top of the store are still loaded, and a JWT saved in a namespace
+// replaces its copy at the top, so a store without namespaces moves into them as it is updated.
+// Keys are looked up in every namespace, they are expected to be unique across them.
+func (store *DirJWTStore) SetNamespaces(names []string, router NamespaceRouter) error {
+	sorted := append([]string{}, names...)
+	sort.Strings(sorted)
+	for i, name := range sorted {
+		if !ValidNamespace(name) {
+			return fmt.Errorf("invalid namespace %q, names need at least 3 letters, digits, '-' or '_'", name)
+		}
+		if i > 0 && sorted[i-1] == name {
+			return fmt.Errorf("namespace %q is listed twice", name)
+		}
+	}
+
+	store.Lock()
+	store.namespaces = sorted
+	store.router = router
+	watching := store.watcher != nil
+	store.Unlock()
+
+	// the watcher has to add the namespace directories
+	if watching {
+		store.stopWatching()
+		return store.startWatching()
+	}
+	return nil
+}
+
+// Namespace returns the namespace the JWT for the public key is stored in, an empty string if
+// it is at the top of the store or isn't stored
+func (store *DirJWTStore) Namespace(publicKey string) string {
+	store.Lock()
+	defer store.Unlock()
+	return store.namespaceOf(publicKey)
+}
+
+// namespaceOf returns the namespace holding the public key, lock should be held
+func (store *DirJWTStore) namespaceOf(publicKey string) string {
+	for _, name := range store.namespaces {
+		path := store.pathIn(filepath.Join(store.directory, name), publicKey)
+		if path == "" {
+			return ""
+		}
+		if _, err := os.Stat(path); err == nil {
+			return name
+		}
+	}
+	return ""
+}
+
+// hasNamespace is true if name is one of the store's namespaces
+func (store *DirJWTStore) hasNamespace(name string) bool {
+	i := sort.SearchStrings(store.namespaces, name)
+	return i < len(store.namespaces) && store.namespaces[i] == name
 }
 
 // IsReadOnly returns a flag determined at creation time
@@ -269,27 +715,131 @@ func (store *DirJWTStore) IsReadOnly() bool {
 	return store.readonly
 }
 
+// levels is the number of directories between the top of the store and a JWT file
+func (store *DirJWTStore) levels() int {
+	if store.depth > 0 {
+		return store.depth
+	}
+	if store.shard {
+		return 1
+	}
+	return 0
+}
+
+// isShardDir returns true for directories below the top of the store that can hold JWTs,
+// or other shards
+// or other shards. Namespace directories, and the shards in them, count too.
+func (store *DirJWTStore) isShardDir(path string) bool {
+	rel, err := filepath.Rel(store.directory, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, ".") {
+		return false
+	}
+	parts := strings.Split(rel, string(filepath.Separator))
+	if store.hasNamespace(parts[0]) {
+		parts = parts[1:]
+	}
+	return len(parts) <= store.levels()
+}
+
+// candidatePaths are the files that can hold the JWT for the public key, in the order Load
+// looks for them: each namespace, the shard at the top of the store, then the flat path for
+// files that haven't been moved to their shard
+func (store *DirJWTStore) candidatePaths(publicKey string) []string {
+	path := store.pathForKey(publicKey)
+	if path == "" {
+		return nil
+	}
+
+	paths := []string{}
+	for _, name := range store.namespaces {
+		paths = append(paths, store.pathIn(filepath.Join(store.directory, name), publicKey))
+	}
+	paths = append(paths, path)
+	if store.depth > 0 {
+		paths = append(paths, store.flatPathForKey(publicKey))
+	}
+	return paths
+}
+
+// existingPathForKey is the file Load reads for the public key, the first of the candidate
+// paths that exists, or the last one if none do
+func (store *DirJWTStore) existingPathForKey(publicKey string) string {
+	paths := store.candidatePaths(publicKey)
+	if len(paths) == 0 {
+		return ""
+	}
+	for _, path := range paths[:len(paths)-1] {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return paths[len(paths)-1]
+}
+
+// savePathForKey is the file Save writes the JWT to, in the namespace the router picks, the
+// one the key is in already, or at the top of the store
+func (store *DirJWTStore) savePathForKey(publicKey string, theJWT string) string {
+	namespace := ""
+	if store.router != nil {
+		namespace = store.router(publicKey, theJWT)
+	}
+	if namespace == "" || !store.hasNamespace(namespace) {
+		namespace = store.namespaceOf(publicKey)
+	}
+	if namespace == "" {
+		return store.pathForKey(publicKey)
+	}
+	return store.pathIn(filepath.Join(store.directory, namespace), publicKey)
+}
+
+func (store *DirJWTStore) flatPathForKey(publicKey string) string {
+	return filepath.Join(store.directory, fmt.Sprintf("%s.%s", publicKey, extension))
+}
+
 func (store *DirJWTStore) pathForKey(publicKey string) string {
-	if len(publicKey) < 2 {
+	return store.pathIn(store.directory, publicKey)
+}
+
+// pathIn is the path for the public key in a directory laid out like the top of the store
+func (store *DirJWTStore) pathIn(base string, publicKey string) string {
+	if len(publicKey) < 2 || len(publicKey) <= store.depth {
 		return ""
 	}
 
 	var dirPath string
 
-	if store.shard {
+	if store.depth > 0 {
+		parts := []string{base}
+		for _, c := range publicKey[len(publicKey)-store.depth:] {
+			parts = append(parts, string(c))
+		}
+		parts = append(parts, fmt.Sprintf("%s.%s", publicKey, extension))
+		dirPath = filepath.Join(parts...)
+	} else if store.shard {
 		last := publicKey[len(publicKey)-2:]
 		fileName := fmt.Sprintf("%s.%s", publicKey, extension)
-		dirPath = filepath.Join(store.directory, last, fileName)
+		dirPath = filepath.Join(base, last, fileName)
 	} else {
 		fileName := fmt.Sprintf("%s.%s", publicKey, extension)
-		dirPath = filepath.Join(store.directory, fileName)
+		dirPath = filepath.Join(base, fileName)
 	}
 
 	return dirPath
 }
 
-// Close is a no-op for a directory store
+// Close stops the file watcher, if there is one
 func (store *DirJWTStore) Close() {
+	store.stopWatching()
+}
+
+func (store *DirJWTStore) stopWatching() {
+	store.pendingLock.Lock()
+	for _, timer := range store.pending {
+		timer.Stop()
+	}
+	store.pending = nil
+	store.pendingLock.Unlock()
+
 	store.Lock()
 	defer store.Unlock()
 
@@ -17,9 +17,11 @@
 package store
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -347,3 +349,333 @@ func TestUnShardedDirStoreNotifications(t *testing.T) {
 	store.Close()
 	readOnlyStore.Close()
 }
+
+func TestDirStoreDelete(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "jwtstore_test")
+	require.NoError(t, err)
+
+	for _, shard := range []bool{true, false} {
+		store, err := NewDirJWTStore(dir, shard, false, nil, nil)
+		require.NoError(t, err)
+
+		err = store.Save("one", "alpha")
+		require.NoError(t, err)
+
+		err = store.Delete("one")
+		require.NoError(t, err)
+
+		_, err = store.Load("one")
+		require.Equal(t, ErrNotFound, err)
+
+		err = store.Delete("one")
+		require.Equal(t, ErrNotFound, err)
+
+		err = store.Delete("")
+		require.Error(t, err)
+		store.Close()
+	}
+
+	store, err := NewImmutableDirJWTStore(dir, false, nil, nil)
+	require.NoError(t, err)
+	err = store.Delete("one")
+	require.Error(t, err)
+	store.Close()
+}
+
+func TestDirStoreIterate(t *testing.T) {
+	for _, shard := range []bool{true, false} {
+		dir, err := ioutil.TempDir(os.TempDir(), "jwtstore_test")
+		require.NoError(t, err)
+
+		store, err := NewDirJWTStore(dir, shard, false, nil, nil)
+		require.NoError(t, err)
+
+		require.NoError(t, store.Save("two", "beta"))
+		require.NoError(t, store.Save("one", "alpha"))
+		require.NoError(t, store.Save("three", "gamma"))
+
+		// other files are ignored
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("hello"), 0644))
+
+		keys := []string{}
+		err = store.Iterate(func(publicKey string, theJWT string) error {
+			keys = append(keys, publicKey+"="+theJWT)
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{"one=alpha", "three=gamma", "two=beta"}, keys)
+		store.Close()
+	}
+}
+
+func TestDirStoreQuarantine(t *testing.T) {
+	for _, depth := range []int{0, 2} {
+		dir, err := ioutil.TempDir(os.TempDir(), "jwtstore_test")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		jwtStore, err := NewDirJWTStore(dir, false, false, nil, nil)
+		require.NoError(t, err)
+		dirStore := jwtStore.(*DirJWTStore)
+		require.NoError(t, dirStore.SetShardDepth(depth))
+
+		require.NoError(t, jwtStore.Save("one", "alpha"))
+		require.NoError(t, jwtStore.Save("two", "beta"))
+
+		keys, err := dirStore.Keys()
+		require.NoError(t, err)
+		require.Equal(t, []string{"one", "two"}, keys)
+
+		require.NoError(t, dirStore.Quarantine("one"))
+		require.Equal(t, ErrNotFound, dirStore.Quarantine("one"))
+
+		_, err = jwtStore.Load("one")
+		require.Equal(t, ErrNotFound, err)
+		data, err := ioutil.ReadFile(filepath.Join(dir, quarantineDir, "one.jwt"))
+		require.NoError(t, err)
+		require.Equal(t, "alpha", string(data))
+
+		// the quarantined file isn't listed
+		keys, err = dirStore.Keys()
+		require.NoError(t, err)
+		require.Equal(t, []string{"two"}, keys)
+		jwtStore.Close()
+	}
+}
+
+func TestShardDepthDirStore(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "jwtstore_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	jwtStore, err := NewDirJWTStore(dir, false, false, nil, nil)
+	require.NoError(t, err)
+	defer jwtStore.Close()
+
+	// written while the store was flat
+	require.NoError(t, jwtStore.Save("flatkz", "eyflat"))
+	require.NoError(t, jwtStore.Save("onlyflat", "eyonly"))
+
+	dirStore := jwtStore.(*DirJWTStore)
+	require.Error(t, dirStore.SetShardDepth(-1))
+	require.Error(t, dirStore.SetShardDepth(MaxShardDepth+1))
+	require.NoError(t, dirStore.SetShardDepth(2))
+
+	require.NoError(t, jwtStore.Save("abcdxy", "eyabcd"))
+	_, err = os.Stat(filepath.Join(dir, "x", "y", "abcdxy.jwt"))
+	require.NoError(t, err)
+
+	got, err := jwtStore.Load("abcdxy")
+	require.NoError(t, err)
+	require.Equal(t, "eyabcd", got)
+
+	// flat files are still found
+	got, err = jwtStore.Load("flatkz")
+	require.NoError(t, err)
+	require.Equal(t, "eyflat", got)
+
+	// saving moves a key into its shard
+	require.NoError(t, jwtStore.Save("flatkz", "eyflat2"))
+	_, err = os.Stat(filepath.Join(dir, "flatkz.jwt"))
+	require.True(t, os.IsNotExist(err))
+	got, err = jwtStore.Load("flatkz")
+	require.NoError(t, err)
+	require.Equal(t, "eyflat2", got)
+
+	keys := []string{}
+	require.NoError(t, jwtStore.Iterate(func(publicKey string, theJWT string) error {
+		keys = append(keys, publicKey)
+		return nil
+	}))
+	require.Equal(t, []string{"abcdxy", "flatkz", "onlyflat"}, keys)
+
+	require.NoError(t, jwtStore.Delete("onlyflat"))
+	require.Equal(t, ErrNotFound, jwtStore.Delete("onlyflat"))
+	require.NoError(t, jwtStore.Delete("abcdxy"))
+	_, err = jwtStore.Load("abcdxy")
+	require.Equal(t, ErrNotFound, err)
+
+	// keys have to be longer than the depth
+	require.NoError(t, dirStore.SetShardDepth(3))
+	_, err = jwtStore.Load("ab")
+	require.Error(t, err)
+
+	sharded, err := NewDirJWTStore(dir, true, false, nil, nil)
+	require.NoError(t, err)
+	defer sharded.Close()
+	require.Error(t, sharded.(*DirJWTStore).SetShardDepth(2))
+}
+
+func TestDirStoreWatchDebounce(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "jwtstore_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	changes := make(chan string, 100)
+	store, err := NewImmutableDirJWTStore(dir, false, func(pubKey string) {
+		changes <- pubKey
+	}, func(err error) {})
+	require.NoError(t, err)
+	defer store.Close()
+
+	expectChange := func(expected string) {
+		select {
+		case pubKey := <-changes:
+			require.Equal(t, expected, pubKey)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no change reported for %s", expected)
+		}
+	}
+
+	expectQuiet := func() {
+		select {
+		case pubKey := <-changes:
+			t.Fatalf("unexpected change for %s", pubKey)
+		case <-time.After(3 * watchDebounce):
+		}
+	}
+
+	// several writes in a row are reported once
+	path := filepath.Join(dir, "one.jwt")
+	for i := 0; i < 3; i++ {
+		require.NoError(t, ioutil.WriteFile(path, []byte(fmt.Sprintf("ey%d", i)), 0644))
+	}
+	expectChange("one")
+	expectQuiet()
+
+	got, err := store.Load("one")
+	require.NoError(t, err)
+	require.Equal(t, "ey2", got)
+
+	// files moved into place
+	tmp := filepath.Join(dir, "two.tmp")
+	require.NoError(t, ioutil.WriteFile(tmp, []byte("eytwo"), 0644))
+	require.NoError(t, os.Rename(tmp, filepath.Join(dir, "two.jwt")))
+	expectChange("two")
+	expectQuiet()
+
+	// and removed files
+	require.NoError(t, os.Remove(path))
+	expectChange("one")
+	expectQuiet()
+}
+
+func TestDirStoreHistory(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "jwtstore_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	jwtStore, err := NewDirJWTStore(dir, true, false, nil, nil)
+	require.NoError(t, err)
+	defer jwtStore.Close()
+	dirStore := jwtStore.(*DirJWTStore)
+	require.NoError(t, dirStore.SetEncryptionKey(testEncryptionKey(1)))
+
+	require.NoError(t, jwtStore.Save("one", "current"))
+	require.NoError(t, dirStore.SaveVersion("one", "A", "alpha", 2))
+	require.NoError(t, dirStore.SaveVersion("one", "B", "beta", 2))
+	require.NoError(t, dirStore.SaveVersion("one", "A", "alpha", 2))
+	require.NoError(t, dirStore.SaveVersion("one", "C", "gamma", 2))
+	require.Error(t, dirStore.SaveVersion("one", "../D", "delta", 2))
+	require.Error(t, dirStore.SaveVersion("../one", "D", "delta", 2))
+
+	versions, err := dirStore.Versions("one")
+	require.NoError(t, err)
+	require.Equal(t, []JWTVersion{{ID: "A", JWT: "alpha"}, {ID: "C", JWT: "gamma"}}, versions)
+
+	versions, err = dirStore.Versions("two")
+	require.NoError(t, err)
+	require.Empty(t, versions)
+
+	// versions are encrypted like the store's JWTs, and aren't listed as keys
+	files, err := ioutil.ReadDir(filepath.Join(dir, historyDir, "one"))
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+	data, err := ioutil.ReadFile(filepath.Join(dir, historyDir, "one", files[0].Name()))
+	require.NoError(t, err)
+	require.NotContains(t, string(data), "alpha")
+
+	keys, err := dirStore.Keys()
+	require.NoError(t, err)
+	require.Equal(t, []string{"one"}, keys)
+}
+
+func TestDirStoreNamespaces(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "jwtstore_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	jwtStore, err := NewDirJWTStore(dir, false, false, nil, nil)
+	require.NoError(t, err)
+	defer jwtStore.Close()
+
+	// written before there were namespaces
+	require.NoError(t, jwtStore.Save("flatkz", "eyacme"))
+	require.NoError(t, jwtStore.Save("onlyflat", "eyold"))
+
+	dirStore := jwtStore.(*DirJWTStore)
+	require.Error(t, dirStore.SetNamespaces([]string{"ab"}, nil))
+	require.Error(t, dirStore.SetNamespaces([]string{"acme", "acme"}, nil))
+	require.Error(t, dirStore.SetNamespaces([]string{"../up"}, nil))
+
+	// the JWT names its namespace, anything else is left where it is
+	route := func(publicKey string, theJWT string) string {
+		switch {
+		case strings.HasPrefix(theJWT, "eyacme"):
+			return "acme"
+		case strings.HasPrefix(theJWT, "eyglobex"):
+			return "globex"
+		}
+		return ""
+	}
+	require.NoError(t, dirStore.SetNamespaces([]string{"globex", "acme"}, route))
+
+	require.NoError(t, jwtStore.Save("globexkey", "eyglobex"))
+	_, err = os.Stat(filepath.Join(dir, "globex", "globexkey.jwt"))
+	require.NoError(t, err)
+	require.Equal(t, "globex", dirStore.Namespace("globexkey"))
+
+	// flat files are still found, saving moves them into their namespace
+	got, err := jwtStore.Load("flatkz")
+	require.NoError(t, err)
+	require.Equal(t, "eyacme", got)
+	require.Equal(t, "", dirStore.Namespace("flatkz"))
+
+	require.NoError(t, jwtStore.Save("flatkz", "eyacme2"))
+	_, err = os.Stat(filepath.Join(dir, "flatkz.jwt"))
+	require.True(t, os.IsNotExist(err))
+	got, err = jwtStore.Load("flatkz")
+	require.NoError(t, err)
+	require.Equal(t, "eyacme2", got)
+	require.Equal(t, "acme", dirStore.Namespace("flatkz"))
+
+	// a JWT the router doesn't place, like a tombstone, stays in its namespace
+	require.NoError(t, jwtStore.Save("flatkz", "tombstone"))
+	require.Equal(t, "acme", dirStore.Namespace("flatkz"))
+	require.NoError(t, jwtStore.Save("newkey", "unrouted"))
+	_, err = os.Stat(filepath.Join(dir, "newkey.jwt"))
+	require.NoError(t, err)
+
+	require.Equal(t, map[string]string{"flatkz": "tombstone", "globexkey": "eyglobex", "newkey": "unrouted", "onlyflat": "eyold"}, dirKeys(t, jwtStore))
+
+	require.NoError(t, jwtStore.Delete("globexkey"))
+	require.Equal(t, ErrNotFound, jwtStore.Delete("globexkey"))
+	_, err = jwtStore.Load("globexkey")
+	require.Equal(t, ErrNotFound, err)
+
+	// namespaces keep their own shards
+	require.NoError(t, dirStore.SetShardDepth(1))
+	require.NoError(t, jwtStore.Save("shardedz", "eyacme"))
+	_, err = os.Stat(filepath.Join(dir, "acme", "z", "shardedz.jwt"))
+	require.NoError(t, err)
+	got, err = jwtStore.Load("shardedz")
+	require.NoError(t, err)
+	require.Equal(t, "eyacme", got)
+
+	// migrating shards keeps files in their namespace
+	jwtStore.Close()
+	_, err = MigrateDirShards(dir, false, 0)
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dir, "acme", "shardedz.jwt"))
+	require.NoError(t, err)
+}
@@ -0,0 +1,177 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package store
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+)
+
+// EncryptionKeySize is the size of the AES-256 key used to encrypt directory stores
+const EncryptionKeySize = 32
+
+// sealed files start with this, JWTs never do, so plaintext files are still readable
+var encryptedPrefix = []byte("NAS-AES256-GCM\n")
+
+// LoadEncryptionKey reads the key from the file, or the environment variable, in the config.
+// The key can be hex or base64 encoded, and files can also hold the 32 raw bytes.
+// A nil key is returned if encryption isn't configured.
+func LoadEncryptionKey(config conf.EncryptionConfig) ([]byte, error) {
+	if config.KeyFile != "" && config.KeyEnv != "" {
+		return nil, fmt.Errorf("encryption key file and environment variable are mutually exclusive")
+	}
+
+	var data []byte
+
+	switch {
+	case config.KeyFile != "":
+		fileData, err := ioutil.ReadFile(config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read encryption key, %s", err.Error())
+		}
+		if len(fileData) == EncryptionKeySize {
+			return fileData, nil
+		}
+		data = fileData
+	case config.KeyEnv != "":
+		value, ok := os.LookupEnv(config.KeyEnv)
+		if !ok || value == "" {
+			return nil, fmt.Errorf("encryption key environment variable %s is not set", config.KeyEnv)
+		}
+		data = []byte(value)
+	default:
+		return nil, nil
+	}
+
+	return decodeEncryptionKey(strings.TrimSpace(string(data)))
+}
+
+func decodeEncryptionKey(encoded string) ([]byte, error) {
+	if key, err := hex.DecodeString(encoded); err == nil && len(key) == EncryptionKeySize {
+		return key, nil
+	}
+
+	if key, err := base64.StdEncoding.DecodeString(encoded); err == nil && len(key) == EncryptionKeySize {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("encryption key must be %d bytes, hex or base64 encoded", EncryptionKeySize)
+}
+
+func newJWTCipher(key []byte) (cipher.AEAD, error) {
+	if len(key) != EncryptionKeySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes", EncryptionKeySize)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// sealJWT encrypts the JWT with a random nonce, the public key is authenticated with it so
+// a file can't be swapped for another account's
+func sealJWT(aead cipher.AEAD, publicKey string, theJWT string) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	sealed := append([]byte{}, encryptedPrefix...)
+	sealed = append(sealed, nonce...)
+	return aead.Seal(sealed, nonce, []byte(theJWT), []byte(publicKey)), nil
+}
+
+// openJWT decrypts a sealed file, files without the prefix are returned as is
+func openJWT(aead cipher.AEAD, publicKey string, data []byte) (string, error) {
+	if !bytes.HasPrefix(data, encryptedPrefix) {
+		return string(data), nil
+	}
+
+	if aead == nil {
+		return "", fmt.Errorf("JWT for %s is encrypted and no key is configured", publicKey)
+	}
+
+	data = data[len(encryptedPrefix):]
+	if len(data) < aead.NonceSize() {
+		return "", fmt.Errorf("encrypted JWT for %s is truncated", publicKey)
+	}
+
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(publicKey))
+	if err != nil {
+		return "", fmt.Errorf("unable to decrypt JWT for %s, %s", publicKey, err.Error())
+	}
+	return string(plain), nil
+}
+
+// ReEncryptDir seals every JWT file in a directory store with the key, plaintext files are
+// encrypted and encrypted files get a new nonce. Files are replaced with a rename, so a
+// failure leaves each one either old or new. The server shouldn't be running on the directory.
+func ReEncryptDir(dirPath string, shard bool, depth int, key []byte) (int, error) {
+	jwtStore, err := NewDirJWTStore(dirPath, shard, false, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer jwtStore.Close()
+
+	dirStore := jwtStore.(*DirJWTStore)
+	if err := dirStore.SetShardDepth(depth); err != nil {
+		return 0, err
+	}
+	if err := dirStore.SetEncryptionKey(key); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	err = dirStore.Iterate(func(publicKey string, theJWT string) error {
+		path := dirStore.existingPathForKey(publicKey)
+		sealed, err := sealJWT(dirStore.aead, publicKey, theJWT)
+		if err != nil {
+			return err
+		}
+
+		tmp := path + ".tmp"
+		if err := ioutil.WriteFile(tmp, sealed, 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+
+		count++
+		return nil
+	})
+	if err != nil {
+		return count, fmt.Errorf("re-encrypted %d JWTs in %s before failing, %s", count, filepath.Clean(dirPath), err.Error())
+	}
+	return count, nil
+}
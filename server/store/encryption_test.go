@@ -0,0 +1,177 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package store
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func testEncryptionKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, EncryptionKeySize)
+}
+
+func TestLoadEncryptionKey(t *testing.T) {
+	key := testEncryptionKey(7)
+
+	dir, err := ioutil.TempDir(os.TempDir(), "encryption_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	hexFile := filepath.Join(dir, "hex")
+	require.NoError(t, ioutil.WriteFile(hexFile, []byte(hex.EncodeToString(key)+"\n"), 0600))
+	rawFile := filepath.Join(dir, "raw")
+	require.NoError(t, ioutil.WriteFile(rawFile, key, 0600))
+	shortFile := filepath.Join(dir, "short")
+	require.NoError(t, ioutil.WriteFile(shortFile, []byte("abcd"), 0600))
+
+	loaded, err := LoadEncryptionKey(conf.EncryptionConfig{KeyFile: hexFile})
+	require.NoError(t, err)
+	require.Equal(t, key, loaded)
+
+	loaded, err = LoadEncryptionKey(conf.EncryptionConfig{KeyFile: rawFile})
+	require.NoError(t, err)
+	require.Equal(t, key, loaded)
+
+	_, err = LoadEncryptionKey(conf.EncryptionConfig{KeyFile: shortFile})
+	require.Error(t, err)
+
+	_, err = LoadEncryptionKey(conf.EncryptionConfig{KeyFile: filepath.Join(dir, "missing")})
+	require.Error(t, err)
+
+	os.Setenv("NAS_TEST_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(key))
+	defer os.Unsetenv("NAS_TEST_ENCRYPTION_KEY")
+	loaded, err = LoadEncryptionKey(conf.EncryptionConfig{KeyEnv: "NAS_TEST_ENCRYPTION_KEY"})
+	require.NoError(t, err)
+	require.Equal(t, key, loaded)
+
+	_, err = LoadEncryptionKey(conf.EncryptionConfig{KeyEnv: "NAS_TEST_ENCRYPTION_KEY_NOT_SET"})
+	require.Error(t, err)
+
+	_, err = LoadEncryptionKey(conf.EncryptionConfig{KeyFile: hexFile, KeyEnv: "NAS_TEST_ENCRYPTION_KEY"})
+	require.Error(t, err)
+
+	loaded, err = LoadEncryptionKey(conf.EncryptionConfig{})
+	require.NoError(t, err)
+	require.Nil(t, loaded)
+}
+
+func TestEncryptedDirStore(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "jwtstore_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	jwtStore, err := NewDirJWTStore(dir, true, false, nil, nil)
+	require.NoError(t, err)
+	defer jwtStore.Close()
+
+	// written before encryption was turned on
+	require.NoError(t, jwtStore.Save("plain", "eyplaintext"))
+
+	dirStore := jwtStore.(*DirJWTStore)
+	require.Error(t, dirStore.SetEncryptionKey([]byte("short")))
+	require.NoError(t, dirStore.SetEncryptionKey(testEncryptionKey(1)))
+
+	require.NoError(t, jwtStore.Save("secret", "eysecret"))
+
+	data, err := ioutil.ReadFile(dirStore.pathForKey("secret"))
+	require.NoError(t, err)
+	require.True(t, bytes.HasPrefix(data, encryptedPrefix))
+	require.False(t, strings.Contains(string(data), "eysecret"))
+
+	got, err := jwtStore.Load("secret")
+	require.NoError(t, err)
+	require.Equal(t, "eysecret", got)
+
+	got, err = jwtStore.Load("plain")
+	require.NoError(t, err)
+	require.Equal(t, "eyplaintext", got)
+
+	// a sealed file copied to another account's name doesn't decrypt
+	require.NoError(t, os.MkdirAll(filepath.Dir(dirStore.pathForKey("other")), 0755))
+	require.NoError(t, ioutil.WriteFile(dirStore.pathForKey("other"), data, 0644))
+	_, err = jwtStore.Load("other")
+	require.Error(t, err)
+
+	// the wrong key
+	require.NoError(t, dirStore.SetEncryptionKey(testEncryptionKey(2)))
+	_, err = jwtStore.Load("secret")
+	require.Error(t, err)
+
+	// no key
+	plainStore, err := NewDirJWTStore(dir, true, false, nil, nil)
+	require.NoError(t, err)
+	defer plainStore.Close()
+	_, err = plainStore.Load("secret")
+	require.Error(t, err)
+}
+
+func TestReEncryptDir(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "jwtstore_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	jwtStore, err := NewDirJWTStore(dir, false, false, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, jwtStore.Save("one", "eyone"))
+	require.NoError(t, jwtStore.Save("two", "eytwo"))
+	jwtStore.Close()
+
+	key := testEncryptionKey(3)
+	count, err := ReEncryptDir(dir, false, 0, key)
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+
+	// running it again gives the encrypted files new nonces
+	before, err := ioutil.ReadFile(filepath.Join(dir, "one.jwt"))
+	require.NoError(t, err)
+	require.True(t, bytes.HasPrefix(before, encryptedPrefix))
+
+	count, err = ReEncryptDir(dir, false, 0, key)
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+
+	after, err := ioutil.ReadFile(filepath.Join(dir, "one.jwt"))
+	require.NoError(t, err)
+	require.NotEqual(t, before, after)
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+
+	jwtStore, err = NewDirJWTStore(dir, false, false, nil, nil)
+	require.NoError(t, err)
+	defer jwtStore.Close()
+	require.NoError(t, jwtStore.(*DirJWTStore).SetEncryptionKey(key))
+
+	got, err := jwtStore.Load("two")
+	require.NoError(t, err)
+	require.Equal(t, "eytwo", got)
+
+	// files sealed with another key can't be re-encrypted
+	_, err = ReEncryptDir(dir, false, 0, testEncryptionKey(4))
+	require.Error(t, err)
+}
@@ -22,9 +22,11 @@ import (
 
 // ErrJWTStore returns errors when possible
 type ErrJWTStore struct {
-	Loads  int
-	Saves  int
-	Closes int
+	Loads    int
+	Saves    int
+	Deletes  int
+	Iterates int
+	Closes   int
 }
 
 // NewErrJWTStore returns an empty, mutable in-memory JWT store
@@ -44,6 +46,18 @@ func (store *ErrJWTStore) Save(publicKey string, theJWT string) error {
 	return fmt.Errorf("always error")
 }
 
+// Delete always returns an error
+func (store *ErrJWTStore) Delete(publicKey string) error {
+	store.Deletes++
+	return fmt.Errorf("always error")
+}
+
+// Iterate always returns an error
+func (store *ErrJWTStore) Iterate(cb JWTIterator) error {
+	store.Iterates++
+	return fmt.Errorf("always error")
+}
+
 // IsReadOnly returns a flag determined at creation time
 func (store *ErrJWTStore) IsReadOnly() bool {
 	return false
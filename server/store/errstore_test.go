@@ -34,9 +34,19 @@ func TestErrStoreSimpleSetGet(t *testing.T) {
 	err = store.Save("one", "alpha")
 	require.Error(t, err)
 
+	err = store.Delete("one")
+	require.Error(t, err)
+
+	err = store.Iterate(func(publicKey string, theJWT string) error {
+		return nil
+	})
+	require.Error(t, err)
+
 	store.Close()
 
 	require.Equal(t, 1, errStore.Loads)
 	require.Equal(t, 1, errStore.Saves)
+	require.Equal(t, 1, errStore.Deletes)
+	require.Equal(t, 1, errStore.Iterates)
 	require.Equal(t, 1, errStore.Closes)
 }
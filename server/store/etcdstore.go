@@ -0,0 +1,650 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+)
+
+const (
+	defaultEtcdPrefix = "/nats-account-server/jwt/"
+	etcdTimeout       = 5 * time.Second
+
+	etcdRewatchWait    = time.Second
+	etcdMaxRewatchWait = 30 * time.Second
+)
+
+// etcdPageSize is the number of JWTs Iterate reads with each range request
+var etcdPageSize = 100
+
+// the v3 JSON gateway sends bytes as base64, which encoding/json does for []byte,
+// and 64 bit integers as strings
+
+type etcdHeader struct {
+	Revision int64 `json:"revision,string,omitempty"`
+}
+
+type etcdKV struct {
+	Key         []byte `json:"key"`
+	Value       []byte `json:"value,omitempty"`
+	ModRevision int64  `json:"mod_revision,string,omitempty"`
+}
+
+type etcdRangeRequest struct {
+	Key       []byte `json:"key"`
+	RangeEnd  []byte `json:"range_end,omitempty"`
+	Limit     int    `json:"limit,omitempty"`
+	Revision  int64  `json:"revision,omitempty"`
+	CountOnly bool   `json:"count_only,omitempty"`
+}
+
+type etcdRangeResponse struct {
+	Header etcdHeader `json:"header"`
+	KVs    []etcdKV   `json:"kvs"`
+	More   bool       `json:"more"`
+	Count  int64      `json:"count,string,omitempty"`
+}
+
+type etcdPutRequest struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type etcdDeleteRequest struct {
+	Key []byte `json:"key"`
+}
+
+type etcdWriteResponse struct {
+	Header  etcdHeader `json:"header"`
+	Deleted int64      `json:"deleted,string,omitempty"`
+}
+
+type etcdWatchCreate struct {
+	Key           []byte `json:"key"`
+	RangeEnd      []byte `json:"range_end,omitempty"`
+	StartRevision int64  `json:"start_revision,omitempty"`
+}
+
+type etcdWatchRequest struct {
+	CreateRequest etcdWatchCreate `json:"create_request"`
+}
+
+type etcdEvent struct {
+	Type string `json:"type,omitempty"` // PUT is the default, and left out
+	KV   etcdKV `json:"kv"`
+}
+
+type etcdWatchResult struct {
+	Header          etcdHeader  `json:"header"`
+	Created         bool        `json:"created,omitempty"`
+	Canceled        bool        `json:"canceled,omitempty"`
+	CancelReason    string      `json:"cancel_reason,omitempty"`
+	CompactRevision int64       `json:"compact_revision,string,omitempty"`
+	Events          []etcdEvent `json:"events,omitempty"`
+}
+
+type etcdWatchMessage struct {
+	Result *etcdWatchResult `json:"result,omitempty"`
+	Error  *etcdError       `json:"error,omitempty"`
+}
+
+// etcdError is the body of a failed gateway request
+type etcdError struct {
+	Message string `json:"message"`
+	Code    int    `json:"code"`
+}
+
+func (e *etcdError) Error() string {
+	return "etcd: " + e.Message
+}
+
+// etcdClient calls the v3 JSON gateway, trying each endpoint in order until one answers
+type etcdClient struct {
+	endpoints []string
+	http      *http.Client
+	stream    *http.Client // no timeout, for watches
+	username  string
+	password  string
+
+	tokenLock sync.Mutex
+	token     string
+}
+
+func (c *etcdClient) post(ctx context.Context, client *http.Client, endpoint string, path string, body []byte, token string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(endpoint, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	return client.Do(req)
+}
+
+// authToken returns the token for requests, authenticating if there isn't one or refresh is set
+func (c *etcdClient) authToken(endpoint string, refresh bool) (string, error) {
+	if c.username == "" {
+		return "", nil
+	}
+
+	c.tokenLock.Lock()
+	defer c.tokenLock.Unlock()
+
+	if c.token != "" && !refresh {
+		return c.token, nil
+	}
+
+	body, err := json.Marshal(map[string]string{"name": c.username, "password": c.password})
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := c.post(context.Background(), c.http, endpoint, "/v3/auth/authenticate", body, "")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", etcdErrorFrom(resp)
+	}
+
+	var auth struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&auth); err != nil {
+		return "", err
+	}
+	c.token = auth.Token
+	return c.token, nil
+}
+
+// open sends a request to one endpoint, getting a new token once if the one it has is rejected
+func (c *etcdClient) open(ctx context.Context, client *http.Client, endpoint string, path string, body []byte) (*http.Response, error) {
+	token, err := c.authToken(endpoint, false)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.post(ctx, client, endpoint, path, body, token)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized && c.username != "" {
+		resp.Body.Close()
+		if token, err = c.authToken(endpoint, true); err != nil {
+			return nil, err
+		}
+		if resp, err = c.post(ctx, client, endpoint, path, body, token); err != nil {
+			return nil, err
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, etcdErrorFrom(resp)
+	}
+	return resp, nil
+}
+
+// call sends a request and decodes the response, an error from etcd itself isn't retried
+// on the other endpoints
+func (c *etcdClient) call(path string, request interface{}, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for _, endpoint := range c.endpoints {
+		resp, err := c.open(context.Background(), c.http, endpoint, path, body)
+		if err != nil {
+			if _, ok := err.(*etcdError); ok {
+				return err
+			}
+			lastErr = err
+			continue
+		}
+		defer resp.Body.Close()
+		return json.NewDecoder(resp.Body).Decode(response)
+	}
+	return fmt.Errorf("unable to reach etcd, %s", lastErr.Error())
+}
+
+// watch starts a watch on the first endpoint that answers, the body streams the results
+func (c *etcdClient) watch(ctx context.Context, create etcdWatchCreate) (io.ReadCloser, error) {
+	body, err := json.Marshal(etcdWatchRequest{CreateRequest: create})
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, endpoint := range c.endpoints {
+		resp, err := c.open(ctx, c.stream, endpoint, "/v3/watch", body)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return resp.Body, nil
+	}
+	return nil, lastErr
+}
+
+func etcdErrorFrom(resp *http.Response) error {
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	e := &etcdError{}
+	if err := json.Unmarshal(data, e); err != nil || e.Message == "" {
+		e.Message = fmt.Sprintf("status %d", resp.StatusCode)
+	}
+	return e
+}
+
+// prefixEnd is the key after every key that starts with prefix, for range requests
+func prefixEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return []byte{0} // every key
+}
+
+// EtcdJWTStore implements the JWT Store interface, keeping each JWT in an etcd key. The prefix
+// is watched, so JWTs saved or deleted by other servers sharing the cluster are passed to
+// changed. The JWTs read and written are cached, and the cached copy is returned by Load if
+// etcd can't be reached, so lookups keep working while saves fail.
+type EtcdJWTStore struct {
+	client   *etcdClient
+	prefix   string
+	readonly bool
+
+	changed JWTChanged
+	errored JWTError
+
+	// writes hold writeLock until their revision is in own, and the watch takes it before
+	// checking an event, so an event for a write can't be seen before the write is recorded
+	writeLock sync.Mutex
+	cacheLock sync.Mutex
+	cache     map[string]string
+	own       map[int64]bool // revisions of this store's writes, skipped by the watch
+	revision  int64          // the latest revision the watch has seen
+
+	cancelWatch context.CancelFunc
+	done        chan struct{}
+}
+
+// NewEtcdJWTStore connects to the etcd cluster in the config. If changed is set the prefix is
+// watched, and errored is called with problems reading the watch.
+func NewEtcdJWTStore(config conf.EtcdConfig, readonly bool, changed JWTChanged, errored JWTError) (JWTStore, error) {
+	if len(config.Endpoints) == 0 {
+		return nil, fmt.Errorf("etcd store requires at least one endpoint")
+	}
+
+	secure := false
+	for _, endpoint := range config.Endpoints {
+		u, err := url.Parse(endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("etcd endpoint %q must be an http or https URL", endpoint)
+		}
+		secure = secure || u.Scheme == "https"
+	}
+
+	tlsConfig, err := etcdTLSConfig(config, secure)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := config.Prefix
+	if prefix == "" {
+		prefix = defaultEtcdPrefix
+	}
+
+	store := &EtcdJWTStore{
+		client: &etcdClient{
+			endpoints: config.Endpoints,
+			http:      &http.Client{Timeout: etcdTimeout, Transport: &http.Transport{TLSClientConfig: tlsConfig}},
+			stream:    &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}},
+			username:  config.Username,
+			password:  config.Password,
+		},
+		prefix:   prefix,
+		readonly: readonly,
+		changed:  changed,
+		errored:  errored,
+		cache:    map[string]string{},
+		own:      map[int64]bool{},
+	}
+
+	// checks the cluster can be reached, and where the watch starts
+	var resp etcdRangeResponse
+	if err := store.client.call("/v3/kv/range", etcdRangeRequest{Key: []byte(prefix), RangeEnd: prefixEnd(prefix), CountOnly: true}, &resp); err != nil {
+		return nil, err
+	}
+	store.revision = resp.Header.Revision
+
+	if changed != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		store.cancelWatch = cancel
+		store.done = make(chan struct{})
+		go store.watch(ctx)
+	}
+
+	return store, nil
+}
+
+func etcdTLSConfig(config conf.EtcdConfig, secure bool) (*tls.Config, error) {
+	if !secure && config.TLS.Root == "" && config.TLS.Cert == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if config.TLS.Root != "" {
+		data, err := ioutil.ReadFile(config.TLS.Root)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read etcd root CA, %s", err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in etcd root CA %s", config.TLS.Root)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.TLS.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(config.TLS.Cert, config.TLS.Key)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load etcd client certificate, %s", err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+func (store *EtcdJWTStore) cached(publicKey string) (string, bool) {
+	store.cacheLock.Lock()
+	defer store.cacheLock.Unlock()
+	theJWT, ok := store.cache[publicKey]
+	return theJWT, ok
+}
+
+// wrote records the result of a save or delete, so the watch doesn't report it
+func (store *EtcdJWTStore) wrote(publicKey string, theJWT string, deleted bool, revision int64) {
+	store.cacheLock.Lock()
+	defer store.cacheLock.Unlock()
+
+	if deleted {
+		delete(store.cache, publicKey)
+	} else {
+		store.cache[publicKey] = theJWT
+	}
+
+	if store.changed != nil && revision > store.revision {
+		store.own[revision] = true
+	}
+}
+
+// Load gets the key for the public key, a missing key is returned as ErrNotFound. If etcd
+// can't be reached the cached copy is returned, if there is one.
+func (store *EtcdJWTStore) Load(publicKey string) (string, error) {
+	if publicKey == "" {
+		return "", fmt.Errorf("invalid public key")
+	}
+
+	var resp etcdRangeResponse
+	if err := store.client.call("/v3/kv/range", etcdRangeRequest{Key: []byte(store.prefix + publicKey)}, &resp); err != nil {
+		if theJWT, ok := store.cached(publicKey); ok {
+			return theJWT, nil
+		}
+		return "", err
+	}
+
+	store.cacheLock.Lock()
+	defer store.cacheLock.Unlock()
+
+	if len(resp.KVs) == 0 {
+		delete(store.cache, publicKey)
+		return "", ErrNotFound
+	}
+
+	theJWT := string(resp.KVs[0].Value)
+	store.cache[publicKey] = theJWT
+	return theJWT, nil
+}
+
+// Save puts the JWT in its key
+func (store *EtcdJWTStore) Save(publicKey string, theJWT string) error {
+	if store.readonly {
+		return fmt.Errorf("store is read-only")
+	}
+
+	if publicKey == "" {
+		return fmt.Errorf("invalid public key")
+	}
+
+	store.writeLock.Lock()
+	defer store.writeLock.Unlock()
+
+	var resp etcdWriteResponse
+	if err := store.client.call("/v3/kv/put", etcdPutRequest{Key: []byte(store.prefix + publicKey), Value: []byte(theJWT)}, &resp); err != nil {
+		return err
+	}
+	store.wrote(publicKey, theJWT, false, resp.Header.Revision)
+	return nil
+}
+
+// Delete removes the key, ErrNotFound is returned if it didn't exist
+func (store *EtcdJWTStore) Delete(publicKey string) error {
+	if store.readonly {
+		return fmt.Errorf("store is read-only")
+	}
+
+	if publicKey == "" {
+		return fmt.Errorf("invalid public key")
+	}
+
+	store.writeLock.Lock()
+	defer store.writeLock.Unlock()
+
+	var resp etcdWriteResponse
+	if err := store.client.call("/v3/kv/deleterange", etcdDeleteRequest{Key: []byte(store.prefix + publicKey)}, &resp); err != nil {
+		return err
+	}
+	if resp.Deleted == 0 {
+		return ErrNotFound
+	}
+	store.wrote(publicKey, "", true, resp.Header.Revision)
+	return nil
+}
+
+// Iterate reads the keys under the prefix a page at a time, in public key order. Every page
+// is read at the revision of the first, so the JWTs are a consistent snapshot.
+func (store *EtcdJWTStore) Iterate(cb JWTIterator) error {
+	key := []byte(store.prefix)
+	end := prefixEnd(store.prefix)
+	var revision int64
+
+	for {
+		var resp etcdRangeResponse
+		if err := store.client.call("/v3/kv/range", etcdRangeRequest{Key: key, RangeEnd: end, Limit: etcdPageSize, Revision: revision}, &resp); err != nil {
+			return err
+		}
+		revision = resp.Header.Revision
+
+		for _, kv := range resp.KVs {
+			publicKey := strings.TrimPrefix(string(kv.Key), store.prefix)
+			if err := cb(publicKey, string(kv.Value)); err != nil {
+				return err
+			}
+		}
+
+		if !resp.More || len(resp.KVs) == 0 {
+			return nil
+		}
+		key = append(resp.KVs[len(resp.KVs)-1].Key, 0)
+	}
+}
+
+// Count returns the number of JWTs under the prefix, etcd can't filter a count by value so
+// the values are read to leave out tombstones
+func (store *EtcdJWTStore) Count() (int, error) {
+	count := 0
+	err := store.Iterate(func(publicKey string, theJWT string) error {
+		if !IsTombstone(theJWT) {
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// watch reads changes to the prefix until the store is closed, watching again with a backoff
+// if the stream breaks. Each watch starts after the last revision seen, so nothing is missed.
+func (store *EtcdJWTStore) watch(ctx context.Context) {
+	defer close(store.done)
+	wait := etcdRewatchWait
+
+	for {
+		err := store.readWatch(ctx)
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil && store.errored != nil {
+			store.errored(fmt.Errorf("etcd watch on %s, %s", store.prefix, err.Error()))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		if wait *= 2; wait > etcdMaxRewatchWait {
+			wait = etcdMaxRewatchWait
+		}
+	}
+}
+
+func (store *EtcdJWTStore) readWatch(ctx context.Context) error {
+	store.cacheLock.Lock()
+	start := store.revision + 1
+	store.cacheLock.Unlock()
+
+	body, err := store.client.watch(ctx, etcdWatchCreate{
+		Key:           []byte(store.prefix),
+		RangeEnd:      prefixEnd(store.prefix),
+		StartRevision: start,
+	})
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	decoder := json.NewDecoder(body)
+	for {
+		var msg etcdWatchMessage
+		if err := decoder.Decode(&msg); err != nil {
+			return err
+		}
+		if msg.Error != nil {
+			return msg.Error
+		}
+		if msg.Result == nil {
+			continue
+		}
+
+		result := msg.Result
+		if result.CompactRevision > 0 {
+			// the changes since the last revision are gone, so the cache can't be trusted
+			store.cacheLock.Lock()
+			store.cache = map[string]string{}
+			store.revision = result.CompactRevision - 1
+			store.cacheLock.Unlock()
+			return fmt.Errorf("revision %d was compacted, the cache was cleared", start)
+		}
+		if result.Canceled {
+			return fmt.Errorf("watch was canceled, %s", result.CancelReason)
+		}
+
+		for _, event := range result.Events {
+			store.applyEvent(event)
+		}
+	}
+}
+
+func (store *EtcdJWTStore) applyEvent(event etcdEvent) {
+	publicKey := strings.TrimPrefix(string(event.KV.Key), store.prefix)
+	revision := event.KV.ModRevision
+
+	store.writeLock.Lock()
+	store.cacheLock.Lock()
+	own := store.own[revision]
+	if revision > store.revision {
+		store.revision = revision
+	}
+	for r := range store.own {
+		if r <= store.revision {
+			delete(store.own, r)
+		}
+	}
+	if event.Type == "DELETE" {
+		delete(store.cache, publicKey)
+	} else {
+		store.cache[publicKey] = string(event.KV.Value)
+	}
+	store.cacheLock.Unlock()
+	store.writeLock.Unlock()
+
+	if !own {
+		store.changed(publicKey)
+	}
+}
+
+// IsReadOnly returns a flag determined at creation time
+func (store *EtcdJWTStore) IsReadOnly() bool {
+	return store.readonly
+}
+
+// Close stops the watch
+func (store *EtcdJWTStore) Close() {
+	if store.cancelWatch != nil {
+		store.cancelWatch()
+		<-store.done
+	}
+}
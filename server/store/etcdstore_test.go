@@ -0,0 +1,295 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeEtcd answers the v3 gateway requests the etcd store makes
+type fakeEtcd struct {
+	sync.Mutex
+	server   *httptest.Server
+	values   map[string]etcdKV
+	revision int64
+	token    string
+	history  []etcdEvent
+	watchers []chan etcdEvent
+}
+
+func newFakeEtcd() *fakeEtcd {
+	fake := &fakeEtcd{values: map[string]etcdKV{}, revision: 1}
+	fake.server = httptest.NewServer(http.HandlerFunc(fake.serve))
+	return fake
+}
+
+func (fake *fakeEtcd) fail(w http.ResponseWriter, status int, msg string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(etcdError{Message: msg})
+}
+
+// commit bumps the revision and sends the event to the watchers, the lock must be held
+func (fake *fakeEtcd) commit(eventType string, kv etcdKV) int64 {
+	fake.revision++
+	kv.ModRevision = fake.revision
+	event := etcdEvent{Type: eventType, KV: kv}
+	fake.history = append(fake.history, event)
+	for _, w := range fake.watchers {
+		w <- event
+	}
+	return fake.revision
+}
+
+func (fake *fakeEtcd) serve(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v3/auth/authenticate" {
+		var auth map[string]string
+		json.NewDecoder(r.Body).Decode(&auth)
+		if auth["name"] != "root" || auth["password"] != "secret" {
+			fake.fail(w, http.StatusBadRequest, "authentication failed")
+			return
+		}
+		fake.Lock()
+		fake.token = fmt.Sprintf("token-%d", fake.revision)
+		token := fake.token
+		fake.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"token": token})
+		return
+	}
+
+	fake.Lock()
+	if fake.token != "" && r.Header.Get("Authorization") != fake.token {
+		fake.Unlock()
+		fake.fail(w, http.StatusUnauthorized, "invalid auth token")
+		return
+	}
+
+	switch r.URL.Path {
+	case "/v3/kv/range":
+		var req etcdRangeRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		keys := []string{}
+		for k := range fake.values {
+			if k == string(req.Key) || (req.RangeEnd != nil && k >= string(req.Key) && k < string(req.RangeEnd)) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		resp := etcdRangeResponse{Header: etcdHeader{Revision: fake.revision}, Count: int64(len(keys))}
+		if !req.CountOnly {
+			for i, k := range keys {
+				if req.Limit > 0 && i == req.Limit {
+					resp.More = true
+					break
+				}
+				resp.KVs = append(resp.KVs, fake.values[k])
+			}
+		}
+		fake.Unlock()
+		json.NewEncoder(w).Encode(resp)
+	case "/v3/kv/put":
+		var req etcdPutRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		kv := etcdKV{Key: req.Key, Value: req.Value}
+		revision := fake.commit("", kv)
+		kv.ModRevision = revision
+		fake.values[string(req.Key)] = kv
+		fake.Unlock()
+		json.NewEncoder(w).Encode(etcdWriteResponse{Header: etcdHeader{Revision: revision}})
+	case "/v3/kv/deleterange":
+		var req etcdDeleteRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		resp := etcdWriteResponse{Header: etcdHeader{Revision: fake.revision}}
+		if _, ok := fake.values[string(req.Key)]; ok {
+			delete(fake.values, string(req.Key))
+			resp.Header.Revision = fake.commit("DELETE", etcdKV{Key: req.Key})
+			resp.Deleted = 1
+		}
+		fake.Unlock()
+		json.NewEncoder(w).Encode(resp)
+	case "/v3/watch":
+		var req etcdWatchRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		events := make(chan etcdEvent, 100)
+		for _, event := range fake.history {
+			if event.KV.ModRevision >= req.CreateRequest.StartRevision {
+				events <- event
+			}
+		}
+		fake.watchers = append(fake.watchers, events)
+		fake.Unlock()
+
+		encoder := json.NewEncoder(w)
+		encoder.Encode(etcdWatchMessage{Result: &etcdWatchResult{Created: true}})
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case event := <-events:
+				encoder.Encode(etcdWatchMessage{Result: &etcdWatchResult{Events: []etcdEvent{event}}})
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	default:
+		fake.Unlock()
+		fake.fail(w, http.StatusNotFound, "unknown path")
+	}
+}
+
+func TestEtcdStore(t *testing.T) {
+	fake := newFakeEtcd()
+	defer fake.server.Close()
+
+	_, err := NewEtcdJWTStore(conf.EtcdConfig{}, false, nil, nil)
+	require.Error(t, err)
+	_, err = NewEtcdJWTStore(conf.EtcdConfig{Endpoints: []string{"localhost:2379"}}, false, nil, nil)
+	require.Error(t, err)
+
+	// the first endpoint isn't running
+	jwtStore, err := NewEtcdJWTStore(conf.EtcdConfig{Endpoints: []string{"http://127.0.0.1:1", fake.server.URL}}, false, nil, nil)
+	require.NoError(t, err)
+	defer jwtStore.Close()
+
+	_, err = jwtStore.Load("missing")
+	require.Equal(t, ErrNotFound, err)
+	require.Equal(t, ErrNotFound, jwtStore.Delete("missing"))
+
+	page := etcdPageSize
+	etcdPageSize = 2
+	defer func() { etcdPageSize = page }()
+
+	for _, k := range []string{"two", "one", "three", "four", "five"} {
+		require.NoError(t, jwtStore.Save(k, "jwt-"+k))
+	}
+
+	got, err := jwtStore.Load("one")
+	require.NoError(t, err)
+	require.Equal(t, "jwt-one", got)
+
+	require.NoError(t, jwtStore.Delete("four"))
+
+	keys := []string{}
+	require.NoError(t, jwtStore.Iterate(func(publicKey string, theJWT string) error {
+		keys = append(keys, publicKey+"="+theJWT)
+		return nil
+	}))
+	require.Equal(t, []string{"five=jwt-five", "one=jwt-one", "three=jwt-three", "two=jwt-two"}, keys)
+
+	count, err := jwtStore.(JWTCounter).Count()
+	require.NoError(t, err)
+	require.Equal(t, 4, count)
+
+	require.NoError(t, jwtStore.Save("six", Tombstone{PubKey: "six"}.Encode()))
+	count, err = jwtStore.(JWTCounter).Count()
+	require.NoError(t, err)
+	require.Equal(t, 4, count)
+
+	fake.Lock()
+	_, ok := fake.values[defaultEtcdPrefix+"one"]
+	fake.Unlock()
+	require.True(t, ok)
+
+	readOnly, err := NewEtcdJWTStore(conf.EtcdConfig{Endpoints: []string{fake.server.URL}}, true, nil, nil)
+	require.NoError(t, err)
+	require.Error(t, readOnly.Save("one", "other"))
+	require.Error(t, readOnly.Delete("one"))
+}
+
+func TestEtcdStoreAuth(t *testing.T) {
+	fake := newFakeEtcd()
+	defer fake.server.Close()
+	fake.token = "initial"
+
+	_, err := NewEtcdJWTStore(conf.EtcdConfig{Endpoints: []string{fake.server.URL}}, false, nil, nil)
+	require.Error(t, err)
+
+	config := conf.EtcdConfig{Endpoints: []string{fake.server.URL}, Username: "root", Password: "secret"}
+	jwtStore, err := NewEtcdJWTStore(config, false, nil, nil)
+	require.NoError(t, err)
+	defer jwtStore.Close()
+	require.NoError(t, jwtStore.Save("one", "alpha"))
+
+	// an expired token is replaced
+	fake.Lock()
+	fake.token = "rotated"
+	fake.Unlock()
+	require.NoError(t, jwtStore.Save("two", "beta"))
+}
+
+func TestEtcdStoreWatch(t *testing.T) {
+	fake := newFakeEtcd()
+	defer fake.server.Close()
+
+	config := conf.EtcdConfig{Endpoints: []string{fake.server.URL}}
+	changes := make(chan string, 10)
+	watching, err := NewEtcdJWTStore(config, false, func(publicKey string) { changes <- publicKey }, nil)
+	require.NoError(t, err)
+	defer watching.Close()
+
+	other, err := NewEtcdJWTStore(config, false, nil, nil)
+	require.NoError(t, err)
+	defer other.Close()
+
+	// the watching store's own saves aren't reported
+	require.NoError(t, watching.Save("mine", "alpha"))
+	require.NoError(t, other.Save("theirs", "beta"))
+	require.NoError(t, other.Delete("mine"))
+
+	got := []string{}
+	for len(got) < 2 {
+		select {
+		case k := <-changes:
+			got = append(got, k)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("changes weren't reported, got %v", got)
+		}
+	}
+	require.Equal(t, []string{"theirs", "mine"}, got)
+
+	select {
+	case k := <-changes:
+		t.Fatalf("unexpected change for %s", k)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// the watch keeps the cache current, and it is served while etcd is down
+	fake.server.CloseClientConnections()
+	fake.server.Close()
+	got2, err := watching.Load("theirs")
+	require.NoError(t, err)
+	require.Equal(t, "beta", got2)
+
+	_, err = watching.Load("mine")
+	require.Error(t, err)
+	require.Error(t, watching.Save("new", "gamma"))
+}
+
+func TestPrefixEnd(t *testing.T) {
+	require.Equal(t, []byte("/jwt0"), prefixEnd("/jwt/"))
+	require.Equal(t, []byte("b"), prefixEnd("a\xff"))
+	require.Equal(t, []byte{0}, prefixEnd("\xff"))
+}
@@ -17,40 +17,111 @@
 package store
 
 import (
+	"container/list"
 	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
 )
 
-// MemJWTStore implements the JWT Store interface, keeping all data in memory
+// MemJWTStore implements the JWT Store interface, keeping all data in memory.
+// A store created with limits drops the least recently loaded JWTs when it is over them.
 type MemJWTStore struct {
-	jwts     map[string]string
+	sync.Mutex
+	jwts     map[string]*list.Element
+	lru      *list.List // front is the most recently loaded or saved
 	readonly bool
+
+	maxEntries int
+	maxBytes   int64
+	minAge     time.Duration
+	size       int64
+	evictions  uint64
+	evicted    JWTChanged
+
+	history map[string][]JWTVersion // kept by SaveVersion, oldest first
+}
+
+type memEntry struct {
+	publicKey string
+	jwt       string
+	saved     time.Time
+}
+
+func (e *memEntry) size() int64 {
+	return int64(len(e.publicKey) + len(e.jwt))
 }
 
 // NewMemJWTStore returns an empty, mutable in-memory JWT store
 func NewMemJWTStore() JWTStore {
-	return &MemJWTStore{
-		jwts:     map[string]string{},
-		readonly: false,
-	}
+	return newMemJWTStore(map[string]string{}, false)
 }
 
 // NewImmutableMemJWTStore returns an immutable store with the provided map
 func NewImmutableMemJWTStore(theJWTs map[string]string) JWTStore {
-	return &MemJWTStore{
-		jwts:     theJWTs,
-		readonly: true,
+	return newMemJWTStore(theJWTs, true)
+}
+
+// NewLimitedMemJWTStore returns an empty, mutable in-memory JWT store that evicts the least
+// recently loaded JWTs once it holds more than the configured entries or bytes. JWTs saved
+// less than MinAge ago aren't evicted, so the store can be over its limits until they age.
+// evicted, if set, is called with the public key of each JWT that is dropped.
+func NewLimitedMemJWTStore(config conf.MemoryConfig, evicted JWTChanged) (JWTStore, error) {
+	if config.MaxEntries < 0 || config.MaxBytes < 0 || config.MinAge < 0 {
+		return nil, fmt.Errorf("memory store limits can't be negative")
+	}
+
+	store := newMemJWTStore(map[string]string{}, false)
+	store.maxEntries = config.MaxEntries
+	store.maxBytes = config.MaxBytes
+	store.minAge = time.Duration(config.MinAge) * time.Second
+	store.evicted = evicted
+	return store, nil
+}
+
+func newMemJWTStore(theJWTs map[string]string, readonly bool) *MemJWTStore {
+	store := &MemJWTStore{
+		jwts:     map[string]*list.Element{},
+		lru:      list.New(),
+		readonly: readonly,
+		history:  map[string][]JWTVersion{},
 	}
+
+	for k, v := range theJWTs {
+		store.add(k, v, time.Time{})
+	}
+	return store
+}
+
+// add puts a new entry at the front, the lock should be held
+func (store *MemJWTStore) add(publicKey string, theJWT string, saved time.Time) {
+	entry := &memEntry{publicKey: publicKey, jwt: theJWT, saved: saved}
+	store.jwts[publicKey] = store.lru.PushFront(entry)
+	store.size += entry.size()
+}
+
+// remove drops an entry, the lock should be held
+func (store *MemJWTStore) remove(elem *list.Element) *memEntry {
+	entry := store.lru.Remove(elem).(*memEntry)
+	delete(store.jwts, entry.publicKey)
+	store.size -= entry.size()
+	return entry
 }
 
 // Load checks the memory store and returns the matching JWT or an error
 func (store *MemJWTStore) Load(publicKey string) (string, error) {
-	theJWT, ok := store.jwts[publicKey]
+	store.Lock()
+	defer store.Unlock()
 
-	if ok {
-		return theJWT, nil
+	elem, ok := store.jwts[publicKey]
+	if !ok {
+		return "", ErrNotFound
 	}
 
-	return "", fmt.Errorf("no matching JWT found")
+	store.lru.MoveToFront(elem)
+	return elem.Value.(*memEntry).jwt, nil
 }
 
 // Save puts the JWT in a map by public key, no checks are performed
@@ -58,10 +129,156 @@ func (store *MemJWTStore) Save(publicKey string, theJWT string) error {
 	if store.readonly {
 		return fmt.Errorf("store is read-only")
 	}
-	store.jwts[publicKey] = theJWT
+
+	store.Lock()
+	if elem, ok := store.jwts[publicKey]; ok {
+		store.remove(elem)
+	}
+	store.add(publicKey, theJWT, time.Now())
+	evicted := store.evict()
+	store.Unlock()
+
+	if store.evicted != nil {
+		for _, key := range evicted {
+			store.evicted(key)
+		}
+	}
 	return nil
 }
 
+// evict drops the least recently loaded entries, that are old enough, until the store is
+// under its limits, the lock should be held
+func (store *MemJWTStore) evict() []string {
+	if store.maxEntries == 0 && store.maxBytes == 0 {
+		return nil
+	}
+
+	over := func() bool {
+		return (store.maxEntries > 0 && len(store.jwts) > store.maxEntries) ||
+			(store.maxBytes > 0 && store.size > store.maxBytes)
+	}
+
+	var evicted []string
+	now := time.Now()
+	elem := store.lru.Back()
+	for elem != nil && over() {
+		prev := elem.Prev()
+		entry := elem.Value.(*memEntry)
+		if store.minAge == 0 || now.Sub(entry.saved) >= store.minAge {
+			store.remove(elem)
+			store.evictions++
+			evicted = append(evicted, entry.publicKey)
+		}
+		elem = prev
+	}
+	return evicted
+}
+
+// Delete removes the JWT for the public key, an error is returned if it isn't in the store
+func (store *MemJWTStore) Delete(publicKey string) error {
+	if store.readonly {
+		return fmt.Errorf("store is read-only")
+	}
+
+	store.Lock()
+	defer store.Unlock()
+
+	elem, ok := store.jwts[publicKey]
+	if !ok {
+		return ErrNotFound
+	}
+	store.remove(elem)
+	return nil
+}
+
+// Iterate calls cb for each JWT in the store, in public key order, without changing which
+// JWTs were loaded most recently
+func (store *MemJWTStore) Iterate(cb JWTIterator) error {
+	store.Lock()
+	entries := make([]memEntry, 0, len(store.jwts))
+	for _, elem := range store.jwts {
+		entries = append(entries, *elem.Value.(*memEntry))
+	}
+	store.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].publicKey < entries[j].publicKey
+	})
+
+	for _, entry := range entries {
+		store.Lock()
+		_, ok := store.jwts[entry.publicKey]
+		store.Unlock()
+		if !ok {
+			continue
+		}
+		if err := cb(entry.publicKey, entry.jwt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveVersion keeps a copy of theJWT, versions don't count towards the store's limits
+func (store *MemJWTStore) SaveVersion(publicKey string, id string, theJWT string, keep int) error {
+	if store.readonly {
+		return fmt.Errorf("store is read-only")
+	}
+
+	if !ValidVersionID(id) {
+		return fmt.Errorf("invalid version id %q", id)
+	}
+
+	store.Lock()
+	defer store.Unlock()
+
+	versions := []JWTVersion{}
+	for _, v := range store.history[publicKey] {
+		if v.ID != id {
+			versions = append(versions, v)
+		}
+	}
+	versions = append(versions, JWTVersion{ID: id, JWT: theJWT})
+
+	if keep >= 0 && len(versions) > keep {
+		versions = versions[len(versions)-keep:]
+	}
+
+	if len(versions) == 0 {
+		delete(store.history, publicKey)
+	} else {
+		store.history[publicKey] = versions
+	}
+	return nil
+}
+
+// Versions returns the copies kept for the public key, oldest first
+func (store *MemJWTStore) Versions(publicKey string) ([]JWTVersion, error) {
+	store.Lock()
+	defer store.Unlock()
+	return append([]JWTVersion{}, store.history[publicKey]...), nil
+}
+
+// Count returns the number of JWTs in the store
+func (store *MemJWTStore) Count() (int, error) {
+	store.Lock()
+	defer store.Unlock()
+	count := 0
+	for _, elem := range store.jwts {
+		if !IsTombstone(elem.Value.(*memEntry).jwt) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Evictions returns the number of JWTs dropped because the store was over its limits
+func (store *MemJWTStore) Evictions() uint64 {
+	store.Lock()
+	defer store.Unlock()
+	return store.evictions
+}
+
 // IsReadOnly returns a flag determined at creation time
 func (store *MemJWTStore) IsReadOnly() bool {
 	return store.readonly
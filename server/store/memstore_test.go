@@ -17,8 +17,11 @@
 package store
 
 import (
+	"fmt"
+	"sync"
 	"testing"
 
+	"github.com/nats-io/nats-account-server/server/conf"
 	"github.com/stretchr/testify/require"
 )
 
@@ -68,3 +71,191 @@ func TestMemStoreReadOnly(t *testing.T) {
 		require.Equal(t, v, got)
 	}
 }
+
+func TestMemStoreDelete(t *testing.T) {
+	store := NewMemJWTStore()
+
+	err := store.Save("one", "alpha")
+	require.NoError(t, err)
+
+	err = store.Delete("one")
+	require.NoError(t, err)
+
+	_, err = store.Load("one")
+	require.Equal(t, ErrNotFound, err)
+
+	err = store.Delete("one")
+	require.Error(t, err)
+
+	roStore := NewImmutableMemJWTStore(map[string]string{"one": "alpha"})
+	err = roStore.Delete("one")
+	require.Error(t, err)
+}
+
+func TestMemStoreIterate(t *testing.T) {
+	store := NewMemJWTStore()
+	require.NoError(t, store.Save("two", "beta"))
+	require.NoError(t, store.Save("one", "alpha"))
+	require.NoError(t, store.Save("three", "gamma"))
+
+	keys := []string{}
+	err := store.Iterate(func(publicKey string, theJWT string) error {
+		keys = append(keys, publicKey+"="+theJWT)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"one=alpha", "three=gamma", "two=beta"}, keys)
+
+	count := 0
+	err = store.Iterate(func(publicKey string, theJWT string) error {
+		count++
+		return fmt.Errorf("stop")
+	})
+	require.Error(t, err)
+	require.Equal(t, 1, count)
+}
+
+func TestMemStoreEvictsLeastRecentlyLoaded(t *testing.T) {
+	evicted := []string{}
+	store, err := NewLimitedMemJWTStore(conf.MemoryConfig{MaxEntries: 2}, func(publicKey string) {
+		evicted = append(evicted, publicKey)
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, store.Save("one", "alpha"))
+	require.NoError(t, store.Save("two", "beta"))
+
+	// loading one makes two the oldest
+	_, err = store.Load("one")
+	require.NoError(t, err)
+	require.NoError(t, store.Save("three", "gamma"))
+	require.Equal(t, []string{"two"}, evicted)
+
+	_, err = store.Load("two")
+	require.Equal(t, ErrNotFound, err)
+	count, err := store.(JWTCounter).Count()
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+
+	// replacing a JWT doesn't evict anything
+	require.NoError(t, store.Save("one", "omega"))
+	require.Equal(t, []string{"two"}, evicted)
+
+	// iterating doesn't count as loading
+	require.NoError(t, store.Iterate(func(publicKey string, theJWT string) error { return nil }))
+	require.NoError(t, store.Save("four", "delta"))
+	require.Equal(t, []string{"two", "three"}, evicted)
+	require.Equal(t, uint64(2), store.(JWTEvictionCounter).Evictions())
+
+	_, err = NewLimitedMemJWTStore(conf.MemoryConfig{MaxEntries: -1}, nil)
+	require.Error(t, err)
+}
+
+func TestMemStoreMaxBytes(t *testing.T) {
+	store, err := NewLimitedMemJWTStore(conf.MemoryConfig{MaxBytes: 20}, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, store.Save("one", "alpha"))  // 8 bytes
+	require.NoError(t, store.Save("two", "beta"))   // 7 bytes
+	require.NoError(t, store.Save("three", "zeta")) // 9 bytes
+
+	_, err = store.Load("one")
+	require.Equal(t, ErrNotFound, err)
+	_, err = store.Load("two")
+	require.NoError(t, err)
+
+	// a JWT bigger than the limit doesn't stay
+	require.NoError(t, store.Save("big", "0123456789012345678901234567890"))
+	count, err := store.(JWTCounter).Count()
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+}
+
+func TestMemStoreMinAge(t *testing.T) {
+	store, err := NewLimitedMemJWTStore(conf.MemoryConfig{MaxEntries: 1, MinAge: 60}, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, store.Save("one", "alpha"))
+	require.NoError(t, store.Save("two", "beta"))
+
+	// both are too new to evict
+	count, err := store.(JWTCounter).Count()
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+	require.Equal(t, uint64(0), store.(JWTEvictionCounter).Evictions())
+
+	// once they age the store shrinks on the next save
+	mem := store.(*MemJWTStore)
+	mem.Lock()
+	for _, elem := range mem.jwts {
+		elem.Value.(*memEntry).saved = elem.Value.(*memEntry).saved.Add(-2 * mem.minAge)
+	}
+	mem.Unlock()
+
+	require.NoError(t, store.Save("three", "gamma"))
+	count, err = store.(JWTCounter).Count()
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+	got, err := store.Load("three")
+	require.NoError(t, err)
+	require.Equal(t, "gamma", got)
+}
+
+func TestMemStoreConcurrentAccess(t *testing.T) {
+	store, err := NewLimitedMemJWTStore(conf.MemoryConfig{MaxEntries: 50, MaxBytes: 1000}, func(publicKey string) {})
+	require.NoError(t, err)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				key := fmt.Sprintf("key%d", (i*31+j)%100)
+				switch j % 4 {
+				case 0:
+					store.Save(key, fmt.Sprintf("jwt%d", j))
+				case 1:
+					store.Delete(key)
+				case 2:
+					store.Iterate(func(publicKey string, theJWT string) error { return nil })
+				default:
+					store.Load(key)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	mem := store.(*MemJWTStore)
+	mem.Lock()
+	defer mem.Unlock()
+	require.True(t, len(mem.jwts) <= 50)
+	require.True(t, mem.size <= 1000)
+	require.Equal(t, len(mem.jwts), mem.lru.Len())
+}
+
+func TestMemStoreHistory(t *testing.T) {
+	store := NewMemJWTStore().(*MemJWTStore)
+
+	require.NoError(t, store.SaveVersion("one", "A", "alpha", 2))
+	require.NoError(t, store.SaveVersion("one", "B", "beta", 2))
+	require.NoError(t, store.SaveVersion("one", "A", "alpha", 2))
+	require.NoError(t, store.SaveVersion("one", "C", "gamma", 2))
+	require.Error(t, store.SaveVersion("one", "../D", "delta", 2))
+
+	versions, err := store.Versions("one")
+	require.NoError(t, err)
+	require.Equal(t, []JWTVersion{{ID: "A", JWT: "alpha"}, {ID: "C", JWT: "gamma"}}, versions)
+
+	versions, err = store.Versions("two")
+	require.NoError(t, err)
+	require.Empty(t, versions)
+
+	// versions aren't JWTs in the store
+	_, err = store.Load("one")
+	require.Equal(t, ErrNotFound, err)
+
+	readonly := NewImmutableMemJWTStore(map[string]string{}).(*MemJWTStore)
+	require.Error(t, readonly.SaveVersion("one", "A", "alpha", 2))
+}
@@ -19,6 +19,7 @@ package store
 import (
 	"fmt"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 
@@ -177,7 +178,7 @@ func (store *NSCJWTStore) Load(publicKey string) (string, error) {
 		}
 	}
 
-	return "", fmt.Errorf("no matching JWT found")
+	return "", ErrNotFound
 }
 
 // Save puts the JWT in a map by public key, no checks are performed
@@ -185,6 +186,55 @@ func (store *NSCJWTStore) Save(publicKey string, theJWT string) error {
 	return fmt.Errorf("store is read-only")
 }
 
+// Delete is not supported, the NSC store is read-only
+func (store *NSCJWTStore) Delete(publicKey string) error {
+	return fmt.Errorf("store is read-only")
+}
+
+// Iterate calls cb for each account JWT in the NSC folder, in public key order
+func (store *NSCJWTStore) Iterate(cb JWTIterator) error {
+	store.Lock()
+	infos, err := store.nsc.List(nsc.Accounts)
+	if err != nil {
+		store.Unlock()
+		return err
+	}
+
+	jwts := map[string]string{}
+	for _, i := range infos {
+		if !i.IsDir() {
+			continue
+		}
+		data, err := store.nsc.Read(nsc.Accounts, i.Name(), nsc.JwtName(i.Name()))
+		if err != nil {
+			store.Unlock()
+			return err
+		}
+		c, err := store.nsc.LoadClaim(nsc.Accounts, i.Name(), nsc.JwtName(i.Name()))
+		if err != nil {
+			store.Unlock()
+			return err
+		}
+		if c != nil {
+			jwts[c.Subject] = string(data)
+		}
+	}
+	store.Unlock()
+
+	keys := make([]string, 0, len(jwts))
+	for k := range jwts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if err := cb(k, jwts[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // IsReadOnly returns a flag determined at creation time
 func (store *NSCJWTStore) IsReadOnly() bool {
 	return true
@@ -116,6 +116,17 @@ func TestValidNSCStore(t *testing.T) {
 	err = store.Save("five", "onetwothree")
 	require.Error(t, err)
 
+	err = store.Delete(c.Subject)
+	require.Error(t, err)
+
+	packed := map[string]string{}
+	err = store.Iterate(func(publicKey string, theJWT string) error {
+		packed[publicKey] = theJWT
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{c.Subject: cd}, packed)
+
 	store.Close()
 }
 
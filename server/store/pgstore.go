@@ -0,0 +1,200 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+
+	// registers the postgres driver with database/sql
+	_ "github.com/lib/pq"
+)
+
+const defaultPostgresTable = "jwts"
+
+// the table name is put into the queries directly, so it is limited to a plain identifier
+var postgresTableName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// PostgresJWTStore implements the JWT Store interface, keeping one row per JWT in a Postgres table
+type PostgresJWTStore struct {
+	db       *sql.DB
+	table    string
+	readonly bool
+}
+
+// NewPostgresJWTStore connects to the database in the config and creates the table if it
+// doesn't exist, read-only stores expect the table to be there already
+func NewPostgresJWTStore(config conf.PostgresConfig, readonly bool) (JWTStore, error) {
+	if config.DSN == "" {
+		return nil, fmt.Errorf("postgres store requires a DSN")
+	}
+
+	table := config.Table
+	if table == "" {
+		table = defaultPostgresTable
+	}
+
+	if !postgresTableName.MatchString(table) {
+		return nil, fmt.Errorf("bad postgres table name %q", table)
+	}
+
+	if config.MaxOpenConns < 0 || config.MaxIdleConns < 0 || config.ConnMaxLifetime < 0 {
+		return nil, fmt.Errorf("postgres pool settings can't be negative")
+	}
+
+	db, err := sql.Open("postgres", config.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open postgres store, %s", err.Error())
+	}
+
+	db.SetMaxOpenConns(config.MaxOpenConns)
+	if config.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(config.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(time.Duration(config.ConnMaxLifetime) * time.Second)
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to connect to postgres store, %s", err.Error())
+	}
+
+	store := &PostgresJWTStore{
+		db:       db,
+		table:    table,
+		readonly: readonly,
+	}
+
+	if !readonly {
+		if err := store.migrate(); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	return store, nil
+}
+
+func (store *PostgresJWTStore) migrate() error {
+	_, err := store.db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		pubkey TEXT PRIMARY KEY,
+		jwt TEXT NOT NULL,
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`, store.table))
+	if err != nil {
+		return fmt.Errorf("unable to create postgres table %s, %s", store.table, err.Error())
+	}
+	return nil
+}
+
+// Load selects the JWT for the public key, a missing row is returned as ErrNotFound
+func (store *PostgresJWTStore) Load(publicKey string) (string, error) {
+	if publicKey == "" {
+		return "", fmt.Errorf("invalid public key")
+	}
+
+	var theJWT string
+	err := store.db.QueryRow(fmt.Sprintf("SELECT jwt FROM %s WHERE pubkey = $1", store.table), publicKey).Scan(&theJWT)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return theJWT, nil
+}
+
+// Save inserts the JWT, or replaces the one already stored for the public key
+func (store *PostgresJWTStore) Save(publicKey string, theJWT string) error {
+	if store.readonly {
+		return fmt.Errorf("store is read-only")
+	}
+
+	if publicKey == "" {
+		return fmt.Errorf("invalid public key")
+	}
+
+	_, err := store.db.Exec(fmt.Sprintf(`INSERT INTO %s (pubkey, jwt, updated_at) VALUES ($1, $2, now())
+		ON CONFLICT (pubkey) DO UPDATE SET jwt = EXCLUDED.jwt, updated_at = EXCLUDED.updated_at`, store.table),
+		publicKey, theJWT)
+	return err
+}
+
+// Delete removes the row for the public key, ErrNotFound is returned if there isn't one
+func (store *PostgresJWTStore) Delete(publicKey string) error {
+	if store.readonly {
+		return fmt.Errorf("store is read-only")
+	}
+
+	if publicKey == "" {
+		return fmt.Errorf("invalid public key")
+	}
+
+	result, err := store.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE pubkey = $1", store.table), publicKey)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Iterate passes every JWT to cb in public key order
+func (store *PostgresJWTStore) Iterate(cb JWTIterator) error {
+	rows, err := store.db.Query(fmt.Sprintf("SELECT pubkey, jwt FROM %s ORDER BY pubkey", store.table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var publicKey, theJWT string
+		if err := rows.Scan(&publicKey, &theJWT); err != nil {
+			return err
+		}
+		if err := cb(publicKey, theJWT); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Count returns the number of rows holding a JWT, rather than a tombstone, without reading them
+func (store *PostgresJWTStore) Count() (int, error) {
+	count := 0
+	err := store.db.QueryRow(fmt.Sprintf("SELECT count(*) FROM %s WHERE jwt NOT LIKE $1", store.table), tombstonePrefix+"%").Scan(&count)
+	return count, err
+}
+
+// IsReadOnly returns a flag determined at creation time
+func (store *PostgresJWTStore) IsReadOnly() bool {
+	return store.readonly
+}
+
+// Close closes the connection pool
+func (store *PostgresJWTStore) Close() {
+	store.db.Close()
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package store
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+// the database tests need a server, set this to a DSN to run them
+const postgresTestDSN = "NATS_ACCOUNT_SERVER_POSTGRES_DSN"
+
+func createTestPostgresStore(t *testing.T) (*PostgresJWTStore, func()) {
+	dsn := os.Getenv(postgresTestDSN)
+	if dsn == "" {
+		t.Skipf("%s is not set", postgresTestDSN)
+	}
+
+	table := fmt.Sprintf("jwts_test_%d", time.Now().UnixNano())
+	s, err := NewPostgresJWTStore(conf.PostgresConfig{DSN: dsn, Table: table, MaxOpenConns: 2}, false)
+	require.NoError(t, err)
+
+	store := s.(*PostgresJWTStore)
+	return store, func() {
+		store.db.Exec(fmt.Sprintf("DROP TABLE %s", table))
+		store.Close()
+	}
+}
+
+func TestPostgresStoreSaveLoadDelete(t *testing.T) {
+	store, cleanup := createTestPostgresStore(t)
+	defer cleanup()
+
+	_, err := store.Load("one")
+	require.Equal(t, ErrNotFound, err)
+
+	require.NoError(t, store.Save("one", "alpha"))
+	require.NoError(t, store.Save("one", "beta"))
+
+	theJWT, err := store.Load("one")
+	require.NoError(t, err)
+	require.Equal(t, "beta", theJWT)
+
+	count, err := store.Count()
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+
+	require.NoError(t, store.Delete("one"))
+	require.Equal(t, ErrNotFound, store.Delete("one"))
+
+	_, err = store.Load("one")
+	require.Equal(t, ErrNotFound, err)
+}
+
+func TestPostgresStoreIterate(t *testing.T) {
+	store, cleanup := createTestPostgresStore(t)
+	defer cleanup()
+
+	require.NoError(t, store.Save("c", "3"))
+	require.NoError(t, store.Save("a", "1"))
+	require.NoError(t, store.Save("b", "2"))
+
+	keys := []string{}
+	err := store.Iterate(func(publicKey string, theJWT string) error {
+		keys = append(keys, publicKey+theJWT)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a1", "b2", "c3"}, keys)
+}
+
+func TestPostgresStoreReadOnly(t *testing.T) {
+	store, cleanup := createTestPostgresStore(t)
+	defer cleanup()
+
+	require.NoError(t, store.Save("one", "alpha"))
+
+	s, err := NewPostgresJWTStore(conf.PostgresConfig{DSN: os.Getenv(postgresTestDSN), Table: store.table}, true)
+	require.NoError(t, err)
+	defer s.Close()
+
+	require.True(t, s.IsReadOnly())
+	require.Error(t, s.Save("two", "beta"))
+	require.Error(t, s.Delete("one"))
+
+	theJWT, err := s.Load("one")
+	require.NoError(t, err)
+	require.Equal(t, "alpha", theJWT)
+}
+
+func TestPostgresStoreConfig(t *testing.T) {
+	_, err := NewPostgresJWTStore(conf.PostgresConfig{}, false)
+	require.Error(t, err)
+
+	_, err = NewPostgresJWTStore(conf.PostgresConfig{DSN: "postgres://localhost/jwts", Table: "jwts; DROP TABLE jwts"}, false)
+	require.Error(t, err)
+
+	_, err = NewPostgresJWTStore(conf.PostgresConfig{DSN: "postgres://localhost/jwts", MaxOpenConns: -1}, false)
+	require.Error(t, err)
+
+	// nothing listens on port 1, so the ping fails and is returned rather than panicking
+	_, err = NewPostgresJWTStore(conf.PostgresConfig{DSN: "postgres://localhost:1/jwts?sslmode=disable&connect_timeout=2"}, false)
+	require.Error(t, err)
+}
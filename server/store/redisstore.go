@@ -0,0 +1,376 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package store
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+)
+
+const (
+	defaultRedisPrefix = "jwt:"
+	redisScanCount     = "100"
+
+	redisResubscribeWait    = time.Second
+	redisMaxResubscribeWait = 30 * time.Second
+)
+
+// RedisJWTStore implements the JWT Store interface, keeping each JWT in a Redis string key.
+// With a channel configured, saves and deletes are published so other account servers
+// sharing the keys can drop what they have cached.
+type RedisJWTStore struct {
+	client   *redisClient
+	dial     redisDialer
+	prefix   string
+	ttl      int
+	channel  string
+	origin   string // sent with invalidations, so the store can skip its own
+	readonly bool
+
+	changed JWTChanged
+	errored JWTError
+
+	subLock sync.Mutex
+	subConn *redisConn
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewRedisJWTStore connects to the Redis server in the config. If the config has a channel
+// changed is called with the public key of each JWT another store saves or deletes, and
+// errored with problems reading the channel.
+func NewRedisJWTStore(config conf.RedisConfig, readonly bool, changed JWTChanged, errored JWTError) (JWTStore, error) {
+	if config.Address == "" {
+		return nil, fmt.Errorf("redis store requires an address")
+	}
+
+	if config.TTL < 0 || config.DB < 0 {
+		return nil, fmt.Errorf("redis TTL and DB can't be negative")
+	}
+
+	tlsConfig, err := redisTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := config.Prefix
+	if prefix == "" {
+		prefix = defaultRedisPrefix
+	}
+
+	origin := make([]byte, 8)
+	if _, err := rand.Read(origin); err != nil {
+		return nil, err
+	}
+
+	dial := newRedisDialer(config.Address, config.Password, config.DB, tlsConfig)
+	store := &RedisJWTStore{
+		client:   newRedisClient(dial),
+		dial:     dial,
+		prefix:   prefix,
+		ttl:      config.TTL,
+		channel:  config.Channel,
+		origin:   hex.EncodeToString(origin),
+		readonly: readonly,
+		changed:  changed,
+		errored:  errored,
+	}
+
+	if _, err := store.client.do("PING"); err != nil {
+		store.client.close()
+		return nil, fmt.Errorf("unable to connect to redis store, %s", err.Error())
+	}
+
+	if store.channel != "" {
+		store.stop = make(chan struct{})
+		store.done = make(chan struct{})
+		go store.subscribe()
+	}
+
+	return store, nil
+}
+
+func redisTLSConfig(config conf.RedisConfig) (*tls.Config, error) {
+	if !config.UseTLS && config.TLS.Root == "" && config.TLS.Cert == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if host, _, err := net.SplitHostPort(config.Address); err == nil {
+		tlsConfig.ServerName = host
+	}
+
+	if config.TLS.Root != "" {
+		data, err := ioutil.ReadFile(config.TLS.Root)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read redis root CA, %s", err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in redis root CA %s", config.TLS.Root)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.TLS.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(config.TLS.Cert, config.TLS.Key)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load redis client certificate, %s", err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// escapeRedisPattern quotes the glob characters in s for SCAN MATCH
+func escapeRedisPattern(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]\`, c) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// Load gets the key for the public key, a missing key is returned as ErrNotFound
+func (store *RedisJWTStore) Load(publicKey string) (string, error) {
+	if publicKey == "" {
+		return "", fmt.Errorf("invalid public key")
+	}
+
+	reply, err := store.client.do("GET", store.prefix+publicKey)
+	if err != nil {
+		return "", err
+	}
+
+	theJWT, ok := reply.(string)
+	if !ok {
+		return "", ErrNotFound
+	}
+	return theJWT, nil
+}
+
+// Save sets the key, with the TTL if there is one, and publishes an invalidation
+func (store *RedisJWTStore) Save(publicKey string, theJWT string) error {
+	if store.readonly {
+		return fmt.Errorf("store is read-only")
+	}
+
+	if publicKey == "" {
+		return fmt.Errorf("invalid public key")
+	}
+
+	args := []string{"SET", store.prefix + publicKey, theJWT}
+	if store.ttl > 0 {
+		args = append(args, "EX", strconv.Itoa(store.ttl))
+	}
+
+	if _, err := store.client.do(args...); err != nil {
+		return err
+	}
+	return store.publish(publicKey)
+}
+
+// Delete removes the key, a missing key isn't an error
+func (store *RedisJWTStore) Delete(publicKey string) error {
+	if store.readonly {
+		return fmt.Errorf("store is read-only")
+	}
+
+	if publicKey == "" {
+		return fmt.Errorf("invalid public key")
+	}
+
+	if _, err := store.client.do("DEL", store.prefix+publicKey); err != nil {
+		return err
+	}
+	return store.publish(publicKey)
+}
+
+func (store *RedisJWTStore) publish(publicKey string) error {
+	if store.channel == "" {
+		return nil
+	}
+	_, err := store.client.do("PUBLISH", store.channel, store.origin+" "+publicKey)
+	return err
+}
+
+// Iterate scans for the keys under the prefix, then passes the JWTs to cb in public key order.
+// Only the keys are collected up front, each JWT is read as it is passed to cb.
+func (store *RedisJWTStore) Iterate(cb JWTIterator) error {
+	pattern := escapeRedisPattern(store.prefix) + "*"
+	seen := map[string]bool{}
+	cursor := "0"
+
+	for {
+		reply, err := store.client.do("SCAN", cursor, "MATCH", pattern, "COUNT", redisScanCount)
+		if err != nil {
+			return err
+		}
+
+		page, ok := reply.([]interface{})
+		if !ok || len(page) != 2 {
+			return fmt.Errorf("redis: unexpected SCAN reply")
+		}
+
+		next, ok := page[0].(string)
+		keys, keysOK := page[1].([]interface{})
+		if !ok || !keysOK {
+			return fmt.Errorf("redis: unexpected SCAN reply")
+		}
+
+		// SCAN can return a key more than once
+		for _, k := range keys {
+			if key, ok := k.(string); ok {
+				seen[strings.TrimPrefix(key, store.prefix)] = true
+			}
+		}
+
+		if next == "0" {
+			break
+		}
+		cursor = next
+	}
+
+	publicKeys := make([]string, 0, len(seen))
+	for k := range seen {
+		publicKeys = append(publicKeys, k)
+	}
+	sort.Strings(publicKeys)
+
+	for _, publicKey := range publicKeys {
+		theJWT, err := store.Load(publicKey)
+		if err == ErrNotFound {
+			continue // expired or removed since the scan
+		}
+		if err != nil {
+			return err
+		}
+		if err := cb(publicKey, theJWT); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// subscribe reads invalidations from the channel until the store is closed, reconnecting
+// with a backoff if the connection is lost
+func (store *RedisJWTStore) subscribe() {
+	defer close(store.done)
+	wait := redisResubscribeWait
+
+	for {
+		err := store.readInvalidations()
+
+		select {
+		case <-store.stop:
+			return
+		default:
+		}
+
+		if err != nil && store.errored != nil {
+			store.errored(fmt.Errorf("redis invalidation channel %s, %s", store.channel, err.Error()))
+		}
+
+		select {
+		case <-store.stop:
+			return
+		case <-time.After(wait):
+		}
+
+		if wait *= 2; wait > redisMaxResubscribeWait {
+			wait = redisMaxResubscribeWait
+		}
+	}
+}
+
+func (store *RedisJWTStore) readInvalidations() error {
+	rc, err := store.dial()
+	if err != nil {
+		return err
+	}
+	defer rc.close()
+
+	store.subLock.Lock()
+	select {
+	case <-store.stop:
+		store.subLock.Unlock()
+		return nil
+	default:
+	}
+	store.subConn = rc
+	store.subLock.Unlock()
+
+	if _, err := rc.do(redisTimeout, "SUBSCRIBE", store.channel); err != nil {
+		return err
+	}
+
+	for {
+		reply, err := rc.receive(0)
+		if err != nil {
+			return err
+		}
+
+		// messages are [message, channel, payload]
+		msg, ok := reply.([]interface{})
+		if !ok || len(msg) != 3 || msg[0] != "message" {
+			continue
+		}
+
+		payload, _ := msg[2].(string)
+		fields := strings.SplitN(payload, " ", 2)
+		if len(fields) != 2 || fields[0] == store.origin || store.changed == nil {
+			continue
+		}
+		store.changed(fields[1])
+	}
+}
+
+// IsReadOnly returns a flag determined at creation time
+func (store *RedisJWTStore) IsReadOnly() bool {
+	return store.readonly
+}
+
+// Close stops reading invalidations and closes the connections
+func (store *RedisJWTStore) Close() {
+	if store.stop != nil {
+		store.subLock.Lock()
+		close(store.stop)
+		if store.subConn != nil {
+			store.subConn.close()
+		}
+		store.subLock.Unlock()
+		<-store.done
+	}
+	store.client.close()
+}
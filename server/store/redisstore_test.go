@@ -0,0 +1,361 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package store
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRedis answers the handful of commands the redis store uses
+type fakeRedis struct {
+	sync.Mutex
+	listener    net.Listener
+	password    string
+	values      map[string]string
+	ttls        map[string]string
+	conns       map[net.Conn]bool
+	subscribers map[string][]*bufio.Writer
+}
+
+func newFakeRedis(t *testing.T, address string) *fakeRedis {
+	listener, err := net.Listen("tcp", address)
+	require.NoError(t, err)
+
+	fake := &fakeRedis{
+		listener:    listener,
+		values:      map[string]string{},
+		ttls:        map[string]string{},
+		conns:       map[net.Conn]bool{},
+		subscribers: map[string][]*bufio.Writer{},
+	}
+	go fake.accept()
+	return fake
+}
+
+func (fake *fakeRedis) address() string {
+	return fake.listener.Addr().String()
+}
+
+func (fake *fakeRedis) accept() {
+	for {
+		conn, err := fake.listener.Accept()
+		if err != nil {
+			return
+		}
+		fake.Lock()
+		fake.conns[conn] = true
+		fake.Unlock()
+		go fake.serve(conn)
+	}
+}
+
+// close stops the listener and drops every connection
+func (fake *fakeRedis) close() {
+	fake.listener.Close()
+	fake.Lock()
+	defer fake.Unlock()
+	for conn := range fake.conns {
+		conn.Close()
+	}
+}
+
+func (fake *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	// the password can be set after the listener is started
+	fake.Lock()
+	password := fake.password
+	fake.Unlock()
+	authed := password == ""
+
+	for {
+		reply, err := readRESPReply(r)
+		if err != nil {
+			return
+		}
+		parts, _ := reply.([]interface{})
+		args := []string{}
+		for _, p := range parts {
+			args = append(args, p.(string))
+		}
+		if len(args) == 0 {
+			return
+		}
+
+		fake.Lock()
+		cmd := strings.ToUpper(args[0])
+		switch {
+		case cmd == "AUTH":
+			authed = args[1] == password
+			if authed {
+				w.WriteString("+OK\r\n")
+			} else {
+				w.WriteString("-WRONGPASS invalid password\r\n")
+			}
+		case !authed:
+			w.WriteString("-NOAUTH Authentication required.\r\n")
+		case cmd == "PING":
+			w.WriteString("+PONG\r\n")
+		case cmd == "SELECT":
+			w.WriteString("+OK\r\n")
+		case cmd == "GET":
+			if v, ok := fake.values[args[1]]; ok {
+				fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+			} else {
+				w.WriteString("$-1\r\n")
+			}
+		case cmd == "SET":
+			fake.values[args[1]] = args[2]
+			delete(fake.ttls, args[1])
+			if len(args) == 5 && args[3] == "EX" {
+				fake.ttls[args[1]] = args[4]
+			}
+			w.WriteString("+OK\r\n")
+		case cmd == "DEL":
+			_, ok := fake.values[args[1]]
+			delete(fake.values, args[1])
+			if ok {
+				w.WriteString(":1\r\n")
+			} else {
+				w.WriteString(":0\r\n")
+			}
+		case cmd == "SCAN":
+			// one key per page, so the cursor is followed
+			prefix := strings.Replace(strings.TrimSuffix(args[3], "*"), `\`, "", -1)
+			keys := []string{}
+			for k := range fake.values {
+				if strings.HasPrefix(k, prefix) {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+			cursor := 0
+			fmt.Sscanf(args[1], "%d", &cursor)
+			next := "0"
+			page := []string{}
+			if cursor < len(keys) {
+				page = append(page, keys[cursor])
+				if cursor+1 < len(keys) {
+					next = fmt.Sprintf("%d", cursor+1)
+				}
+			}
+			fmt.Fprintf(w, "*2\r\n$%d\r\n%s\r\n*%d\r\n", len(next), next, len(page))
+			for _, k := range page {
+				fmt.Fprintf(w, "$%d\r\n%s\r\n", len(k), k)
+			}
+		case cmd == "PUBLISH":
+			subs := fake.subscribers[args[1]]
+			for _, sub := range subs {
+				writeRESPCommand(sub, "message", args[1], args[2])
+				sub.Flush()
+			}
+			fmt.Fprintf(w, ":%d\r\n", len(subs))
+		case cmd == "SUBSCRIBE":
+			fake.subscribers[args[1]] = append(fake.subscribers[args[1]], w)
+			writeRESPCommand(w, "subscribe", args[1])
+		default:
+			fmt.Fprintf(w, "-ERR unknown command '%s'\r\n", args[0])
+		}
+		w.Flush()
+		fake.Unlock()
+	}
+}
+
+func (fake *fakeRedis) subscriberCount(channel string) int {
+	fake.Lock()
+	defer fake.Unlock()
+	return len(fake.subscribers[channel])
+}
+
+func TestRedisStore(t *testing.T) {
+	fake := newFakeRedis(t, "127.0.0.1:0")
+	defer fake.close()
+
+	jwtStore, err := NewRedisJWTStore(conf.RedisConfig{Address: fake.address(), TTL: 60}, false, nil, nil)
+	require.NoError(t, err)
+	defer jwtStore.Close()
+	require.False(t, jwtStore.IsReadOnly())
+
+	_, err = jwtStore.Load("two")
+	require.Equal(t, ErrNotFound, err)
+
+	require.NoError(t, jwtStore.Save("two", "eytwo"))
+	require.NoError(t, jwtStore.Save("one", "eyone"))
+	require.NoError(t, jwtStore.Save("three", "eythree"))
+
+	fake.Lock()
+	require.Equal(t, "eytwo", fake.values["jwt:two"])
+	require.Equal(t, "60", fake.ttls["jwt:two"])
+	fake.values["other:four"] = "not ours"
+	fake.Unlock()
+
+	theJWT, err := jwtStore.Load("one")
+	require.NoError(t, err)
+	require.Equal(t, "eyone", theJWT)
+
+	require.NoError(t, jwtStore.Delete("three"))
+	require.NoError(t, jwtStore.Delete("three"))
+	_, err = jwtStore.Load("three")
+	require.Equal(t, ErrNotFound, err)
+
+	keys := []string{}
+	require.NoError(t, jwtStore.Iterate(func(publicKey string, theJWT string) error {
+		keys = append(keys, publicKey)
+		require.Equal(t, "ey"+publicKey, theJWT)
+		return nil
+	}))
+	require.Equal(t, []string{"one", "two"}, keys)
+
+	_, err = jwtStore.Load("")
+	require.Error(t, err)
+	require.Error(t, jwtStore.Save("", "ey"))
+
+	readOnly, err := NewRedisJWTStore(conf.RedisConfig{Address: fake.address()}, true, nil, nil)
+	require.NoError(t, err)
+	defer readOnly.Close()
+	require.True(t, readOnly.IsReadOnly())
+	require.Error(t, readOnly.Save("one", "eyone"))
+	require.Error(t, readOnly.Delete("one"))
+
+	theJWT, err = readOnly.Load("one")
+	require.NoError(t, err)
+	require.Equal(t, "eyone", theJWT)
+}
+
+func TestRedisStoreConfig(t *testing.T) {
+	fake := newFakeRedis(t, "127.0.0.1:0")
+	defer fake.close()
+	fake.Lock()
+	fake.password = "secret"
+	fake.Unlock()
+
+	_, err := NewRedisJWTStore(conf.RedisConfig{}, false, nil, nil)
+	require.Error(t, err)
+
+	_, err = NewRedisJWTStore(conf.RedisConfig{Address: fake.address(), TTL: -1}, false, nil, nil)
+	require.Error(t, err)
+
+	_, err = NewRedisJWTStore(conf.RedisConfig{Address: fake.address()}, false, nil, nil)
+	require.Error(t, err)
+
+	_, err = NewRedisJWTStore(conf.RedisConfig{Address: fake.address(), Password: "wrong"}, false, nil, nil)
+	require.Error(t, err)
+
+	_, err = NewRedisJWTStore(conf.RedisConfig{Address: fake.address(), TLS: conf.TLSConf{Root: "missing.pem"}}, false, nil, nil)
+	require.Error(t, err)
+
+	jwtStore, err := NewRedisJWTStore(conf.RedisConfig{Address: fake.address(), Password: "secret", DB: 2, Prefix: "my*jwts:"}, false, nil, nil)
+	require.NoError(t, err)
+	defer jwtStore.Close()
+
+	require.NoError(t, jwtStore.Save("one", "eyone"))
+	fake.Lock()
+	require.Equal(t, "eyone", fake.values["my*jwts:one"])
+	fake.Unlock()
+
+	count := 0
+	require.NoError(t, jwtStore.Iterate(func(publicKey string, theJWT string) error {
+		count++
+		return nil
+	}))
+	require.Equal(t, 1, count)
+}
+
+func TestRedisStoreInvalidation(t *testing.T) {
+	fake := newFakeRedis(t, "127.0.0.1:0")
+	defer fake.close()
+
+	config := conf.RedisConfig{Address: fake.address(), Channel: "jwt-changes"}
+
+	aChanged := make(chan string, 10)
+	a, err := NewRedisJWTStore(config, false, func(publicKey string) { aChanged <- publicKey }, nil)
+	require.NoError(t, err)
+	defer a.Close()
+
+	bChanged := make(chan string, 10)
+	b, err := NewRedisJWTStore(config, false, func(publicKey string) { bChanged <- publicKey }, nil)
+	require.NoError(t, err)
+	defer b.Close()
+
+	for i := 0; i < 50 && fake.subscriberCount("jwt-changes") < 2; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	require.Equal(t, 2, fake.subscriberCount("jwt-changes"))
+
+	require.NoError(t, a.Save("one", "eyone"))
+	require.NoError(t, a.Delete("two"))
+
+	for _, expected := range []string{"one", "two"} {
+		select {
+		case publicKey := <-bChanged:
+			require.Equal(t, expected, publicKey)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no invalidation for %s", expected)
+		}
+	}
+
+	// a store skips its own invalidations
+	select {
+	case publicKey := <-aChanged:
+		t.Fatalf("unexpected invalidation for %s", publicKey)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRedisStoreConnectionLoss(t *testing.T) {
+	fake := newFakeRedis(t, "127.0.0.1:0")
+	address := fake.address()
+
+	errors := make(chan error, 10)
+	jwtStore, err := NewRedisJWTStore(conf.RedisConfig{Address: address, Channel: "jwt-changes"}, false, nil, func(err error) { errors <- err })
+	require.NoError(t, err)
+	defer jwtStore.Close()
+
+	require.NoError(t, jwtStore.Save("one", "eyone"))
+
+	fake.close()
+
+	_, err = jwtStore.Load("one")
+	require.Error(t, err)
+	require.Error(t, jwtStore.Save("two", "eytwo"))
+
+	select {
+	case <-errors:
+	case <-time.After(2 * time.Second):
+		t.Fatal("lost subscription wasn't reported")
+	}
+
+	// the next command dials again
+	fake = newFakeRedis(t, address)
+	defer fake.close()
+
+	require.NoError(t, jwtStore.Save("two", "eytwo"))
+	theJWT, err := jwtStore.Load("two")
+	require.NoError(t, err)
+	require.Equal(t, "eytwo", theJWT)
+}
@@ -0,0 +1,278 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package store
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	redisTimeout  = 5 * time.Second
+	redisMaxIdle  = 4
+	redisMaxReply = 16 * 1024 * 1024 // bulk replies larger than this are treated as a protocol error
+)
+
+// redisError is an error reply from the server, the connection is still usable after one
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+var errRedisClosed = errors.New("redis client is closed")
+
+// redisConn is a connection speaking RESP, the Redis protocol
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// redisDialer opens, and authenticates, a new connection
+type redisDialer func() (*redisConn, error)
+
+// newRedisDialer returns a dialer for the address, tlsConfig is nil for plain TCP
+func newRedisDialer(address string, password string, db int, tlsConfig *tls.Config) redisDialer {
+	return func() (*redisConn, error) {
+		dialer := &net.Dialer{Timeout: redisTimeout}
+
+		var conn net.Conn
+		var err error
+		if tlsConfig != nil {
+			conn, err = tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+		} else {
+			conn, err = dialer.Dial("tcp", address)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		rc := &redisConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+
+		if password != "" {
+			if _, err := rc.do(redisTimeout, "AUTH", password); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+
+		if db != 0 {
+			if _, err := rc.do(redisTimeout, "SELECT", strconv.Itoa(db)); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+
+		return rc, nil
+	}
+}
+
+// do sends one command and reads the reply, a timeout of 0 waits forever
+func (rc *redisConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	if err := rc.send(timeout, args...); err != nil {
+		return nil, err
+	}
+	return rc.receive(timeout)
+}
+
+func (rc *redisConn) send(timeout time.Duration, args ...string) error {
+	if timeout > 0 {
+		rc.conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	if err := writeRESPCommand(rc.w, args...); err != nil {
+		return err
+	}
+	return rc.w.Flush()
+}
+
+func (rc *redisConn) receive(timeout time.Duration) (interface{}, error) {
+	if timeout > 0 {
+		rc.conn.SetReadDeadline(time.Now().Add(timeout))
+	} else {
+		rc.conn.SetReadDeadline(time.Time{})
+	}
+	return readRESPReply(rc.r)
+}
+
+func (rc *redisConn) close() {
+	rc.conn.Close()
+}
+
+// writeRESPCommand writes a command as an array of bulk strings
+func writeRESPCommand(w io.Writer, args ...string) error {
+	if _, err := fmt.Fprintf(w, "*%d\r\n", len(args)); err != nil {
+		return err
+	}
+	for _, arg := range args {
+		if _, err := fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readRESPReply reads one reply. Simple and bulk strings are returned as strings, integers
+// as int64, arrays as []interface{} and a nil bulk string or array as nil. Error replies
+// are returned as a redisError.
+func readRESPReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readRESPLine(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) == 0 {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad integer reply %q", line)
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < -1 || n > redisMaxReply {
+			return nil, fmt.Errorf("redis: bad bulk length %q", line)
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		if data[n] != '\r' || data[n+1] != '\n' {
+			return nil, fmt.Errorf("redis: bulk string isn't terminated")
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < -1 {
+			return nil, fmt.Errorf("redis: bad array length %q", line)
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		values := make([]interface{}, 0, n)
+		for i := 0; i < n; i++ {
+			v, err := readRESPReply(r)
+			if err != nil {
+				if _, ok := err.(redisError); !ok {
+					return nil, err
+				}
+				v = err
+			}
+			values = append(values, v)
+		}
+		return values, nil
+	}
+
+	return nil, fmt.Errorf("redis: unknown reply type %q", line[0])
+}
+
+func readRESPLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("redis: line isn't terminated")
+	}
+	return line[:len(line)-2], nil
+}
+
+// redisClient keeps a few idle connections. A connection with a network or protocol error
+// is closed and the next command dials again, so losing the server turns into errors on the
+// commands sent while it is down rather than a broken store.
+type redisClient struct {
+	sync.Mutex
+	dial   redisDialer
+	idle   []*redisConn
+	closed bool
+}
+
+func newRedisClient(dial redisDialer) *redisClient {
+	return &redisClient{dial: dial}
+}
+
+func (client *redisClient) get() (*redisConn, error) {
+	client.Lock()
+	if client.closed {
+		client.Unlock()
+		return nil, errRedisClosed
+	}
+	if n := len(client.idle); n > 0 {
+		rc := client.idle[n-1]
+		client.idle = client.idle[:n-1]
+		client.Unlock()
+		return rc, nil
+	}
+	client.Unlock()
+	return client.dial()
+}
+
+func (client *redisClient) put(rc *redisConn) {
+	client.Lock()
+	defer client.Unlock()
+	if client.closed || len(client.idle) >= redisMaxIdle {
+		rc.close()
+		return
+	}
+	client.idle = append(client.idle, rc)
+}
+
+// do runs a command on an idle connection, or a new one
+func (client *redisClient) do(args ...string) (interface{}, error) {
+	rc, err := client.get()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := rc.do(redisTimeout, args...)
+	if err != nil {
+		if _, ok := err.(redisError); !ok {
+			rc.close()
+			return nil, err
+		}
+	}
+	client.put(rc)
+	return reply, err
+}
+
+func (client *redisClient) close() {
+	client.Lock()
+	defer client.Unlock()
+	client.closed = true
+	for _, rc := range client.idle {
+		rc.close()
+	}
+	client.idle = nil
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteRESPCommand(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, writeRESPCommand(&buf, "SET", "key", ""))
+	require.Equal(t, "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$0\r\n\r\n", buf.String())
+}
+
+func TestReadRESPReply(t *testing.T) {
+	read := func(s string) (interface{}, error) {
+		return readRESPReply(bufio.NewReader(bytes.NewBufferString(s)))
+	}
+
+	v, err := read("+OK\r\n")
+	require.NoError(t, err)
+	require.Equal(t, "OK", v)
+
+	v, err = read(":42\r\n")
+	require.NoError(t, err)
+	require.Equal(t, int64(42), v)
+
+	v, err = read("$5\r\nhello\r\n")
+	require.NoError(t, err)
+	require.Equal(t, "hello", v)
+
+	v, err = read("$-1\r\n")
+	require.NoError(t, err)
+	require.Nil(t, v)
+
+	v, err = read("*2\r\n$1\r\na\r\n*1\r\n:1\r\n")
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{"a", []interface{}{int64(1)}}, v)
+
+	_, err = read("-ERR wrong\r\n")
+	require.Equal(t, redisError("ERR wrong"), err)
+
+	// an error inside an array doesn't stop the reply being read
+	v, err = read("*2\r\n-ERR one\r\n+two\r\n")
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{redisError("ERR one"), "two"}, v)
+
+	for _, bad := range []string{"", "+OK\n", "?x\r\n", ":x\r\n", "$3\r\nab\r\n", "$2\r\nabcd", "$-2\r\n", "*x\r\n"} {
+		_, err = read(bad)
+		require.Error(t, err, bad)
+	}
+}
@@ -0,0 +1,312 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package store
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+)
+
+const (
+	s3Timeout    = 10 * time.Second
+	s3MaxRetries = 3
+	s3RetryWait  = 100 * time.Millisecond // doubled on each retry
+)
+
+// S3JWTStore implements the JWT Store interface, keeping one object per JWT in an S3 bucket
+type S3JWTStore struct {
+	endpoint  *url.URL
+	bucket    string
+	prefix    string
+	pathStyle bool
+	readonly  bool
+	creds     s3Credentials
+	client    *http.Client
+	retryWait time.Duration
+}
+
+// NewS3JWTStore returns a store for the bucket in the config, credentials that aren't in the
+// config are read from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+func NewS3JWTStore(config conf.S3Config, readonly bool) (JWTStore, error) {
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("S3 store requires a bucket")
+	}
+
+	creds := s3Credentials{
+		region:       firstNonEmpty(config.Region, os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1"),
+		accessKey:    firstNonEmpty(config.AccessKey, os.Getenv("AWS_ACCESS_KEY_ID")),
+		secretKey:    firstNonEmpty(config.SecretKey, os.Getenv("AWS_SECRET_ACCESS_KEY")),
+		sessionToken: firstNonEmpty(config.SessionToken, os.Getenv("AWS_SESSION_TOKEN")),
+	}
+
+	if creds.accessKey == "" || creds.secretKey == "" {
+		return nil, fmt.Errorf("S3 store requires an access key and secret key")
+	}
+
+	endpoint := config.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", creds.region)
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("bad S3 endpoint %q", endpoint)
+	}
+
+	prefix := config.Prefix
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix = prefix + "/"
+	}
+
+	return &S3JWTStore{
+		endpoint:  u,
+		bucket:    config.Bucket,
+		prefix:    prefix,
+		pathStyle: config.PathStyle,
+		readonly:  readonly,
+		creds:     creds,
+		client:    &http.Client{Timeout: s3Timeout},
+		retryWait: s3RetryWait,
+	}, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// objectURL returns the URL for an object key, or the bucket if key is empty
+func (store *S3JWTStore) objectURL(key string, query url.Values) *url.URL {
+	u := *store.endpoint
+	path := strings.TrimSuffix(u.Path, "/")
+
+	if store.pathStyle {
+		path = path + "/" + store.bucket
+	} else {
+		u.Host = store.bucket + "." + u.Host
+	}
+
+	u.Path = path + "/" + key
+	u.RawQuery = query.Encode()
+	return &u
+}
+
+// do sends a signed request, retrying with backoff on network errors, throttling and 5xx responses
+func (store *S3JWTStore) do(method string, key string, query url.Values, body []byte) (*http.Response, error) {
+	wait := store.retryWait
+	var lastErr error
+
+	for attempt := 0; attempt <= s3MaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(wait)
+			wait *= 2
+		}
+
+		req, err := http.NewRequest(method, store.objectURL(key, query).String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		signV4(req, body, store.creds, time.Now())
+
+		resp, err := store.client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			lastErr = s3Error(resp)
+			continue
+		}
+
+		return resp, nil
+	}
+
+	return nil, lastErr
+}
+
+// s3Error reads the error code from an S3 error response and closes the body
+func s3Error(resp *http.Response) error {
+	defer resp.Body.Close()
+	var s3err struct {
+		Code    string
+		Message string
+	}
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if xml.Unmarshal(data, &s3err) == nil && s3err.Code != "" {
+		return fmt.Errorf("S3 returned status %d, %s: %s", resp.StatusCode, s3err.Code, s3err.Message)
+	}
+	return fmt.Errorf("S3 returned status %d", resp.StatusCode)
+}
+
+// Load gets the object for the public key, NoSuchKey is returned as ErrNotFound
+func (store *S3JWTStore) Load(publicKey string) (string, error) {
+	if publicKey == "" {
+		return "", fmt.Errorf("invalid public key")
+	}
+
+	resp, err := store.do(http.MethodGet, store.prefix+publicKey+"."+extension, nil, nil)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return "", ErrNotFound
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", s3Error(resp)
+	}
+
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// Save puts a whole object, so readers see either the old or the new JWT
+func (store *S3JWTStore) Save(publicKey string, theJWT string) error {
+	if store.readonly {
+		return fmt.Errorf("store is read-only")
+	}
+
+	if publicKey == "" {
+		return fmt.Errorf("invalid public key")
+	}
+
+	resp, err := store.do(http.MethodPut, store.prefix+publicKey+"."+extension, nil, []byte(theJWT))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Delete removes the object for the public key, S3 doesn't report missing objects
+func (store *S3JWTStore) Delete(publicKey string) error {
+	if store.readonly {
+		return fmt.Errorf("store is read-only")
+	}
+
+	if publicKey == "" {
+		return fmt.Errorf("invalid public key")
+	}
+
+	resp, err := store.do(http.MethodDelete, store.prefix+publicKey+"."+extension, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return s3Error(resp)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type s3ListResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key string
+	}
+}
+
+// Iterate lists the bucket a page at a time, S3 lists keys in order so the JWTs are
+// passed to cb in public key order
+func (store *S3JWTStore) Iterate(cb JWTIterator) error {
+	token := ""
+
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", store.prefix)
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := store.do(http.MethodGet, "", query, nil)
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			return s3Error(resp)
+		}
+
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, object := range result.Contents {
+			name := strings.TrimPrefix(object.Key, store.prefix)
+			if strings.Contains(name, "/") || !strings.HasSuffix(name, "."+extension) {
+				continue
+			}
+
+			publicKey := strings.TrimSuffix(name, "."+extension)
+			theJWT, err := store.Load(publicKey)
+			if err == ErrNotFound {
+				continue // removed since the list
+			}
+			if err != nil {
+				return err
+			}
+			if err := cb(publicKey, theJWT); err != nil {
+				return err
+			}
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// IsReadOnly returns a flag determined at creation time
+func (store *S3JWTStore) IsReadOnly() bool {
+	return store.readonly
+}
+
+// Close is a no-op for an S3 store
+func (store *S3JWTStore) Close() {
+}
@@ -0,0 +1,225 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package store
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nats-io/nats-account-server/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeS3 is a path style, in memory bucket
+type fakeS3 struct {
+	sync.Mutex
+	bucket   string
+	objects  map[string]string
+	failures int // requests to fail with a 503 before answering
+	pageSize int
+	requests int
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	f.requests++
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/") {
+		http.Error(w, "<Error><Code>AccessDenied</Code></Error>", http.StatusForbidden)
+		return
+	}
+
+	if f.failures > 0 {
+		f.failures--
+		http.Error(w, "<Error><Code>SlowDown</Code><Message>Please reduce your request rate.</Message></Error>", http.StatusServiceUnavailable)
+		return
+	}
+
+	bucketPath := "/" + f.bucket + "/"
+	if !strings.HasPrefix(r.URL.Path, bucketPath) {
+		http.Error(w, "<Error><Code>NoSuchBucket</Code></Error>", http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, bucketPath)
+
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		f.list(w, r)
+	case r.Method == http.MethodGet:
+		data, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(data))
+	case r.Method == http.MethodPut:
+		data, _ := ioutil.ReadAll(r.Body)
+		f.objects[key] = string(data)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	start, _ := strconv.Atoi(r.URL.Query().Get("continuation-token"))
+
+	keys := []string{}
+	for k := range f.objects {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	result := s3ListResult{}
+	end := start + f.pageSize
+	if end < len(keys) {
+		result.IsTruncated = true
+		result.NextContinuationToken = fmt.Sprintf("%d", end)
+	} else {
+		end = len(keys)
+	}
+	for _, k := range keys[start:end] {
+		result.Contents = append(result.Contents, struct{ Key string }{k})
+	}
+
+	data, _ := xml.Marshal(result)
+	w.Write(data)
+}
+
+func newTestS3Store(t *testing.T, readonly bool) (JWTStore, *fakeS3, func()) {
+	fake := &fakeS3{bucket: "jwts", objects: map[string]string{}, pageSize: 2}
+	server := httptest.NewServer(fake)
+
+	store, err := NewS3JWTStore(conf.S3Config{
+		Bucket:    "jwts",
+		Prefix:    "accounts",
+		Endpoint:  server.URL,
+		PathStyle: true,
+		AccessKey: "access",
+		SecretKey: "secret",
+	}, readonly)
+	require.NoError(t, err)
+	store.(*S3JWTStore).retryWait = 0
+
+	return store, fake, server.Close
+}
+
+func TestS3StoreSaveLoadDelete(t *testing.T) {
+	store, fake, done := newTestS3Store(t, false)
+	defer done()
+	defer store.Close()
+
+	require.False(t, store.IsReadOnly())
+
+	_, err := store.Load("one")
+	require.Equal(t, ErrNotFound, err)
+
+	require.NoError(t, store.Save("one", "alpha"))
+	require.Equal(t, "alpha", fake.objects["accounts/one.jwt"])
+
+	got, err := store.Load("one")
+	require.NoError(t, err)
+	require.Equal(t, "alpha", got)
+
+	require.NoError(t, store.Save("one", "beta"))
+	got, err = store.Load("one")
+	require.NoError(t, err)
+	require.Equal(t, "beta", got)
+
+	require.NoError(t, store.Delete("one"))
+	_, err = store.Load("one")
+	require.Equal(t, ErrNotFound, err)
+
+	_, err = store.Load("")
+	require.Error(t, err)
+}
+
+func TestS3StoreIterate(t *testing.T) {
+	store, fake, done := newTestS3Store(t, false)
+	defer done()
+
+	require.NoError(t, store.Save("two", "beta"))
+	require.NoError(t, store.Save("one", "alpha"))
+	require.NoError(t, store.Save("three", "gamma"))
+	fake.objects["other/four.jwt"] = "delta"
+	fake.objects["accounts/notes.txt"] = "hello"
+
+	keys := []string{}
+	err := store.Iterate(func(publicKey string, theJWT string) error {
+		keys = append(keys, publicKey+"="+theJWT)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"one=alpha", "three=gamma", "two=beta"}, keys)
+}
+
+func TestS3StoreRetries(t *testing.T) {
+	store, fake, done := newTestS3Store(t, false)
+	defer done()
+
+	fake.failures = s3MaxRetries
+	require.NoError(t, store.Save("one", "alpha"))
+	require.Equal(t, s3MaxRetries+1, fake.requests)
+
+	fake.failures = s3MaxRetries + 1
+	_, err := store.Load("one")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "SlowDown")
+}
+
+func TestS3StoreReadOnly(t *testing.T) {
+	store, fake, done := newTestS3Store(t, true)
+	defer done()
+
+	fake.objects["accounts/one.jwt"] = "alpha"
+
+	require.True(t, store.IsReadOnly())
+	require.Error(t, store.Save("one", "beta"))
+	require.Error(t, store.Delete("one"))
+
+	got, err := store.Load("one")
+	require.NoError(t, err)
+	require.Equal(t, "alpha", got)
+}
+
+func TestS3StoreConfig(t *testing.T) {
+	_, err := NewS3JWTStore(conf.S3Config{}, false)
+	require.Error(t, err)
+
+	_, err = NewS3JWTStore(conf.S3Config{Bucket: "b", AccessKey: "a", SecretKey: "s", Endpoint: "::"}, false)
+	require.Error(t, err)
+
+	store, err := NewS3JWTStore(conf.S3Config{Bucket: "b", Region: "eu-west-1", AccessKey: "a", SecretKey: "s"}, false)
+	require.NoError(t, err)
+	s3 := store.(*S3JWTStore)
+	require.Equal(t, "https://b.s3.eu-west-1.amazonaws.com/one.jwt", s3.objectURL("one.jwt", nil).String())
+
+	s3.pathStyle = true
+	require.Equal(t, "https://s3.eu-west-1.amazonaws.com/b/one.jwt", s3.objectURL("one.jwt", nil).String())
+}
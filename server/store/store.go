@@ -16,12 +16,73 @@
 
 package store
 
+import (
+	"errors"
+)
+
+// ErrNotFound is returned by stores when there is no JWT for a public key
+var ErrNotFound = errors.New("no matching JWT found")
+
+// JWTIterator is called for each JWT in a store, returning an error stops the iteration
+type JWTIterator func(publicKey string, theJWT string) error
+
+// JWTCounter can be implemented by stores that count JWTs without reading them all, tombstones aren't counted
+type JWTCounter interface {
+	Count() (int, error)
+}
+
+// JWTEvictionCounter can be implemented by stores that drop JWTs to stay under a size limit
+type JWTEvictionCounter interface {
+	Evictions() uint64
+}
+
+// JWTKeyLister can be implemented by stores that list their keys without reading the JWTs, so
+// each one can be loaded, and fail, on its own
+type JWTKeyLister interface {
+	Keys() ([]string, error)
+}
+
+// JWTQuarantiner can be implemented by stores that can move a corrupt JWT aside, instead of deleting it
+type JWTQuarantiner interface {
+	Quarantine(publicKey string) error
+}
+
+// JWTVersion is an old copy of a JWT kept by a JWTHistory store, ID is the JWT's ID
+type JWTVersion struct {
+	ID  string
+	JWT string
+}
+
+// JWTHistory can be implemented by stores that keep old versions of JWTs, so one can be restored
+type JWTHistory interface {
+	// SaveVersion keeps a copy of theJWT under id, replacing a copy with the same id. The oldest
+	// copies are removed so at most keep are left.
+	SaveVersion(publicKey string, id string, theJWT string, keep int) error
+	// Versions returns the copies kept for the public key, oldest first
+	Versions(publicKey string) ([]JWTVersion, error)
+}
+
+// ValidVersionID returns true for IDs that can be used with SaveVersion, JWT IDs are base32
+func ValidVersionID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'A' && c <= 'Z') && !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
 // JWTStore is the interface for all store implementations in the account server
 // The store provides a handful of methods for setting and getting a JWT.
 // The data doesn't really have to be a JWT, no validation is expected at this level
 type JWTStore interface {
 	Load(publicKey string) (string, error)
 	Save(publicKey string, theJWT string) error
+	Delete(publicKey string) error
+	Iterate(cb JWTIterator) error
 	IsReadOnly() bool
 	Close()
 }
@@ -0,0 +1,60 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// ErrDeleted is returned for a public key whose JWT was deleted and replaced by a tombstone
+var ErrDeleted = errors.New("JWT was deleted")
+
+// tombstones are saved in place of the JWT, JWTs never start with the prefix
+const tombstonePrefix = "NAS-TOMBSTONE\n"
+
+// Tombstone records that an account, or an activation, was deliberately deleted, it is saved in place of the
+// JWT so stores don't need to know about it
+type Tombstone struct {
+	PubKey    string `json:"pubkey"`
+	DeletedAt int64  `json:"deleted_at"`
+	DeletedBy string `json:"deleted_by,omitempty"`
+}
+
+// Encode returns the tombstone as it is saved in a store
+func (tombstone Tombstone) Encode() string {
+	data, _ := json.Marshal(tombstone)
+	return tombstonePrefix + string(data)
+}
+
+// IsTombstone is true if the data loaded from a store is a tombstone rather than a JWT
+func IsTombstone(data string) bool {
+	return strings.HasPrefix(data, tombstonePrefix)
+}
+
+// DecodeTombstone parses a tombstone loaded from a store, false is returned if the data isn't one
+func DecodeTombstone(data string) (Tombstone, bool) {
+	var tombstone Tombstone
+	if !IsTombstone(data) {
+		return tombstone, false
+	}
+	if err := json.Unmarshal([]byte(data[len(tombstonePrefix):]), &tombstone); err != nil {
+		return tombstone, false
+	}
+	return tombstone, true
+}
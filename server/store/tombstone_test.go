@@ -0,0 +1,54 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTombstone(t *testing.T) {
+	tombstone := Tombstone{PubKey: "ABC", DeletedAt: 100, DeletedBy: "OP"}
+	encoded := tombstone.Encode()
+	require.True(t, IsTombstone(encoded))
+
+	decoded, ok := DecodeTombstone(encoded)
+	require.True(t, ok)
+	require.Equal(t, tombstone, decoded)
+
+	require.False(t, IsTombstone("eyJ0eXAiOiJqd3QifQ"))
+	_, ok = DecodeTombstone("eyJ0eXAiOiJqd3QifQ")
+	require.False(t, ok)
+	_, ok = DecodeTombstone(tombstonePrefix + "{")
+	require.False(t, ok)
+
+	// tombstones round trip through a store like any other value
+	jwtStore := NewMemJWTStore()
+	require.NoError(t, jwtStore.Save("ABC", encoded))
+	loaded, err := jwtStore.Load("ABC")
+	require.NoError(t, err)
+	decoded, ok = DecodeTombstone(loaded)
+	require.True(t, ok)
+	require.Equal(t, tombstone, decoded)
+
+	// but they aren't counted as JWTs
+	require.NoError(t, jwtStore.Save("DEF", "eyJ0eXAiOiJqd3QifQ"))
+	count, err := jwtStore.(JWTCounter).Count()
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+}